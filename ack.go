@@ -0,0 +1,65 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import "github.com/hibiken/asynq/internal/base"
+
+// AckMode specifies when a task is acknowledged, which determines whether
+// the task may be processed more than once or may be lost.
+type AckMode int
+
+const (
+	// AtLeastOnce acknowledges the task after it's processed. If the worker
+	// crashes while processing the task, the task is processed again, so
+	// its handler should be idempotent. This is the default.
+	AtLeastOnce AckMode = iota
+
+	// AtMostOnce acknowledges the task before it's processed, for tasks
+	// with side effects for which duplicates are worse than loss (e.g.
+	// charging a credit card). If the worker crashes while processing
+	// the task, the task is lost. A task which fails is not retried but
+	// sent to the dead queue.
+	//
+	// Backgrounds created with NewBackgroundWithBroker cannot acknowledge
+	// tasks before processing them, and process them at least once.
+	AtMostOnce
+)
+
+// String returns the string representation of the ack mode.
+func (m AckMode) String() string {
+	switch m {
+	case AtLeastOnce:
+		return "at-least-once"
+	case AtMostOnce:
+		return "at-most-once"
+	}
+	return "unknown"
+}
+
+// ackStore is implemented by brokers which can remove a task from
+// the in-progress queue before it's processed.
+type ackStore interface {
+	Ack(msg *base.TaskMessage) error
+}
+
+// ackedEarly reports whether the task is acknowledged before it's processed.
+func (p *processor) ackedEarly(msg *base.TaskMessage) bool {
+	return msg.AtMostOnce && p.acks != nil
+}
+
+// ack acknowledges the task before it's processed if it should be processed
+// at most once, and reports whether the task can be processed. A task which
+// cannot be acknowledged is pushed back to its queue.
+func (p *processor) ack(msg *base.TaskMessage) bool {
+	if !p.ackedEarly(msg) {
+		return true
+	}
+	if err := p.acks.Ack(msg); err != nil {
+		p.logger.error("Could not acknowledge task id=%s: %v; Pushing task back to queue", msg.ID, err)
+		p.requeue(msg)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// earlyAckBroker records the calls to acknowledge and complete the tasks.
+type earlyAckBroker struct {
+	base.Broker
+
+	mu     sync.Mutex
+	events []string
+	ackErr error
+}
+
+func (b *earlyAckBroker) record(event string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events = append(b.events, event)
+}
+
+func (b *earlyAckBroker) Ack(msg *base.TaskMessage) error {
+	if b.ackErr != nil {
+		return b.ackErr
+	}
+	b.record("ack")
+	return nil
+}
+
+func (b *earlyAckBroker) Done(msg *base.TaskMessage) error {
+	b.record("done")
+	return nil
+}
+
+func (b *earlyAckBroker) Requeue(msg *base.TaskMessage) error {
+	b.record("requeue")
+	return nil
+}
+
+func (b *earlyAckBroker) RetryInQueue(msg *base.TaskMessage, qname string, processAt time.Time, errMsg string) error {
+	b.record("retry")
+	return nil
+}
+
+func (b *earlyAckBroker) Kill(msg *base.TaskMessage, errMsg string) error {
+	b.record("kill")
+	return nil
+}
+
+func TestProcessorAckModes(t *testing.T) {
+	errFailed := errors.New("payment gateway timed out")
+	tests := []struct {
+		desc       string
+		atMostOnce bool
+		handlerErr error
+		ackErr     error
+		want       []string
+	}{
+		{"at most once", true, nil, nil, []string{"ack", "process", "done"}},
+		{"at most once failed", true, errFailed, nil, []string{"ack", "process", "kill"}},
+		{"at most once not acknowledged", true, nil, errors.New("NOSCRIPT"), []string{"requeue"}},
+		{"at least once", false, nil, nil, []string{"process", "done"}},
+		{"at least once failed", false, errFailed, nil, []string{"process", "retry"}},
+	}
+
+	for _, tc := range tests {
+		b := &earlyAckBroker{ackErr: tc.ackErr}
+		workerCh := make(chan int)
+		go fakeHeartbeater(workerCh)
+		p := newProcessor(processorParams{
+			logger:         testLogger,
+			rdb:            b,
+			queues:         defaultQueueConfig,
+			concurrency:    1,
+			retryDelayFunc: defaultDelayFunc,
+			workerCh:       workerCh,
+			cancelations:   base.NewCancelations(),
+		})
+		p.handler = HandlerFunc(func(ctx context.Context, task *Task) error {
+			b.record("process")
+			return tc.handlerErr
+		})
+		msg := h.NewTaskMessage("charge_card", nil)
+		msg.AtMostOnce = tc.atMostOnce
+
+		p.dispatch(msg)
+		// wait for the worker to finish.
+		p.sema <- struct{}{}
+		<-p.sema
+
+		b.mu.Lock()
+		if diff := cmp.Diff(tc.want, b.events); diff != "" {
+			t.Errorf("%s: broker received %v, want %v; (-want,+got)\n%s", tc.desc, b.events, tc.want, diff)
+		}
+		b.mu.Unlock()
+		close(workerCh)
+	}
+}
+
+func TestProcessorAtMostOnceWithoutAckStore(t *testing.T) {
+	b := &ackBroker{}
+	workerCh := make(chan int)
+	go fakeHeartbeater(workerCh)
+	defer close(workerCh)
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            b,
+		queues:         defaultQueueConfig,
+		concurrency:    1,
+		retryDelayFunc: defaultDelayFunc,
+		workerCh:       workerCh,
+		cancelations:   base.NewCancelations(),
+	})
+	if p.acks != nil {
+		t.Fatalf("processor acknowledges tasks early with a broker which cannot")
+	}
+	processed := make(chan struct{}, 1)
+	p.handler = HandlerFunc(func(ctx context.Context, task *Task) error {
+		processed <- struct{}{}
+		return nil
+	})
+	msg := h.NewTaskMessage("charge_card", nil)
+	msg.AtMostOnce = true
+
+	p.dispatch(msg)
+	select {
+	case <-processed:
+	case <-time.After(time.Second):
+		t.Fatalf("task was not processed")
+	}
+	// wait for the worker to finish.
+	p.sema <- struct{}{}
+	<-p.sema
+}
+
+func TestClientAckModes(t *testing.T) {
+	b := &recordingBroker{}
+	client := &Client{rdb: sharedBroker{b}, ackModes: map[string]AckMode{"charge_card": AtMostOnce}}
+
+	tests := []struct {
+		task *Task
+		opts []Option
+		want bool
+	}{
+		{NewTask("charge_card", nil), nil, true},
+		{NewTask("charge_card", nil), []Option{Ack(AtLeastOnce)}, false},
+		{NewTask("send_email", nil), nil, false},
+		{NewTask("send_email", nil), []Option{Ack(AtMostOnce)}, true},
+	}
+
+	for _, tc := range tests {
+		b.enqueued = nil
+		if _, err := client.Schedule(tc.task, time.Now(), tc.opts...); err != nil {
+			t.Fatalf("Schedule returned error: %v", err)
+		}
+		if len(b.enqueued) != 1 {
+			t.Fatalf("broker received %d tasks, want 1", len(b.enqueued))
+		}
+		if got := b.enqueued[0].AtMostOnce; got != tc.want {
+			t.Errorf("Schedule(%q, %v) enqueued task with AtMostOnce=%t, want %t", tc.task.Type, tc.opts, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+// Package asynqtest provides helpers for the tests of applications using
+// asynq, to seed the queues with tasks and to assert on the tasks enqueued,
+// scheduled, retried, or killed, without relying on the layout of the keys
+// in redis. RunHandler processes a task with a handler as a background
+// would, to unit test the handlers without redis.
+//
+// The helpers operate on the keys of the default namespace, so the clients
+// and backgrounds under test should not set KeyPrefix. Tests should use
+// a dedicated redis database, since FlushDB deletes all its keys.
+//
+//	func TestSignup(t *testing.T) {
+//	    r := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 15})
+//	    asynqtest.FlushDB(t, r)
+//
+//	    signup(asynq.NewClient(asynq.RedisClientOpt{Addr: "localhost:6379", DB: 15}), "user@example.com")
+//
+//	    got := asynqtest.GetEnqueuedMessages(t, r, "email")
+//	    want := []*asynqtest.TaskMessage{asynqtest.NewTaskMessageWithQueue("welcome_email", map[string]interface{}{"to": "user@example.com"}, "email")}
+//	    if diff := cmp.Diff(want, got, asynqtest.IgnoreIDOpt, asynqtest.IgnoreProcessAtOpt); diff != "" {
+//	        t.Errorf("enqueued tasks mismatch (-want,+got)\n%s", diff)
+//	    }
+//	}
+package asynqtest
+
+import (
+	"testing"
+
+	"github.com/go-redis/redis/v7"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// TaskMessage is the representation of a task stored in redis,
+// the same type as asynq.TaskMessage.
+type TaskMessage = base.TaskMessage
+
+// ZSetEntry is an entry in redis sorted set.
+type ZSetEntry = h.ZSetEntry
+
+// SortMsgOpt is a cmp.Option to sort task messages for comparing slice of task messages.
+var SortMsgOpt = h.SortMsgOpt
+
+// SortZSetEntryOpt is an cmp.Option to sort ZSetEntry for comparing slice of zset entries.
+var SortZSetEntryOpt = h.SortZSetEntryOpt
+
+// IgnoreIDOpt is an cmp.Option to ignore ID field in task messages when comparing.
+var IgnoreIDOpt = h.IgnoreIDOpt
+
+// IgnoreProcessAtOpt is an cmp.Option to ignore ProcessAt field in task messages
+// when comparing, which is set by the client to the time a task is scheduled.
+var IgnoreProcessAtOpt = h.IgnoreProcessAtOpt
+
+// NewTaskMessage returns a new instance of TaskMessage given a task type and payload.
+func NewTaskMessage(taskType string, payload map[string]interface{}) *TaskMessage {
+	return h.NewTaskMessage(taskType, payload)
+}
+
+// NewTaskMessageWithQueue returns a new instance of TaskMessage given a
+// task type, payload and queue name.
+func NewTaskMessageWithQueue(taskType string, payload map[string]interface{}, qname string) *TaskMessage {
+	return h.NewTaskMessageWithQueue(taskType, payload, qname)
+}
+
+// FlushDB deletes all the keys of the currently selected DB.
+func FlushDB(tb testing.TB, r redis.UniversalClient) {
+	tb.Helper()
+	h.FlushDB(tb, r)
+}
+
+// SeedEnqueuedQueue initializes the specified queue with the given messages.
+//
+// If queue name option is not passed, it defaults to the default queue.
+func SeedEnqueuedQueue(tb testing.TB, r redis.UniversalClient, msgs []*TaskMessage, queueOpt ...string) {
+	tb.Helper()
+	h.SeedEnqueuedQueue(tb, r, msgs, queueOpt...)
+}
+
+// SeedInProgressQueue initializes the in-progress queue with the given messages.
+func SeedInProgressQueue(tb testing.TB, r redis.UniversalClient, msgs []*TaskMessage) {
+	tb.Helper()
+	h.SeedInProgressQueue(tb, r, msgs)
+}
+
+// SeedScheduledQueue initializes the scheduled queue with the given messages.
+func SeedScheduledQueue(tb testing.TB, r redis.UniversalClient, entries []ZSetEntry) {
+	tb.Helper()
+	h.SeedScheduledQueue(tb, r, entries)
+}
+
+// SeedRetryQueue initializes the retry queue with the given messages.
+func SeedRetryQueue(tb testing.TB, r redis.UniversalClient, entries []ZSetEntry) {
+	tb.Helper()
+	h.SeedRetryQueue(tb, r, entries)
+}
+
+// SeedDeadQueue initializes the dead queue with the given messages.
+func SeedDeadQueue(tb testing.TB, r redis.UniversalClient, entries []ZSetEntry) {
+	tb.Helper()
+	h.SeedDeadQueue(tb, r, entries)
+}
+
+// SeedCompletedQueue initializes the completed queue with the given messages.
+func SeedCompletedQueue(tb testing.TB, r redis.UniversalClient, entries []ZSetEntry) {
+	tb.Helper()
+	h.SeedCompletedQueue(tb, r, entries)
+}
+
+// GetEnqueuedMessages returns all task messages in the specified queue.
+//
+// If queue name option is not passed, it defaults to the default queue.
+func GetEnqueuedMessages(tb testing.TB, r redis.UniversalClient, queueOpt ...string) []*TaskMessage {
+	tb.Helper()
+	return h.GetEnqueuedMessages(tb, r, queueOpt...)
+}
+
+// GetInProgressMessages returns all task messages in the in-progress queue.
+func GetInProgressMessages(tb testing.TB, r redis.UniversalClient) []*TaskMessage {
+	tb.Helper()
+	return h.GetInProgressMessages(tb, r)
+}
+
+// GetScheduledMessages returns all task messages in the scheduled queue.
+func GetScheduledMessages(tb testing.TB, r redis.UniversalClient) []*TaskMessage {
+	tb.Helper()
+	return h.GetScheduledMessages(tb, r)
+}
+
+// GetRetryMessages returns all task messages in the retry queue.
+func GetRetryMessages(tb testing.TB, r redis.UniversalClient) []*TaskMessage {
+	tb.Helper()
+	return h.GetRetryMessages(tb, r)
+}
+
+// GetDeadMessages returns all task messages in the dead queue.
+func GetDeadMessages(tb testing.TB, r redis.UniversalClient) []*TaskMessage {
+	tb.Helper()
+	return h.GetDeadMessages(tb, r)
+}
+
+// GetScheduledEntries returns all task messages and its score in the scheduled queue.
+func GetScheduledEntries(tb testing.TB, r redis.UniversalClient) []ZSetEntry {
+	tb.Helper()
+	return h.GetScheduledEntries(tb, r)
+}
+
+// GetRetryEntries returns all task messages and its score in the retry queue.
+func GetRetryEntries(tb testing.TB, r redis.UniversalClient) []ZSetEntry {
+	tb.Helper()
+	return h.GetRetryEntries(tb, r)
+}
+
+// GetDeadEntries returns all task messages and its score in the dead queue.
+func GetDeadEntries(tb testing.TB, r redis.UniversalClient) []ZSetEntry {
+	tb.Helper()
+	return h.GetDeadEntries(tb, r)
+}
+
+// GetCompletedEntries returns all task messages and its score in the completed queue.
+func GetCompletedEntries(tb testing.TB, r redis.UniversalClient) []ZSetEntry {
+	tb.Helper()
+	return h.GetCompletedEntries(tb, r)
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynqtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCmpOptions(t *testing.T) {
+	m1 := NewTaskMessage("send_email", map[string]interface{}{"to": "user@example.com"})
+	m2 := NewTaskMessageWithQueue("send_email", map[string]interface{}{"to": "user@example.com"}, "low")
+	if m1.Queue != "default" || m2.Queue != "low" {
+		t.Errorf("task messages are in queues %q and %q, want %q and %q", m1.Queue, m2.Queue, "default", "low")
+	}
+
+	m3 := NewTaskMessage("send_email", map[string]interface{}{"to": "user@example.com"})
+	m3.ProcessAt = time.Now().UnixNano()
+	if diff := cmp.Diff(m1, m3, IgnoreIDOpt, IgnoreProcessAtOpt); diff != "" {
+		t.Errorf("task messages differ with IgnoreIDOpt and IgnoreProcessAtOpt; (-want,+got)\n%s", diff)
+	}
+	if !cmp.Equal([]*TaskMessage{m1, m3}, []*TaskMessage{m3, m1}, SortMsgOpt) {
+		t.Errorf("task messages in different orders differ with SortMsgOpt")
+	}
+}
+
+func TestSeedAndGet(t *testing.T) {
+	r := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 14})
+	FlushDB(t, r)
+
+	m1 := NewTaskMessage("send_email", nil)
+	m2 := NewTaskMessageWithQueue("reindex", nil, "low")
+	m3 := NewTaskMessage("export_report", nil)
+	SeedEnqueuedQueue(t, r, []*TaskMessage{m1})
+	SeedEnqueuedQueue(t, r, []*TaskMessage{m2}, "low")
+	SeedScheduledQueue(t, r, []ZSetEntry{{Msg: m3, Score: 1234}})
+
+	if diff := cmp.Diff([]*TaskMessage{m1}, GetEnqueuedMessages(t, r)); diff != "" {
+		t.Errorf("enqueued tasks mismatch; (-want,+got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]*TaskMessage{m2}, GetEnqueuedMessages(t, r, "low")); diff != "" {
+		t.Errorf("enqueued tasks in %q mismatch; (-want,+got)\n%s", "low", diff)
+	}
+	if diff := cmp.Diff([]ZSetEntry{{Msg: m3, Score: 1234}}, GetScheduledEntries(t, r)); diff != "" {
+		t.Errorf("scheduled tasks mismatch; (-want,+got)\n%s", diff)
+	}
+	if got := GetRetryMessages(t, r); len(got) != 0 {
+		t.Errorf("retry tasks = %v, want none", got)
+	}
+}
+
+func TestClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewClock(start)
+	if got := clock.Now(); !got.Equal(start) {
+		t.Errorf("Now() = %v, want %v", got, start)
+	}
+	clock.Advance(time.Hour)
+	if got, want := clock.Now(), start.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("Now() after Advance(%v) = %v, want %v", time.Hour, got, want)
+	}
+	clock.Set(start)
+	if got := clock.Now(); !got.Equal(start) {
+		t.Errorf("Now() after Set(%v) = %v, want %v", start, got, start)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynqtest
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a fake clock whose time only changes when it's advanced or set,
+// to be passed as the Clock of the clients, backgrounds, and brokers under
+// test so that scheduled tasks, retries, and retention can be exercised
+// without sleeping.
+//
+//	clock := asynqtest.NewClock(time.Now())
+//	client := asynq.NewClientWithConfig(r, &asynq.ClientConfig{Clock: clock})
+//	bg := asynq.NewBackground(r, &asynq.Config{Clock: clock, SchedulerInterval: 10 * time.Millisecond})
+//
+//	client.Schedule(task, clock.Now().Add(time.Hour))
+//	clock.Advance(time.Hour) // the task is processed within SchedulerInterval.
+//
+// Clocks are safe for concurrent use by multiple goroutines.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewClock returns a new Clock set to the given time.
+func NewClock(t time.Time) *Clock {
+	return &Clock{now: t}
+}
+
+// Now returns the time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the time of the clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set sets the time of the clock to t.
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
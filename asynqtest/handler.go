@@ -0,0 +1,80 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynqtest
+
+import (
+	"testing"
+
+	"github.com/hibiken/asynq"
+)
+
+type retriedOption int
+
+// Retried returns an option for RunHandler to process the task as if it
+// had been retried n times, to test the last attempt of a task for example.
+func Retried(n int) asynq.Option {
+	return retriedOption(n)
+}
+
+// HandlerResult is the result of processing a task with RunHandler.
+type HandlerResult struct {
+	tb testing.TB
+
+	// Err is the error returned by the handler, nil if it succeeded.
+	Err error
+
+	// Outcome is what a background would do with the task.
+	Outcome asynq.Outcome
+}
+
+// RunHandler processes the task once with the handler as a background
+// would, with the context carrying the ID, retry count, max retry, queue,
+// and timeout of the task given by the options, and returns the result to
+// assert on.
+//
+//	func TestSendEmail(t *testing.T) {
+//	    task := asynq.NewTask("send_email", map[string]interface{}{"to": "invalid"})
+//	    asynqtest.RunHandler(t, handler, task, asynq.MaxRetry(3)).AssertRetry()
+//	    asynqtest.RunHandler(t, handler, task, asynq.MaxRetry(3), asynqtest.Retried(3)).AssertDead()
+//	}
+func RunHandler(tb testing.TB, h asynq.Handler, task *asynq.Task, opts ...asynq.Option) *HandlerResult {
+	tb.Helper()
+	var retried int
+	var taskOpts []asynq.Option
+	for _, opt := range opts {
+		if n, ok := opt.(retriedOption); ok {
+			retried = int(n)
+			continue
+		}
+		taskOpts = append(taskOpts, opt)
+	}
+	outcome, err := asynq.ProcessOnce(h, task, retried, taskOpts...)
+	return &HandlerResult{tb: tb, Err: err, Outcome: outcome}
+}
+
+// AssertDone fails the test unless the task is done.
+func (r *HandlerResult) AssertDone() {
+	r.tb.Helper()
+	r.assert(asynq.OutcomeDone)
+}
+
+// AssertRetry fails the test unless the task is retried.
+func (r *HandlerResult) AssertRetry() {
+	r.tb.Helper()
+	r.assert(asynq.OutcomeRetry)
+}
+
+// AssertDead fails the test unless the task is moved to the dead queue.
+func (r *HandlerResult) AssertDead() {
+	r.tb.Helper()
+	r.assert(asynq.OutcomeDead)
+}
+
+func (r *HandlerResult) assert(want asynq.Outcome) {
+	r.tb.Helper()
+	if r.Outcome != want {
+		r.tb.Errorf("task is %v with error %v, want %v", r.Outcome, r.Err, want)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynqtest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+func TestRunHandler(t *testing.T) {
+	var (
+		id       string
+		retried  int
+		maxRetry int
+		qname    string
+		deadline time.Time
+	)
+	h := asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+		id, _ = asynq.GetTaskID(ctx)
+		retried, _ = asynq.GetRetryCount(ctx)
+		maxRetry, _ = asynq.GetMaxRetry(ctx)
+		qname, _ = asynq.GetQueueName(ctx)
+		deadline, _ = ctx.Deadline()
+		if task.Type == "fail" {
+			return errors.New("smtp server is down")
+		}
+		return nil
+	})
+
+	start := time.Now()
+	RunHandler(t, h, asynq.NewTask("send_email", nil), asynq.Queue("email"), asynq.Timeout(time.Minute)).AssertDone()
+	if id == "" || retried != 0 || maxRetry != 25 || qname != "email" {
+		t.Errorf("handler got task id=%q retried=%d max_retry=%d queue=%q, want an ID, 0, 25, and %q", id, retried, maxRetry, qname, "email")
+	}
+	if deadline.Before(start.Add(time.Minute)) || deadline.After(time.Now().Add(time.Minute)) {
+		t.Errorf("handler got deadline %v, want a minute from now", deadline)
+	}
+
+	fail := asynq.NewTask("fail", nil)
+	res := RunHandler(t, h, fail, asynq.MaxRetry(3), Retried(2))
+	res.AssertRetry()
+	if res.Err == nil || retried != 2 || maxRetry != 3 {
+		t.Errorf("RunHandler returned error %v and handler got retried=%d max_retry=%d, want an error, 2, and 3", res.Err, retried, maxRetry)
+	}
+	RunHandler(t, h, fail, asynq.MaxRetry(3), Retried(3)).AssertDead()
+	RunHandler(t, h, fail, asynq.Ack(asynq.AtMostOnce)).AssertDead()
+}
@@ -11,12 +11,12 @@ import (
 	"math/rand"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/hibiken/asynq/internal/base"
-	"github.com/hibiken/asynq/internal/rdb"
 )
 
 // Background is responsible for managing the background-task processing.
@@ -31,6 +31,8 @@ import (
 // (e.g., queue size reaches a certain limit, or the task has been in the
 // queue for a certain amount of time).
 type Background struct {
+	logger *asynqLogger
+
 	mu      sync.Mutex
 	running bool
 
@@ -40,12 +42,20 @@ type Background struct {
 	// wait group to wait for all goroutines to finish.
 	wg sync.WaitGroup
 
-	rdb         *rdb.RDB
+	rdb         base.Broker
 	scheduler   *scheduler
 	processor   *processor
 	syncer      *syncer
 	heartbeater *heartbeater
 	subscriber  *subscriber
+	controller  *controller
+	gate        *dependencyGate
+	rollups     *rollupRefresher
+	healthcheck *healthchecker
+	leases      *leaseKeeper
+	canary      *canaryScheduler
+	janitor     *janitor
+	waker       *waker
 }
 
 // Config specifies the background-task processing behavior.
@@ -64,6 +74,36 @@ type Config struct {
 	// t is the task in question.
 	RetryDelayFunc func(n int, e error, t *Task) time.Duration
 
+	// RecoverPanicFunc is called when a handler panics, with the stack
+	// trace of the panic, and decides whether the task is retried or moved
+	// to the dead queue. The error recorded for the task is "panic: <value>".
+	//
+	// If nil, tasks whose handler panicked are retried like the tasks whose
+	// handler returned an error.
+	RecoverPanicFunc RecoverPanicFunc
+
+	// DefaultTimeout specifies the timeout of the tasks scheduled without
+	// Timeout option, so that no handler runs unbounded even if the
+	// producers of the tasks forget to set a timeout. The context passed
+	// to the handler is canceled when the timeout is exceeded.
+	//
+	// Tasks scheduled with Timeout(0) have a zero timeout, same as the tasks
+	// without Timeout option, so DefaultTimeout overrides it as well.
+	//
+	// If unset or zero, tasks without Timeout option have no timeout.
+	DefaultTimeout time.Duration
+
+	// BaseContext optionally specifies a function that returns the base
+	// context for the contexts passed to the handlers, called for each task
+	// (or batch of tasks) processed, so that applications
+	// can seed them with loggers, tracers, or other values, like
+	// http.Server.BaseContext. The handlers' contexts are canceled when
+	// the base context is canceled. BaseContext must return a non-nil
+	// context.
+	//
+	// If nil, the base context is context.Background().
+	BaseContext func() context.Context
+
 	// List of queues to process with given priority value. Keys are the names of the
 	// queues and values are associated priority value.
 	//
@@ -82,14 +122,389 @@ type Config struct {
 	// the time respectively.
 	//
 	// If a queue has a zero or negative priority value, the queue will be ignored.
+	//
+	// The priority values are stored in redis as queue weights when the background
+	// starts, unless they have been set already, and can be adjusted at runtime
+	// with Inspector.SetQueueWeight.
 	Queues map[string]int
 
+	// List of regions the background serves.
+	//
+	// If set, the background processes only the tasks scheduled with Region option
+	// with one of the regions, and each queue in Queues is processed in every region
+	// with the same priority. Tasks scheduled without Region option are not processed.
+	//
+	// Example:
+	// Regions: []string{"eu"}
+	// With the above config, the background processes the tasks scheduled
+	// with Region("eu") option only. This can be used to comply with data residency
+	// rules by running the backgrounds in each region with their own Regions.
+	//
+	// If set to nil or not specified, the background processes the tasks scheduled
+	// without Region option only.
+	Regions []string
+
 	// StrictPriority indicates whether the queue priority should be treated strictly.
 	//
 	// If set to true, tasks in the queue with the highest priority is processed first.
 	// The tasks in lower priority queues are processed only when those queues with
 	// higher priorities are empty.
 	StrictPriority bool
+
+	// List of functions to transform the payload of each task, applied in order
+	// before the task is passed to the handler (e.g. to decrypt, decompress, or
+	// upgrade payloads written in an older schema).
+	//
+	// If a transformer returns a non-nil error, the task is not passed to the
+	// handler and will be retried after delay. Binary payloads of the tasks
+	// created with NewBinaryTask are not transformed. Payloads encoded by
+	// the PayloadCodec are decoded before being transformed.
+	PayloadTransformers []PayloadTransformer
+
+	// PayloadCodec decodes the payloads of the tasks scheduled by clients
+	// with the codec of the same name, before they are passed to the handler.
+	// See PayloadCodec for details.
+	//
+	// Tasks whose payloads were encoded by a codec of another name fail,
+	// and are retried after delay.
+	PayloadCodec PayloadCodec
+
+	// Encryption holds the keys to decrypt the payloads of the tasks
+	// encrypted by clients, before they are passed to the handler.
+	// See Encryption for details.
+	//
+	// Tasks encrypted with a key not in Keys fail, and are retried
+	// after delay.
+	Encryption *Encryption
+
+	// Signing holds the keys to verify the signatures of the tasks signed
+	// by clients. Tasks without a valid signature are moved to the dead
+	// queue without being processed. See Signing for details.
+	//
+	// If nil, signatures are not verified.
+	Signing *Signing
+
+	// TypeAliases maps the old names of renamed task types to the new names.
+	// Tasks of an old type are passed to the handler as tasks of the new type,
+	// so that tasks enqueued with the old name (e.g. by clients not yet updated,
+	// or before the rename) are processed by the handler of the new type.
+	// PayloadTransformers are called with the type name the task was enqueued with.
+	//
+	// See Inspector.RenameTaskType to rewrite the tasks stored in redis.
+	TypeAliases map[string]string
+
+	// FaultInjection specifies failures to inject for testing.
+	//
+	// If set to nil or not specified, no failures are injected.
+	// See FaultInjection for details.
+	FaultInjection *FaultInjection
+
+	// KeyPrefix specifies the namespace of the redis keys, so that multiple
+	// applications can share a redis instance without their queues colliding.
+	//
+	// The same KeyPrefix should be used by the Client that schedules tasks
+	// to be processed by the background.
+	//
+	// If unset or empty, the default namespace "{asynq}" is used.
+	// See ClientConfig for details.
+	KeyPrefix string
+
+	// List of downstream dependencies of the handler.
+	//
+	// A handler reports a dependency as down with ReportDependencyDown,
+	// which pauses retries of the tasks depending on it until the dependency
+	// recovers. See Dependency for details.
+	Dependencies []*Dependency
+
+	// CircuitBreakers specifies the circuit breakers of the queues by queue
+	// name, which pause processing of a queue while too many of its tasks
+	// are failing. See CircuitBreaker for details.
+	//
+	// With Regions, the breaker of a queue applies to the queue in each
+	// region, and each region trips independently.
+	//
+	// If nil or empty, queues are never paused by failures.
+	CircuitBreakers map[string]*CircuitBreaker
+
+	// List of limits on the rate at which tasks of a type, or tasks in
+	// a queue, are processed. Limits can be shared by all backgrounds.
+	//
+	// Tasks over the limit are postponed when they are pulled out of the
+	// queues, instead of failing and being retried. See TaskRateLimit
+	// for details.
+	RateLimits []*TaskRateLimit
+
+	// IdleTimeout specifies how long the background should be idle, with no
+	// tasks to process in any of its queues, before OnIdle is called.
+	//
+	// If zero or negative, OnIdle is never called.
+	IdleTimeout time.Duration
+
+	// OnIdle is called in a new goroutine once the background has been idle
+	// for IdleTimeout, and again after each subsequent idle period.
+	//
+	// OnIdle can be used to signal an orchestration layer that the
+	// background worker process can be scaled down to zero. Use
+	// Inspector.WaitForTasks to find out when to bring it back.
+	OnIdle func()
+
+	// OnDead is called in a new goroutine with each task moved to the dead
+	// queue, along with the error it was killed with, so that dead tasks
+	// can be mirrored elsewhere (e.g. Kafka or S3) for long-term analysis
+	// before they're trimmed from the dead queue. The info of the task
+	// carries its payload, headers, and error history including the error
+	// it was killed with; its Key is empty.
+	//
+	// OnDead is called only for the tasks killed by the background while
+	// processing them (e.g. after exhausting their retries). It's not called
+	// for the tasks moved to the dead queue when their leases expire, or
+	// by Inspector. A panic in OnDead is recovered and logged.
+	//
+	// If nil, no hook is called.
+	OnDead func(info *TaskInfo, err error)
+
+	// BulkSize specifies the maximum number of tasks to pass at once to
+	// a handler which implements BulkHandler.
+	//
+	// A batch is made of the tasks waiting in the queues when the first task
+	// of the batch is pulled out, so batches are smaller when the queues are
+	// short. If the background processes one queue, it waits up to a second
+	// for more tasks to fill a batch.
+	//
+	// Each batch is processed by one worker, within the shortest timeout of
+	// its tasks. Canceling one of the tasks cancels the whole batch.
+	//
+	// If zero or one, tasks are passed to the handler one by one.
+	BulkSize int
+
+	// DequeueBatchSize specifies the maximum number of tasks to pull out of
+	// the queues in one round trip to redis, which reduces the operations
+	// per second on redis when many small tasks are processed. At most as
+	// many tasks as there are idle workers are pulled out at once.
+	//
+	// Tasks of a batch are pulled out of the queues in the order they're
+	// queried, so a batch may take several tasks out of a low priority
+	// queue when the higher priority queues are empty.
+	//
+	// If zero or one, tasks are pulled out one by one.
+	DequeueBatchSize int
+
+	// QueueShards specifies the number of shards of the queues by queue
+	// name, which should match the QueueShards of the Clients. Each queue
+	// is processed by pulling tasks out of all its shards, starting from
+	// a random shard each time so that the shards are consumed evenly, with
+	// the priority of the queue.
+	//
+	// Queues not in the map, or with fewer than two shards, are not sharded.
+	QueueShards map[string]int
+
+	// WakeOnEnqueue makes the background subscribe to the wakeups published
+	// by the Clients with PublishWakeups option, so that a task enqueued to
+	// any of its queues starts within milliseconds when all the queues are
+	// empty.
+	//
+	// Without wakeups, a background which processes several queues blocks
+	// on one of them while they're all empty, so tasks enqueued to the others
+	// may wait up to a second. A background which processes one queue always
+	// starts tasks right away.
+	//
+	// While its queues stay empty, the background polls them less and less
+	// often, up to every MaxIdleWait, to reduce the load of idle backgrounds
+	// on redis, and polls them again right away when woken up. The scheduled
+	// and retry tasks forwarded to the queues, the tasks requeued by the
+	// backgrounds, and the tasks enqueued or moved to another queue by the
+	// Inspector wake up the backgrounds too.
+	WakeOnEnqueue bool
+
+	// MaxIdleWait specifies the longest time a background with WakeOnEnqueue
+	// waits for wakeups before polling its empty queues again, which bounds
+	// how late a task enqueued without a wakeup (e.g. by a Client without
+	// PublishWakeups, or by a process writing to redis directly) starts. The wait doubles from one second while the
+	// queues stay empty.
+	//
+	// If unset or zero, the wait is capped at 30 seconds.
+	MaxIdleWait time.Duration
+
+	// SlowRetry specifies a policy to move tasks which have been retried
+	// many times to a low priority queue.
+	//
+	// If nil, tasks are retried in their queues. See SlowRetry for details.
+	SlowRetry *SlowRetry
+
+	// WarmPool specifies the resources to preload for each worker
+	// (e.g. ML models) before the background starts processing tasks.
+	//
+	// If nil, workers don't preload resources. See WarmPool for details.
+	WarmPool *WarmPool
+
+	// FastLane reserves workers for the task types expected to finish quickly,
+	// so that they are not blocked behind long running tasks.
+	//
+	// If nil, all workers process tasks of any type. See FastLane for details.
+	FastLane *FastLane
+
+	// ResultSink stores the results streamed by the handlers with CreateResult
+	// outside of redis (e.g. in S3 or a filesystem). Only the pointers to the
+	// results are stored in redis.
+	//
+	// If nil, CreateResult returns ErrNoResultSink. Results are not supported
+	// by backgrounds created with NewBackgroundWithBroker.
+	ResultSink ResultSink
+
+	// ResultRetention specifies how long to keep the pointers to the results
+	// in redis. Results in ResultSink should be expired by the sink itself
+	// (e.g. with a lifecycle rule of the bucket).
+	//
+	// If unset or zero, the pointers are kept for 7 days.
+	ResultRetention time.Duration
+
+	// DeadRetention limits the number and the age of the dead tasks kept
+	// in redis. See DeadRetention for details.
+	//
+	// If nil, up to 10,000 dead tasks are kept for 90 days.
+	DeadRetention *DeadRetention
+
+	// CompletedRetention specifies how long to keep the tasks processed
+	// successfully by the background in the "completed" state, so that
+	// they can be inspected with Inspector.ListTasks. Expired completed
+	// tasks are deleted every minute by one of the backgrounds.
+	//
+	// If zero or negative, completed tasks are deleted once they're done.
+	// Completed tasks are not kept by backgrounds created with
+	// NewBackgroundWithBroker.
+	CompletedRetention time.Duration
+
+	// Canary specifies a heartbeat task to enqueue periodically to detect
+	// stalls of the whole pipeline with Inspector.Canary.
+	//
+	// If nil, the background doesn't enqueue the canary, but completes
+	// canary tasks enqueued by the other backgrounds. See Canary for details.
+	Canary *Canary
+
+	// Simulation makes the background process the synthetic tasks enqueued
+	// by "asynqmon simulate" without calling the handler, so that the
+	// capacity of a staging fleet can be measured. See SimulatedTaskType.
+	//
+	// If false, simulated tasks are passed to the handler like any other task.
+	Simulation bool
+
+	// DuplicateDetection makes the background detect the tasks delivered
+	// to the handlers more than once, and log them with the workers which
+	// processed them. See DuplicateDetection for details.
+	//
+	// If nil, duplicate deliveries are not detected.
+	DuplicateDetection *DuplicateDetection
+
+	// PoisonPillDetection makes the background move the tasks which
+	// repeatedly crash the workers to the dead queue. See
+	// PoisonPillDetection for details.
+	//
+	// If nil, crashes are not counted.
+	PoisonPillDetection *PoisonPillDetection
+
+	// Profiling specifies when to capture pprof profiles of the process,
+	// e.g. when all the workers have been busy or a task has been running
+	// for too long.
+	//
+	// If nil, profiles are not captured. See Profiling for details.
+	Profiling *Profiling
+
+	// HealthCheckFunc is called periodically with any errors encountered
+	// while pinging the broker, or nil if the broker is reachable (e.g. to
+	// fail the readiness probe of the process while redis is unreachable).
+	//
+	// If nil, the broker is not pinged.
+	HealthCheckFunc func(error)
+
+	// HealthCheckInterval specifies the interval between healthchecks.
+	//
+	// If unset or zero, the interval is set to 15 seconds.
+	HealthCheckInterval time.Duration
+
+	// SchedulerInterval specifies how often the scheduled and retry tasks
+	// which have come due are moved to their queues, which bounds how late
+	// they start. Shorter intervals (e.g. 100ms) lower the latency of
+	// scheduled tasks and retries, while longer intervals reduce the load
+	// on redis.
+	//
+	// If unset or zero, the interval is set to 5 seconds.
+	SchedulerInterval time.Duration
+
+	// Clock tells the time to retry and postpone the tasks at, to forward
+	// the scheduled and retry tasks which have come due, and to expire the
+	// completed and dead tasks, so that tests can fast-forward time without
+	// sleeping (see asynqtest.Clock). The scheduled tasks are still checked
+	// every SchedulerInterval of real time.
+	//
+	// If unset, the time of the system is used.
+	Clock Clock
+
+	// Locker provides the distributed locks shared by the background worker
+	// processes (e.g. to let only one of them forward scheduled tasks to
+	// the queues at a time).
+	//
+	// If nil, locks stored in redis are used. Backgrounds created with
+	// NewBackgroundWithBroker don't use locks unless Locker is set.
+	Locker Locker
+
+	// RollupInterval specifies how often to recount the tasks by the values
+	// of their rollup dimensions (see ClientConfig.RollupDimensions), which
+	// corrects the counts and the indexes of the correlation IDs of the
+	// tasks moved or deleted without updating them (see Inspector.Rollup).
+	//
+	// Only one of the backgrounds sharing a redis instance does the counting
+	// at a time, which scans all tasks. Counts are read with Inspector.Rollup.
+	//
+	// If zero or negative, the background doesn't recount the tasks.
+	RollupInterval time.Duration
+
+	// Logger specifies the logger used by the background to log messages.
+	//
+	// If unset, messages are written to stderr with the standard log package.
+	Logger Logger
+
+	// LogLevel specifies the minimum severity of messages to log.
+	//
+	// The level can be changed at runtime with `asynqmon ctl loglevel [level]`.
+	//
+	// If unset, InfoLevel is used.
+	LogLevel LogLevel
+}
+
+// PayloadTransformer transforms the payload of a task with the given type name.
+//
+// A PayloadTransformer may modify and return the given payload map, but it should
+// not modify values nested in the map.
+type PayloadTransformer func(typename string, payload map[string]interface{}) (map[string]interface{}, error)
+
+// regionQueue returns the name of the queue for the given region.
+func regionQueue(qname, region string) string {
+	return qname + "@" + region
+}
+
+// regionQueues returns the queue config to process each queue
+// in every region with the same priority.
+func regionQueues(queues map[string]int, regions []string) map[string]int {
+	res := make(map[string]int)
+	for qname, p := range queues {
+		for _, region := range regions {
+			res[regionQueue(qname, strings.ToLower(region))] = p
+		}
+	}
+	return res
+}
+
+// withQueue returns a copy of the queues with the given queue added,
+// unless the queues have it already.
+func withQueue(queues map[string]int, qname string, weight int) map[string]int {
+	if _, ok := queues[qname]; ok {
+		return queues
+	}
+	res := map[string]int{qname: weight}
+	for q, p := range queues {
+		res[q] = p
+	}
+	return res
 }
 
 // Formula taken from https://github.com/mperham/sidekiq.
@@ -106,6 +521,28 @@ var defaultQueueConfig = map[string]int{
 // NewBackground returns a new Background given a redis connection option
 // and background processing configuration.
 func NewBackground(r RedisConnOpt, cfg *Config) *Background {
+	rdb := newRDB(r, cfg.KeyPrefix)
+	// forwarded tasks wake up the backgrounds waiting for wakeups.
+	rdb.SetPublishWakeups(cfg.WakeOnEnqueue)
+	if cfg.Clock != nil {
+		rdb.SetClock(cfg.Clock)
+	}
+	if cfg.DeadRetention != nil {
+		rdb.SetDeadRetention(cfg.DeadRetention.MaxSize, cfg.DeadRetention.MaxAge)
+	}
+	return newBackground(rdb, cfg)
+}
+
+// NewBackgroundWithBroker returns a new Background given a broker
+// and background processing configuration.
+//
+// KeyPrefix field of the config is ignored, and the broker is not closed
+// when the background stops.
+func NewBackgroundWithBroker(b Broker, cfg *Config) *Background {
+	return newBackground(sharedBroker{b}, cfg)
+}
+
+func newBackground(rdb base.Broker, cfg *Config) *Background {
 	n := cfg.Concurrency
 	if n < 1 {
 		n = 1
@@ -123,6 +560,18 @@ func NewBackground(r RedisConnOpt, cfg *Config) *Background {
 	if len(queues) == 0 {
 		queues = defaultQueueConfig
 	}
+	if len(cfg.Regions) > 0 {
+		queues = regionQueues(queues, cfg.Regions)
+	}
+	slowRetry := cfg.SlowRetry.normalize()
+	if slowRetry != nil && len(cfg.Regions) > 0 {
+		slowRetry.regional = true
+		for _, region := range cfg.Regions {
+			queues = withQueue(queues, regionQueue(slowRetry.Queue, strings.ToLower(region)), slowRetry.Weight)
+		}
+	} else if slowRetry != nil {
+		queues = withQueue(queues, slowRetry.Queue, slowRetry.Weight)
+	}
 
 	host, err := os.Hostname()
 	if err != nil {
@@ -130,17 +579,92 @@ func NewBackground(r RedisConnOpt, cfg *Config) *Background {
 	}
 	pid := os.Getpid()
 
-	rdb := rdb.NewRDB(createRedisClient(r))
+	logger := newLogger(os.Stderr)
+	if cfg.Logger != nil {
+		logger.setBase(cfg.Logger)
+	}
+	if cfg.LogLevel != levelUnspecified {
+		logger.setLevel(cfg.LogLevel)
+	}
+
+	faults := newFaultInjector(cfg.FaultInjection)
 	syncRequestCh := make(chan *syncRequest)
 	stateCh := make(chan string)
 	workerCh := make(chan int)
 	cancelations := base.NewCancelations()
-	syncer := newSyncer(syncRequestCh, 5*time.Second)
-	heartbeater := newHeartbeater(rdb, host, pid, n, queues, cfg.StrictPriority, 5*time.Second, stateCh, workerCh)
-	scheduler := newScheduler(rdb, 5*time.Second, queues)
-	processor := newProcessor(rdb, queues, cfg.StrictPriority, n, delayFunc, syncRequestCh, workerCh, cancelations)
-	subscriber := newSubscriber(rdb, cancelations)
+	depStore, _ := rdb.(dependencyStore)
+	gate := newDependencyGate(logger, cfg.Dependencies, depStore, time.Second)
+	syncer := newSyncer(logger, syncRequestCh, 5*time.Second)
+	heartbeater := newHeartbeater(logger, rdb, host, pid, n, queues, cfg.StrictPriority, 5*time.Second, stateCh, workerCh, faults)
+	locker := cfg.Locker
+	if l, ok := rdb.(Locker); ok && locker == nil {
+		locker = l
+	}
+	shards := newQueueShards(cfg.QueueShards)
+	scheduler := newScheduler(logger, rdb, locker, cfg.SchedulerInterval, shards.expandConfig(queues))
+	store, _ := rdb.(rollupStore)
+	rollups := newRollupRefresher(logger, store, locker, cfg.RollupInterval)
+	canaryRDB, _ := rdb.(canaryStore)
+	canary := newCanaryScheduler(logger, canaryRDB, locker, cfg.Canary)
+	janitorRDB, _ := rdb.(janitorStore)
+	janitor := newJanitor(logger, janitorRDB, locker, cfg.DeadRetention, cfg.CompletedRetention, time.Minute)
+	healthcheck := newHealthChecker(logger, rdb, cfg.HealthCheckInterval, cfg.HealthCheckFunc)
+	leaseRDB, _ := rdb.(leaseStore)
+	leases := newLeaseKeeper(logger, leaseRDB, base.LeaseDuration/3)
+	resultRDB, _ := rdb.(resultStore)
+	results := newResults(cfg.ResultSink, resultRDB, cfg.ResultRetention)
+	deliveryRDB, _ := rdb.(deliveryStore)
+	duplicates := newDuplicateDetector(logger, deliveryRDB, fmt.Sprintf("%s:%d", host, pid), cfg.DuplicateDetection)
+	startRDB, _ := rdb.(startStore)
+	wakeRDB, _ := rdb.(wakeStore)
+	waker := newWaker(logger, wakeRDB, shards.expandConfig(queues), cfg.WakeOnEnqueue)
+	pills := newPoisonPillDetector(logger, startRDB, cfg.PoisonPillDetection)
+	processor := newProcessor(processorParams{
+		logger:         logger,
+		rdb:            rdb,
+		queues:         queues,
+		strictPriority: cfg.StrictPriority,
+		concurrency:    n,
+		retryDelayFunc: delayFunc,
+		syncCh:         syncRequestCh,
+		workerCh:       workerCh,
+		cancelations:   cancelations,
+		transformers:   cfg.PayloadTransformers,
+		typeAliases:    cfg.TypeAliases,
+		codec:          cfg.PayloadCodec,
+		encryption:     cfg.Encryption,
+		signing:        cfg.Signing,
+		faults:         faults,
+		gate:           gate,
+		rateLimits:     cfg.RateLimits,
+		idleTimeout:    cfg.IdleTimeout,
+		onIdle:         cfg.OnIdle,
+		warmPool:       cfg.WarmPool,
+		fastLane:       cfg.FastLane,
+		bulkSize:       cfg.BulkSize,
+		leases:         leases,
+		slowRetry:      slowRetry,
+		results:        results,
+		profiling:      cfg.Profiling,
+		duplicates:     duplicates,
+		retention:      cfg.CompletedRetention,
+		simulation:     cfg.Simulation,
+		recoverPanic:   cfg.RecoverPanicFunc,
+		pills:          pills,
+		breakers:       newCircuitBreakers(logger, cfg.CircuitBreakers),
+		dequeueBatch:   cfg.DequeueBatchSize,
+		waker:          waker,
+		maxIdleWait:    cfg.MaxIdleWait,
+		shards:         shards,
+		clock:          cfg.Clock,
+		defaultTimeout: cfg.DefaultTimeout,
+		baseContext:    cfg.BaseContext,
+		onDead:         cfg.OnDead,
+	})
+	subscriber := newSubscriber(logger, rdb, cancelations)
+	controller := newController(logger, rdb, host, pid, processor, stateCh)
 	return &Background{
+		logger:      logger,
 		stateCh:     stateCh,
 		rdb:         rdb,
 		scheduler:   scheduler,
@@ -148,9 +672,31 @@ func NewBackground(r RedisConnOpt, cfg *Config) *Background {
 		syncer:      syncer,
 		heartbeater: heartbeater,
 		subscriber:  subscriber,
+		controller:  controller,
+		gate:        gate,
+		rollups:     rollups,
+		healthcheck: healthcheck,
+		leases:      leases,
+		canary:      canary,
+		janitor:     janitor,
+		waker:       waker,
 	}
 }
 
+// IdleTime returns how long the background has been idle,
+// or zero if the background is processing tasks.
+func (bg *Background) IdleTime() time.Duration {
+	return bg.processor.idle.idleTime()
+}
+
+// Ready reports whether the background has loaded the worker slots of
+// its WarmPool and is ready to process tasks, e.g. for a readiness probe.
+//
+// Backgrounds without WarmPool are always ready.
+func (bg *Background) Ready() bool {
+	return bg.processor.pool.isReady()
+}
+
 // A Handler processes a task.
 //
 // ProcessTask should return nil if the processing of a task
@@ -173,19 +719,54 @@ func (fn HandlerFunc) ProcessTask(ctx context.Context, task *Task) error {
 	return fn(ctx, task)
 }
 
+// A BulkHandler processes a batch of tasks at once (e.g. to insert
+// rows in bulk), to amortize the work across the tasks.
+//
+// ProcessTasks should return an error for each task, in the same order
+// as the tasks; nil if the processing of the task is successful.
+// Each task with a non-nil error will be retried after delay, as if it
+// was processed by a Handler. If ProcessTasks panics or returns the wrong
+// number of errors, all tasks in the batch will be retried.
+//
+// A handler passed to Background.Run which implements BulkHandler is
+// given batches of up to BulkSize tasks if BulkSize option of Config
+// is greater than one.
+type BulkHandler interface {
+	ProcessTasks(context.Context, []*Task) []error
+}
+
+// The BulkHandlerFunc type is an adapter to allow the use of
+// ordinary functions as a BulkHandler. BulkHandlerFunc is also a
+// Handler, which processes a task as a batch of one.
+type BulkHandlerFunc func(context.Context, []*Task) []error
+
+// ProcessTasks calls fn(ctx, tasks)
+func (fn BulkHandlerFunc) ProcessTasks(ctx context.Context, tasks []*Task) []error {
+	return fn(ctx, tasks)
+}
+
+// ProcessTask calls fn(ctx, []*Task{task})
+func (fn BulkHandlerFunc) ProcessTask(ctx context.Context, task *Task) error {
+	errs := fn(ctx, []*Task{task})
+	if len(errs) != 1 {
+		return fmt.Errorf("batch handler returned %d errors for 1 task", len(errs))
+	}
+	return errs[0]
+}
+
 // Run starts the background-task processing and blocks until
 // an os signal to exit the program is received. Once it receives
 // a signal, it gracefully shuts down all pending workers and other
 // goroutines to process the tasks.
 func (bg *Background) Run(handler Handler) {
-	logger.SetPrefix(fmt.Sprintf("asynq: pid=%d ", os.Getpid()))
-	logger.info("Starting processing")
+	bg.logger.setPrefix(fmt.Sprintf("asynq: pid=%d ", os.Getpid()))
+	bg.logger.info("Starting processing")
 
 	bg.start(handler)
 	defer bg.stop()
 
-	logger.info("Send signal TSTP to stop processing new tasks")
-	logger.info("Send signal TERM or INT to terminate the process")
+	bg.logger.info("Send signal TSTP to stop processing new tasks")
+	bg.logger.info("Send signal TERM or INT to terminate the process")
 
 	// Wait for a signal to terminate.
 	sigs := make(chan os.Signal, 1)
@@ -200,7 +781,7 @@ func (bg *Background) Run(handler Handler) {
 		break
 	}
 	fmt.Println()
-	logger.info("Starting graceful shutdown")
+	bg.logger.info("Starting graceful shutdown")
 }
 
 // starts the background-task processing.
@@ -216,8 +797,16 @@ func (bg *Background) start(handler Handler) {
 
 	bg.heartbeater.start(&bg.wg)
 	bg.subscriber.start(&bg.wg)
+	bg.controller.start(&bg.wg)
 	bg.syncer.start(&bg.wg)
+	bg.gate.start(&bg.wg)
+	bg.rollups.start(&bg.wg)
+	bg.healthcheck.start(&bg.wg)
+	bg.leases.start(&bg.wg)
+	bg.canary.start(&bg.wg)
+	bg.janitor.start(&bg.wg)
 	bg.scheduler.start(&bg.wg)
+	bg.waker.start(&bg.wg)
 	bg.processor.start(&bg.wg)
 }
 
@@ -234,16 +823,25 @@ func (bg *Background) stop() {
 	//
 	// processor -> syncer      (via syncRequestCh)
 	// processor -> heartbeater (via workerCh)
+	// controller -> heartbeater (via stateCh)
 	bg.scheduler.terminate()
 	bg.processor.terminate()
+	bg.waker.terminate()
 	bg.syncer.terminate()
 	bg.subscriber.terminate()
+	bg.controller.terminate()
 	bg.heartbeater.terminate()
+	bg.gate.terminate()
+	bg.rollups.terminate()
+	bg.healthcheck.terminate()
+	bg.leases.terminate()
+	bg.canary.terminate()
+	bg.janitor.terminate()
 
 	bg.wg.Wait()
 
 	bg.rdb.Close()
 	bg.running = false
 
-	logger.info("Bye!")
+	bg.logger.info("Bye!")
 }
@@ -120,3 +120,35 @@ func TestNormalizeQueueCfg(t *testing.T) {
 		}
 	}
 }
+
+func TestRegionQueues(t *testing.T) {
+	tests := []struct {
+		queues  map[string]int
+		regions []string
+		want    map[string]int
+	}{
+		{
+			queues:  map[string]int{"default": 1},
+			regions: []string{"eu"},
+			want:    map[string]int{"default@eu": 1},
+		},
+		{
+			queues:  map[string]int{"critical": 6, "low": 1},
+			regions: []string{"EU", "us"},
+			want: map[string]int{
+				"critical@eu": 6,
+				"critical@us": 6,
+				"low@eu":      1,
+				"low@us":      1,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		got := regionQueues(tc.queues, tc.regions)
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("regionQueues(%v, %v) = %v, want %v; (-want,+got)\n%s",
+				tc.queues, tc.regions, got, tc.want, diff)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// A Batch collects tasks to be scheduled and writes them to redis
+// all at once in a single round trip.
+//
+// Batch is useful to schedule tasks only after a unit of work (e.g. an HTTP
+// request or a database transaction) completes successfully, so that no
+// tasks are scheduled if the work fails.
+//
+// Batches are safe for concurrent use by multiple goroutines.
+type Batch struct {
+	client *Client
+
+	mu      sync.Mutex
+	entries []*base.BatchEntry
+
+	// err is the first error of the tasks added to the batch.
+	err error
+}
+
+// NewBatch returns a new empty Batch which writes tasks using the client.
+func (c *Client) NewBatch() *Batch {
+	return &Batch{client: c}
+}
+
+// Schedule adds a task to the batch to be processed at the specified time.
+// The task is not registered until Flush is called.
+//
+// opts specifies the behavior of task processing. If there are conflicting
+// Option values the last one overrides others.
+//
+// Workflow steps cannot be added to a batch since they are released only
+// after the steps they depend on complete; Flush returns an error instead.
+func (b *Batch) Schedule(task *Task, processAt time.Time, opts ...Option) {
+	msg, err := b.client.newTaskMessage(task, opts...)
+	if err == nil && msg.WorkflowID != "" {
+		err = fmt.Errorf("asynq: workflow step %q cannot be added to a batch", msg.WorkflowStep)
+	}
+	if err != nil {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.err == nil {
+			b.err = err
+		}
+		return
+	}
+	entry := &base.BatchEntry{Msg: msg}
+	t := now(b.client.clock)
+	entry.Msg.ProcessAt = t.UnixNano()
+	if t.Before(processAt) {
+		entry.ProcessAt = processAt
+		entry.Msg.ProcessAt = processAt.UnixNano()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries = append(b.entries, entry)
+}
+
+// Len returns the number of tasks in the batch.
+func (b *Batch) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.entries)
+}
+
+// Flush registers all tasks in the batch in a single transaction and
+// empties the batch.
+//
+// Flush returns nil if all tasks are registered successfully, otherwise
+// returns a non-nil error and none of the tasks are registered.
+func (b *Batch) Flush() error {
+	b.mu.Lock()
+	entries, err := b.entries, b.err
+	b.entries, b.err = nil, nil
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return b.client.rdb.WriteBatch(entries)
+}
+
+// Discard empties the batch without registering any tasks.
+func (b *Batch) Discard() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries, b.err = nil, nil
+}
+
+type batchKey struct{}
+
+// WithBatch returns a copy of ctx associated with the batch.
+func WithBatch(ctx context.Context, b *Batch) context.Context {
+	return context.WithValue(ctx, batchKey{}, b)
+}
+
+// BatchFromContext returns the batch associated with ctx if any.
+func BatchFromContext(ctx context.Context) (b *Batch, ok bool) {
+	b, ok = ctx.Value(batchKey{}).(*Batch)
+	return b, ok
+}
+
+// BatchHandler returns an http.Handler which associates a new Batch with
+// each request context before calling h.
+//
+// Tasks added to the batch by h are flushed after h returns
+// if the response status code is less than 400, and discarded otherwise.
+// The batch can be obtained by calling BatchFromContext with the request context.
+func BatchHandler(c *Client, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := c.NewBatch()
+		rw := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rw, r.WithContext(WithBatch(r.Context(), b)))
+		if rw.status >= 400 {
+			b.Discard()
+			return
+		}
+		if err := b.Flush(); err != nil {
+			c.logger.error("Could not flush batch of tasks for %s %s: %v", r.Method, r.URL.Path, err)
+		}
+	})
+}
+
+// statusRecorder is an http.ResponseWriter which records the response status code.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+func TestBatchFlush(t *testing.T) {
+	r := setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: redisAddr,
+		DB:   redisDB,
+	})
+
+	t1 := NewTask("send_email", map[string]interface{}{"user_id": 42})
+	t2 := NewTask("generate_csv", nil)
+
+	b := client.NewBatch()
+	b.Schedule(t1, time.Now())
+	b.Schedule(t2, time.Now().Add(time.Hour), Queue("low"))
+	if got := b.Len(); got != 2 {
+		t.Fatalf("(*Batch).Len() = %d, want 2", got)
+	}
+
+	if gotEnqueued := h.GetEnqueuedMessages(t, r); len(gotEnqueued) != 0 {
+		t.Errorf("%q has %d tasks before flush, want 0", base.DefaultQueue, len(gotEnqueued))
+	}
+
+	if err := b.Flush(); err != nil {
+		t.Fatalf("(*Batch).Flush() = %v, want nil", err)
+	}
+	if got := b.Len(); got != 0 {
+		t.Errorf("(*Batch).Len() = %d after flush, want 0", got)
+	}
+
+	wantEnqueued := []*base.TaskMessage{
+		{Type: t1.Type, Payload: t1.Payload.data, Retry: defaultMaxRetry, Queue: "default", Timeout: time.Duration(0).String()},
+	}
+	gotEnqueued := h.GetEnqueuedMessages(t, r)
+	if diff := cmp.Diff(wantEnqueued, gotEnqueued, cmpopts.IgnoreFields(base.TaskMessage{}, "ID", "ProcessAt")); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.DefaultQueue, diff)
+	}
+	wantScheduled := []*base.TaskMessage{
+		{Type: t2.Type, Payload: t2.Payload.data, Retry: defaultMaxRetry, Queue: "low", Timeout: time.Duration(0).String()},
+	}
+	gotScheduled := h.GetScheduledMessages(t, r)
+	if diff := cmp.Diff(wantScheduled, gotScheduled, cmpopts.IgnoreFields(base.TaskMessage{}, "ID", "ProcessAt")); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.ScheduledQueue, diff)
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	r := setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: redisAddr,
+		DB:   redisDB,
+	})
+
+	tests := []struct {
+		status       int
+		wantEnqueued int
+	}{
+		{http.StatusOK, 1},
+		{http.StatusCreated, 1},
+		{http.StatusBadRequest, 0},
+		{http.StatusInternalServerError, 0},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r) // clean up db before each test case.
+
+		handler := BatchHandler(client, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			b, ok := BatchFromContext(req.Context())
+			if !ok {
+				t.Fatal("BatchFromContext did not return a batch")
+			}
+			b.Schedule(NewTask("send_email", nil), time.Now())
+			w.WriteHeader(tc.status)
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/signup", nil))
+
+		if got := len(h.GetEnqueuedMessages(t, r)); got != tc.wantEnqueued {
+			t.Errorf("with response status %d, %d tasks enqueued, want %d", tc.status, got, tc.wantEnqueued)
+		}
+	}
+}
+
+func TestBatchFromContext(t *testing.T) {
+	if _, ok := BatchFromContext(context.Background()); ok {
+		t.Errorf("BatchFromContext(context.Background()) returned ok, want not ok")
+	}
+	b := &Batch{}
+	got, ok := BatchFromContext(WithBatch(context.Background(), b))
+	if !ok || got != b {
+		t.Errorf("BatchFromContext(WithBatch(ctx, b)) = %v, %t; want %v, true", got, ok, b)
+	}
+}
+
+func TestBatchRejectsWorkflowSteps(t *testing.T) {
+	b := &recordingBroker{}
+	client := NewClientWithBroker(b)
+
+	batch := client.NewBatch()
+	batch.Schedule(NewTask("send_email", nil), time.Now())
+	batch.Schedule(NewTask("generate_csv", nil), time.Now(), WorkflowStep("wf", "csv"))
+	if got := batch.Len(); got != 1 {
+		t.Errorf("(*Batch).Len() = %d, want 1", got)
+	}
+	if err := batch.Flush(); err == nil {
+		t.Errorf("(*Batch).Flush() = nil, want error for the workflow step")
+	}
+	if len(b.enqueued) != 0 || len(b.scheduled) != 0 {
+		t.Errorf("broker has enqueued %v and scheduled %v, want none", b.enqueued, b.scheduled)
+	}
+}
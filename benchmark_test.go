@@ -8,6 +8,7 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -156,3 +157,66 @@ func BenchmarkEndToEndMultipleQueues(b *testing.B) {
 		b.StartTimer() // end teardown
 	}
 }
+
+// Benchmark of the time it takes for a task enqueued while the queues are
+// empty to start, reported as p50 and p99 latencies.
+func BenchmarkStartLatency(b *testing.B) {
+	multi := map[string]int{"high": 6, "default": 3, "low": 1}
+	tests := []struct {
+		name   string
+		queues map[string]int
+		wakeup bool
+	}{
+		{"SingleQueue", nil, false},
+		{"MultipleQueues", multi, false},
+		{"MultipleQueuesWithWakeups", multi, true},
+	}
+	for _, tc := range tests {
+		b.Run(tc.name, func(b *testing.B) {
+			setup(b)
+			redis := &RedisClientOpt{
+				Addr: redisAddr,
+				DB:   redisDB,
+			}
+			client := NewClientWithConfig(redis, &ClientConfig{PublishWakeups: tc.wakeup})
+			bg := NewBackground(redis, &Config{
+				Concurrency:   1,
+				Queues:        tc.queues,
+				WakeOnEnqueue: tc.wakeup,
+			})
+			started := make(chan time.Time)
+			bg.start(HandlerFunc(func(ctx context.Context, t *Task) error {
+				started <- time.Now()
+				return nil
+			}))
+			defer bg.stop()
+
+			var qnames []string
+			for qname := range tc.queues {
+				qnames = append(qnames, qname)
+			}
+			if len(qnames) == 0 {
+				qnames = []string{"default"}
+			}
+			latencies := make([]time.Duration, b.N)
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				// let the background wait on the empty queues.
+				b.StopTimer()
+				time.Sleep(10 * time.Millisecond)
+				b.StartTimer()
+				enqueued := time.Now()
+				t := NewTask("task", map[string]interface{}{"data": n})
+				if _, err := client.Schedule(t, enqueued, Queue(qnames[n%len(qnames)])); err != nil {
+					b.Fatal(err)
+				}
+				latencies[n] = (<-started).Sub(enqueued)
+			}
+			b.StopTimer()
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			ms := float64(time.Millisecond)
+			b.ReportMetric(float64(latencies[len(latencies)/2])/ms, "p50-ms")
+			b.ReportMetric(float64(latencies[len(latencies)*99/100])/ms, "p99-ms")
+		})
+	}
+}
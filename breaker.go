@@ -0,0 +1,202 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// CircuitBreaker specifies when to pause processing of a queue whose tasks
+// are failing, so that a downstream dependency in trouble isn't flooded with
+// requests during an incident.
+//
+// The breaker trips when the ratio of the tasks of the queue which failed
+// over the last Window exceeds FailureRate. The queue is then paused for
+// the CoolDown, after which processing resumes and the failures are counted
+// again from scratch.
+//
+// Each background keeps its own breakers in memory, based on the tasks its
+// workers processed, so the breakers of the backgrounds trip independently.
+type CircuitBreaker struct {
+	// FailureRate is the ratio of failed tasks, between 0 and 1, above which
+	// the breaker trips.
+	//
+	// If zero or negative, 0.5 is used.
+	FailureRate float64
+
+	// Window specifies over how long the failure rate is computed.
+	//
+	// If zero or negative, one minute is used.
+	Window time.Duration
+
+	// MinTasks is the number of tasks to process in the window before
+	// the breaker can trip, so that a few failures don't pause the queue.
+	//
+	// If zero or negative, ten is used.
+	MinTasks int
+
+	// CoolDown specifies how long the queue stays paused once the breaker
+	// has tripped.
+	//
+	// If zero or negative, 30 seconds is used.
+	CoolDown time.Duration
+}
+
+// number of buckets the window of a breaker is split into.
+const breakerBuckets = 10
+
+// breakerBucket counts the tasks processed in a slice of the window.
+type breakerBucket struct {
+	start  time.Time
+	total  int
+	failed int
+}
+
+// breaker is the state of the circuit breaker of a queue.
+type breaker struct {
+	cfg CircuitBreaker
+
+	// buckets of the window, oldest first.
+	buckets []breakerBucket
+
+	// time the queue is paused until, zero if the breaker is closed.
+	openUntil time.Time
+}
+
+// record counts the result of a task processed at the given time, and
+// reports whether the breaker tripped.
+func (b *breaker) record(failed bool, now time.Time) bool {
+	width := b.cfg.Window / breakerBuckets
+	cutoff := now.Add(-b.cfg.Window)
+	i := 0
+	for i < len(b.buckets) && !b.buckets[i].start.After(cutoff) {
+		i++
+	}
+	b.buckets = b.buckets[i:]
+	if n := len(b.buckets); n == 0 || now.Sub(b.buckets[n-1].start) >= width {
+		b.buckets = append(b.buckets, breakerBucket{start: now})
+	}
+	last := &b.buckets[len(b.buckets)-1]
+	last.total++
+	if failed {
+		last.failed++
+	}
+
+	var total, nfailed int
+	for _, bk := range b.buckets {
+		total += bk.total
+		nfailed += bk.failed
+	}
+	if total < b.cfg.MinTasks || float64(nfailed)/float64(total) <= b.cfg.FailureRate {
+		return false
+	}
+	b.openUntil = now.Add(b.cfg.CoolDown)
+	b.buckets = nil
+	return true
+}
+
+// circuitBreakers keeps the breakers of the queues.
+//
+// The breakers are configured by the names of the queues without the
+// region, and each queue in a region has its own breaker.
+//
+// A nil circuitBreakers never pauses queues.
+type circuitBreakers struct {
+	logger *asynqLogger
+	cfgs   map[string]CircuitBreaker // by lowercase queue name without region
+
+	mu       sync.Mutex
+	breakers map[string]*breaker // by queue name
+}
+
+func newCircuitBreakers(logger *asynqLogger, cfgs map[string]*CircuitBreaker) *circuitBreakers {
+	if len(cfgs) == 0 {
+		return nil
+	}
+	cb := &circuitBreakers{
+		logger:   logger,
+		cfgs:     make(map[string]CircuitBreaker),
+		breakers: make(map[string]*breaker),
+	}
+	for qname, c := range cfgs {
+		if c == nil {
+			continue
+		}
+		cfg := *c
+		if cfg.FailureRate <= 0 {
+			cfg.FailureRate = 0.5
+		}
+		if cfg.Window <= 0 {
+			cfg.Window = time.Minute
+		}
+		if cfg.MinTasks <= 0 {
+			cfg.MinTasks = 10
+		}
+		if cfg.CoolDown <= 0 {
+			cfg.CoolDown = 30 * time.Second
+		}
+		cb.cfgs[strings.ToLower(qname)] = cfg
+	}
+	return cb
+}
+
+// get returns the breaker of the queue, nil if the queue has none.
+// It must be called with mu held.
+func (cb *circuitBreakers) get(qname string) *breaker {
+	if b, ok := cb.breakers[qname]; ok {
+		return b
+	}
+	name := qname
+	if i := strings.IndexByte(name, '@'); i >= 0 {
+		name = name[:i]
+	}
+	cfg, ok := cb.cfgs[name]
+	if !ok {
+		return nil
+	}
+	b := &breaker{cfg: cfg}
+	cb.breakers[qname] = b
+	return b
+}
+
+// record counts the result of a task of the queue processed at the given time.
+func (cb *circuitBreakers) record(qname string, failed bool, now time.Time) {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	b := cb.get(qname)
+	if b == nil || now.Before(b.openUntil) {
+		return
+	}
+	if b.record(failed, now) {
+		cb.logger.warn("Circuit breaker of queue %q tripped: more than %.0f%% of the tasks failed in the last %v; Pausing the queue for %v",
+			qname, b.cfg.FailureRate*100, b.cfg.Window, b.cfg.CoolDown)
+	}
+}
+
+// allowed returns the queues whose breakers are closed at the given time.
+func (cb *circuitBreakers) allowed(qnames []string, now time.Time) []string {
+	if cb == nil {
+		return qnames
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	res := make([]string, 0, len(qnames))
+	for _, qname := range qnames {
+		if b := cb.get(qname); b != nil && !b.openUntil.IsZero() {
+			if now.Before(b.openUntil) {
+				continue
+			}
+			cb.logger.info("Circuit breaker of queue %q cooled down; Resuming the queue", qname)
+			b.openUntil = time.Time{}
+		}
+		res = append(res, qname)
+	}
+	return res
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNewCircuitBreakers(t *testing.T) {
+	if cb := newCircuitBreakers(testLogger, nil); cb != nil {
+		t.Errorf("newCircuitBreakers(testLogger, nil) = %v, want nil", cb)
+	}
+	cb := newCircuitBreakers(testLogger, map[string]*CircuitBreaker{"default": {}})
+	want := CircuitBreaker{FailureRate: 0.5, Window: time.Minute, MinTasks: 10, CoolDown: 30 * time.Second}
+	if diff := cmp.Diff(want, cb.cfgs["default"]); diff != "" {
+		t.Errorf("newCircuitBreakers with zero config = %+v, want %+v; (-want,+got)\n%s", cb.cfgs["default"], want, diff)
+	}
+
+	// A nil circuitBreakers never pauses queues.
+	var nop *circuitBreakers
+	nop.record("default", true, time.Now())
+	if got := nop.allowed([]string{"default"}, time.Now()); len(got) != 1 {
+		t.Errorf("nil circuitBreakers allowed %v, want [default]", got)
+	}
+}
+
+func TestCircuitBreakers(t *testing.T) {
+	cb := newCircuitBreakers(testLogger, map[string]*CircuitBreaker{
+		"email": {FailureRate: 0.5, Window: time.Minute, MinTasks: 4, CoolDown: 30 * time.Second},
+	})
+	qnames := []string{"default", "email"}
+	now := time.Now()
+
+	// failures of a queue without a breaker are not counted.
+	for i := 0; i < 10; i++ {
+		cb.record("default", true, now)
+	}
+	// not enough tasks to trip.
+	for i := 0; i < 3; i++ {
+		cb.record("email", true, now)
+	}
+	if got := cb.allowed(qnames, now); len(got) != 2 {
+		t.Fatalf("allowed = %v after 3 failures, want both queues", got)
+	}
+	// failures older than the window are forgotten.
+	now = now.Add(2 * time.Minute)
+	cb.record("email", true, now)
+	cb.record("email", false, now)
+	cb.record("email", true, now)
+	if got := cb.allowed(qnames, now); len(got) != 2 {
+		t.Fatalf("allowed = %v after 2 failures out of 3 tasks in the window, want both queues", got)
+	}
+	now = now.Add(time.Second)
+	cb.record("email", false, now)
+	if got := cb.allowed(qnames, now); len(got) != 2 {
+		t.Fatalf("allowed = %v at 50%% failures, want both queues", got)
+	}
+	cb.record("email", true, now)
+	if diff := cmp.Diff([]string{"default"}, cb.allowed(qnames, now)); diff != "" {
+		t.Fatalf("allowed after the breaker tripped; (-want,+got)\n%s", diff)
+	}
+	// results of the tasks still running are not counted while paused.
+	cb.record("email", true, now.Add(time.Second))
+
+	now = now.Add(30 * time.Second)
+	if got := cb.allowed(qnames, now); len(got) != 2 {
+		t.Fatalf("allowed = %v after the cool-down, want both queues", got)
+	}
+	// failures are counted again from scratch.
+	for i := 0; i < 3; i++ {
+		cb.record("email", true, now)
+	}
+	if got := cb.allowed(qnames, now); len(got) != 2 {
+		t.Errorf("allowed = %v after 3 failures since the cool-down, want both queues", got)
+	}
+}
+
+func TestCircuitBreakersInRegions(t *testing.T) {
+	cb := newCircuitBreakers(testLogger, map[string]*CircuitBreaker{
+		"Email": {FailureRate: 0.5, Window: time.Minute, MinTasks: 2, CoolDown: 30 * time.Second},
+	})
+	qnames := []string{"email@eu", "email@us"}
+	now := time.Now()
+
+	// The breaker configured by the name in any case trips for the queue
+	// in the region, and the queue in the other region keeps running.
+	cb.record("email@eu", true, now)
+	cb.record("email@eu", true, now)
+	if diff := cmp.Diff([]string{"email@us"}, cb.allowed(qnames, now)); diff != "" {
+		t.Errorf("allowed after the breaker of %q tripped; (-want,+got)\n%s", "email@eu", diff)
+	}
+}
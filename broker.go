@@ -0,0 +1,52 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import "github.com/hibiken/asynq/internal/base"
+
+// Broker is a message broker which stores tasks and their states,
+// and delivers tasks to background worker processes.
+//
+// By default, Client and Background use a broker backed by redis.
+// Implement Broker to use another backend, and pass it to
+// NewClientWithBroker and NewBackgroundWithBroker.
+//
+// Broker implementations must be safe for concurrent use by multiple goroutines.
+type Broker = base.Broker
+
+// Types used by Broker methods.
+type (
+	// TaskMessage is the representation of a task stored in a broker.
+	TaskMessage = base.TaskMessage
+
+	// TaskError is the error of a failed attempt to process a task.
+	TaskError = base.TaskError
+
+	// BatchEntry is a task message to be written as part of a batch.
+	BatchEntry = base.BatchEntry
+
+	// ProcessInfo holds information about a background worker process.
+	ProcessInfo = base.ProcessInfo
+
+	// KillSwitch is an emergency stop of processing in all background worker processes.
+	KillSwitch = base.KillSwitch
+
+	// ControlReply is a reply to a control message from a background worker process.
+	ControlReply = base.ControlReply
+
+	// Subscription is a subscription to a pubsub channel.
+	Subscription = base.Subscription
+)
+
+// ErrNoProcessableTask should be returned by Broker.Dequeue
+// if there are no tasks ready to be processed.
+var ErrNoProcessableTask = base.ErrNoProcessableTask
+
+// sharedBroker is a broker owned by the caller, which is not closed by asynq.
+type sharedBroker struct {
+	Broker
+}
+
+func (sharedBroker) Close() error { return nil }
@@ -0,0 +1,59 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"testing"
+	"time"
+)
+
+// recordingBroker records the tasks written to it.
+// Calling other methods panics.
+type recordingBroker struct {
+	Broker
+	enqueued  []*TaskMessage
+	scheduled []*TaskMessage
+	closed    bool
+}
+
+func (b *recordingBroker) Enqueue(msg *TaskMessage) error {
+	b.enqueued = append(b.enqueued, msg)
+	return nil
+}
+
+func (b *recordingBroker) Schedule(msg *TaskMessage, processAt time.Time) error {
+	b.scheduled = append(b.scheduled, msg)
+	return nil
+}
+
+func (b *recordingBroker) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestNewClientWithBroker(t *testing.T) {
+	b := &recordingBroker{}
+	client := NewClientWithBroker(b)
+
+	task := NewTask("send_email", map[string]interface{}{"user_id": 42})
+	if _, err := client.Schedule(task, time.Now()); err != nil {
+		t.Fatalf("(*Client).Schedule returned error: %v", err)
+	}
+	if _, err := client.Schedule(task, time.Now().Add(time.Hour), Queue("low")); err != nil {
+		t.Fatalf("(*Client).Schedule returned error: %v", err)
+	}
+
+	if len(b.enqueued) != 1 || b.enqueued[0].Type != task.Type {
+		t.Errorf("broker has enqueued %v, want one %q task", b.enqueued, task.Type)
+	}
+	if len(b.scheduled) != 1 || b.scheduled[0].Queue != "low" {
+		t.Errorf("broker has scheduled %v, want one task in %q queue", b.scheduled, "low")
+	}
+
+	// The broker is owned by the caller and should not be closed.
+	if err := client.rdb.Close(); err != nil || b.closed {
+		t.Errorf("broker was closed by the client")
+	}
+}
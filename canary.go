@@ -0,0 +1,167 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/rs/xid"
+)
+
+// Canary specifies a heartbeat task which is scheduled periodically to be
+// processed right away, so that it's enqueued by the forwarder and processed
+// by the backgrounds like any other task. A stall of the whole pipeline
+// (e.g. backgrounds not pulling tasks out of the queues or scheduled tasks
+// not being forwarded) can be detected with Inspector.Canary, even when each
+// component seems healthy.
+//
+// Only one of the backgrounds sharing a redis instance schedules the canary
+// at a time. Canary tasks are completed by the backgrounds without calling
+// the handler.
+type Canary struct {
+	// Interval specifies how often to schedule the canary.
+	//
+	// If zero or negative, the canary is scheduled every minute.
+	Interval time.Duration
+
+	// Queue specifies the queue to enqueue the canary in, which should
+	// be processed by the backgrounds.
+	//
+	// If empty, "default" is used.
+	Queue string
+
+	// MaxDelay specifies how long the canary may take from being scheduled
+	// to being completed. The canary is unhealthy if it hasn't been
+	// completed within Interval plus MaxDelay.
+	//
+	// If zero or negative, twice the Interval is used.
+	MaxDelay time.Duration
+}
+
+// canaryTaskType is the type of the canary tasks.
+const canaryTaskType = "asynq:canary"
+
+// canaryLockName is the name of the lock to acquire before enqueuing the canary.
+const canaryLockName = "canary"
+
+// canaryStore is implemented by brokers which keep track of the canary.
+type canaryStore interface {
+	EnqueueCanary(msg *base.TaskMessage, maxAge time.Duration) error
+	CompleteCanary() error
+}
+
+// canaryScheduler periodically schedules the canary task.
+//
+// A nil canaryScheduler does nothing.
+type canaryScheduler struct {
+	logger *asynqLogger
+	rdb    canaryStore
+
+	// locker ensures only one of the backgrounds schedules the canary
+	// at a time, nil if backgrounds don't coordinate.
+	locker Locker
+
+	// queue to enqueue the canary in.
+	queue string
+
+	// maxAge is how long after its completion the canary is stale.
+	maxAge time.Duration
+
+	// channel to communicate back to the long running "canary scheduler" goroutine.
+	done chan struct{}
+
+	// interval between canaries.
+	interval time.Duration
+}
+
+func newCanaryScheduler(logger *asynqLogger, r canaryStore, locker Locker, c *Canary) *canaryScheduler {
+	if r == nil || c == nil {
+		return nil
+	}
+	interval := c.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	maxDelay := c.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = 2 * interval
+	}
+	qname := strings.ToLower(c.Queue)
+	if qname == "" {
+		qname = base.DefaultQueueName
+	}
+	return &canaryScheduler{
+		logger:   logger,
+		rdb:      r,
+		locker:   locker,
+		queue:    qname,
+		maxAge:   interval + maxDelay,
+		done:     make(chan struct{}),
+		interval: interval,
+	}
+}
+
+func (s *canaryScheduler) terminate() {
+	if s == nil {
+		return
+	}
+	s.logger.debug("Canary scheduler shutting down...")
+	// Signal the canary scheduler goroutine to stop.
+	s.done <- struct{}{}
+	if s.locker != nil {
+		if err := s.locker.Unlock(canaryLockName); err != nil {
+			s.logger.warn("Could not release canary lock: %v", err)
+		}
+	}
+}
+
+func (s *canaryScheduler) start(wg *sync.WaitGroup) {
+	if s == nil {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-s.done:
+				s.logger.debug("Canary scheduler done")
+				return
+			case <-time.After(s.interval):
+				s.exec()
+			}
+		}
+	}()
+}
+
+func (s *canaryScheduler) exec() {
+	if s.locker != nil {
+		ok, err := s.locker.Lock(canaryLockName, 3*s.interval)
+		if err != nil {
+			s.logger.error("Could not acquire canary lock: %v", err)
+			return
+		}
+		if !ok {
+			return
+		}
+	}
+	msg := &base.TaskMessage{
+		ID:        xid.New(),
+		Type:      canaryTaskType,
+		Queue:     s.queue,
+		ProcessAt: time.Now().UnixNano(),
+	}
+	if err := s.rdb.EnqueueCanary(msg, s.maxAge); err != nil {
+		s.logger.error("Could not enqueue canary: %v", err)
+	}
+}
+
+// isCanary reports whether the task is a canary.
+func isCanary(msg *base.TaskMessage) bool {
+	return msg.Type == canaryTaskType
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/rs/xid"
+)
+
+// fakeCanaryStore records the canaries enqueued and completed.
+type fakeCanaryStore struct {
+	base.Broker
+	enqueued  []*base.TaskMessage
+	maxAge    time.Duration
+	completed int
+}
+
+func (s *fakeCanaryStore) EnqueueCanary(msg *base.TaskMessage, maxAge time.Duration) error {
+	s.enqueued = append(s.enqueued, msg)
+	s.maxAge = maxAge
+	return nil
+}
+
+func (s *fakeCanaryStore) CompleteCanary() error {
+	s.completed++
+	return nil
+}
+
+func TestCanarySchedulerWithLocker(t *testing.T) {
+	tests := []struct {
+		held         bool
+		wantEnqueued int
+	}{
+		{held: true, wantEnqueued: 1},
+		{held: false, wantEnqueued: 0},
+	}
+
+	for _, tc := range tests {
+		s := &fakeCanaryStore{}
+		l := &fakeLocker{held: tc.held}
+		c := newCanaryScheduler(testLogger, s, l, &Canary{Interval: time.Minute, Queue: "Low"})
+		c.exec()
+		if len(s.enqueued) != tc.wantEnqueued {
+			t.Fatalf("with lock held=%t, enqueued %d canaries, want %d", tc.held, len(s.enqueued), tc.wantEnqueued)
+		}
+		if tc.wantEnqueued > 0 {
+			msg := s.enqueued[0]
+			if msg.Type != canaryTaskType || msg.Queue != "low" {
+				t.Errorf("enqueued canary of type %q in queue %q, want %q in %q", msg.Type, msg.Queue, canaryTaskType, "low")
+			}
+			if want := 3 * time.Minute; s.maxAge != want {
+				t.Errorf("enqueued canary with max age %v, want %v", s.maxAge, want)
+			}
+		}
+		var wg sync.WaitGroup
+		c.start(&wg)
+		c.terminate()
+		wg.Wait()
+		want := []string{canaryLockName}
+		if diff := cmp.Diff(want, l.unlocked); diff != "" {
+			t.Errorf("unlocked %v, want %v; (-want,+got)\n%s", l.unlocked, want, diff)
+		}
+	}
+}
+
+func TestNewCanarySchedulerDisabled(t *testing.T) {
+	if c := newCanaryScheduler(testLogger, &fakeCanaryStore{}, nil, nil); c != nil {
+		t.Errorf("newCanaryScheduler without Canary = %v, want nil", c)
+	}
+	if c := newCanaryScheduler(testLogger, nil, nil, &Canary{}); c != nil {
+		t.Errorf("newCanaryScheduler without store = %v, want nil", c)
+	}
+	// nil scheduler should be safe to start and terminate.
+	var c *canaryScheduler
+	var wg sync.WaitGroup
+	c.start(&wg)
+	c.terminate()
+	wg.Wait()
+}
+
+func TestProcessorCompletesCanary(t *testing.T) {
+	s := &fakeCanaryStore{}
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            s,
+		queues:         defaultQueueConfig,
+		concurrency:    1,
+		retryDelayFunc: defaultDelayFunc,
+		cancelations:   base.NewCancelations(),
+	})
+	canary := &base.TaskMessage{ID: xid.New(), Type: canaryTaskType, Queue: "default"}
+	msg := h.NewTaskMessage("send_email", nil)
+	errFailed := errors.New("SMTP server not responding")
+	var handled []string
+	handler := BulkHandlerFunc(func(ctx context.Context, tasks []*Task) []error {
+		var errs []error
+		for _, t := range tasks {
+			handled = append(handled, t.Type)
+			errs = append(errs, errFailed)
+		}
+		return errs
+	})
+
+	errs := p.processBulk(context.Background(), handler, []*base.TaskMessage{canary, msg})
+
+	if diff := cmp.Diff([]string{"send_email"}, handled); diff != "" {
+		t.Errorf("handler called with %v, want %v; (-want,+got)\n%s", handled, []string{"send_email"}, diff)
+	}
+	if errs[0] != nil || errs[1] != errFailed {
+		t.Errorf("processBulk returned %v, want [<nil> %v]", errs, errFailed)
+	}
+	if s.completed != 1 {
+		t.Errorf("completed %d canaries, want 1", s.completed)
+	}
+}
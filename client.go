@@ -5,11 +5,14 @@
 package asynq
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hibiken/asynq/internal/base"
-	"github.com/hibiken/asynq/internal/rdb"
 	"github.com/rs/xid"
 )
 
@@ -20,13 +23,342 @@ import (
 //
 // Clients are safe for concurrent use by multiple goroutines.
 type Client struct {
-	rdb *rdb.RDB
+	logger     *asynqLogger
+	rdb        base.Broker
+	encoding   base.MessageEncoding
+	dimensions []string
+
+	// codec encodes the payloads, nil if payloads are not encoded.
+	codec PayloadCodec
+
+	// compression compresses large payloads, nil if payloads are
+	// not compressed.
+	compression *Compression
+
+	// encryption encrypts the payloads, nil if payloads are not encrypted.
+	encryption *Encryption
+
+	// signing signs the tasks, nil if tasks are not signed.
+	signing *Signing
+
+	// ackModes holds the ack modes of the task types by type name.
+	ackModes map[string]AckMode
+
+	// buffer holds the tasks written while redis was failing over,
+	// nil if the client doesn't buffer tasks.
+	buffer *failoverBuffer
+
+	// maxPayloadSize is the maximum size of the payloads in bytes,
+	// zero if the size is not limited.
+	maxPayloadSize int
+
+	// quotas holds the max numbers of pending tasks by queue name.
+	quotas map[string]int
+
+	// quotaTimeout is how long to wait for a full queue to have room.
+	quotaTimeout time.Duration
+
+	// shards holds the number of shards of the sharded queues.
+	shards queueShards
+
+	// clock tells the time, the time of the system if nil.
+	clock Clock
+
+	// dedupWindow is how long the content of the tasks is remembered to
+	// drop duplicates, zero to not drop them.
+	dedupWindow time.Duration
+
+	// mu guards defaults.
+	mu sync.RWMutex
+
+	// defaults holds the default options of the task types.
+	defaults map[string][]Option
+
+	// beforeSchedule and afterSchedule are the hooks called around
+	// scheduling each task, nil to not call them.
+	beforeSchedule func(task *Task) error
+	afterSchedule  func(task *Task, info *TaskInfo, err error)
 }
 
 // NewClient and returns a new Client given a redis connection option.
 func NewClient(r RedisConnOpt) *Client {
-	rdb := rdb.NewRDB(createRedisClient(r))
-	return &Client{rdb}
+	return NewClientWithConfig(r, nil)
+}
+
+// ClientConfig specifies the behavior of a Client.
+type ClientConfig struct {
+	// KeyPrefix specifies the namespace of the redis keys, so that multiple
+	// applications can share a redis instance without their queues colliding.
+	//
+	// If the prefix doesn't contain a hash tag (e.g. "asynq:{myapp}"),
+	// the whole prefix is used as the hash tag (e.g. "myapp" becomes "{myapp}"),
+	// so that all keys in the namespace are stored in the same hash slot
+	// in Redis Cluster.
+	//
+	// If unset or empty, the default namespace "{asynq}" is used.
+	KeyPrefix string
+
+	// MessageEncoding specifies how task messages are encoded in redis.
+	//
+	// ProtobufEncoding takes less memory in redis and less CPU time to encode
+	// and decode than JSONEncoding. Backgrounds and Inspectors read messages
+	// in either encoding, so a Client can switch to ProtobufEncoding once all
+	// of them have been upgraded to a version which supports it.
+	//
+	// If unset, JSONEncoding is used.
+	MessageEncoding MessageEncoding
+
+	// PublishWakeups makes the client publish a wakeup via redis pub/sub
+	// whenever it enqueues a task to be processed immediately, so that
+	// orchestration layers which scale the backgrounds down to zero when they
+	// are idle can bring them back when work arrives. See Inspector.WaitForTasks.
+	//
+	// Wakeups are not published for tasks scheduled to be processed in the future.
+	PublishWakeups bool
+
+	// List of payload keys to roll up the task counts by (e.g. "country", "plan").
+	//
+	// The values of the keys are extracted from the payload of each task
+	// when it's scheduled, and the tasks in each state are counted by the
+	// values as they move between the states.
+	// See Inspector.Rollup for details.
+	//
+	// Keys should not contain colons. Tasks without a key are not counted
+	// for the key.
+	RollupDimensions []string
+
+	// FailoverBuffer makes the client buffer tasks in memory while redis
+	// is unavailable for writes (e.g. for the 10-30 seconds of a sentinel
+	// failover), and write them once redis recovers, instead of returning
+	// an error for each call. See FailoverBuffer for details.
+	//
+	// If nil, the client returns the error of redis for each call.
+	FailoverBuffer *FailoverBuffer
+
+	// AckModes specifies when the tasks of each type are acknowledged
+	// (e.g. {"charge_card": asynq.AtMostOnce}). The mode is recorded in
+	// the task message when the task is scheduled, and the Ack option
+	// overrides it for the task. See AckMode for details.
+	//
+	// Tasks of the types not in the map are processed at least once.
+	AckModes map[string]AckMode
+
+	// PayloadCodec encodes the payloads of the tasks in redis (e.g. in
+	// MessagePack, or encrypted). Backgrounds should be configured with
+	// the same codec to decode them. See PayloadCodec for details.
+	//
+	// If nil, payloads are encoded as part of the task messages.
+	PayloadCodec PayloadCodec
+
+	// Compression makes the client compress the payloads larger than
+	// a threshold, to reduce the memory used by large tasks in redis.
+	// Backgrounds of older versions cannot process compressed tasks.
+	// See Compression for details.
+	//
+	// If nil, payloads are not compressed.
+	Compression *Compression
+
+	// Encryption makes the client encrypt the payloads with AES-GCM.
+	// Backgrounds should be configured with the keys to decrypt them.
+	// See Encryption for details.
+	//
+	// If nil, payloads are not encrypted.
+	Encryption *Encryption
+
+	// Signing makes the client sign the tasks with HMAC, so that
+	// backgrounds configured with the key process only the tasks signed
+	// with it. See Signing for details.
+	//
+	// If nil, tasks are not signed.
+	Signing *Signing
+
+	// MaxPayloadSize specifies the maximum size of the payload of a task
+	// in bytes, as stored in redis after being encoded and compressed,
+	// so that oversized payloads (e.g. files which should be stored
+	// elsewhere) are rejected when they're scheduled instead of degrading
+	// redis. Payloads larger than the limit are rejected with
+	// a *PayloadTooLargeError.
+	//
+	// The size of a payload map is the size of its JSON encoding.
+	//
+	// If zero or negative, the size of the payloads is not limited.
+	MaxPayloadSize int
+
+	// QueueQuotas specifies the maximum number of pending tasks by queue
+	// name, so that producers get backpressure when the backgrounds fall
+	// behind instead of filling up redis. Tasks to be processed immediately
+	// are rejected with ErrQueueFull when their queue has as many enqueued
+	// tasks as its quota; tasks scheduled to be processed in the future
+	// are not limited.
+	//
+	// Queues not in the map, or with a zero or negative quota, are not limited.
+	QueueQuotas map[string]int
+
+	// QueueFullTimeout specifies how long Schedule waits for a full queue
+	// to have room before returning ErrQueueFull.
+	//
+	// If zero or negative, Schedule returns ErrQueueFull right away.
+	QueueFullTimeout time.Duration
+
+	// QueueShards specifies the number of shards of the queues by queue
+	// name, so that an extremely busy queue is spread over several redis
+	// lists instead of being bottlenecked on a single key. The tasks of
+	// a sharded queue are enqueued to one of its shards at random.
+	//
+	// Backgrounds should be configured with the same shards to process
+	// the tasks of all the shards. QueueQuotas apply to each shard.
+	//
+	// Queues not in the map, or with fewer than two shards, are not sharded.
+	QueueShards map[string]int
+
+	// DedupWindow drops the tasks scheduled with the same type and payload
+	// as a task scheduled within the window, to absorb the retries of
+	// upstream producers (e.g. webhooks delivered more than once).
+	// Schedule returns ErrDuplicateTask for the dropped tasks. Payloads
+	// are compared by their JSON encoding with the keys sorted, so the
+	// order the values are set in doesn't matter.
+	//
+	// Tasks scheduled in batches and workflow steps are not deduplicated.
+	//
+	// If zero or negative, tasks are not deduplicated.
+	DedupWindow time.Duration
+
+	// Clock tells the time to schedule the tasks at, so that tests can
+	// control whether a task is enqueued or scheduled without sleeping.
+	//
+	// The backgrounds processing the tasks should be configured with the
+	// same clock.
+	//
+	// If unset, the time of the system is used.
+	Clock Clock
+
+	// BeforeSchedule is called with each task before it's scheduled,
+	// including the tasks added to batches and workflow steps, so that
+	// applications can validate the payloads or inject headers (e.g. trace
+	// IDs) for every producer without wrapping the client. The task is
+	// a copy of the one given to Schedule with non-nil Headers and
+	// a shallow copy of the payload, which the hook may modify without
+	// changing the given task. Values nested in the payload are shared
+	// with the given task and should not be modified. If the hook returns
+	// an error, the task is not scheduled and the error is returned to
+	// the caller.
+	//
+	// If nil, tasks are scheduled as given.
+	BeforeSchedule func(task *Task) error
+
+	// AfterSchedule is called after each call to Schedule with the task,
+	// and the info of the scheduled task or the error returned to the
+	// caller, so that applications can emit metrics for every producer.
+	// Tasks added to batches are not reported.
+	//
+	// If nil, no hook is called.
+	AfterSchedule func(task *Task, info *TaskInfo, err error)
+
+	// Logger specifies the logger used by the client to log messages.
+	//
+	// If unset, messages are written to stderr with the standard log package.
+	Logger Logger
+
+	// LogLevel specifies the minimum severity of messages to log.
+	//
+	// If unset, InfoLevel is used.
+	LogLevel LogLevel
+}
+
+// PayloadTooLargeError is returned when scheduling a task whose payload
+// is larger than MaxPayloadSize of the client.
+type PayloadTooLargeError struct {
+	// Type of the task.
+	Type string
+
+	// Size of the payload in bytes.
+	Size int
+
+	// MaxSize is the maximum size of the payloads in bytes.
+	MaxSize int
+}
+
+func (e *PayloadTooLargeError) Error() string {
+	return fmt.Sprintf("asynq: payload of task %q is %d bytes, larger than the max payload size of %d bytes", e.Type, e.Size, e.MaxSize)
+}
+
+// payloadSize returns the size of the payload of the message as stored.
+func payloadSize(msg *base.TaskMessage) (int, error) {
+	if msg.Data != nil {
+		return len(msg.Data), nil
+	}
+	if len(msg.Payload) == 0 {
+		return 0, nil
+	}
+	data, err := json.Marshal(msg.Payload)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// MessageEncoding specifies how task messages are encoded in redis.
+type MessageEncoding int
+
+const (
+	// JSONEncoding encodes task messages in JSON.
+	JSONEncoding MessageEncoding = iota
+
+	// ProtobufEncoding encodes task messages in protocol buffers.
+	ProtobufEncoding
+)
+
+// NewClientWithConfig returns a new Client given a redis connection option
+// and client configuration. cfg may be nil to use the default configuration.
+func NewClientWithConfig(r RedisConnOpt, cfg *ClientConfig) *Client {
+	if cfg == nil {
+		cfg = &ClientConfig{}
+	}
+	rdb := newRDB(r, cfg.KeyPrefix)
+	rdb.SetPublishWakeups(cfg.PublishWakeups)
+	if cfg.Clock != nil {
+		rdb.SetClock(cfg.Clock)
+	}
+	quotas := make(map[string]int)
+	for qname, n := range cfg.QueueQuotas {
+		if n > 0 {
+			quotas[strings.ToLower(qname)] = n
+		}
+	}
+	logger := newLogger(os.Stderr)
+	if cfg.Logger != nil {
+		logger.setBase(cfg.Logger)
+	}
+	if cfg.LogLevel != levelUnspecified {
+		logger.setLevel(cfg.LogLevel)
+	}
+	c := &Client{
+		logger:      logger,
+		rdb:         rdb,
+		encoding:    base.MessageEncoding(cfg.MessageEncoding),
+		dimensions:  cfg.RollupDimensions,
+		codec:       cfg.PayloadCodec,
+		compression: cfg.Compression,
+		encryption:  cfg.Encryption,
+		signing:     cfg.Signing,
+		ackModes:    cfg.AckModes,
+
+		maxPayloadSize: cfg.MaxPayloadSize,
+		quotas:         quotas,
+		quotaTimeout:   cfg.QueueFullTimeout,
+		shards:         newQueueShards(cfg.QueueShards),
+		clock:          cfg.Clock,
+		dedupWindow:    cfg.DedupWindow,
+		beforeSchedule: cfg.BeforeSchedule,
+		afterSchedule:  cfg.AfterSchedule,
+	}
+	c.buffer = newFailoverBuffer(logger, c.write, cfg.FailoverBuffer)
+	return c
+}
+
+// NewClientWithBroker returns a new Client which schedules tasks using the broker.
+func NewClientWithBroker(b Broker) *Client {
+	return &Client{logger: newLogger(os.Stderr), rdb: sharedBroker{b}}
 }
 
 // Option specifies the task processing behavior.
@@ -34,9 +366,19 @@ type Option interface{}
 
 // Internal option representations.
 type (
-	retryOption   int
-	queueOption   string
-	timeoutOption time.Duration
+	retryOption         int
+	queueOption         string
+	timeoutOption       time.Duration
+	regionOption        string
+	correlationIDOption string
+	ackModeOption       AckMode
+	contentTypeOption   string
+	deadlineOption      time.Time
+	workflowStepOption  struct {
+		id        string
+		step      string
+		dependsOn []string
+	}
 )
 
 // MaxRetry returns an option to specify the max number of times
@@ -57,9 +399,50 @@ func Queue(name string) Option {
 	return queueOption(strings.ToLower(name))
 }
 
+// Region returns an option to specify the region in which the task
+// should be processed.
+//
+// The task is enqueued into the region-specific queue, and is processed only
+// by the backgrounds that serve the region (see Regions field of Config).
+//
+// Region name is case-insensitive and the lowercased version is used.
+func Region(name string) Option {
+	return regionOption(strings.ToLower(name))
+}
+
+// CorrelationID returns an option to specify the correlation ID of the task,
+// which identifies a group of related tasks (e.g. tasks spawned by the same
+// user request or API call chain).
+//
+// Tasks with a correlation ID can be looked up with Inspector.ListByCorrelationID.
+func CorrelationID(id string) Option {
+	return correlationIDOption(id)
+}
+
+// Ack returns an option to specify when the task is acknowledged,
+// which determines whether it's processed at least once or at most once.
+//
+// See AckMode for details.
+func Ack(mode AckMode) Option {
+	return ackModeOption(mode)
+}
+
+// ContentType returns an option to specify the content type of the payload
+// recorded in the task message, so that consumers written in other languages
+// can decode it (e.g. ContentTypeProtobuf for a task created with
+// NewBinaryTask).
+//
+// Content types other than ContentTypeJSON require a binary payload.
+// See ContentTypeJSON for the content types backgrounds decode.
+func ContentType(t string) Option {
+	return contentTypeOption(t)
+}
+
 // Timeout returns an option to specify how long a task may run.
 //
-// Zero duration means no limit.
+// Zero duration means no limit, unless the background processing the task
+// has a DefaultTimeout: a zero timeout can't be told apart from no timeout,
+// so the DefaultTimeout applies to the task.
 func Timeout(d time.Duration) Option {
 	return timeoutOption(d)
 }
@@ -68,6 +451,16 @@ type option struct {
 	retry   int
 	queue   string
 	timeout time.Duration
+	region  string
+	ackMode AckMode
+
+	correlationID string
+	contentType   string
+	deadline      time.Time
+
+	workflowID   string
+	workflowStep string
+	dependsOn    []string
 }
 
 func composeOptions(opts ...Option) option {
@@ -84,6 +477,22 @@ func composeOptions(opts ...Option) option {
 			res.queue = string(opt)
 		case timeoutOption:
 			res.timeout = time.Duration(opt)
+		case regionOption:
+			res.region = string(opt)
+		case correlationIDOption:
+			res.correlationID = string(opt)
+		case ackModeOption:
+			res.ackMode = AckMode(opt)
+		case contentTypeOption:
+			res.contentType = string(opt)
+		case deadlineOption:
+			if res.deadline.IsZero() || time.Time(opt).Before(res.deadline) {
+				res.deadline = time.Time(opt)
+			}
+		case workflowStepOption:
+			res.workflowID = opt.id
+			res.workflowStep = opt.step
+			res.dependsOn = opt.dependsOn
 		default:
 			// ignore unexpected option
 		}
@@ -96,29 +505,242 @@ const (
 	defaultMaxRetry = 25
 )
 
+// SetDefaultOptions sets the options of the tasks of the given type scheduled
+// by the client, so that the policies of each task type live in one place
+// instead of being repeated at every call site. The options the task was
+// created with and the options given to Schedule override the default
+// options. Calling SetDefaultOptions again replaces the default options of
+// the type, and calling it without options removes them.
+//
+// Example:
+//
+//	client.SetDefaultOptions("send_email", asynq.Queue("mail"), asynq.MaxRetry(10))
+//	client.Schedule(asynq.NewTask("send_email", payload), time.Now()) // in queue "mail" with 10 retries.
+func (c *Client) SetDefaultOptions(typename string, opts ...Option) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(opts) == 0 {
+		delete(c.defaults, typename)
+		return
+	}
+	if c.defaults == nil {
+		c.defaults = make(map[string][]Option)
+	}
+	c.defaults[typename] = append([]Option(nil), opts...)
+}
+
+// defaultOptions returns the default options of the task type.
+func (c *Client) defaultOptions(typename string) []Option {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.defaults[typename]
+}
+
 // Schedule registers a task to be processed at the specified time.
 //
-// Schedule returns nil if the task is registered successfully,
-// otherwise returns a non-nil error.
+// Schedule returns the info of the registered task if the task is
+// registered successfully, otherwise returns a non-nil error.
+// The ID of the returned task info can be stored to track the task later.
 //
 // opts specifies the behavior of task processing. If there are conflicting
 // Option values the last one overrides others.
-func (c *Client) Schedule(task *Task, processAt time.Time, opts ...Option) error {
+func (c *Client) Schedule(task *Task, processAt time.Time, opts ...Option) (*TaskInfo, error) {
+	info, err := c.schedule(task, processAt, opts...)
+	if c.afterSchedule != nil {
+		c.afterSchedule(task, info, err)
+	}
+	return info, err
+}
+
+func (c *Client) schedule(task *Task, processAt time.Time, opts ...Option) (*TaskInfo, error) {
+	msg, err := c.newTaskMessage(task, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if msg.WorkflowID != "" {
+		return c.enqueueWorkflowStep(msg, composeOptions(opts...).dependsOn, processAt)
+	}
+	var hash string
+	if c.dedupWindow > 0 {
+		if hash, err = c.dedup(task, msg); err != nil {
+			return nil, err
+		}
+	}
+	// the clock is read once, so that the task is reported in the state
+	// it's written in.
+	t := now(c.clock)
+	if err := c.enqueue(msg, processAt, t); err != nil {
+		if hash != "" {
+			c.forget(msg, hash)
+		}
+		return nil, err
+	}
+	if !processAt.After(t) {
+		return newTaskInfo(msg, "enqueued", 0), nil
+	}
+	return newTaskInfo(msg, "scheduled", processAt.Unix()), nil
+}
+
+// newTaskMessage returns a task message for the given task and options
+// with the client's configuration applied.
+func (c *Client) newTaskMessage(task *Task, opts ...Option) (*base.TaskMessage, error) {
+	if c.beforeSchedule != nil {
+		headers := copyHeaders(task.Headers)
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		payload := Payload{data: copyPayload(task.Payload.data), raw: task.Payload.raw}
+		task = &Task{Type: task.Type, Payload: payload, Headers: headers, opts: task.opts}
+		if err := c.beforeSchedule(task); err != nil {
+			return nil, err
+		}
+	}
+	// options given to the call override the options of the task, which
+	// override the default options of the type, which override the mode
+	// of the type.
+	if len(task.opts) > 0 {
+		opts = append(append([]Option(nil), task.opts...), opts...)
+	}
+	if defaults := c.defaultOptions(task.Type); len(defaults) > 0 {
+		opts = append(append([]Option(nil), defaults...), opts...)
+	}
+	if mode, ok := c.ackModes[task.Type]; ok {
+		opts = append([]Option{Ack(mode)}, opts...)
+	}
+	msg := newTaskMessage(task, opts...)
+	if err := checkContentType(msg); err != nil {
+		return nil, err
+	}
+	msg.Queue = c.shards.pick(msg.Queue)
+	msg.Encoding = c.encoding
+	for _, dim := range c.dimensions {
+		v, ok := task.Payload.data[dim]
+		if !ok {
+			continue
+		}
+		if msg.Dimensions == nil {
+			msg.Dimensions = make(map[string]string)
+		}
+		msg.Dimensions[dim] = fmt.Sprint(v)
+	}
+	if err := encodePayload(c.codec, msg); err != nil {
+		return nil, err
+	}
+	if err := compressPayload(c.compression, msg); err != nil {
+		return nil, err
+	}
+	if err := encryptPayload(c.encryption, msg); err != nil {
+		return nil, err
+	}
+	if err := signTask(c.signing, msg); err != nil {
+		return nil, err
+	}
+	if c.maxPayloadSize > 0 {
+		n, err := payloadSize(msg)
+		if err != nil {
+			return nil, err
+		}
+		if n > c.maxPayloadSize {
+			return nil, &PayloadTooLargeError{Type: task.Type, Size: n, MaxSize: c.maxPayloadSize}
+		}
+	}
+	return msg, nil
+}
+
+// newTaskMessage returns a task message for the given task and options.
+func newTaskMessage(task *Task, opts ...Option) *base.TaskMessage {
 	opt := composeOptions(opts...)
+	qname := opt.queue
+	if opt.region != "" {
+		qname = regionQueue(qname, opt.region)
+	}
 	msg := &base.TaskMessage{
 		ID:      xid.New(),
 		Type:    task.Type,
 		Payload: task.Payload.data,
-		Queue:   opt.queue,
+		Data:    task.Payload.raw,
+		Queue:   qname,
 		Retry:   opt.retry,
 		Timeout: opt.timeout.String(),
+		Headers: copyHeaders(task.Headers),
+
+		CorrelationID: opt.correlationID,
+		AtMostOnce:    opt.ackMode == AtMostOnce,
+		ContentType:   opt.contentType,
+		WorkflowID:    opt.workflowID,
+		WorkflowStep:  opt.workflowStep,
 	}
-	return c.enqueue(msg, processAt)
+	if !opt.deadline.IsZero() {
+		msg.Deadline = opt.deadline.UnixNano()
+	}
+	return msg
 }
 
-func (c *Client) enqueue(msg *base.TaskMessage, processAt time.Time) error {
-	if time.Now().After(processAt) {
-		return c.rdb.Enqueue(msg)
+// copyHeaders returns a copy of the headers, nil if there are none.
+func copyHeaders(headers map[string]string) map[string]string {
+	if len(headers) == 0 {
+		return nil
+	}
+	res := make(map[string]string, len(headers))
+	for k, v := range headers {
+		res[k] = v
 	}
-	return c.rdb.Schedule(msg, processAt)
+	return res
+}
+
+// copyPayload returns a shallow copy of the payload data, nil if the
+// data is nil.
+func copyPayload(data map[string]interface{}) map[string]interface{} {
+	if data == nil {
+		return nil
+	}
+	res := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		res[k] = v
+	}
+	return res
+}
+
+// enqueue writes the task to be processed at processAt, given the current
+// time t, or buffers it while redis is failing over.
+func (c *Client) enqueue(msg *base.TaskMessage, processAt, t time.Time) error {
+	if t.After(processAt) {
+		msg.ProcessAt = t.UnixNano()
+	} else {
+		msg.ProcessAt = processAt.UnixNano()
+	}
+	if c.buffer.buffering() && c.buffer.add(msg, processAt) {
+		return nil
+	}
+	err := c.writeAt(msg, processAt, t)
+	if isFailoverError(err) && c.buffer.add(msg, processAt) {
+		return nil
+	}
+	return err
+}
+
+// write writes the task to redis, enqueueing it within the quota of its
+// queue if it's due. Tasks flushed from the failover buffer are written
+// by write too, so that they count toward the quotas.
+func (c *Client) write(msg *base.TaskMessage, processAt time.Time) error {
+	return c.writeAt(msg, processAt, now(c.clock))
+}
+
+// writeAt is like write, given the current time t.
+func (c *Client) writeAt(msg *base.TaskMessage, processAt, t time.Time) error {
+	due := !processAt.After(t)
+	if max, ok := c.quotas[logicalQueue(msg.Queue)]; ok && due {
+		return c.enqueueWithQuota(msg, max)
+	}
+	return writeTask(c.rdb, msg, processAt, due)
+}
+
+// Flush writes the tasks buffered while redis was failing over, and returns
+// the error of redis if it's still unavailable for writes. It should be
+// called before exiting when the client has FailoverBuffer option, since
+// buffered tasks are lost when the process exits.
+//
+// Flush returns nil if no tasks are buffered.
+func (c *Client) Flush() error {
+	return c.buffer.flush()
 }
@@ -5,6 +5,7 @@
 package asynq
 
 import (
+	"errors"
 	"testing"
 	"time"
 
@@ -87,6 +88,26 @@ func TestClient(t *testing.T) {
 			},
 			wantScheduled: nil, // db is flushed in setup so zset does not exist hence nil
 		},
+		{
+			desc:      "With region option",
+			task:      task,
+			processAt: time.Now(),
+			opts: []Option{
+				Region("EU"),
+			},
+			wantEnqueued: map[string][]*base.TaskMessage{
+				"default@eu": []*base.TaskMessage{
+					&base.TaskMessage{
+						Type:    task.Type,
+						Payload: task.Payload.data,
+						Retry:   defaultMaxRetry,
+						Queue:   "default@eu",
+						Timeout: time.Duration(0).String(),
+					},
+				},
+			},
+			wantScheduled: nil, // db is flushed in setup so zset does not exist hence nil
+		},
 		{
 			desc:      "Negative retry count",
 			task:      task,
@@ -193,22 +214,250 @@ func TestClient(t *testing.T) {
 	for _, tc := range tests {
 		h.FlushDB(t, r) // clean up db before each test case.
 
-		err := client.Schedule(tc.task, tc.processAt, tc.opts...)
+		info, err := client.Schedule(tc.task, tc.processAt, tc.opts...)
 		if err != nil {
 			t.Error(err)
 			continue
 		}
+		wantState := "enqueued"
+		if tc.wantScheduled != nil {
+			wantState = "scheduled"
+		}
+		if info.ID == "" || info.State != wantState || info.Type != tc.task.Type {
+			t.Errorf("%s;\nSchedule returned %+v, want task info with non-empty ID in %q state", tc.desc, info, wantState)
+		}
 
 		for qname, want := range tc.wantEnqueued {
 			gotEnqueued := h.GetEnqueuedMessages(t, r, qname)
-			if diff := cmp.Diff(want, gotEnqueued, h.IgnoreIDOpt); diff != "" {
+			if diff := cmp.Diff(want, gotEnqueued, h.IgnoreIDOpt, h.IgnoreProcessAtOpt); diff != "" {
 				t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, base.QueueKey(qname), diff)
 			}
 		}
 
 		gotScheduled := h.GetScheduledEntries(t, r)
-		if diff := cmp.Diff(tc.wantScheduled, gotScheduled, h.IgnoreIDOpt); diff != "" {
+		if diff := cmp.Diff(tc.wantScheduled, gotScheduled, h.IgnoreIDOpt, h.IgnoreProcessAtOpt); diff != "" {
 			t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, base.ScheduledQueue, diff)
 		}
 	}
 }
+
+func TestClientWithProtobufEncoding(t *testing.T) {
+	r := setup(t)
+	client := NewClientWithConfig(&RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   14,
+	}, &ClientConfig{MessageEncoding: ProtobufEncoding})
+
+	task := NewTask("send_email", map[string]interface{}{"user_id": 42})
+	if _, err := client.Schedule(task, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	data := r.LRange(base.QueueKey("default"), 0, -1).Val()
+	if len(data) != 1 || len(data[0]) == 0 || data[0][0] != 0 {
+		t.Fatalf("%q has %q, want one protobuf encoded message", base.QueueKey("default"), data)
+	}
+	want := []*base.TaskMessage{{
+		Type:     task.Type,
+		Payload:  map[string]interface{}{"user_id": 42.0},
+		Queue:    "default",
+		Retry:    defaultMaxRetry,
+		Timeout:  time.Duration(0).String(),
+		Encoding: base.ProtobufEncoding,
+	}}
+	got := h.GetEnqueuedMessages(t, r, "default")
+	if diff := cmp.Diff(want, got, h.IgnoreIDOpt, h.IgnoreProcessAtOpt); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.QueueKey("default"), diff)
+	}
+}
+
+func TestClientMaxPayloadSize(t *testing.T) {
+	b := &recordingBroker{}
+	client := &Client{rdb: sharedBroker{b}, maxPayloadSize: 32}
+
+	tests := []struct {
+		task    *Task
+		wantErr *PayloadTooLargeError
+	}{
+		{NewTask("send_email", map[string]interface{}{"to": "user@example.com"}), nil},
+		{NewTask("send_email", nil), nil},
+		{NewTask("send_email", map[string]interface{}{"to": "user@example.com", "body": "Hello!"}), &PayloadTooLargeError{Type: "send_email", Size: 41, MaxSize: 32}},
+		{NewBinaryTask("thumbnail", make([]byte, 32)), nil},
+		{NewBinaryTask("thumbnail", make([]byte, 33)), &PayloadTooLargeError{Type: "thumbnail", Size: 33, MaxSize: 32}},
+	}
+
+	for _, tc := range tests {
+		b.enqueued = nil
+		_, err := client.Schedule(tc.task, time.Now())
+		if tc.wantErr == nil {
+			if err != nil {
+				t.Errorf("Schedule(%q) returned error: %v", tc.task.Type, err)
+			}
+			continue
+		}
+		if diff := cmp.Diff(tc.wantErr, err); diff != "" {
+			t.Errorf("Schedule(%q) returned error %v, want %v; (-want,+got)\n%s", tc.task.Type, err, tc.wantErr, diff)
+		}
+		if len(b.enqueued) != 0 {
+			t.Errorf("broker received %d tasks with an oversized payload, want none", len(b.enqueued))
+		}
+	}
+}
+
+func TestClientHeaders(t *testing.T) {
+	b := &recordingBroker{}
+	client := NewClientWithBroker(b)
+	task := NewTask("send_email", map[string]interface{}{"user_id": 42})
+	task.Headers = map[string]string{"trace-id": "4bf92f35", "tenant-id": "acme"}
+	if _, err := client.Schedule(task, time.Now()); err != nil {
+		t.Fatalf("(*Client).Schedule returned error: %v", err)
+	}
+	task.Headers["tenant-id"] = "globex"
+
+	want := map[string]string{"trace-id": "4bf92f35", "tenant-id": "acme"}
+	msg := b.enqueued[0]
+	if diff := cmp.Diff(want, msg.Headers); diff != "" {
+		t.Errorf("enqueued task has headers %v, want %v; (-want,+got)\n%s", msg.Headers, want, diff)
+	}
+	got, err := (&processor{}).transform(msg)
+	if err != nil {
+		t.Fatalf("transform returned error: %v", err)
+	}
+	if diff := cmp.Diff(want, got.Headers); diff != "" {
+		t.Errorf("handler gets task with headers %v, want %v; (-want,+got)\n%s", got.Headers, want, diff)
+	}
+	if _, ok := got.Payload.data["trace-id"]; ok {
+		t.Errorf("handler gets task with headers in the payload %v", got.Payload.data)
+	}
+}
+
+func TestClientSetDefaultOptions(t *testing.T) {
+	b := &recordingBroker{}
+	client := &Client{rdb: b, ackModes: map[string]AckMode{"send_email": AtMostOnce}}
+	client.SetDefaultOptions("send_email", Queue("mail"), MaxRetry(10))
+
+	task := NewTask("send_email", nil)
+	schedule := func(task *Task, opts ...Option) *base.TaskMessage {
+		t.Helper()
+		if _, err := client.Schedule(task, time.Now(), opts...); err != nil {
+			t.Fatalf("(*Client).Schedule returned error: %v", err)
+		}
+		return b.enqueued[len(b.enqueued)-1]
+	}
+	if msg := schedule(task); msg.Queue != "mail" || msg.Retry != 10 || !msg.AtMostOnce {
+		t.Errorf("task scheduled in queue %q with %d retries (at most once: %t), want %q, 10, true", msg.Queue, msg.Retry, msg.AtMostOnce, "mail")
+	}
+	// Options given to the call override the default options.
+	if msg := schedule(task, MaxRetry(3)); msg.Queue != "mail" || msg.Retry != 3 {
+		t.Errorf("task scheduled in queue %q with %d retries, want %q, 3", msg.Queue, msg.Retry, "mail")
+	}
+	if msg := schedule(NewTask("reindex", nil)); msg.Queue != "default" || msg.Retry != defaultMaxRetry {
+		t.Errorf("task of another type scheduled in queue %q with %d retries, want %q, %d", msg.Queue, msg.Retry, "default", defaultMaxRetry)
+	}
+
+	client.SetDefaultOptions("send_email")
+	if msg := schedule(task); msg.Queue != "default" || msg.Retry != defaultMaxRetry {
+		t.Errorf("task scheduled in queue %q with %d retries after removing the defaults, want %q, %d", msg.Queue, msg.Retry, "default", defaultMaxRetry)
+	}
+}
+
+func TestClientScheduleHooks(t *testing.T) {
+	b := &recordingBroker{}
+	client := NewClientWithBroker(b)
+	errInvalid := errors.New("missing recipient")
+	client.beforeSchedule = func(task *Task) error {
+		if _, err := task.Payload.GetString("to"); err != nil {
+			return errInvalid
+		}
+		task.Headers["trace-id"] = "abc123"
+		return nil
+	}
+	type call struct {
+		typename string
+		info     *TaskInfo
+		err      error
+	}
+	var calls []call
+	client.afterSchedule = func(task *Task, info *TaskInfo, err error) {
+		calls = append(calls, call{task.Type, info, err})
+	}
+
+	task := NewTask("send_email", map[string]interface{}{"to": "user@example.com"})
+	info, err := client.Schedule(task, time.Now())
+	if err != nil {
+		t.Fatalf("(*Client).Schedule returned error: %v", err)
+	}
+	if got := b.enqueued[0].Headers["trace-id"]; got != "abc123" {
+		t.Errorf("trace-id header of the enqueued task = %q, want %q", got, "abc123")
+	}
+	if task.Headers != nil {
+		t.Errorf("headers of the given task = %v, want them unchanged", task.Headers)
+	}
+	if _, err := client.Schedule(NewTask("send_email", nil), time.Now()); err != errInvalid {
+		t.Errorf("(*Client).Schedule with invalid payload returned error %v, want %v", err, errInvalid)
+	}
+	if len(b.enqueued) != 1 {
+		t.Errorf("%d tasks enqueued, want 1", len(b.enqueued))
+	}
+	want := []call{{"send_email", info, nil}, {"send_email", nil, errInvalid}}
+	if len(calls) != len(want) {
+		t.Fatalf("AfterSchedule called %d times, want %d", len(calls), len(want))
+	}
+	for i, c := range calls {
+		if c != want[i] {
+			t.Errorf("AfterSchedule call %d = %+v, want %+v", i, c, want[i])
+		}
+	}
+}
+
+func TestClientBeforeScheduleModifiesPayloadCopy(t *testing.T) {
+	b := &recordingBroker{}
+	client := NewClientWithBroker(b)
+	client.beforeSchedule = func(task *Task) error {
+		task.Payload.data["to"] = "redacted"
+		task.Payload.data["sent_by"] = "hook"
+		return nil
+	}
+
+	task := NewTask("send_email", map[string]interface{}{"to": "user@example.com"})
+	for i := 0; i < 2; i++ {
+		if _, err := client.Schedule(task, time.Now()); err != nil {
+			t.Fatalf("(*Client).Schedule returned error: %v", err)
+		}
+	}
+	want := map[string]interface{}{"to": "user@example.com"}
+	if diff := cmp.Diff(want, task.Payload.data); diff != "" {
+		t.Errorf("payload of the given task modified by the hook; (-want,+got)\n%s", diff)
+	}
+	for _, msg := range b.enqueued {
+		if got := msg.Payload["to"]; got != "redacted" {
+			t.Errorf("payload[%q] of the enqueued task = %v, want %q", "to", got, "redacted")
+		}
+	}
+}
+
+func TestClientTaskOptions(t *testing.T) {
+	b := &recordingBroker{}
+	client := NewClientWithBroker(b)
+	client.SetDefaultOptions("send_email", Queue("mail"), MaxRetry(10))
+
+	task := NewTask("send_email", nil, MaxRetry(3), Timeout(time.Minute))
+	tests := []struct {
+		opts      []Option
+		wantQueue string
+		wantRetry int
+	}{
+		{nil, "mail", 3},
+		{[]Option{MaxRetry(1), Queue("critical")}, "critical", 1},
+	}
+	for _, tc := range tests {
+		if _, err := client.Schedule(task, time.Now(), tc.opts...); err != nil {
+			t.Fatalf("(*Client).Schedule returned error: %v", err)
+		}
+		msg := b.enqueued[len(b.enqueued)-1]
+		if msg.Queue != tc.wantQueue || msg.Retry != tc.wantRetry || msg.Timeout != time.Minute.String() {
+			t.Errorf("task scheduled with %v in queue %q with %d retries and timeout %q, want %q, %d, %q",
+				tc.opts, msg.Queue, msg.Retry, msg.Timeout, tc.wantQueue, tc.wantRetry, time.Minute.String())
+		}
+	}
+}
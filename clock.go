@@ -0,0 +1,28 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// Clock tells the current time.
+//
+// Clients and backgrounds tell the time with a Clock to schedule, forward,
+// retry, and expire tasks, so that tests can fast-forward time with a fake
+// clock (e.g. asynqtest.Clock) instead of sleeping. Leases, heartbeats,
+// and stats are always kept in real time.
+type Clock = base.Clock
+
+// now returns the current time told by the clock, or the time of the system
+// if the clock is nil.
+func now(c Clock) time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// fixedClock tells a fixed time.
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+// retryAtBroker records the times the tasks are retried at.
+type retryAtBroker struct {
+	base.Broker
+
+	mu       sync.Mutex
+	retryAts []time.Time
+}
+
+func (b *retryAtBroker) RetryInQueue(msg *base.TaskMessage, qname string, processAt time.Time, errMsg string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.retryAts = append(b.retryAts, processAt)
+	return nil
+}
+
+func TestProcessorRetryWithClock(t *testing.T) {
+	clock := fixedClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	b := &retryAtBroker{}
+	workerCh := make(chan int)
+	go fakeHeartbeater(workerCh)
+	defer close(workerCh)
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            b,
+		queues:         defaultQueueConfig,
+		concurrency:    1,
+		retryDelayFunc: func(n int, err error, t *Task) time.Duration { return time.Minute },
+		workerCh:       workerCh,
+		cancelations:   base.NewCancelations(),
+		clock:          clock,
+	})
+	p.handler = HandlerFunc(func(ctx context.Context, task *Task) error {
+		return errors.New("payment gateway timed out")
+	})
+
+	p.dispatch(h.NewTaskMessage("charge_card", nil))
+	// wait for the worker to finish.
+	p.sema <- struct{}{}
+	<-p.sema
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	want := clock.Now().Add(time.Minute)
+	if len(b.retryAts) != 1 || !b.retryAts[0].Equal(want) {
+		t.Errorf("tasks retried at %v, want [%v]", b.retryAts, want)
+	}
+}
+
+func TestProcessorDeadlineWithClock(t *testing.T) {
+	// the deadline has passed by the clock, but not in real time.
+	clock := fixedClock(time.Now().Add(time.Hour))
+	b := &killBroker{}
+	workerCh := make(chan int)
+	go fakeHeartbeater(workerCh)
+	defer close(workerCh)
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            b,
+		queues:         defaultQueueConfig,
+		concurrency:    1,
+		retryDelayFunc: defaultDelayFunc,
+		workerCh:       workerCh,
+		cancelations:   base.NewCancelations(),
+		clock:          clock,
+	})
+	called := false
+	p.handler = HandlerFunc(func(ctx context.Context, task *Task) error {
+		called = true
+		return nil
+	})
+
+	msg := h.NewTaskMessage("provision_account", nil)
+	msg.Deadline = time.Now().Add(time.Minute).UnixNano()
+	p.dispatch(msg)
+	// wait for the worker to finish.
+	p.sema <- struct{}{}
+	<-p.sema
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if called {
+		t.Errorf("handler was called for a task past its deadline by the clock")
+	}
+	if len(b.killed) != 1 || b.killed[0].ErrorMsg != errDeadlinePassed.Error() {
+		t.Errorf("killed %v, want the task killed with %q", b.killed, errDeadlinePassed)
+	}
+}
+
+func TestClientScheduleWithClock(t *testing.T) {
+	b := &recordingBroker{}
+	clock := fixedClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	client := &Client{rdb: sharedBroker{b}, clock: clock}
+	task := NewTask("send_email", nil)
+
+	tests := []struct {
+		processAt     time.Time
+		wantState     string
+		wantEnqueued  int
+		wantScheduled int
+	}{
+		// due by the clock, though in the past in real time.
+		{time.Time(clock), "enqueued", 1, 0},
+		{time.Time(clock).Add(-time.Minute), "enqueued", 2, 0},
+		{time.Time(clock).Add(time.Minute), "scheduled", 2, 1},
+	}
+	for _, tc := range tests {
+		info, err := client.Schedule(task, tc.processAt)
+		if err != nil {
+			t.Fatalf("(*Client).Schedule(task, %v) returned error: %v", tc.processAt, err)
+		}
+		if info.State != tc.wantState {
+			t.Errorf("(*Client).Schedule(task, %v) returned a task in state %q, want %q", tc.processAt, info.State, tc.wantState)
+		}
+		if len(b.enqueued) != tc.wantEnqueued || len(b.scheduled) != tc.wantScheduled {
+			t.Errorf("after (*Client).Schedule(task, %v), %d tasks are enqueued and %d scheduled, want %d and %d",
+				tc.processAt, len(b.enqueued), len(b.scheduled), tc.wantEnqueued, tc.wantScheduled)
+		}
+	}
+}
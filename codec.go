@@ -0,0 +1,95 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// PayloadCodec encodes and decodes the payloads of tasks, so that payloads
+// can be stored in redis in an encoding of choice (e.g. MessagePack, or
+// encrypted), while the task messages are handled by asynq as usual.
+//
+// Set the same PayloadCodec to ClientConfig and Config; the name of the
+// codec is recorded in the task messages, and a background decodes only
+// the payloads encoded by the codec of the same name. Binary payloads of
+// the tasks created with NewBinaryTask, and the payloads of the tasks with
+// a ContentType, are not encoded. The name "json" is reserved.
+//
+// A PayloadCodec must be safe for concurrent use by multiple goroutines.
+type PayloadCodec interface {
+	// Name identifies the codec in the task messages (e.g. "msgpack").
+	Name() string
+
+	// Encode encodes the payload.
+	Encode(payload map[string]interface{}) ([]byte, error)
+
+	// Decode decodes the data encoded by Encode.
+	Decode(data []byte) (map[string]interface{}, error)
+}
+
+// encodePayload encodes the payload of the message with the codec.
+//
+// Payloads with a content type are not encoded, since they are decoded
+// by their content type (see ContentTypeJSON).
+func encodePayload(codec PayloadCodec, msg *base.TaskMessage) error {
+	if codec == nil || msg.Data != nil || msg.ContentType != "" {
+		return nil
+	}
+	data, err := codec.Encode(msg.Payload)
+	if err != nil {
+		return fmt.Errorf("asynq: could not encode payload with codec %q: %v", codec.Name(), err)
+	}
+	msg.Payload = nil
+	msg.Data = data
+	msg.Codec = codec.Name()
+	return nil
+}
+
+// jsonCodecName is the codec name of the map payloads encoded in JSON
+// to be compressed. It's reserved and should not be used by a PayloadCodec.
+const jsonCodecName = "json"
+
+// messagePayload returns the payload of the message, decrypting with the
+// keys, decompressing, and decoding the data encoded by a PayloadCodec.
+//
+// It doesn't modify the message, which needs to be kept as is to update
+// the task state in redis.
+func messagePayload(msg *base.TaskMessage, codec PayloadCodec, keys *Encryption) (Payload, error) {
+	if msg.ContentType != "" {
+		return contentPayload(msg, keys)
+	}
+	if msg.Codec == "" && msg.Compression == "" && msg.KeyID == "" {
+		return Payload{data: msg.Payload, raw: msg.Data}, nil
+	}
+	data, err := decrypt(keys, msg.KeyID, msg.Data)
+	if err != nil {
+		return Payload{}, err
+	}
+	data, err = decompress(msg.Compression, data)
+	if err != nil {
+		return Payload{}, err
+	}
+	switch {
+	case msg.Codec == "":
+		return Payload{raw: data}, nil
+	case msg.Codec == jsonCodecName:
+		var payload map[string]interface{}
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return Payload{}, fmt.Errorf("could not decode payload: %v", err)
+		}
+		return Payload{data: payload}, nil
+	case codec == nil || codec.Name() != msg.Codec:
+		return Payload{}, fmt.Errorf("no payload codec %q to decode the payload", msg.Codec)
+	}
+	payload, err := codec.Decode(data)
+	if err != nil {
+		return Payload{}, fmt.Errorf("could not decode payload with codec %q: %v", msg.Codec, err)
+	}
+	return Payload{data: payload}, nil
+}
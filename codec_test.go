@@ -0,0 +1,162 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// reversedJSONCodec encodes payloads in JSON with the bytes reversed,
+// so that the encoded data is not readable as JSON.
+type reversedJSONCodec struct{}
+
+func (reversedJSONCodec) Name() string { return "reversed-json" }
+
+func (reversedJSONCodec) Encode(payload map[string]interface{}) ([]byte, error) {
+	if _, ok := payload["fail"]; ok {
+		return nil, errors.New("cannot encode")
+	}
+	data, err := json.Marshal(payload)
+	return reverse(data), err
+}
+
+func (reversedJSONCodec) Decode(data []byte) (map[string]interface{}, error) {
+	var payload map[string]interface{}
+	err := json.Unmarshal(reverse(data), &payload)
+	return payload, err
+}
+
+func reverse(b []byte) []byte {
+	res := make([]byte, len(b))
+	for i := range b {
+		res[len(b)-1-i] = b[i]
+	}
+	return res
+}
+
+func TestPayloadCodec(t *testing.T) {
+	b := &recordingBroker{}
+	client := &Client{rdb: sharedBroker{b}, codec: reversedJSONCodec{}}
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            &ackBroker{},
+		queues:         defaultQueueConfig,
+		concurrency:    1,
+		retryDelayFunc: defaultDelayFunc,
+		cancelations:   base.NewCancelations(),
+		codec:          reversedJSONCodec{},
+	})
+
+	payload := map[string]interface{}{"user_id": 42.0, "template": "welcome"}
+	if _, err := client.Schedule(NewTask("send_email", payload), time.Now()); err != nil {
+		t.Fatalf("Schedule returned error: %v", err)
+	}
+	if _, err := client.Schedule(NewBinaryTask("resize_image", []byte("PNG")), time.Now()); err != nil {
+		t.Fatalf("Schedule returned error: %v", err)
+	}
+	if len(b.enqueued) != 2 {
+		t.Fatalf("broker received %d tasks, want 2", len(b.enqueued))
+	}
+
+	msg := b.enqueued[0]
+	if msg.Payload != nil || msg.Codec != "reversed-json" || len(msg.Data) == 0 {
+		t.Errorf("enqueued task with Payload=%v Codec=%q Data=%q, want payload encoded by the codec", msg.Payload, msg.Codec, msg.Data)
+	}
+	task, err := p.transform(msg)
+	if err != nil {
+		t.Fatalf("transform returned error: %v", err)
+	}
+	if diff := cmp.Diff(payload, task.Payload.data); diff != "" {
+		t.Errorf("transform decoded payload %v, want %v; (-want,+got)\n%s", task.Payload.data, payload, diff)
+	}
+
+	// binary payloads are not encoded.
+	msg = b.enqueued[1]
+	if msg.Codec != "" || string(msg.Data) != "PNG" {
+		t.Errorf("enqueued binary task with Codec=%q Data=%q, want Codec=%q Data=%q", msg.Codec, msg.Data, "", "PNG")
+	}
+	task, err = p.transform(msg)
+	if err != nil {
+		t.Fatalf("transform returned error: %v", err)
+	}
+	if got := string(task.Payload.Bytes()); got != "PNG" {
+		t.Errorf("transform returned binary payload %q, want %q", got, "PNG")
+	}
+}
+
+func TestPayloadCodecMismatch(t *testing.T) {
+	msg := &base.TaskMessage{Type: "send_email", Data: []byte("{}"), Codec: "msgpack"}
+	for _, codec := range []PayloadCodec{nil, reversedJSONCodec{}} {
+		p := newProcessor(processorParams{
+			logger:         testLogger,
+			rdb:            &ackBroker{},
+			queues:         defaultQueueConfig,
+			concurrency:    1,
+			retryDelayFunc: defaultDelayFunc,
+			cancelations:   base.NewCancelations(),
+			codec:          codec,
+		})
+		if _, err := p.transform(msg); err == nil {
+			t.Errorf("transform with codec %v of payload encoded by %q returned nil error, want non-nil", codec, msg.Codec)
+		}
+	}
+}
+
+func TestPayloadCodecEncodeError(t *testing.T) {
+	b := &recordingBroker{}
+	client := &Client{rdb: sharedBroker{b}, codec: reversedJSONCodec{}}
+	task := NewTask("send_email", map[string]interface{}{"fail": true})
+
+	if _, err := client.Schedule(task, time.Now()); err == nil {
+		t.Errorf("Schedule with payload the codec fails to encode returned nil error, want non-nil")
+	}
+	batch := client.NewBatch()
+	batch.Schedule(task, time.Now())
+	if err := batch.Flush(); err == nil {
+		t.Errorf("Batch.Flush with payload the codec fails to encode returned nil error, want non-nil")
+	}
+	if len(b.enqueued) != 0 {
+		t.Errorf("broker received %d tasks, want 0", len(b.enqueued))
+	}
+}
+
+func TestPayloadCodecWithContentType(t *testing.T) {
+	b := &recordingBroker{}
+	client := &Client{rdb: sharedBroker{b}, codec: reversedJSONCodec{}}
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            &ackBroker{},
+		queues:         defaultQueueConfig,
+		concurrency:    1,
+		retryDelayFunc: defaultDelayFunc,
+		cancelations:   base.NewCancelations(),
+		codec:          reversedJSONCodec{},
+	})
+
+	payload := map[string]interface{}{"user_id": 42.0}
+	if _, err := client.Schedule(NewTask("send_email", payload), time.Now(), ContentType(ContentTypeJSON)); err != nil {
+		t.Fatalf("Schedule returned error: %v", err)
+	}
+	if len(b.enqueued) != 1 {
+		t.Fatalf("broker received %d tasks, want 1", len(b.enqueued))
+	}
+	msg := b.enqueued[0]
+	if msg.Codec != "" {
+		t.Errorf("enqueued task with content type %q and Codec=%q, want no codec", msg.ContentType, msg.Codec)
+	}
+	task, err := p.transform(msg)
+	if err != nil {
+		t.Fatalf("transform returned error: %v", err)
+	}
+	if diff := cmp.Diff(payload, task.Payload.data); diff != "" {
+		t.Errorf("transform decoded payload %v, want %v; (-want,+got)\n%s", task.Payload.data, payload, diff)
+	}
+}
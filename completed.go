@@ -0,0 +1,31 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// completedStore is implemented by brokers which can keep the completed
+// tasks for a while.
+type completedStore interface {
+	Complete(msg *base.TaskMessage, expireAt time.Time) error
+}
+
+// complete marks the task as done, keeping it in the completed state for
+// the retention if it's configured. The workflow step of the task is
+// completed first, so that the steps waiting for it are released even if
+// the process exits before the task is marked as done.
+func (p *processor) complete(msg *base.TaskMessage) error {
+	if err := p.completeStep(msg); err != nil {
+		return err
+	}
+	if p.completions == nil || p.retention <= 0 || isCanary(msg) {
+		return p.rdb.Done(msg)
+	}
+	return p.completions.Complete(msg, now(p.clock).Add(p.retention))
+}
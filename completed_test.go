@@ -0,0 +1,93 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// completingBroker records the tasks marked as done and completed.
+type completingBroker struct {
+	base.Broker
+
+	mu        sync.Mutex
+	done      []*base.TaskMessage
+	completed map[*base.TaskMessage]time.Time
+}
+
+func (b *completingBroker) Done(msg *base.TaskMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.done = append(b.done, msg)
+	return nil
+}
+
+func (b *completingBroker) Complete(msg *base.TaskMessage, expireAt time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.completed == nil {
+		b.completed = make(map[*base.TaskMessage]time.Time)
+	}
+	b.completed[msg] = expireAt
+	return nil
+}
+
+func TestProcessorCompletedRetention(t *testing.T) {
+	tests := []struct {
+		retention     time.Duration
+		typename      string
+		wantCompleted bool
+	}{
+		{time.Hour, "send_email", true},
+		{0, "send_email", false},
+		{time.Hour, canaryTaskType, false},
+	}
+
+	for _, tc := range tests {
+		b := &completingBroker{}
+		workerCh := make(chan int)
+		go fakeHeartbeater(workerCh)
+		p := newProcessor(processorParams{
+			logger:         testLogger,
+			rdb:            b,
+			queues:         defaultQueueConfig,
+			concurrency:    1,
+			retryDelayFunc: defaultDelayFunc,
+			workerCh:       workerCh,
+			cancelations:   base.NewCancelations(),
+			retention:      tc.retention,
+		})
+		p.handler = HandlerFunc(func(ctx context.Context, task *Task) error { return nil })
+		msg := h.NewTaskMessage(tc.typename, nil)
+
+		start := time.Now()
+		p.dispatch(msg)
+		// wait for the worker to finish.
+		p.sema <- struct{}{}
+		<-p.sema
+
+		b.mu.Lock()
+		expireAt, completed := b.completed[msg]
+		wantDone := 1
+		if tc.wantCompleted {
+			wantDone = 0
+		}
+		if completed != tc.wantCompleted || len(b.done) != wantDone {
+			t.Errorf("task %q with retention %v: completed=%t and done %d times, want completed=%t and done %d times",
+				tc.typename, tc.retention, completed, len(b.done), tc.wantCompleted, wantDone)
+		}
+		if completed && expireAt.Before(start.Add(tc.retention)) {
+			t.Errorf("task with retention %v is kept until %v, want after %v", tc.retention, expireAt, start.Add(tc.retention))
+		}
+		b.mu.Unlock()
+		close(workerCh)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// Compression specifies how a Client compresses large payloads in redis.
+//
+// Payloads are compressed with gzip, and the compression is recorded in
+// the task messages, so that backgrounds decompress the payloads before
+// passing them to the handler without any configuration.
+type Compression struct {
+	// Threshold specifies the size in bytes of the encoded payload above
+	// which the payload is compressed. Smaller payloads are stored as is,
+	// since compressing them saves little memory for the CPU time.
+	//
+	// If zero or negative, 1024 bytes is used.
+	Threshold int
+}
+
+// gzipCompression is the compression of the payloads compressed with gzip.
+const gzipCompression = "gzip"
+
+// compressPayload compresses the payload of the message with gzip if it's
+// larger than the threshold, and compressing it makes it smaller.
+func compressPayload(c *Compression, msg *base.TaskMessage) error {
+	if c == nil {
+		return nil
+	}
+	threshold := c.Threshold
+	if threshold <= 0 {
+		threshold = 1024
+	}
+	data := msg.Data
+	if data == nil {
+		var err error
+		if data, err = json.Marshal(msg.Payload); err != nil {
+			return fmt.Errorf("asynq: could not encode payload: %v", err)
+		}
+	}
+	if len(data) <= threshold {
+		return nil
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("asynq: could not compress payload: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("asynq: could not compress payload: %v", err)
+	}
+	if buf.Len() >= len(data) {
+		return nil
+	}
+	if msg.ContentType != "" {
+		// The payload is decoded by the content type, see ContentTypeJSON.
+		msg.Payload = nil
+		msg.Data = buf.Bytes()
+		msg.ContentEncoding = gzipCompression
+		return nil
+	}
+	if msg.Data == nil {
+		msg.Payload = nil
+		msg.Codec = jsonCodecName
+	}
+	msg.Data = buf.Bytes()
+	msg.Compression = gzipCompression
+	return nil
+}
+
+// decompress returns the data decompressed with the given compression.
+func decompress(compression string, data []byte) ([]byte, error) {
+	switch compression {
+	case "":
+		return data, nil
+	case gzipCompression:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress payload: %v", err)
+		}
+		defer r.Close()
+		res, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress payload: %v", err)
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("unknown payload compression %q", compression)
+}
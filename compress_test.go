@@ -0,0 +1,100 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+func TestPayloadCompression(t *testing.T) {
+	body := strings.Repeat("lorem ipsum dolor sit amet ", 100)
+	tests := []struct {
+		desc            string
+		task            *Task
+		codec           PayloadCodec
+		wantCompression string
+	}{
+		{
+			desc:            "large payload",
+			task:            NewTask("send_email", map[string]interface{}{"body": body, "user_id": 42.0}),
+			wantCompression: "gzip",
+		},
+		{
+			desc:            "small payload",
+			task:            NewTask("send_email", map[string]interface{}{"user_id": 42.0}),
+			wantCompression: "",
+		},
+		{
+			desc:            "large binary payload",
+			task:            NewBinaryTask("resize_image", []byte(body)),
+			wantCompression: "gzip",
+		},
+		{
+			desc:            "large payload encoded by codec",
+			task:            NewTask("send_email", map[string]interface{}{"body": body}),
+			codec:           reversedJSONCodec{},
+			wantCompression: "gzip",
+		},
+	}
+
+	for _, tc := range tests {
+		b := &recordingBroker{}
+		client := &Client{rdb: sharedBroker{b}, codec: tc.codec, compression: &Compression{}}
+		p := newProcessor(processorParams{
+			logger:         testLogger,
+			rdb:            &ackBroker{},
+			queues:         defaultQueueConfig,
+			concurrency:    1,
+			retryDelayFunc: defaultDelayFunc,
+			cancelations:   base.NewCancelations(),
+			codec:          tc.codec,
+		})
+
+		if _, err := client.Schedule(tc.task, time.Now()); err != nil {
+			t.Fatalf("%s: Schedule returned error: %v", tc.desc, err)
+		}
+		msg := b.enqueued[0]
+		if msg.Compression != tc.wantCompression {
+			t.Errorf("%s: enqueued task with Compression=%q, want %q", tc.desc, msg.Compression, tc.wantCompression)
+		}
+		if tc.wantCompression != "" && len(msg.Data) >= len(body) {
+			t.Errorf("%s: enqueued task with %d bytes of data, want less than %d", tc.desc, len(msg.Data), len(body))
+		}
+		// Encode the message as stored in redis.
+		data, err := base.EncodeMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := base.DecodeMessage(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := p.transform(decoded)
+		if err != nil {
+			t.Fatalf("%s: transform returned error: %v", tc.desc, err)
+		}
+		if !bytes.Equal(got.Payload.Bytes(), tc.task.Payload.Bytes()) {
+			t.Errorf("%s: transform returned binary payload %q, want %q", tc.desc, got.Payload.Bytes(), tc.task.Payload.Bytes())
+		}
+		if diff := cmp.Diff(tc.task.Payload.data, got.Payload.data); diff != "" {
+			t.Errorf("%s: transform returned payload %v, want %v; (-want,+got)\n%s", tc.desc, got.Payload.data, tc.task.Payload.data, diff)
+		}
+	}
+}
+
+func TestDecompressError(t *testing.T) {
+	if _, err := decompress("gzip", []byte("not gzip")); err == nil {
+		t.Errorf("decompress of invalid data returned nil error, want non-nil")
+	}
+	if _, err := decompress("zstd", []byte{}); err == nil {
+		t.Errorf("decompress with unknown compression returned nil error, want non-nil")
+	}
+}
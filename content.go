@@ -0,0 +1,127 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// Content types of the payloads backgrounds decode, recorded in the task
+// messages so that tasks enqueued by producers written in other languages
+// can be processed alongside the tasks enqueued by a Client.
+//
+// A task message with a content type has its payload in Data (or in Payload
+// for JSON objects), optionally encoded with the content encoding "gzip",
+// and is decoded by the content type regardless of the codec recorded in
+// the message. A task with any other content type or content encoding is
+// moved to the dead queue without being retried.
+const (
+	// ContentTypeJSON is the content type of a payload encoded as a JSON
+	// object, which the handler reads with the getters of Payload.
+	ContentTypeJSON = "application/json"
+
+	// ContentTypeProtobuf is the content type of a payload encoded in
+	// protocol buffers, which the handler reads with Payload.Bytes.
+	ContentTypeProtobuf = "application/protobuf"
+
+	// ContentTypeText is the content type of a plain text payload,
+	// which the handler reads with Payload.Bytes.
+	ContentTypeText = "text/plain"
+)
+
+// contentTypeProtobufAlias is the content type some producers use for
+// protocol buffers.
+const contentTypeProtobufAlias = "application/x-protobuf"
+
+// identityEncoding is the content encoding of data which isn't encoded.
+const identityEncoding = "identity"
+
+// contentError indicates the content type or the content encoding of
+// a task is not supported, in which case the task is never retried.
+type contentError struct {
+	contentType     string
+	contentEncoding string
+}
+
+func (e *contentError) Error() string {
+	if e.contentEncoding != "" {
+		return fmt.Sprintf("unsupported content encoding %q", e.contentEncoding)
+	}
+	return fmt.Sprintf("unsupported content type %q", e.contentType)
+}
+
+// isContentError reports whether err indicates an unsupported payload.
+func isContentError(err error) bool {
+	_, ok := err.(*contentError)
+	return ok
+}
+
+// mediaType returns the media type of the content type without the
+// parameters (e.g. charset), or an empty string if it's malformed.
+func mediaType(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return t
+}
+
+// checkContentType returns an error if the message has a content type
+// which its payload cannot have.
+func checkContentType(msg *base.TaskMessage) error {
+	if msg.ContentType == "" {
+		return nil
+	}
+	switch mediaType(msg.ContentType) {
+	case ContentTypeJSON:
+		return nil
+	case ContentTypeProtobuf, contentTypeProtobufAlias, ContentTypeText:
+		if msg.Data == nil {
+			return fmt.Errorf("asynq: content type %q requires a binary payload", msg.ContentType)
+		}
+		return nil
+	}
+	return fmt.Errorf("asynq: %v", &contentError{contentType: msg.ContentType})
+}
+
+// contentPayload returns the payload of the message decoded by its content
+// type and content encoding, decrypting the data with the keys.
+func contentPayload(msg *base.TaskMessage, keys *Encryption) (Payload, error) {
+	t := mediaType(msg.ContentType)
+	if t == ContentTypeJSON && msg.Data == nil {
+		return Payload{data: msg.Payload}, nil
+	}
+	data, err := decrypt(keys, msg.KeyID, msg.Data)
+	if err != nil {
+		return Payload{}, err
+	}
+	switch msg.ContentEncoding {
+	case "", identityEncoding:
+	case gzipCompression:
+		if data, err = decompress(gzipCompression, data); err != nil {
+			return Payload{}, err
+		}
+	default:
+		return Payload{}, &contentError{contentType: msg.ContentType, contentEncoding: msg.ContentEncoding}
+	}
+	switch t {
+	case ContentTypeJSON:
+		var payload map[string]interface{}
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return Payload{}, fmt.Errorf("could not decode %s payload: %v", ContentTypeJSON, err)
+		}
+		return Payload{data: payload}, nil
+	case ContentTypeProtobuf, contentTypeProtobufAlias, ContentTypeText:
+		if data == nil {
+			data = []byte{}
+		}
+		return Payload{raw: data}, nil
+	}
+	return Payload{}, &contentError{contentType: msg.ContentType}
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestContentPayload(t *testing.T) {
+	tests := []struct {
+		desc     string
+		msg      *base.TaskMessage
+		wantData map[string]interface{}
+		wantRaw  []byte
+	}{
+		{
+			desc:     "json data",
+			msg:      &base.TaskMessage{ContentType: "application/json; charset=utf-8", Data: []byte(`{"user_id":42}`)},
+			wantData: map[string]interface{}{"user_id": 42.0},
+		},
+		{
+			desc:     "json object",
+			msg:      &base.TaskMessage{ContentType: ContentTypeJSON, Payload: map[string]interface{}{"user_id": 42.0}},
+			wantData: map[string]interface{}{"user_id": 42.0},
+		},
+		{
+			desc:     "gzipped json",
+			msg:      &base.TaskMessage{ContentType: ContentTypeJSON, ContentEncoding: "gzip", Data: gzipped(t, []byte(`{"user_id":42}`))},
+			wantData: map[string]interface{}{"user_id": 42.0},
+		},
+		{
+			desc:    "protobuf",
+			msg:     &base.TaskMessage{ContentType: "application/x-protobuf", Data: []byte{0x08, 0x2a}},
+			wantRaw: []byte{0x08, 0x2a},
+		},
+		{
+			desc:    "text",
+			msg:     &base.TaskMessage{ContentType: ContentTypeText, ContentEncoding: "identity", Data: []byte("hello"), Codec: "msgpack"},
+			wantRaw: []byte("hello"),
+		},
+	}
+
+	for _, tc := range tests {
+		got, err := messagePayload(tc.msg, nil, nil)
+		if err != nil {
+			t.Errorf("%s: messagePayload returned error: %v", tc.desc, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.wantData, got.data); diff != "" {
+			t.Errorf("%s: messagePayload returned payload %v, want %v; (-want,+got)\n%s", tc.desc, got.data, tc.wantData, diff)
+		}
+		if !bytes.Equal(got.raw, tc.wantRaw) {
+			t.Errorf("%s: messagePayload returned binary payload %q, want %q", tc.desc, got.raw, tc.wantRaw)
+		}
+	}
+}
+
+func TestContentPayloadUnsupported(t *testing.T) {
+	tests := []*base.TaskMessage{
+		{ContentType: "application/xml", Data: []byte("<task/>")},
+		{ContentType: "not a media type", Data: []byte{}},
+		{ContentType: ContentTypeText, ContentEncoding: "br", Data: []byte("hello")},
+	}
+
+	for _, msg := range tests {
+		_, err := messagePayload(msg, nil, nil)
+		if !isContentError(err) {
+			t.Errorf("messagePayload with content type %q and encoding %q returned error %v, want unsupported content error",
+				msg.ContentType, msg.ContentEncoding, err)
+		}
+	}
+}
+
+func TestClientContentType(t *testing.T) {
+	body := strings.Repeat("lorem ipsum dolor sit amet ", 100)
+	b := &recordingBroker{}
+	client := &Client{rdb: sharedBroker{b}, compression: &Compression{}}
+
+	if _, err := client.Schedule(NewBinaryTask("resize_image", []byte(body)), time.Now(), ContentType(ContentTypeText)); err != nil {
+		t.Fatalf("Schedule returned error: %v", err)
+	}
+	msg := b.enqueued[0]
+	if msg.ContentType != ContentTypeText || msg.ContentEncoding != "gzip" || msg.Compression != "" {
+		t.Errorf("enqueued task with ContentType=%q ContentEncoding=%q Compression=%q, want %q, %q, %q",
+			msg.ContentType, msg.ContentEncoding, msg.Compression, ContentTypeText, "gzip", "")
+	}
+	got, err := messagePayload(msg, nil, nil)
+	if err != nil {
+		t.Fatalf("messagePayload returned error: %v", err)
+	}
+	if string(got.Bytes()) != body {
+		t.Errorf("messagePayload returned %d bytes, want the %d bytes enqueued", len(got.Bytes()), len(body))
+	}
+
+	tests := []struct {
+		task        *Task
+		contentType string
+	}{
+		{NewTask("send_email", map[string]interface{}{"user_id": 42}), ContentTypeProtobuf},
+		{NewBinaryTask("resize_image", []byte{}), "application/xml"},
+	}
+	for _, tc := range tests {
+		if _, err := client.Schedule(tc.task, time.Now(), ContentType(tc.contentType)); err == nil {
+			t.Errorf("Schedule(%q, ContentType(%q)) succeeded, want error", tc.task.Type, tc.contentType)
+		}
+	}
+}
+
+func TestProcessorKillsUnsupportedContent(t *testing.T) {
+	b := &earlyAckBroker{}
+	workerCh := make(chan int)
+	go fakeHeartbeater(workerCh)
+	defer close(workerCh)
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            b,
+		queues:         defaultQueueConfig,
+		concurrency:    1,
+		retryDelayFunc: defaultDelayFunc,
+		workerCh:       workerCh,
+		cancelations:   base.NewCancelations(),
+	})
+	p.handler = HandlerFunc(func(ctx context.Context, task *Task) error {
+		b.record("process")
+		return nil
+	})
+	msg := h.NewTaskMessage("resize_image", nil)
+	msg.ContentType = "application/xml"
+	msg.Data = []byte("<image/>")
+
+	p.dispatch(msg)
+	// wait for the worker to finish.
+	p.sema <- struct{}{}
+	<-p.sema
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	want := []string{"kill"}
+	if diff := cmp.Diff(want, b.events); diff != "" {
+		t.Errorf("broker received %v, want %v; (-want,+got)\n%s", b.events, want, diff)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+type taskMetadataKey struct{}
+
+// taskMetadata holds the metadata of the task being processed.
+type taskMetadata struct {
+	id       string
+	retried  int
+	maxRetry int
+	qname    string
+}
+
+// withTaskMetadata returns a copy of ctx which carries the metadata
+// of the task.
+func withTaskMetadata(ctx context.Context, msg *base.TaskMessage) context.Context {
+	return context.WithValue(ctx, taskMetadataKey{}, &taskMetadata{
+		id:       msg.ID.String(),
+		retried:  msg.Retried,
+		maxRetry: msg.Retry,
+		qname:    msg.Queue,
+	})
+}
+
+// GetTaskID returns the ID of the task being processed.
+//
+// ctx should be the context passed to the handler; GetTaskID returns false
+// if ctx is not a context of a task processed by a background. Contexts of
+// the batches passed to a BulkHandler don't carry the metadata of the tasks.
+func GetTaskID(ctx context.Context) (string, bool) {
+	m, ok := ctx.Value(taskMetadataKey{}).(*taskMetadata)
+	if !ok {
+		return "", false
+	}
+	return m.id, true
+}
+
+// GetRetryCount returns the number of times the task being processed has
+// been retried, which is zero on the first attempt.
+//
+// Example:
+//
+//	func handler(ctx context.Context, task *asynq.Task) error {
+//	    err := sendEmail(task)
+//	    retried, _ := asynq.GetRetryCount(ctx)
+//	    maxRetry, _ := asynq.GetMaxRetry(ctx)
+//	    if err != nil && retried >= maxRetry {
+//	        page("sending email failed for the last time: %v", err)
+//	    }
+//	    return err
+//	}
+//
+// See GetTaskID for the contexts which carry the metadata.
+func GetRetryCount(ctx context.Context) (int, bool) {
+	m, ok := ctx.Value(taskMetadataKey{}).(*taskMetadata)
+	if !ok {
+		return 0, false
+	}
+	return m.retried, true
+}
+
+// GetMaxRetry returns the maximum number of times the task being processed
+// can be retried. The task is not retried if it fails when the retry count
+// has reached the max retry.
+//
+// See GetTaskID for the contexts which carry the metadata.
+func GetMaxRetry(ctx context.Context) (int, bool) {
+	m, ok := ctx.Value(taskMetadataKey{}).(*taskMetadata)
+	if !ok {
+		return 0, false
+	}
+	return m.maxRetry, true
+}
+
+// GetQueueName returns the name of the queue the task being processed
+// was pulled out of.
+//
+// See GetTaskID for the contexts which carry the metadata.
+func GetQueueName(ctx context.Context) (string, bool) {
+	m, ok := ctx.Value(taskMetadataKey{}).(*taskMetadata)
+	if !ok {
+		return "", false
+	}
+	return m.qname, true
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"testing"
+
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+func TestTaskMetadata(t *testing.T) {
+	msg := h.NewTaskMessageWithQueue("send_email", nil, "critical")
+	msg.Retried = 2
+	msg.Retry = 5
+	ctx, cancel := createContext(context.Background(), msg, 0)
+	defer cancel()
+
+	if id, ok := GetTaskID(ctx); !ok || id != msg.ID.String() {
+		t.Errorf("GetTaskID(ctx) = %q, %t, want %q, true", id, ok, msg.ID.String())
+	}
+	if n, ok := GetRetryCount(ctx); !ok || n != 2 {
+		t.Errorf("GetRetryCount(ctx) = %d, %t, want 2, true", n, ok)
+	}
+	if n, ok := GetMaxRetry(ctx); !ok || n != 5 {
+		t.Errorf("GetMaxRetry(ctx) = %d, %t, want 5, true", n, ok)
+	}
+	if qname, ok := GetQueueName(ctx); !ok || qname != "critical" {
+		t.Errorf("GetQueueName(ctx) = %q, %t, want %q, true", qname, ok, "critical")
+	}
+}
+
+func TestTaskMetadataWithoutTask(t *testing.T) {
+	ctx := context.Background()
+	if id, ok := GetTaskID(ctx); ok {
+		t.Errorf("GetTaskID(ctx) = %q, true, want false", id)
+	}
+	if n, ok := GetRetryCount(ctx); ok {
+		t.Errorf("GetRetryCount(ctx) = %d, true, want false", n)
+	}
+	if n, ok := GetMaxRetry(ctx); ok {
+		t.Errorf("GetMaxRetry(ctx) = %d, true, want false", n)
+	}
+	if qname, ok := GetQueueName(ctx); ok {
+		t.Errorf("GetQueueName(ctx) = %q, true, want false", qname)
+	}
+}
+
+type requestIDKey struct{}
+
+func TestProcessorBaseContext(t *testing.T) {
+	b := &earlyAckBroker{}
+	workerCh := make(chan int)
+	go fakeHeartbeater(workerCh)
+	defer close(workerCh)
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            b,
+		queues:         defaultQueueConfig,
+		concurrency:    1,
+		retryDelayFunc: defaultDelayFunc,
+		workerCh:       workerCh,
+		cancelations:   base.NewCancelations(),
+		baseContext: func() context.Context {
+			return context.WithValue(context.Background(), requestIDKey{}, "req-42")
+		},
+	})
+	var got interface{}
+	var id string
+	p.handler = HandlerFunc(func(ctx context.Context, task *Task) error {
+		got = ctx.Value(requestIDKey{})
+		id, _ = GetTaskID(ctx)
+		return nil
+	})
+	msg := h.NewTaskMessage("send_email", nil)
+
+	p.dispatch(msg)
+	// wait for the worker to finish.
+	p.sema <- struct{}{}
+	<-p.sema
+
+	if got != "req-42" {
+		t.Errorf("handler got value %v from the context, want %q", got, "req-42")
+	}
+	if id != msg.ID.String() {
+		t.Errorf("handler got task ID %q, want %q", id, msg.ID.String())
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// controller is responsible for executing commands broadcasted via
+// the control channel (e.g. by asynqmon) and replying with the status of
+// the background worker process.
+type controller struct {
+	logger *asynqLogger
+	rdb    base.Broker
+
+	host string
+	pid  int
+
+	processor *processor
+
+	// channel to send state updates.
+	stateCh chan<- string
+
+	// channel to communicate back to the long running "controller" goroutine.
+	done chan struct{}
+}
+
+func newController(logger *asynqLogger, rdb base.Broker, host string, pid int, processor *processor, stateCh chan<- string) *controller {
+	return &controller{
+		logger:    logger,
+		rdb:       rdb,
+		host:      host,
+		pid:       pid,
+		processor: processor,
+		stateCh:   stateCh,
+		done:      make(chan struct{}),
+	}
+}
+
+func (c *controller) terminate() {
+	c.logger.debug("Controller shutting down...")
+	// Signal the controller goroutine to stop.
+	c.done <- struct{}{}
+}
+
+func (c *controller) start(wg *sync.WaitGroup) {
+	pubsub, err := c.rdb.ControlPubSub()
+	if err != nil {
+		c.logger.error("cannot subscribe to control channel: %v", err)
+		// Keep the goroutine running so that terminate does not block.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-c.done
+		}()
+		return
+	}
+	controlCh := pubsub.Channel()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-c.done:
+				pubsub.Close()
+				c.logger.debug("Controller done")
+				return
+			case m := <-controlCh:
+				var msg base.ControlMessage
+				if err := json.Unmarshal([]byte(m), &msg); err != nil {
+					c.logger.error("could not decode control message: %v", err)
+					continue
+				}
+				c.exec(&msg)
+			}
+		}
+	}()
+}
+
+// exec executes the command in the message and publishes the reply.
+func (c *controller) exec(msg *base.ControlMessage) {
+	var err error
+	switch msg.Command {
+	case "quiet":
+		if !c.processor.isStopped() {
+			c.processor.setQuiet(true)
+			c.stateCh <- "quiet"
+		}
+	case "resume":
+		if c.processor.isStopped() {
+			err = fmt.Errorf("processor has been stopped and cannot be resumed")
+			break
+		}
+		c.processor.setQuiet(false)
+		c.stateCh <- "running"
+	case "loglevel":
+		var level LogLevel
+		level, err = parseLogLevel(msg.Arg)
+		if err == nil {
+			c.logger.setLevel(level)
+		}
+	case "concurrency":
+		var n int
+		n, err = strconv.Atoi(msg.Arg)
+		if err == nil {
+			err = c.processor.setConcurrency(n)
+		}
+	case "recover":
+		err = c.processor.gate.setRecovered(msg.Arg)
+	case "status":
+		// nothing to do, reply with the current status.
+	default:
+		err = fmt.Errorf("unknown command %q", msg.Command)
+	}
+	if err != nil {
+		c.logger.warn("Could not execute control command %q: %v", msg.Command, err)
+	} else {
+		c.logger.info("Executed control command %q", msg.Command)
+	}
+	reply := c.status()
+	if err != nil {
+		reply.ErrorMsg = err.Error()
+	}
+	if err := c.rdb.PublishControlReply(msg.ID, reply); err != nil {
+		c.logger.error("could not publish reply to control message: %v", err)
+	}
+}
+
+// status returns the current status of the process.
+func (c *controller) status() *base.ControlReply {
+	var state string
+	switch {
+	case c.processor.isStopped():
+		state = "stopped"
+	case c.processor.isQuiet():
+		state = "quiet"
+	default:
+		state = "running"
+	}
+	return &base.ControlReply{
+		Host:              c.host,
+		PID:               c.pid,
+		State:             state,
+		Concurrency:       c.processor.getConcurrency(),
+		ActiveWorkerCount: c.processor.activeWorkers(),
+		LogLevel:          c.logger.getLevel().String(),
+	}
+}
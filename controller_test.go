@@ -0,0 +1,118 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+)
+
+func TestController(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	tests := []struct {
+		msg         *base.ControlMessage
+		wantReply   *base.ControlReply
+		wantQuiet   bool
+		wantState   string // state sent to heartbeater, empty if none
+		concurrency int
+	}{
+		{
+			msg: &base.ControlMessage{ID: "id1", Command: "quiet"},
+			wantReply: &base.ControlReply{
+				Host: "localhost", PID: 1234, State: "quiet", Concurrency: 10, LogLevel: "info",
+			},
+			wantQuiet:   true,
+			wantState:   "quiet",
+			concurrency: 10,
+		},
+		{
+			msg: &base.ControlMessage{ID: "id2", Command: "concurrency", Arg: "3"},
+			wantReply: &base.ControlReply{
+				Host: "localhost", PID: 1234, State: "running", Concurrency: 3, LogLevel: "info",
+			},
+			wantQuiet:   false,
+			concurrency: 3,
+		},
+		{
+			msg: &base.ControlMessage{ID: "id3", Command: "concurrency", Arg: "20"},
+			wantReply: &base.ControlReply{
+				Host: "localhost", PID: 1234, State: "running", Concurrency: 10, LogLevel: "info",
+				ErrorMsg: "concurrency should be between 1 and 10",
+			},
+			wantQuiet:   false,
+			concurrency: 10,
+		},
+		{
+			msg: &base.ControlMessage{ID: "id4", Command: "unknown"},
+			wantReply: &base.ControlReply{
+				Host: "localhost", PID: 1234, State: "running", Concurrency: 10, LogLevel: "info",
+				ErrorMsg: `unknown command "unknown"`,
+			},
+			wantQuiet:   false,
+			concurrency: 10,
+		},
+	}
+
+	for _, tc := range tests {
+		stateCh := make(chan string, 1)
+		p := newProcessor(processorParams{
+			logger:         testLogger,
+			rdb:            rdbClient,
+			queues:         defaultQueueConfig,
+			concurrency:    10,
+			retryDelayFunc: defaultDelayFunc,
+			cancelations:   base.NewCancelations(),
+		})
+		c := newController(testLogger, rdbClient, "localhost", 1234, p, stateCh)
+		var wg sync.WaitGroup
+		c.start(&wg)
+
+		pubsub, err := rdbClient.ControlReplyPubSub(tc.msg.ID)
+		if err != nil {
+			c.terminate()
+			t.Fatalf("could not subscribe to reply channel: %v", err)
+		}
+		if err := rdbClient.PublishControl(tc.msg); err != nil {
+			c.terminate()
+			t.Fatalf("could not publish control message: %v", err)
+		}
+
+		select {
+		case m := <-pubsub.Channel():
+			var got base.ControlReply
+			if err := json.Unmarshal([]byte(m.Payload), &got); err != nil {
+				t.Fatalf("could not decode reply: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantReply, &got); diff != "" {
+				t.Errorf("reply to %+v mismatch (-want,+got):\n%s", tc.msg, diff)
+			}
+		case <-time.After(3 * time.Second):
+			t.Errorf("did not receive reply to %+v", tc.msg)
+		}
+		pubsub.Close()
+
+		if got := p.isQuiet(); got != tc.wantQuiet {
+			t.Errorf("processor.isQuiet() = %t, want %t", got, tc.wantQuiet)
+		}
+		if got := p.getConcurrency(); got != tc.concurrency {
+			t.Errorf("processor.getConcurrency() = %d, want %d", got, tc.concurrency)
+		}
+		if tc.wantState != "" {
+			if got := <-stateCh; got != tc.wantState {
+				t.Errorf("state = %q, want %q", got, tc.wantState)
+			}
+		}
+
+		c.terminate()
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+type costsKey struct{}
+
+// AddCost reports that the handler processing the task consumed the given
+// amount of a resource (e.g. AddCost(ctx, "openai_tokens", 1234)).
+//
+// Costs are added up by task type and by value of the rollup dimensions of
+// the task for each day (UTC) when the task is done or fails, and can be read
+// with Inspector.Costs. Resource names should not contain colons.
+//
+// ctx should be the context passed to the handler; AddCost does nothing
+// if ctx is not a context of a task processed by a background.
+func AddCost(ctx context.Context, resource string, amount float64) {
+	c, ok := ctx.Value(costsKey{}).(*costs)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.amounts[resource] += amount
+}
+
+// costs holds the costs reported by the handler of a task.
+type costs struct {
+	mu      sync.Mutex
+	amounts map[string]float64
+}
+
+// withCosts returns a copy of ctx which carries c for AddCost.
+func withCosts(ctx context.Context) (context.Context, *costs) {
+	c := &costs{amounts: make(map[string]float64)}
+	return context.WithValue(ctx, costsKey{}, c), c
+}
+
+// split returns the costs divided evenly among n tasks.
+func (c *costs) split(n int) map[string]float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := make(map[string]float64, len(c.amounts))
+	for resource, amount := range c.amounts {
+		res[resource] = amount / float64(n)
+	}
+	return res
+}
+
+// costStore is implemented by brokers which store costs.
+type costStore interface {
+	AddCosts(msg *base.TaskMessage, costs map[string]float64) error
+}
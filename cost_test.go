@@ -0,0 +1,38 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAddCost(t *testing.T) {
+	ctx, c := withCosts(context.Background())
+	AddCost(ctx, "openai_tokens", 1000)
+	AddCost(ctx, "openai_tokens", 234)
+	AddCost(ctx, "cpu_seconds", 3)
+
+	tests := []struct {
+		n    int
+		want map[string]float64
+	}{
+		{1, map[string]float64{"openai_tokens": 1234, "cpu_seconds": 3}},
+		{2, map[string]float64{"openai_tokens": 617, "cpu_seconds": 1.5}},
+	}
+	for _, tc := range tests {
+		got := c.split(tc.n)
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("costs.split(%d) = %v, want %v; (-want,+got)\n%s", tc.n, got, tc.want, diff)
+		}
+	}
+}
+
+func TestAddCostWithoutTask(t *testing.T) {
+	// AddCost should be a no-op if the context is not of a task.
+	AddCost(context.Background(), "openai_tokens", 1234)
+}
@@ -0,0 +1,51 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// Deadline returns an option to specify the time by which the task must be
+// processed. The context passed to the handler is canceled at the deadline,
+// and the task is moved to the dead queue instead of being processed or
+// retried once the deadline has passed.
+//
+// If the option is given more than once, the earliest deadline is used.
+func Deadline(t time.Time) Option {
+	return deadlineOption(t)
+}
+
+// DeadlineFromContext returns an option to carry the deadline of ctx over
+// to the task (see Deadline), so that the deadline of a request is enforced
+// on the tasks scheduled to serve it. The option has no effect if ctx has
+// no deadline.
+//
+// Example:
+//
+//	func (s *server) handleSignup(w http.ResponseWriter, r *http.Request) {
+//	    task := asynq.NewTask("provision_account", map[string]interface{}{"user_id": 42})
+//	    s.client.Schedule(task, time.Now(), asynq.DeadlineFromContext(r.Context()))
+//	}
+func DeadlineFromContext(ctx context.Context) Option {
+	d, ok := ctx.Deadline()
+	if !ok {
+		return nil
+	}
+	return deadlineOption(d)
+}
+
+// errDeadlinePassed is the error of the tasks dequeued past their deadline.
+var errDeadlinePassed = errors.New("asynq: deadline of the task has passed")
+
+// deadlinePassed reports whether the message has a deadline which has passed
+// at time t.
+func deadlinePassed(msg *base.TaskMessage, t time.Time) bool {
+	return msg.Deadline != 0 && !t.Before(time.Unix(0, msg.Deadline))
+}
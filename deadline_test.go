@@ -0,0 +1,64 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	h "github.com/hibiken/asynq/internal/asynqtest"
+)
+
+func TestDeadlineFromContext(t *testing.T) {
+	deadline := time.Now().Add(time.Minute)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	b := &recordingBroker{}
+	client := NewClientWithBroker(b)
+	task := NewTask("provision_account", nil)
+	if _, err := client.Schedule(task, time.Now(), DeadlineFromContext(ctx)); err != nil {
+		t.Fatalf("(*Client).Schedule returned error: %v", err)
+	}
+	if _, err := client.Schedule(task, time.Now(), DeadlineFromContext(context.Background())); err != nil {
+		t.Fatalf("(*Client).Schedule returned error: %v", err)
+	}
+	// The earliest deadline is used.
+	if _, err := client.Schedule(task, time.Now(), Deadline(deadline.Add(time.Hour)), DeadlineFromContext(ctx)); err != nil {
+		t.Fatalf("(*Client).Schedule returned error: %v", err)
+	}
+	for i, want := range []int64{deadline.UnixNano(), 0, deadline.UnixNano()} {
+		if got := b.enqueued[i].Deadline; got != want {
+			t.Errorf("task %d enqueued with deadline %d, want %d", i, got, want)
+		}
+	}
+
+	msg := b.enqueued[0]
+	msg.Timeout = "1h"
+	taskCtx, cancel := createContext(context.Background(), msg, 0)
+	defer cancel()
+	if got, ok := taskCtx.Deadline(); !ok || !got.Equal(time.Unix(0, msg.Deadline)) {
+		t.Errorf("context of the task has deadline %v, %t, want %v", got, ok, deadline)
+	}
+}
+
+func TestProcessOnceDeadlinePassed(t *testing.T) {
+	called := false
+	handler := HandlerFunc(func(ctx context.Context, task *Task) error {
+		called = true
+		return nil
+	})
+	outcome, err := ProcessOnce(handler, NewTask("provision_account", nil), 0, Deadline(time.Now().Add(-time.Second)))
+	if outcome != OutcomeDead || err != errDeadlinePassed || called {
+		t.Errorf("ProcessOnce past the deadline = %v, %v (handler called: %t), want %v, %v without calling the handler", outcome, err, called, OutcomeDead, errDeadlinePassed)
+	}
+
+	msg := h.NewTaskMessage("provision_account", nil)
+	msg.Deadline = time.Now().Add(-time.Second).UnixNano()
+	if !isFinal(msg, context.DeadlineExceeded, time.Now()) {
+		t.Errorf("isFinal of a task past its deadline = false, want true")
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// ErrDuplicateTask is returned by Client.Schedule when a task of the same
+// type with the same payload was scheduled within the DedupWindow of the
+// client. The task is dropped.
+var ErrDuplicateTask = errors.New("asynq: task with the same content was scheduled within the dedup window")
+
+// dedupStore is implemented by brokers which can record the content of
+// the tasks to drop duplicates.
+type dedupStore interface {
+	Dedup(msg *base.TaskMessage, hash string, ttl time.Duration) (string, error)
+	Forget(msg *base.TaskMessage, hash string) error
+}
+
+// errDedupUnsupported is returned when a task is scheduled with a dedup
+// window with a broker which cannot record the content of the tasks.
+var errDedupUnsupported = errors.New("asynq: broker does not support dedup of tasks")
+
+// contentHash returns the hash of the type and the payload of the task.
+// Payloads are hashed in JSON with the keys sorted, so that payloads with
+// the same values hash the same regardless of the order they were set in.
+func contentHash(task *Task) (string, error) {
+	data := task.Payload.raw
+	if data == nil {
+		var err error
+		if data, err = json.Marshal(task.Payload.data); err != nil {
+			return "", err
+		}
+	}
+	h := sha256.New()
+	h.Write([]byte(task.Type))
+	h.Write([]byte{0})
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// dedup records the content of the task for the dedup window of the client,
+// and returns ErrDuplicateTask if a task with the same content has been
+// recorded within the window. It returns the hash of the content to forget
+// if the task cannot be enqueued.
+func (c *Client) dedup(task *Task, msg *base.TaskMessage) (string, error) {
+	ds, ok := c.rdb.(dedupStore)
+	if !ok {
+		return "", errDedupUnsupported
+	}
+	hash, err := contentHash(task)
+	if err != nil {
+		return "", err
+	}
+	id, err := ds.Dedup(msg, hash, c.dedupWindow)
+	if err != nil {
+		return "", err
+	}
+	if id != "" {
+		c.logger.info("Dropping task type=%s as a duplicate of task id=%s", task.Type, id)
+		return "", ErrDuplicateTask
+	}
+	return hash, nil
+}
+
+// forget deletes the record of the content of the task which could not be
+// enqueued, so that it doesn't drop the retries of the producer.
+func (c *Client) forget(msg *base.TaskMessage, hash string) {
+	if err := c.rdb.(dedupStore).Forget(msg, hash); err != nil {
+		c.logger.warn("Could not delete the dedup record of task id=%s: %v", msg.ID, err)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// dedupBroker records the content of the tasks in memory.
+type dedupBroker struct {
+	recordingBroker
+	seen       map[string]string // hash -> task id
+	enqueueErr error
+}
+
+func (b *dedupBroker) Enqueue(msg *base.TaskMessage) error {
+	if b.enqueueErr != nil {
+		return b.enqueueErr
+	}
+	return b.recordingBroker.Enqueue(msg)
+}
+
+func (b *dedupBroker) Dedup(msg *base.TaskMessage, hash string, ttl time.Duration) (string, error) {
+	if id, ok := b.seen[hash]; ok {
+		return id, nil
+	}
+	b.seen[hash] = msg.ID.String()
+	return "", nil
+}
+
+func (b *dedupBroker) Forget(msg *base.TaskMessage, hash string) error {
+	if b.seen[hash] == msg.ID.String() {
+		delete(b.seen, hash)
+	}
+	return nil
+}
+
+func TestClientDedupWindow(t *testing.T) {
+	b := &dedupBroker{seen: make(map[string]string)}
+	client := &Client{logger: testLogger, rdb: b, dedupWindow: time.Minute}
+
+	schedule := func(task *Task) error {
+		_, err := client.Schedule(task, time.Now())
+		return err
+	}
+	if err := schedule(NewTask("handle_webhook", map[string]interface{}{"event": "paid", "order_id": 42})); err != nil {
+		t.Fatalf("(*Client).Schedule returned error: %v", err)
+	}
+	// Payloads are compared regardless of the order and the types of the numbers.
+	if err := schedule(NewTask("handle_webhook", map[string]interface{}{"order_id": 42.0, "event": "paid"})); err != ErrDuplicateTask {
+		t.Errorf("(*Client).Schedule of the same content returned error %v, want %v", err, ErrDuplicateTask)
+	}
+	if err := schedule(NewTask("handle_webhook", map[string]interface{}{"event": "paid", "order_id": 43})); err != nil {
+		t.Errorf("(*Client).Schedule of another payload returned error: %v", err)
+	}
+	if err := schedule(NewTask("send_receipt", map[string]interface{}{"event": "paid", "order_id": 42})); err != nil {
+		t.Errorf("(*Client).Schedule of another type returned error: %v", err)
+	}
+	if len(b.enqueued) != 3 {
+		t.Errorf("broker received %d tasks, want 3", len(b.enqueued))
+	}
+
+	// Tasks which could not be enqueued don't drop the retries.
+	b.enqueueErr = errors.New("LOADING Redis is loading the dataset in memory")
+	task := NewBinaryTask("handle_webhook", []byte("payload"))
+	if err := schedule(task); err != b.enqueueErr {
+		t.Fatalf("(*Client).Schedule returned error %v, want %v", err, b.enqueueErr)
+	}
+	b.enqueueErr = nil
+	if err := schedule(task); err != nil {
+		t.Errorf("(*Client).Schedule of the task failed to be enqueued returned error: %v", err)
+	}
+}
+
+func TestClientDedupUnsupported(t *testing.T) {
+	client := &Client{logger: testLogger, rdb: &recordingBroker{}, dedupWindow: time.Minute}
+	if _, err := client.Schedule(NewTask("handle_webhook", nil), time.Now()); err != errDedupUnsupported {
+		t.Errorf("(*Client).Schedule returned error %v, want %v", err, errDedupUnsupported)
+	}
+}
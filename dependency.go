@@ -0,0 +1,366 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// Dependency is a downstream service (e.g. an SMTP server or a payment API)
+// that task handlers depend on.
+//
+// While a dependency is down, retries of the tasks of the given types are
+// paused: retry tasks are put back into the retry queue without running
+// the handler or counting them as retries, so that the tasks don't exhaust
+// their retries during a known outage.
+//
+// The outage is stored in redis, so that a dependency reported down by one
+// background pauses the retries in all the backgrounds sharing the redis
+// instance, and stays down across restarts.
+type Dependency struct {
+	// Name identifies the dependency in ReportDependencyDown and
+	// `asynqmon ctl recover [name]` command.
+	Name string
+
+	// List of types of the tasks whose retries are paused while
+	// the dependency is down.
+	TaskTypes []string
+
+	// Probe checks the health of the dependency.
+	//
+	// While the dependency is down, Probe is called every ProbeInterval and
+	// the dependency is marked as recovered once Probe returns nil.
+	//
+	// If nil, the dependency stays down until it is marked as recovered with
+	// `asynqmon ctl recover [name]` command.
+	Probe func() error
+
+	// ProbeInterval specifies how often to call Probe while the dependency is
+	// down, and how long to postpone the paused retries.
+	//
+	// If zero or negative, ten seconds is used.
+	ProbeInterval time.Duration
+
+	// DownTimeout specifies how long the dependency stays down after it was
+	// last reported down or failed a probe, unless it's marked as recovered
+	// earlier, so that the retries resume even if no background is left to
+	// probe the dependency.
+	//
+	// If zero or negative, an hour is used.
+	DownTimeout time.Duration
+}
+
+const (
+	defaultProbeInterval = 10 * time.Second
+	defaultDownTimeout   = time.Hour
+)
+
+// dependencyStore is implemented by brokers which store the outages of
+// the dependencies.
+type dependencyStore interface {
+	// SetDependencyDown marks the named dependency as down for ttl.
+	SetDependencyDown(name string, ttl time.Duration) error
+
+	// ClearDependencyDown marks the named dependency as recovered.
+	ClearDependencyDown(name string) error
+
+	// DependenciesDown returns the names of the given dependencies
+	// which are down.
+	DependenciesDown(names []string) ([]string, error)
+}
+
+// localDependencyStore stores the outages of the dependencies in the process,
+// for brokers which don't store them.
+type localDependencyStore struct {
+	mu sync.Mutex
+
+	// time the outage expires by name of the dependency.
+	down map[string]time.Time
+}
+
+func newLocalDependencyStore() *localDependencyStore {
+	return &localDependencyStore{down: make(map[string]time.Time)}
+}
+
+func (s *localDependencyStore) SetDependencyDown(name string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down[name] = time.Now().Add(ttl)
+	return nil
+}
+
+func (s *localDependencyStore) ClearDependencyDown(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.down, name)
+	return nil
+}
+
+func (s *localDependencyStore) DependenciesDown(names []string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var down []string
+	for _, name := range names {
+		if expireAt, ok := s.down[name]; ok && now.Before(expireAt) {
+			down = append(down, name)
+		}
+	}
+	return down, nil
+}
+
+type dependencyGateKey struct{}
+
+// ReportDependencyDown reports that the named dependency is down, which pauses
+// retries of the tasks depending on it until the dependency recovers.
+//
+// ctx should be the context passed to the handler. Reporting a dependency not
+// listed in Config.Dependencies has no effect.
+//
+// Example:
+//
+//	if err := sendEmail(task); err == errSMTPUnavailable {
+//	    asynq.ReportDependencyDown(ctx, "smtp")
+//	    return err
+//	}
+func ReportDependencyDown(ctx context.Context, name string) {
+	g, ok := ctx.Value(dependencyGateKey{}).(*dependencyGate)
+	if !ok {
+		return
+	}
+	if err := g.setDown(name); err != nil {
+		g.logger.warn("Could not report dependency down: %v", err)
+	}
+}
+
+// dependencyGate keeps track of the health of the dependencies and
+// probes the dependencies which are down.
+//
+// The outages are written to the store, and the dependencies which are
+// down are read back every interval, so that retryPaused doesn't query
+// the store for every task.
+//
+// A nil dependencyGate never pauses retries.
+type dependencyGate struct {
+	logger *asynqLogger
+	store  dependencyStore
+
+	mu sync.Mutex
+
+	// dependencies by name.
+	deps map[string]*Dependency
+
+	// names of the dependencies by task type.
+	depsByType map[string][]string
+
+	// time of the next probe by name of the dependency which is down,
+	// as of the last read from the store.
+	down map[string]time.Time
+
+	// interval between checks for the dependencies to probe.
+	interval time.Duration
+
+	// channel to communicate back to the long running "gate" goroutine.
+	done chan struct{}
+}
+
+// newDependencyGate returns a gate for the dependencies, which stores their
+// outages in store, or in the process if store is nil.
+func newDependencyGate(logger *asynqLogger, deps []*Dependency, store dependencyStore, interval time.Duration) *dependencyGate {
+	if len(deps) == 0 {
+		return nil
+	}
+	if store == nil {
+		store = newLocalDependencyStore()
+	}
+	g := &dependencyGate{
+		logger:     logger,
+		store:      store,
+		deps:       make(map[string]*Dependency),
+		depsByType: make(map[string][]string),
+		down:       make(map[string]time.Time),
+		interval:   interval,
+		done:       make(chan struct{}),
+	}
+	for _, d := range deps {
+		dep := *d
+		if dep.ProbeInterval <= 0 {
+			dep.ProbeInterval = defaultProbeInterval
+		}
+		if dep.DownTimeout <= 0 {
+			dep.DownTimeout = defaultDownTimeout
+		}
+		g.deps[dep.Name] = &dep
+		for _, typename := range dep.TaskTypes {
+			g.depsByType[typename] = append(g.depsByType[typename], dep.Name)
+		}
+	}
+	return g
+}
+
+// withContext returns a copy of ctx which carries the gate
+// for ReportDependencyDown.
+func (g *dependencyGate) withContext(ctx context.Context) context.Context {
+	if g == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, dependencyGateKey{}, g)
+}
+
+// setDown marks the named dependency as down.
+func (g *dependencyGate) setDown(name string) error {
+	dep, ok := g.deps[name]
+	if !ok {
+		return fmt.Errorf("unknown dependency %q", name)
+	}
+	if err := g.store.SetDependencyDown(name, dep.DownTimeout); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.markDown(dep)
+	return nil
+}
+
+// setRecovered marks the named dependency as recovered.
+func (g *dependencyGate) setRecovered(name string) error {
+	if g == nil {
+		return fmt.Errorf("unknown dependency %q", name)
+	}
+	if _, ok := g.deps[name]; !ok {
+		return fmt.Errorf("unknown dependency %q", name)
+	}
+	if err := g.store.ClearDependencyDown(name); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.markRecovered(name)
+	return nil
+}
+
+// markDown records that the dependency is down. g.mu must be held.
+func (g *dependencyGate) markDown(dep *Dependency) {
+	if _, ok := g.down[dep.Name]; !ok {
+		g.logger.warn("Dependency %q is down; Pausing retries of %v tasks", dep.Name, dep.TaskTypes)
+		g.down[dep.Name] = time.Now().Add(dep.ProbeInterval)
+	}
+}
+
+// markRecovered records that the named dependency is up. g.mu must be held.
+func (g *dependencyGate) markRecovered(name string) {
+	if _, ok := g.down[name]; ok {
+		g.logger.info("Dependency %q has recovered; Resuming retries", name)
+		delete(g.down, name)
+	}
+}
+
+// sync reads the dependencies which are down from the store, which may
+// have been reported down or marked as recovered by other backgrounds,
+// or whose outage has expired.
+func (g *dependencyGate) sync() {
+	names := make([]string, 0, len(g.deps))
+	for name := range g.deps {
+		names = append(names, name)
+	}
+	down, err := g.store.DependenciesDown(names)
+	if err != nil {
+		g.logger.warn("Could not read dependencies down: %v", err)
+		return
+	}
+	isDown := make(map[string]bool, len(down))
+	for _, name := range down {
+		isDown[name] = true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for name, dep := range g.deps {
+		if isDown[name] {
+			g.markDown(dep)
+		} else {
+			g.markRecovered(name)
+		}
+	}
+}
+
+// retryPaused reports whether the retry of the task should be paused
+// because one of its dependencies is down, and if so, how long to
+// postpone the retry.
+func (g *dependencyGate) retryPaused(msg *base.TaskMessage) (time.Duration, bool) {
+	if g == nil || msg.Retried == 0 {
+		return 0, false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, name := range g.depsByType[msg.Type] {
+		if _, ok := g.down[name]; ok {
+			return g.deps[name].ProbeInterval, true
+		}
+	}
+	return 0, false
+}
+
+func (g *dependencyGate) terminate() {
+	if g == nil {
+		return
+	}
+	g.logger.debug("Dependency gate shutting down...")
+	// Signal the gate goroutine to stop probing.
+	g.done <- struct{}{}
+}
+
+func (g *dependencyGate) start(wg *sync.WaitGroup) {
+	if g == nil {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-g.done:
+				g.logger.debug("Dependency gate done")
+				return
+			case <-time.After(g.interval):
+				g.sync()
+				g.probe()
+			}
+		}
+	}()
+}
+
+// probe calls the probes of the dependencies which are down
+// and due to be probed.
+func (g *dependencyGate) probe() {
+	now := time.Now()
+	var due []*Dependency
+	g.mu.Lock()
+	for name, next := range g.down {
+		dep := g.deps[name]
+		if dep.Probe != nil && !now.Before(next) {
+			due = append(due, dep)
+			g.down[name] = now.Add(dep.ProbeInterval)
+		}
+	}
+	g.mu.Unlock()
+
+	for _, dep := range due {
+		if err := dep.Probe(); err != nil {
+			g.logger.info("Dependency %q is still down: %v", dep.Name, err)
+			if err := g.store.SetDependencyDown(dep.Name, dep.DownTimeout); err != nil {
+				g.logger.warn("Could not extend outage of dependency %q: %v", dep.Name, err)
+			}
+			continue
+		}
+		if err := g.setRecovered(dep.Name); err != nil {
+			g.logger.warn("Could not mark dependency %q as recovered: %v", dep.Name, err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	h "github.com/hibiken/asynq/internal/asynqtest"
+)
+
+func TestDependencyGate(t *testing.T) {
+	g := newDependencyGate(testLogger, []*Dependency{
+		{Name: "smtp", TaskTypes: []string{"send_email"}, ProbeInterval: time.Minute},
+		{Name: "payments", TaskTypes: []string{"charge"}},
+	}, nil, time.Second)
+
+	retry := h.NewTaskMessage("send_email", nil)
+	retry.Retried = 1
+	first := h.NewTaskMessage("send_email", nil)
+	other := h.NewTaskMessage("charge", nil)
+	other.Retried = 1
+
+	if _, ok := g.retryPaused(retry); ok {
+		t.Errorf("retryPaused(%v) = true before the dependency is reported down, want false", retry)
+	}
+
+	ctx := g.withContext(context.Background())
+	ReportDependencyDown(ctx, "smtp")
+	ReportDependencyDown(ctx, "unknown") // should be ignored
+
+	if d, ok := g.retryPaused(retry); !ok || d != time.Minute {
+		t.Errorf("retryPaused(%v) = %v, %t, want %v, true", retry, d, ok, time.Minute)
+	}
+	if _, ok := g.retryPaused(first); ok {
+		t.Errorf("retryPaused(%v) = true for the first attempt, want false", first)
+	}
+	if _, ok := g.retryPaused(other); ok {
+		t.Errorf("retryPaused(%v) = true for a task not depending on %q, want false", other, "smtp")
+	}
+
+	if err := g.setRecovered("unknown"); err == nil {
+		t.Errorf("setRecovered(%q) returned nil error, want non-nil error", "unknown")
+	}
+	if err := g.setRecovered("smtp"); err != nil {
+		t.Fatalf("setRecovered(%q) returned error: %v", "smtp", err)
+	}
+	if _, ok := g.retryPaused(retry); ok {
+		t.Errorf("retryPaused(%v) = true after the dependency recovered, want false", retry)
+	}
+}
+
+func TestDependencyGateProbe(t *testing.T) {
+	var mu sync.Mutex
+	healthy := false
+	probe := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !healthy {
+			return fmt.Errorf("connection refused")
+		}
+		return nil
+	}
+	g := newDependencyGate(testLogger, []*Dependency{
+		{Name: "smtp", TaskTypes: []string{"send_email"}, Probe: probe, ProbeInterval: 20 * time.Millisecond},
+	}, nil, 10*time.Millisecond)
+	var wg sync.WaitGroup
+	g.start(&wg)
+	defer func() {
+		g.terminate()
+		wg.Wait()
+	}()
+
+	msg := h.NewTaskMessage("send_email", nil)
+	msg.Retried = 1
+	if err := g.setDown("smtp"); err != nil {
+		t.Fatalf("setDown(%q) returned error: %v", "smtp", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := g.retryPaused(msg); !ok {
+		t.Fatalf("retryPaused(%v) = false while probe fails, want true", msg)
+	}
+
+	mu.Lock()
+	healthy = true
+	mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := g.retryPaused(msg); ok {
+		t.Errorf("retryPaused(%v) = true after probe succeeded, want false", msg)
+	}
+}
+
+func TestDependencyGateSharedStore(t *testing.T) {
+	deps := []*Dependency{{Name: "smtp", TaskTypes: []string{"send_email"}}}
+	store := newLocalDependencyStore()
+	g1 := newDependencyGate(testLogger, deps, store, time.Second)
+	g2 := newDependencyGate(testLogger, deps, store, time.Second)
+
+	msg := h.NewTaskMessage("send_email", nil)
+	msg.Retried = 1
+	if err := g1.setDown("smtp"); err != nil {
+		t.Fatalf("setDown(%q) returned error: %v", "smtp", err)
+	}
+	g2.sync()
+	if _, ok := g2.retryPaused(msg); !ok {
+		t.Errorf("retryPaused(%v) = false after another gate reported %q down, want true", msg, "smtp")
+	}
+
+	if err := g1.setRecovered("smtp"); err != nil {
+		t.Fatalf("setRecovered(%q) returned error: %v", "smtp", err)
+	}
+	g2.sync()
+	if _, ok := g2.retryPaused(msg); ok {
+		t.Errorf("retryPaused(%v) = true after another gate marked %q as recovered, want false", msg, "smtp")
+	}
+}
+
+func TestDependencyGateDownTimeout(t *testing.T) {
+	g := newDependencyGate(testLogger, []*Dependency{
+		{Name: "smtp", TaskTypes: []string{"send_email"}, DownTimeout: 20 * time.Millisecond},
+	}, nil, time.Second)
+
+	msg := h.NewTaskMessage("send_email", nil)
+	msg.Retried = 1
+	if err := g.setDown("smtp"); err != nil {
+		t.Fatalf("setDown(%q) returned error: %v", "smtp", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	g.sync()
+	if _, ok := g.retryPaused(msg); ok {
+		t.Errorf("retryPaused(%v) = true after the outage expired, want false", msg)
+	}
+}
+
+func TestNilDependencyGate(t *testing.T) {
+	g := newDependencyGate(testLogger, nil, nil, time.Second)
+	if g != nil {
+		t.Fatalf("newDependencyGate(testLogger, nil) = %v, want nil", g)
+	}
+	msg := h.NewTaskMessage("send_email", nil)
+	msg.Retried = 1
+	if _, ok := g.retryPaused(msg); ok {
+		t.Errorf("retryPaused(%v) = true with no dependencies, want false", msg)
+	}
+	// should not panic.
+	ReportDependencyDown(g.withContext(context.Background()), "smtp")
+}
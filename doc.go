@@ -14,6 +14,41 @@ specify the options using one of RedisConnOpt types.
         DB:       3,
     }
 
+Use RedisFailoverClientOpt to connect to redis via sentinels
+for high availability.
+
+    redis = &asynq.RedisFailoverClientOpt{
+        MasterName:    "mymaster",
+        SentinelAddrs: []string{"localhost:5000", "localhost:5001", "localhost:5002"},
+    }
+
+Set TLSConfig in the options to connect to redis servers that require
+TLS, such as managed redis services with in-transit encryption enabled.
+
+    redis = &asynq.RedisClientOpt{
+        Addr:      "my-redis.example.com:6380",
+        Password:  "secretpassword",
+        TLSConfig: &tls.Config{},
+    }
+
+Use ParseRedisURI to create the options from a URI string,
+for example one provided by an environment variable.
+
+    redis, err := asynq.ParseRedisURI("redis://:secretpassword@localhost:6379/3")
+
+An existing go-redis client can be passed instead of the options, so that
+asynq shares the connection pool and hooks with the rest of the application.
+asynq does not close the client.
+
+    redis := goredis.NewClient(&goredis.Options{Addr: "localhost:6379"})
+
+Applications sharing a redis instance can use different key prefixes
+so that their queues don't collide. The Client and the Background of
+an application should use the same prefix.
+
+    client := asynq.NewClientWithConfig(redis, &asynq.ClientConfig{KeyPrefix: "myapp"})
+    bg := asynq.NewBackground(redis, &asynq.Config{KeyPrefix: "myapp"})
+
 The Client is used to register a task to be processed at the specified time.
 
 Task is created with two parameters: its type and payload.
@@ -25,7 +60,10 @@ Task is created with two parameters: its type and payload.
         map[string]interface{}{"user_id": 42})
 
     // Schedule the task t to be processed a minute from now.
-    err := client.Schedule(t, time.Now().Add(time.Minute))
+    info, err := client.Schedule(t, time.Now().Add(time.Minute))
+
+The returned TaskInfo holds the ID of the task, which can be stored
+to track the task later.
 
 The Background is used to run the background task processing with a given
 handler.
@@ -0,0 +1,84 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// DuplicateDetection specifies how the backgrounds detect the tasks
+// delivered to the handlers more than once, which at-least-once delivery
+// allows (e.g. when the lease of a task expires while a worker is still
+// processing it, or a worker crashes after processing a task).
+//
+// Each background records the attempts of the tasks it starts processing
+// in redis. When an attempt is started again, it logs a warning with the
+// workers which started it, and counts a duplicate delivery, reported by
+// Inspector.CurrentStats and as duplicate_deliveries_total metric by
+// asynqmon. Retries of a task after its handler failed are different
+// attempts, so they're not counted as duplicates, whereas a task retried
+// because its lease expired is the same attempt delivered again.
+type DuplicateDetection struct {
+	// Window specifies how long the attempts are remembered. Attempts
+	// started again after the window are not detected.
+	//
+	// If zero or negative, 24 hours is used.
+	Window time.Duration
+}
+
+// deliveryStore is implemented by brokers which record the deliveries.
+type deliveryStore interface {
+	RecordDelivery(msg *base.TaskMessage, worker string, ttl time.Duration) (string, error)
+}
+
+// duplicateDetector records the attempts started by the background
+// to detect duplicate deliveries.
+//
+// A nil duplicateDetector does nothing.
+type duplicateDetector struct {
+	logger *asynqLogger
+	rdb    deliveryStore
+
+	// worker identifies the background in the logs, "<host>:<pid>".
+	worker string
+
+	// window is how long the attempts are remembered.
+	window time.Duration
+}
+
+func newDuplicateDetector(logger *asynqLogger, r deliveryStore, worker string, cfg *DuplicateDetection) *duplicateDetector {
+	if r == nil || cfg == nil {
+		return nil
+	}
+	window := cfg.Window
+	if window <= 0 {
+		window = 24 * time.Hour
+	}
+	return &duplicateDetector{
+		logger: logger,
+		rdb:    r,
+		worker: worker,
+		window: window,
+	}
+}
+
+// check records that the background started processing the task, and logs
+// a warning if the same attempt has been started before.
+func (d *duplicateDetector) check(msg *base.TaskMessage) {
+	if d == nil {
+		return
+	}
+	first, err := d.rdb.RecordDelivery(msg, d.worker, d.window)
+	if err != nil {
+		d.logger.error("Could not record delivery of task id=%s: %v", msg.ID, err)
+		return
+	}
+	if first != "" {
+		d.logger.warn("Duplicate delivery of task id=%s type=%s retried=%d: started by %s, and again by %s",
+			msg.ID, msg.Type, msg.Retried, first, d.worker)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// deliveryBroker remembers the worker which started each attempt.
+type deliveryBroker struct {
+	ackBroker
+
+	mu         sync.Mutex
+	started    map[string]string
+	duplicates int
+	ttl        time.Duration
+	err        error
+}
+
+func (b *deliveryBroker) RecordDelivery(msg *base.TaskMessage, worker string, ttl time.Duration) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return "", b.err
+	}
+	b.ttl = ttl
+	key := fmt.Sprintf("%s:%d", msg.ID, base.Attempt(msg))
+	if first, ok := b.started[key]; ok {
+		b.duplicates++
+		return first, nil
+	}
+	if b.started == nil {
+		b.started = make(map[string]string)
+	}
+	b.started[key] = worker
+	return "", nil
+}
+
+func TestNewDuplicateDetector(t *testing.T) {
+	b := &deliveryBroker{}
+	if d := newDuplicateDetector(testLogger, b, "localhost:1234", nil); d != nil {
+		t.Errorf("newDuplicateDetector with nil config = %v, want nil", d)
+	}
+	if d := newDuplicateDetector(testLogger, nil, "localhost:1234", &DuplicateDetection{}); d != nil {
+		t.Errorf("newDuplicateDetector with broker which cannot record deliveries = %v, want nil", d)
+	}
+	d := newDuplicateDetector(testLogger, b, "localhost:1234", &DuplicateDetection{})
+	if d == nil || d.window != 24*time.Hour {
+		t.Fatalf("newDuplicateDetector with zero Window = %+v, want window of 24h", d)
+	}
+	// A nil detector does nothing.
+	var nop *duplicateDetector
+	nop.check(h.NewTaskMessage("send_email", nil))
+}
+
+func TestDuplicateDetectorCheck(t *testing.T) {
+	b := &deliveryBroker{}
+	worker1 := newDuplicateDetector(testLogger, b, "host-a:1234", &DuplicateDetection{Window: time.Hour})
+	worker2 := newDuplicateDetector(testLogger, b, "host-b:5678", &DuplicateDetection{Window: time.Hour})
+	msg := h.NewTaskMessage("charge_card", nil)
+
+	worker1.check(msg)
+	worker2.check(msg) // delivered again while the first worker is processing it.
+	retried := *msg
+	retried.Retried++
+	worker2.check(&retried) // a retry is a new attempt.
+
+	if b.duplicates != 1 {
+		t.Errorf("counted %d duplicate deliveries, want 1", b.duplicates)
+	}
+	if b.ttl != time.Hour {
+		t.Errorf("deliveries recorded for %v, want %v", b.ttl, time.Hour)
+	}
+
+	// Processing is not blocked while redis is unavailable.
+	b.err = errors.New("connection refused")
+	worker1.check(msg)
+}
+
+func TestProcessorRecordsDeliveries(t *testing.T) {
+	b := &deliveryBroker{}
+	workerCh := make(chan int)
+	go fakeHeartbeater(workerCh)
+	defer close(workerCh)
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            b,
+		queues:         defaultQueueConfig,
+		concurrency:    1,
+		retryDelayFunc: defaultDelayFunc,
+		workerCh:       workerCh,
+		cancelations:   base.NewCancelations(),
+		duplicates:     newDuplicateDetector(testLogger, b, "localhost:1234", &DuplicateDetection{}),
+	})
+	p.handler = HandlerFunc(func(ctx context.Context, task *Task) error { return nil })
+	msg := h.NewTaskMessage("charge_card", nil)
+
+	// the task is delivered twice, e.g. after its lease expired.
+	for i := 0; i < 2; i++ {
+		p.dispatch(msg)
+		// wait for the worker to finish.
+		p.sema <- struct{}{}
+		<-p.sema
+	}
+
+	want := map[string]string{fmt.Sprintf("%s:0", msg.ID): "localhost:1234"}
+	if diff := cmp.Diff(want, b.started); diff != "" {
+		t.Errorf("recorded deliveries %v, want %v; (-want,+got)\n%s", b.started, want, diff)
+	}
+	if b.duplicates != 1 {
+		t.Errorf("counted %d duplicate deliveries, want 1", b.duplicates)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// Encryption specifies the keys to encrypt the payloads in redis with
+// AES-GCM, so that sensitive data (e.g. PII) in the payloads isn't stored
+// in plaintext.
+//
+// A Client encrypts the payloads with the key of KeyID, and records the
+// key ID in the task messages. Backgrounds decrypt the payloads with the
+// key of the ID recorded before passing them to the handler. To rotate the
+// keys, add the new key to Keys of the backgrounds first, then change KeyID
+// of the clients to the new key, and remove the old key once the tasks
+// encrypted with it have been processed.
+//
+// Inspectors don't decrypt the payloads; the payloads of encrypted tasks
+// are shown as binary payloads.
+type Encryption struct {
+	// KeyID specifies the ID of the key to encrypt the payloads with,
+	// which should be in Keys. Backgrounds ignore it.
+	KeyID string
+
+	// Keys maps the key IDs to the AES keys, of 16, 24, or 32 bytes to
+	// select AES-128, AES-192, or AES-256. Backgrounds need the keys of
+	// all the tasks in redis.
+	Keys map[string][]byte
+}
+
+// aead returns the AES-GCM cipher of the key with the id.
+func (e *Encryption) aead(id string) (cipher.AEAD, error) {
+	key, ok := e.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("no encryption key %q", id)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key %q: %v", id, err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptPayload encrypts the payload of the message with the current key.
+// The nonce is prepended to the encrypted data.
+func encryptPayload(e *Encryption, msg *base.TaskMessage) error {
+	if e == nil {
+		return nil
+	}
+	aead, err := e.aead(e.KeyID)
+	if err != nil {
+		return fmt.Errorf("asynq: %v", err)
+	}
+	data := msg.Data
+	if data == nil {
+		if data, err = json.Marshal(msg.Payload); err != nil {
+			return fmt.Errorf("asynq: could not encode payload: %v", err)
+		}
+		msg.Payload = nil
+		msg.Codec = jsonCodecName
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("asynq: could not encrypt payload: %v", err)
+	}
+	msg.Data = aead.Seal(nonce, nonce, data, nil)
+	msg.KeyID = e.KeyID
+	return nil
+}
+
+// decrypt returns the data decrypted with the key of the id.
+func decrypt(e *Encryption, id string, data []byte) ([]byte, error) {
+	if id == "" {
+		return data, nil
+	}
+	if e == nil {
+		return nil, fmt.Errorf("no encryption key %q to decrypt the payload", id)
+	}
+	aead, err := e.aead(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("could not decrypt payload with key %q: data too short", id)
+	}
+	n := aead.NonceSize()
+	res, err := aead.Open(nil, data[:n], data[n:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt payload with key %q: %v", id, err)
+	}
+	return res, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+var (
+	oldKey = bytes.Repeat([]byte{0x01}, 16)
+	newKey = bytes.Repeat([]byte{0x02}, 32)
+)
+
+func TestPayloadEncryption(t *testing.T) {
+	body := strings.Repeat("lorem ipsum dolor sit amet ", 100)
+	tests := []struct {
+		desc        string
+		task        *Task
+		codec       PayloadCodec
+		compression *Compression
+	}{
+		{
+			desc: "payload",
+			task: NewTask("send_email", map[string]interface{}{"to": "user@example.com", "user_id": 42.0}),
+		},
+		{
+			desc: "binary payload",
+			task: NewBinaryTask("resize_image", []byte("image data")),
+		},
+		{
+			desc:  "payload encoded by codec",
+			task:  NewTask("send_email", map[string]interface{}{"to": "user@example.com"}),
+			codec: reversedJSONCodec{},
+		},
+		{
+			desc:        "compressed payload",
+			task:        NewTask("send_email", map[string]interface{}{"body": body}),
+			compression: &Compression{},
+		},
+	}
+
+	keys := map[string][]byte{"2020-05": oldKey, "2020-06": newKey}
+	for _, tc := range tests {
+		b := &recordingBroker{}
+		client := &Client{
+			rdb:         sharedBroker{b},
+			codec:       tc.codec,
+			compression: tc.compression,
+			encryption:  &Encryption{KeyID: "2020-06", Keys: keys},
+		}
+		p := newProcessor(processorParams{
+			logger:         testLogger,
+			rdb:            &ackBroker{},
+			queues:         defaultQueueConfig,
+			concurrency:    1,
+			retryDelayFunc: defaultDelayFunc,
+			cancelations:   base.NewCancelations(),
+			codec:          tc.codec,
+			encryption:     &Encryption{Keys: keys},
+		})
+
+		if _, err := client.Schedule(tc.task, time.Now()); err != nil {
+			t.Fatalf("%s: Schedule returned error: %v", tc.desc, err)
+		}
+		msg := b.enqueued[0]
+		if msg.KeyID != "2020-06" || msg.Payload != nil {
+			t.Errorf("%s: enqueued task with KeyID=%q and Payload=%v, want KeyID=%q and no payload", tc.desc, msg.KeyID, msg.Payload, "2020-06")
+		}
+		if bytes.Contains(msg.Data, []byte("user@example.com")) || bytes.Contains(msg.Data, []byte("image data")) {
+			t.Errorf("%s: enqueued task with plaintext data %q", tc.desc, msg.Data)
+		}
+		// Encode the message as stored in redis.
+		data, err := base.EncodeMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := base.DecodeMessage(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := p.transform(decoded)
+		if err != nil {
+			t.Fatalf("%s: transform returned error: %v", tc.desc, err)
+		}
+		if !bytes.Equal(got.Payload.Bytes(), tc.task.Payload.Bytes()) {
+			t.Errorf("%s: transform returned binary payload %q, want %q", tc.desc, got.Payload.Bytes(), tc.task.Payload.Bytes())
+		}
+		if diff := cmp.Diff(tc.task.Payload.data, got.Payload.data); diff != "" {
+			t.Errorf("%s: transform returned payload %v, want %v; (-want,+got)\n%s", tc.desc, got.Payload.data, tc.task.Payload.data, diff)
+		}
+	}
+}
+
+func TestPayloadEncryptionKeyRotation(t *testing.T) {
+	b := &recordingBroker{}
+	client := &Client{rdb: sharedBroker{b}, encryption: &Encryption{KeyID: "2020-05", Keys: map[string][]byte{"2020-05": oldKey}}}
+	task := NewTask("send_email", map[string]interface{}{"to": "user@example.com"})
+	if _, err := client.Schedule(task, time.Now()); err != nil {
+		t.Fatalf("Schedule returned error: %v", err)
+	}
+	client.encryption = &Encryption{KeyID: "2020-06", Keys: map[string][]byte{"2020-06": newKey}}
+	if _, err := client.Schedule(task, time.Now()); err != nil {
+		t.Fatalf("Schedule returned error: %v", err)
+	}
+
+	// Backgrounds decrypt the tasks encrypted with both keys.
+	keys := &Encryption{Keys: map[string][]byte{"2020-05": oldKey, "2020-06": newKey}}
+	for _, msg := range b.enqueued {
+		got, err := messagePayload(msg, nil, keys)
+		if err != nil {
+			t.Fatalf("messagePayload of task encrypted with %q returned error: %v", msg.KeyID, err)
+		}
+		if diff := cmp.Diff(task.Payload.data, got.data); diff != "" {
+			t.Errorf("messagePayload of task encrypted with %q = %v, want %v; (-want,+got)\n%s", msg.KeyID, got.data, task.Payload.data, diff)
+		}
+	}
+
+	// Tasks encrypted with a removed key cannot be decrypted.
+	keys = &Encryption{Keys: map[string][]byte{"2020-06": newKey}}
+	if _, err := messagePayload(b.enqueued[0], nil, keys); err == nil {
+		t.Errorf("messagePayload of task encrypted with a removed key returned nil error, want non-nil")
+	}
+	if _, err := messagePayload(b.enqueued[0], nil, nil); err == nil {
+		t.Errorf("messagePayload of encrypted task without keys returned nil error, want non-nil")
+	}
+}
+
+func TestEncryptPayloadError(t *testing.T) {
+	tests := []struct {
+		desc string
+		e    *Encryption
+	}{
+		{"missing key", &Encryption{KeyID: "2020-06", Keys: map[string][]byte{"2020-05": oldKey}}},
+		{"invalid key size", &Encryption{KeyID: "2020-06", Keys: map[string][]byte{"2020-06": []byte("short")}}},
+	}
+
+	for _, tc := range tests {
+		msg := &base.TaskMessage{Type: "send_email", Payload: map[string]interface{}{"to": "user@example.com"}}
+		if err := encryptPayload(tc.e, msg); err == nil {
+			t.Errorf("%s: encryptPayload returned nil error, want non-nil", tc.desc)
+		}
+	}
+}
+
+func TestDecryptTamperedData(t *testing.T) {
+	e := &Encryption{KeyID: "2020-06", Keys: map[string][]byte{"2020-06": newKey}}
+	msg := &base.TaskMessage{Type: "resize_image", Data: []byte("image data")}
+	if err := encryptPayload(e, msg); err != nil {
+		t.Fatal(err)
+	}
+	msg.Data[len(msg.Data)-1] ^= 0xff
+	if _, err := decrypt(e, msg.KeyID, msg.Data); err == nil {
+		t.Errorf("decrypt of tampered data returned nil error, want non-nil")
+	}
+	if _, err := decrypt(e, msg.KeyID, []byte{0x01}); err == nil {
+		t.Errorf("decrypt of truncated data returned nil error, want non-nil")
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// EnvConfig is the configuration read from the environment variables
+// by ConfigFromEnv.
+type EnvConfig struct {
+	// Redis is the redis connection option to pass to NewClientWithConfig,
+	// NewBackground and NewInspector.
+	Redis RedisConnOpt
+
+	// Client is the config of the clients.
+	Client *ClientConfig
+
+	// Background is the config of the backgrounds. Fields not covered by
+	// the environment variables (e.g. Dependencies) can be set before
+	// passing it to NewBackground.
+	Background *Config
+
+	// Inspector is the config of the inspectors.
+	Inspector *InspectorConfig
+}
+
+// ConfigFromEnv returns the configuration of the clients, backgrounds, and
+// inspectors given by the environment variables, so that containerized
+// deployments can be configured without parsing flags in every service.
+//
+// The following variables are read; all of them are optional:
+//
+//	ASYNQ_REDIS_URL              redis URI, see ParseRedisURI (e.g. "rediss://:password@redis:6380/1")
+//	ASYNQ_REDIS_ADDR             redis server address used if ASYNQ_REDIS_URL is unset (default "127.0.0.1:6379")
+//	ASYNQ_REDIS_PASSWORD         redis server password
+//	ASYNQ_REDIS_DB               redis DB number
+//	ASYNQ_REDIS_SENTINEL_ADDRS   comma separated addresses of sentinels, to connect via sentinels
+//	ASYNQ_REDIS_MASTER_NAME      name of the master monitored by the sentinels
+//	ASYNQ_REDIS_CLUSTER_ADDRS    comma separated addresses of cluster nodes, to connect to a cluster
+//	ASYNQ_REDIS_POOL_SIZE        maximum number of socket connections
+//	ASYNQ_REDIS_TLS              "true" to connect using TLS
+//	ASYNQ_REDIS_TLS_SERVER_NAME  server name to verify the certificate of (default host of the address)
+//	ASYNQ_REDIS_TLS_CA_FILE      path to the PEM encoded CA certificates to verify the server with
+//	ASYNQ_NAMESPACE              namespace of the redis keys, see ClientConfig.KeyPrefix
+//	ASYNQ_CONCURRENCY            maximum number of concurrent processing of tasks
+//	ASYNQ_QUEUES                 comma separated queues with weights (e.g. "critical=6,default=3,low")
+//	ASYNQ_STRICT_PRIORITY        "true" to treat queue priority strictly
+//	ASYNQ_REGIONS                comma separated regions the backgrounds serve
+//	ASYNQ_LOG_LEVEL              minimum severity of messages to log (debug, info, warn, or error)
+//
+// A queue without a weight in ASYNQ_QUEUES has weight 1. Setting ASYNQ_REDIS_TLS_SERVER_NAME
+// or ASYNQ_REDIS_TLS_CA_FILE implies ASYNQ_REDIS_TLS.
+//
+// It returns a non-nil error if a variable has an invalid value.
+func ConfigFromEnv() (*EnvConfig, error) {
+	return configFromEnv(os.LookupEnv)
+}
+
+// envReader reads the environment variables, and keeps the first error.
+type envReader struct {
+	lookup func(string) (string, bool)
+	err    error
+}
+
+func (r *envReader) str(name string) string {
+	v, _ := r.lookup(name)
+	return strings.TrimSpace(v)
+}
+
+func (r *envReader) list(name string) []string {
+	var res []string
+	for _, s := range strings.Split(r.str(name), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+func (r *envReader) int(name string) int {
+	s := r.str(name)
+	if s == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		r.fail(name, "should be an integer, got %q", s)
+	}
+	return n
+}
+
+func (r *envReader) bool(name string) bool {
+	s := r.str(name)
+	if s == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		r.fail(name, "should be a boolean, got %q", s)
+	}
+	return b
+}
+
+func (r *envReader) fail(name, format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf("asynq: invalid %s: %s", name, fmt.Sprintf(format, args...))
+	}
+}
+
+func configFromEnv(lookup func(string) (string, bool)) (*EnvConfig, error) {
+	r := &envReader{lookup: lookup}
+	conn := r.redisConnOpt()
+	ns := r.str("ASYNQ_NAMESPACE")
+	bg := &Config{
+		Concurrency:    r.int("ASYNQ_CONCURRENCY"),
+		Queues:         r.queues("ASYNQ_QUEUES"),
+		StrictPriority: r.bool("ASYNQ_STRICT_PRIORITY"),
+		Regions:        r.list("ASYNQ_REGIONS"),
+		KeyPrefix:      ns,
+	}
+	if s := r.str("ASYNQ_LOG_LEVEL"); s != "" {
+		level, err := parseLogLevel(s)
+		if err != nil {
+			r.fail("ASYNQ_LOG_LEVEL", "%v", err)
+		}
+		bg.LogLevel = level
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &EnvConfig{
+		Redis:      conn,
+		Client:     &ClientConfig{KeyPrefix: ns},
+		Background: bg,
+		Inspector:  &InspectorConfig{KeyPrefix: ns},
+	}, nil
+}
+
+// queues parses the queues with weights (e.g. "critical=6,default=3,low").
+func (r *envReader) queues(name string) map[string]int {
+	items := r.list(name)
+	if len(items) == 0 {
+		return nil
+	}
+	res := make(map[string]int)
+	for _, item := range items {
+		qname, weight := item, 1
+		if i := strings.Index(item, "="); i >= 0 {
+			qname = strings.TrimSpace(item[:i])
+			w, err := strconv.Atoi(strings.TrimSpace(item[i+1:]))
+			if err != nil || w < 0 {
+				r.fail(name, "weight of queue %q should be a non-negative integer", qname)
+			}
+			weight = w
+		}
+		if qname == "" {
+			r.fail(name, "queue name should not be empty")
+		}
+		res[qname] = weight
+	}
+	return res
+}
+
+func (r *envReader) redisConnOpt() RedisConnOpt {
+	password := r.str("ASYNQ_REDIS_PASSWORD")
+	poolSize := r.int("ASYNQ_REDIS_POOL_SIZE")
+	if addrs := r.list("ASYNQ_REDIS_CLUSTER_ADDRS"); len(addrs) > 0 {
+		return RedisClusterClientOpt{
+			Addrs:     addrs,
+			Password:  password,
+			PoolSize:  poolSize,
+			TLSConfig: r.tlsConfig(addrs[0]),
+		}
+	}
+	if addrs := r.list("ASYNQ_REDIS_SENTINEL_ADDRS"); len(addrs) > 0 {
+		master := r.str("ASYNQ_REDIS_MASTER_NAME")
+		if master == "" {
+			r.fail("ASYNQ_REDIS_MASTER_NAME", "should be set with ASYNQ_REDIS_SENTINEL_ADDRS")
+		}
+		return RedisFailoverClientOpt{
+			MasterName:    master,
+			SentinelAddrs: addrs,
+			Password:      password,
+			DB:            r.int("ASYNQ_REDIS_DB"),
+			PoolSize:      poolSize,
+			TLSConfig:     r.tlsConfig(addrs[0]),
+		}
+	}
+	if uri := r.str("ASYNQ_REDIS_URL"); uri != "" {
+		opt, err := ParseRedisURI(uri)
+		if err != nil {
+			r.fail("ASYNQ_REDIS_URL", "%v", err)
+			return nil
+		}
+		c, ok := opt.(RedisClientOpt)
+		if !ok {
+			return opt
+		}
+		c.PoolSize = poolSize
+		if tlsConfig := r.tlsConfig(c.Addr); tlsConfig != nil {
+			c.TLSConfig = tlsConfig
+		}
+		return c
+	}
+	addr := r.str("ASYNQ_REDIS_ADDR")
+	if addr == "" {
+		addr = "127.0.0.1:6379"
+	}
+	return RedisClientOpt{
+		Addr:      addr,
+		Password:  password,
+		DB:        r.int("ASYNQ_REDIS_DB"),
+		PoolSize:  poolSize,
+		TLSConfig: r.tlsConfig(addr),
+	}
+}
+
+// tlsConfig returns the TLS config to connect to the server at addr,
+// or nil if TLS is not enabled.
+func (r *envReader) tlsConfig(addr string) *tls.Config {
+	serverName := r.str("ASYNQ_REDIS_TLS_SERVER_NAME")
+	caFile := r.str("ASYNQ_REDIS_TLS_CA_FILE")
+	if !r.bool("ASYNQ_REDIS_TLS") && serverName == "" && caFile == "" {
+		return nil
+	}
+	if serverName == "" {
+		serverName = addr
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			serverName = host
+		}
+	}
+	cfg := &tls.Config{ServerName: serverName}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			r.fail("ASYNQ_REDIS_TLS_CA_FILE", "%v", err)
+			return cfg
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			r.fail("ASYNQ_REDIS_TLS_CA_FILE", "no certificates found in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg
+}
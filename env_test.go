@@ -0,0 +1,159 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// envLookup returns a lookup function of the given environment variables.
+func envLookup(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	tests := []struct {
+		desc string
+		env  map[string]string
+		want *EnvConfig
+	}{
+		{
+			desc: "defaults",
+			env:  map[string]string{},
+			want: &EnvConfig{
+				Redis:      RedisClientOpt{Addr: "127.0.0.1:6379"},
+				Client:     &ClientConfig{},
+				Background: &Config{},
+				Inspector:  &InspectorConfig{},
+			},
+		},
+		{
+			desc: "worker",
+			env: map[string]string{
+				"ASYNQ_REDIS_ADDR":      "redis:6379",
+				"ASYNQ_REDIS_PASSWORD":  "mypassword",
+				"ASYNQ_REDIS_DB":        "2",
+				"ASYNQ_REDIS_POOL_SIZE": "20",
+				"ASYNQ_REDIS_TLS":       "true",
+				"ASYNQ_NAMESPACE":       "myapp",
+				"ASYNQ_CONCURRENCY":     "30",
+				"ASYNQ_QUEUES":          "critical=6, default=3, low",
+				"ASYNQ_STRICT_PRIORITY": "1",
+				"ASYNQ_REGIONS":         "eu,us",
+				"ASYNQ_LOG_LEVEL":       "warn",
+			},
+			want: &EnvConfig{
+				Redis: RedisClientOpt{
+					Addr:      "redis:6379",
+					Password:  "mypassword",
+					DB:        2,
+					PoolSize:  20,
+					TLSConfig: &tls.Config{ServerName: "redis"},
+				},
+				Client: &ClientConfig{KeyPrefix: "myapp"},
+				Background: &Config{
+					Concurrency:    30,
+					Queues:         map[string]int{"critical": 6, "default": 3, "low": 1},
+					StrictPriority: true,
+					Regions:        []string{"eu", "us"},
+					KeyPrefix:      "myapp",
+					LogLevel:       WarnLevel,
+				},
+				Inspector: &InspectorConfig{KeyPrefix: "myapp"},
+			},
+		},
+		{
+			desc: "redis uri",
+			env: map[string]string{
+				"ASYNQ_REDIS_URL":             "rediss://:mypassword@redis:6380/1",
+				"ASYNQ_REDIS_TLS_SERVER_NAME": "redis.example.com",
+			},
+			want: &EnvConfig{
+				Redis: RedisClientOpt{
+					Addr:      "redis:6380",
+					Password:  "mypassword",
+					DB:        1,
+					TLSConfig: &tls.Config{ServerName: "redis.example.com"},
+				},
+				Client:     &ClientConfig{},
+				Background: &Config{},
+				Inspector:  &InspectorConfig{},
+			},
+		},
+		{
+			desc: "sentinels",
+			env: map[string]string{
+				"ASYNQ_REDIS_SENTINEL_ADDRS": "sentinel-0:26379,sentinel-1:26379,sentinel-2:26379",
+				"ASYNQ_REDIS_MASTER_NAME":    "mymaster",
+			},
+			want: &EnvConfig{
+				Redis: RedisFailoverClientOpt{
+					MasterName:    "mymaster",
+					SentinelAddrs: []string{"sentinel-0:26379", "sentinel-1:26379", "sentinel-2:26379"},
+				},
+				Client:     &ClientConfig{},
+				Background: &Config{},
+				Inspector:  &InspectorConfig{},
+			},
+		},
+		{
+			desc: "cluster",
+			env: map[string]string{
+				"ASYNQ_REDIS_CLUSTER_ADDRS": "redis-0:6379,redis-1:6379",
+				"ASYNQ_REDIS_PASSWORD":      "mypassword",
+			},
+			want: &EnvConfig{
+				Redis: RedisClusterClientOpt{
+					Addrs:    []string{"redis-0:6379", "redis-1:6379"},
+					Password: "mypassword",
+				},
+				Client:     &ClientConfig{},
+				Background: &Config{},
+				Inspector:  &InspectorConfig{},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		got, err := configFromEnv(envLookup(tc.env))
+		if err != nil {
+			t.Errorf("%s: configFromEnv returned error: %v", tc.desc, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got, cmpopts.IgnoreUnexported(tls.Config{})); diff != "" {
+			t.Errorf("%s: configFromEnv = %+v, want %+v\n(-want,+got)\n%s", tc.desc, got, tc.want, diff)
+		}
+	}
+}
+
+func TestConfigFromEnvErrors(t *testing.T) {
+	tests := []struct {
+		desc string
+		env  map[string]string
+	}{
+		{"invalid concurrency", map[string]string{"ASYNQ_CONCURRENCY": "many"}},
+		{"invalid queue weight", map[string]string{"ASYNQ_QUEUES": "critical=high"}},
+		{"negative queue weight", map[string]string{"ASYNQ_QUEUES": "critical=-1"}},
+		{"empty queue name", map[string]string{"ASYNQ_QUEUES": "=3"}},
+		{"invalid bool", map[string]string{"ASYNQ_STRICT_PRIORITY": "maybe"}},
+		{"unknown log level", map[string]string{"ASYNQ_LOG_LEVEL": "verbose"}},
+		{"invalid redis uri", map[string]string{"ASYNQ_REDIS_URL": "rdb://localhost:6379"}},
+		{"sentinels without master", map[string]string{"ASYNQ_REDIS_SENTINEL_ADDRS": "sentinel:26379"}},
+		{"missing ca file", map[string]string{"ASYNQ_REDIS_TLS_CA_FILE": "/nonexistent/ca.pem"}},
+	}
+
+	for _, tc := range tests {
+		if _, err := configFromEnv(envLookup(tc.env)); err == nil {
+			t.Errorf("%s: configFromEnv(%v) returned nil error, want non-nil", tc.desc, tc.env)
+		}
+	}
+}
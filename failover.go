@@ -0,0 +1,205 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// FailoverBuffer specifies how a Client buffers tasks in memory while
+// redis is unavailable for writes, e.g. during the failover of the master
+// monitored by sentinels, instead of returning an error from each call.
+//
+// Buffered tasks are written to redis in order as soon as it becomes
+// writable again, within the quotas of their queues (see QueueQuotas of
+// ClientConfig). Tasks still buffered are lost if the process exits,
+// so call Client.Flush before exiting.
+type FailoverBuffer struct {
+	// Size specifies the maximum number of tasks to buffer. Once the buffer
+	// is full, the client returns the error of redis.
+	//
+	// If zero or negative, 1000 is used.
+	Size int
+
+	// MaxDuration specifies how long the client keeps buffering tasks
+	// since the oldest task in the buffer failed to be written. Once the
+	// outage lasts longer, the client returns the error of redis, while
+	// the buffered tasks are still written when redis recovers.
+	//
+	// If zero or negative, 30 seconds is used.
+	MaxDuration time.Duration
+}
+
+// failoverErrorPrefixes are the prefixes of the errors redis replies with
+// while it cannot accept writes, e.g. while a replica is promoted to master.
+var failoverErrorPrefixes = []string{"MASTERDOWN", "READONLY", "LOADING", "TRYAGAIN", "CLUSTERDOWN"}
+
+// isFailoverError reports whether err is a transient error of redis being
+// unavailable for writes, after which the write can be retried.
+func isFailoverError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	for _, prefix := range failoverErrorPrefixes {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTask enqueues the task if it's due, otherwise schedules it at processAt.
+func writeTask(b base.Broker, msg *base.TaskMessage, processAt time.Time, due bool) error {
+	if due {
+		return b.Enqueue(msg)
+	}
+	return b.Schedule(msg, processAt)
+}
+
+// bufferedTask is a task waiting in a failover buffer.
+type bufferedTask struct {
+	msg       *base.TaskMessage
+	processAt time.Time
+	added     time.Time
+}
+
+// failoverBuffer holds the tasks a client failed to write while redis was
+// failing over, and writes them once redis recovers.
+//
+// A nil failoverBuffer buffers nothing.
+type failoverBuffer struct {
+	logger *asynqLogger
+	// write writes a task to redis, within the quota of its queue.
+	write func(msg *base.TaskMessage, processAt time.Time) error
+
+	size        int
+	maxDuration time.Duration
+
+	// interval between attempts to flush the buffer.
+	interval time.Duration
+
+	// flushMu serializes the flushes, so that each task is written once.
+	flushMu sync.Mutex
+
+	mu    sync.Mutex
+	tasks []*bufferedTask
+	// flushing is true while the goroutine flushing the buffer is running.
+	flushing bool
+}
+
+func newFailoverBuffer(logger *asynqLogger, write func(msg *base.TaskMessage, processAt time.Time) error, cfg *FailoverBuffer) *failoverBuffer {
+	if cfg == nil {
+		return nil
+	}
+	size := cfg.Size
+	if size <= 0 {
+		size = 1000
+	}
+	maxDuration := cfg.MaxDuration
+	if maxDuration <= 0 {
+		maxDuration = 30 * time.Second
+	}
+	return &failoverBuffer{
+		logger:      logger,
+		write:       write,
+		size:        size,
+		maxDuration: maxDuration,
+		interval:    500 * time.Millisecond,
+	}
+}
+
+// buffering reports whether tasks are waiting in the buffer, in which case
+// new tasks should be buffered after them to keep the order.
+func (b *failoverBuffer) buffering() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.tasks) > 0
+}
+
+// add buffers the task, and reports whether it was buffered. The task is not
+// buffered if the buffer is full, or the outage has lasted too long.
+func (b *failoverBuffer) add(msg *base.TaskMessage, processAt time.Time) bool {
+	if b == nil {
+		return false
+	}
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.tasks) >= b.size {
+		return false
+	}
+	if len(b.tasks) > 0 && now.Sub(b.tasks[0].added) > b.maxDuration {
+		return false
+	}
+	b.tasks = append(b.tasks, &bufferedTask{msg: msg, processAt: processAt, added: now})
+	if !b.flushing {
+		b.flushing = true
+		go b.run()
+	}
+	return true
+}
+
+// run flushes the buffer periodically until it's empty.
+func (b *failoverBuffer) run() {
+	for {
+		time.Sleep(b.interval)
+		if err := b.flush(); err != nil {
+			b.logger.debug("Could not flush failover buffer: %v", err)
+		}
+		b.mu.Lock()
+		if len(b.tasks) == 0 {
+			b.flushing = false
+			b.mu.Unlock()
+			return
+		}
+		b.mu.Unlock()
+	}
+}
+
+// flush writes the buffered tasks in order, and returns the error of redis
+// if it's still unavailable.
+func (b *failoverBuffer) flush() error {
+	if b == nil {
+		return nil
+	}
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+	for {
+		b.mu.Lock()
+		if len(b.tasks) == 0 {
+			b.mu.Unlock()
+			return nil
+		}
+		t := b.tasks[0]
+		b.mu.Unlock()
+
+		err := b.write(t.msg, t.processAt)
+		if isFailoverError(err) {
+			return err
+		}
+		if err != nil {
+			b.logger.error("Could not write buffered task %s: %v", t.msg.ID, err)
+		}
+		b.mu.Lock()
+		b.tasks[0] = nil
+		b.tasks = b.tasks[1:]
+		b.mu.Unlock()
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+var errMasterDown = errors.New("MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'.")
+
+// failoverBroker fails the writes with errMasterDown while down is true.
+type failoverBroker struct {
+	base.Broker
+
+	mu      sync.Mutex
+	down    bool
+	written []string
+}
+
+func (b *failoverBroker) write(msg *base.TaskMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down {
+		return errMasterDown
+	}
+	b.written = append(b.written, msg.Type)
+	return nil
+}
+
+func (b *failoverBroker) Enqueue(msg *base.TaskMessage) error {
+	return b.write(msg)
+}
+
+func (b *failoverBroker) Schedule(msg *base.TaskMessage, processAt time.Time) error {
+	return b.write(msg)
+}
+
+func (b *failoverBroker) setDown(down bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.down = down
+}
+
+func (b *failoverBroker) writtenTypes() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.written...)
+}
+
+func TestClientFailoverBuffer(t *testing.T) {
+	b := &failoverBroker{down: true}
+	c := &Client{rdb: b}
+	buf := newFailoverBuffer(testLogger, c.write, &FailoverBuffer{Size: 2})
+	buf.interval = time.Hour // flush manually
+	c.buffer = buf
+
+	if _, err := c.Schedule(NewTask("first", nil), time.Now()); err != nil {
+		t.Errorf("Schedule during failover returned error: %v", err)
+	}
+	if _, err := c.Schedule(NewTask("second", nil), time.Now().Add(time.Hour)); err != nil {
+		t.Errorf("Schedule during failover returned error: %v", err)
+	}
+	if _, err := c.Schedule(NewTask("third", nil), time.Now()); err != errMasterDown {
+		t.Errorf("Schedule with full buffer returned error %v, want %v", err, errMasterDown)
+	}
+	if err := c.Flush(); err != errMasterDown {
+		t.Errorf("Flush during failover returned error %v, want %v", err, errMasterDown)
+	}
+
+	b.setDown(false)
+	if err := c.Flush(); err != nil {
+		t.Errorf("Flush returned error: %v", err)
+	}
+	want := []string{"first", "second"}
+	if diff := cmp.Diff(want, b.writtenTypes()); diff != "" {
+		t.Errorf("written %v, want %v; (-want,+got)\n%s", b.writtenTypes(), want, diff)
+	}
+
+	// Once the buffer is empty, tasks are written directly.
+	if _, err := c.Schedule(NewTask("fourth", nil), time.Now()); err != nil {
+		t.Errorf("Schedule returned error: %v", err)
+	}
+	if got := b.writtenTypes(); len(got) != 3 {
+		t.Errorf("written %v, want 3 tasks", got)
+	}
+}
+
+func TestClientFailoverBufferKeepsOrder(t *testing.T) {
+	b := &failoverBroker{down: true}
+	c := &Client{rdb: b}
+	buf := newFailoverBuffer(testLogger, c.write, &FailoverBuffer{})
+	buf.interval = time.Hour
+	c.buffer = buf
+
+	if _, err := c.Schedule(NewTask("first", nil), time.Now()); err != nil {
+		t.Fatalf("Schedule during failover returned error: %v", err)
+	}
+	b.setDown(false)
+	// Tasks are buffered after the ones waiting to keep the order.
+	if _, err := c.Schedule(NewTask("second", nil), time.Now()); err != nil {
+		t.Fatalf("Schedule returned error: %v", err)
+	}
+	if got := b.writtenTypes(); len(got) != 0 {
+		t.Errorf("written %v before flush, want none", got)
+	}
+	if err := c.Flush(); err != nil {
+		t.Errorf("Flush returned error: %v", err)
+	}
+	want := []string{"first", "second"}
+	if diff := cmp.Diff(want, b.writtenTypes()); diff != "" {
+		t.Errorf("written %v, want %v; (-want,+got)\n%s", b.writtenTypes(), want, diff)
+	}
+}
+
+func TestClientFailoverBufferMaxDuration(t *testing.T) {
+	b := &failoverBroker{down: true}
+	c := &Client{rdb: b}
+	buf := newFailoverBuffer(testLogger, c.write, &FailoverBuffer{MaxDuration: time.Minute})
+	buf.interval = time.Hour
+	c.buffer = buf
+
+	if _, err := c.Schedule(NewTask("first", nil), time.Now()); err != nil {
+		t.Fatalf("Schedule during failover returned error: %v", err)
+	}
+	buf.tasks[0].added = time.Now().Add(-2 * time.Minute)
+	if _, err := c.Schedule(NewTask("second", nil), time.Now()); err != errMasterDown {
+		t.Errorf("Schedule after MaxDuration returned error %v, want %v", err, errMasterDown)
+	}
+}
+
+func TestClientFailoverBufferFlushesInBackground(t *testing.T) {
+	b := &failoverBroker{down: true}
+	c := &Client{rdb: b}
+	buf := newFailoverBuffer(testLogger, c.write, &FailoverBuffer{})
+	buf.interval = 10 * time.Millisecond
+	c.buffer = buf
+
+	if _, err := c.Schedule(NewTask("send_email", nil), time.Now()); err != nil {
+		t.Fatalf("Schedule during failover returned error: %v", err)
+	}
+	b.setDown(false)
+	time.Sleep(100 * time.Millisecond)
+
+	want := []string{"send_email"}
+	if diff := cmp.Diff(want, b.writtenTypes()); diff != "" {
+		t.Errorf("written %v, want %v; (-want,+got)\n%s", b.writtenTypes(), want, diff)
+	}
+	if buf.buffering() {
+		t.Errorf("failover buffer still has tasks after redis recovered")
+	}
+}
+
+// failoverQuotaBroker is a failoverBroker which enqueues tasks within
+// the quota of the total number of tasks written.
+type failoverQuotaBroker struct {
+	*failoverBroker
+}
+
+func (b failoverQuotaBroker) EnqueueWithQuota(msg *base.TaskMessage, max int) error {
+	b.mu.Lock()
+	full := !b.down && len(b.written) >= max
+	b.mu.Unlock()
+	if full {
+		return ErrQueueFull
+	}
+	return b.write(msg)
+}
+
+func TestClientFailoverBufferQuota(t *testing.T) {
+	b := failoverQuotaBroker{&failoverBroker{down: true}}
+	c := &Client{rdb: b, quotas: map[string]int{"default": 1}}
+	c.buffer = newFailoverBuffer(testLogger, c.write, &FailoverBuffer{})
+	c.buffer.interval = time.Hour
+
+	for _, typename := range []string{"first", "second"} {
+		if _, err := c.Schedule(NewTask(typename, nil), time.Now()); err != nil {
+			t.Fatalf("Schedule during failover returned error: %v", err)
+		}
+	}
+	b.setDown(false)
+	if err := c.Flush(); err != nil {
+		t.Errorf("Flush returned error: %v", err)
+	}
+	// The buffered tasks count toward the quota of their queue.
+	want := []string{"first"}
+	if diff := cmp.Diff(want, b.writtenTypes()); diff != "" {
+		t.Errorf("written %v, want %v; (-want,+got)\n%s", b.writtenTypes(), want, diff)
+	}
+}
+
+func TestClientWithoutFailoverBuffer(t *testing.T) {
+	b := &failoverBroker{down: true}
+	c := &Client{rdb: b}
+
+	if _, err := c.Schedule(NewTask("send_email", nil), time.Now()); err != errMasterDown {
+		t.Errorf("Schedule during failover returned error %v, want %v", err, errMasterDown)
+	}
+	if err := c.Flush(); err != nil {
+		t.Errorf("Flush returned error: %v", err)
+	}
+}
+
+func TestIsFailoverError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errMasterDown, true},
+		{errors.New("READONLY You can't write against a read only replica."), true},
+		{errors.New("LOADING Redis is loading the dataset in memory"), true},
+		{io.EOF, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{errors.New("ERR wrong number of arguments"), false},
+	}
+
+	for _, tc := range tests {
+		if got := isFailoverError(tc.err); got != tc.want {
+			t.Errorf("isFailoverError(%v) = %t, want %t", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// FastLane reserves some of the workers of the background for the tasks
+// expected to finish quickly, so that they are not blocked behind long
+// running tasks even when both share a queue.
+//
+// Fast tasks are processed by any worker, while the other tasks are
+// processed by at most Concurrency minus Workers workers.
+// FastLane has no effect if the handler is a BulkHandler.
+type FastLane struct {
+	// Workers specifies the number of workers reserved for the fast tasks.
+	//
+	// It's capped at Concurrency minus one. If zero or negative, no workers
+	// are reserved.
+	Workers int
+
+	// ExpectedDurations declares how long the tasks of each type are
+	// expected to take to process, keyed by task type.
+	ExpectedDurations map[string]time.Duration
+
+	// MaxDuration specifies the expected duration under which the tasks
+	// are fast. Tasks of the types not in ExpectedDurations are not fast.
+	//
+	// If zero or negative, tasks expected to take less than a second are fast.
+	MaxDuration time.Duration
+}
+
+// fastLane keeps track of the workers processing the tasks outside
+// the fast lane.
+//
+// A nil fastLane treats every task as fast, i.e. any worker can process it.
+type fastLane struct {
+	// fast is the set of the types of the fast tasks.
+	fast map[string]bool
+
+	// slow is a counting semaphore to ensure the number of workers
+	// processing the tasks outside the fast lane leaves the reserved
+	// workers available.
+	slow chan struct{}
+
+	// waiting is a counting semaphore to limit the number of tasks waiting
+	// for a worker outside the fast lane, so that the fast tasks behind
+	// them in the queues can be pulled out in the meantime.
+	waiting chan struct{}
+}
+
+func newFastLane(cfg *FastLane, concurrency int) *fastLane {
+	if cfg == nil || cfg.Workers < 1 || concurrency < 2 {
+		return nil
+	}
+	reserved := cfg.Workers
+	if reserved > concurrency-1 {
+		reserved = concurrency - 1
+	}
+	maxDuration := cfg.MaxDuration
+	if maxDuration <= 0 {
+		maxDuration = time.Second
+	}
+	fast := make(map[string]bool)
+	for typename, d := range cfg.ExpectedDurations {
+		if d < maxDuration {
+			fast[typename] = true
+		}
+	}
+	return &fastLane{
+		fast:    fast,
+		slow:    make(chan struct{}, concurrency-reserved),
+		waiting: make(chan struct{}, reserved),
+	}
+}
+
+// isFast reports whether the task can be processed by the reserved workers.
+func (l *fastLane) isFast(msg *base.TaskMessage) bool {
+	return l == nil || l.fast[msg.Type]
+}
+
+// release releases the worker outside the fast lane processing the task.
+func (l *fastLane) release(msg *base.TaskMessage) {
+	if !l.isFast(msg) {
+		<-l.slow
+	}
+}
+
+// wait blocks until no task is waiting for a worker outside the fast lane.
+// It should be called only once the processor has been stopped.
+func (l *fastLane) wait() {
+	if l == nil {
+		return
+	}
+	for i := 0; i < cap(l.waiting); i++ {
+		l.waiting <- struct{}{}
+	}
+}
+
+// dispatchSlow dispatches the task outside the fast lane once one of the
+// workers outside the fast lane is available. If none is available, the
+// task waits for one in the background, so that the processor can keep
+// passing the fast tasks to the reserved workers.
+func (p *processor) dispatchSlow(msg *base.TaskMessage) {
+	select {
+	case p.lane.slow <- struct{}{}:
+		p.dispatch(msg)
+		return
+	default:
+	}
+	select {
+	case <-p.abort:
+		// shutdown is starting, return immediately after requeuing the message.
+		p.requeue(msg)
+	case p.lane.slow <- struct{}{}:
+		p.dispatch(msg)
+	case p.lane.waiting <- struct{}{}:
+		// keep the lease of the task while it's waiting for a worker.
+		p.leases.add(msg)
+		go func() {
+			defer func() { <-p.lane.waiting }()
+			select {
+			case <-p.abort:
+				p.leases.remove(msg)
+				p.requeue(msg)
+			case p.lane.slow <- struct{}{}:
+				p.dispatch(msg)
+			}
+		}()
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// ackBroker records the tasks marked as done and requeued.
+type ackBroker struct {
+	base.Broker
+
+	mu       sync.Mutex
+	done     []string
+	requeued []string
+}
+
+func (b *ackBroker) Done(msg *base.TaskMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.done = append(b.done, msg.Type)
+	return nil
+}
+
+func (b *ackBroker) Requeue(msg *base.TaskMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.requeued = append(b.requeued, msg.Type)
+	return nil
+}
+
+func TestNewFastLane(t *testing.T) {
+	durations := map[string]time.Duration{
+		"ping":   10 * time.Millisecond,
+		"resize": 5 * time.Second,
+		"render": time.Hour,
+	}
+	tests := []struct {
+		cfg         *FastLane
+		concurrency int
+		wantNil     bool
+		wantSlow    int
+		wantFast    []string
+	}{
+		{cfg: nil, concurrency: 10, wantNil: true},
+		{cfg: &FastLane{Workers: 0, ExpectedDurations: durations}, concurrency: 10, wantNil: true},
+		{cfg: &FastLane{Workers: 2, ExpectedDurations: durations}, concurrency: 1, wantNil: true},
+		{cfg: &FastLane{Workers: 2, ExpectedDurations: durations}, concurrency: 10, wantSlow: 8, wantFast: []string{"ping"}},
+		{cfg: &FastLane{Workers: 20, ExpectedDurations: durations}, concurrency: 10, wantSlow: 1, wantFast: []string{"ping"}},
+		{cfg: &FastLane{Workers: 2, ExpectedDurations: durations, MaxDuration: time.Minute}, concurrency: 10, wantSlow: 8, wantFast: []string{"ping", "resize"}},
+	}
+
+	for _, tc := range tests {
+		l := newFastLane(tc.cfg, tc.concurrency)
+		if tc.wantNil {
+			if l != nil {
+				t.Errorf("newFastLane(%+v, %d) = %+v, want nil", tc.cfg, tc.concurrency, l)
+			}
+			continue
+		}
+		if cap(l.slow) != tc.wantSlow {
+			t.Errorf("newFastLane(%+v, %d) allows %d workers outside the fast lane, want %d", tc.cfg, tc.concurrency, cap(l.slow), tc.wantSlow)
+		}
+		var fast []string
+		for _, typename := range []string{"ping", "resize", "render", "unknown"} {
+			if l.isFast(h.NewTaskMessage(typename, nil)) {
+				fast = append(fast, typename)
+			}
+		}
+		if diff := cmp.Diff(tc.wantFast, fast); diff != "" {
+			t.Errorf("newFastLane(%+v, %d) treats %v as fast, want %v; (-want,+got)\n%s", tc.cfg, tc.concurrency, fast, tc.wantFast, diff)
+		}
+	}
+}
+
+// newFastLaneProcessor returns a processor with two workers,
+// one of which is reserved for "ping" tasks.
+func newFastLaneProcessor(b base.Broker) *processor {
+	workerCh := make(chan int)
+	go fakeHeartbeater(workerCh)
+	return newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            b,
+		queues:         defaultQueueConfig,
+		concurrency:    2,
+		retryDelayFunc: defaultDelayFunc,
+		workerCh:       workerCh,
+		cancelations:   base.NewCancelations(),
+		fastLane: &FastLane{
+			Workers:           1,
+			ExpectedDurations: map[string]time.Duration{"ping": time.Millisecond},
+		},
+	})
+}
+
+func TestProcessorFastLane(t *testing.T) {
+	b := &ackBroker{}
+	p := newFastLaneProcessor(b)
+	unblock := make(chan struct{})
+	unblockPing := make(chan struct{})
+	processed := make(chan string, 3)
+	p.handler = HandlerFunc(func(ctx context.Context, task *Task) error {
+		if task.Type == "render" {
+			<-unblock
+		}
+		processed <- task.Type
+		if task.Type == "ping" {
+			<-unblockPing
+		}
+		return nil
+	})
+
+	p.dispatchSlow(h.NewTaskMessage("render", nil))
+	// the task should wait for the worker outside the fast lane without
+	// blocking the processor.
+	p.dispatchSlow(h.NewTaskMessage("render", nil))
+	p.dispatch(h.NewTaskMessage("ping", nil))
+
+	select {
+	case typename := <-processed:
+		if typename != "ping" {
+			t.Fatalf("processed %q first, want %q", typename, "ping")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("fast task was not processed while the other worker was busy")
+	}
+	// the worker count is updated by the worker goroutines.
+	deadline := time.Now().Add(time.Second)
+	for p.activeWorkers() != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := p.activeWorkers(); got != 2 {
+		t.Errorf("activeWorkers() = %d while the fast task is processed, want 2", got)
+	}
+	close(unblockPing)
+
+	close(unblock)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-processed:
+		case <-time.After(time.Second):
+			t.Fatalf("processed %d of the tasks outside the fast lane, want 2", i)
+		}
+	}
+	time.Sleep(50 * time.Millisecond) // wait for the workers to acknowledge the tasks.
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.done) != 3 {
+		t.Errorf("%d tasks are done, want 3", len(b.done))
+	}
+}
+
+func TestProcessorFastLaneRequeuesWaitingTasksOnShutdown(t *testing.T) {
+	b := &ackBroker{}
+	p := newFastLaneProcessor(b)
+	unblock := make(chan struct{})
+	p.handler = HandlerFunc(func(ctx context.Context, task *Task) error {
+		<-unblock
+		return nil
+	})
+
+	p.dispatchSlow(h.NewTaskMessage("render", nil))
+	p.dispatchSlow(h.NewTaskMessage("resize", nil))
+	close(p.abort)
+	p.lane.wait()
+
+	b.mu.Lock()
+	if diff := cmp.Diff([]string{"resize"}, b.requeued); diff != "" {
+		t.Errorf("requeued %v, want %v; (-want,+got)\n%s", b.requeued, []string{"resize"}, diff)
+	}
+	b.mu.Unlock()
+	close(unblock)
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// FaultInjection specifies controlled failures to inject into the
+// interaction between a background worker process and redis.
+//
+// FaultInjection is intended for testing only: use it to verify that
+// handlers are idempotent and that the system recovers as documented.
+// Do not use it in production.
+//
+// Rates are probabilities between 0 and 1, and a zero value disables
+// the corresponding failure.
+type FaultInjection struct {
+	// DropAckRate is the rate at which the acknowledgement of a
+	// successfully processed task is dropped.
+	//
+	// The task stays in the in-progress list and will be processed
+	// again once its lease expires, or once the background restarts
+	// and restores unfinished tasks if the broker doesn't lease tasks.
+	DropAckRate float64
+
+	// HeartbeatDelay delays each heartbeat by the duration.
+	//
+	// If the delay is longer than the heartbeat interval, the process info
+	// expires and the process appears to be dead in between heartbeats.
+	HeartbeatDelay time.Duration
+
+	// LeaseLossRate is the rate at which a task loses its lease while
+	// being processed.
+	//
+	// The task is moved back to its queue while the handler is still
+	// running, so the task may be processed concurrently by another worker.
+	LeaseLossRate float64
+
+	// DuplicateDeliveryRate is the rate at which a copy of a dequeued
+	// task is enqueued, so that the task is delivered twice.
+	DuplicateDeliveryRate float64
+}
+
+// faultInjector decides when to inject failures specified by FaultInjection.
+//
+// A nil faultInjector never injects failures.
+type faultInjector struct {
+	cfg FaultInjection
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newFaultInjector(cfg *FaultInjection) *faultInjector {
+	if cfg == nil {
+		return nil
+	}
+	return &faultInjector{
+		cfg:  *cfg,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// roll reports whether a failure with the given rate should be injected.
+func (f *faultInjector) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rand.Float64() < rate
+}
+
+func (f *faultInjector) dropAck() bool {
+	return f != nil && f.roll(f.cfg.DropAckRate)
+}
+
+func (f *faultInjector) loseLease() bool {
+	return f != nil && f.roll(f.cfg.LeaseLossRate)
+}
+
+func (f *faultInjector) duplicateDelivery() bool {
+	return f != nil && f.roll(f.cfg.DuplicateDeliveryRate)
+}
+
+func (f *faultInjector) heartbeatDelay() time.Duration {
+	if f == nil {
+		return 0
+	}
+	return f.cfg.HeartbeatDelay
+}
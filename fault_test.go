@@ -0,0 +1,55 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFaultInjector(t *testing.T) {
+	tests := []struct {
+		cfg                   *FaultInjection
+		wantDropAck           bool
+		wantLoseLease         bool
+		wantDuplicateDelivery bool
+		wantHeartbeatDelay    time.Duration
+	}{
+		{
+			cfg: nil,
+		},
+		{
+			cfg: &FaultInjection{},
+		},
+		{
+			cfg: &FaultInjection{
+				DropAckRate:           1,
+				HeartbeatDelay:        3 * time.Second,
+				LeaseLossRate:         1,
+				DuplicateDeliveryRate: 1,
+			},
+			wantDropAck:           true,
+			wantLoseLease:         true,
+			wantDuplicateDelivery: true,
+			wantHeartbeatDelay:    3 * time.Second,
+		},
+	}
+
+	for _, tc := range tests {
+		f := newFaultInjector(tc.cfg)
+		if got := f.dropAck(); got != tc.wantDropAck {
+			t.Errorf("dropAck() with %+v = %t, want %t", tc.cfg, got, tc.wantDropAck)
+		}
+		if got := f.loseLease(); got != tc.wantLoseLease {
+			t.Errorf("loseLease() with %+v = %t, want %t", tc.cfg, got, tc.wantLoseLease)
+		}
+		if got := f.duplicateDelivery(); got != tc.wantDuplicateDelivery {
+			t.Errorf("duplicateDelivery() with %+v = %t, want %t", tc.cfg, got, tc.wantDuplicateDelivery)
+		}
+		if got := f.heartbeatDelay(); got != tc.wantHeartbeatDelay {
+			t.Errorf("heartbeatDelay() with %+v = %v, want %v", tc.cfg, got, tc.wantHeartbeatDelay)
+		}
+	}
+}
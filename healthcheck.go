@@ -0,0 +1,79 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// healthchecker is responsible for pinging the broker periodically
+// and calling the user provided HealthCheckFunc with the result.
+//
+// A nil healthchecker does nothing.
+type healthchecker struct {
+	logger *asynqLogger
+	rdb    base.Broker
+
+	// channel to communicate back to the long running "healthchecker" goroutine.
+	done chan struct{}
+
+	// interval between healthchecks.
+	interval time.Duration
+
+	// function to call with the result of each healthcheck.
+	healthcheckFunc func(error)
+}
+
+const defaultHealthCheckInterval = 15 * time.Second
+
+func newHealthChecker(logger *asynqLogger, rdb base.Broker, interval time.Duration, fn func(error)) *healthchecker {
+	if fn == nil {
+		return nil
+	}
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	return &healthchecker{
+		logger:          logger,
+		rdb:             rdb,
+		done:            make(chan struct{}),
+		interval:        interval,
+		healthcheckFunc: fn,
+	}
+}
+
+func (hc *healthchecker) terminate() {
+	if hc == nil {
+		return
+	}
+	hc.logger.debug("Healthchecker shutting down...")
+	// Signal the healthchecker goroutine to stop.
+	hc.done <- struct{}{}
+}
+
+func (hc *healthchecker) start(wg *sync.WaitGroup) {
+	if hc == nil {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		timer := time.NewTimer(hc.interval)
+		for {
+			select {
+			case <-hc.done:
+				hc.logger.debug("Healthchecker done")
+				timer.Stop()
+				return
+			case <-timer.C:
+				hc.healthcheckFunc(hc.rdb.Ping())
+				timer.Reset(hc.interval)
+			}
+		}
+	}()
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// pingBroker returns err from Ping.
+// Calling other methods panics.
+type pingBroker struct {
+	base.Broker
+	mu  sync.Mutex
+	err error
+}
+
+func (b *pingBroker) Ping() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+func (b *pingBroker) setErr(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = err
+}
+
+func TestHealthChecker(t *testing.T) {
+	b := &pingBroker{}
+	var (
+		mu       sync.Mutex
+		lastErr  error
+		numCalls int
+	)
+	hc := newHealthChecker(testLogger, b, 20*time.Millisecond, func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		lastErr = err
+		numCalls++
+	})
+
+	var wg sync.WaitGroup
+	hc.start(&wg)
+
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if numCalls == 0 || lastErr != nil {
+		t.Errorf("HealthCheckFunc called %d times with last error %v, want at least once with nil", numCalls, lastErr)
+	}
+	mu.Unlock()
+
+	errDown := errors.New("connection refused")
+	b.setErr(errDown)
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if lastErr != errDown {
+		t.Errorf("HealthCheckFunc last called with %v, want %v", lastErr, errDown)
+	}
+	mu.Unlock()
+
+	hc.terminate()
+	wg.Wait()
+}
+
+func TestNewHealthCheckerWithoutFunc(t *testing.T) {
+	if hc := newHealthChecker(testLogger, &pingBroker{}, time.Second, nil); hc != nil {
+		t.Errorf("newHealthChecker without HealthCheckFunc = %v, want nil", hc)
+	}
+}
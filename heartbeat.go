@@ -9,13 +9,13 @@ import (
 	"time"
 
 	"github.com/hibiken/asynq/internal/base"
-	"github.com/hibiken/asynq/internal/rdb"
 )
 
 // heartbeater is responsible for writing process info to redis periodically to
 // indicate that the background worker process is up.
 type heartbeater struct {
-	rdb *rdb.RDB
+	logger *asynqLogger
+	rdb    base.Broker
 
 	pinfo *base.ProcessInfo
 
@@ -30,22 +30,45 @@ type heartbeater struct {
 
 	// interval between heartbeats.
 	interval time.Duration
+
+	// faults injects failures for testing, nil in production.
+	faults *faultInjector
+
+	// refresher extends the expiration of the process info without
+	// rewriting it, nil if the broker cannot.
+	refresher processInfoRefresher
+
+	// state and worker count of the process info last written,
+	// and whether it has been written.
+	written        bool
+	writtenState   string
+	writtenWorkers int
 }
 
-func newHeartbeater(rdb *rdb.RDB, host string, pid, concurrency int, queues map[string]int, strict bool,
-	interval time.Duration, stateCh <-chan string, workerCh <-chan int) *heartbeater {
+// processInfoRefresher is implemented by brokers which can extend the
+// expiration of the process info without rewriting it.
+type processInfoRefresher interface {
+	RefreshProcessInfo(ps *base.ProcessInfo, ttl time.Duration) (bool, error)
+}
+
+func newHeartbeater(logger *asynqLogger, rdb base.Broker, host string, pid, concurrency int, queues map[string]int, strict bool,
+	interval time.Duration, stateCh <-chan string, workerCh <-chan int, faults *faultInjector) *heartbeater {
+	refresher, _ := rdb.(processInfoRefresher)
 	return &heartbeater{
-		rdb:      rdb,
-		pinfo:    base.NewProcessInfo(host, pid, concurrency, queues, strict),
-		done:     make(chan struct{}),
-		stateCh:  stateCh,
-		workerCh: workerCh,
-		interval: interval,
+		logger:    logger,
+		rdb:       rdb,
+		refresher: refresher,
+		pinfo:     base.NewProcessInfo(host, pid, concurrency, queues, strict),
+		done:      make(chan struct{}),
+		stateCh:   stateCh,
+		workerCh:  workerCh,
+		interval:  interval,
+		faults:    faults,
 	}
 }
 
 func (h *heartbeater) terminate() {
-	logger.info("Heartbeater shutting down...")
+	h.logger.debug("Heartbeater shutting down...")
 	// Signal the heartbeater goroutine to stop.
 	h.done <- struct{}{}
 }
@@ -57,12 +80,12 @@ func (h *heartbeater) start(wg *sync.WaitGroup) {
 	go func() {
 		defer wg.Done()
 		h.beat()
-		timer := time.NewTimer(h.interval)
+		timer := time.NewTimer(h.interval + h.faults.heartbeatDelay())
 		for {
 			select {
 			case <-h.done:
 				h.rdb.ClearProcessInfo(h.pinfo)
-				logger.info("Heartbeater done")
+				h.logger.debug("Heartbeater done")
 				return
 			case state := <-h.stateCh:
 				h.pinfo.State = state
@@ -70,17 +93,30 @@ func (h *heartbeater) start(wg *sync.WaitGroup) {
 				h.pinfo.ActiveWorkerCount += delta
 			case <-timer.C:
 				h.beat()
-				timer.Reset(h.interval)
+				timer.Reset(h.interval + h.faults.heartbeatDelay())
 			}
 		}
 	}()
 }
 
+// beat writes the process info, or only extends its expiration if it hasn't
+// changed since it was last written.
 func (h *heartbeater) beat() {
 	// Note: Set TTL to be long enough so that it won't expire before we write again
 	// and short enough to expire quickly once the process is shut down or killed.
-	err := h.rdb.WriteProcessInfo(h.pinfo, h.interval*2)
-	if err != nil {
-		logger.error("could not write heartbeat data: %v", err)
+	ttl := h.interval * 2
+	if h.refresher != nil && h.written && h.writtenState == h.pinfo.State && h.writtenWorkers == h.pinfo.ActiveWorkerCount {
+		ok, err := h.refresher.RefreshProcessInfo(h.pinfo, ttl)
+		if err == nil && ok {
+			return
+		}
+	}
+	if err := h.rdb.WriteProcessInfo(h.pinfo, ttl); err != nil {
+		h.written = false
+		h.logger.error("could not write heartbeat data: %v", err)
+		return
 	}
+	h.written = true
+	h.writtenState = h.pinfo.State
+	h.writtenWorkers = h.pinfo.ActiveWorkerCount
 }
@@ -37,7 +37,7 @@ func TestHeartbeater(t *testing.T) {
 
 		stateCh := make(chan string)
 		workerCh := make(chan int)
-		hb := newHeartbeater(rdbClient, tc.host, tc.pid, tc.concurrency, tc.queues, false, tc.interval, stateCh, workerCh)
+		hb := newHeartbeater(testLogger, rdbClient, tc.host, tc.pid, tc.concurrency, tc.queues, false, tc.interval, stateCh, workerCh, nil)
 
 		var wg sync.WaitGroup
 		hb.start(&wg)
@@ -102,3 +102,42 @@ func TestHeartbeater(t *testing.T) {
 		hb.terminate()
 	}
 }
+
+// heartbeatBroker records the writes of the process info.
+// Calling other methods panics.
+type heartbeatBroker struct {
+	base.Broker
+	events  []string
+	expired bool
+}
+
+func (b *heartbeatBroker) WriteProcessInfo(ps *base.ProcessInfo, ttl time.Duration) error {
+	b.events = append(b.events, "write "+ps.State)
+	b.expired = false
+	return nil
+}
+
+func (b *heartbeatBroker) RefreshProcessInfo(ps *base.ProcessInfo, ttl time.Duration) (bool, error) {
+	b.events = append(b.events, "refresh")
+	return !b.expired, nil
+}
+
+func TestHeartbeaterWritesChanges(t *testing.T) {
+	b := &heartbeatBroker{}
+	hb := newHeartbeater(testLogger, b, "localhost", 45678, 10, defaultQueueConfig, false, time.Second, nil, nil, nil)
+	hb.pinfo.State = "running"
+
+	hb.beat()
+	hb.beat()
+	hb.pinfo.ActiveWorkerCount++
+	hb.beat()
+	hb.pinfo.State = "stopped"
+	hb.beat()
+	b.expired = true
+	hb.beat()
+
+	want := []string{"write running", "refresh", "write running", "write stopped", "refresh", "write stopped"}
+	if diff := cmp.Diff(want, b.events); diff != "" {
+		t.Errorf("broker received %v, want %v; (-want,+got)\n%s", b.events, want, diff)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"sync"
+	"time"
+)
+
+// idleMonitor keeps track of how long the processor has been idle and
+// calls the hook once the processor has been idle for the timeout.
+type idleMonitor struct {
+	logger  *asynqLogger
+	timeout time.Duration
+	onIdle  func()
+
+	mu sync.Mutex
+
+	// number of tasks being processed.
+	active int
+
+	// time the last task finished, or the monitor was created.
+	since time.Time
+
+	// notified is true if the hook has been called since the last task.
+	notified bool
+}
+
+func newIdleMonitor(logger *asynqLogger, timeout time.Duration, onIdle func()) *idleMonitor {
+	return &idleMonitor{
+		logger:  logger,
+		timeout: timeout,
+		onIdle:  onIdle,
+		since:   time.Now(),
+	}
+}
+
+// taskStarted records that the processor started processing a task.
+func (m *idleMonitor) taskStarted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active++
+	m.notified = false
+}
+
+// taskFinished records that the processor finished processing a task.
+func (m *idleMonitor) taskFinished() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active--
+	if m.active == 0 {
+		m.since = time.Now()
+	}
+}
+
+// idleTime returns how long the processor has been idle,
+// or zero if it's processing tasks.
+func (m *idleMonitor) idleTime() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active > 0 {
+		return 0
+	}
+	return time.Since(m.since)
+}
+
+// check calls the hook in a new goroutine if the processor has been idle
+// for the timeout and the hook has not been called since the last task.
+// It should be called when all queues are empty.
+func (m *idleMonitor) check() {
+	if m.timeout <= 0 || m.onIdle == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active > 0 || m.notified || time.Since(m.since) < m.timeout {
+		return
+	}
+	m.notified = true
+	m.logger.info("Idle for %v", m.timeout)
+	go m.onIdle()
+}
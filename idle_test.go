@@ -0,0 +1,69 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdleMonitor(t *testing.T) {
+	called := make(chan struct{}, 10)
+	m := newIdleMonitor(testLogger, 50*time.Millisecond, func() { called <- struct{}{} })
+
+	m.check()
+	if len(called) != 0 {
+		t.Fatalf("OnIdle called before the idle timeout")
+	}
+
+	m.taskStarted()
+	time.Sleep(60 * time.Millisecond)
+	m.check()
+	if len(called) != 0 {
+		t.Fatalf("OnIdle called while processing a task")
+	}
+	if d := m.idleTime(); d != 0 {
+		t.Errorf("idleTime() = %v while processing a task, want 0", d)
+	}
+	m.taskFinished()
+
+	time.Sleep(60 * time.Millisecond)
+	m.check()
+	m.check() // should be called only once per idle period.
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatalf("OnIdle not called after the idle timeout")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if len(called) != 0 {
+		t.Errorf("OnIdle called %d more times, want once per idle period", len(called))
+	}
+	if d := m.idleTime(); d < 50*time.Millisecond {
+		t.Errorf("idleTime() = %v, want at least %v", d, 50*time.Millisecond)
+	}
+
+	// The next idle period starts after a task is processed.
+	m.taskStarted()
+	m.taskFinished()
+	time.Sleep(60 * time.Millisecond)
+	m.check()
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Errorf("OnIdle not called after the second idle period")
+	}
+}
+
+func TestIdleMonitorWithoutTimeout(t *testing.T) {
+	called := false
+	m := newIdleMonitor(testLogger, 0, func() { called = true })
+	time.Sleep(10 * time.Millisecond)
+	m.check()
+	time.Sleep(10 * time.Millisecond)
+	if called {
+		t.Errorf("OnIdle called with zero IdleTimeout")
+	}
+}
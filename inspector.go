@@ -0,0 +1,1182 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/rs/xid"
+)
+
+// ErrTaskNotFound indicates that a task specified by a key does not exist.
+var ErrTaskNotFound = rdb.ErrTaskNotFound
+
+// Inspector is used to inspect and mutate the state of tasks.
+//
+// Inspectors are safe for concurrent use by multiple goroutines.
+type Inspector struct {
+	rdb             *rdb.RDB
+	readBack        bool
+	readBackTimeout time.Duration
+}
+
+// InspectorConfig specifies the behavior of an Inspector.
+type InspectorConfig struct {
+	// ReadBack makes mutating operations verify their effect
+	// by reading the task back after the write.
+	//
+	// A mutating operation retries the read until its effect becomes
+	// visible, or returns an error if ReadBackTimeout elapses.
+	// This is useful when reads may not immediately reflect the writes
+	// (e.g. reading from a replica), so that a subsequent list call
+	// doesn't show a stale state.
+	ReadBack bool
+
+	// ReadBackTimeout specifies how long to wait for the effect
+	// of a mutating operation to become visible.
+	//
+	// If unset or zero, default timeout of 1 second is used.
+	ReadBackTimeout time.Duration
+
+	// KeyPrefix specifies the namespace of the redis keys to inspect.
+	//
+	// If unset or empty, the default namespace "{asynq}" is used.
+	// See ClientConfig for details.
+	KeyPrefix string
+}
+
+const defaultReadBackTimeout = time.Second
+
+// interval between reads to verify the effect of a mutating operation.
+const readBackInterval = 50 * time.Millisecond
+
+// NewInspector returns a new Inspector given a redis connection option
+// and inspector configuration. cfg may be nil to use the default configuration.
+func NewInspector(r RedisConnOpt, cfg *InspectorConfig) *Inspector {
+	if cfg == nil {
+		cfg = &InspectorConfig{}
+	}
+	timeout := cfg.ReadBackTimeout
+	if timeout <= 0 {
+		timeout = defaultReadBackTimeout
+	}
+	rdb := newRDB(r, cfg.KeyPrefix)
+	// tasks enqueued by the inspector wake up the backgrounds
+	// with WakeOnEnqueue option.
+	rdb.SetPublishWakeups(true)
+	return &Inspector{
+		rdb:             rdb,
+		readBack:        cfg.ReadBack,
+		readBackTimeout: timeout,
+	}
+}
+
+// Close closes the connection with redis server.
+func (i *Inspector) Close() error {
+	return i.rdb.Close()
+}
+
+// TaskInfo describes a task and its current state.
+type TaskInfo struct {
+	// ID is the identifier of the task.
+	ID string
+
+	// Key is used to specify the task in Inspector methods.
+	// Key is empty unless the task is scheduled, retry, or dead state.
+	Key string
+
+	// Type and Payload of the task.
+	Type    string
+	Payload Payload
+
+	// Queue is the name of the queue the task belongs to; the name of
+	// a sharded queue rather than of its shard.
+	Queue string
+
+	// State of the task: one of "enqueued", "inprogress",
+	// "scheduled", "retry", "dead", or "completed".
+	State string
+
+	// MaxRetry is the max number of times the task will be retried.
+	MaxRetry int
+
+	// Retried is the number of times the task has been retried so far.
+	Retried int
+
+	// Timeout is how long the task may run.
+	// Zero means no limit.
+	Timeout time.Duration
+
+	// CorrelationID identifies a group of related tasks.
+	CorrelationID string
+
+	// Headers holds the headers of the task set by the producer.
+	Headers map[string]string
+
+	// Deadline is the time by which the task must be processed.
+	// Zero means no deadline.
+	Deadline time.Time
+
+	// ErrorMsg is the error message from the last failure.
+	ErrorMsg string
+
+	// ErrorHistory holds the errors of the last failures, oldest first.
+	ErrorHistory []*TaskError
+
+	// PayloadHistory holds the previous payloads of the task, oldest first.
+	// Use PayloadDiff to see the changes from the last one.
+	PayloadHistory []*PayloadVersion
+
+	// NextProcessAt is the time the task is scheduled to be processed
+	// if the task is in scheduled or retry state.
+	// For a dead task, it's when the task was last failed, and for
+	// a completed task, it's when the task is deleted.
+	NextProcessAt time.Time
+}
+
+func newTaskInfo(msg *base.TaskMessage, state string, score int64) *TaskInfo {
+	info := &TaskInfo{
+		ID:       msg.ID.String(),
+		Type:     msg.Type,
+		Payload:  inspectPayload(msg),
+		Queue:    logicalQueue(msg.Queue),
+		State:    state,
+		MaxRetry: msg.Retry,
+		Retried:  msg.Retried,
+		ErrorMsg: msg.ErrorMsg,
+
+		CorrelationID:  msg.CorrelationID,
+		Headers:        msg.Headers,
+		ErrorHistory:   msg.ErrorHistory,
+		PayloadHistory: newPayloadHistory(msg.PayloadHistory),
+	}
+	if d, err := time.ParseDuration(msg.Timeout); err == nil {
+		info.Timeout = d
+	}
+	if msg.Deadline != 0 {
+		info.Deadline = time.Unix(0, msg.Deadline)
+	}
+	if prefix, ok := keyPrefixes[state]; ok {
+		info.Key = fmt.Sprintf("%s:%d:%s", prefix, score, info.ID)
+		info.NextProcessAt = time.Unix(score, 0)
+	}
+	return info
+}
+
+// inspectPayload returns the payload of the task message, or the data
+// as stored in redis if it cannot be decoded (e.g. it's encoded by
+// a PayloadCodec or encrypted).
+func inspectPayload(msg *base.TaskMessage) Payload {
+	payload, err := messagePayload(msg, nil, nil)
+	if err != nil {
+		return Payload{data: msg.Payload, raw: msg.Data}
+	}
+	return payload
+}
+
+// keyPrefixes maps a task state to the prefix of the task keys.
+var keyPrefixes = map[string]string{
+	"scheduled": "s",
+	"retry":     "r",
+	"dead":      "d",
+	"completed": "c",
+}
+
+// taskKey is a parsed representation of a task key.
+type taskKey struct {
+	state string
+	zset  string
+	id    xid.ID
+	score int64
+}
+
+// parseTaskKey parses a task key in "<state prefix>:<score>:<id>" format.
+func parseTaskKey(key string, keys *base.Keys) (*taskKey, error) {
+	parts := strings.Split(key, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid task key %q", key)
+	}
+	var k taskKey
+	switch parts[0] {
+	case "s":
+		k.state, k.zset = "scheduled", keys.ScheduledQueue
+	case "r":
+		k.state, k.zset = "retry", keys.RetryQueue
+	case "d":
+		k.state, k.zset = "dead", keys.DeadQueue
+	case "c":
+		k.state, k.zset = "completed", keys.CompletedQueue
+	default:
+		return nil, fmt.Errorf("invalid task key %q", key)
+	}
+	var err error
+	if k.score, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid task key %q", key)
+	}
+	if k.id, err = xid.FromString(parts[2]); err != nil {
+		return nil, fmt.Errorf("invalid task key %q", key)
+	}
+	return &k, nil
+}
+
+// GetTaskInfo returns information of the task specified by the key.
+//
+// If the task does not exist, it returns ErrTaskNotFound.
+func (i *Inspector) GetTaskInfo(key string) (*TaskInfo, error) {
+	k, err := parseTaskKey(key, i.rdb.Keys())
+	if err != nil {
+		return nil, err
+	}
+	msg, score, err := i.rdb.FindZSetTask(k.zset, k.id, k.score, k.score)
+	if err != nil {
+		return nil, err
+	}
+	return newTaskInfo(msg, k.state, score), nil
+}
+
+// EnqueueTask enqueues the scheduled, retry, or dead task specified by the key
+// so that it will be processed immediately, and returns the updated task info.
+//
+// If the task does not exist, it returns ErrTaskNotFound.
+func (i *Inspector) EnqueueTask(key string) (*TaskInfo, error) {
+	k, err := parseTaskKey(key, i.rdb.Keys())
+	if err != nil {
+		return nil, err
+	}
+	msg, _, err := i.rdb.FindZSetTask(k.zset, k.id, k.score, k.score)
+	if err != nil {
+		return nil, err
+	}
+	switch k.state {
+	case "scheduled":
+		err = i.rdb.EnqueueScheduledTask(k.id, k.score)
+	case "retry":
+		err = i.rdb.EnqueueRetryTask(k.id, k.score)
+	case "dead":
+		err = i.rdb.EnqueueDeadTask(k.id, k.score)
+	default:
+		return nil, fmt.Errorf("cannot enqueue a task in %s state", k.state)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info := newTaskInfo(msg, "enqueued", 0)
+	if !i.readBack {
+		return info, nil
+	}
+	// The task is checked to be gone from the zset rather than found in its
+	// queue, since a worker may have processed it already.
+	err = i.verify(key, "enqueue", func() (bool, error) {
+		_, _, err := i.rdb.FindZSetTask(k.zset, k.id, k.score, k.score)
+		if err == ErrTaskNotFound {
+			return true, nil
+		}
+		return false, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// KillTask moves the scheduled or retry task specified by the key
+// to the dead state, and returns the updated task info.
+//
+// Unless ReadBack is set in the config, the Key of the returned task info
+// may be empty if the dead task could not be read back right away.
+//
+// If the task does not exist, it returns ErrTaskNotFound.
+func (i *Inspector) KillTask(key string) (*TaskInfo, error) {
+	k, err := parseTaskKey(key, i.rdb.Keys())
+	if err != nil {
+		return nil, err
+	}
+	msg, _, err := i.rdb.FindZSetTask(k.zset, k.id, k.score, k.score)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	switch k.state {
+	case "scheduled":
+		err = i.rdb.KillScheduledTask(k.id, k.score)
+	case "retry":
+		err = i.rdb.KillRetryTask(k.id, k.score)
+	default:
+		return nil, fmt.Errorf("cannot kill a task in %s state", k.state)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var info *TaskInfo
+	check := func() (bool, error) {
+		m, score, err := i.rdb.FindZSetTask(i.rdb.Keys().DeadQueue, k.id, start.Unix(), time.Now().Unix())
+		if err == ErrTaskNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		info = newTaskInfo(m, "dead", score)
+		return true, nil
+	}
+	if i.readBack {
+		err = i.verify(key, "kill", check)
+		return info, err
+	}
+	// The key of the dead task is only known by reading it back,
+	// so look it up once without waiting.
+	if ok, err := check(); err != nil || !ok {
+		info = newTaskInfo(msg, "dead", 0)
+		info.Key, info.NextProcessAt = "", time.Time{}
+	}
+	return info, nil
+}
+
+// DeleteTask deletes the scheduled, retry, dead, or completed task specified
+// by the key.
+//
+// If the task does not exist, it returns ErrTaskNotFound.
+func (i *Inspector) DeleteTask(key string) error {
+	k, err := parseTaskKey(key, i.rdb.Keys())
+	if err != nil {
+		return err
+	}
+	switch k.state {
+	case "scheduled":
+		err = i.rdb.DeleteScheduledTask(k.id, k.score)
+	case "retry":
+		err = i.rdb.DeleteRetryTask(k.id, k.score)
+	case "dead":
+		err = i.rdb.DeleteDeadTask(k.id, k.score)
+	case "completed":
+		err = i.rdb.DeleteCompletedTask(k.id, k.score)
+	}
+	if err != nil || !i.readBack {
+		return err
+	}
+	return i.verify(key, "delete", func() (bool, error) {
+		_, _, err := i.rdb.FindZSetTask(k.zset, k.id, k.score, k.score)
+		if err == ErrTaskNotFound {
+			return true, nil
+		}
+		return false, err
+	})
+}
+
+// ListByCorrelationID returns all tasks that have the given correlation ID
+// across all queues and states.
+//
+// The tasks are read from an index of the correlation ID, kept up to date
+// like the rollup counts (see Rollup). Tasks updated by the Inspector, or
+// enqueued tasks deleted with their queue, may be left out or listed as they
+// were until the index is rebuilt by RefreshRollups.
+func (i *Inspector) ListByCorrelationID(id string) ([]*TaskInfo, error) {
+	if id == "" {
+		return nil, fmt.Errorf("correlation ID should not be empty")
+	}
+	tasks, err := i.rdb.FindTasksByCorrelationID(id)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*TaskInfo, len(tasks))
+	for j, t := range tasks {
+		res[j] = newTaskInfo(t.Msg, t.State, t.Score)
+	}
+	return res, nil
+}
+
+// CountByCorrelationID returns the number of tasks that have the given
+// correlation ID in each state (e.g. "enqueued": 2, "dead": 1).
+func (i *Inspector) CountByCorrelationID(id string) (map[string]int, error) {
+	tasks, err := i.ListByCorrelationID(id)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]int)
+	for _, t := range tasks {
+		res[t.State]++
+	}
+	return res, nil
+}
+
+// ListTasks returns a page of the tasks in the given state, one of
+// "enqueued", "inprogress", "scheduled", "retry", "dead", or "completed".
+// Completed tasks are kept only by the backgrounds with CompletedRetention.
+//
+// qname specifies the queue of the enqueued tasks to list, and is ignored
+// for other states. The enqueued tasks of a sharded queue are listed from
+// all its shards. page is numbered from zero.
+func (i *Inspector) ListTasks(state, qname string, page, pageSize int) ([]*TaskInfo, error) {
+	if page < 0 || pageSize < 1 {
+		return nil, fmt.Errorf("page should be non-negative and page size should be positive, got %d and %d", page, pageSize)
+	}
+	pgn := rdb.Pagination{Page: page, Size: pageSize}
+	qname = strings.ToLower(qname)
+	var qnames []string
+	if state == "enqueued" {
+		var err error
+		if qnames, err = i.queueLists(qname); err != nil {
+			return nil, err
+		}
+	}
+	var tasks []*rdb.CorrelatedTask
+	var err error
+	if len(qnames) > 1 || len(qnames) == 1 && qnames[0] != qname {
+		tasks, err = i.rdb.ListEnqueuedInQueues(qnames, pgn)
+	} else {
+		tasks, err = i.rdb.ListMessages(state, qname, pgn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*TaskInfo, len(tasks))
+	for j, t := range tasks {
+		res[j] = newTaskInfo(t.Msg, t.State, t.Score)
+	}
+	return res, nil
+}
+
+// queueLists returns the names of the lists holding the enqueued tasks of
+// the queue: the queue itself if it exists, followed by its shards in order.
+//
+// The shards are found in the queues in redis, so that an Inspector doesn't
+// need to be configured with the shards of the queues.
+func (i *Inspector) queueLists(qname string) ([]string, error) {
+	stats, err := i.rdb.CurrentStats()
+	if err != nil {
+		return nil, err
+	}
+	var shards []string
+	for q := range stats.Queues {
+		if shardIndex(q) >= 0 && logicalQueue(q) == qname {
+			shards = append(shards, q)
+		}
+	}
+	sort.Slice(shards, func(x, y int) bool { return shardIndex(shards[x]) < shardIndex(shards[y]) })
+	if _, ok := stats.Queues[qname]; ok {
+		return append([]string{qname}, shards...), nil
+	}
+	return shards, nil
+}
+
+// RenameTaskType rewrites the enqueued, scheduled, and retry tasks of type
+// oldType to be of type newType, and returns the number of tasks rewritten.
+//
+// If transform is non-nil, it's called with oldType to transform the payload
+// of each task rewritten, and the previous payload is kept in the
+// PayloadHistory of the task. Binary payloads, and payloads encoded by
+// a PayloadCodec or compressed are not transformed. If transform returns
+// a non-nil error, RenameTaskType stops and returns the error; the tasks
+// rewritten until then are kept rewritten, and it's safe to call
+// RenameTaskType again.
+//
+// To rename a task type without stranding tasks in flight, first deploy the
+// backgrounds with TypeAliases mapping oldType to newType, then update the
+// clients to enqueue tasks of newType, and finally call RenameTaskType to
+// rewrite the remaining tasks of oldType. Tasks being processed or dead are
+// not rewritten, and are processed with the alias when they're retried or
+// enqueued again.
+func (i *Inspector) RenameTaskType(oldType, newType string, transform PayloadTransformer) (int, error) {
+	if oldType == "" || newType == "" {
+		return 0, fmt.Errorf("task type should not be empty")
+	}
+	var fn func(map[string]interface{}) (map[string]interface{}, error)
+	if transform != nil {
+		fn = func(payload map[string]interface{}) (map[string]interface{}, error) {
+			return transform(oldType, payload)
+		}
+	}
+	counts, err := i.rdb.RenameTaskType(oldType, newType, fn)
+	n := 0
+	for _, c := range counts {
+		n += c
+	}
+	return n, err
+}
+
+// TaskFilter specifies the tasks to update with Inspector.UpdateTasks.
+// Zero fields match any task.
+type TaskFilter struct {
+	// State specifies the state of the tasks, "enqueued" or "scheduled".
+	//
+	// If empty, both enqueued and scheduled tasks are matched.
+	State string
+
+	// Queue specifies the queue of the tasks. The tasks of all the shards
+	// of a sharded queue are matched.
+	Queue string
+
+	// Type specifies the type of the tasks.
+	Type string
+
+	// CorrelationID specifies the correlation ID of the tasks.
+	CorrelationID string
+
+	// ProcessAfter and ProcessBefore specify the window of the time the
+	// tasks are scheduled to be processed at. If either is set, only
+	// the scheduled tasks within the window are matched.
+	ProcessAfter  time.Time
+	ProcessBefore time.Time
+}
+
+func (f *TaskFilter) match(msg *base.TaskMessage, processAt time.Time) bool {
+	if q := strings.ToLower(f.Queue); q != "" && msg.Queue != q && logicalQueue(msg.Queue) != q {
+		return false
+	}
+	if f.Type != "" && msg.Type != f.Type {
+		return false
+	}
+	if f.CorrelationID != "" && msg.CorrelationID != f.CorrelationID {
+		return false
+	}
+	if f.ProcessAfter.IsZero() && f.ProcessBefore.IsZero() {
+		return true
+	}
+	if processAt.IsZero() {
+		return false
+	}
+	if !f.ProcessAfter.IsZero() && processAt.Before(f.ProcessAfter) {
+		return false
+	}
+	if !f.ProcessBefore.IsZero() && !processAt.Before(f.ProcessBefore) {
+		return false
+	}
+	return true
+}
+
+// TaskChanges specifies the changes Inspector.UpdateTasks makes to each
+// task matched. Zero fields are not changed.
+type TaskChanges struct {
+	// Queue specifies the queue to move the tasks to. Tasks moved to
+	// a sharded queue are moved to one of its shards at random, unless
+	// they're in the queue already.
+	Queue string
+
+	// MaxRetry specifies the max number of retries of the tasks.
+	MaxRetry *int
+
+	// Timeout specifies how long the tasks may run; zero means no limit.
+	Timeout *time.Duration
+
+	// ProcessAt specifies the time to process the tasks at. Enqueued tasks
+	// are scheduled if the time is in the future.
+	ProcessAt time.Time
+
+	// Delay specifies how long to postpone the tasks by, from the time they
+	// are scheduled to be processed at, or from now for enqueued tasks.
+	//
+	// Delay and ProcessAt cannot be set at the same time.
+	Delay time.Duration
+}
+
+// UpdateTasks applies the changes to the enqueued and scheduled tasks
+// matching the filter, and returns the number of tasks updated.
+//
+// Tasks being processed, retried, or dead are not updated. Tasks are
+// updated one at a time; a task processed or deleted while UpdateTasks
+// runs is skipped, and if UpdateTasks returns a non-nil error, the tasks
+// updated until then are kept updated. The changed fields are not signed,
+// so updated tasks keep their signature, see Signing.
+func (i *Inspector) UpdateTasks(filter *TaskFilter, changes *TaskChanges) (int, error) {
+	if filter == nil {
+		filter = &TaskFilter{}
+	}
+	if changes == nil {
+		return 0, fmt.Errorf("changes should not be nil")
+	}
+	if !changes.ProcessAt.IsZero() && changes.Delay != 0 {
+		return 0, fmt.Errorf("ProcessAt and Delay should not be set at the same time")
+	}
+	if changes.MaxRetry != nil && *changes.MaxRetry < 0 {
+		return 0, fmt.Errorf("max retry should not be negative, got %d", *changes.MaxRetry)
+	}
+	var enqueued, scheduled bool
+	switch strings.ToLower(filter.State) {
+	case "":
+		enqueued, scheduled = true, true
+	case "enqueued":
+		enqueued = true
+	case "scheduled":
+		scheduled = true
+	default:
+		return 0, fmt.Errorf("tasks in state %q cannot be updated, want %q or %q", filter.State, "enqueued", "scheduled")
+	}
+	dst := strings.ToLower(changes.Queue)
+	var shards []string
+	if dst != "" {
+		qnames, err := i.queueLists(dst)
+		if err != nil {
+			return 0, err
+		}
+		for _, q := range qnames {
+			if q != dst {
+				shards = append(shards, q)
+			}
+		}
+	}
+	now := time.Now()
+	counts, err := i.rdb.UpdateTasks(enqueued, scheduled, func(msg *base.TaskMessage, processAt time.Time) (time.Time, bool) {
+		if !filter.match(msg, processAt) {
+			return time.Time{}, false
+		}
+		switch {
+		case dst == "" || logicalQueue(msg.Queue) == dst:
+		case len(shards) > 0:
+			msg.Queue = shards[rand.Intn(len(shards))]
+		default:
+			msg.Queue = dst
+		}
+		if changes.MaxRetry != nil {
+			msg.Retry = *changes.MaxRetry
+		}
+		if changes.Timeout != nil {
+			msg.Timeout = changes.Timeout.String()
+		}
+		var t time.Time
+		switch {
+		case !changes.ProcessAt.IsZero():
+			t = changes.ProcessAt
+		case changes.Delay != 0 && processAt.IsZero():
+			t = now.Add(changes.Delay)
+		case changes.Delay != 0:
+			t = processAt.Add(changes.Delay)
+		}
+		if !t.IsZero() {
+			msg.ProcessAt = t.UnixNano()
+		}
+		return t, true
+	})
+	n := 0
+	for _, c := range counts {
+		n += c
+	}
+	return n, err
+}
+
+// ListProcesses returns the background worker processes
+// which are running, sorted by host and pid.
+func (i *Inspector) ListProcesses() ([]*ProcessInfo, error) {
+	res, err := i.rdb.ListProcesses()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(res, func(x, y int) bool {
+		if res[x].Host != res[y].Host {
+			return res[x].Host < res[y].Host
+		}
+		return res[x].PID < res[y].PID
+	})
+	return res, nil
+}
+
+// Stats holds the current state of the queues.
+type Stats struct {
+	// Total number of tasks enqueued in all queues.
+	Enqueued int
+
+	// Number of tasks currently being processed.
+	InProgress int
+
+	// Number of tasks in scheduled, retry, dead, and completed state
+	// respectively.
+	Scheduled int
+	Retry     int
+	Dead      int
+	Completed int
+
+	// Number of tasks processed and failed today (UTC).
+	Processed int
+	Failed    int
+
+	// Total number of duplicate deliveries detected by the backgrounds
+	// with DuplicateDetection.
+	DuplicateDeliveries int
+
+	// Number of tasks enqueued in each queue by queue name. The tasks of
+	// a sharded queue are counted under the name of the queue.
+	Queues map[string]int
+
+	// Time the stats were taken.
+	Timestamp time.Time
+}
+
+// CurrentStats returns the current state of the queues.
+func (i *Inspector) CurrentStats() (*Stats, error) {
+	s, err := i.rdb.CurrentStats()
+	if err != nil {
+		return nil, err
+	}
+	return &Stats{
+		Enqueued:   s.Enqueued,
+		InProgress: s.InProgress,
+		Scheduled:  s.Scheduled,
+		Retry:      s.Retry,
+		Dead:       s.Dead,
+		Completed:  s.Completed,
+		Processed:  s.Processed,
+		Failed:     s.Failed,
+		Queues:     logicalQueueSizes(s.Queues),
+		Timestamp:  s.Timestamp,
+
+		DuplicateDeliveries: s.Duplicates,
+	}, nil
+}
+
+// logicalQueueSizes returns the sizes of the queues with the sizes of the
+// shards of each sharded queue summed up under the name of the queue.
+func logicalQueueSizes(sizes map[string]int) map[string]int {
+	res := make(map[string]int, len(sizes))
+	for qname, n := range sizes {
+		res[logicalQueue(qname)] += n
+	}
+	return res
+}
+
+// DailyCosts holds the costs reported by handlers with AddCost for a day.
+type DailyCosts struct {
+	// ByType maps task type to resource name to amount.
+	ByType map[string]map[string]float64
+
+	// ByDimension maps rollup dimension to value to resource name to amount
+	// (e.g. ByDimension["team"]["payments"]["openai_tokens"]).
+	ByDimension map[string]map[string]map[string]float64
+
+	// Time within the day (UTC).
+	Time time.Time
+}
+
+// Costs returns the costs reported by handlers from the last n days,
+// most recent day first. Costs are kept for 90 days.
+func (i *Inspector) Costs(n int) ([]*DailyCosts, error) {
+	data, err := i.rdb.Costs(n)
+	if err != nil {
+		return nil, err
+	}
+	var res []*DailyCosts
+	for _, c := range data {
+		res = append(res, &DailyCosts{
+			ByType:      c.ByType,
+			ByDimension: c.ByDimension,
+			Time:        c.Time,
+		})
+	}
+	return res, nil
+}
+
+// LatencyStats holds the distributions of the durations the tasks of a type
+// in a queue waited in the queue and took to process.
+type LatencyStats struct {
+	Queue string
+	Type  string
+
+	// Wait is the distribution of the durations from the time the tasks were
+	// scheduled to be processed at (or enqueued at) until a worker started
+	// processing them. Only the first attempts of the tasks are counted,
+	// and tasks scheduled by older versions of the client are not counted.
+	Wait *Distribution
+
+	// Run is the distribution of the durations the handler took to process
+	// the tasks. Tasks processed as a batch by a BulkHandler are counted as
+	// taking the whole duration of the batch.
+	Run *Distribution
+}
+
+// Distribution summarizes a distribution of durations.
+//
+// Percentiles are read from histograms, and may be up to 19% greater than
+// the actual values.
+type Distribution struct {
+	// Count is the number of durations in the distribution.
+	Count int64
+
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+}
+
+func newDistribution(h rdb.LatencyHistogram) *Distribution {
+	return &Distribution{
+		Count: h.Count(),
+		P50:   h.Quantile(0.5),
+		P90:   h.Quantile(0.9),
+		P99:   h.Quantile(0.99),
+	}
+}
+
+// Latencies returns the distributions of the wait and run durations of the
+// tasks processed in the last window of time (e.g. time.Hour), per queue
+// and task type, sorted by queue and type.
+//
+// Latencies are recorded with a resolution of a minute and kept for a day;
+// window is capped at 24 hours.
+func (i *Inspector) Latencies(window time.Duration) ([]*LatencyStats, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("window should be positive, got %v", window)
+	}
+	data, err := i.rdb.Latencies(window)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*LatencyStats, len(data))
+	for j, l := range data {
+		res[j] = &LatencyStats{
+			Queue: l.Queue,
+			Type:  l.Type,
+			Wait:  newDistribution(l.Wait),
+			Run:   newDistribution(l.Run),
+		}
+	}
+	return res, nil
+}
+
+// Result returns the pointer to the result of the task with the given id,
+// which was streamed by its handler to the result sink with CreateResult.
+//
+// If the task has no result or the pointer has expired, it returns
+// ErrResultNotFound.
+func (i *Inspector) Result(id string) (*TaskResult, error) {
+	return i.rdb.Result(id)
+}
+
+// Progress returns the last progress reported with ReportProgress by the
+// handler of the task with the given id.
+//
+// If no progress was reported or it has expired, it returns
+// ErrProgressNotFound.
+func (i *Inspector) Progress(id string) (*TaskProgress, error) {
+	return i.rdb.Progress(id)
+}
+
+// CanaryStatus is the state of the canary task scheduled by the backgrounds
+// with Canary option.
+type CanaryStatus struct {
+	// Time the canary was last scheduled.
+	LastEnqueued time.Time
+
+	// Time the canary was last completed, zero if it has never been completed.
+	LastCompleted time.Time
+
+	// MaxAge is how long after its completion the canary is considered stale,
+	// which is the Interval plus the MaxDelay of the Canary option.
+	MaxAge time.Duration
+
+	// Healthy is true if the canary has been completed within MaxAge.
+	Healthy bool
+}
+
+// Canary returns the state of the canary task, or nil if no background
+// has scheduled the canary.
+//
+// The canary is unhealthy if it hasn't been completed recently, which
+// indicates that tasks are not flowing through the pipeline.
+// It's also unhealthy until the first canary is completed.
+func (i *Inspector) Canary() (*CanaryStatus, error) {
+	c, err := i.rdb.Canary()
+	if err != nil || c == nil {
+		return nil, err
+	}
+	return &CanaryStatus{
+		LastEnqueued:  c.Enqueued,
+		LastCompleted: c.Completed,
+		MaxAge:        c.MaxAge,
+		Healthy:       !c.Completed.IsZero() && time.Since(c.Completed) <= c.MaxAge,
+	}, nil
+}
+
+// QueueWeights returns the weights of the queues stored in redis.
+//
+// The weights are seeded from the Queues field of Config when a background
+// worker process starts, unless they have been set already.
+func (i *Inspector) QueueWeights() (map[string]int, error) {
+	return i.rdb.QueueWeights()
+}
+
+// SetQueueWeight sets the weight of the given queue.
+//
+// The weight is picked up by all running background worker processes
+// within a few seconds; a weight of zero pauses processing the queue.
+// The weight applies only to the processes configured to process the queue.
+func (i *Inspector) SetQueueWeight(qname string, weight int) error {
+	if weight < 0 {
+		return fmt.Errorf("queue weight should not be negative, got %d", weight)
+	}
+	return i.rdb.SetQueueWeight(strings.ToLower(qname), weight)
+}
+
+// Snapshot is the state of the queues and the background worker processes
+// at a point in time, which can be encoded in JSON (e.g. to serve it from
+// the /status endpoint of an application).
+type Snapshot struct {
+	// Time the snapshot was taken.
+	Time time.Time
+
+	// Queues sorted by name.
+	Queues []*QueueSnapshot
+
+	// Number of tasks in each state; Enqueued is the sum of the queue sizes.
+	Enqueued   int
+	InProgress int
+	Scheduled  int
+	Retry      int
+	Dead       int
+
+	// Number of tasks processed and failed today (UTC).
+	Processed int
+	Failed    int
+
+	// Throughput is the number of tasks processed per second today (UTC).
+	Throughput float64
+
+	// ErrorRate is the ratio of failed tasks to processed tasks today (UTC).
+	ErrorRate float64
+
+	// Processes are the running background worker processes,
+	// sorted by host and pid.
+	Processes []*ProcessInfo
+
+	// KillSwitch is the kill switch if engaged, nil otherwise.
+	KillSwitch *KillSwitch `json:",omitempty"`
+}
+
+// QueueSnapshot is the state of a queue in a Snapshot.
+type QueueSnapshot struct {
+	Name string
+
+	// Number of tasks enqueued in the queue.
+	Size int
+
+	// Weight of the queue stored in redis, nil if not set.
+	Weight *int `json:",omitempty"`
+}
+
+// Snapshot returns the current state of the queues and the background
+// worker processes.
+//
+// Task counts are taken atomically so that they are consistent with each
+// other; processes and the kill switch are read right after.
+func (i *Inspector) Snapshot() (*Snapshot, error) {
+	stats, err := i.rdb.CurrentStats()
+	if err != nil {
+		return nil, err
+	}
+	weights, err := i.rdb.QueueWeights()
+	if err != nil {
+		return nil, err
+	}
+	ps, err := i.ListProcesses()
+	if err != nil {
+		return nil, err
+	}
+	ks, err := i.rdb.KillSwitch()
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{
+		Time:       stats.Timestamp,
+		Queues:     []*QueueSnapshot{},
+		Enqueued:   stats.Enqueued,
+		InProgress: stats.InProgress,
+		Scheduled:  stats.Scheduled,
+		Retry:      stats.Retry,
+		Dead:       stats.Dead,
+		Processed:  stats.Processed,
+		Failed:     stats.Failed,
+		Processes:  ps,
+		KillSwitch: ks,
+	}
+	if s.Processes == nil {
+		s.Processes = []*ProcessInfo{}
+	}
+	for qname, n := range logicalQueueSizes(stats.Queues) {
+		q := &QueueSnapshot{Name: qname, Size: n}
+		if w, ok := weights[qname]; ok {
+			q.Weight = &w
+		}
+		s.Queues = append(s.Queues, q)
+	}
+	sort.Slice(s.Queues, func(x, y int) bool { return s.Queues[x].Name < s.Queues[y].Name })
+	now := stats.Timestamp.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if elapsed := now.Sub(midnight).Seconds(); elapsed > 0 {
+		s.Throughput = float64(s.Processed) / elapsed
+	}
+	if s.Processed > 0 {
+		s.ErrorRate = float64(s.Failed) / float64(s.Processed)
+	}
+	return s, nil
+}
+
+// KillSwitchEvent is an audit entry of a change to the kill switch.
+type KillSwitchEvent = base.KillSwitchEvent
+
+// EngageKillSwitch pauses processing in all background worker processes
+// for the duration d, as an emergency stop. Engaging the kill switch
+// again renews it for the new duration.
+//
+// In-flight tasks are not affected. Processing resumes automatically once
+// the kill switch expires, or when it's disengaged with DisengageKillSwitch.
+// The change is recorded in the kill switch log with the reason.
+func (i *Inspector) EngageKillSwitch(d time.Duration, reason string) (*KillSwitch, error) {
+	if d <= 0 {
+		return nil, fmt.Errorf("kill switch duration should be positive, got %v", d)
+	}
+	now := time.Now()
+	ks := &KillSwitch{
+		Reason:  reason,
+		By:      operator(),
+		Engaged: now,
+		Expires: now.Add(d),
+	}
+	if err := i.rdb.EngageKillSwitch(ks); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// DisengageKillSwitch resumes processing paused by the kill switch,
+// and reports whether the kill switch was engaged.
+func (i *Inspector) DisengageKillSwitch() (bool, error) {
+	return i.rdb.DisengageKillSwitch(operator())
+}
+
+// KillSwitch returns the kill switch if it's engaged, or nil otherwise.
+func (i *Inspector) KillSwitch() (*KillSwitch, error) {
+	return i.rdb.KillSwitch()
+}
+
+// KillSwitchLog returns up to n most recent changes to the kill switch,
+// most recent first. Changes older than the last 100 are not kept.
+func (i *Inspector) KillSwitchLog(n int) ([]*KillSwitchEvent, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("number of events should be positive, got %d", n)
+	}
+	return i.rdb.KillSwitchLog(n)
+}
+
+// operator returns "user@host" identifying who performs an operation.
+func operator() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown-host"
+	}
+	return name + "@" + host
+}
+
+// WaitForTasks blocks until there are tasks waiting to be processed in any
+// queue and returns the name of one of those queues, or returns an error
+// if ctx is done first.
+//
+// WaitForTasks is intended for orchestration layers which scale backgrounds
+// down to zero when they are idle (see Config.OnIdle) to bring them back
+// when work arrives. It returns immediately if tasks are already waiting,
+// including the scheduled and retry tasks which are due but haven't been
+// forwarded to their queues since no background is running. Otherwise it
+// waits for a wakeup published by a Client with PublishWakeups option, or
+// until the next scheduled or retry task is due.
+func (i *Inspector) WaitForTasks(ctx context.Context) (string, error) {
+	// Subscribe before checking the queues to avoid missing any wakeups.
+	pubsub, err := i.rdb.WakePubSub()
+	if err != nil {
+		return "", err
+	}
+	defer pubsub.Close()
+	stats, err := i.rdb.CurrentStats()
+	if err != nil {
+		return "", err
+	}
+	for qname, n := range stats.Queues {
+		if n > 0 {
+			return qname, nil
+		}
+	}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		var due <-chan time.Time
+		msg, dueAt, err := i.rdb.NextDelayedTask()
+		switch {
+		case err == rdb.ErrTaskNotFound:
+		case err != nil:
+			return "", err
+		case !dueAt.After(time.Now()):
+			return logicalQueue(msg.Queue), nil
+		default:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(time.Until(dueAt))
+			due = timer.C
+		}
+		select {
+		case m := <-pubsub.Channel():
+			return m.Payload, nil
+		case <-due:
+			// check again, since the task may have been deleted or
+			// rescheduled in the meantime.
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// Rollup returns the number of tasks in each state by value of the given
+// rollup dimension (see ClientConfig.RollupDimensions), e.g.
+// rollup["pro"]["enqueued"] is the number of enqueued tasks whose payload
+// has "pro" as the value of the dimension.
+//
+// Counts are kept up to date as tasks are enqueued, scheduled, processed,
+// retried and killed, and as the Inspector enqueues, kills or deletes them
+// one at a time or by queue. Tasks moved or deleted otherwise (e.g. updated
+// by the Inspector, or trimmed from the dead and completed queues) are
+// counted correctly as of the last refresh by a background with
+// RollupInterval option, or RefreshRollups.
+func (i *Inspector) Rollup(dimension string) (map[string]map[string]int, error) {
+	return i.rdb.Rollups(dimension)
+}
+
+// RefreshRollups recounts the tasks by the values of their rollup dimensions,
+// correcting the counts of the tasks moved or deleted without updating them.
+// It rebuilds the indexes of the correlation IDs too (see ListByCorrelationID).
+//
+// RefreshRollups scans all tasks, so it should be called sparingly.
+func (i *Inspector) RefreshRollups() error {
+	return i.rdb.RefreshRollups()
+}
+
+// verify calls check until it reports that the effect of the operation
+// is visible, or returns an error if the read back timeout elapses.
+func (i *Inspector) verify(key, op string, check func() (bool, error)) error {
+	deadline := time.Now().Add(i.readBackTimeout)
+	for {
+		ok, err := check()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("could not verify %s of task %q within %v", op, key, i.readBackTimeout)
+		}
+		time.Sleep(readBackInterval)
+	}
+}
@@ -0,0 +1,493 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+func TestParseTaskKey(t *testing.T) {
+	m := h.NewTaskMessage("send_email", nil)
+
+	tests := []struct {
+		key     string
+		want    *taskKey
+		wantErr bool
+	}{
+		{
+			key:  fmt.Sprintf("s:1575732274:%s", m.ID),
+			want: &taskKey{state: "scheduled", zset: base.ScheduledQueue, id: m.ID, score: 1575732274},
+		},
+		{
+			key:  fmt.Sprintf("r:1575732274:%s", m.ID),
+			want: &taskKey{state: "retry", zset: base.RetryQueue, id: m.ID, score: 1575732274},
+		},
+		{
+			key:  fmt.Sprintf("d:1575732274:%s", m.ID),
+			want: &taskKey{state: "dead", zset: base.DeadQueue, id: m.ID, score: 1575732274},
+		},
+		{
+			key:  fmt.Sprintf("c:1575732274:%s", m.ID),
+			want: &taskKey{state: "completed", zset: base.CompletedQueue, id: m.ID, score: 1575732274},
+		},
+		{key: fmt.Sprintf("x:1575732274:%s", m.ID), wantErr: true},
+		{key: fmt.Sprintf("s:abc:%s", m.ID), wantErr: true},
+		{key: "s:1575732274:badid", wantErr: true},
+		{key: "s:1575732274", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		got, err := parseTaskKey(tc.key, base.DefaultKeys)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseTaskKey(%q) returned nil error, want non-nil error", tc.key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTaskKey(%q) returned error: %v", tc.key, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(taskKey{})); diff != "" {
+			t.Errorf("parseTaskKey(%q) = %+v, want %+v; (-want,+got)\n%s", tc.key, got, tc.want, diff)
+		}
+	}
+}
+
+func TestInspectorEnqueueTaskWithReadBack(t *testing.T) {
+	r := setup(t)
+	m := h.NewTaskMessage("send_email", nil)
+	score := time.Now().Add(time.Hour).Unix()
+	h.SeedScheduledQueue(t, r, []h.ZSetEntry{{Msg: m, Score: float64(score)}})
+
+	inspector := NewInspector(RedisClientOpt{Addr: redisAddr, DB: redisDB}, &InspectorConfig{ReadBack: true})
+	key := fmt.Sprintf("s:%d:%s", score, m.ID)
+
+	got, err := inspector.EnqueueTask(key)
+	if err != nil {
+		t.Fatalf("(*Inspector).EnqueueTask(%q) returned error: %v", key, err)
+	}
+	if got.ID != m.ID.String() || got.State != "enqueued" || got.Key != "" {
+		t.Errorf("(*Inspector).EnqueueTask(%q) = %+v, want enqueued task with ID %v", key, got, m.ID)
+	}
+	if _, err := inspector.EnqueueTask(key); err != ErrTaskNotFound {
+		t.Errorf("second (*Inspector).EnqueueTask(%q) returned error %v, want %v", key, err, ErrTaskNotFound)
+	}
+	if enqueued := h.GetEnqueuedMessages(t, r); len(enqueued) != 1 {
+		t.Errorf("got %d enqueued messages, want 1", len(enqueued))
+	}
+}
+
+func TestInspectorKillTaskWithReadBack(t *testing.T) {
+	r := setup(t)
+	m := h.NewTaskMessage("send_email", nil)
+	score := time.Now().Add(time.Minute).Unix()
+	h.SeedRetryQueue(t, r, []h.ZSetEntry{{Msg: m, Score: float64(score)}})
+
+	inspector := NewInspector(RedisClientOpt{Addr: redisAddr, DB: redisDB}, &InspectorConfig{ReadBack: true})
+	key := fmt.Sprintf("r:%d:%s", score, m.ID)
+
+	got, err := inspector.KillTask(key)
+	if err != nil {
+		t.Fatalf("(*Inspector).KillTask(%q) returned error: %v", key, err)
+	}
+	if got.ID != m.ID.String() || got.State != "dead" {
+		t.Errorf("(*Inspector).KillTask(%q) = %+v, want dead task with ID %v", key, got, m.ID)
+	}
+	// The returned key should specify the task in dead state.
+	info, err := inspector.GetTaskInfo(got.Key)
+	if err != nil {
+		t.Fatalf("(*Inspector).GetTaskInfo(%q) returned error: %v", got.Key, err)
+	}
+	if diff := cmp.Diff(got, info, cmp.AllowUnexported(Payload{})); diff != "" {
+		t.Errorf("(*Inspector).GetTaskInfo(%q) = %+v, want %+v; (-want,+got)\n%s", got.Key, info, got, diff)
+	}
+}
+
+func TestInspectorDeleteTaskWithReadBack(t *testing.T) {
+	r := setup(t)
+	m := h.NewTaskMessage("send_email", nil)
+	score := time.Now().Add(-time.Hour).Unix()
+	h.SeedDeadQueue(t, r, []h.ZSetEntry{{Msg: m, Score: float64(score)}})
+
+	inspector := NewInspector(RedisClientOpt{Addr: redisAddr, DB: redisDB}, &InspectorConfig{ReadBack: true})
+	key := fmt.Sprintf("d:%d:%s", score, m.ID)
+
+	if err := inspector.DeleteTask(key); err != nil {
+		t.Fatalf("(*Inspector).DeleteTask(%q) returned error: %v", key, err)
+	}
+	if _, err := inspector.GetTaskInfo(key); err != ErrTaskNotFound {
+		t.Errorf("(*Inspector).GetTaskInfo(%q) returned error %v, want %v", key, err, ErrTaskNotFound)
+	}
+}
+
+func TestInspectorListByCorrelationID(t *testing.T) {
+	setup(t)
+	client := NewClient(RedisClientOpt{Addr: redisAddr, DB: redisDB})
+	inspector := NewInspector(RedisClientOpt{Addr: redisAddr, DB: redisDB}, nil)
+
+	task := NewTask("send_email", nil)
+	for _, processAt := range []time.Time{time.Now(), time.Now().Add(time.Hour)} {
+		if _, err := client.Schedule(task, processAt, CorrelationID("req-1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := client.Schedule(task, time.Now(), CorrelationID("req-2")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := inspector.CountByCorrelationID("req-1")
+	if err != nil {
+		t.Fatalf("(*Inspector).CountByCorrelationID(%q) returned error: %v", "req-1", err)
+	}
+	want := map[string]int{"enqueued": 1, "scheduled": 1}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(*Inspector).CountByCorrelationID(%q) = %v, want %v; (-want,+got)\n%s", "req-1", got, want, diff)
+	}
+}
+
+func TestInspectorWaitForTasks(t *testing.T) {
+	setup(t)
+	client := NewClientWithConfig(RedisClientOpt{Addr: redisAddr, DB: redisDB}, &ClientConfig{PublishWakeups: true})
+	inspector := NewInspector(RedisClientOpt{Addr: redisAddr, DB: redisDB}, nil)
+
+	// Should time out if no tasks are enqueued.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := inspector.WaitForTasks(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("(*Inspector).WaitForTasks returned error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		client.Schedule(NewTask("send_email", nil), time.Now(), Queue("critical"))
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	qname, err := inspector.WaitForTasks(ctx)
+	if err != nil {
+		t.Fatalf("(*Inspector).WaitForTasks returned error: %v", err)
+	}
+	if qname != "critical" {
+		t.Errorf("(*Inspector).WaitForTasks = %q, want %q", qname, "critical")
+	}
+
+	// Should return immediately since the task is waiting in the queue.
+	qname, err = inspector.WaitForTasks(context.Background())
+	if err != nil || qname != "critical" {
+		t.Errorf("(*Inspector).WaitForTasks = %q, %v, want %q, nil", qname, err, "critical")
+	}
+}
+
+func TestInspectorWaitForDelayedTasks(t *testing.T) {
+	setup(t)
+	client := NewClient(RedisClientOpt{Addr: redisAddr, DB: redisDB})
+	inspector := NewInspector(RedisClientOpt{Addr: redisAddr, DB: redisDB}, nil)
+
+	// no background forwards the task, and no wakeup is published.
+	if _, err := client.Schedule(NewTask("send_email", nil), time.Now().Add(time.Second), Queue("low")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	qname, err := inspector.WaitForTasks(ctx)
+	if err != nil {
+		t.Fatalf("(*Inspector).WaitForTasks returned error: %v", err)
+	}
+	if qname != "low" {
+		t.Errorf("(*Inspector).WaitForTasks = %q, want %q", qname, "low")
+	}
+}
+
+func TestInspectorCurrentStats(t *testing.T) {
+	setup(t)
+	client := NewClient(RedisClientOpt{Addr: redisAddr, DB: redisDB})
+	inspector := NewInspector(RedisClientOpt{Addr: redisAddr, DB: redisDB}, nil)
+
+	task := NewTask("send_email", nil)
+	schedule := []struct {
+		processAt time.Time
+		opts      []Option
+	}{
+		{time.Now(), nil},
+		{time.Now(), []Option{Queue("critical")}},
+		{time.Now(), []Option{Queue("critical")}},
+		{time.Now().Add(time.Hour), nil},
+	}
+	for _, s := range schedule {
+		if _, err := client.Schedule(task, s.processAt, s.opts...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := inspector.CurrentStats()
+	if err != nil {
+		t.Fatalf("(*Inspector).CurrentStats() returned error: %v", err)
+	}
+	want := &Stats{
+		Enqueued:  3,
+		Scheduled: 1,
+		Queues:    map[string]int{"default": 1, "critical": 2},
+	}
+	ignoreOpt := cmpopts.IgnoreFields(Stats{}, "Timestamp")
+	if diff := cmp.Diff(want, got, ignoreOpt); diff != "" {
+		t.Errorf("(*Inspector).CurrentStats() = %+v, want %+v; (-want,+got)\n%s", got, want, diff)
+	}
+}
+
+func TestInspectorSnapshot(t *testing.T) {
+	setup(t)
+	client := NewClient(RedisClientOpt{Addr: redisAddr, DB: redisDB})
+	inspector := NewInspector(RedisClientOpt{Addr: redisAddr, DB: redisDB}, nil)
+
+	task := NewTask("send_email", nil)
+	for _, opts := range [][]Option{nil, {Queue("critical")}, {Queue("critical")}} {
+		if _, err := client.Schedule(task, time.Now(), opts...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := inspector.SetQueueWeight("critical", 6); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := inspector.Snapshot()
+	if err != nil {
+		t.Fatalf("(*Inspector).Snapshot() returned error: %v", err)
+	}
+	weight := 6
+	want := &Snapshot{
+		Queues: []*QueueSnapshot{
+			{Name: "critical", Size: 2, Weight: &weight},
+			{Name: "default", Size: 1},
+		},
+		Enqueued:  3,
+		Processes: []*ProcessInfo{},
+	}
+	ignoreOpt := cmpopts.IgnoreFields(Snapshot{}, "Time")
+	if diff := cmp.Diff(want, got, ignoreOpt); diff != "" {
+		t.Errorf("(*Inspector).Snapshot() = %+v, want %+v; (-want,+got)\n%s", got, want, diff)
+	}
+}
+
+func TestInspectorListTasks(t *testing.T) {
+	setup(t)
+	client := NewClient(RedisClientOpt{Addr: redisAddr, DB: redisDB})
+	inspector := NewInspector(RedisClientOpt{Addr: redisAddr, DB: redisDB}, nil)
+
+	processAt := time.Now().Add(time.Hour)
+	var enqueued []*TaskInfo
+	for i := 0; i < 3; i++ {
+		info, err := client.Schedule(NewTask("send_email", map[string]interface{}{"n": i}), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		enqueued = append(enqueued, info)
+	}
+	scheduled, err := client.Schedule(NewTask("reindex", nil), processAt, Queue("low"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		state    string
+		qname    string
+		page     int
+		pageSize int
+		wantIDs  []string
+	}{
+		{"enqueued", "default", 0, 2, []string{enqueued[0].ID, enqueued[1].ID}},
+		{"enqueued", "default", 1, 2, []string{enqueued[2].ID}},
+		{"scheduled", "", 0, 10, []string{scheduled.ID}},
+		{"dead", "", 0, 10, nil},
+	}
+
+	for _, tc := range tests {
+		got, err := inspector.ListTasks(tc.state, tc.qname, tc.page, tc.pageSize)
+		if err != nil {
+			t.Errorf("(*Inspector).ListTasks(%q, %q, %d, %d) returned error: %v",
+				tc.state, tc.qname, tc.page, tc.pageSize, err)
+			continue
+		}
+		var gotIDs []string
+		for _, info := range got {
+			if info.State != tc.state {
+				t.Errorf("(*Inspector).ListTasks(%q, ...) returned task in %q state", tc.state, info.State)
+			}
+			gotIDs = append(gotIDs, info.ID)
+		}
+		if diff := cmp.Diff(tc.wantIDs, gotIDs); diff != "" {
+			t.Errorf("(*Inspector).ListTasks(%q, %q, %d, %d) returned tasks %v, want %v; (-want,+got)\n%s",
+				tc.state, tc.qname, tc.page, tc.pageSize, gotIDs, tc.wantIDs, diff)
+		}
+	}
+
+	if _, err := inspector.ListTasks("unknown", "", 0, 10); err == nil {
+		t.Errorf("(*Inspector).ListTasks(%q, ...) succeeded, want error", "unknown")
+	}
+	if _, err := inspector.ListTasks("enqueued", "nonexistent", 0, 10); err == nil {
+		t.Errorf("(*Inspector).ListTasks(%q, %q, ...) succeeded, want error", "enqueued", "nonexistent")
+	}
+}
+
+func TestInspectorShardedQueue(t *testing.T) {
+	setup(t)
+	client := NewClientWithConfig(RedisClientOpt{Addr: redisAddr, DB: redisDB}, &ClientConfig{QueueShards: map[string]int{"critical": 3}})
+	inspector := NewInspector(RedisClientOpt{Addr: redisAddr, DB: redisDB}, nil)
+
+	ids := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		info, err := client.Schedule(NewTask("send_email", nil), time.Now(), Queue("critical"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[info.ID] = true
+	}
+
+	stats, err := inspector.CurrentStats()
+	if err != nil {
+		t.Fatalf("(*Inspector).CurrentStats() returned error: %v", err)
+	}
+	if diff := cmp.Diff(map[string]int{"critical": 5}, stats.Queues); diff != "" {
+		t.Errorf("(*Inspector).CurrentStats().Queues = %v; (-want,+got)\n%s", stats.Queues, diff)
+	}
+
+	// The pages are listed across the shards.
+	listed := make(map[string]bool)
+	for page, want := range []int{2, 2, 1} {
+		got, err := inspector.ListTasks("enqueued", "critical", page, 2)
+		if err != nil {
+			t.Fatalf("(*Inspector).ListTasks returned error: %v", err)
+		}
+		if len(got) != want {
+			t.Errorf("(*Inspector).ListTasks(page=%d) returned %d tasks, want %d", page, len(got), want)
+		}
+		for _, info := range got {
+			if info.Queue != "critical" {
+				t.Errorf("(*Inspector).ListTasks returned task in queue %q, want %q", info.Queue, "critical")
+			}
+			listed[info.ID] = true
+		}
+	}
+	if diff := cmp.Diff(ids, listed); diff != "" {
+		t.Errorf("(*Inspector).ListTasks listed tasks mismatch; (-want,+got)\n%s", diff)
+	}
+
+	maxRetry := 1
+	n, err := inspector.UpdateTasks(&TaskFilter{Queue: "critical"}, &TaskChanges{MaxRetry: &maxRetry})
+	if err != nil {
+		t.Fatalf("(*Inspector).UpdateTasks returned error: %v", err)
+	}
+	if n != 5 {
+		t.Errorf("(*Inspector).UpdateTasks updated %d tasks, want 5", n)
+	}
+}
+
+func TestInspectorUpdateTasks(t *testing.T) {
+	r := setup(t)
+	client := NewClient(RedisClientOpt{Addr: redisAddr, DB: redisDB})
+	inspector := NewInspector(RedisClientOpt{Addr: redisAddr, DB: redisDB}, nil)
+
+	now := time.Now()
+	for _, processAt := range []time.Time{now, now.Add(time.Hour), now.Add(3 * time.Hour)} {
+		if _, err := client.Schedule(NewTask("send_email", nil), processAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := client.Schedule(NewTask("reindex", nil), now); err != nil {
+		t.Fatal(err)
+	}
+
+	maxRetry := 3
+	n, err := inspector.UpdateTasks(
+		&TaskFilter{Type: "send_email", ProcessBefore: now.Add(2 * time.Hour)},
+		&TaskChanges{Queue: "low", MaxRetry: &maxRetry, Delay: time.Hour},
+	)
+	if err != nil {
+		t.Fatalf("(*Inspector).UpdateTasks returned error: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("(*Inspector).UpdateTasks updated %d tasks, want 1", n)
+	}
+	scheduled := h.GetScheduledEntries(t, r)
+	if len(scheduled) != 2 {
+		t.Fatalf("%d tasks are scheduled, want 2", len(scheduled))
+	}
+	for _, e := range scheduled {
+		updated := e.Msg.Queue == "low"
+		if updated != (e.Msg.Retry == maxRetry) {
+			t.Errorf("scheduled task in queue %q has max retry %d", e.Msg.Queue, e.Msg.Retry)
+		}
+		if updated && int64(e.Score) != now.Add(2*time.Hour).Unix() {
+			t.Errorf("updated task is scheduled at %v, want %v", time.Unix(int64(e.Score), 0), now.Add(2*time.Hour))
+		}
+	}
+
+	n, err = inspector.UpdateTasks(&TaskFilter{State: "enqueued"}, &TaskChanges{Queue: "critical"})
+	if err != nil {
+		t.Fatalf("(*Inspector).UpdateTasks returned error: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("(*Inspector).UpdateTasks updated %d tasks, want 2", n)
+	}
+	if got := len(h.GetEnqueuedMessages(t, r, "critical")); got != 2 {
+		t.Errorf("%d tasks are enqueued in %q, want 2", got, "critical")
+	}
+}
+
+func TestInspectorUpdateTasksInvalid(t *testing.T) {
+	inspector := &Inspector{}
+	negative := -1
+	tests := []struct {
+		desc    string
+		filter  *TaskFilter
+		changes *TaskChanges
+	}{
+		{"nil changes", nil, nil},
+		{"both ProcessAt and Delay", nil, &TaskChanges{ProcessAt: time.Now(), Delay: time.Hour}},
+		{"negative max retry", nil, &TaskChanges{MaxRetry: &negative}},
+		{"dead tasks", &TaskFilter{State: "dead"}, &TaskChanges{Queue: "low"}},
+	}
+
+	for _, tc := range tests {
+		if _, err := inspector.UpdateTasks(tc.filter, tc.changes); err == nil {
+			t.Errorf("%s: (*Inspector).UpdateTasks succeeded, want error", tc.desc)
+		}
+	}
+}
+
+func TestTaskFilterMatch(t *testing.T) {
+	now := time.Now()
+	msg := h.NewTaskMessage("send_email", nil)
+	msg.CorrelationID = "req-1"
+	tests := []struct {
+		filter    TaskFilter
+		processAt time.Time
+		want      bool
+	}{
+		{TaskFilter{}, time.Time{}, true},
+		{TaskFilter{Type: "send_email", Queue: "Default"}, time.Time{}, true},
+		{TaskFilter{Type: "reindex"}, time.Time{}, false},
+		{TaskFilter{CorrelationID: "req-2"}, time.Time{}, false},
+		{TaskFilter{ProcessBefore: now}, time.Time{}, false},
+		{TaskFilter{ProcessBefore: now}, now.Add(-time.Minute), true},
+		{TaskFilter{ProcessBefore: now}, now, false},
+		{TaskFilter{ProcessAfter: now}, now.Add(time.Minute), true},
+		{TaskFilter{ProcessAfter: now, ProcessBefore: now.Add(time.Hour)}, now.Add(2 * time.Hour), false},
+	}
+
+	for _, tc := range tests {
+		if got := tc.filter.match(msg, tc.processAt); got != tc.want {
+			t.Errorf("%+v.match(msg, %v) = %t, want %t", tc.filter, tc.processAt, got, tc.want)
+		}
+	}
+}
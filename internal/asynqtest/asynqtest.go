@@ -3,10 +3,12 @@
 // that can be found in the LICENSE file.
 
 // Package asynqtest defines test helpers for asynq and its internal packages.
+//
+// The helpers for the tests of applications are exported by package
+// github.com/hibiken/asynq/asynqtest.
 package asynqtest
 
 import (
-	"encoding/json"
 	"sort"
 	"testing"
 
@@ -56,6 +58,14 @@ var SortProcessInfoOpt = cmp.Transformer("SortProcessInfo", func(in []*base.Proc
 // IgnoreIDOpt is an cmp.Option to ignore ID field in task messages when comparing.
 var IgnoreIDOpt = cmpopts.IgnoreFields(base.TaskMessage{}, "ID")
 
+// IgnoreProcessAtOpt is an cmp.Option to ignore ProcessAt field in task messages
+// when comparing, which is set by the client to the time a task is scheduled.
+var IgnoreProcessAtOpt = cmpopts.IgnoreFields(base.TaskMessage{}, "ProcessAt")
+
+// IgnoreErrorTimeOpt is an cmp.Option to ignore the time of errors in the
+// error history of task messages.
+var IgnoreErrorTimeOpt = cmpopts.IgnoreFields(base.TaskError{}, "Time")
+
 // NewTaskMessage returns a new instance of TaskMessage given a task type and payload.
 func NewTaskMessage(taskType string, payload map[string]interface{}) *base.TaskMessage {
 	return &base.TaskMessage{
@@ -79,11 +89,11 @@ func NewTaskMessageWithQueue(taskType string, payload map[string]interface{}, qn
 	}
 }
 
-// MustMarshal marshals given task message and returns a json string.
-// Calling test will fail if marshaling errors out.
+// MustMarshal marshals given task message with its encoding and returns
+// the encoded string. Calling test will fail if marshaling errors out.
 func MustMarshal(tb testing.TB, msg *base.TaskMessage) string {
 	tb.Helper()
-	data, err := json.Marshal(msg)
+	data, err := base.EncodeMessage(msg)
 	if err != nil {
 		tb.Fatal(err)
 	}
@@ -94,12 +104,11 @@ func MustMarshal(tb testing.TB, msg *base.TaskMessage) string {
 // Calling test will fail if unmarshaling errors out.
 func MustUnmarshal(tb testing.TB, data string) *base.TaskMessage {
 	tb.Helper()
-	var msg base.TaskMessage
-	err := json.Unmarshal([]byte(data), &msg)
+	msg, err := base.DecodeMessage([]byte(data))
 	if err != nil {
 		tb.Fatal(err)
 	}
-	return &msg
+	return msg
 }
 
 // MustMarshalSlice marshals a slice of task messages and return a slice of
@@ -125,7 +134,7 @@ func MustUnmarshalSlice(tb testing.TB, data []string) []*base.TaskMessage {
 }
 
 // FlushDB deletes all the keys of the currently selected DB.
-func FlushDB(tb testing.TB, r *redis.Client) {
+func FlushDB(tb testing.TB, r redis.UniversalClient) {
 	tb.Helper()
 	if err := r.FlushDB().Err(); err != nil {
 		tb.Fatal(err)
@@ -135,7 +144,7 @@ func FlushDB(tb testing.TB, r *redis.Client) {
 // SeedEnqueuedQueue initializes the specified queue with the given messages.
 //
 // If queue name option is not passed, it defaults to the default queue.
-func SeedEnqueuedQueue(tb testing.TB, r *redis.Client, msgs []*base.TaskMessage, queueOpt ...string) {
+func SeedEnqueuedQueue(tb testing.TB, r redis.UniversalClient, msgs []*base.TaskMessage, queueOpt ...string) {
 	tb.Helper()
 	queue := base.DefaultQueue
 	if len(queueOpt) > 0 {
@@ -146,30 +155,36 @@ func SeedEnqueuedQueue(tb testing.TB, r *redis.Client, msgs []*base.TaskMessage,
 }
 
 // SeedInProgressQueue initializes the in-progress queue with the given messages.
-func SeedInProgressQueue(tb testing.TB, r *redis.Client, msgs []*base.TaskMessage) {
+func SeedInProgressQueue(tb testing.TB, r redis.UniversalClient, msgs []*base.TaskMessage) {
 	tb.Helper()
 	seedRedisList(tb, r, base.InProgressQueue, msgs)
 }
 
 // SeedScheduledQueue initializes the scheduled queue with the given messages.
-func SeedScheduledQueue(tb testing.TB, r *redis.Client, entries []ZSetEntry) {
+func SeedScheduledQueue(tb testing.TB, r redis.UniversalClient, entries []ZSetEntry) {
 	tb.Helper()
 	seedRedisZSet(tb, r, base.ScheduledQueue, entries)
 }
 
 // SeedRetryQueue initializes the retry queue with the given messages.
-func SeedRetryQueue(tb testing.TB, r *redis.Client, entries []ZSetEntry) {
+func SeedRetryQueue(tb testing.TB, r redis.UniversalClient, entries []ZSetEntry) {
 	tb.Helper()
 	seedRedisZSet(tb, r, base.RetryQueue, entries)
 }
 
 // SeedDeadQueue initializes the dead queue with the given messages.
-func SeedDeadQueue(tb testing.TB, r *redis.Client, entries []ZSetEntry) {
+func SeedDeadQueue(tb testing.TB, r redis.UniversalClient, entries []ZSetEntry) {
 	tb.Helper()
 	seedRedisZSet(tb, r, base.DeadQueue, entries)
 }
 
-func seedRedisList(tb testing.TB, c *redis.Client, key string, msgs []*base.TaskMessage) {
+// SeedCompletedQueue initializes the completed queue with the given messages.
+func SeedCompletedQueue(tb testing.TB, r redis.UniversalClient, entries []ZSetEntry) {
+	tb.Helper()
+	seedRedisZSet(tb, r, base.CompletedQueue, entries)
+}
+
+func seedRedisList(tb testing.TB, c redis.UniversalClient, key string, msgs []*base.TaskMessage) {
 	data := MustMarshalSlice(tb, msgs)
 	for _, s := range data {
 		if err := c.LPush(key, s).Err(); err != nil {
@@ -178,7 +193,7 @@ func seedRedisList(tb testing.TB, c *redis.Client, key string, msgs []*base.Task
 	}
 }
 
-func seedRedisZSet(tb testing.TB, c *redis.Client, key string, items []ZSetEntry) {
+func seedRedisZSet(tb testing.TB, c redis.UniversalClient, key string, items []ZSetEntry) {
 	for _, item := range items {
 		z := &redis.Z{Member: MustMarshal(tb, item.Msg), Score: float64(item.Score)}
 		if err := c.ZAdd(key, z).Err(); err != nil {
@@ -190,7 +205,7 @@ func seedRedisZSet(tb testing.TB, c *redis.Client, key string, items []ZSetEntry
 // GetEnqueuedMessages returns all task messages in the specified queue.
 //
 // If queue name option is not passed, it defaults to the default queue.
-func GetEnqueuedMessages(tb testing.TB, r *redis.Client, queueOpt ...string) []*base.TaskMessage {
+func GetEnqueuedMessages(tb testing.TB, r redis.UniversalClient, queueOpt ...string) []*base.TaskMessage {
 	tb.Helper()
 	queue := base.DefaultQueue
 	if len(queueOpt) > 0 {
@@ -200,58 +215,64 @@ func GetEnqueuedMessages(tb testing.TB, r *redis.Client, queueOpt ...string) []*
 }
 
 // GetInProgressMessages returns all task messages in the in-progress queue.
-func GetInProgressMessages(tb testing.TB, r *redis.Client) []*base.TaskMessage {
+func GetInProgressMessages(tb testing.TB, r redis.UniversalClient) []*base.TaskMessage {
 	tb.Helper()
 	return getListMessages(tb, r, base.InProgressQueue)
 }
 
 // GetScheduledMessages returns all task messages in the scheduled queue.
-func GetScheduledMessages(tb testing.TB, r *redis.Client) []*base.TaskMessage {
+func GetScheduledMessages(tb testing.TB, r redis.UniversalClient) []*base.TaskMessage {
 	tb.Helper()
 	return getZSetMessages(tb, r, base.ScheduledQueue)
 }
 
 // GetRetryMessages returns all task messages in the retry queue.
-func GetRetryMessages(tb testing.TB, r *redis.Client) []*base.TaskMessage {
+func GetRetryMessages(tb testing.TB, r redis.UniversalClient) []*base.TaskMessage {
 	tb.Helper()
 	return getZSetMessages(tb, r, base.RetryQueue)
 }
 
 // GetDeadMessages returns all task messages in the dead queue.
-func GetDeadMessages(tb testing.TB, r *redis.Client) []*base.TaskMessage {
+func GetDeadMessages(tb testing.TB, r redis.UniversalClient) []*base.TaskMessage {
 	tb.Helper()
 	return getZSetMessages(tb, r, base.DeadQueue)
 }
 
 // GetScheduledEntries returns all task messages and its score in the scheduled queue.
-func GetScheduledEntries(tb testing.TB, r *redis.Client) []ZSetEntry {
+func GetScheduledEntries(tb testing.TB, r redis.UniversalClient) []ZSetEntry {
 	tb.Helper()
 	return getZSetEntries(tb, r, base.ScheduledQueue)
 }
 
 // GetRetryEntries returns all task messages and its score in the retry queue.
-func GetRetryEntries(tb testing.TB, r *redis.Client) []ZSetEntry {
+func GetRetryEntries(tb testing.TB, r redis.UniversalClient) []ZSetEntry {
 	tb.Helper()
 	return getZSetEntries(tb, r, base.RetryQueue)
 }
 
 // GetDeadEntries returns all task messages and its score in the dead queue.
-func GetDeadEntries(tb testing.TB, r *redis.Client) []ZSetEntry {
+func GetDeadEntries(tb testing.TB, r redis.UniversalClient) []ZSetEntry {
 	tb.Helper()
 	return getZSetEntries(tb, r, base.DeadQueue)
 }
 
-func getListMessages(tb testing.TB, r *redis.Client, list string) []*base.TaskMessage {
+// GetCompletedEntries returns all task messages and its score in the completed queue.
+func GetCompletedEntries(tb testing.TB, r redis.UniversalClient) []ZSetEntry {
+	tb.Helper()
+	return getZSetEntries(tb, r, base.CompletedQueue)
+}
+
+func getListMessages(tb testing.TB, r redis.UniversalClient, list string) []*base.TaskMessage {
 	data := r.LRange(list, 0, -1).Val()
 	return MustUnmarshalSlice(tb, data)
 }
 
-func getZSetMessages(tb testing.TB, r *redis.Client, zset string) []*base.TaskMessage {
+func getZSetMessages(tb testing.TB, r redis.UniversalClient, zset string) []*base.TaskMessage {
 	data := r.ZRange(zset, 0, -1).Val()
 	return MustUnmarshalSlice(tb, data)
 }
 
-func getZSetEntries(tb testing.TB, r *redis.Client, zset string) []ZSetEntry {
+func getZSetEntries(tb testing.TB, r redis.UniversalClient, zset string) []ZSetEntry {
 	data := r.ZRangeWithScores(zset, 0, -1).Val()
 	var entries []ZSetEntry
 	for _, z := range data {
@@ -7,6 +7,8 @@ package base
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
@@ -19,41 +21,361 @@ import (
 const DefaultQueueName = "default"
 
 // Redis keys
+//
+// All keys share the "{asynq}" hash tag so that they are assigned to
+// the same hash slot in Redis Cluster. This allows Lua scripts and
+// transactions to operate on multiple keys (e.g. moving a task from
+// a queue to the in-progress list).
+//
+// Keys are not tagged per queue: the in-progress list, the leases, and the
+// scheduled, retry, and dead sets are shared by all queues, and a single
+// script moves tasks between them and any queue (e.g. dequeuing from several
+// queues in priority order, or forwarding due tasks to their queues).
+// Spreading the queues over slots would break the atomicity of these moves.
+// The keys of separate namespaces (see NewKeys) are in separate slots.
 const (
-	psPrefix        = "asynq:ps:"                    // HASH
-	AllProcesses    = "asynq:ps"                     // ZSET
-	processedPrefix = "asynq:processed:"             // STRING - asynq:processed:<yyyy-mm-dd>
-	failurePrefix   = "asynq:failure:"               // STRING - asynq:failure:<yyyy-mm-dd>
-	QueuePrefix     = "asynq:queues:"                // LIST   - asynq:queues:<qname>
-	AllQueues       = "asynq:queues"                 // SET
-	DefaultQueue    = QueuePrefix + DefaultQueueName // LIST
-	ScheduledQueue  = "asynq:scheduled"              // ZSET
-	RetryQueue      = "asynq:retry"                  // ZSET
-	DeadQueue       = "asynq:dead"                   // ZSET
-	InProgressQueue = "asynq:in_progress"            // LIST
-	CancelChannel   = "asynq:cancel"                 // PubSub channel
+	psPrefix           = "{asynq}:ps:"                  // HASH
+	AllProcesses       = "{asynq}:ps"                   // ZSET
+	processedPrefix    = "{asynq}:processed:"           // STRING - {asynq}:processed:<yyyy-mm-dd>
+	failurePrefix      = "{asynq}:failure:"             // STRING - {asynq}:failure:<yyyy-mm-dd>
+	costsPrefix        = "{asynq}:costs:"               // HASH   - {asynq}:costs:<yyyy-mm-dd>
+	latencyPrefix      = "{asynq}:latency:"             // HASH   - {asynq}:latency:<yyyy-mm-ddThh:mm>
+	resultPrefix       = "{asynq}:results:"             // STRING - {asynq}:results:<task id>, TaskResult in JSON
+	progressPrefix     = "{asynq}:progress:"            // STRING - {asynq}:progress:<task id>, TaskProgress in JSON
+	QueuePrefix        = "{asynq}:queues:"              // LIST   - {asynq}:queues:<qname>
+	AllQueues          = "{asynq}:queues"               // SET
+	QueueWeights       = "{asynq}:queue_weights"        // HASH   - qname -> weight
+	DefaultQueue       = QueuePrefix + DefaultQueueName // LIST
+	ScheduledQueue     = "{asynq}:scheduled"            // ZSET
+	RetryQueue         = "{asynq}:retry"                // ZSET
+	DeadQueue          = "{asynq}:dead"                 // ZSET
+	CompletedQueue     = "{asynq}:completed"            // ZSET   - completed task message -> retention expiration
+	InProgressQueue    = "{asynq}:in_progress"          // LIST
+	Leases             = "{asynq}:leases"               // ZSET   - in-progress task message -> lease expiration
+	Rollups            = "{asynq}:rollups"              // HASH   - <dimension>:<value>:<state> -> count
+	Correlations       = "{asynq}:rollups:correlations" // SET    - correlation ids with an index
+	correlationPrefix  = "{asynq}:rollups:correlation:" // HASH   - {asynq}:rollups:correlation:<id>, task id -> <state>:<task message>
+	KillSwitchKey      = "{asynq}:killswitch"           // STRING - KillSwitch in JSON, expires with the kill switch
+	KillSwitchLog      = "{asynq}:killswitch:log"       // LIST   - KillSwitchEvent in JSON
+	Canary             = "{asynq}:canary"               // HASH   - enqueued, completed, max_age
+	CancelChannel      = "asynq:cancel"                 // PubSub channel
+	ControlChannel     = "asynq:control"                // PubSub channel
+	WakeChannel        = "asynq:wake"                   // PubSub channel
+	controlReplyPrefix = "asynq:control:reply:"         // PubSub channel - asynq:control:reply:<id>
+	lockPrefix         = "{asynq}:lock:"                // STRING - {asynq}:lock:<name>
+	rateLimitPrefix    = "{asynq}:ratelimit:"           // HASH   - {asynq}:ratelimit:<name>, token bucket
+	deliveryPrefix     = "{asynq}:delivery:"            // STRING - {asynq}:delivery:<task id>:<retried>, worker which started the attempt
+	startsPrefix       = "{asynq}:starts:"              // STRING - {asynq}:starts:<task id>:<retried>, number of unfinished starts of the attempt
+	workflowPrefix     = "{asynq}:workflows:"           // HASH   - {asynq}:workflows:<workflow id>, state of the steps
+	dependencyPrefix   = "{asynq}:dependencies:"        // STRING - {asynq}:dependencies:<name>, time reported down, expires with the outage
+	dedupPrefix        = "{asynq}:dedup:"               // STRING - {asynq}:dedup:<content hash>, ID of the task enqueued first
+	Duplicates         = "{asynq}:duplicates"           // STRING - number of duplicate deliveries
 )
 
+// DefaultKeyPrefix is the prefix of the keys in the default namespace.
+const DefaultKeyPrefix = "{asynq}"
+
+// LeaseDuration is how long an in-progress task is leased to the background
+// worker process which dequeued it. The process extends the leases of the
+// tasks it's processing, and the tasks whose leases have expired are
+// recovered from the in-progress list (e.g. after the process crashed).
+const LeaseDuration = 30 * time.Second
+
+// Clock tells the current time, so that tests can control the time seen
+// by the clients and the backgrounds.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// RealClock is the clock of the system.
+var RealClock Clock = realClock{}
+
+// Keys holds the redis keys and pubsub channel names within a namespace.
+//
+// Keys in different namespaces don't collide, so that multiple
+// applications can share a redis instance.
+type Keys struct {
+	// Prefix is the prefix of all keys in the namespace.
+	Prefix string
+
+	AllProcesses    string // ZSET
+	QueuePrefix     string // LIST - <prefix>:queues:<qname>
+	AllQueues       string // SET
+	QueueWeights    string // HASH - qname -> weight
+	DefaultQueue    string // LIST
+	ScheduledQueue  string // ZSET
+	RetryQueue      string // ZSET
+	DeadQueue       string // ZSET
+	CompletedQueue  string // ZSET
+	InProgressQueue string // LIST
+	Leases          string // ZSET
+	Rollups         string // HASH
+	Correlations    string // SET
+	KillSwitchKey   string // STRING
+	KillSwitchLog   string // LIST
+	Canary          string // HASH
+	Duplicates      string // STRING
+	CancelChannel   string // PubSub channel
+	ControlChannel  string // PubSub channel
+	WakeChannel     string // PubSub channel
+
+	psPrefix           string
+	processedPrefix    string
+	failurePrefix      string
+	costsPrefix        string
+	latencyPrefix      string
+	resultPrefix       string
+	progressPrefix     string
+	controlReplyPrefix string
+	lockPrefix         string
+	rateLimitPrefix    string
+	deliveryPrefix     string
+	startsPrefix       string
+	workflowPrefix     string
+	dependencyPrefix   string
+	dedupPrefix        string
+	correlationPrefix  string
+}
+
+// DefaultKeys holds the keys in the default namespace.
+var DefaultKeys = &Keys{
+	Prefix:             DefaultKeyPrefix,
+	AllProcesses:       AllProcesses,
+	QueuePrefix:        QueuePrefix,
+	AllQueues:          AllQueues,
+	QueueWeights:       QueueWeights,
+	DefaultQueue:       DefaultQueue,
+	ScheduledQueue:     ScheduledQueue,
+	RetryQueue:         RetryQueue,
+	DeadQueue:          DeadQueue,
+	CompletedQueue:     CompletedQueue,
+	InProgressQueue:    InProgressQueue,
+	Leases:             Leases,
+	Rollups:            Rollups,
+	Correlations:       Correlations,
+	KillSwitchKey:      KillSwitchKey,
+	KillSwitchLog:      KillSwitchLog,
+	Canary:             Canary,
+	Duplicates:         Duplicates,
+	CancelChannel:      CancelChannel,
+	ControlChannel:     ControlChannel,
+	WakeChannel:        WakeChannel,
+	psPrefix:           psPrefix,
+	processedPrefix:    processedPrefix,
+	failurePrefix:      failurePrefix,
+	costsPrefix:        costsPrefix,
+	latencyPrefix:      latencyPrefix,
+	resultPrefix:       resultPrefix,
+	progressPrefix:     progressPrefix,
+	controlReplyPrefix: controlReplyPrefix,
+	lockPrefix:         lockPrefix,
+	rateLimitPrefix:    rateLimitPrefix,
+	deliveryPrefix:     deliveryPrefix,
+	startsPrefix:       startsPrefix,
+	workflowPrefix:     workflowPrefix,
+	dependencyPrefix:   dependencyPrefix,
+	dedupPrefix:        dedupPrefix,
+	correlationPrefix:  correlationPrefix,
+}
+
+// NewKeys returns the keys in the namespace specified by the prefix.
+// An empty prefix specifies the default namespace.
+//
+// If the prefix doesn't contain a hash tag (e.g. "{myapp}"), the whole
+// prefix is used as the hash tag, so that all keys in the namespace are
+// assigned to the same hash slot in Redis Cluster.
+func NewKeys(prefix string) *Keys {
+	if prefix == "" || prefix == DefaultKeyPrefix {
+		return DefaultKeys
+	}
+	if !hasHashTag(prefix) {
+		prefix = "{" + prefix + "}"
+	}
+	p := prefix + ":"
+	return &Keys{
+		Prefix:             prefix,
+		AllProcesses:       p + "ps",
+		QueuePrefix:        p + "queues:",
+		AllQueues:          p + "queues",
+		QueueWeights:       p + "queue_weights",
+		DefaultQueue:       p + "queues:" + DefaultQueueName,
+		ScheduledQueue:     p + "scheduled",
+		RetryQueue:         p + "retry",
+		DeadQueue:          p + "dead",
+		CompletedQueue:     p + "completed",
+		InProgressQueue:    p + "in_progress",
+		Leases:             p + "leases",
+		Rollups:            p + "rollups",
+		Correlations:       p + "rollups:correlations",
+		KillSwitchKey:      p + "killswitch",
+		KillSwitchLog:      p + "killswitch:log",
+		Canary:             p + "canary",
+		Duplicates:         p + "duplicates",
+		CancelChannel:      p + "cancel",
+		ControlChannel:     p + "control",
+		WakeChannel:        p + "wake",
+		psPrefix:           p + "ps:",
+		processedPrefix:    p + "processed:",
+		failurePrefix:      p + "failure:",
+		costsPrefix:        p + "costs:",
+		latencyPrefix:      p + "latency:",
+		resultPrefix:       p + "results:",
+		progressPrefix:     p + "progress:",
+		controlReplyPrefix: p + "control:reply:",
+		lockPrefix:         p + "lock:",
+		rateLimitPrefix:    p + "ratelimit:",
+		deliveryPrefix:     p + "delivery:",
+		startsPrefix:       p + "starts:",
+		workflowPrefix:     p + "workflows:",
+		dependencyPrefix:   p + "dependencies:",
+		dedupPrefix:        p + "dedup:",
+		correlationPrefix:  p + "rollups:correlation:",
+	}
+}
+
+// hasHashTag reports whether the key contains a non-empty hash tag.
+func hasHashTag(key string) bool {
+	i := strings.Index(key, "{")
+	if i < 0 {
+		return false
+	}
+	return strings.Index(key[i+1:], "}") > 0
+}
+
 // QueueKey returns a redis key string for the given queue name.
-func QueueKey(qname string) string {
-	return QueuePrefix + strings.ToLower(qname)
+func (k *Keys) QueueKey(qname string) string {
+	return k.QueuePrefix + strings.ToLower(qname)
 }
 
 // ProcessedKey returns a redis key string for processed count
 // for the given day.
-func ProcessedKey(t time.Time) string {
-	return processedPrefix + t.UTC().Format("2006-01-02")
+func (k *Keys) ProcessedKey(t time.Time) string {
+	return k.processedPrefix + t.UTC().Format("2006-01-02")
 }
 
 // FailureKey returns a redis key string for failure count
 // for the given day.
-func FailureKey(t time.Time) string {
-	return failurePrefix + t.UTC().Format("2006-01-02")
+func (k *Keys) FailureKey(t time.Time) string {
+	return k.failurePrefix + t.UTC().Format("2006-01-02")
+}
+
+// CostsKey returns a redis key string for the costs reported by
+// handlers for the given day.
+func (k *Keys) CostsKey(t time.Time) string {
+	return k.costsPrefix + t.UTC().Format("2006-01-02")
+}
+
+// LatencyKey returns a redis key string for the latency histograms
+// of the tasks processed in the given minute.
+func (k *Keys) LatencyKey(t time.Time) string {
+	return k.latencyPrefix + t.UTC().Format("2006-01-02T15:04")
+}
+
+// ResultKey returns a redis key string for the pointer to the result
+// of the task with the given id.
+func (k *Keys) ResultKey(id string) string {
+	return k.resultPrefix + id
+}
+
+// ProgressKey returns a redis key string for the progress of the task
+// with the given id.
+func (k *Keys) ProgressKey(id string) string {
+	return k.progressPrefix + id
 }
 
 // ProcessInfoKey returns a redis key string for process info.
+func (k *Keys) ProcessInfoKey(hostname string, pid int) string {
+	return fmt.Sprintf("%s%s:%d", k.psPrefix, hostname, pid)
+}
+
+// ControlReplyChannel returns a pubsub channel name to which replies
+// for the control message with the given id are published.
+func (k *Keys) ControlReplyChannel(id string) string {
+	return k.controlReplyPrefix + id
+}
+
+// LockKey returns a redis key for the lock with the given name.
+func (k *Keys) LockKey(name string) string {
+	return k.lockPrefix + name
+}
+
+// RateLimitKey returns a redis key string for the token bucket
+// of the rate limit with the given name.
+func (k *Keys) RateLimitKey(name string) string {
+	return k.rateLimitPrefix + name
+}
+
+// DeliveryKey returns a redis key string for the worker which started
+// processing the given attempt of the task with the given id (see Attempt).
+func (k *Keys) DeliveryKey(id string, attempt int) string {
+	return fmt.Sprintf("%s%s:%d", k.deliveryPrefix, id, attempt)
+}
+
+// StartsKey returns a redis key string for the number of times processing
+// of the task with the given id was started and did not finish.
+func (k *Keys) StartsKey(id string) string {
+	return k.startsPrefix + id
+}
+
+// DedupKey returns a redis key string for the task enqueued with the
+// content with the given hash.
+func (k *Keys) DedupKey(hash string) string {
+	return k.dedupPrefix + hash
+}
+
+// CorrelationKey returns a redis key string for the index of the tasks
+// with the given correlation id. The key is the key of the rollups with
+// ":correlation:<id>" appended, so that the scripts updating the rollups
+// can build it.
+func (k *Keys) CorrelationKey(id string) string {
+	return k.correlationPrefix + id
+}
+
+// WorkflowKey returns a redis key string for the state of the workflow
+// with the given id.
+func (k *Keys) WorkflowKey(id string) string {
+	return k.workflowPrefix + id
+}
+
+// DependencyKey returns a redis key string which exists while the named
+// dependency is down.
+func (k *Keys) DependencyKey(name string) string {
+	return k.dependencyPrefix + name
+}
+
+// QueueKey returns a redis key string for the given queue name
+// in the default namespace.
+func QueueKey(qname string) string {
+	return DefaultKeys.QueueKey(qname)
+}
+
+// ProcessedKey returns a redis key string for processed count
+// for the given day in the default namespace.
+func ProcessedKey(t time.Time) string {
+	return DefaultKeys.ProcessedKey(t)
+}
+
+// FailureKey returns a redis key string for failure count
+// for the given day in the default namespace.
+func FailureKey(t time.Time) string {
+	return DefaultKeys.FailureKey(t)
+}
+
+// ProcessInfoKey returns a redis key string for process info
+// in the default namespace.
 func ProcessInfoKey(hostname string, pid int) string {
-	return fmt.Sprintf("%s%s:%d", psPrefix, hostname, pid)
+	return DefaultKeys.ProcessInfoKey(hostname, pid)
+}
+
+// ControlReplyChannel returns a pubsub channel name to which replies
+// for the control message with the given id are published
+// in the default namespace.
+func ControlReplyChannel(id string) string {
+	return DefaultKeys.ControlReplyChannel(id)
 }
 
 // TaskMessage is the internal representation of a task with additional metadata fields.
@@ -65,6 +387,46 @@ type TaskMessage struct {
 	// Payload holds data needed to process the task.
 	Payload map[string]interface{}
 
+	// Data holds the binary payload of the task, which is set instead
+	// of Payload. It's nil if the task has a map payload.
+	Data []byte `json:",omitempty"`
+
+	// Codec is the name of the codec which encoded the payload into Data
+	// ("json" if Payload was encoded to be compressed), or empty if Data
+	// is a binary payload.
+	Codec string `json:",omitempty"`
+
+	// Compression is the compression of Data (e.g. "gzip"),
+	// or empty if Data is not compressed.
+	Compression string `json:",omitempty"`
+
+	// ContentType is the media type of the payload (e.g. "application/json")
+	// set by the producer, or empty if the payload is decoded by Codec.
+	ContentType string `json:",omitempty"`
+
+	// ContentEncoding is the encoding of Data applied after ContentType
+	// (e.g. "gzip"), or empty if Data is not encoded.
+	ContentEncoding string `json:",omitempty"`
+
+	// WorkflowID is the ID of the workflow the task is a step of,
+	// or empty if the task is not part of a workflow.
+	WorkflowID string `json:",omitempty"`
+
+	// WorkflowStep is the name of the step of the workflow the task runs.
+	WorkflowStep string `json:",omitempty"`
+
+	// KeyID is the ID of the key Data is encrypted with,
+	// or empty if Data is not encrypted.
+	KeyID string `json:",omitempty"`
+
+	// Signature is the HMAC of the task signed by the client,
+	// or nil if the task is not signed.
+	Signature []byte `json:",omitempty"`
+
+	// PayloadHistory holds the previous versions of the payload, oldest
+	// first, kept when the payload is rewritten (e.g. by a fix-up script).
+	PayloadHistory []*PayloadVersion `json:",omitempty"`
+
 	// ID is a unique identifier for each task.
 	ID xid.ID
 
@@ -77,14 +439,129 @@ type TaskMessage struct {
 	// Retried is the number of times we've retried this task so far.
 	Retried int
 
+	// Recovered is the number of times the task was retried because its
+	// lease expired, which are counted in Retried as well.
+	Recovered int `json:",omitempty"`
+
 	// ErrorMsg holds the error message from the last failure.
 	ErrorMsg string
 
+	// ErrorHistory holds the errors of the last failures, oldest first,
+	// up to MaxErrorHistory entries.
+	ErrorHistory []*TaskError `json:",omitempty"`
+
 	// Timeout specifies how long a task may run.
 	// The string value should be compatible with time.Duration.ParseDuration.
 	//
-	// Zero means no limit.
+	// Zero means no limit, or the default timeout of the background
+	// if it has one.
 	Timeout string
+
+	// CorrelationID identifies a group of related tasks
+	// (e.g. tasks spawned by the same user request).
+	CorrelationID string `json:",omitempty"`
+
+	// Dimensions holds the values of the rollup dimensions extracted
+	// from the payload when the task was scheduled (e.g. "plan": "pro").
+	Dimensions map[string]string `json:",omitempty"`
+
+	// Headers holds the metadata of the task set by the producer apart from
+	// the payload (e.g. trace IDs, tenant IDs).
+	Headers map[string]string `json:",omitempty"`
+
+	// ProcessAt is the time the task was scheduled to be processed at,
+	// or enqueued at if it was not scheduled, in nanoseconds since the
+	// unix epoch. It's zero if the message was written by older versions.
+	ProcessAt int64 `json:",omitempty"`
+
+	// Deadline is the time by which the task must be processed in
+	// nanoseconds since the unix epoch, or zero if it has no deadline.
+	Deadline int64 `json:",omitempty"`
+
+	// AtMostOnce indicates that the task should be acknowledged before it's
+	// processed, so that it's never processed more than once even if the
+	// worker crashes, at the risk of being lost.
+	AtMostOnce bool `json:",omitempty"`
+
+	// Encoding specifies how the message is encoded in redis.
+	// It is set by DecodeMessage to the encoding of the decoded data.
+	Encoding MessageEncoding `json:"-"`
+}
+
+// Lease is the lease of an in-progress task to the background
+// worker process processing it.
+type Lease struct {
+	Msg *TaskMessage
+
+	// ExpireAt is the time the lease expires.
+	ExpireAt time.Time
+}
+
+// MaxErrorHistory is the max number of errors kept in the ErrorHistory
+// of a task message.
+const MaxErrorHistory = 10
+
+// TaskError holds the error of a failed attempt to process a task.
+type TaskError struct {
+	Msg  string
+	Time time.Time
+}
+
+// Attempt returns the number of times the task was retried after its
+// handler failed, not counting the retries after its lease expired, so that
+// a task redelivered after its lease expired is the same attempt as the
+// delivery whose lease expired.
+func Attempt(msg *TaskMessage) int {
+	return msg.Retried - msg.Recovered
+}
+
+// RecordError returns a copy of the message with the error assigned
+// as its last error and appended to its error history, dropping the
+// oldest errors beyond MaxErrorHistory.
+//
+// The error history of the given message is left unchanged.
+func RecordError(msg *TaskMessage, errMsg string, t time.Time) *TaskMessage {
+	modified := *msg
+	modified.ErrorMsg = errMsg
+	history := msg.ErrorHistory
+	if len(history) >= MaxErrorHistory {
+		history = history[len(history)-MaxErrorHistory+1:]
+	}
+	modified.ErrorHistory = make([]*TaskError, len(history), len(history)+1)
+	copy(modified.ErrorHistory, history)
+	modified.ErrorHistory = append(modified.ErrorHistory, &TaskError{Msg: errMsg, Time: t})
+	return &modified
+}
+
+// MaxPayloadHistory is the maximum number of previous payload versions
+// kept in a task message.
+const MaxPayloadHistory = 5
+
+// PayloadVersion holds a previous version of the payload of a task.
+type PayloadVersion struct {
+	// Type is the type name of the task with the payload.
+	Type    string
+	Payload map[string]interface{}
+	// Time is when the payload was replaced.
+	Time time.Time
+}
+
+// RecordPayload returns a copy of the message with the payload replaced,
+// and the previous payload appended to its payload history, dropping the
+// oldest versions beyond MaxPayloadHistory.
+//
+// The payload history of the given message is left unchanged.
+func RecordPayload(msg *TaskMessage, payload map[string]interface{}, t time.Time) *TaskMessage {
+	modified := *msg
+	modified.Payload = payload
+	history := msg.PayloadHistory
+	if len(history) >= MaxPayloadHistory {
+		history = history[len(history)-MaxPayloadHistory+1:]
+	}
+	modified.PayloadHistory = make([]*PayloadVersion, len(history), len(history)+1)
+	copy(modified.PayloadHistory, history)
+	modified.PayloadHistory = append(modified.PayloadHistory, &PayloadVersion{Type: msg.Type, Payload: msg.Payload, Time: t})
+	return &modified
 }
 
 // ProcessInfo holds information about running background worker process.
@@ -110,6 +587,90 @@ func NewProcessInfo(host string, pid, concurrency int, queues map[string]int, st
 	}
 }
 
+// TaskResult points to the result of a task stored outside of redis.
+type TaskResult struct {
+	// Location of the result in the result sink (e.g. "s3://bucket/key").
+	Location string
+
+	// Checksum is the hex-encoded SHA-256 digest of the result.
+	Checksum string
+
+	// Size of the result in bytes.
+	Size int64
+
+	// Time the result was written.
+	Time time.Time
+}
+
+// TaskProgress is the progress of a task reported by its handler.
+type TaskProgress struct {
+	// Percent is the percentage of the task done, between 0 and 100.
+	Percent float64
+
+	// Data holds the details of the progress reported by the handler
+	// as JSON (e.g. {"rows": 1200, "total": 5000}), or null.
+	Data json.RawMessage `json:",omitempty"`
+
+	// Time the progress was reported.
+	Time time.Time
+}
+
+// KillSwitch is an emergency stop of processing in all background
+// worker processes, which lapses at Expires unless renewed.
+type KillSwitch struct {
+	// Reason the kill switch was engaged.
+	Reason string
+
+	// By identifies who engaged the kill switch (e.g. "user@host").
+	By string
+
+	// Time the kill switch was engaged and expires.
+	Engaged time.Time
+	Expires time.Time
+}
+
+// KillSwitchEvent is an audit entry of a change to the kill switch.
+type KillSwitchEvent struct {
+	// Action is either "on" or "off".
+	Action string
+
+	// Reason and By are copied from the kill switch for "on" action.
+	// By identifies who disengaged the kill switch for "off" action.
+	Reason string
+	By     string
+
+	// Time of the change.
+	Time time.Time
+
+	// Time the kill switch expires for "on" action.
+	Expires time.Time
+}
+
+// ControlMessage is a command broadcasted to all running background worker processes.
+type ControlMessage struct {
+	// ID identifies the message. Replies are published to ControlReplyChannel(ID).
+	ID string
+
+	// Command is the name of the command (e.g. "quiet", "resume", "status").
+	Command string
+
+	// Arg holds the argument for the command if any.
+	Arg string
+}
+
+// ControlReply is a reply from a background worker process to a ControlMessage.
+type ControlReply struct {
+	Host              string
+	PID               int
+	State             string
+	Concurrency       int
+	ActiveWorkerCount int
+	LogLevel          string
+
+	// ErrorMsg is non-empty if the process could not execute the command.
+	ErrorMsg string
+}
+
 // Cancelations is a collection that holds cancel functions for all in-progress tasks.
 //
 // Its methods are safe to be used in multiple goroutines.
@@ -156,3 +717,105 @@ func (c *Cancelations) GetAll() []context.CancelFunc {
 	}
 	return res
 }
+
+// ErrNoProcessableTask indicates that there are no tasks ready to be processed.
+var ErrNoProcessableTask = errors.New("no tasks are ready for processing")
+
+// BatchEntry is a task message to be written as part of a batch.
+type BatchEntry struct {
+	Msg *TaskMessage
+
+	// ProcessAt specifies when to process the task.
+	// Zero value means the task should be enqueued immediately.
+	ProcessAt time.Time
+}
+
+// Subscription is a subscription to a pubsub channel.
+type Subscription interface {
+	// Channel returns a channel to receive the published messages.
+	Channel() <-chan string
+
+	// Close unsubscribes from the pubsub channel.
+	Close() error
+}
+
+// Broker is a message broker that stores tasks and their states,
+// and delivers tasks to background worker processes.
+//
+// RDB in the rdb package is the implementation backed by redis.
+type Broker interface {
+	// Enqueue adds the message to the queue specified by its Queue field.
+	Enqueue(msg *TaskMessage) error
+
+	// Schedule adds the message to the scheduled tasks to be processed at processAt.
+	Schedule(msg *TaskMessage, processAt time.Time) error
+
+	// WriteBatch enqueues or schedules all the given messages atomically.
+	WriteBatch(entries []*BatchEntry) error
+
+	// Dequeue queries the given queues in order and moves a message
+	// to the in-progress state if there is one and returns it.
+	// If all queues are empty, ErrNoProcessableTask is returned.
+	Dequeue(qnames ...string) (*TaskMessage, error)
+
+	// Done removes the message from the in-progress state.
+	Done(msg *TaskMessage) error
+
+	// Requeue moves the message from the in-progress state back to its queue.
+	Requeue(msg *TaskMessage) error
+
+	// RequeueAll moves all messages in the in-progress state back to
+	// their queues and returns the number of messages moved.
+	RequeueAll() (int64, error)
+
+	// Retry moves the message from the in-progress state to the retry state
+	// to be processed again at processAt.
+	Retry(msg *TaskMessage, processAt time.Time, errMsg string) error
+
+	// RetryInQueue is like Retry, but the message is moved to the given
+	// queue when it's processed again.
+	RetryInQueue(msg *TaskMessage, qname string, processAt time.Time, errMsg string) error
+
+	// Postpone moves the message from the in-progress state to the retry state
+	// to be processed again at processAt, without counting it as a retry.
+	Postpone(msg *TaskMessage, processAt time.Time) error
+
+	// Kill moves the message from the in-progress state to the dead state.
+	Kill(msg *TaskMessage, errMsg string) error
+
+	// CheckAndEnqueue moves the scheduled and retry messages that are ready
+	// to be processed to their queues. If queue names are given, only the
+	// messages for the queues are moved.
+	CheckAndEnqueue(qnames ...string) error
+
+	// WriteProcessInfo writes the process info which expires after ttl.
+	WriteProcessInfo(ps *ProcessInfo, ttl time.Duration) error
+
+	// ClearProcessInfo deletes the process info.
+	ClearProcessInfo(ps *ProcessInfo) error
+
+	// SeedQueueWeights sets the weights of the queues unless they have been set already.
+	SeedQueueWeights(weights map[string]int) error
+
+	// QueueWeights returns the weights of the queues.
+	QueueWeights() (map[string]int, error)
+
+	// CancelationPubSub subscribes to the task cancelation messages,
+	// which hold the IDs of the tasks to cancel.
+	CancelationPubSub() (Subscription, error)
+
+	// ControlPubSub subscribes to the control messages (encoded in JSON).
+	ControlPubSub() (Subscription, error)
+
+	// PublishControlReply publishes a reply to the control message with the given id.
+	PublishControlReply(id string, reply *ControlReply) error
+
+	// KillSwitch returns the kill switch if it's engaged, or nil otherwise.
+	KillSwitch() (*KillSwitch, error)
+
+	// Ping checks the connectivity with the broker.
+	Ping() error
+
+	// Close closes the connection with the broker.
+	Close() error
+}
@@ -5,6 +5,7 @@
 package base
 
 import (
+	"fmt"
 	"testing"
 	"time"
 )
@@ -14,7 +15,7 @@ func TestQueueKey(t *testing.T) {
 		qname string
 		want  string
 	}{
-		{"custom", "asynq:queues:custom"},
+		{"custom", "{asynq}:queues:custom"},
 	}
 
 	for _, tc := range tests {
@@ -30,9 +31,9 @@ func TestProcessedKey(t *testing.T) {
 		input time.Time
 		want  string
 	}{
-		{time.Date(2019, 11, 14, 10, 30, 1, 1, time.UTC), "asynq:processed:2019-11-14"},
-		{time.Date(2020, 12, 1, 1, 0, 1, 1, time.UTC), "asynq:processed:2020-12-01"},
-		{time.Date(2020, 1, 6, 15, 02, 1, 1, time.UTC), "asynq:processed:2020-01-06"},
+		{time.Date(2019, 11, 14, 10, 30, 1, 1, time.UTC), "{asynq}:processed:2019-11-14"},
+		{time.Date(2020, 12, 1, 1, 0, 1, 1, time.UTC), "{asynq}:processed:2020-12-01"},
+		{time.Date(2020, 1, 6, 15, 02, 1, 1, time.UTC), "{asynq}:processed:2020-01-06"},
 	}
 
 	for _, tc := range tests {
@@ -48,9 +49,9 @@ func TestFailureKey(t *testing.T) {
 		input time.Time
 		want  string
 	}{
-		{time.Date(2019, 11, 14, 10, 30, 1, 1, time.UTC), "asynq:failure:2019-11-14"},
-		{time.Date(2020, 12, 1, 1, 0, 1, 1, time.UTC), "asynq:failure:2020-12-01"},
-		{time.Date(2020, 1, 6, 15, 02, 1, 1, time.UTC), "asynq:failure:2020-01-06"},
+		{time.Date(2019, 11, 14, 10, 30, 1, 1, time.UTC), "{asynq}:failure:2019-11-14"},
+		{time.Date(2020, 12, 1, 1, 0, 1, 1, time.UTC), "{asynq}:failure:2020-12-01"},
+		{time.Date(2020, 1, 6, 15, 02, 1, 1, time.UTC), "{asynq}:failure:2020-01-06"},
 	}
 
 	for _, tc := range tests {
@@ -61,14 +62,217 @@ func TestFailureKey(t *testing.T) {
 	}
 }
 
+func TestCostsKey(t *testing.T) {
+	tests := []struct {
+		prefix string
+		input  time.Time
+		want   string
+	}{
+		{"", time.Date(2019, 11, 14, 10, 30, 1, 1, time.UTC), "{asynq}:costs:2019-11-14"},
+		{"myapp", time.Date(2020, 12, 1, 1, 0, 1, 1, time.UTC), "{myapp}:costs:2020-12-01"},
+	}
+
+	for _, tc := range tests {
+		got := NewKeys(tc.prefix).CostsKey(tc.input)
+		if got != tc.want {
+			t.Errorf("NewKeys(%q).CostsKey(%v) = %q, want %q", tc.prefix, tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestLatencyKey(t *testing.T) {
+	tests := []struct {
+		prefix string
+		input  time.Time
+		want   string
+	}{
+		{"", time.Date(2019, 11, 14, 10, 30, 1, 1, time.UTC), "{asynq}:latency:2019-11-14T10:30"},
+		{"myapp", time.Date(2020, 12, 1, 1, 0, 59, 1, time.UTC), "{myapp}:latency:2020-12-01T01:00"},
+	}
+
+	for _, tc := range tests {
+		got := NewKeys(tc.prefix).LatencyKey(tc.input)
+		if got != tc.want {
+			t.Errorf("NewKeys(%q).LatencyKey(%v) = %q, want %q", tc.prefix, tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestResultKey(t *testing.T) {
+	tests := []struct {
+		prefix string
+		id     string
+		want   string
+	}{
+		{"", "bo5q0b4r7v0mip0nnqug", "{asynq}:results:bo5q0b4r7v0mip0nnqug"},
+		{"myapp", "bo5q0b4r7v0mip0nnqug", "{myapp}:results:bo5q0b4r7v0mip0nnqug"},
+	}
+
+	for _, tc := range tests {
+		got := NewKeys(tc.prefix).ResultKey(tc.id)
+		if got != tc.want {
+			t.Errorf("NewKeys(%q).ResultKey(%q) = %q, want %q", tc.prefix, tc.id, got, tc.want)
+		}
+	}
+}
+
+func TestProgressKey(t *testing.T) {
+	tests := []struct {
+		prefix string
+		id     string
+		want   string
+	}{
+		{"", "bo5q0b4r7v0mip0nnqug", "{asynq}:progress:bo5q0b4r7v0mip0nnqug"},
+		{"myapp", "bo5q0b4r7v0mip0nnqug", "{myapp}:progress:bo5q0b4r7v0mip0nnqug"},
+	}
+
+	for _, tc := range tests {
+		got := NewKeys(tc.prefix).ProgressKey(tc.id)
+		if got != tc.want {
+			t.Errorf("NewKeys(%q).ProgressKey(%q) = %q, want %q", tc.prefix, tc.id, got, tc.want)
+		}
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	tests := []struct {
+		prefix string
+		name   string
+		want   string
+	}{
+		{"", "type:send_email", "{asynq}:ratelimit:type:send_email"},
+		{"myapp", "queue:low", "{myapp}:ratelimit:queue:low"},
+	}
+
+	for _, tc := range tests {
+		got := NewKeys(tc.prefix).RateLimitKey(tc.name)
+		if got != tc.want {
+			t.Errorf("NewKeys(%q).RateLimitKey(%q) = %q, want %q", tc.prefix, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDeliveryKey(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		id      string
+		retried int
+		want    string
+	}{
+		{"", "b4dd2an05e5gu3ufv1pg", 0, "{asynq}:delivery:b4dd2an05e5gu3ufv1pg:0"},
+		{"myapp", "b4dd2an05e5gu3ufv1pg", 3, "{myapp}:delivery:b4dd2an05e5gu3ufv1pg:3"},
+	}
+
+	for _, tc := range tests {
+		got := NewKeys(tc.prefix).DeliveryKey(tc.id, tc.retried)
+		if got != tc.want {
+			t.Errorf("NewKeys(%q).DeliveryKey(%q, %d) = %q, want %q", tc.prefix, tc.id, tc.retried, got, tc.want)
+		}
+	}
+}
+
+func TestDedupKey(t *testing.T) {
+	tests := []struct {
+		prefix string
+		hash   string
+		want   string
+	}{
+		{"", "9f86d081884c7d65", "{asynq}:dedup:9f86d081884c7d65"},
+		{"myapp", "9f86d081884c7d65", "{myapp}:dedup:9f86d081884c7d65"},
+	}
+
+	for _, tc := range tests {
+		got := NewKeys(tc.prefix).DedupKey(tc.hash)
+		if got != tc.want {
+			t.Errorf("NewKeys(%q).DedupKey(%q) = %q, want %q", tc.prefix, tc.hash, got, tc.want)
+		}
+	}
+}
+
+func TestCorrelationKey(t *testing.T) {
+	tests := []struct {
+		prefix string
+		id     string
+		want   string
+	}{
+		{"", "req-1", "{asynq}:rollups:correlation:req-1"},
+		{"myapp", "req-1", "{myapp}:rollups:correlation:req-1"},
+	}
+
+	for _, tc := range tests {
+		keys := NewKeys(tc.prefix)
+		got := keys.CorrelationKey(tc.id)
+		if got != tc.want {
+			t.Errorf("NewKeys(%q).CorrelationKey(%q) = %q, want %q", tc.prefix, tc.id, got, tc.want)
+		}
+		if want := keys.Rollups + ":correlation:" + tc.id; got != want {
+			t.Errorf("NewKeys(%q).CorrelationKey(%q) = %q, want the key of the rollups with the id appended %q", tc.prefix, tc.id, got, want)
+		}
+	}
+}
+
+func TestStartsKey(t *testing.T) {
+	tests := []struct {
+		prefix string
+		id     string
+		want   string
+	}{
+		{"", "b4dd2an05e5gu3ufv1pg", "{asynq}:starts:b4dd2an05e5gu3ufv1pg"},
+		{"myapp", "b4dd2an05e5gu3ufv1pg", "{myapp}:starts:b4dd2an05e5gu3ufv1pg"},
+	}
+
+	for _, tc := range tests {
+		got := NewKeys(tc.prefix).StartsKey(tc.id)
+		if got != tc.want {
+			t.Errorf("NewKeys(%q).StartsKey(%q) = %q, want %q", tc.prefix, tc.id, got, tc.want)
+		}
+	}
+}
+
+func TestDependencyKey(t *testing.T) {
+	tests := []struct {
+		prefix string
+		name   string
+		want   string
+	}{
+		{"", "smtp", "{asynq}:dependencies:smtp"},
+		{"myapp", "smtp", "{myapp}:dependencies:smtp"},
+	}
+
+	for _, tc := range tests {
+		got := NewKeys(tc.prefix).DependencyKey(tc.name)
+		if got != tc.want {
+			t.Errorf("NewKeys(%q).DependencyKey(%q) = %q, want %q", tc.prefix, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestWorkflowKey(t *testing.T) {
+	tests := []struct {
+		prefix string
+		id     string
+		want   string
+	}{
+		{"", "order:1234", "{asynq}:workflows:order:1234"},
+		{"myapp", "order:1234", "{myapp}:workflows:order:1234"},
+	}
+
+	for _, tc := range tests {
+		got := NewKeys(tc.prefix).WorkflowKey(tc.id)
+		if got != tc.want {
+			t.Errorf("NewKeys(%q).WorkflowKey(%q) = %q, want %q", tc.prefix, tc.id, got, tc.want)
+		}
+	}
+}
+
 func TestProcessInfoKey(t *testing.T) {
 	tests := []struct {
 		hostname string
 		pid      int
 		want     string
 	}{
-		{"localhost", 9876, "asynq:ps:localhost:9876"},
-		{"127.0.0.1", 1234, "asynq:ps:127.0.0.1:1234"},
+		{"localhost", 9876, "{asynq}:ps:localhost:9876"},
+		{"127.0.0.1", 1234, "{asynq}:ps:127.0.0.1:1234"},
 	}
 
 	for _, tc := range tests {
@@ -78,3 +282,109 @@ func TestProcessInfoKey(t *testing.T) {
 		}
 	}
 }
+
+func TestControlReplyChannel(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"bpsgccse5ua3rcn7jiog", "asynq:control:reply:bpsgccse5ua3rcn7jiog"},
+	}
+
+	for _, tc := range tests {
+		got := ControlReplyChannel(tc.id)
+		if got != tc.want {
+			t.Errorf("ControlReplyChannel(%q) = %q, want %q", tc.id, got, tc.want)
+		}
+	}
+}
+
+func TestNewKeys(t *testing.T) {
+	tests := []struct {
+		prefix         string
+		wantQueueKey   string
+		wantCancel     string
+		wantProcessKey string
+	}{
+		{"", "{asynq}:queues:custom", "asynq:cancel", "{asynq}:ps:localhost:9876"},
+		{"{asynq}", "{asynq}:queues:custom", "asynq:cancel", "{asynq}:ps:localhost:9876"},
+		{"myapp", "{myapp}:queues:custom", "{myapp}:cancel", "{myapp}:ps:localhost:9876"},
+		{"asynq:{myapp}", "asynq:{myapp}:queues:custom", "asynq:{myapp}:cancel", "asynq:{myapp}:ps:localhost:9876"},
+		{"asynq:{}", "{asynq:{}}:queues:custom", "{asynq:{}}:cancel", "{asynq:{}}:ps:localhost:9876"},
+	}
+
+	for _, tc := range tests {
+		k := NewKeys(tc.prefix)
+		if got := k.QueueKey("custom"); got != tc.wantQueueKey {
+			t.Errorf("NewKeys(%q).QueueKey(%q) = %q, want %q", tc.prefix, "custom", got, tc.wantQueueKey)
+		}
+		if got := k.CancelChannel; got != tc.wantCancel {
+			t.Errorf("NewKeys(%q).CancelChannel = %q, want %q", tc.prefix, got, tc.wantCancel)
+		}
+		if got := k.ProcessInfoKey("localhost", 9876); got != tc.wantProcessKey {
+			t.Errorf("NewKeys(%q).ProcessInfoKey(%q, %d) = %q, want %q", tc.prefix, "localhost", 9876, got, tc.wantProcessKey)
+		}
+	}
+}
+
+func TestRecordError(t *testing.T) {
+	now := time.Now()
+	msg := &TaskMessage{Type: "send_email"}
+	for i := 0; i < MaxErrorHistory+2; i++ {
+		prev := msg
+		n := len(prev.ErrorHistory)
+		msg = RecordError(msg, fmt.Sprintf("error %d", i), now.Add(time.Duration(i)*time.Second))
+		if len(prev.ErrorHistory) != n || prev.ErrorMsg == msg.ErrorMsg {
+			t.Fatalf("RecordError modified the given message")
+		}
+	}
+
+	if msg.ErrorMsg != fmt.Sprintf("error %d", MaxErrorHistory+1) {
+		t.Errorf("ErrorMsg = %q, want %q", msg.ErrorMsg, fmt.Sprintf("error %d", MaxErrorHistory+1))
+	}
+	if len(msg.ErrorHistory) != MaxErrorHistory {
+		t.Fatalf("len(ErrorHistory) = %d, want %d", len(msg.ErrorHistory), MaxErrorHistory)
+	}
+	// The two oldest errors should have been dropped.
+	for i, e := range msg.ErrorHistory {
+		want := fmt.Sprintf("error %d", i+2)
+		if e.Msg != want {
+			t.Errorf("ErrorHistory[%d].Msg = %q, want %q", i, e.Msg, want)
+		}
+		if wantTime := now.Add(time.Duration(i+2) * time.Second); !e.Time.Equal(wantTime) {
+			t.Errorf("ErrorHistory[%d].Time = %v, want %v", i, e.Time, wantTime)
+		}
+	}
+}
+
+func TestRecordPayload(t *testing.T) {
+	now := time.Now()
+	msg := &TaskMessage{Type: "send_email", Payload: map[string]interface{}{"version": 0}}
+	for i := 1; i <= MaxPayloadHistory+2; i++ {
+		prev := msg
+		n := len(prev.PayloadHistory)
+		msg = RecordPayload(msg, map[string]interface{}{"version": i}, now.Add(time.Duration(i)*time.Second))
+		if len(prev.PayloadHistory) != n || prev.Payload["version"] != i-1 {
+			t.Fatalf("RecordPayload modified the given message")
+		}
+	}
+
+	if got := msg.Payload["version"]; got != MaxPayloadHistory+2 {
+		t.Errorf("Payload[%q] = %v, want %d", "version", got, MaxPayloadHistory+2)
+	}
+	if len(msg.PayloadHistory) != MaxPayloadHistory {
+		t.Fatalf("len(PayloadHistory) = %d, want %d", len(msg.PayloadHistory), MaxPayloadHistory)
+	}
+	// The two oldest versions should have been dropped.
+	for i, v := range msg.PayloadHistory {
+		if got := v.Payload["version"]; got != i+2 {
+			t.Errorf("PayloadHistory[%d].Payload[%q] = %v, want %d", i, "version", got, i+2)
+		}
+		if wantTime := now.Add(time.Duration(i+3) * time.Second); !v.Time.Equal(wantTime) {
+			t.Errorf("PayloadHistory[%d].Time = %v, want %v", i, v.Time, wantTime)
+		}
+		if v.Type != "send_email" {
+			t.Errorf("PayloadHistory[%d].Type = %q, want %q", i, v.Type, "send_email")
+		}
+	}
+}
@@ -0,0 +1,760 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package base
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+// MessageEncoding specifies how a task message is encoded in redis.
+type MessageEncoding int
+
+const (
+	// JSONEncoding encodes task messages in JSON.
+	JSONEncoding MessageEncoding = iota
+
+	// ProtobufEncoding encodes task messages in protocol buffers
+	// wire format prefixed with a zero byte. See task_message.proto.
+	ProtobufEncoding
+)
+
+// protobufPrefix is the first byte of protobuf encoded messages,
+// which distinguishes them from JSON encoded messages.
+const protobufPrefix = 0
+
+// EncodeMessage encodes the message with the encoding specified
+// by its Encoding field.
+func EncodeMessage(msg *TaskMessage) ([]byte, error) {
+	switch msg.Encoding {
+	case JSONEncoding:
+		return json.Marshal(msg)
+	case ProtobufEncoding:
+		return encodeProtobuf(msg)
+	default:
+		return nil, fmt.Errorf("unknown message encoding %d", msg.Encoding)
+	}
+}
+
+// DecodeMessage decodes the message encoded in either JSON or protobuf.
+// Encoding field of the returned message is set to the encoding of the data,
+// so that encoding the message again produces the same data.
+func DecodeMessage(data []byte) (*TaskMessage, error) {
+	if len(data) > 0 && data[0] == protobufPrefix {
+		return decodeProtobuf(data[1:])
+	}
+	var msg TaskMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Field numbers of TaskMessage, TaskError, Struct, and Value in task_message.proto.
+const (
+	fieldID              = 1
+	fieldQueue           = 2
+	fieldType            = 3
+	fieldPayload         = 4
+	fieldRetry           = 5
+	fieldRetried         = 6
+	fieldErrorMsg        = 7
+	fieldTimeout         = 8
+	fieldCorrelationID   = 9
+	fieldDimensions      = 10
+	fieldErrorHistory    = 11
+	fieldProcessAt       = 12
+	fieldData            = 13
+	fieldAtMostOnce      = 14
+	fieldCodec           = 15
+	fieldCompression     = 16
+	fieldPayloadHistory  = 17
+	fieldKeyID           = 18
+	fieldSignature       = 19
+	fieldContentType     = 20
+	fieldContentEncoding = 21
+	fieldWorkflowID      = 22
+	fieldWorkflowStep    = 23
+	fieldHeaders         = 24
+	fieldDeadline        = 25
+	fieldRecovered       = 26
+
+	fieldTaskErrorMsg  = 1
+	fieldTaskErrorTime = 2
+
+	fieldVersionType    = 1
+	fieldVersionPayload = 2
+	fieldVersionTime    = 3
+
+	fieldStructFields = 1
+	fieldEntryKey     = 1
+	fieldEntryValue   = 2
+	fieldListValues   = 1
+
+	fieldNullValue   = 1
+	fieldNumberValue = 2
+	fieldStringValue = 3
+	fieldBoolValue   = 4
+	fieldStructValue = 5
+	fieldListValue   = 6
+)
+
+// Wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+type protoWriter struct {
+	buf []byte
+}
+
+func (w *protoWriter) tag(field, wire int) {
+	w.varint(uint64(field<<3 | wire))
+}
+
+func (w *protoWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	w.buf = append(w.buf, b[:n]...)
+}
+
+func (w *protoWriter) bytes(field int, b []byte) {
+	w.tag(field, wireBytes)
+	w.varint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *protoWriter) string(field int, s string) {
+	w.bytes(field, []byte(s))
+}
+
+// stringMap writes the entries of the map sorted by key, so that the same
+// map is always encoded the same way.
+func (w *protoWriter) stringMap(field int, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry protoWriter
+		entry.string(fieldEntryKey, k)
+		entry.string(fieldEntryValue, m[k])
+		w.bytes(field, entry.buf)
+	}
+}
+
+func (w *protoWriter) int(field int, v int) {
+	if v == 0 {
+		return
+	}
+	w.tag(field, wireVarint)
+	w.varint(uint64(v))
+}
+
+func encodeProtobuf(msg *TaskMessage) ([]byte, error) {
+	w := protoWriter{buf: []byte{protobufPrefix}}
+	// ID and Queue are always written first, so that lua scripts can read them.
+	w.string(fieldID, msg.ID.String())
+	w.string(fieldQueue, msg.Queue)
+	if msg.Type != "" {
+		w.string(fieldType, msg.Type)
+	}
+	if msg.Payload != nil {
+		payload, err := encodeStruct(msg.Payload)
+		if err != nil {
+			return nil, err
+		}
+		w.bytes(fieldPayload, payload)
+	}
+	w.int(fieldRetry, msg.Retry)
+	w.int(fieldRetried, msg.Retried)
+	if msg.ErrorMsg != "" {
+		w.string(fieldErrorMsg, msg.ErrorMsg)
+	}
+	if msg.Timeout != "" {
+		w.string(fieldTimeout, msg.Timeout)
+	}
+	if msg.CorrelationID != "" {
+		w.string(fieldCorrelationID, msg.CorrelationID)
+	}
+	w.stringMap(fieldDimensions, msg.Dimensions)
+	for _, e := range msg.ErrorHistory {
+		var te protoWriter
+		te.string(fieldTaskErrorMsg, e.Msg)
+		if !e.Time.IsZero() {
+			te.tag(fieldTaskErrorTime, wireVarint)
+			te.varint(uint64(e.Time.UnixNano()))
+		}
+		w.bytes(fieldErrorHistory, te.buf)
+	}
+	if msg.ProcessAt != 0 {
+		w.tag(fieldProcessAt, wireVarint)
+		w.varint(uint64(msg.ProcessAt))
+	}
+	if msg.Data != nil {
+		w.bytes(fieldData, msg.Data)
+	}
+	if msg.AtMostOnce {
+		w.int(fieldAtMostOnce, 1)
+	}
+	if msg.Codec != "" {
+		w.string(fieldCodec, msg.Codec)
+	}
+	if msg.Compression != "" {
+		w.string(fieldCompression, msg.Compression)
+	}
+	if msg.ContentType != "" {
+		w.string(fieldContentType, msg.ContentType)
+	}
+	if msg.ContentEncoding != "" {
+		w.string(fieldContentEncoding, msg.ContentEncoding)
+	}
+	if msg.WorkflowID != "" {
+		w.string(fieldWorkflowID, msg.WorkflowID)
+	}
+	if msg.WorkflowStep != "" {
+		w.string(fieldWorkflowStep, msg.WorkflowStep)
+	}
+	w.stringMap(fieldHeaders, msg.Headers)
+	if msg.Deadline != 0 {
+		w.tag(fieldDeadline, wireVarint)
+		w.varint(uint64(msg.Deadline))
+	}
+	if msg.Recovered != 0 {
+		w.tag(fieldRecovered, wireVarint)
+		w.varint(uint64(msg.Recovered))
+	}
+	if msg.KeyID != "" {
+		w.string(fieldKeyID, msg.KeyID)
+	}
+	if msg.Signature != nil {
+		w.bytes(fieldSignature, msg.Signature)
+	}
+	for _, v := range msg.PayloadHistory {
+		var pv protoWriter
+		if v.Type != "" {
+			pv.string(fieldVersionType, v.Type)
+		}
+		if v.Payload != nil {
+			payload, err := encodeStruct(v.Payload)
+			if err != nil {
+				return nil, err
+			}
+			pv.bytes(fieldVersionPayload, payload)
+		}
+		if !v.Time.IsZero() {
+			pv.tag(fieldVersionTime, wireVarint)
+			pv.varint(uint64(v.Time.UnixNano()))
+		}
+		w.bytes(fieldPayloadHistory, pv.buf)
+	}
+	return w.buf, nil
+}
+
+// encodeStruct encodes the map as google.protobuf.Struct.
+// Keys are sorted so that the encoding is deterministic.
+func encodeStruct(m map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var w protoWriter
+	for _, k := range keys {
+		v, err := encodeValue(m[k])
+		if err != nil {
+			return nil, err
+		}
+		var entry protoWriter
+		entry.string(fieldEntryKey, k)
+		entry.bytes(fieldEntryValue, v)
+		w.bytes(fieldStructFields, entry.buf)
+	}
+	return w.buf, nil
+}
+
+// encodeValue encodes the value as google.protobuf.Value.
+//
+// Values of types other than the ones produced by decoding JSON
+// are converted as if they were encoded in JSON and decoded,
+// so that a handler sees the same payload regardless of the encoding.
+func encodeValue(v interface{}) ([]byte, error) {
+	var w protoWriter
+	switch v := v.(type) {
+	case nil:
+		w.tag(fieldNullValue, wireVarint)
+		w.varint(0)
+	case bool:
+		w.tag(fieldBoolValue, wireVarint)
+		if v {
+			w.varint(1)
+		} else {
+			w.varint(0)
+		}
+	case string:
+		w.string(fieldStringValue, v)
+	case float64:
+		w.tag(fieldNumberValue, wireFixed64)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+		w.buf = append(w.buf, b[:]...)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32:
+		return encodeValue(reflect.ValueOf(v).Convert(reflect.TypeOf(float64(0))).Float())
+	case map[string]interface{}:
+		b, err := encodeStruct(v)
+		if err != nil {
+			return nil, err
+		}
+		w.bytes(fieldStructValue, b)
+	case []interface{}:
+		var list protoWriter
+		for _, x := range v {
+			b, err := encodeValue(x)
+			if err != nil {
+				return nil, err
+			}
+			list.bytes(fieldListValues, b)
+		}
+		w.bytes(fieldListValue, list.buf)
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		var x interface{}
+		if err := json.Unmarshal(data, &x); err != nil {
+			return nil, err
+		}
+		return encodeValue(x)
+	}
+	return w.buf, nil
+}
+
+var errMalformed = errors.New("malformed protobuf message")
+
+type protoReader struct {
+	buf []byte
+}
+
+func (r *protoReader) done() bool {
+	return len(r.buf) == 0
+}
+
+func (r *protoReader) varint() (uint64, error) {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		return 0, errMalformed
+	}
+	r.buf = r.buf[n:]
+	return v, nil
+}
+
+// next reads the tag of the next field.
+func (r *protoReader) next() (field, wire int, err error) {
+	v, err := r.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(v >> 3), int(v & 7), nil
+}
+
+func (r *protoReader) bytes() ([]byte, error) {
+	n, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(r.buf)) < n {
+		return nil, errMalformed
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b, nil
+}
+
+func (r *protoReader) fixed64() (uint64, error) {
+	if len(r.buf) < 8 {
+		return 0, errMalformed
+	}
+	v := binary.LittleEndian.Uint64(r.buf)
+	r.buf = r.buf[8:]
+	return v, nil
+}
+
+// skip skips the value of a field of the given wire type.
+func (r *protoReader) skip(wire int) error {
+	var err error
+	switch wire {
+	case wireVarint:
+		_, err = r.varint()
+	case wireFixed64:
+		_, err = r.fixed64()
+	case wireBytes:
+		_, err = r.bytes()
+	default:
+		err = errMalformed
+	}
+	return err
+}
+
+func decodeProtobuf(data []byte) (*TaskMessage, error) {
+	msg := TaskMessage{Encoding: ProtobufEncoding}
+	r := protoReader{data}
+	for !r.done() {
+		field, wire, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case wire == wireBytes && !isVarintField(field):
+			b, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			switch field {
+			case fieldID:
+				if msg.ID, err = xid.FromString(string(b)); err != nil {
+					return nil, err
+				}
+			case fieldQueue:
+				msg.Queue = string(b)
+			case fieldType:
+				msg.Type = string(b)
+			case fieldPayload:
+				if msg.Payload, err = decodeStruct(b); err != nil {
+					return nil, err
+				}
+			case fieldErrorMsg:
+				msg.ErrorMsg = string(b)
+			case fieldTimeout:
+				msg.Timeout = string(b)
+			case fieldCorrelationID:
+				msg.CorrelationID = string(b)
+			case fieldDimensions:
+				k, v, err := decodeStringEntry(b)
+				if err != nil {
+					return nil, err
+				}
+				if msg.Dimensions == nil {
+					msg.Dimensions = make(map[string]string)
+				}
+				msg.Dimensions[k] = v
+			case fieldData:
+				msg.Data = append([]byte{}, b...)
+			case fieldCodec:
+				msg.Codec = string(b)
+			case fieldCompression:
+				msg.Compression = string(b)
+			case fieldContentType:
+				msg.ContentType = string(b)
+			case fieldContentEncoding:
+				msg.ContentEncoding = string(b)
+			case fieldWorkflowID:
+				msg.WorkflowID = string(b)
+			case fieldWorkflowStep:
+				msg.WorkflowStep = string(b)
+			case fieldHeaders:
+				k, v, err := decodeStringEntry(b)
+				if err != nil {
+					return nil, err
+				}
+				if msg.Headers == nil {
+					msg.Headers = make(map[string]string)
+				}
+				msg.Headers[k] = v
+			case fieldKeyID:
+				msg.KeyID = string(b)
+			case fieldSignature:
+				msg.Signature = append([]byte{}, b...)
+			case fieldPayloadHistory:
+				v, err := decodePayloadVersion(b)
+				if err != nil {
+					return nil, err
+				}
+				msg.PayloadHistory = append(msg.PayloadHistory, v)
+			case fieldErrorHistory:
+				e, err := decodeTaskError(b)
+				if err != nil {
+					return nil, err
+				}
+				msg.ErrorHistory = append(msg.ErrorHistory, e)
+			}
+		case wire == wireVarint && isVarintField(field):
+			v, err := r.varint()
+			if err != nil {
+				return nil, err
+			}
+			switch field {
+			case fieldRetry:
+				msg.Retry = int(int64(v))
+			case fieldRetried:
+				msg.Retried = int(int64(v))
+			case fieldProcessAt:
+				msg.ProcessAt = int64(v)
+			case fieldDeadline:
+				msg.Deadline = int64(v)
+			case fieldRecovered:
+				msg.Recovered = int(int64(v))
+			case fieldAtMostOnce:
+				msg.AtMostOnce = v != 0
+			}
+		default:
+			// unknown field, skip it for forward compatibility.
+			if err := r.skip(wire); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &msg, nil
+}
+
+// isVarintField reports whether the field of TaskMessage is encoded as a varint.
+func isVarintField(field int) bool {
+	switch field {
+	case fieldRetry, fieldRetried, fieldProcessAt, fieldAtMostOnce, fieldDeadline, fieldRecovered:
+		return true
+	}
+	return false
+}
+
+func decodeTaskError(data []byte) (*TaskError, error) {
+	var e TaskError
+	r := protoReader{data}
+	for !r.done() {
+		field, wire, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case field == fieldTaskErrorMsg && wire == wireBytes:
+			b, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			e.Msg = string(b)
+		case field == fieldTaskErrorTime && wire == wireVarint:
+			v, err := r.varint()
+			if err != nil {
+				return nil, err
+			}
+			e.Time = time.Unix(0, int64(v))
+		default:
+			if err := r.skip(wire); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &e, nil
+}
+
+func decodePayloadVersion(data []byte) (*PayloadVersion, error) {
+	var v PayloadVersion
+	r := protoReader{data}
+	for !r.done() {
+		field, wire, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case field == fieldVersionType && wire == wireBytes:
+			b, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			v.Type = string(b)
+		case field == fieldVersionPayload && wire == wireBytes:
+			b, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			if v.Payload, err = decodeStruct(b); err != nil {
+				return nil, err
+			}
+		case field == fieldVersionTime && wire == wireVarint:
+			n, err := r.varint()
+			if err != nil {
+				return nil, err
+			}
+			v.Time = time.Unix(0, int64(n))
+		default:
+			if err := r.skip(wire); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &v, nil
+}
+
+// decodeStringEntry decodes an entry of map<string, string>.
+func decodeStringEntry(data []byte) (key, val string, err error) {
+	r := protoReader{data}
+	for !r.done() {
+		field, wire, err := r.next()
+		if err != nil {
+			return "", "", err
+		}
+		if wire != wireBytes {
+			if err := r.skip(wire); err != nil {
+				return "", "", err
+			}
+			continue
+		}
+		b, err := r.bytes()
+		if err != nil {
+			return "", "", err
+		}
+		switch field {
+		case fieldEntryKey:
+			key = string(b)
+		case fieldEntryValue:
+			val = string(b)
+		}
+	}
+	return key, val, nil
+}
+
+func decodeStruct(data []byte) (map[string]interface{}, error) {
+	res := make(map[string]interface{})
+	r := protoReader{data}
+	for !r.done() {
+		field, wire, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if field != fieldStructFields || wire != wireBytes {
+			if err := r.skip(wire); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		b, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+		var key string
+		var val interface{}
+		entry := protoReader{b}
+		for !entry.done() {
+			field, wire, err := entry.next()
+			if err != nil {
+				return nil, err
+			}
+			if wire != wireBytes {
+				if err := entry.skip(wire); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			b, err := entry.bytes()
+			if err != nil {
+				return nil, err
+			}
+			switch field {
+			case fieldEntryKey:
+				key = string(b)
+			case fieldEntryValue:
+				if val, err = decodeValue(b); err != nil {
+					return nil, err
+				}
+			}
+		}
+		res[key] = val
+	}
+	return res, nil
+}
+
+func decodeValue(data []byte) (interface{}, error) {
+	var res interface{}
+	r := protoReader{data}
+	for !r.done() {
+		field, wire, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case field == fieldNullValue && wire == wireVarint:
+			if _, err := r.varint(); err != nil {
+				return nil, err
+			}
+			res = nil
+		case field == fieldBoolValue && wire == wireVarint:
+			v, err := r.varint()
+			if err != nil {
+				return nil, err
+			}
+			res = v != 0
+		case field == fieldNumberValue && wire == wireFixed64:
+			v, err := r.fixed64()
+			if err != nil {
+				return nil, err
+			}
+			res = math.Float64frombits(v)
+		case field == fieldStringValue && wire == wireBytes:
+			b, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			res = string(b)
+		case field == fieldStructValue && wire == wireBytes:
+			b, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			if res, err = decodeStruct(b); err != nil {
+				return nil, err
+			}
+		case field == fieldListValue && wire == wireBytes:
+			b, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			if res, err = decodeList(b); err != nil {
+				return nil, err
+			}
+		default:
+			if err := r.skip(wire); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return res, nil
+}
+
+func decodeList(data []byte) ([]interface{}, error) {
+	res := []interface{}{}
+	r := protoReader{data}
+	for !r.done() {
+		field, wire, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if field != fieldListValues || wire != wireBytes {
+			if err := r.skip(wire); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		b, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+		v, err := decodeValue(b)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
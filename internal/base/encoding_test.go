@@ -0,0 +1,189 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package base
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/rs/xid"
+)
+
+func TestEncodeDecodeMessage(t *testing.T) {
+	msg := &TaskMessage{
+		Type: "send_email",
+		Payload: map[string]interface{}{
+			"user_id": 42,
+			"subject": "hello",
+			"admin":   true,
+			"extra":   nil,
+			"tags":    []interface{}{"a", 1.5},
+			"headers": map[string]interface{}{"x-priority": "high"},
+			"amounts": []int{1, 2},
+		},
+		ID:            xid.New(),
+		Queue:         "default",
+		Retry:         25,
+		Retried:       3,
+		Recovered:     1,
+		ErrorMsg:      "something went wrong",
+		Timeout:       "30s",
+		CorrelationID: "req-123",
+		Dimensions:    map[string]string{"plan": "pro", "country": "jp"},
+		Headers:       map[string]string{"trace-id": "4bf92f35", "tenant-id": "acme"},
+		ErrorHistory: []*TaskError{
+			{Msg: "connection reset", Time: time.Unix(1590000000, 123)},
+			{Msg: "something went wrong", Time: time.Unix(1590000060, 0)},
+		},
+		ProcessAt:  time.Unix(1590000000, 456).UnixNano(),
+		Deadline:   time.Unix(1590003600, 0).UnixNano(),
+		AtMostOnce: true,
+		PayloadHistory: []*PayloadVersion{
+			{Type: "welcome_email", Payload: map[string]interface{}{"user_id": 41.0}, Time: time.Unix(1590000030, 789)},
+		},
+	}
+	// Payload as seen by the handler after JSON round trip.
+	wantPayload := map[string]interface{}{
+		"user_id": 42.0,
+		"subject": "hello",
+		"admin":   true,
+		"extra":   nil,
+		"tags":    []interface{}{"a", 1.5},
+		"headers": map[string]interface{}{"x-priority": "high"},
+		"amounts": []interface{}{1.0, 2.0},
+	}
+
+	for _, enc := range []MessageEncoding{JSONEncoding, ProtobufEncoding} {
+		m := *msg
+		m.Encoding = enc
+		data, err := EncodeMessage(&m)
+		if err != nil {
+			t.Fatalf("EncodeMessage with encoding %d returned error: %v", enc, err)
+		}
+		got, err := DecodeMessage(data)
+		if err != nil {
+			t.Fatalf("DecodeMessage with encoding %d returned error: %v", enc, err)
+		}
+		want := m
+		want.Payload = wantPayload
+		if diff := cmp.Diff(&want, got); diff != "" {
+			t.Errorf("DecodeMessage(EncodeMessage(msg)) with encoding %d = %+v, want %+v; (-want,+got)\n%s",
+				enc, got, &want, diff)
+		}
+		// Encoding the decoded message should produce the same data,
+		// so that it can be used to remove the message from redis.
+		again, err := EncodeMessage(got)
+		if err != nil {
+			t.Fatalf("EncodeMessage with encoding %d returned error: %v", enc, err)
+		}
+		if enc == ProtobufEncoding && !bytes.Equal(again, data) {
+			t.Errorf("EncodeMessage(DecodeMessage(data)) = %q, want %q", again, data)
+		}
+	}
+}
+
+func TestEncodeDecodeBinaryMessage(t *testing.T) {
+	msg := &TaskMessage{
+		Type:        "resize_image",
+		Data:        []byte{0x0a, 0x03, 0x66, 0x6f, 0x6f, 0x00, 0xff},
+		Codec:       "msgpack",
+		Compression: "gzip",
+		KeyID:       "2020-06",
+		Signature:   []byte{0xde, 0xad, 0xbe, 0xef},
+		ID:          xid.New(),
+		Queue:       "default",
+		Retry:       25,
+
+		ContentType:     "application/protobuf",
+		ContentEncoding: "gzip",
+		WorkflowID:      "order:1234",
+		WorkflowStep:    "charge_card",
+	}
+
+	for _, enc := range []MessageEncoding{JSONEncoding, ProtobufEncoding} {
+		m := *msg
+		m.Encoding = enc
+		data, err := EncodeMessage(&m)
+		if err != nil {
+			t.Fatalf("EncodeMessage with encoding %d returned error: %v", enc, err)
+		}
+		got, err := DecodeMessage(data)
+		if err != nil {
+			t.Fatalf("DecodeMessage with encoding %d returned error: %v", enc, err)
+		}
+		if diff := cmp.Diff(&m, got); diff != "" {
+			t.Errorf("DecodeMessage(EncodeMessage(msg)) with encoding %d = %+v, want %+v; (-want,+got)\n%s",
+				enc, got, &m, diff)
+		}
+		if enc == ProtobufEncoding && !bytes.Contains(data, msg.Data) {
+			t.Errorf("EncodeMessage(msg) = %q, want binary payload %q stored as is", data, msg.Data)
+		}
+	}
+}
+
+func TestDecodeMessageWithUnknownFields(t *testing.T) {
+	msg := &TaskMessage{
+		Type:     "send_email",
+		ID:       xid.New(),
+		Queue:    "default",
+		Encoding: ProtobufEncoding,
+	}
+	data, err := EncodeMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Append a field written by a newer version (field 100, varint 1).
+	var w protoWriter
+	w.tag(100, wireVarint)
+	w.varint(1)
+	data = append(data, w.buf...)
+
+	got, err := DecodeMessage(data)
+	if err != nil {
+		t.Fatalf("DecodeMessage returned error: %v", err)
+	}
+	if diff := cmp.Diff(msg, got); diff != "" {
+		t.Errorf("DecodeMessage(data) = %+v, want %+v; (-want,+got)\n%s", got, msg, diff)
+	}
+}
+
+func TestProtobufEncodingIsSmaller(t *testing.T) {
+	msg := &TaskMessage{
+		Type:    "send_email",
+		Payload: map[string]interface{}{"user_id": 42, "template": "welcome"},
+		ID:      xid.New(),
+		Queue:   "default",
+		Retry:   25,
+		Timeout: "0s",
+	}
+	jsonData, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Encoding = ProtobufEncoding
+	pbData, err := EncodeMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pbData) >= len(jsonData) {
+		t.Errorf("protobuf encoded message is %d bytes, want less than %d bytes of JSON", len(pbData), len(jsonData))
+	}
+}
+
+func TestDecodeMessageError(t *testing.T) {
+	tests := [][]byte{
+		[]byte("not json"),
+		{0, 0x0a, 0x7f},                // length out of range
+		{0, 0x0a, 0x03, 'a', 'b', 'c'}, // invalid ID
+	}
+	for _, data := range tests {
+		if _, err := DecodeMessage(data); err == nil {
+			t.Errorf("DecodeMessage(%q) returned nil error, want non-nil error", data)
+		}
+	}
+}
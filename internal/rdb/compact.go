@@ -0,0 +1,178 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// CompactionResult reports the keys rewritten (or to be rewritten) by Compact,
+// and the memory used by redis before and after.
+type CompactionResult struct {
+	// Keys compacted, in the order they were compacted.
+	Keys []*KeyCompaction
+
+	// Keys longer than the max length, which were not compacted.
+	Skipped []string
+
+	// Memory used by redis in bytes, and the ratio of the memory allocated
+	// by the operating system to the memory used, before and after
+	// the compaction (as reported by INFO memory).
+	UsedMemoryBefore    int64
+	UsedMemoryAfter     int64
+	FragmentationBefore float64
+	FragmentationAfter  float64
+}
+
+// KeyCompaction reports the compaction of a key.
+type KeyCompaction struct {
+	Key string
+
+	// Number of elements in the key.
+	Len int64
+
+	// Memory used by the key in bytes before and after the compaction
+	// (as estimated by MEMORY USAGE).
+	Before int64
+	After  int64
+}
+
+// number of elements to copy at a time while compacting a key.
+const compactionBatchSize = 1000
+
+// KEYS[1] -> key to compact
+// KEYS[2] -> temporary key to copy the elements to
+// ARGV[1] -> batch size
+var compactCmd = redis.NewScript(`
+local kind = redis.call("TYPE", KEYS[1])["ok"]
+local size = tonumber(ARGV[1])
+redis.call("DEL", KEYS[2])
+local n = 0
+if kind == "zset" then
+	n = redis.call("ZCARD", KEYS[1])
+	for i = 0, n - 1, size do
+		local batch = redis.call("ZRANGE", KEYS[1], i, i + size - 1, "WITHSCORES")
+		local args = {}
+		for j = 1, #batch, 2 do
+			table.insert(args, batch[j + 1])
+			table.insert(args, batch[j])
+		end
+		redis.call("ZADD", KEYS[2], unpack(args))
+	end
+elseif kind == "list" then
+	n = redis.call("LLEN", KEYS[1])
+	for i = 0, n - 1, size do
+		redis.call("RPUSH", KEYS[2], unpack(redis.call("LRANGE", KEYS[1], i, i + size - 1)))
+	end
+else
+	return 0
+end
+if n == 0 then
+	return 0
+end
+redis.call("RENAME", KEYS[2], KEYS[1])
+return n`)
+
+// Compact rewrites the queues, and the scheduled, retry, dead, and completed
+// sets with at least minLen elements into fresh keys, to reclaim the memory
+// fragmented after large backlogs have drained. Redis keeps the encoding of
+// a large list or sorted set after it shrinks, and a fresh key of the same
+// elements is encoded compactly.
+//
+// Each key is copied and replaced atomically, during which redis doesn't
+// serve other clients; the pause is proportional to the length of the key.
+// Keys longer than maxLen are skipped to bound the pause, unless maxLen is
+// zero or negative.
+//
+// If dryRun is true, Compact only reports the keys to compact without
+// rewriting them.
+func (r *RDB) Compact(minLen, maxLen int64, dryRun bool) (*CompactionResult, error) {
+	res := &CompactionResult{}
+	var err error
+	if res.UsedMemoryBefore, res.FragmentationBefore, err = r.memoryStats(); err != nil {
+		return nil, err
+	}
+	qkeys, err := r.client.SMembers(r.keys.AllQueues).Result()
+	if err != nil {
+		return nil, err
+	}
+	zsets := []string{r.keys.ScheduledQueue, r.keys.RetryQueue, r.keys.DeadQueue, r.keys.CompletedQueue}
+	for _, key := range append(qkeys, zsets...) {
+		n, err := r.keyLen(key)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 || n < minLen {
+			continue
+		}
+		if maxLen > 0 && n > maxLen {
+			res.Skipped = append(res.Skipped, key)
+			continue
+		}
+		before, err := r.client.MemoryUsage(key).Result()
+		if err != nil {
+			return nil, err
+		}
+		c := &KeyCompaction{Key: key, Len: n, Before: before, After: before}
+		res.Keys = append(res.Keys, c)
+		if dryRun {
+			continue
+		}
+		if c.Len, err = compactCmd.Run(r.client, []string{key, key + ":compacting"}, compactionBatchSize).Int64(); err != nil {
+			return nil, err
+		}
+		if c.After, err = r.client.MemoryUsage(key).Result(); err != nil && err != redis.Nil {
+			return nil, err
+		}
+		if ch := r.wakeChannel(); ch != "" && strings.HasPrefix(key, r.keys.QueuePrefix) {
+			// wake up the backgrounds which polled the queue while it was copied.
+			r.client.Publish(ch, strings.TrimPrefix(key, r.keys.QueuePrefix))
+		}
+	}
+	if res.UsedMemoryAfter, res.FragmentationAfter, err = r.memoryStats(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// keyLen returns the number of elements in the list or sorted set.
+func (r *RDB) keyLen(key string) (int64, error) {
+	kind, err := r.client.Type(key).Result()
+	if err != nil {
+		return 0, err
+	}
+	switch kind {
+	case "list":
+		return r.client.LLen(key).Result()
+	case "zset":
+		return r.client.ZCard(key).Result()
+	}
+	return 0, nil
+}
+
+// memoryStats returns the memory used by redis in bytes and the
+// fragmentation ratio reported by INFO memory.
+func (r *RDB) memoryStats() (used int64, fragmentation float64, err error) {
+	info, err := r.client.Info("memory").Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, line := range strings.Split(info, "\r\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "used_memory":
+			used, _ = strconv.ParseInt(kv[1], 10, 64)
+		case "mem_fragmentation_ratio":
+			fragmentation, _ = strconv.ParseFloat(kv[1], 64)
+		}
+	}
+	return used, fragmentation, nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+func TestCompact(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	var enqueued []*base.TaskMessage
+	var scheduled []h.ZSetEntry
+	for i := 0; i < 2500; i++ {
+		enqueued = append(enqueued, h.NewTaskMessage("send_email", nil))
+		scheduled = append(scheduled, h.ZSetEntry{
+			Msg:   h.NewTaskMessage("reindex", nil),
+			Score: float64(now.Add(time.Duration(i) * time.Second).Unix()),
+		})
+	}
+	h.SeedEnqueuedQueue(t, r.client, enqueued)
+	h.SeedScheduledQueue(t, r.client, scheduled)
+	h.SeedRetryQueue(t, r.client, []h.ZSetEntry{{Msg: h.NewTaskMessage("sync", nil), Score: float64(now.Unix())}})
+	h.SeedDeadQueue(t, r.client, scheduled[:2])
+
+	res, err := r.Compact(2, 0, false)
+	if err != nil {
+		t.Fatalf("(*RDB).Compact returned error: %v", err)
+	}
+	var gotKeys []string
+	for _, k := range res.Keys {
+		gotKeys = append(gotKeys, k.Key)
+		if k.Before <= 0 || k.After <= 0 {
+			t.Errorf("compaction of %q reported memory usage %d -> %d, want positive", k.Key, k.Before, k.After)
+		}
+	}
+	wantKeys := []string{base.DefaultQueue, base.ScheduledQueue, base.DeadQueue}
+	if diff := cmp.Diff(wantKeys, gotKeys); diff != "" {
+		t.Errorf("(*RDB).Compact compacted %v, want %v; (-want,+got)\n%s", gotKeys, wantKeys, diff)
+	}
+	if res.UsedMemoryBefore <= 0 || res.UsedMemoryAfter <= 0 {
+		t.Errorf("(*RDB).Compact reported used memory %d -> %d, want positive", res.UsedMemoryBefore, res.UsedMemoryAfter)
+	}
+
+	if diff := cmp.Diff(enqueued, h.GetEnqueuedMessages(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q after compaction; (-want,+got)\n%s", base.DefaultQueue, diff)
+	}
+	if diff := cmp.Diff(scheduled, h.GetScheduledEntries(t, r.client), h.SortZSetEntryOpt); diff != "" {
+		t.Errorf("mismatch found in %q after compaction; (-want,+got)\n%s", base.ScheduledQueue, diff)
+	}
+	if n := r.client.Exists(base.ScheduledQueue + ":compacting").Val(); n != 0 {
+		t.Errorf("temporary key of the compaction was not removed")
+	}
+}
+
+func TestCompactMaxLen(t *testing.T) {
+	r := setup(t)
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{
+		h.NewTaskMessage("send_email", nil),
+		h.NewTaskMessage("send_email", nil),
+	})
+
+	res, err := r.Compact(1, 1, true)
+	if err != nil {
+		t.Fatalf("(*RDB).Compact returned error: %v", err)
+	}
+	if len(res.Keys) != 0 {
+		t.Errorf("(*RDB).Compact compacted %d keys, want 0", len(res.Keys))
+	}
+	want := []string{base.DefaultQueue}
+	if diff := cmp.Diff(want, res.Skipped); diff != "" {
+		t.Errorf("(*RDB).Compact skipped %v, want %v; (-want,+got)\n%s", res.Skipped, want, diff)
+	}
+}
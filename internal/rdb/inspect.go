@@ -7,6 +7,9 @@ package rdb
 import (
 	"encoding/json"
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -23,8 +26,10 @@ type Stats struct {
 	Scheduled  int
 	Retry      int
 	Dead       int
+	Completed  int
 	Processed  int
 	Failed     int
+	Duplicates int            // number of duplicate deliveries detected
 	Queues     map[string]int // map of queue name to number of tasks in the queue (e.g., "default": 100, "critical": 20)
 	Timestamp  time.Time
 }
@@ -36,6 +41,17 @@ type DailyStats struct {
 	Time      time.Time
 }
 
+// DailyCosts holds the costs reported by handlers for a given day.
+type DailyCosts struct {
+	// ByType maps task type to resource name to amount.
+	ByType map[string]map[string]float64
+
+	// ByDimension maps rollup dimension to value to resource name to amount.
+	ByDimension map[string]map[string]map[string]float64
+
+	Time time.Time
+}
+
 // EnqueuedTask is a task in a queue and is ready to be processed.
 type EnqueuedTask struct {
 	ID      xid.ID
@@ -67,12 +83,13 @@ type RetryTask struct {
 	Type    string
 	Payload map[string]interface{}
 	// TODO(hibiken): add LastFailedAt time.Time
-	ProcessAt time.Time
-	ErrorMsg  string
-	Retried   int
-	Retry     int
-	Score     int64
-	Queue     string
+	ProcessAt    time.Time
+	ErrorMsg     string
+	ErrorHistory []*base.TaskError
+	Retried      int
+	Retry        int
+	Score        int64
+	Queue        string
 }
 
 // DeadTask is a task in that has exhausted all retries.
@@ -82,17 +99,20 @@ type DeadTask struct {
 	Payload      map[string]interface{}
 	LastFailedAt time.Time
 	ErrorMsg     string
+	ErrorHistory []*base.TaskError
 	Score        int64
 	Queue        string
 }
 
-// KEYS[1] -> asynq:queues
-// KEYS[2] -> asynq:in_progress
-// KEYS[3] -> asynq:scheduled
-// KEYS[4] -> asynq:retry
-// KEYS[5] -> asynq:dead
-// KEYS[6] -> asynq:processed:<yyyy-mm-dd>
-// KEYS[7] -> asynq:failure:<yyyy-mm-dd>
+// KEYS[1] -> {asynq}:queues
+// KEYS[2] -> {asynq}:in_progress
+// KEYS[3] -> {asynq}:scheduled
+// KEYS[4] -> {asynq}:retry
+// KEYS[5] -> {asynq}:dead
+// KEYS[6] -> {asynq}:processed:<yyyy-mm-dd>
+// KEYS[7] -> {asynq}:failure:<yyyy-mm-dd>
+// KEYS[8] -> {asynq}:duplicates
+// KEYS[9] -> {asynq}:completed
 var currentStatsCmd = redis.NewScript(`
 local res = {}
 local queues = redis.call("SMEMBERS", KEYS[1])
@@ -122,19 +142,25 @@ if f then
 end
 table.insert(res, "failed")
 table.insert(res, fcount)
+table.insert(res, "duplicates")
+table.insert(res, tonumber(redis.call("GET", KEYS[8]) or 0))
+table.insert(res, KEYS[9])
+table.insert(res, redis.call("ZCARD", KEYS[9]))
 return res`)
 
 // CurrentStats returns a current state of the queues.
 func (r *RDB) CurrentStats() (*Stats, error) {
 	now := time.Now()
 	res, err := currentStatsCmd.Run(r.client, []string{
-		base.AllQueues,
-		base.InProgressQueue,
-		base.ScheduledQueue,
-		base.RetryQueue,
-		base.DeadQueue,
-		base.ProcessedKey(now),
-		base.FailureKey(now),
+		r.keys.AllQueues,
+		r.keys.InProgressQueue,
+		r.keys.ScheduledQueue,
+		r.keys.RetryQueue,
+		r.keys.DeadQueue,
+		r.keys.ProcessedKey(now),
+		r.keys.FailureKey(now),
+		r.keys.Duplicates,
+		r.keys.CompletedQueue,
 	}).Result()
 	if err != nil {
 		return nil, err
@@ -152,26 +178,85 @@ func (r *RDB) CurrentStats() (*Stats, error) {
 		val := cast.ToInt(data[i+1])
 
 		switch {
-		case strings.HasPrefix(key, base.QueuePrefix):
+		case strings.HasPrefix(key, r.keys.QueuePrefix):
 			stats.Enqueued += val
-			stats.Queues[strings.TrimPrefix(key, base.QueuePrefix)] = val
-		case key == base.InProgressQueue:
+			stats.Queues[strings.TrimPrefix(key, r.keys.QueuePrefix)] = val
+		case key == r.keys.InProgressQueue:
 			stats.InProgress = val
-		case key == base.ScheduledQueue:
+		case key == r.keys.ScheduledQueue:
 			stats.Scheduled = val
-		case key == base.RetryQueue:
+		case key == r.keys.RetryQueue:
 			stats.Retry = val
-		case key == base.DeadQueue:
+		case key == r.keys.DeadQueue:
 			stats.Dead = val
+		case key == r.keys.CompletedQueue:
+			stats.Completed = val
 		case key == "processed":
 			stats.Processed = val
 		case key == "failed":
 			stats.Failed = val
+		case key == "duplicates":
+			stats.Duplicates = val
 		}
 	}
 	return stats, nil
 }
 
+// QueueSize holds the numbers of tasks of a queue in the states before
+// they're processed.
+type QueueSize struct {
+	Pending    int
+	Scheduled  int
+	InProgress int
+	Timestamp  time.Time
+}
+
+// KEYS[1] -> {asynq}:queues:<qname>
+// KEYS[2] -> {asynq}:scheduled
+// KEYS[3] -> {asynq}:in_progress
+// ARGV[1] -> queue name
+var queueSizeCmd = redis.NewScript(decodeMessageLua + `
+local scheduled = 0
+for _, msg in ipairs(redis.call("ZRANGE", KEYS[2], 0, -1)) do
+	if decodeMessage(msg)["Queue"] == ARGV[1] then
+		scheduled = scheduled + 1
+	end
+end
+local inProgress = 0
+for _, msg in ipairs(redis.call("LRANGE", KEYS[3], 0, -1)) do
+	if decodeMessage(msg)["Queue"] == ARGV[1] then
+		inProgress = inProgress + 1
+	end
+end
+return {redis.call("LLEN", KEYS[1]), scheduled, inProgress}`)
+
+// QueueSize returns the numbers of tasks of the queue which are enqueued,
+// scheduled, and in progress.
+//
+// The scheduled and in-progress tasks of all queues are read to count the
+// tasks of the queue, so it takes time proportional to their number.
+func (r *RDB) QueueSize(qname string) (*QueueSize, error) {
+	now := time.Now()
+	res, err := queueSizeCmd.Run(r.client, []string{
+		r.keys.QueueKey(qname),
+		r.keys.ScheduledQueue,
+		r.keys.InProgressQueue,
+	}, qname).Result()
+	if err != nil {
+		return nil, err
+	}
+	data, err := cast.ToIntSliceE(res)
+	if err != nil || len(data) != 3 {
+		return nil, fmt.Errorf("unexpected return value from Lua script: %v", res)
+	}
+	return &QueueSize{
+		Pending:    data[0],
+		Scheduled:  data[1],
+		InProgress: data[2],
+		Timestamp:  now,
+	}, nil
+}
+
 var historicalStatsCmd = redis.NewScript(`
 local res = {}
 for _, key in ipairs(KEYS) do
@@ -195,8 +280,8 @@ func (r *RDB) HistoricalStats(n int) ([]*DailyStats, error) {
 	for i := 0; i < n; i++ {
 		ts := now.Add(-time.Duration(i) * day)
 		days = append(days, ts)
-		keys = append(keys, base.ProcessedKey(ts))
-		keys = append(keys, base.FailureKey(ts))
+		keys = append(keys, r.keys.ProcessedKey(ts))
+		keys = append(keys, r.keys.FailureKey(ts))
 	}
 	res, err := historicalStatsCmd.Run(r.client, keys, len(keys)).Result()
 	if err != nil {
@@ -217,6 +302,253 @@ func (r *RDB) HistoricalStats(n int) ([]*DailyStats, error) {
 	return stats, nil
 }
 
+// Costs returns the costs reported by handlers from the last n days,
+// most recent day first.
+func (r *RDB) Costs(n int) ([]*DailyCosts, error) {
+	const day = 24 * time.Hour
+	now := time.Now().UTC()
+	res := []*DailyCosts{}
+	for i := 0; i < n; i++ {
+		ts := now.Add(-time.Duration(i) * day)
+		data, err := r.client.HGetAll(r.keys.CostsKey(ts)).Result()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, parseCosts(data, ts))
+	}
+	return res, nil
+}
+
+// LatencyHistogram counts durations by histogram bucket.
+type LatencyHistogram map[int]int64
+
+// Count returns the number of durations in the histogram.
+func (h LatencyHistogram) Count() int64 {
+	var n int64
+	for _, c := range h {
+		n += c
+	}
+	return n
+}
+
+// Quantile returns the upper bound of the bucket holding the q-quantile
+// of the durations (e.g. 0.99 for the 99th percentile), or zero if the
+// histogram is empty.
+func (h LatencyHistogram) Quantile(q float64) time.Duration {
+	buckets := make([]int, 0, len(h))
+	for i := range h {
+		buckets = append(buckets, i)
+	}
+	sort.Ints(buckets)
+	rank := int64(math.Ceil(q * float64(h.Count())))
+	var n int64
+	for _, i := range buckets {
+		n += h[i]
+		if n >= rank {
+			return latencyBucketBound(i)
+		}
+	}
+	return 0
+}
+
+// Latencies holds the histograms of the durations the tasks of a type
+// in a queue waited in the queue and took to process.
+type Latencies struct {
+	Queue string
+	Type  string
+	Wait  LatencyHistogram
+	Run   LatencyHistogram
+}
+
+// Latencies returns the latency histograms of the tasks processed in the
+// last window of time, with a resolution of a minute, sorted by queue and type.
+// The window is capped at LatencyRetention.
+func (r *RDB) Latencies(window time.Duration) ([]*Latencies, error) {
+	if window > LatencyRetention {
+		window = LatencyRetention
+	}
+	now := time.Now()
+	var cmds []*redis.StringStringMapCmd
+	_, err := r.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for t := now; now.Sub(t) < window; t = t.Add(-time.Minute) {
+			cmds = append(cmds, pipe.HGetAll(r.keys.LatencyKey(t)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*Latencies)
+	for _, cmd := range cmds {
+		for field, val := range cmd.Val() {
+			parseLatencyField(byName, field, val)
+		}
+	}
+	res := make([]*Latencies, 0, len(byName))
+	for _, l := range byName {
+		res = append(res, l)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Queue != res[j].Queue {
+			return res[i].Queue < res[j].Queue
+		}
+		return res[i].Type < res[j].Type
+	})
+	return res, nil
+}
+
+// parseLatencyField adds the count of a field of the latency hash written
+// by AddLatencies to the histograms of its queue and type.
+//
+// Types may contain colons, but queue names don't.
+func parseLatencyField(byName map[string]*Latencies, field, val string) {
+	parts := strings.SplitN(field, ":", 4)
+	if len(parts) != 4 {
+		return // bad data, ignore
+	}
+	bucket, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return // bad data, ignore
+	}
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return // bad data, ignore
+	}
+	qname, typename := parts[2], parts[3]
+	l, ok := byName[qname+":"+typename]
+	if !ok {
+		l = &Latencies{
+			Queue: qname,
+			Type:  typename,
+			Wait:  make(LatencyHistogram),
+			Run:   make(LatencyHistogram),
+		}
+		byName[qname+":"+typename] = l
+	}
+	switch parts[0] {
+	case "wait":
+		l.Wait[bucket] += n
+	case "run":
+		l.Run[bucket] += n
+	}
+}
+
+// Result returns the pointer to the result of the task with the given id.
+//
+// If no result was stored or the result has expired, it returns ErrResultNotFound.
+func (r *RDB) Result(id string) (*base.TaskResult, error) {
+	data, err := r.client.Get(r.keys.ResultKey(id)).Result()
+	if err == redis.Nil {
+		return nil, ErrResultNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var res base.TaskResult
+	if err := json.Unmarshal([]byte(data), &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Progress returns the last progress reported for the task with the given id.
+//
+// If no progress was reported or the progress has expired, it returns ErrProgressNotFound.
+func (r *RDB) Progress(id string) (*base.TaskProgress, error) {
+	data, err := r.client.Get(r.keys.ProgressKey(id)).Result()
+	if err == redis.Nil {
+		return nil, ErrProgressNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p base.TaskProgress
+	if err := json.Unmarshal([]byte(data), &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// CanaryStatus is the state of the canary task.
+type CanaryStatus struct {
+	// Time the canary was last enqueued and completed.
+	Enqueued  time.Time
+	Completed time.Time
+
+	// MaxAge is how long after its completion the canary is considered stale.
+	MaxAge time.Duration
+}
+
+// Canary returns the state of the canary task, or nil if it has never
+// been enqueued.
+func (r *RDB) Canary() (*CanaryStatus, error) {
+	data, err := r.client.HGetAll(r.keys.Canary).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	unix := func(field string) time.Time {
+		n, err := strconv.ParseInt(data[field], 10, 64)
+		if err != nil || n == 0 {
+			return time.Time{}
+		}
+		return time.Unix(n, 0)
+	}
+	maxAge, _ := strconv.ParseInt(data["max_age"], 10, 64)
+	return &CanaryStatus{
+		Enqueued:  unix("enqueued"),
+		Completed: unix("completed"),
+		MaxAge:    time.Duration(maxAge) * time.Second,
+	}, nil
+}
+
+// parseCosts parses the fields of the costs hash written by AddCosts.
+//
+// Types and values may contain colons, but dimensions and resource names don't.
+func parseCosts(data map[string]string, t time.Time) *DailyCosts {
+	c := &DailyCosts{
+		ByType:      make(map[string]map[string]float64),
+		ByDimension: make(map[string]map[string]map[string]float64),
+		Time:        t,
+	}
+	for field, val := range data {
+		amount, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			continue // bad data, ignore and continue
+		}
+		i := strings.LastIndex(field, ":")
+		if i < 0 {
+			continue // bad data, ignore and continue
+		}
+		rest, resource := field[:i], field[i+1:]
+		switch {
+		case strings.HasPrefix(rest, "type:"):
+			typename := strings.TrimPrefix(rest, "type:")
+			if c.ByType[typename] == nil {
+				c.ByType[typename] = make(map[string]float64)
+			}
+			c.ByType[typename][resource] = amount
+		case strings.HasPrefix(rest, "dimension:"):
+			rest = strings.TrimPrefix(rest, "dimension:")
+			j := strings.Index(rest, ":")
+			if j < 0 {
+				continue // bad data, ignore and continue
+			}
+			dim, value := rest[:j], rest[j+1:]
+			if c.ByDimension[dim] == nil {
+				c.ByDimension[dim] = make(map[string]map[string]float64)
+			}
+			if c.ByDimension[dim][value] == nil {
+				c.ByDimension[dim][value] = make(map[string]float64)
+			}
+			c.ByDimension[dim][value][resource] = amount
+		}
+	}
+	return c
+}
+
 // RedisInfo returns a map of redis info.
 func (r *RDB) RedisInfo() (map[string]string, error) {
 	res, err := r.client.Info().Result()
@@ -261,8 +593,8 @@ func (p Pagination) stop() int64 {
 
 // ListEnqueued returns enqueued tasks that are ready to be processed.
 func (r *RDB) ListEnqueued(qname string, pgn Pagination) ([]*EnqueuedTask, error) {
-	qkey := base.QueueKey(qname)
-	if !r.client.SIsMember(base.AllQueues, qkey).Val() {
+	qkey := r.keys.QueueKey(qname)
+	if !r.client.SIsMember(r.keys.AllQueues, qkey).Val() {
 		return nil, fmt.Errorf("queue %q does not exist", qname)
 	}
 	// Note: Because we use LPUSH to redis list, we need to calculate the
@@ -276,8 +608,7 @@ func (r *RDB) ListEnqueued(qname string, pgn Pagination) ([]*EnqueuedTask, error
 	reverse(data)
 	var tasks []*EnqueuedTask
 	for _, s := range data {
-		var msg base.TaskMessage
-		err := json.Unmarshal([]byte(s), &msg)
+		msg, err := base.DecodeMessage([]byte(s))
 		if err != nil {
 			continue // bad data, ignore and continue
 		}
@@ -297,15 +628,14 @@ func (r *RDB) ListInProgress(pgn Pagination) ([]*InProgressTask, error) {
 	// correct range and reverse the list to get the tasks with pagination.
 	stop := -pgn.start() - 1
 	start := -pgn.stop() - 1
-	data, err := r.client.LRange(base.InProgressQueue, start, stop).Result()
+	data, err := r.client.LRange(r.keys.InProgressQueue, start, stop).Result()
 	if err != nil {
 		return nil, err
 	}
 	reverse(data)
 	var tasks []*InProgressTask
 	for _, s := range data {
-		var msg base.TaskMessage
-		err := json.Unmarshal([]byte(s), &msg)
+		msg, err := base.DecodeMessage([]byte(s))
 		if err != nil {
 			continue // bad data, ignore and continue
 		}
@@ -321,7 +651,7 @@ func (r *RDB) ListInProgress(pgn Pagination) ([]*InProgressTask, error) {
 // ListScheduled returns all tasks that are scheduled to be processed
 // in the future.
 func (r *RDB) ListScheduled(pgn Pagination) ([]*ScheduledTask, error) {
-	data, err := r.client.ZRangeWithScores(base.ScheduledQueue, pgn.start(), pgn.stop()).Result()
+	data, err := r.client.ZRangeWithScores(r.keys.ScheduledQueue, pgn.start(), pgn.stop()).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -331,8 +661,7 @@ func (r *RDB) ListScheduled(pgn Pagination) ([]*ScheduledTask, error) {
 		if !ok {
 			continue // bad data, ignore and continue
 		}
-		var msg base.TaskMessage
-		err := json.Unmarshal([]byte(s), &msg)
+		msg, err := base.DecodeMessage([]byte(s))
 		if err != nil {
 			continue // bad data, ignore and continue
 		}
@@ -352,7 +681,7 @@ func (r *RDB) ListScheduled(pgn Pagination) ([]*ScheduledTask, error) {
 // ListRetry returns all tasks that have failed before and willl be retried
 // in the future.
 func (r *RDB) ListRetry(pgn Pagination) ([]*RetryTask, error) {
-	data, err := r.client.ZRangeWithScores(base.RetryQueue, pgn.start(), pgn.stop()).Result()
+	data, err := r.client.ZRangeWithScores(r.keys.RetryQueue, pgn.start(), pgn.stop()).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -362,22 +691,22 @@ func (r *RDB) ListRetry(pgn Pagination) ([]*RetryTask, error) {
 		if !ok {
 			continue // bad data, ignore and continue
 		}
-		var msg base.TaskMessage
-		err := json.Unmarshal([]byte(s), &msg)
+		msg, err := base.DecodeMessage([]byte(s))
 		if err != nil {
 			continue // bad data, ignore and continue
 		}
 		processAt := time.Unix(int64(z.Score), 0)
 		tasks = append(tasks, &RetryTask{
-			ID:        msg.ID,
-			Type:      msg.Type,
-			Payload:   msg.Payload,
-			ErrorMsg:  msg.ErrorMsg,
-			Retry:     msg.Retry,
-			Retried:   msg.Retried,
-			Queue:     msg.Queue,
-			ProcessAt: processAt,
-			Score:     int64(z.Score),
+			ID:           msg.ID,
+			Type:         msg.Type,
+			Payload:      msg.Payload,
+			ErrorMsg:     msg.ErrorMsg,
+			ErrorHistory: msg.ErrorHistory,
+			Retry:        msg.Retry,
+			Retried:      msg.Retried,
+			Queue:        msg.Queue,
+			ProcessAt:    processAt,
+			Score:        int64(z.Score),
 		})
 	}
 	return tasks, nil
@@ -385,7 +714,7 @@ func (r *RDB) ListRetry(pgn Pagination) ([]*RetryTask, error) {
 
 // ListDead returns all tasks that have exhausted its retry limit.
 func (r *RDB) ListDead(pgn Pagination) ([]*DeadTask, error) {
-	data, err := r.client.ZRangeWithScores(base.DeadQueue, pgn.start(), pgn.stop()).Result()
+	data, err := r.client.ZRangeWithScores(r.keys.DeadQueue, pgn.start(), pgn.stop()).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -395,8 +724,7 @@ func (r *RDB) ListDead(pgn Pagination) ([]*DeadTask, error) {
 		if !ok {
 			continue // bad data, ignore and continue
 		}
-		var msg base.TaskMessage
-		err := json.Unmarshal([]byte(s), &msg)
+		msg, err := base.DecodeMessage([]byte(s))
 		if err != nil {
 			continue // bad data, ignore and continue
 		}
@@ -406,6 +734,7 @@ func (r *RDB) ListDead(pgn Pagination) ([]*DeadTask, error) {
 			Type:         msg.Type,
 			Payload:      msg.Payload,
 			ErrorMsg:     msg.ErrorMsg,
+			ErrorHistory: msg.ErrorHistory,
 			Queue:        msg.Queue,
 			LastFailedAt: lastFailedAt,
 			Score:        int64(z.Score),
@@ -414,11 +743,117 @@ func (r *RDB) ListDead(pgn Pagination) ([]*DeadTask, error) {
 	return tasks, nil
 }
 
+// ListMessages returns the task messages in the given state along with
+// their scores. qname is used only to list the enqueued tasks.
+func (r *RDB) ListMessages(state, qname string, pgn Pagination) ([]*CorrelatedTask, error) {
+	var list string
+	switch state {
+	case "enqueued":
+		list = r.keys.QueueKey(qname)
+		if !r.client.SIsMember(r.keys.AllQueues, list).Val() {
+			return nil, fmt.Errorf("queue %q does not exist", qname)
+		}
+	case "inprogress":
+		list = r.keys.InProgressQueue
+	}
+	if list != "" {
+		// Note: Because we use LPUSH to redis list, we need to calculate the
+		// correct range and reverse the list to get the tasks with pagination.
+		data, err := r.client.LRange(list, -pgn.stop()-1, -pgn.start()-1).Result()
+		if err != nil {
+			return nil, err
+		}
+		reverse(data)
+		var tasks []*CorrelatedTask
+		for _, s := range data {
+			msg, err := base.DecodeMessage([]byte(s))
+			if err != nil {
+				continue // bad data, ignore and continue
+			}
+			tasks = append(tasks, &CorrelatedTask{Msg: msg, State: state})
+		}
+		return tasks, nil
+	}
+
+	var zset string
+	switch state {
+	case "scheduled":
+		zset = r.keys.ScheduledQueue
+	case "retry":
+		zset = r.keys.RetryQueue
+	case "dead":
+		zset = r.keys.DeadQueue
+	case "completed":
+		zset = r.keys.CompletedQueue
+	default:
+		return nil, fmt.Errorf("unknown task state %q", state)
+	}
+	data, err := r.client.ZRangeWithScores(zset, pgn.start(), pgn.stop()).Result()
+	if err != nil {
+		return nil, err
+	}
+	var tasks []*CorrelatedTask
+	for _, z := range data {
+		s, ok := z.Member.(string)
+		if !ok {
+			continue // bad data, ignore and continue
+		}
+		msg, err := base.DecodeMessage([]byte(s))
+		if err != nil {
+			continue // bad data, ignore and continue
+		}
+		tasks = append(tasks, &CorrelatedTask{Msg: msg, State: state, Score: int64(z.Score)})
+	}
+	return tasks, nil
+}
+
+// ListEnqueuedInQueues returns a page of the tasks enqueued in the queues,
+// listed as if the tasks of the queues were in a single queue, the tasks
+// of each queue following the tasks of the queues before it.
+func (r *RDB) ListEnqueuedInQueues(qnames []string, pgn Pagination) ([]*CorrelatedTask, error) {
+	start, stop := pgn.start(), pgn.stop()
+	var tasks []*CorrelatedTask
+	for _, qname := range qnames {
+		qkey := r.keys.QueueKey(qname)
+		n, err := r.client.LLen(qkey).Result()
+		if err != nil {
+			return nil, err
+		}
+		if start >= n {
+			start, stop = start-n, stop-n
+			continue
+		}
+		last := stop
+		if last >= n {
+			last = n - 1
+		}
+		// Note: Because we use LPUSH to redis list, we need to calculate the
+		// correct range and reverse the list to get the tasks with pagination.
+		data, err := r.client.LRange(qkey, -last-1, -start-1).Result()
+		if err != nil {
+			return nil, err
+		}
+		reverse(data)
+		for _, s := range data {
+			msg, err := base.DecodeMessage([]byte(s))
+			if err != nil {
+				continue // bad data, ignore and continue
+			}
+			tasks = append(tasks, &CorrelatedTask{Msg: msg, State: "enqueued"})
+		}
+		if stop < n {
+			break
+		}
+		start, stop = 0, stop-n
+	}
+	return tasks, nil
+}
+
 // EnqueueDeadTask finds a task that matches the given id and score from dead queue
 // and enqueues it for processing. If a task that matches the id and score
 // does not exist, it returns ErrTaskNotFound.
 func (r *RDB) EnqueueDeadTask(id xid.ID, score int64) error {
-	n, err := r.removeAndEnqueue(base.DeadQueue, id.String(), float64(score))
+	n, err := r.removeAndEnqueue(r.keys.DeadQueue, id.String(), float64(score))
 	if err != nil {
 		return err
 	}
@@ -432,7 +867,7 @@ func (r *RDB) EnqueueDeadTask(id xid.ID, score int64) error {
 // and enqueues it for processing. If a task that matches the id and score
 // does not exist, it returns ErrTaskNotFound.
 func (r *RDB) EnqueueRetryTask(id xid.ID, score int64) error {
-	n, err := r.removeAndEnqueue(base.RetryQueue, id.String(), float64(score))
+	n, err := r.removeAndEnqueue(r.keys.RetryQueue, id.String(), float64(score))
 	if err != nil {
 		return err
 	}
@@ -446,7 +881,7 @@ func (r *RDB) EnqueueRetryTask(id xid.ID, score int64) error {
 // and enqueues it for processing. If a task that matches the id and score does not
 // exist, it returns ErrTaskNotFound.
 func (r *RDB) EnqueueScheduledTask(id xid.ID, score int64) error {
-	n, err := r.removeAndEnqueue(base.ScheduledQueue, id.String(), float64(score))
+	n, err := r.removeAndEnqueue(r.keys.ScheduledQueue, id.String(), float64(score))
 	if err != nil {
 		return err
 	}
@@ -459,36 +894,48 @@ func (r *RDB) EnqueueScheduledTask(id xid.ID, score int64) error {
 // EnqueueAllScheduledTasks enqueues all tasks from scheduled queue
 // and returns the number of tasks enqueued.
 func (r *RDB) EnqueueAllScheduledTasks() (int64, error) {
-	return r.removeAndEnqueueAll(base.ScheduledQueue)
+	return r.removeAndEnqueueAll(r.keys.ScheduledQueue)
 }
 
 // EnqueueAllRetryTasks enqueues all tasks from retry queue
 // and returns the number of tasks enqueued.
 func (r *RDB) EnqueueAllRetryTasks() (int64, error) {
-	return r.removeAndEnqueueAll(base.RetryQueue)
+	return r.removeAndEnqueueAll(r.keys.RetryQueue)
 }
 
 // EnqueueAllDeadTasks enqueues all tasks from dead queue
 // and returns the number of tasks enqueued.
 func (r *RDB) EnqueueAllDeadTasks() (int64, error) {
-	return r.removeAndEnqueueAll(base.DeadQueue)
+	return r.removeAndEnqueueAll(r.keys.DeadQueue)
 }
 
-var removeAndEnqueueCmd = redis.NewScript(`
+// KEYS[1] -> zset to remove the task from
+// KEYS[2] -> {asynq}:rollups
+// ARGV[1] -> score of the task
+// ARGV[2] -> task ID
+// ARGV[3] -> queue prefix
+// ARGV[4] -> wake channel to publish the queue name to, or empty string
+// ARGV[5] -> state of the tasks in KEYS[1] (e.g. "retry")
+var removeAndEnqueueCmd = redis.NewScript(rollupsLua + `
 local msgs = redis.call("ZRANGEBYSCORE", KEYS[1], ARGV[1], ARGV[1])
 for _, msg in ipairs(msgs) do
-	local decoded = cjson.decode(msg)
+	local decoded = decodeMessage(msg)
 	if decoded["ID"] == ARGV[2] then
 		local qkey = ARGV[3] .. decoded["Queue"]
 		redis.call("LPUSH", qkey, msg)
 		redis.call("ZREM", KEYS[1], msg)
+		moveRollups(KEYS[2], msg, ARGV[5], "enqueued")
+		if ARGV[4] ~= "" then
+			redis.call("PUBLISH", ARGV[4], decoded["Queue"])
+		end
 		return 1
 	end
 end
 return 0`)
 
 func (r *RDB) removeAndEnqueue(zset, id string, score float64) (int64, error) {
-	res, err := removeAndEnqueueCmd.Run(r.client, []string{zset}, score, id, base.QueuePrefix).Result()
+	res, err := removeAndEnqueueCmd.Run(r.client, []string{zset, r.keys.Rollups},
+		score, id, r.keys.QueuePrefix, r.wakeChannel(), r.zsetState(zset)).Result()
 	if err != nil {
 		return 0, err
 	}
@@ -499,18 +946,32 @@ func (r *RDB) removeAndEnqueue(zset, id string, score float64) (int64, error) {
 	return n, nil
 }
 
-var removeAndEnqueueAllCmd = redis.NewScript(`
+// KEYS[1] -> zset to remove the tasks from
+// KEYS[2] -> {asynq}:rollups
+// ARGV[1] -> queue prefix
+// ARGV[2] -> wake channel to publish the queue names to, or empty string
+// ARGV[3] -> state of the tasks in KEYS[1] (e.g. "retry")
+var removeAndEnqueueAllCmd = redis.NewScript(rollupsLua + `
 local msgs = redis.call("ZRANGE", KEYS[1], 0, -1)
+local qnames = {}
 for _, msg in ipairs(msgs) do
-	local decoded = cjson.decode(msg)
+	local decoded = decodeMessage(msg)
 	local qkey = ARGV[1] .. decoded["Queue"]
 	redis.call("LPUSH", qkey, msg)
 	redis.call("ZREM", KEYS[1], msg)
+	moveRollups(KEYS[2], msg, ARGV[3], "enqueued")
+	qnames[decoded["Queue"]] = true
+end
+if ARGV[2] ~= "" then
+	for qname in pairs(qnames) do
+		redis.call("PUBLISH", ARGV[2], qname)
+	end
 end
 return table.getn(msgs)`)
 
 func (r *RDB) removeAndEnqueueAll(zset string) (int64, error) {
-	res, err := removeAndEnqueueAllCmd.Run(r.client, []string{zset}, base.QueuePrefix).Result()
+	res, err := removeAndEnqueueAllCmd.Run(r.client, []string{zset, r.keys.Rollups},
+		r.keys.QueuePrefix, r.wakeChannel(), r.zsetState(zset)).Result()
 	if err != nil {
 		return 0, err
 	}
@@ -525,7 +986,7 @@ func (r *RDB) removeAndEnqueueAll(zset string) (int64, error) {
 // and moves it to dead queue. If a task that maches the id and score does not exist,
 // it returns ErrTaskNotFound.
 func (r *RDB) KillRetryTask(id xid.ID, score int64) error {
-	n, err := r.removeAndKill(base.RetryQueue, id.String(), float64(score))
+	n, err := r.removeAndKill(r.keys.RetryQueue, id.String(), float64(score))
 	if err != nil {
 		return err
 	}
@@ -539,7 +1000,7 @@ func (r *RDB) KillRetryTask(id xid.ID, score int64) error {
 // and moves it to dead queue. If a task that maches the id and score does not exist,
 // it returns ErrTaskNotFound.
 func (r *RDB) KillScheduledTask(id xid.ID, score int64) error {
-	n, err := r.removeAndKill(base.ScheduledQueue, id.String(), float64(score))
+	n, err := r.removeAndKill(r.keys.ScheduledQueue, id.String(), float64(score))
 	if err != nil {
 		return err
 	}
@@ -552,42 +1013,72 @@ func (r *RDB) KillScheduledTask(id xid.ID, score int64) error {
 // KillAllRetryTasks moves all tasks from retry queue to dead queue and
 // returns the number of tasks that were moved.
 func (r *RDB) KillAllRetryTasks() (int64, error) {
-	return r.removeAndKillAll(base.RetryQueue)
+	return r.removeAndKillAll(r.keys.RetryQueue)
 }
 
 // KillAllScheduledTasks moves all tasks from scheduled queue to dead queue and
 // returns the number of tasks that were moved.
 func (r *RDB) KillAllScheduledTasks() (int64, error) {
-	return r.removeAndKillAll(base.ScheduledQueue)
+	return r.removeAndKillAll(r.keys.ScheduledQueue)
 }
 
 // KEYS[1] -> ZSET to move task from (e.g., retry queue)
-// KEYS[2] -> asynq:dead
+// KEYS[2] -> {asynq}:dead
+// KEYS[3] -> {asynq}:rollups
 // ARGV[1] -> score of the task to kill
 // ARGV[2] -> id of the task to kill
 // ARGV[3] -> current timestamp
 // ARGV[4] -> cutoff timestamp (e.g., 90 days ago)
 // ARGV[5] -> max number of tasks in dead queue (e.g., 100)
-var removeAndKillCmd = redis.NewScript(`
+// ARGV[6] -> state of the tasks in KEYS[1] (e.g. "retry")
+// KEYS[4] -> {asynq}:workflows:<workflow id> (only for workflow steps)
+// ARGV[7] -> step name (only for workflow steps)
+// ARGV[8] -> workflow retention in seconds (only for workflow steps)
+var removeAndKillCmd = redis.NewScript(failWorkflowStepLua + rollupsLua + `
 local msgs = redis.call("ZRANGEBYSCORE", KEYS[1], ARGV[1], ARGV[1])
 for _, msg in ipairs(msgs) do
-	local decoded = cjson.decode(msg)
+	local decoded = decodeMessage(msg)
 	if decoded["ID"] == ARGV[2] then
 		redis.call("ZREM", KEYS[1], msg)
 		redis.call("ZADD", KEYS[2], ARGV[3], msg)
 		redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", ARGV[4])
-		redis.call("ZREMRANGEBYRANK", KEYS[2], 0, -ARGV[5])
+		redis.call("ZREMRANGEBYRANK", KEYS[2], 0, -tonumber(ARGV[5]) - 1)
+		moveRollups(KEYS[3], msg, ARGV[6], "dead")
+		if KEYS[4] then
+			failWorkflowStep(KEYS[4], ARGV[7], ARGV[8])
+		end
 		return 1
 	end
 end
 return 0`)
 
+// removeAndKill moves the task to the dead queue, failing its step if
+// the task is a step of a workflow.
+//
+// The workflow of the task isn't readable by the script, so the task is
+// read first; the script moves the task only if it's still in zset.
 func (r *RDB) removeAndKill(zset, id string, score float64) (int64, error) {
 	now := time.Now()
-	limit := now.AddDate(0, 0, -deadExpirationInDays).Unix() // 90 days ago
-	res, err := removeAndKillCmd.Run(r.client,
-		[]string{zset, base.DeadQueue},
-		score, id, now.Unix(), limit, maxDeadTasks).Result()
+	limit, maxSize := r.deadLimits(now)
+	keys := []string{zset, r.keys.DeadQueue, r.keys.Rollups}
+	args := []interface{}{score, id, now.Unix(), limit, maxSize, r.zsetState(zset)}
+	scoreStr := strconv.FormatFloat(score, 'f', -1, 64)
+	data, err := r.client.ZRangeByScore(zset, &redis.ZRangeBy{Min: scoreStr, Max: scoreStr}).Result()
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range data {
+		msg, err := base.DecodeMessage([]byte(s))
+		if err != nil || msg.ID.String() != id {
+			continue
+		}
+		if msg.WorkflowID != "" {
+			keys = append(keys, r.keys.WorkflowKey(msg.WorkflowID))
+			args = append(args, msg.WorkflowStep, int(WorkflowRetention.Seconds()))
+		}
+		break
+	}
+	res, err := removeAndKillCmd.Run(r.client, keys, args...).Result()
 	if err != nil {
 		return 0, err
 	}
@@ -598,26 +1089,66 @@ func (r *RDB) removeAndKill(zset, id string, score float64) (int64, error) {
 	return n, nil
 }
 
-// KEYS[1] -> ZSET to move task from (e.g., retry queue)
-// KEYS[2] -> asynq:dead
+// KEYS[1] -> ZSET to move tasks from (e.g., retry queue)
+// KEYS[2] -> {asynq}:dead
+// KEYS[3] -> {asynq}:rollups
+// KEYS[4:] -> {asynq}:workflows:<workflow id> of the first ARGV[6] tasks
 // ARGV[1] -> current timestamp
 // ARGV[2] -> cutoff timestamp (e.g., 90 days ago)
 // ARGV[3] -> max number of tasks in dead queue (e.g., 100)
-var removeAndKillAllCmd = redis.NewScript(`
-local msgs = redis.call("ZRANGE", KEYS[1], 0, -1)
-for _, msg in ipairs(msgs) do
-	redis.call("ZADD", KEYS[2], ARGV[1], msg)
-	redis.call("ZREM", KEYS[1], msg)
-	redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", ARGV[2])
-	redis.call("ZREMRANGEBYRANK", KEYS[2], 0, -ARGV[3])
+// ARGV[4] -> workflow retention in seconds
+// ARGV[5] -> state of the tasks in KEYS[1] (e.g. "retry")
+// ARGV[6] -> number of the tasks which are workflow steps
+// ARGV[7:7+ARGV[6]] -> step names of the workflow steps
+// ARGV[7+ARGV[6]:] -> tasks to move, the workflow steps first
+//
+// Tasks removed from KEYS[1] after they were read are left alone.
+var removeAndKillAllCmd = redis.NewScript(failWorkflowStepLua + rollupsLua + `
+local steps = tonumber(ARGV[6])
+local first = 7 + steps
+local n = 0
+for i = first, #ARGV do
+	if redis.call("ZREM", KEYS[1], ARGV[i]) == 1 then
+		redis.call("ZADD", KEYS[2], ARGV[1], ARGV[i])
+		moveRollups(KEYS[3], ARGV[i], ARGV[5], "dead")
+		local j = i - first + 1
+		if j <= steps then
+			failWorkflowStep(KEYS[3 + j], ARGV[6 + j], ARGV[4])
+		end
+		n = n + 1
+	end
 end
-return table.getn(msgs)`)
+redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", ARGV[2])
+redis.call("ZREMRANGEBYRANK", KEYS[2], 0, -tonumber(ARGV[3]) - 1)
+return n`)
 
+// removeAndKillAll moves all tasks in zset to the dead queue, failing the
+// steps of the tasks which are steps of workflows.
 func (r *RDB) removeAndKillAll(zset string) (int64, error) {
 	now := time.Now()
-	limit := now.AddDate(0, 0, -deadExpirationInDays).Unix() // 90 days ago
-	res, err := removeAndKillAllCmd.Run(r.client, []string{zset, base.DeadQueue},
-		now.Unix(), limit, maxDeadTasks).Result()
+	limit, maxSize := r.deadLimits(now)
+	data, err := r.client.ZRange(zset, 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+	keys := []string{zset, r.keys.DeadQueue, r.keys.Rollups}
+	var steps, stepMsgs, msgs []interface{}
+	for _, s := range data {
+		msg, err := base.DecodeMessage([]byte(s))
+		if err != nil || msg.WorkflowID == "" {
+			msgs = append(msgs, s)
+			continue
+		}
+		keys = append(keys, r.keys.WorkflowKey(msg.WorkflowID))
+		steps = append(steps, msg.WorkflowStep)
+		stepMsgs = append(stepMsgs, s)
+	}
+	// The workflow steps come first, in the order of their keys.
+	args := []interface{}{now.Unix(), limit, maxSize, int(WorkflowRetention.Seconds()), r.zsetState(zset), len(steps)}
+	args = append(args, steps...)
+	args = append(args, stepMsgs...)
+	args = append(args, msgs...)
+	res, err := removeAndKillAllCmd.Run(r.client, keys, args...).Result()
 	if err != nil {
 		return 0, err
 	}
@@ -632,36 +1163,49 @@ func (r *RDB) removeAndKillAll(zset string) (int64, error) {
 // and deletes it. If a task that matches the id and score does not exist,
 // it returns ErrTaskNotFound.
 func (r *RDB) DeleteDeadTask(id xid.ID, score int64) error {
-	return r.deleteTask(base.DeadQueue, id.String(), float64(score))
+	return r.deleteTask(r.keys.DeadQueue, id.String(), float64(score))
+}
+
+// DeleteCompletedTask finds a task that matches the given id and score from
+// completed queue and deletes it. If a task that matches the id and score
+// does not exist, it returns ErrTaskNotFound.
+func (r *RDB) DeleteCompletedTask(id xid.ID, score int64) error {
+	return r.deleteTask(r.keys.CompletedQueue, id.String(), float64(score))
 }
 
 // DeleteRetryTask finds a task that matches the given id and score from retry queue
 // and deletes it. If a task that matches the id and score does not exist,
 // it returns ErrTaskNotFound.
 func (r *RDB) DeleteRetryTask(id xid.ID, score int64) error {
-	return r.deleteTask(base.RetryQueue, id.String(), float64(score))
+	return r.deleteTask(r.keys.RetryQueue, id.String(), float64(score))
 }
 
 // DeleteScheduledTask finds a task that matches the given id and score from
 // scheduled queue  and deletes it. If a task that matches the id and score
 //does not exist, it returns ErrTaskNotFound.
 func (r *RDB) DeleteScheduledTask(id xid.ID, score int64) error {
-	return r.deleteTask(base.ScheduledQueue, id.String(), float64(score))
+	return r.deleteTask(r.keys.ScheduledQueue, id.String(), float64(score))
 }
 
-var deleteTaskCmd = redis.NewScript(`
+// KEYS[1] -> zset to delete the task from
+// KEYS[2] -> {asynq}:rollups
+// ARGV[1] -> score of the task
+// ARGV[2] -> task ID
+// ARGV[3] -> state of the tasks in KEYS[1] (e.g. "dead")
+var deleteTaskCmd = redis.NewScript(rollupsLua + `
 local msgs = redis.call("ZRANGEBYSCORE", KEYS[1], ARGV[1], ARGV[1])
 for _, msg in ipairs(msgs) do
-	local decoded = cjson.decode(msg)
+	local decoded = decodeMessage(msg)
 	if decoded["ID"] == ARGV[2] then
 		redis.call("ZREM", KEYS[1], msg)
+		moveRollups(KEYS[2], msg, ARGV[3], "")
 		return 1
 	end
 end
 return 0`)
 
 func (r *RDB) deleteTask(zset, id string, score float64) error {
-	res, err := deleteTaskCmd.Run(r.client, []string{zset}, score, id).Result()
+	res, err := deleteTaskCmd.Run(r.client, []string{zset, r.keys.Rollups}, score, id, r.zsetState(zset)).Result()
 	if err != nil {
 		return err
 	}
@@ -675,19 +1219,335 @@ func (r *RDB) deleteTask(zset, id string, score float64) error {
 	return nil
 }
 
+// NextDelayedTask returns the scheduled or retry task to be processed first,
+// and the time it's due. If there are no such tasks, it returns
+// ErrTaskNotFound.
+//
+// A set whose first task cannot be decoded is skipped.
+func (r *RDB) NextDelayedTask() (*base.TaskMessage, time.Time, error) {
+	var next *base.TaskMessage
+	var dueAt time.Time
+	for _, zset := range []string{r.keys.ScheduledQueue, r.keys.RetryQueue} {
+		data, err := r.client.ZRangeWithScores(zset, 0, 0).Result()
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if len(data) == 0 {
+			continue
+		}
+		s, ok := data[0].Member.(string)
+		if !ok {
+			continue
+		}
+		msg, err := base.DecodeMessage([]byte(s))
+		if err != nil {
+			continue // bad data, ignore and continue
+		}
+		if t := time.Unix(int64(data[0].Score), 0); next == nil || t.Before(dueAt) {
+			next, dueAt = msg, t
+		}
+	}
+	if next == nil {
+		return nil, time.Time{}, ErrTaskNotFound
+	}
+	return next, dueAt, nil
+}
+
+// FindZSetTask finds a task that matches the given id from the given zset
+// among the members with score between min and max (inclusive), and returns
+// the task message along with its score. If a task that matches the id does
+// not exist, it returns ErrTaskNotFound.
+func (r *RDB) FindZSetTask(zset string, id xid.ID, min, max int64) (*base.TaskMessage, int64, error) {
+	res, err := r.client.ZRangeByScoreWithScores(zset, &redis.ZRangeBy{
+		Min: strconv.FormatInt(min, 10),
+		Max: strconv.FormatInt(max, 10),
+	}).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, z := range res {
+		s, ok := z.Member.(string)
+		if !ok {
+			continue
+		}
+		msg, err := base.DecodeMessage([]byte(s))
+		if err != nil {
+			continue // bad data, ignore and continue
+		}
+		if msg.ID == id {
+			return msg, int64(z.Score), nil
+		}
+	}
+	return nil, 0, ErrTaskNotFound
+}
+
+// FindListTask finds a task that matches the given id from the given list
+// (e.g. a queue or in-progress list) and returns the task message.
+// If a task that matches the id does not exist, it returns ErrTaskNotFound.
+func (r *RDB) FindListTask(key string, id xid.ID) (*base.TaskMessage, error) {
+	data, err := r.client.LRange(key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range data {
+		msg, err := base.DecodeMessage([]byte(s))
+		if err != nil {
+			continue // bad data, ignore and continue
+		}
+		if msg.ID == id {
+			return msg, nil
+		}
+	}
+	return nil, ErrTaskNotFound
+}
+
+// CorrelatedTask is a task message along with its state.
+type CorrelatedTask struct {
+	Msg *base.TaskMessage
+
+	// State of the task: one of "enqueued", "inprogress",
+	// "scheduled", "retry", or "dead".
+	State string
+
+	// Score of the task if the task is in scheduled, retry, or dead state.
+	Score int64
+}
+
+// order of the states in which FindTasksByCorrelationID returns the tasks.
+var correlatedStates = map[string]int{
+	"enqueued":   0,
+	"inprogress": 1,
+	"scheduled":  2,
+	"retry":      3,
+	"dead":       4,
+	"completed":  5,
+}
+
+// FindTasksByCorrelationID returns all tasks that have the given correlation ID
+// across all queues and states, ordered by state and then by ID.
+//
+// The tasks are read from the index of the correlation ID, a hash of the
+// task IDs to their states and messages, which the scripts moving tasks keep
+// up to date (see rollupsLua). The indexed tasks which are no longer in
+// the zset of their state (e.g. trimmed from the dead queue) are left out.
+// RefreshRollups rebuilds the index of the tasks moved or deleted otherwise.
+func (r *RDB) FindTasksByCorrelationID(id string) ([]*CorrelatedTask, error) {
+	entries, err := r.client.HGetAll(r.keys.CorrelationKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		tasks []*CorrelatedTask
+		data  []string
+	)
+	for _, e := range entries {
+		// states don't contain colons.
+		i := strings.Index(e, ":")
+		if i < 0 {
+			continue // bad data, ignore and continue
+		}
+		msg, err := base.DecodeMessage([]byte(e[i+1:]))
+		if err != nil {
+			continue // bad data, ignore and continue
+		}
+		tasks = append(tasks, &CorrelatedTask{Msg: msg, State: e[:i]})
+		data = append(data, e[i+1:])
+	}
+	scores := make([]*redis.FloatCmd, len(tasks))
+	_, err = r.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for j, t := range tasks {
+			if zset := r.stateZSet(t.State); zset != "" {
+				scores[j] = pipe.ZScore(zset, data[j])
+			}
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	var res []*CorrelatedTask
+	for j, t := range tasks {
+		if scores[j] != nil {
+			score, err := scores[j].Result()
+			if err == redis.Nil {
+				continue // no longer in the zset
+			}
+			if err != nil {
+				return nil, err
+			}
+			t.Score = int64(score)
+		}
+		res = append(res, t)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if si, sj := correlatedStates[res[i].State], correlatedStates[res[j].State]; si != sj {
+			return si < sj
+		}
+		return res[i].Msg.ID.String() < res[j].Msg.ID.String()
+	})
+	return res, nil
+}
+
+// correlationEntry returns the value of a task in the index of its
+// correlation ID.
+func correlationEntry(state, data string) string {
+	return state + ":" + data
+}
+
+// forEachTask calls fn with each task across all queues and states, along
+// with the data of its message. Msg field of the task is set, even though
+// it may not have a correlation ID.
+func (r *RDB) forEachTask(fn func(t *CorrelatedTask, data string)) error {
+	qkeys, err := r.client.SMembers(r.keys.AllQueues).Result()
+	if err != nil {
+		return err
+	}
+	for _, key := range append(qkeys, r.keys.InProgressQueue) {
+		state := "enqueued"
+		if key == r.keys.InProgressQueue {
+			state = "inprogress"
+		}
+		data, err := r.client.LRange(key, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		for _, s := range data {
+			msg, err := base.DecodeMessage([]byte(s))
+			if err != nil {
+				continue // bad data, ignore and continue
+			}
+			fn(&CorrelatedTask{Msg: msg, State: state}, s)
+		}
+	}
+	zsets := []struct {
+		key   string
+		state string
+	}{
+		{r.keys.ScheduledQueue, "scheduled"},
+		{r.keys.RetryQueue, "retry"},
+		{r.keys.DeadQueue, "dead"},
+		{r.keys.CompletedQueue, "completed"},
+	}
+	for _, zset := range zsets {
+		data, err := r.client.ZRangeWithScores(zset.key, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		for _, z := range data {
+			s, ok := z.Member.(string)
+			if !ok {
+				continue
+			}
+			msg, err := base.DecodeMessage([]byte(s))
+			if err != nil {
+				continue // bad data, ignore and continue
+			}
+			fn(&CorrelatedTask{Msg: msg, State: zset.state, Score: int64(z.Score)}, s)
+		}
+	}
+	return nil
+}
+
+// RefreshRollups counts the tasks in each state by the values of their
+// rollup dimensions, and replaces the stored counts with the result.
+// It rebuilds the indexes of the correlation IDs too.
+//
+// Counts are stored in a hash with fields formatted as
+// "<dimension>:<value>:<state>". The scripts which enqueue, forward,
+// dequeue, finish, retry and kill tasks, and the scripts of the Inspector
+// moving or deleting a task, update the counts and the indexes (see
+// rollupsLua), so RefreshRollups only needs to correct them for the tasks
+// moved or deleted otherwise (e.g. trimmed from the dead queue).
+func (r *RDB) RefreshRollups() error {
+	counts := make(map[string]interface{})
+	indexes := make(map[string]map[string]interface{})
+	err := r.forEachTask(func(t *CorrelatedTask, data string) {
+		for dim, val := range t.Msg.Dimensions {
+			field := rollupField(dim, val, t.State)
+			n, _ := counts[field].(int)
+			counts[field] = n + 1
+		}
+		if cid := t.Msg.CorrelationID; cid != "" {
+			if indexes[cid] == nil {
+				indexes[cid] = make(map[string]interface{})
+			}
+			indexes[cid][t.Msg.ID.String()] = correlationEntry(t.State, data)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	cids, err := r.client.SMembers(r.keys.Correlations).Result()
+	if err != nil {
+		return err
+	}
+	_, err = r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(r.keys.Rollups)
+		if len(counts) > 0 {
+			pipe.HMSet(r.keys.Rollups, counts)
+		}
+		for _, cid := range cids {
+			pipe.Del(r.keys.CorrelationKey(cid))
+		}
+		pipe.Del(r.keys.Correlations)
+		for cid, entries := range indexes {
+			pipe.HMSet(r.keys.CorrelationKey(cid), entries)
+			pipe.SAdd(r.keys.Correlations, cid)
+		}
+		return nil
+	})
+	return err
+}
+
+// Rollups returns the counts of the tasks in each state by value of
+// the given dimension.
+func (r *RDB) Rollups(dimension string) (map[string]map[string]int, error) {
+	data, err := r.client.HGetAll(r.keys.Rollups).Result()
+	if err != nil {
+		return nil, err
+	}
+	// values may contain colons, but dimensions and states don't.
+	prefix := dimension + ":"
+	res := make(map[string]map[string]int)
+	for field, count := range data {
+		if !strings.HasPrefix(field, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(field, prefix)
+		i := strings.LastIndex(rest, ":")
+		if i < 0 {
+			continue // bad data, ignore and continue
+		}
+		val, state := rest[:i], rest[i+1:]
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			continue // bad data, ignore and continue
+		}
+		if res[val] == nil {
+			res[val] = make(map[string]int)
+		}
+		res[val][state] = n
+	}
+	return res, nil
+}
+
+func rollupField(dimension, value, state string) string {
+	return dimension + ":" + value + ":" + state
+}
+
 // DeleteAllDeadTasks deletes all tasks from the dead queue.
 func (r *RDB) DeleteAllDeadTasks() error {
-	return r.client.Del(base.DeadQueue).Err()
+	return r.client.Del(r.keys.DeadQueue).Err()
 }
 
 // DeleteAllRetryTasks deletes all tasks from the dead queue.
 func (r *RDB) DeleteAllRetryTasks() error {
-	return r.client.Del(base.RetryQueue).Err()
+	return r.client.Del(r.keys.RetryQueue).Err()
 }
 
 // DeleteAllScheduledTasks deletes all tasks from the dead queue.
 func (r *RDB) DeleteAllScheduledTasks() error {
-	return r.client.Del(base.ScheduledQueue).Err()
+	return r.client.Del(r.keys.ScheduledQueue).Err()
 }
 
 // ErrQueueNotFound indicates specified queue does not exist.
@@ -743,7 +1603,7 @@ func (r *RDB) RemoveQueue(qname string, force bool) error {
 		script = removeQueueCmd
 	}
 	err := script.Run(r.client,
-		[]string{base.AllQueues, base.QueueKey(qname)},
+		[]string{r.keys.AllQueues, r.keys.QueueKey(qname)},
 		force).Err()
 	if err != nil {
 		switch err.Error() {
@@ -775,7 +1635,7 @@ return res`)
 // ListProcesses returns the list of process statuses.
 func (r *RDB) ListProcesses() ([]*base.ProcessInfo, error) {
 	res, err := listProcessesCmd.Run(r.client,
-		[]string{base.AllProcesses}, time.Now().UTC().Unix()).Result()
+		[]string{r.keys.AllProcesses}, time.Now().UTC().Unix()).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -5,6 +5,7 @@
 package rdb
 
 import (
+	"encoding/json"
 	"fmt"
 	"sort"
 	"testing"
@@ -124,6 +125,47 @@ func TestCurrentStats(t *testing.T) {
 	}
 }
 
+func TestQueueSize(t *testing.T) {
+	r := setup(t)
+	h.FlushDB(t, r.client)
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("send_email", nil)
+	m3 := h.NewTaskMessageWithQueue("reindex", nil, "low")
+	m4 := h.NewTaskMessage("send_email", nil)
+	m5 := h.NewTaskMessageWithQueue("reindex", nil, "low")
+	m6 := h.NewTaskMessage("send_email", nil)
+	m7 := h.NewTaskMessageWithQueue("reindex", nil, "low")
+	m7.Encoding = base.ProtobufEncoding
+	now := time.Now()
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{m1, m2})
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{m3}, "low")
+	h.SeedScheduledQueue(t, r.client, []h.ZSetEntry{
+		{Msg: m4, Score: float64(now.Add(time.Hour).Unix())},
+		{Msg: m5, Score: float64(now.Add(time.Hour).Unix())},
+	})
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{m6, m7})
+
+	tests := []struct {
+		qname string
+		want  *QueueSize
+	}{
+		{"default", &QueueSize{Pending: 2, Scheduled: 1, InProgress: 1}},
+		{"low", &QueueSize{Pending: 1, Scheduled: 1, InProgress: 1}},
+		{"empty", &QueueSize{}},
+	}
+
+	for _, tc := range tests {
+		got, err := r.QueueSize(tc.qname)
+		if err != nil {
+			t.Errorf("(*RDB).QueueSize(%q) returned error: %v", tc.qname, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got, cmpopts.IgnoreFields(QueueSize{}, "Timestamp")); diff != "" {
+			t.Errorf("(*RDB).QueueSize(%q) = %+v, want %+v; (-want,+got)\n%s", tc.qname, got, tc.want, diff)
+		}
+	}
+}
+
 func TestCurrentStatsWithoutData(t *testing.T) {
 	r := setup(t)
 
@@ -198,6 +240,197 @@ func TestHistoricalStats(t *testing.T) {
 
 }
 
+func TestCosts(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("summarize", nil)
+	t1.Dimensions = map[string]string{"team": "payments"}
+	t2 := h.NewTaskMessage("summarize", nil)
+	t2.Dimensions = map[string]string{"team": "search:web"}
+	t3 := h.NewTaskMessage("send_email", nil)
+
+	h.FlushDB(t, r.client)
+	costs := []struct {
+		msg   *base.TaskMessage
+		costs map[string]float64
+	}{
+		{t1, map[string]float64{"openai_tokens": 1000, "cpu_seconds": 1.5}},
+		{t2, map[string]float64{"openai_tokens": 234}},
+		{t3, map[string]float64{"emails": 1}},
+		{t3, nil},
+	}
+	for _, c := range costs {
+		if err := r.AddCosts(c.msg, c.costs); err != nil {
+			t.Fatalf("(*RDB).AddCosts(%v, %v) returned error: %v", c.msg, c.costs, err)
+		}
+	}
+
+	got, err := r.Costs(2)
+	if err != nil {
+		t.Fatalf("(*RDB).Costs(2) returned error: %v", err)
+	}
+	want := []*DailyCosts{
+		{
+			ByType: map[string]map[string]float64{
+				"summarize":  {"openai_tokens": 1234, "cpu_seconds": 1.5},
+				"send_email": {"emails": 1},
+			},
+			ByDimension: map[string]map[string]map[string]float64{
+				"team": {
+					"payments":   {"openai_tokens": 1000, "cpu_seconds": 1.5},
+					"search:web": {"openai_tokens": 234},
+				},
+			},
+		},
+		{
+			ByType:      map[string]map[string]float64{},
+			ByDimension: map[string]map[string]map[string]float64{},
+		},
+	}
+	ignoreOpt := cmpopts.IgnoreFields(DailyCosts{}, "Time")
+	if diff := cmp.Diff(want, got, ignoreOpt); diff != "" {
+		t.Errorf("(*RDB).Costs(2) = %v, want %v; (-want,+got)\n%s", got, want, diff)
+	}
+	if ttl := r.client.TTL(r.keys.CostsKey(time.Now())).Val(); ttl > statsTTL {
+		t.Errorf("TTL %q = %v, want less than or equal to %v", r.keys.CostsKey(time.Now()), ttl, statsTTL)
+	}
+}
+
+func TestLatencies(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("image:resize", nil)
+	t2.Queue = "low"
+
+	h.FlushDB(t, r.client)
+	latencies := []struct {
+		msg       *base.TaskMessage
+		wait, run time.Duration
+	}{
+		{t1, 10 * time.Millisecond, time.Second},
+		{t1, 20 * time.Millisecond, 2 * time.Second},
+		{t1, -1, 3 * time.Second},
+		{t2, 5 * time.Second, time.Minute},
+	}
+	for _, l := range latencies {
+		if err := r.AddLatencies(l.msg, l.wait, l.run); err != nil {
+			t.Fatalf("(*RDB).AddLatencies(%v, %v, %v) returned error: %v", l.msg, l.wait, l.run, err)
+		}
+	}
+
+	got, err := r.Latencies(time.Hour)
+	if err != nil {
+		t.Fatalf("(*RDB).Latencies(time.Hour) returned error: %v", err)
+	}
+	want := []*Latencies{
+		{
+			Queue: "default",
+			Type:  "send_email",
+			Wait:  LatencyHistogram{latencyBucket(10 * time.Millisecond): 1, latencyBucket(20 * time.Millisecond): 1},
+			Run:   LatencyHistogram{latencyBucket(time.Second): 1, latencyBucket(2 * time.Second): 1, latencyBucket(3 * time.Second): 1},
+		},
+		{
+			Queue: "low",
+			Type:  "image:resize",
+			Wait:  LatencyHistogram{latencyBucket(5 * time.Second): 1},
+			Run:   LatencyHistogram{latencyBucket(time.Minute): 1},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(*RDB).Latencies(time.Hour) = %v, want %v; (-want,+got)\n%s", got, want, diff)
+	}
+	if ttl := r.client.TTL(r.keys.LatencyKey(time.Now())).Val(); ttl > LatencyRetention {
+		t.Errorf("TTL %q = %v, want less than or equal to %v", r.keys.LatencyKey(time.Now()), ttl, LatencyRetention)
+	}
+}
+
+func TestLatencyHistogramQuantile(t *testing.T) {
+	var hist LatencyHistogram = make(map[int]int64)
+	if got := hist.Quantile(0.5); got != 0 {
+		t.Errorf("Quantile(0.5) of empty histogram = %v, want 0", got)
+	}
+	for i := 1; i <= 100; i++ {
+		hist[latencyBucket(time.Duration(i)*time.Millisecond)]++
+	}
+	tests := []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0.5, 50 * time.Millisecond},
+		{0.9, 90 * time.Millisecond},
+		{0.99, 99 * time.Millisecond},
+		{1, 100 * time.Millisecond},
+	}
+	for _, tc := range tests {
+		got := hist.Quantile(tc.q)
+		// the quantile is the upper bound of its bucket.
+		if got < tc.want || float64(got) > 1.19*float64(tc.want) {
+			t.Errorf("Quantile(%v) = %v, want between %v and 19%% more", tc.q, got, tc.want)
+		}
+	}
+	if n := hist.Count(); n != 100 {
+		t.Errorf("Count() = %d, want 100", n)
+	}
+}
+
+func TestResult(t *testing.T) {
+	r := setup(t)
+	h.FlushDB(t, r.client)
+	id := xid.New().String()
+
+	if _, err := r.Result(id); err != ErrResultNotFound {
+		t.Fatalf("(*RDB).Result(%q) returned error %v, want %v", id, err, ErrResultNotFound)
+	}
+
+	res := &base.TaskResult{
+		Location: "s3://results/export_report/" + id,
+		Checksum: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		Size:     1 << 20,
+		Time:     time.Now().UTC().Truncate(time.Second),
+	}
+	if err := r.SetResult(id, res, time.Hour); err != nil {
+		t.Fatalf("(*RDB).SetResult(%q, %v, time.Hour) returned error: %v", id, res, err)
+	}
+	got, err := r.Result(id)
+	if err != nil {
+		t.Fatalf("(*RDB).Result(%q) returned error: %v", id, err)
+	}
+	if diff := cmp.Diff(res, got); diff != "" {
+		t.Errorf("(*RDB).Result(%q) = %v, want %v; (-want,+got)\n%s", id, got, res, diff)
+	}
+	if ttl := r.client.TTL(r.keys.ResultKey(id)).Val(); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("TTL %q = %v, want between 0 and %v", r.keys.ResultKey(id), ttl, time.Hour)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	r := setup(t)
+	h.FlushDB(t, r.client)
+	id := xid.New().String()
+
+	if _, err := r.Progress(id); err != ErrProgressNotFound {
+		t.Fatalf("(*RDB).Progress(%q) returned error %v, want %v", id, err, ErrProgressNotFound)
+	}
+
+	for _, p := range []*base.TaskProgress{
+		{Percent: 10, Time: time.Now().UTC().Truncate(time.Second)},
+		{Percent: 55.5, Data: json.RawMessage(`{"rows":555,"total":1000}`), Time: time.Now().UTC().Truncate(time.Second)},
+	} {
+		if err := r.SetProgress(id, p, time.Hour); err != nil {
+			t.Fatalf("(*RDB).SetProgress(%q, %v, time.Hour) returned error: %v", id, p, err)
+		}
+		got, err := r.Progress(id)
+		if err != nil {
+			t.Fatalf("(*RDB).Progress(%q) returned error: %v", id, err)
+		}
+		if diff := cmp.Diff(p, got); diff != "" {
+			t.Errorf("(*RDB).Progress(%q) = %v, want %v; (-want,+got)\n%s", id, got, p, diff)
+		}
+	}
+	if ttl := r.client.TTL(r.keys.ProgressKey(id)).Val(); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("TTL %q = %v, want between 0 and %v", r.keys.ProgressKey(id), ttl, time.Hour)
+	}
+}
+
 func TestRedisInfo(t *testing.T) {
 	r := setup(t)
 
@@ -362,6 +595,48 @@ func TestListEnqueuedPagination(t *testing.T) {
 	}
 }
 
+func TestListEnqueuedInQueues(t *testing.T) {
+	r := setup(t)
+	for _, q := range []struct {
+		qname string
+		n     int
+	}{{"critical#0", 3}, {"critical#1", 0}, {"critical#2", 4}} {
+		var msgs []*base.TaskMessage
+		for i := 0; i < q.n; i++ {
+			msgs = append(msgs, h.NewTaskMessageWithQueue(fmt.Sprintf("%s %d", q.qname, i), nil, q.qname))
+		}
+		h.SeedEnqueuedQueue(t, r.client, msgs, q.qname)
+	}
+	qnames := []string{"critical#0", "critical#1", "critical#2"}
+
+	tests := []struct {
+		page int
+		size int
+		want []string
+	}{
+		{0, 2, []string{"critical#0 0", "critical#0 1"}},
+		{1, 2, []string{"critical#0 2", "critical#2 0"}},
+		{1, 3, []string{"critical#2 0", "critical#2 1", "critical#2 2"}},
+		{3, 2, []string{"critical#2 3"}},
+		{4, 2, nil},
+	}
+	for _, tc := range tests {
+		got, err := r.ListEnqueuedInQueues(qnames, Pagination{Page: tc.page, Size: tc.size})
+		if err != nil {
+			t.Errorf("r.ListEnqueuedInQueues(page=%d, size=%d) returned error: %v", tc.page, tc.size, err)
+			continue
+		}
+		var types []string
+		for _, task := range got {
+			types = append(types, task.Msg.Type)
+		}
+		if diff := cmp.Diff(tc.want, types); diff != "" {
+			t.Errorf("r.ListEnqueuedInQueues(page=%d, size=%d) = %v, want %v; (-want,+got)\n%s",
+				tc.page, tc.size, types, tc.want, diff)
+		}
+	}
+}
+
 func TestListInProgress(t *testing.T) {
 	r := setup(t)
 
@@ -1014,6 +1289,47 @@ func TestEnqueueRetryTask(t *testing.T) {
 	}
 }
 
+func TestEnqueueZSetTasksPublishWakeups(t *testing.T) {
+	r := setup(t)
+	h.FlushDB(t, r.client)
+	r.SetPublishWakeups(true)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessageWithQueue("export_csv", nil, "low")
+	t3 := h.NewTaskMessageWithQueue("export_csv", nil, "low")
+	s1 := time.Now().Add(time.Hour).Unix()
+	h.SeedScheduledQueue(t, r.client, []h.ZSetEntry{{Msg: t1, Score: float64(s1)}})
+	h.SeedRetryQueue(t, r.client, []h.ZSetEntry{
+		{Msg: t2, Score: float64(s1)},
+		{Msg: t3, Score: float64(s1)},
+	})
+	pubsub, err := r.WakePubSub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pubsub.Close()
+
+	if err := r.EnqueueScheduledTask(t1.ID, s1); err != nil {
+		t.Fatalf("r.EnqueueScheduledTask(%s, %d) returned error: %v", t1.ID, s1, err)
+	}
+	if _, err := r.EnqueueAllRetryTasks(); err != nil {
+		t.Fatalf("r.EnqueueAllRetryTasks() returned error: %v", err)
+	}
+	// one wakeup per queue.
+	var got []string
+	for len(got) < 2 {
+		select {
+		case m := <-pubsub.Channel():
+			got = append(got, m.Payload)
+		case <-time.After(time.Second):
+			t.Fatalf("received wakeups %v, want 2", got)
+		}
+	}
+	want := []string{base.DefaultQueueName, "low"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("received wakeups %v, want %v; (-want,+got)\n%s", got, want, diff)
+	}
+}
+
 func TestEnqueueScheduledTask(t *testing.T) {
 	r := setup(t)
 	t1 := h.NewTaskMessage("send_email", nil)
@@ -1817,6 +2133,120 @@ func TestDeleteScheduledTask(t *testing.T) {
 	}
 }
 
+func TestFindZSetTask(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	t1 := time.Now().Add(-5 * time.Minute)
+	t2 := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		dead      []h.ZSetEntry
+		id        xid.ID
+		min, max  int64
+		wantMsg   *base.TaskMessage
+		wantScore int64
+		wantErr   error
+	}{
+		{
+			dead: []h.ZSetEntry{
+				{Msg: m1, Score: float64(t1.Unix())},
+				{Msg: m2, Score: float64(t2.Unix())},
+			},
+			id:        m1.ID,
+			min:       t1.Unix(),
+			max:       t1.Unix(),
+			wantMsg:   m1,
+			wantScore: t1.Unix(),
+			wantErr:   nil,
+		},
+		{
+			dead: []h.ZSetEntry{
+				{Msg: m1, Score: float64(t1.Unix())},
+				{Msg: m2, Score: float64(t2.Unix())},
+			},
+			id:        m2.ID,
+			min:       t2.Unix() - 10,
+			max:       time.Now().Unix(),
+			wantMsg:   m2,
+			wantScore: t2.Unix(),
+			wantErr:   nil,
+		},
+		{
+			dead: []h.ZSetEntry{
+				{Msg: m1, Score: float64(t1.Unix())},
+				{Msg: m2, Score: float64(t2.Unix())},
+			},
+			id:      m2.ID,
+			min:     t1.Unix(),
+			max:     time.Now().Unix(),
+			wantErr: ErrTaskNotFound,
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client)
+		h.SeedDeadQueue(t, r.client, tc.dead)
+
+		gotMsg, gotScore, err := r.FindZSetTask(base.DeadQueue, tc.id, tc.min, tc.max)
+		if err != tc.wantErr {
+			t.Errorf("(*RDB).FindZSetTask(%q, %v, %d, %d) returned error %v, want %v",
+				base.DeadQueue, tc.id, tc.min, tc.max, err, tc.wantErr)
+			continue
+		}
+		if diff := cmp.Diff(tc.wantMsg, gotMsg); diff != "" {
+			t.Errorf("(*RDB).FindZSetTask(%q, %v, %d, %d) returned message %v, want %v; (-want,+got)\n%s",
+				base.DeadQueue, tc.id, tc.min, tc.max, gotMsg, tc.wantMsg, diff)
+		}
+		if gotScore != tc.wantScore {
+			t.Errorf("(*RDB).FindZSetTask(%q, %v, %d, %d) returned score %d, want %d",
+				base.DeadQueue, tc.id, tc.min, tc.max, gotScore, tc.wantScore)
+		}
+	}
+}
+
+func TestFindListTask(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+
+	tests := []struct {
+		enqueued []*base.TaskMessage
+		id       xid.ID
+		want     *base.TaskMessage
+		wantErr  error
+	}{
+		{
+			enqueued: []*base.TaskMessage{m1, m2},
+			id:       m2.ID,
+			want:     m2,
+			wantErr:  nil,
+		},
+		{
+			enqueued: []*base.TaskMessage{m1},
+			id:       m2.ID,
+			want:     nil,
+			wantErr:  ErrTaskNotFound,
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client)
+		h.SeedEnqueuedQueue(t, r.client, tc.enqueued)
+
+		got, err := r.FindListTask(base.DefaultQueue, tc.id)
+		if err != tc.wantErr {
+			t.Errorf("(*RDB).FindListTask(%q, %v) returned error %v, want %v",
+				base.DefaultQueue, tc.id, err, tc.wantErr)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("(*RDB).FindListTask(%q, %v) = %v, want %v; (-want,+got)\n%s",
+				base.DefaultQueue, tc.id, got, tc.want, diff)
+		}
+	}
+}
+
 func TestDeleteAllDeadTasks(t *testing.T) {
 	r := setup(t)
 	m1 := h.NewTaskMessage("send_email", nil)
@@ -2103,3 +2533,202 @@ func TestListProcesses(t *testing.T) {
 		}
 	}
 }
+
+func TestFindTasksByCorrelationID(t *testing.T) {
+	r := setup(t)
+	for _, enc := range []base.MessageEncoding{base.JSONEncoding, base.ProtobufEncoding} {
+		h.FlushDB(t, r.client)
+		m1 := h.NewTaskMessage("send_email", nil)
+		m1.CorrelationID = "req-1"
+		m2 := h.NewTaskMessage("reindex", nil)
+		m2.CorrelationID = "req-1"
+		m3 := h.NewTaskMessage("generate_csv", nil)
+		m3.CorrelationID = "req-2"
+		m4 := h.NewTaskMessage("sync", nil)
+		m4.CorrelationID = "req-1"
+		for _, m := range []*base.TaskMessage{m1, m2, m3, m4} {
+			m.Encoding = enc
+		}
+		retryAt := time.Now().Add(time.Hour)
+
+		// m2 is postponed to the retry queue, and m4 is left in progress.
+		for _, m := range []*base.TaskMessage{m2, m4} {
+			if err := r.Enqueue(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := r.Dequeue("default"); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Postpone(m2, retryAt); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Dequeue("default"); err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range []*base.TaskMessage{m1, m3} {
+			if err := r.Enqueue(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		got, err := r.FindTasksByCorrelationID("req-1")
+		if err != nil {
+			t.Fatalf("(*RDB).FindTasksByCorrelationID(%q) returned error: %v", "req-1", err)
+		}
+		want := []*CorrelatedTask{
+			{Msg: m1, State: "enqueued"},
+			{Msg: m4, State: "inprogress"},
+			{Msg: m2, State: "retry", Score: retryAt.Unix()},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("encoding %d: (*RDB).FindTasksByCorrelationID(%q) = %v, want %v; (-want,+got)\n%s",
+				enc, "req-1", got, want, diff)
+		}
+
+		// the task killed by the Inspector is indexed as dead, and is
+		// left out once it's deleted with the dead queue.
+		if err := r.KillRetryTask(m2.ID, retryAt.Unix()); err != nil {
+			t.Fatal(err)
+		}
+		got, err = r.FindTasksByCorrelationID("req-1")
+		if err != nil {
+			t.Fatalf("(*RDB).FindTasksByCorrelationID(%q) returned error: %v", "req-1", err)
+		}
+		if len(got) != 3 || got[2].Msg.ID != m2.ID || got[2].State != "dead" {
+			t.Errorf("encoding %d: (*RDB).FindTasksByCorrelationID(%q) = %v, want %v in dead state last",
+				enc, "req-1", got, m2)
+		}
+		if err := r.DeleteAllDeadTasks(); err != nil {
+			t.Fatal(err)
+		}
+		got, err = r.FindTasksByCorrelationID("req-1")
+		if err != nil {
+			t.Fatalf("(*RDB).FindTasksByCorrelationID(%q) returned error: %v", "req-1", err)
+		}
+		if diff := cmp.Diff(want[:2], got); diff != "" {
+			t.Errorf("encoding %d: (*RDB).FindTasksByCorrelationID(%q) = %v, want %v; (-want,+got)\n%s",
+				enc, "req-1", got, want[:2], diff)
+		}
+
+		// finished tasks are removed from the index.
+		if err := r.Done(m4); err != nil {
+			t.Fatal(err)
+		}
+		if n := r.client.HLen(base.DefaultKeys.CorrelationKey("req-1")).Val(); n != 2 {
+			t.Errorf("encoding %d: index of %q has %d tasks, want 2 (the enqueued task and the stale dead task)", enc, "req-1", n)
+		}
+	}
+}
+
+func TestRefreshRollupsIndexesCorrelationIDs(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	m1.CorrelationID = "req-1"
+	m2 := h.NewTaskMessage("reindex", nil)
+	m2.CorrelationID = "req-1"
+	m3 := h.NewTaskMessage("generate_csv", nil)
+	m3.CorrelationID = "req-2"
+	score := time.Now().Add(time.Hour).Unix()
+
+	// the index of req-3 is left by a task deleted without the scripts,
+	// and the tasks seeded without the scripts are not indexed.
+	stale := h.NewTaskMessage("sync", nil)
+	stale.CorrelationID = "req-3"
+	if err := r.Enqueue(stale); err != nil {
+		t.Fatal(err)
+	}
+	r.client.Del(base.DefaultKeys.DefaultQueue)
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{m1, m3})
+	h.SeedRetryQueue(t, r.client, []h.ZSetEntry{{Msg: m2, Score: float64(score)}})
+
+	if err := r.RefreshRollups(); err != nil {
+		t.Fatalf("(*RDB).RefreshRollups() returned error: %v", err)
+	}
+
+	got, err := r.FindTasksByCorrelationID("req-1")
+	if err != nil {
+		t.Fatalf("(*RDB).FindTasksByCorrelationID(%q) returned error: %v", "req-1", err)
+	}
+	want := []*CorrelatedTask{
+		{Msg: m1, State: "enqueued"},
+		{Msg: m2, State: "retry", Score: score},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(*RDB).FindTasksByCorrelationID(%q) = %v, want %v; (-want,+got)\n%s",
+			"req-1", got, want, diff)
+	}
+	got, err = r.FindTasksByCorrelationID("req-3")
+	if err != nil {
+		t.Fatalf("(*RDB).FindTasksByCorrelationID(%q) returned error: %v", "req-3", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("(*RDB).FindTasksByCorrelationID(%q) = %v, want none", "req-3", got)
+	}
+	cids := r.client.SMembers(base.DefaultKeys.Correlations).Val()
+	sort.Strings(cids)
+	if diff := cmp.Diff([]string{"req-1", "req-2"}, cids); diff != "" {
+		t.Errorf("indexed correlation IDs = %v, want %v; (-want,+got)\n%s", cids, []string{"req-1", "req-2"}, diff)
+	}
+}
+
+func TestRollups(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("export", nil)
+	m1.Dimensions = map[string]string{"plan": "pro", "country": "jp"}
+	m2 := h.NewTaskMessage("export", nil)
+	m2.Dimensions = map[string]string{"plan": "pro"}
+	m3 := h.NewTaskMessage("export", nil)
+	m3.Dimensions = map[string]string{"plan": "free:trial"}
+	m4 := h.NewTaskMessage("export", nil)
+	m5 := h.NewTaskMessage("export", nil)
+	m5.Dimensions = map[string]string{"plan": "pro"}
+
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{m1, m2, m4})
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{m3})
+	h.SeedDeadQueue(t, r.client, []h.ZSetEntry{{Msg: m5, Score: float64(time.Now().Unix())}})
+
+	// stale counts should be replaced.
+	if err := r.client.HSet(base.DefaultKeys.Rollups, "plan:enterprise:enqueued", 10).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.RefreshRollups(); err != nil {
+		t.Fatalf("(*RDB).RefreshRollups() returned error: %v", err)
+	}
+
+	tests := []struct {
+		dimension string
+		want      map[string]map[string]int
+	}{
+		{
+			dimension: "plan",
+			want: map[string]map[string]int{
+				"pro":        {"enqueued": 2, "dead": 1},
+				"free:trial": {"inprogress": 1},
+			},
+		},
+		{
+			dimension: "country",
+			want: map[string]map[string]int{
+				"jp": {"enqueued": 1},
+			},
+		},
+		{
+			dimension: "region",
+			want:      map[string]map[string]int{},
+		},
+	}
+
+	for _, tc := range tests {
+		got, err := r.Rollups(tc.dimension)
+		if err != nil {
+			t.Errorf("(*RDB).Rollups(%q) returned error: %v", tc.dimension, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("(*RDB).Rollups(%q) = %v, want %v; (-want,+got)\n%s",
+				tc.dimension, got, tc.want, diff)
+		}
+	}
+}
@@ -0,0 +1,632 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/rs/xid"
+)
+
+// MigrationResult reports the changes made (or to be made) by Migrate.
+type MigrationResult struct {
+	// Keys written before keys had the hash tag, which were renamed
+	// to the current key names.
+	Keys []string
+
+	// Number of task messages rewritten in the current format, keyed by redis key.
+	Messages map[string]int
+
+	// Queue keys which were not registered in the set of all queues.
+	Queues []string
+}
+
+// Migrate detects task messages and key layouts written by older versions
+// of the library and rewrites them in the current format.
+//
+// Specifically, it
+//   - sets Queue to the default queue name if it's missing from a message
+//     (written before v0.2.0).
+//   - sets Timeout to zero duration if it's missing from a message
+//     (written before v0.4.0).
+//   - renames keys written without the "{asynq}" hash tag
+//     (written before Redis Cluster was supported).
+//   - registers any queue keys missing from the set of all queues.
+//
+// If dryRun is true, Migrate only reports the changes without making them.
+func (r *RDB) Migrate(dryRun bool) (*MigrationResult, error) {
+	res := &MigrationResult{Messages: make(map[string]int)}
+
+	keys, err := r.migrateKeys(dryRun)
+	if err != nil {
+		return nil, err
+	}
+	res.Keys = keys
+
+	qkeys, err := r.scan(r.keys.QueuePrefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	for _, qkey := range qkeys {
+		ok, err := r.client.SIsMember(r.keys.AllQueues, qkey).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			continue
+		}
+		res.Queues = append(res.Queues, strings.TrimPrefix(qkey, r.keys.QueuePrefix))
+		if !dryRun {
+			if err := r.client.SAdd(r.keys.AllQueues, qkey).Err(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, key := range append(qkeys, r.keys.InProgressQueue) {
+		n, err := r.migrateList(key, dryRun)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			res.Messages[key] = n
+		}
+	}
+	for _, key := range []string{r.keys.ScheduledQueue, r.keys.RetryQueue, r.keys.DeadQueue} {
+		n, err := r.migrateZSet(key, dryRun)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			res.Messages[key] = n
+		}
+	}
+	return res, nil
+}
+
+// legacyKeyPrefix is the prefix of the keys written before keys had
+// the hash tag, and keyPrefix is the prefix of the current keys.
+const (
+	legacyKeyPrefix = "asynq:"
+	keyPrefix       = "{asynq}:"
+)
+
+// KEYS[1] -> legacy key
+// KEYS[2] -> current key
+//
+// Renames the legacy key to the current key. If the current key
+// already exists (e.g. written by a newer version running alongside),
+// the data of the legacy key is merged into it.
+var mergeKeyCmd = redis.NewScript(`
+local t = redis.call("TYPE", KEYS[1]).ok
+if t == "none" then
+	return 0
+end
+if redis.call("EXISTS", KEYS[2]) == 0 then
+	redis.call("RENAME", KEYS[1], KEYS[2])
+	return 1
+end
+if t == "list" then
+	for _, v in ipairs(redis.call("LRANGE", KEYS[1], 0, -1)) do
+		redis.call("RPUSH", KEYS[2], v)
+	end
+elseif t == "zset" then
+	redis.call("ZUNIONSTORE", KEYS[2], 2, KEYS[2], KEYS[1])
+elseif t == "set" then
+	redis.call("SUNIONSTORE", KEYS[2], KEYS[2], KEYS[1])
+elseif t == "string" then
+	redis.call("INCRBY", KEYS[2], redis.call("GET", KEYS[1]))
+end
+redis.call("DEL", KEYS[1])
+return 1`)
+
+// legacyKeyNames are the names of the legacy keys, and legacyKeyPatterns
+// match the names of the legacy keys with a suffix (e.g. a queue name).
+//
+// They are matched exactly rather than by the legacy prefix, since the keys
+// of the namespaces given by KeyPrefix (e.g. "asynq:{myapp}:queues") have
+// the same prefix.
+var (
+	legacyKeyNames = []string{
+		legacyKeyPrefix + "ps",
+		legacyKeyPrefix + "queues",
+		legacyKeyPrefix + "scheduled",
+		legacyKeyPrefix + "retry",
+		legacyKeyPrefix + "dead",
+		legacyKeyPrefix + "in_progress",
+	}
+	legacyKeyPatterns = []string{
+		legacyKeyPrefix + "ps:*",
+		legacyKeyPrefix + "processed:*",
+		legacyKeyPrefix + "failure:*",
+		legacyKeyPrefix + "queues:*",
+	}
+)
+
+// legacyKeys returns the sorted names of the legacy keys which exist.
+func (r *RDB) legacyKeys() ([]string, error) {
+	var keys []string
+	for _, key := range legacyKeyNames {
+		n, err := r.client.Exists(key).Result()
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			keys = append(keys, key)
+		}
+	}
+	for _, pattern := range legacyKeyPatterns {
+		ks, err := r.scan(pattern)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, ks...)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// migrateKeys renames the legacy keys to the current key names,
+// and returns the legacy keys.
+//
+// The legacy keys exist only in the default namespace.
+func (r *RDB) migrateKeys(dryRun bool) ([]string, error) {
+	if r.keys != base.DefaultKeys {
+		return nil, nil
+	}
+	keys, err := r.legacyKeys()
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return keys, nil
+	}
+	for _, key := range keys {
+		if key == legacyKeyPrefix+"ps" || strings.HasPrefix(key, legacyKeyPrefix+"ps:") {
+			// Process info is rewritten by running processes periodically.
+			if err := r.client.Del(key).Err(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		newKey := keyPrefix + strings.TrimPrefix(key, legacyKeyPrefix)
+		if err := mergeKeyCmd.Run(r.client, []string{key, newKey}).Err(); err != nil {
+			return nil, err
+		}
+	}
+	// The set of all queues holds the queue keys as its members.
+	members, err := r.client.SMembers(r.keys.AllQueues).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range members {
+		if !strings.HasPrefix(m, legacyKeyPrefix) {
+			continue
+		}
+		newKey := keyPrefix + strings.TrimPrefix(m, legacyKeyPrefix)
+		if err := r.client.SAdd(r.keys.AllQueues, newKey).Err(); err != nil {
+			return nil, err
+		}
+		if err := r.client.SRem(r.keys.AllQueues, m).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// scan returns all keys that match the pattern.
+// In a cluster, keys are collected from all master nodes.
+func (r *RDB) scan(match string) ([]string, error) {
+	c, ok := r.client.(*redis.ClusterClient)
+	if !ok {
+		return scanKeys(r.client, match)
+	}
+	var (
+		mu   sync.Mutex
+		keys []string
+	)
+	err := c.ForEachMaster(func(node *redis.Client) error {
+		ks, err := scanKeys(node, match)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		keys = append(keys, ks...)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func scanKeys(c redis.Cmdable, match string) ([]string, error) {
+	var keys []string
+	iter := c.Scan(0, match, 0).Iterator()
+	for iter.Next() {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// migrateMessage returns the task message in the current format and
+// reports whether it differs from the given data.
+func migrateMessage(data string) (string, bool) {
+	var msg map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber() // preserve numbers in payload as is.
+	if err := dec.Decode(&msg); err != nil {
+		return "", false // bad data, leave it as is.
+	}
+	changed := false
+	if q, _ := msg["Queue"].(string); q == "" {
+		msg["Queue"] = base.DefaultQueueName
+		changed = true
+	}
+	if _, ok := msg["Timeout"]; !ok {
+		msg["Timeout"] = "0s"
+		changed = true
+	}
+	if !changed {
+		return "", false
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(msg); err != nil {
+		return "", false
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), true
+}
+
+// KEYS[1] -> list
+// ARGV[1] -> old task message value
+// ARGV[2] -> new task message value
+var replaceListElemCmd = redis.NewScript(`
+local msgs = redis.call("LRANGE", KEYS[1], 0, -1)
+for i, msg in ipairs(msgs) do
+	if msg == ARGV[1] then
+		redis.call("LSET", KEYS[1], i-1, ARGV[2])
+		return 1
+	end
+end
+return 0`)
+
+func (r *RDB) migrateList(key string, dryRun bool) (int, error) {
+	data, err := r.client.LRange(key, 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, s := range data {
+		migrated, ok := migrateMessage(s)
+		if !ok {
+			continue
+		}
+		if dryRun {
+			n++
+			continue
+		}
+		res, err := replaceListElemCmd.Run(r.client, []string{key}, s, migrated).Int()
+		if err != nil {
+			return n, err
+		}
+		n += res // zero if the message has been removed from the list in the meantime.
+	}
+	return n, nil
+}
+
+// KEYS[1] -> zset
+// ARGV[1] -> old task message value
+// ARGV[2] -> new task message value
+var replaceZSetMemberCmd = redis.NewScript(`
+local score = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if not score then
+	return 0
+end
+redis.call("ZREM", KEYS[1], ARGV[1])
+redis.call("ZADD", KEYS[1], score, ARGV[2])
+return 1`)
+
+func (r *RDB) migrateZSet(key string, dryRun bool) (int, error) {
+	data, err := r.client.ZRange(key, 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, s := range data {
+		migrated, ok := migrateMessage(s)
+		if !ok {
+			continue
+		}
+		if dryRun {
+			n++
+			continue
+		}
+		res, err := replaceZSetMemberCmd.Run(r.client, []string{key}, s, migrated).Int()
+		if err != nil {
+			return n, err
+		}
+		n += res // zero if the message has been removed from the zset in the meantime.
+	}
+	return n, nil
+}
+
+// RenameTaskType rewrites the enqueued, scheduled, and retry tasks of type
+// oldType to be of type newType, and returns the number of tasks rewritten
+// keyed by redis key.
+//
+// If fn is non-nil, it's applied to a copy of the payload of each task
+// rewritten, and the previous payload is kept in the payload history of
+// the task. Binary payloads are left as is. If fn returns a non-nil error,
+// RenameTaskType stops and returns the error; tasks rewritten until then
+// are kept rewritten.
+func (r *RDB) RenameTaskType(oldType, newType string, fn func(payload map[string]interface{}) (map[string]interface{}, error)) (map[string]int, error) {
+	res := make(map[string]int)
+	qkeys, err := r.client.SMembers(r.keys.AllQueues).Result()
+	if err != nil {
+		return nil, err
+	}
+	rename := func(data string) (string, bool, error) {
+		msg, err := base.DecodeMessage([]byte(data))
+		if err != nil || msg.Type != oldType {
+			return "", false, nil // bad data or other type, leave it as is.
+		}
+		if fn != nil && msg.Data == nil {
+			payload, err := fn(copyPayload(msg.Payload))
+			if err != nil {
+				return "", false, err
+			}
+			msg = base.RecordPayload(msg, payload, time.Now())
+		}
+		msg.Type = newType
+		encoded, err := base.EncodeMessage(msg)
+		if err != nil {
+			return "", false, err
+		}
+		return string(encoded), true, nil
+	}
+	for _, key := range qkeys {
+		data, err := r.client.LRange(key, 0, -1).Result()
+		if err != nil {
+			return res, err
+		}
+		for _, s := range data {
+			renamed, ok, err := rename(s)
+			if err != nil {
+				return res, err
+			}
+			if !ok {
+				continue
+			}
+			n, err := replaceListElemCmd.Run(r.client, []string{key}, s, renamed).Int()
+			if err != nil {
+				return res, err
+			}
+			if n > 0 { // zero if the task has been dequeued in the meantime.
+				res[key] += n
+			}
+		}
+	}
+	for _, key := range []string{r.keys.ScheduledQueue, r.keys.RetryQueue} {
+		data, err := r.client.ZRange(key, 0, -1).Result()
+		if err != nil {
+			return res, err
+		}
+		for _, s := range data {
+			renamed, ok, err := rename(s)
+			if err != nil {
+				return res, err
+			}
+			if !ok {
+				continue
+			}
+			n, err := replaceZSetMemberCmd.Run(r.client, []string{key}, s, renamed).Int()
+			if err != nil {
+				return res, err
+			}
+			if n > 0 { // zero if the task has been forwarded in the meantime.
+				res[key] += n
+			}
+		}
+	}
+	return res, nil
+}
+
+// copyPayload returns a shallow copy of the payload, so that the payload
+// can be modified while the original is kept in the payload history.
+func copyPayload(payload map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		res[k] = v
+	}
+	return res
+}
+
+// UpdateZSetTaskPayload applies fn to a copy of the payload of the task
+// with the given id and score in the zset, keeping the previous payload
+// in the payload history of the task, and returns the updated message.
+// If a task that matches the id and score does not exist, it returns
+// ErrTaskNotFound.
+func (r *RDB) UpdateZSetTaskPayload(zset string, id xid.ID, score int64, fn func(payload map[string]interface{}) (map[string]interface{}, error)) (*base.TaskMessage, error) {
+	data, err := r.client.ZRangeByScore(zset, &redis.ZRangeBy{
+		Min: strconv.FormatInt(score, 10),
+		Max: strconv.FormatInt(score, 10),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range data {
+		msg, err := base.DecodeMessage([]byte(s))
+		if err != nil || msg.ID != id {
+			continue // bad data or other task, ignore and continue
+		}
+		if msg.Data != nil {
+			return nil, fmt.Errorf("payload of task %s is not a map", id)
+		}
+		payload, err := fn(copyPayload(msg.Payload))
+		if err != nil {
+			return nil, err
+		}
+		msg = base.RecordPayload(msg, payload, time.Now())
+		encoded, err := base.EncodeMessage(msg)
+		if err != nil {
+			return nil, err
+		}
+		n, err := replaceZSetMemberCmd.Run(r.client, []string{zset}, s, string(encoded)).Int()
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 { // the task has been moved in the meantime.
+			return nil, ErrTaskNotFound
+		}
+		return msg, nil
+	}
+	return nil, ErrTaskNotFound
+}
+
+// KEYS[1] -> source queue
+// KEYS[2] -> destination queue or {asynq}:scheduled
+// KEYS[3] -> {asynq}:queues
+// ARGV[1] -> old task message value
+// ARGV[2] -> new task message value
+// ARGV[3] -> score in the scheduled zset, empty to enqueue the task
+// ARGV[4] -> wake channel to publish the queue name to, or empty string
+// ARGV[5] -> name of the destination queue
+var moveListElemCmd = redis.NewScript(`
+if redis.call("LREM", KEYS[1], 1, ARGV[1]) == 0 then
+	return 0
+end
+if ARGV[3] == "" then
+	redis.call("LPUSH", KEYS[2], ARGV[2])
+	redis.call("SADD", KEYS[3], KEYS[2])
+	if ARGV[4] ~= "" then
+		redis.call("PUBLISH", ARGV[4], ARGV[5])
+	end
+else
+	redis.call("ZADD", KEYS[2], ARGV[3], ARGV[2])
+end
+return 1`)
+
+// KEYS[1] -> zset
+// ARGV[1] -> old task message value
+// ARGV[2] -> new task message value
+// ARGV[3] -> new score
+var rescoreZSetMemberCmd = redis.NewScript(`
+if redis.call("ZREM", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("ZADD", KEYS[1], ARGV[3], ARGV[2])
+return 1`)
+
+// UpdateTasks applies fn to the enqueued tasks if enqueued is true, and to
+// the scheduled tasks if scheduled is true, and returns the number of tasks
+// updated keyed by redis key.
+//
+// fn is called with a task message and the time the task is scheduled to
+// be processed at (zero for enqueued tasks). If it updates the message, it
+// returns the time the task should be processed at and true.
+//
+// An enqueued task is scheduled if the time is in the future, and is kept
+// enqueued in the queue of the message otherwise; a task moved to another
+// queue is pushed to the tail of the queue. A scheduled task is rescheduled
+// at the time, or kept at its time if the time is zero, and is forwarded to
+// the queue of the message by the backgrounds once due.
+func (r *RDB) UpdateTasks(enqueued, scheduled bool, fn func(msg *base.TaskMessage, processAt time.Time) (time.Time, bool)) (map[string]int, error) {
+	res := make(map[string]int)
+	update := func(data string, processAt time.Time) (*base.TaskMessage, string, time.Time, bool, error) {
+		msg, err := base.DecodeMessage([]byte(data))
+		if err != nil {
+			return nil, "", time.Time{}, false, nil // bad data, leave it as is.
+		}
+		t, ok := fn(msg, processAt)
+		if !ok {
+			return nil, "", time.Time{}, false, nil
+		}
+		encoded, err := base.EncodeMessage(msg)
+		if err != nil {
+			return nil, "", time.Time{}, false, err
+		}
+		return msg, string(encoded), t, true, nil
+	}
+	if enqueued {
+		qkeys, err := r.client.SMembers(r.keys.AllQueues).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range qkeys {
+			data, err := r.client.LRange(key, 0, -1).Result()
+			if err != nil {
+				return res, err
+			}
+			for _, s := range data {
+				msg, updated, processAt, ok, err := update(s, time.Time{})
+				if err != nil {
+					return res, err
+				}
+				if !ok {
+					continue
+				}
+				var n int
+				switch dst := r.keys.QueueKey(msg.Queue); {
+				case processAt.After(time.Now()):
+					n, err = moveListElemCmd.Run(r.client, []string{key, r.keys.ScheduledQueue, r.keys.AllQueues},
+						s, updated, processAt.Unix(), "", "").Int()
+				case dst != key:
+					n, err = moveListElemCmd.Run(r.client, []string{key, dst, r.keys.AllQueues},
+						s, updated, "", r.wakeChannel(), msg.Queue).Int()
+				default:
+					n, err = replaceListElemCmd.Run(r.client, []string{key}, s, updated).Int()
+				}
+				if err != nil {
+					return res, err
+				}
+				if n > 0 { // zero if the task has been dequeued in the meantime.
+					res[key] += n
+				}
+			}
+		}
+	}
+	if scheduled {
+		data, err := r.client.ZRangeWithScores(r.keys.ScheduledQueue, 0, -1).Result()
+		if err != nil {
+			return res, err
+		}
+		for _, z := range data {
+			s, _ := z.Member.(string)
+			_, updated, processAt, ok, err := update(s, time.Unix(int64(z.Score), 0))
+			if err != nil {
+				return res, err
+			}
+			if !ok {
+				continue
+			}
+			score := int64(z.Score)
+			if !processAt.IsZero() {
+				// tasks due are forwarded to their queues by the backgrounds.
+				score = processAt.Unix()
+			}
+			n, err := rescoreZSetMemberCmd.Run(r.client, []string{r.keys.ScheduledQueue}, s, updated, score).Int()
+			if err != nil {
+				return res, err
+			}
+			if n > 0 { // zero if the task has been forwarded in the meantime.
+				res[r.keys.ScheduledQueue] += n
+			}
+		}
+	}
+	return res, nil
+}
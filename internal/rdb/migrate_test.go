@@ -0,0 +1,335 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+func TestMigrateMessage(t *testing.T) {
+	tests := []struct {
+		data        string
+		want        string
+		wantChanged bool
+	}{
+		{
+			data:        `{"ID":"bpsgccse5ua3rcn7jiog","Type":"send_email","Payload":{"user_id":12345678901234567890},"Retry":25}`,
+			want:        `{"ID":"bpsgccse5ua3rcn7jiog","Payload":{"user_id":12345678901234567890},"Queue":"default","Retry":25,"Timeout":"0s","Type":"send_email"}`,
+			wantChanged: true,
+		},
+		{
+			data:        `{"ID":"bpsgccse5ua3rcn7jiog","Type":"send_email","Payload":null,"Queue":"low","Retry":25}`,
+			want:        `{"ID":"bpsgccse5ua3rcn7jiog","Payload":null,"Queue":"low","Retry":25,"Timeout":"0s","Type":"send_email"}`,
+			wantChanged: true,
+		},
+		{
+			data:        `{"ID":"bpsgccse5ua3rcn7jiog","Type":"send_email","Payload":null,"Queue":"low","Retry":25,"Timeout":"0s"}`,
+			want:        "",
+			wantChanged: false,
+		},
+		{
+			data:        `not json`,
+			want:        "",
+			wantChanged: false,
+		},
+	}
+
+	for _, tc := range tests {
+		got, changed := migrateMessage(tc.data)
+		if got != tc.want || changed != tc.wantChanged {
+			t.Errorf("migrateMessage(%q) = %q, %t; want %q, %t", tc.data, got, changed, tc.want, tc.wantChanged)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	r := setup(t)
+	// task message written before v0.2.0 (no Queue and Timeout fields).
+	const old = `{"ID":"bpsgccse5ua3rcn7jiog","Type":"send_email","Payload":{"user_id":42},"Retry":25}`
+	current := h.NewTaskMessage("reindex", nil)
+	current.Timeout = "0s"
+
+	// seed data directly to emulate data written by older versions.
+	if err := r.client.LPush(base.DefaultQueue, old).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.client.LPush(base.DefaultQueue, h.MustMarshal(t, current)).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.client.ZAdd(base.DeadQueue, &redis.Z{Member: old, Score: 1575732274}).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := &MigrationResult{
+		Messages: map[string]int{
+			base.DefaultQueue: 1,
+			base.DeadQueue:    1,
+		},
+		Queues: []string{base.DefaultQueueName},
+	}
+
+	// dry run should not change any data.
+	got, err := r.Migrate(true)
+	if err != nil {
+		t.Fatalf("(*RDB).Migrate(true) returned error: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(*RDB).Migrate(true) = %+v, want %+v; (-want,+got)\n%s", got, want, diff)
+	}
+	if r.client.SIsMember(base.AllQueues, base.DefaultQueue).Val() {
+		t.Errorf("(*RDB).Migrate(true) added %q to %q", base.DefaultQueue, base.AllQueues)
+	}
+
+	got, err = r.Migrate(false)
+	if err != nil {
+		t.Fatalf("(*RDB).Migrate(false) returned error: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(*RDB).Migrate(false) = %+v, want %+v; (-want,+got)\n%s", got, want, diff)
+	}
+	if !r.client.SIsMember(base.AllQueues, base.DefaultQueue).Val() {
+		t.Errorf("%q is not a member of SET %q", base.DefaultQueue, base.AllQueues)
+	}
+	for _, msg := range append(h.GetEnqueuedMessages(t, r.client), h.GetDeadMessages(t, r.client)...) {
+		if msg.Queue != base.DefaultQueueName || msg.Timeout != "0s" {
+			t.Errorf("message %+v was not migrated", msg)
+		}
+	}
+	if entries := h.GetDeadEntries(t, r.client); len(entries) != 1 || entries[0].Score != 1575732274 {
+		t.Errorf("dead queue entries = %+v, want one entry with score 1575732274", entries)
+	}
+
+	// running migration again should be a no-op.
+	got, err = r.Migrate(false)
+	if err != nil {
+		t.Fatalf("(*RDB).Migrate(false) returned error: %v", err)
+	}
+	if len(got.Keys) != 0 || len(got.Messages) != 0 || len(got.Queues) != 0 {
+		t.Errorf("second (*RDB).Migrate(false) = %+v, want no changes", got)
+	}
+}
+
+func TestMigrateLegacyKeys(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	m1.Timeout = "0s"
+	m2 := h.NewTaskMessage("reindex", nil)
+	m2.Timeout = "0s"
+	m3 := h.NewTaskMessage("gen_thumbnail", nil)
+	m3.Timeout = "0s"
+
+	// seed data with the key names used before keys had the hash tag.
+	if err := r.client.LPush("asynq:queues:default", h.MustMarshal(t, m1)).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.client.SAdd("asynq:queues", "asynq:queues:default").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.client.ZAdd("asynq:dead", &redis.Z{Member: h.MustMarshal(t, m2), Score: 1575732274}).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.client.Set("asynq:processed:2020-02-20", 10, 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	// keys of a namespace with the legacy prefix should be left alone.
+	if err := r.client.LPush("asynq:{myapp}:queues:default", h.MustMarshal(t, m1)).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.client.ZAdd("asynq:{myapp}:ps", &redis.Z{Member: "host:1234", Score: 1575732274}).Err(); err != nil {
+		t.Fatal(err)
+	}
+	// data written by a newer version running alongside should be kept.
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{m3})
+	if err := r.client.Set(base.ProcessedKey(time.Date(2020, 2, 20, 0, 0, 0, 0, time.UTC)), 5, 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"asynq:dead", "asynq:processed:2020-02-20", "asynq:queues", "asynq:queues:default"}
+	got, err := r.Migrate(false)
+	if err != nil {
+		t.Fatalf("(*RDB).Migrate(false) returned error: %v", err)
+	}
+	if diff := cmp.Diff(want, got.Keys); diff != "" {
+		t.Errorf("(*RDB).Migrate(false).Keys = %v, want %v; (-want,+got)\n%s", got.Keys, want, diff)
+	}
+
+	if n := r.client.Exists(want...).Val(); n != 0 {
+		t.Errorf("%d legacy keys exist after migration, want 0", n)
+	}
+	if n := r.client.Exists("asynq:{myapp}:queues:default", "asynq:{myapp}:ps").Val(); n != 2 {
+		t.Errorf("%d of the keys of namespace %q exist after migration, want 2", n, "asynq:{myapp}:")
+	}
+	// legacy tasks are older, so they should be processed first.
+	wantEnqueued := []*base.TaskMessage{m3, m1}
+	if diff := cmp.Diff(wantEnqueued, h.GetEnqueuedMessages(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.DefaultQueue, diff)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{m2}, h.GetDeadMessages(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.DeadQueue, diff)
+	}
+	if diff := cmp.Diff([]string{base.DefaultQueue}, r.client.SMembers(base.AllQueues).Val()); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.AllQueues, diff)
+	}
+	processedKey := base.ProcessedKey(time.Date(2020, 2, 20, 0, 0, 0, 0, time.UTC))
+	if n := r.client.Get(processedKey).Val(); n != "15" {
+		t.Errorf("%q = %s, want 15", processedKey, n)
+	}
+}
+
+func TestRenameTaskType(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", map[string]interface{}{"to": "user@example.com"})
+	m2 := h.NewTaskMessage("reindex", nil)
+	m3 := h.NewTaskMessage("send_email", map[string]interface{}{"to": "admin@example.com"})
+	m4 := h.NewTaskMessage("send_email", map[string]interface{}{"to": "ops@example.com"})
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{m1, m2})
+	h.SeedScheduledQueue(t, r.client, []h.ZSetEntry{{Msg: m3, Score: 1575732274}})
+	h.SeedRetryQueue(t, r.client, []h.ZSetEntry{{Msg: m4, Score: 1575732275}})
+
+	got, err := r.RenameTaskType("send_email", "email:send", func(payload map[string]interface{}) (map[string]interface{}, error) {
+		payload["version"] = "2"
+		return payload, nil
+	})
+	if err != nil {
+		t.Fatalf("(*RDB).RenameTaskType returned error: %v", err)
+	}
+	want := map[string]int{base.DefaultQueue: 1, base.ScheduledQueue: 1, base.RetryQueue: 1}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(*RDB).RenameTaskType = %v, want %v; (-want,+got)\n%s", got, want, diff)
+	}
+
+	renamed := func(msg *base.TaskMessage) *base.TaskMessage {
+		m := *msg
+		m.Type = "email:send"
+		m.Payload = map[string]interface{}{"to": msg.Payload["to"], "version": "2"}
+		m.PayloadHistory = []*base.PayloadVersion{{Type: "send_email", Payload: msg.Payload}}
+		return &m
+	}
+	ignoreTime := cmpopts.IgnoreFields(base.PayloadVersion{}, "Time")
+	wantEnqueued := []*base.TaskMessage{renamed(m1), m2}
+	if diff := cmp.Diff(wantEnqueued, h.GetEnqueuedMessages(t, r.client), h.SortMsgOpt, ignoreTime); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.DefaultQueue, diff)
+	}
+	wantScheduled := []h.ZSetEntry{{Msg: renamed(m3), Score: 1575732274}}
+	if diff := cmp.Diff(wantScheduled, h.GetScheduledEntries(t, r.client), ignoreTime); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.ScheduledQueue, diff)
+	}
+	wantRetry := []h.ZSetEntry{{Msg: renamed(m4), Score: 1575732275}}
+	if diff := cmp.Diff(wantRetry, h.GetRetryEntries(t, r.client), ignoreTime); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.RetryQueue, diff)
+	}
+
+	// renaming again should be a no-op.
+	got, err = r.RenameTaskType("send_email", "email:send", nil)
+	if err != nil {
+		t.Fatalf("(*RDB).RenameTaskType returned error: %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("second (*RDB).RenameTaskType = %v, want no changes", got)
+	}
+}
+
+func TestUpdateZSetTaskPayload(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", map[string]interface{}{"to": "usr@example.com"})
+	m2 := h.NewTaskMessage("send_email", map[string]interface{}{"to": "admin@example.com"})
+	h.SeedDeadQueue(t, r.client, []h.ZSetEntry{{Msg: m1, Score: 1575732274}, {Msg: m2, Score: 1575732274}})
+
+	fix := func(payload map[string]interface{}) (map[string]interface{}, error) {
+		payload["to"] = "user@example.com"
+		return payload, nil
+	}
+	got, err := r.UpdateZSetTaskPayload(base.DeadQueue, m1.ID, 1575732274, fix)
+	if err != nil {
+		t.Fatalf("(*RDB).UpdateZSetTaskPayload returned error: %v", err)
+	}
+	want := *m1
+	want.Payload = map[string]interface{}{"to": "user@example.com"}
+	want.PayloadHistory = []*base.PayloadVersion{{Type: "send_email", Payload: m1.Payload}}
+	ignoreTime := cmpopts.IgnoreFields(base.PayloadVersion{}, "Time")
+	if diff := cmp.Diff(&want, got, ignoreTime); diff != "" {
+		t.Errorf("(*RDB).UpdateZSetTaskPayload = %v, want %v; (-want,+got)\n%s", got, &want, diff)
+	}
+	wantDead := []h.ZSetEntry{{Msg: &want, Score: 1575732274}, {Msg: m2, Score: 1575732274}}
+	if diff := cmp.Diff(wantDead, h.GetDeadEntries(t, r.client), h.SortZSetEntryOpt, ignoreTime); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.DeadQueue, diff)
+	}
+
+	if _, err := r.UpdateZSetTaskPayload(base.DeadQueue, m1.ID, 1575732275, fix); err != ErrTaskNotFound {
+		t.Errorf("(*RDB).UpdateZSetTaskPayload with wrong score returned error %v, want %v", err, ErrTaskNotFound)
+	}
+}
+
+func TestUpdateTasks(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	m3 := h.NewTaskMessage("send_email", nil)
+	m4 := h.NewTaskMessage("send_email", nil)
+	m5 := h.NewTaskMessage("reindex", nil)
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{m1, m2, m3})
+	h.SeedScheduledQueue(t, r.client, []h.ZSetEntry{
+		{Msg: m4, Score: float64(now.Add(time.Hour).Unix())},
+		{Msg: m5, Score: float64(now.Add(time.Hour).Unix())},
+	})
+
+	later := now.Add(3 * time.Hour).Truncate(time.Second)
+	got, err := r.UpdateTasks(true, true, func(msg *base.TaskMessage, processAt time.Time) (time.Time, bool) {
+		switch msg.ID {
+		case m1.ID: // moved to another queue.
+			msg.Queue = "low"
+			return time.Time{}, true
+		case m2.ID: // updated in place.
+			msg.Retry = 3
+			return time.Time{}, true
+		case m3.ID: // scheduled for later.
+			return later, true
+		case m4.ID: // rescheduled.
+			msg.Timeout = "1m0s"
+			return later, true
+		}
+		return time.Time{}, false
+	})
+	if err != nil {
+		t.Fatalf("(*RDB).UpdateTasks returned error: %v", err)
+	}
+	want := map[string]int{base.DefaultQueue: 3, base.ScheduledQueue: 1}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(*RDB).UpdateTasks = %v, want %v; (-want,+got)\n%s", got, want, diff)
+	}
+
+	updated := func(msg *base.TaskMessage, fn func(m *base.TaskMessage)) *base.TaskMessage {
+		m := *msg
+		fn(&m)
+		return &m
+	}
+	wantDefault := []*base.TaskMessage{updated(m2, func(m *base.TaskMessage) { m.Retry = 3 })}
+	if diff := cmp.Diff(wantDefault, h.GetEnqueuedMessages(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.DefaultQueue, diff)
+	}
+	wantLow := []*base.TaskMessage{updated(m1, func(m *base.TaskMessage) { m.Queue = "low" })}
+	if diff := cmp.Diff(wantLow, h.GetEnqueuedMessages(t, r.client, "low")); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.QueueKey("low"), diff)
+	}
+	if !r.client.SIsMember(base.AllQueues, base.QueueKey("low")).Val() {
+		t.Errorf("%q is not a member of %q", base.QueueKey("low"), base.AllQueues)
+	}
+	wantScheduled := []h.ZSetEntry{
+		{Msg: m3, Score: float64(later.Unix())},
+		{Msg: updated(m4, func(m *base.TaskMessage) { m.Timeout = "1m0s" }), Score: float64(later.Unix())},
+		{Msg: m5, Score: float64(now.Add(time.Hour).Unix())},
+	}
+	if diff := cmp.Diff(wantScheduled, h.GetScheduledEntries(t, r.client), h.SortZSetEntryOpt); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.ScheduledQueue, diff)
+	}
+}
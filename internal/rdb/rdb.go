@@ -9,68 +9,352 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v7"
 	"github.com/hibiken/asynq/internal/base"
+	"github.com/rs/xid"
 	"github.com/spf13/cast"
 )
 
 var (
 	// ErrNoProcessableTask indicates that there are no tasks ready to be processed.
-	ErrNoProcessableTask = errors.New("no tasks are ready for processing")
+	ErrNoProcessableTask = base.ErrNoProcessableTask
 
 	// ErrTaskNotFound indicates that a task that matches the given identifier was not found.
 	ErrTaskNotFound = errors.New("could not find a task")
+
+	// ErrResultNotFound indicates that no result was stored for the given task.
+	ErrResultNotFound = errors.New("could not find a result of the task")
+
+	// ErrQueueFull indicates that the queue has as many pending tasks as its quota.
+	ErrQueueFull = errors.New("queue is full")
+
+	// ErrProgressNotFound indicates that no progress was reported for the given task.
+	ErrProgressNotFound = errors.New("could not find a progress of the task")
 )
 
 const statsTTL = 90 * 24 * time.Hour // 90 days
 
+// decodeMessageLua defines a lua function to read the ID and Queue fields
+// of a task message encoded in either JSON or protobuf.
+// It should be prepended to the scripts which use it.
+//
+// Protobuf encoded messages start with a zero byte followed by
+// ID and Queue fields, each of which is a one-byte tag, a varint length,
+// and the string value.
+const decodeMessageLua = `
+local function readField(msg, pos)
+	local len, shift = 0, 0
+	pos = pos + 1 -- skip the tag
+	while true do
+		local b = string.byte(msg, pos)
+		pos = pos + 1
+		len = len + (b % 128) * 2 ^ shift
+		if b < 128 then break end
+		shift = shift + 7
+	end
+	return string.sub(msg, pos, pos + len - 1), pos + len
+end
+local function decodeMessage(msg)
+	if string.byte(msg, 1) ~= 0 then
+		return cjson.decode(msg)
+	end
+	local id, pos = readField(msg, 2)
+	local queue = readField(msg, pos)
+	return {ID = id, Queue = queue}
+end
+`
+
+// rollupsLua defines the lua function moveRollups, which moves a task
+// message from one state to another in the rollup counts stored at key
+// (see RefreshRollups), so that the scripts moving tasks keep the counts
+// up to date. Either state may be an empty string when the task is added
+// or deleted. It needs decodeMessageLua.
+//
+// moveRollups also keeps the index of the tasks with a correlation ID
+// (see FindTasksByCorrelationID) up to date, which is stored at the key
+// of the rollups with ":correlation:<id>" appended (see Keys.CorrelationKey).
+// The optional data argument is the message written in the new state if
+// the script encodes it anew (e.g. with the error of a retried task).
+//
+// The Dimensions and CorrelationID fields of protobuf encoded messages are
+// found by skipping the other fields, each of which is a varint tag followed
+// by a varint, a fixed 64-bit value, or a varint length and the bytes.
+const rollupsLua = decodeMessageLua + `
+local function readVarint(msg, pos)
+	local v, shift = 0, 0
+	while true do
+		local b = string.byte(msg, pos)
+		pos = pos + 1
+		v = v + (b % 128) * 2 ^ shift
+		if b < 128 then return v, pos end
+		shift = shift + 7
+	end
+end
+local function rollupPrefixes(msg)
+	local res, cid = {}, nil
+	if string.byte(msg, 1) ~= 0 then
+		if not string.find(msg, '"Dimensions"', 1, true) and
+			not string.find(msg, '"CorrelationID"', 1, true) then
+			return res
+		end
+		local decoded = cjson.decode(msg)
+		local dims = decoded["Dimensions"]
+		if type(dims) == "table" then
+			for dim, val in pairs(dims) do
+				table.insert(res, dim .. ":" .. val .. ":")
+			end
+		end
+		if type(decoded["CorrelationID"]) == "string" and decoded["CorrelationID"] ~= "" then
+			cid = decoded["CorrelationID"]
+		end
+		return res, cid
+	end
+	local pos = 2
+	while pos <= string.len(msg) do
+		local tag, len
+		tag, pos = readVarint(msg, pos)
+		local wire = tag % 8
+		if wire == 0 then
+			len, pos = readVarint(msg, pos)
+		elseif wire == 1 then
+			pos = pos + 8
+		elseif wire == 2 then
+			len, pos = readVarint(msg, pos)
+			local field = (tag - wire) / 8
+			if field == 10 then
+				local entry = string.sub(msg, pos, pos + len - 1)
+				local dim, p = readField(entry, 1)
+				table.insert(res, dim .. ":" .. readField(entry, p) .. ":")
+			elseif field == 9 and len > 0 then
+				cid = string.sub(msg, pos, pos + len - 1)
+			end
+			pos = pos + len
+		else
+			break
+		end
+	end
+	return res, cid
+end
+local function moveRollups(key, msg, from, to, data)
+	local prefixes, cid = rollupPrefixes(msg)
+	for _, prefix in ipairs(prefixes) do
+		if from ~= "" and redis.call("HINCRBY", key, prefix .. from, -1) <= 0 then
+			redis.call("HDEL", key, prefix .. from)
+		end
+		if to ~= "" then
+			redis.call("HINCRBY", key, prefix .. to, 1)
+		end
+	end
+	if cid then
+		local index = key .. ":correlation:" .. cid
+		local id = decodeMessage(msg)["ID"]
+		if to == "" then
+			redis.call("HDEL", index, id)
+		else
+			redis.call("HSET", index, id, to .. ":" .. (data or msg))
+			redis.call("SADD", key .. ":correlations", cid)
+		end
+	end
+end
+`
+
 // RDB is a client interface to query and mutate task queues.
 type RDB struct {
-	client *redis.Client
+	client redis.UniversalClient
+
+	// shared is true if the client is owned by the caller
+	// and should not be closed by RDB.
+	shared bool
+
+	// keys in the namespace RDB operates on.
+	keys *base.Keys
+
+	// wakeups is true if the queue name is published to the wake channel
+	// whenever a task is enqueued.
+	wakeups bool
+
+	// deadMaxSize and deadMaxAge limit the number and the age of the tasks
+	// kept in the dead queue, zero to use the defaults.
+	deadMaxSize int
+	deadMaxAge  time.Duration
+
+	// lockToken identifies the locks held by this RDB.
+	lockToken string
+
+	// clock tells the time to forward and expire the tasks.
+	clock base.Clock
 }
 
+var _ base.Broker = (*RDB)(nil)
+
 // NewRDB returns a new instance of RDB.
-func NewRDB(client *redis.Client) *RDB {
-	return &RDB{client}
+func NewRDB(client redis.UniversalClient) *RDB {
+	return &RDB{client: client, keys: base.DefaultKeys, lockToken: xid.New().String(), clock: base.RealClock}
+}
+
+// NewSharedRDB returns a new instance of RDB that uses the client
+// owned by the caller. Close does not close the client.
+func NewSharedRDB(client redis.UniversalClient) *RDB {
+	return &RDB{client: client, shared: true, keys: base.DefaultKeys, lockToken: xid.New().String(), clock: base.RealClock}
 }
 
-// Close closes the connection with redis server.
+// SetKeyPrefix makes RDB operate on the keys in the namespace specified
+// by the prefix. It should be called before RDB is used.
+func (r *RDB) SetKeyPrefix(prefix string) {
+	r.keys = base.NewKeys(prefix)
+}
+
+// SetClock makes RDB tell the time with the clock to forward the scheduled
+// and retry tasks which have come due, and to expire the completed and dead
+// tasks. Leases and stats are kept in real time. It should be called before
+// RDB is used.
+func (r *RDB) SetClock(c base.Clock) {
+	r.clock = c
+}
+
+// SetPublishWakeups makes RDB publish the queue name to the wake channel
+// whenever a task is enqueued. It should be called before RDB is used.
+func (r *RDB) SetPublishWakeups(enabled bool) {
+	r.wakeups = enabled
+}
+
+// SetDeadRetention makes RDB trim the dead queue to maxSize tasks killed
+// within maxAge whenever a task is killed. Zero or negative values keep the
+// defaults of 10,000 tasks and 90 days. It should be called before RDB is used.
+func (r *RDB) SetDeadRetention(maxSize int, maxAge time.Duration) {
+	r.deadMaxSize = maxSize
+	r.deadMaxAge = maxAge
+}
+
+// deadLimits returns the cutoff timestamp of the tasks in the dead queue
+// and the max number of tasks in the queue.
+func (r *RDB) deadLimits(now time.Time) (cutoff int64, maxSize int) {
+	maxSize = r.deadMaxSize
+	if maxSize <= 0 {
+		maxSize = maxDeadTasks
+	}
+	if r.deadMaxAge > 0 {
+		return now.Add(-r.deadMaxAge).Unix(), maxSize
+	}
+	return now.AddDate(0, 0, -deadExpirationInDays).Unix(), maxSize // 90 days ago
+}
+
+// Keys returns the keys in the namespace RDB operates on.
+func (r *RDB) Keys() *base.Keys {
+	return r.keys
+}
+
+// Ping checks the connection with redis server.
+func (r *RDB) Ping() error {
+	return r.client.Ping().Err()
+}
+
+// Close closes the connection with redis server,
+// unless the client is shared with the caller.
 func (r *RDB) Close() error {
+	if r.shared {
+		return nil
+	}
 	return r.client.Close()
 }
 
-// KEYS[1] -> asynq:queues:<qname>
-// KEYS[2] -> asynq:queues
+// KEYS[1] -> {asynq}:queues:<qname>
+// KEYS[2] -> {asynq}:queues
+// KEYS[3] -> {asynq}:rollups
 // ARGV[1] -> task message data
-var enqueueCmd = redis.NewScript(`
+// ARGV[2] -> wake channel to publish the queue name to, or empty string
+// ARGV[3] -> queue name
+var enqueueCmd = redis.NewScript(rollupsLua + `
 redis.call("LPUSH", KEYS[1], ARGV[1])
 redis.call("SADD", KEYS[2], KEYS[1])
+moveRollups(KEYS[3], ARGV[1], "", "enqueued")
+if ARGV[2] ~= "" then
+	redis.call("PUBLISH", ARGV[2], ARGV[3])
+end
 return 1`)
 
 // Enqueue inserts the given task to the tail of the queue.
 func (r *RDB) Enqueue(msg *base.TaskMessage) error {
-	bytes, err := json.Marshal(msg)
+	bytes, err := base.EncodeMessage(msg)
 	if err != nil {
 		return err
 	}
-	key := base.QueueKey(msg.Queue)
-	return enqueueCmd.Run(r.client, []string{key, base.AllQueues}, bytes).Err()
+	key := r.keys.QueueKey(msg.Queue)
+	return enqueueCmd.Run(r.client, []string{key, r.keys.AllQueues, r.keys.Rollups},
+		bytes, r.wakeChannel(), msg.Queue).Err()
+}
+
+// KEYS[1] -> {asynq}:queues:<qname>
+// KEYS[2] -> {asynq}:queues
+// KEYS[3] -> {asynq}:rollups
+// ARGV[1] -> task message data
+// ARGV[2] -> wake channel to publish the queue name to, or empty string
+// ARGV[3] -> queue name
+// ARGV[4] -> max number of tasks in the queue
+var enqueueWithQuotaCmd = redis.NewScript(rollupsLua + `
+if redis.call("LLEN", KEYS[1]) >= tonumber(ARGV[4]) then
+	return 0
+end
+redis.call("LPUSH", KEYS[1], ARGV[1])
+redis.call("SADD", KEYS[2], KEYS[1])
+moveRollups(KEYS[3], ARGV[1], "", "enqueued")
+if ARGV[2] ~= "" then
+	redis.call("PUBLISH", ARGV[2], ARGV[3])
+end
+return 1`)
+
+// EnqueueWithQuota inserts the given task to the tail of the queue unless
+// the queue has max tasks or more, in which case it returns ErrQueueFull.
+func (r *RDB) EnqueueWithQuota(msg *base.TaskMessage, max int) error {
+	bytes, err := base.EncodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	key := r.keys.QueueKey(msg.Queue)
+	res, err := enqueueWithQuotaCmd.Run(r.client, []string{key, r.keys.AllQueues, r.keys.Rollups},
+		bytes, r.wakeChannel(), msg.Queue, max).Result()
+	if err != nil {
+		return err
+	}
+	n, err := cast.ToInt64E(res)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// wakeChannel returns the channel to publish wakeups to,
+// or an empty string if wakeups are disabled.
+func (r *RDB) wakeChannel() string {
+	if !r.wakeups {
+		return ""
+	}
+	return r.keys.WakeChannel
 }
 
 // Dequeue queries given queues in order and pops a task message if there is one and returns it.
 // If all queues are empty, ErrNoProcessableTask error is returned.
+//
+// If only one queue is given, Dequeue blocks until a task arrives in the queue
+// or a timeout of one second elapses.
 func (r *RDB) Dequeue(qnames ...string) (*base.TaskMessage, error) {
 	var data string
 	var err error
 	if len(qnames) == 1 {
-		data, err = r.dequeueSingle(base.QueueKey(qnames[0]))
+		data, err = r.dequeueSingle(r.keys.QueueKey(qnames[0]))
 	} else {
 		// TODO(hibiken): Take keys are argument and don't compute every time
 		var keys []string
 		for _, q := range qnames {
-			keys = append(keys, base.QueueKey(q))
+			keys = append(keys, r.keys.QueueKey(q))
 		}
 		data, err = r.dequeue(keys...)
 	}
@@ -80,50 +364,148 @@ func (r *RDB) Dequeue(qnames ...string) (*base.TaskMessage, error) {
 	if err != nil {
 		return nil, err
 	}
-	var msg base.TaskMessage
-	err = json.Unmarshal([]byte(data), &msg)
-	if err != nil {
-		return nil, err
-	}
-	return &msg, nil
+	return base.DecodeMessage([]byte(data))
 }
 
+// KEYS[1] -> {asynq}:leases
+// KEYS[2] -> {asynq}:rollups
+// ARGV[1] -> lease expiration timestamp
+// ARGV[2] -> task message data popped to in-progress queue
+var leasePoppedCmd = redis.NewScript(rollupsLua + `
+redis.call("ZADD", KEYS[1], ARGV[1], ARGV[2])
+moveRollups(KEYS[2], ARGV[2], "enqueued", "inprogress")
+return redis.status_reply("OK")`)
+
 func (r *RDB) dequeueSingle(queue string) (data string, err error) {
 	// timeout needed to avoid blocking forever
-	return r.client.BRPopLPush(queue, base.InProgressQueue, time.Second).Result()
+	data, err = r.client.BRPopLPush(queue, r.keys.InProgressQueue, time.Second).Result()
+	if err != nil {
+		return "", err
+	}
+	// The lease and the rollup counts can't be written atomically with
+	// a blocking command. If the lease is not written (e.g. the process
+	// crashed in between), the task is leased when the leases are recovered;
+	// see RecoverExpiredLeases. The counts are fixed by RefreshRollups.
+	expireAt := time.Now().Add(base.LeaseDuration).Unix()
+	leasePoppedCmd.Run(r.client, []string{r.keys.Leases, r.keys.Rollups}, expireAt, data)
+	return data, nil
 }
 
-// KEYS[1] -> asynq:in_progress
-// ARGV    -> List of queues to query in order
-var dequeueCmd = redis.NewScript(`
+// KEYS[1] -> {asynq}:in_progress
+// KEYS[2] -> {asynq}:leases
+// KEYS[3] -> {asynq}:rollups
+// ARGV[1] -> lease expiration timestamp
+// ARGV[2:] -> List of queues to query in order
+var dequeueCmd = redis.NewScript(rollupsLua + `
 local res
-for _, qkey in ipairs(ARGV) do
-	res = redis.call("RPOPLPUSH", qkey, KEYS[1])
+for i = 2, table.getn(ARGV) do
+	res = redis.call("RPOPLPUSH", ARGV[i], KEYS[1])
 	if res then
+		redis.call("ZADD", KEYS[2], ARGV[1], res)
+		moveRollups(KEYS[3], res, "enqueued", "inprogress")
 		return res
 	end
 end
 return res`)
 
 func (r *RDB) dequeue(queues ...string) (data string, err error) {
-	var args []interface{}
+	args := []interface{}{time.Now().Add(base.LeaseDuration).Unix()}
 	for _, qkey := range queues {
 		args = append(args, qkey)
 	}
-	res, err := dequeueCmd.Run(r.client, []string{base.InProgressQueue}, args...).Result()
+	res, err := dequeueCmd.Run(r.client, []string{r.keys.InProgressQueue, r.keys.Leases, r.keys.Rollups}, args...).Result()
 	if err != nil {
 		return "", err
 	}
 	return cast.ToStringE(res)
 }
 
-// KEYS[1] -> asynq:in_progress
-// KEYS[2] -> asynq:processed:<yyyy-mm-dd>
+// KEYS[1] -> {asynq}:in_progress
+// KEYS[2] -> {asynq}:leases
+// KEYS[3] -> {asynq}:rollups
+// ARGV[1] -> lease expiration timestamp
+// ARGV[2] -> max number of tasks to pop
+// ARGV[3:] -> List of queues to query in order
+var dequeueNCmd = redis.NewScript(rollupsLua + `
+local res = {}
+local n = tonumber(ARGV[2])
+for i = 3, table.getn(ARGV) do
+	while table.getn(res) < n do
+		local msg = redis.call("RPOPLPUSH", ARGV[i], KEYS[1])
+		if not msg then
+			break
+		end
+		redis.call("ZADD", KEYS[2], ARGV[1], msg)
+		moveRollups(KEYS[3], msg, "enqueued", "inprogress")
+		table.insert(res, msg)
+	end
+end
+return res`)
+
+// KEYS[1] -> {asynq}:in_progress
+// KEYS[2] -> {asynq}:leases
+// KEYS[3] -> {asynq}:dead
+// ARGV[1] -> data that cannot be decoded
+// ARGV[2] -> died_at UNIX timestamp
+var killBadDataCmd = redis.NewScript(`
+redis.call("LREM", KEYS[1], 0, ARGV[1])
+redis.call("ZREM", KEYS[2], ARGV[1])
+redis.call("ZADD", KEYS[3], ARGV[2], ARGV[1])
+return redis.status_reply("OK")
+`)
+
+// DequeueN pops up to n task messages out of the given queues in one round
+// trip, querying the queues in order until n tasks are popped. If all queues
+// are empty, ErrNoProcessableTask error is returned.
+//
+// Popped data that cannot be decoded is moved to the dead queue as is and
+// the other task messages are returned; if none can be decoded,
+// ErrNoProcessableTask error is returned.
+//
+// Unlike Dequeue, DequeueN never blocks.
+func (r *RDB) DequeueN(n int, qnames ...string) ([]*base.TaskMessage, error) {
+	args := []interface{}{time.Now().Add(base.LeaseDuration).Unix(), n}
+	for _, q := range qnames {
+		args = append(args, r.keys.QueueKey(q))
+	}
+	res, err := dequeueNCmd.Run(r.client, []string{r.keys.InProgressQueue, r.keys.Leases, r.keys.Rollups}, args...).Result()
+	if err != nil {
+		return nil, err
+	}
+	data, err := cast.ToStringSliceE(res)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*base.TaskMessage, 0, len(data))
+	for _, s := range data {
+		msg, err := base.DecodeMessage([]byte(s))
+		if err != nil {
+			keys := []string{r.keys.InProgressQueue, r.keys.Leases, r.keys.DeadQueue}
+			if err := killBadDataCmd.Run(r.client, keys, s, time.Now().Unix()).Err(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) == 0 {
+		return nil, ErrNoProcessableTask
+	}
+	return msgs, nil
+}
+
+// KEYS[1] -> {asynq}:in_progress
+// KEYS[2] -> {asynq}:processed:<yyyy-mm-dd>
+// KEYS[3] -> {asynq}:leases
+// KEYS[4] -> {asynq}:rollups
 // ARGV[1] -> base.TaskMessage value
 // ARGV[2] -> stats expiration timestamp
 // Note: LREM count ZERO means "remove all elements equal to val"
-var doneCmd = redis.NewScript(`
-redis.call("LREM", KEYS[1], 0, ARGV[1]) 
+var doneCmd = redis.NewScript(rollupsLua + `
+if redis.call("LREM", KEYS[1], 0, ARGV[1]) > 0 then
+	moveRollups(KEYS[4], ARGV[1], "inprogress", "")
+end
+redis.call("ZREM", KEYS[3], ARGV[1])
 local n = redis.call("INCR", KEYS[2])
 if tonumber(n) == 1 then
 	redis.call("EXPIREAT", KEYS[2], ARGV[2])
@@ -133,60 +515,292 @@ return redis.status_reply("OK")
 
 // Done removes the task from in-progress queue to mark the task as done.
 func (r *RDB) Done(msg *base.TaskMessage) error {
-	bytes, err := json.Marshal(msg)
+	bytes, err := base.EncodeMessage(msg)
 	if err != nil {
 		return err
 	}
 	now := time.Now()
-	processedKey := base.ProcessedKey(now)
+	processedKey := r.keys.ProcessedKey(now)
 	expireAt := now.Add(statsTTL)
 	return doneCmd.Run(r.client,
-		[]string{base.InProgressQueue, processedKey},
+		[]string{r.keys.InProgressQueue, processedKey, r.keys.Leases, r.keys.Rollups},
 		bytes, expireAt.Unix()).Err()
 }
 
-// KEYS[1] -> asynq:in_progress
-// KEYS[2] -> asynq:queues:<qname>
+// KEYS[1] -> {asynq}:in_progress
+// KEYS[2] -> {asynq}:processed:<yyyy-mm-dd>
+// KEYS[3] -> {asynq}:leases
+// KEYS[4] -> {asynq}:completed
+// KEYS[5] -> {asynq}:rollups
+// ARGV[1] -> base.TaskMessage value
+// ARGV[2] -> stats expiration timestamp
+// ARGV[3] -> retention expiration timestamp
+var completeCmd = redis.NewScript(rollupsLua + `
+local from = ""
+if redis.call("LREM", KEYS[1], 0, ARGV[1]) > 0 then
+	from = "inprogress"
+end
+redis.call("ZREM", KEYS[3], ARGV[1])
+redis.call("ZADD", KEYS[4], ARGV[3], ARGV[1])
+moveRollups(KEYS[5], ARGV[1], from, "completed")
+local n = redis.call("INCR", KEYS[2])
+if tonumber(n) == 1 then
+	redis.call("EXPIREAT", KEYS[2], ARGV[2])
+end
+return redis.status_reply("OK")`)
+
+// Complete removes the task from in-progress queue to mark the task as done,
+// and keeps it in the completed queue until expireAt.
+func (r *RDB) Complete(msg *base.TaskMessage, expireAt time.Time) error {
+	bytes, err := base.EncodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	processedKey := r.keys.ProcessedKey(now)
+	statsExpireAt := now.Add(statsTTL)
+	return completeCmd.Run(r.client,
+		[]string{r.keys.InProgressQueue, processedKey, r.keys.Leases, r.keys.CompletedQueue, r.keys.Rollups},
+		bytes, statsExpireAt.Unix(), expireAt.Unix()).Err()
+}
+
+// DeleteExpiredCompleted deletes the tasks whose retention has expired
+// from the completed queue, and returns the number of tasks deleted.
+func (r *RDB) DeleteExpiredCompleted() (int64, error) {
+	return r.client.ZRemRangeByScore(r.keys.CompletedQueue, "-inf", strconv.FormatInt(r.clock.Now().Unix(), 10)).Result()
+}
+
+// KEYS[1] -> {asynq}:in_progress
+// KEYS[2] -> {asynq}:leases
+// KEYS[3] -> {asynq}:rollups
 // ARGV[1] -> base.TaskMessage value
+var ackCmd = redis.NewScript(rollupsLua + `
+if redis.call("LREM", KEYS[1], 0, ARGV[1]) > 0 then
+	moveRollups(KEYS[3], ARGV[1], "inprogress", "")
+end
+redis.call("ZREM", KEYS[2], ARGV[1])
+return redis.status_reply("OK")`)
+
+// Ack removes the task from in-progress queue before the task is processed,
+// so that it's not restored if the worker crashes while processing it.
+// Unlike Done, it doesn't count the task as processed.
+func (r *RDB) Ack(msg *base.TaskMessage) error {
+	bytes, err := base.EncodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	return ackCmd.Run(r.client, []string{r.keys.InProgressQueue, r.keys.Leases, r.keys.Rollups}, bytes).Err()
+}
+
+// KEYS[1] -> {asynq}:delivery:<task id>:<attempt>
+// KEYS[2] -> {asynq}:duplicates
+// ARGV[1] -> worker which started processing the task
+// ARGV[2] -> how long to remember the delivery in milliseconds
+var recordDeliveryCmd = redis.NewScript(`
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return ""
+end
+redis.call("INCR", KEYS[2])
+return redis.call("GET", KEYS[1])`)
+
+// RecordDelivery records that the worker started processing the task,
+// remembering it for the given duration. If the same attempt of the task
+// has already been started, it counts a duplicate delivery and returns
+// the worker which started it first; otherwise it returns an empty string.
+//
+// Tasks recovered after their leases expired are the same attempt as the
+// delivery whose lease expired (see base.Attempt).
+func (r *RDB) RecordDelivery(msg *base.TaskMessage, worker string, ttl time.Duration) (string, error) {
+	keys := []string{r.keys.DeliveryKey(msg.ID.String(), base.Attempt(msg)), r.keys.Duplicates}
+	res, err := recordDeliveryCmd.Run(r.client, keys, worker, ttl.Milliseconds()).Result()
+	if err != nil {
+		return "", err
+	}
+	return cast.ToStringE(res)
+}
+
+// KEYS[1] -> {asynq}:dedup:<content hash>
+// ARGV[1] -> task ID
+// ARGV[2] -> how long to remember the content in milliseconds
+var dedupCmd = redis.NewScript(`
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return ""
+end
+return redis.call("GET", KEYS[1])`)
+
+// Dedup records that the task was enqueued with the content with the given
+// hash, remembering it for the given duration. If a task with the same
+// content has already been recorded, it returns the ID of that task;
+// otherwise it returns an empty string.
+func (r *RDB) Dedup(msg *base.TaskMessage, hash string, ttl time.Duration) (string, error) {
+	res, err := dedupCmd.Run(r.client, []string{r.keys.DedupKey(hash)}, msg.ID.String(), ttl.Milliseconds()).Result()
+	if err != nil {
+		return "", err
+	}
+	return cast.ToStringE(res)
+}
+
+// KEYS[1] -> {asynq}:dedup:<content hash>
+// ARGV[1] -> task ID
+var forgetCmd = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("DEL", KEYS[1])
+end
+return 1`)
+
+// Forget deletes the record of the content with the given hash written
+// by Dedup for the task, so that a task failed to be enqueued doesn't
+// drop the tasks with the same content.
+func (r *RDB) Forget(msg *base.TaskMessage, hash string) error {
+	return forgetCmd.Run(r.client, []string{r.keys.DedupKey(hash)}, msg.ID.String()).Err()
+}
+
+// KEYS[1] -> {asynq}:starts:<task id>
+// ARGV[1] -> how long to remember the starts in milliseconds
+var recordStartCmd = redis.NewScript(`
+local n = redis.call("INCR", KEYS[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[1])
+return n`)
+
+// RecordStart counts that processing of the task was started, remembering
+// the count for the given duration since the last start, and returns the
+// number of times the task was started without finishing, including this
+// one. Starts are counted across the attempts of the task, since the tasks
+// interrupted by a crash are retried once their leases expire.
+func (r *RDB) RecordStart(msg *base.TaskMessage, ttl time.Duration) (int, error) {
+	key := r.keys.StartsKey(msg.ID.String())
+	res, err := recordStartCmd.Run(r.client, []string{key}, ttl.Milliseconds()).Result()
+	if err != nil {
+		return 0, err
+	}
+	n, err := cast.ToIntE(res)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// ClearStarts forgets the starts of the task once an attempt of the task
+// has finished.
+func (r *RDB) ClearStarts(msg *base.TaskMessage) error {
+	return r.client.Del(r.keys.StartsKey(msg.ID.String())).Err()
+}
+
+// KEYS[1] -> {asynq}:in_progress
+// KEYS[2] -> {asynq}:queues:<qname>
+// KEYS[3] -> {asynq}:leases
+// KEYS[4] -> {asynq}:rollups
+// ARGV[1] -> base.TaskMessage value
+// ARGV[2] -> wake channel to publish the queue name to, or empty string
+// ARGV[3] -> queue name
 // Note: Use RPUSH to push to the head of the queue.
-var requeueCmd = redis.NewScript(`
-redis.call("LREM", KEYS[1], 0, ARGV[1])
+var requeueCmd = redis.NewScript(rollupsLua + `
+local from = ""
+if redis.call("LREM", KEYS[1], 0, ARGV[1]) > 0 then
+	from = "inprogress"
+end
+redis.call("ZREM", KEYS[3], ARGV[1])
 redis.call("RPUSH", KEYS[2], ARGV[1])
+moveRollups(KEYS[4], ARGV[1], from, "enqueued")
+if ARGV[2] ~= "" then
+	redis.call("PUBLISH", ARGV[2], ARGV[3])
+end
 return redis.status_reply("OK")`)
 
 // Requeue moves the task from in-progress queue to the specified queue.
 func (r *RDB) Requeue(msg *base.TaskMessage) error {
-	bytes, err := json.Marshal(msg)
+	bytes, err := base.EncodeMessage(msg)
 	if err != nil {
 		return err
 	}
 	return requeueCmd.Run(r.client,
-		[]string{base.InProgressQueue, base.QueueKey(msg.Queue)},
-		string(bytes)).Err()
+		[]string{r.keys.InProgressQueue, r.keys.QueueKey(msg.Queue), r.keys.Leases, r.keys.Rollups},
+		string(bytes), r.wakeChannel(), msg.Queue).Err()
 }
 
 // Schedule adds the task to the backlog queue to be processed in the future.
 func (r *RDB) Schedule(msg *base.TaskMessage, processAt time.Time) error {
-	bytes, err := json.Marshal(msg)
+	bytes, err := base.EncodeMessage(msg)
 	if err != nil {
 		return err
 	}
 	score := float64(processAt.Unix())
-	return r.client.ZAdd(base.ScheduledQueue,
-		&redis.Z{Member: string(bytes), Score: score}).Err()
+	if len(msg.Dimensions) == 0 && msg.CorrelationID == "" {
+		return r.client.ZAdd(r.keys.ScheduledQueue,
+			&redis.Z{Member: string(bytes), Score: score}).Err()
+	}
+	_, err = r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(r.keys.ScheduledQueue, &redis.Z{Member: string(bytes), Score: score})
+		r.addRollups(pipe, msg, bytes, "scheduled")
+		return nil
+	})
+	return err
+}
+
+// addRollups counts the task message in the given state in the rollup counts,
+// and adds the task message data to the index of its correlation ID.
+func (r *RDB) addRollups(pipe redis.Pipeliner, msg *base.TaskMessage, data []byte, state string) {
+	for dim, val := range msg.Dimensions {
+		pipe.HIncrBy(r.keys.Rollups, rollupField(dim, val, state), 1)
+	}
+	if msg.CorrelationID != "" {
+		pipe.HSet(r.keys.CorrelationKey(msg.CorrelationID), msg.ID.String(), correlationEntry(state, string(data)))
+		pipe.SAdd(r.keys.Correlations, msg.CorrelationID)
+	}
+}
+
+// BatchEntry is a task message to be written to redis as part of a batch.
+type BatchEntry = base.BatchEntry
+
+// WriteBatch enqueues or schedules all the given task messages
+// in a single transaction.
+func (r *RDB) WriteBatch(entries []*BatchEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	_, err := r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, e := range entries {
+			bytes, err := base.EncodeMessage(e.Msg)
+			if err != nil {
+				return err
+			}
+			if e.ProcessAt.IsZero() {
+				key := r.keys.QueueKey(e.Msg.Queue)
+				pipe.LPush(key, bytes)
+				pipe.SAdd(r.keys.AllQueues, key)
+				if r.wakeups {
+					pipe.Publish(r.keys.WakeChannel, e.Msg.Queue)
+				}
+				r.addRollups(pipe, e.Msg, bytes, "enqueued")
+			} else {
+				score := float64(e.ProcessAt.Unix())
+				pipe.ZAdd(r.keys.ScheduledQueue, &redis.Z{Member: string(bytes), Score: score})
+				r.addRollups(pipe, e.Msg, bytes, "scheduled")
+			}
+		}
+		return nil
+	})
+	return err
 }
 
-// KEYS[1] -> asynq:in_progress
-// KEYS[2] -> asynq:retry
-// KEYS[3] -> asynq:processed:<yyyy-mm-dd>
-// KEYS[4] -> asynq:failure:<yyyy-mm-dd>
-// ARGV[1] -> base.TaskMessage value to remove from base.InProgressQueue queue
+// KEYS[1] -> {asynq}:in_progress
+// KEYS[2] -> {asynq}:retry
+// KEYS[3] -> {asynq}:processed:<yyyy-mm-dd>
+// KEYS[4] -> {asynq}:failure:<yyyy-mm-dd>
+// KEYS[5] -> {asynq}:leases
+// KEYS[6] -> {asynq}:rollups
+// ARGV[1] -> base.TaskMessage value to remove from InProgress queue
 // ARGV[2] -> base.TaskMessage value to add to Retry queue
 // ARGV[3] -> retry_at UNIX timestamp
 // ARGV[4] -> stats expiration timestamp
-var retryCmd = redis.NewScript(`
-redis.call("LREM", KEYS[1], 0, ARGV[1])
+var retryCmd = redis.NewScript(rollupsLua + `
+local from = ""
+if redis.call("LREM", KEYS[1], 0, ARGV[1]) > 0 then
+	from = "inprogress"
+end
+redis.call("ZREM", KEYS[5], ARGV[1])
 redis.call("ZADD", KEYS[2], ARGV[3], ARGV[2])
+moveRollups(KEYS[6], ARGV[1], from, "retry", ARGV[2])
 local n = redis.call("INCR", KEYS[3])
 if tonumber(n) == 1 then
 	redis.call("EXPIREAT", KEYS[3], ARGV[4])
@@ -200,46 +814,87 @@ return redis.status_reply("OK")`)
 // Retry moves the task from in-progress to retry queue, incrementing retry count
 // and assigning error message to the task message.
 func (r *RDB) Retry(msg *base.TaskMessage, processAt time.Time, errMsg string) error {
-	bytesToRemove, err := json.Marshal(msg)
+	return r.RetryInQueue(msg, msg.Queue, processAt, errMsg)
+}
+
+// RetryInQueue is like Retry, but the task is moved to the given queue
+// when it's processed again.
+func (r *RDB) RetryInQueue(msg *base.TaskMessage, qname string, processAt time.Time, errMsg string) error {
+	bytesToRemove, err := base.EncodeMessage(msg)
 	if err != nil {
 		return err
 	}
-	modified := *msg
+	now := time.Now()
+	modified := base.RecordError(msg, errMsg, now)
 	modified.Retried++
-	modified.ErrorMsg = errMsg
-	bytesToAdd, err := json.Marshal(&modified)
+	modified.Queue = qname
+	bytesToAdd, err := base.EncodeMessage(modified)
 	if err != nil {
 		return err
 	}
-	now := time.Now()
-	processedKey := base.ProcessedKey(now)
-	failureKey := base.FailureKey(now)
+	processedKey := r.keys.ProcessedKey(now)
+	failureKey := r.keys.FailureKey(now)
 	expireAt := now.Add(statsTTL)
 	return retryCmd.Run(r.client,
-		[]string{base.InProgressQueue, base.RetryQueue, processedKey, failureKey},
+		[]string{r.keys.InProgressQueue, r.keys.RetryQueue, processedKey, failureKey, r.keys.Leases, r.keys.Rollups},
 		string(bytesToRemove), string(bytesToAdd), processAt.Unix(), expireAt.Unix()).Err()
 }
 
+// KEYS[1] -> {asynq}:in_progress
+// KEYS[2] -> {asynq}:retry
+// KEYS[3] -> {asynq}:leases
+// KEYS[4] -> {asynq}:rollups
+// ARGV[1] -> base.TaskMessage value
+// ARGV[2] -> retry_at UNIX timestamp
+var postponeCmd = redis.NewScript(rollupsLua + `
+local x = redis.call("LREM", KEYS[1], 0, ARGV[1])
+redis.call("ZREM", KEYS[3], ARGV[1])
+if tonumber(x) == 0 then
+	return redis.status_reply("OK")
+end
+redis.call("ZADD", KEYS[2], ARGV[2], ARGV[1])
+moveRollups(KEYS[4], ARGV[1], "inprogress", "retry")
+return redis.status_reply("OK")`)
+
+// Postpone moves the task from in-progress to retry queue to be processed
+// at the given time, without incrementing retry count.
+func (r *RDB) Postpone(msg *base.TaskMessage, processAt time.Time) error {
+	bytes, err := base.EncodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	return postponeCmd.Run(r.client,
+		[]string{r.keys.InProgressQueue, r.keys.RetryQueue, r.keys.Leases, r.keys.Rollups},
+		string(bytes), processAt.Unix()).Err()
+}
+
 const (
 	maxDeadTasks         = 10000
 	deadExpirationInDays = 90
 )
 
-// KEYS[1] -> asynq:in_progress
-// KEYS[2] -> asynq:dead
-// KEYS[3] -> asynq:processed:<yyyy-mm-dd>
-// KEYS[4] -> asynq.failure:<yyyy-mm-dd>
-// ARGV[1] -> base.TaskMessage value to remove from base.InProgressQueue queue
+// KEYS[1] -> {asynq}:in_progress
+// KEYS[2] -> {asynq}:dead
+// KEYS[3] -> {asynq}:processed:<yyyy-mm-dd>
+// KEYS[4] -> {asynq}:failure:<yyyy-mm-dd>
+// KEYS[5] -> {asynq}:leases
+// KEYS[6] -> {asynq}:rollups
+// ARGV[1] -> base.TaskMessage value to remove from InProgress queue
 // ARGV[2] -> base.TaskMessage value to add to Dead queue
 // ARGV[3] -> died_at UNIX timestamp
 // ARGV[4] -> cutoff timestamp (e.g., 90 days ago)
 // ARGV[5] -> max number of tasks in dead queue (e.g., 100)
 // ARGV[6] -> stats expiration timestamp
-var killCmd = redis.NewScript(`
-redis.call("LREM", KEYS[1], 0, ARGV[1])
+var killCmd = redis.NewScript(rollupsLua + `
+local from = ""
+if redis.call("LREM", KEYS[1], 0, ARGV[1]) > 0 then
+	from = "inprogress"
+end
+redis.call("ZREM", KEYS[5], ARGV[1])
 redis.call("ZADD", KEYS[2], ARGV[3], ARGV[2])
+moveRollups(KEYS[6], ARGV[1], from, "dead", ARGV[2])
 redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", ARGV[4])
-redis.call("ZREMRANGEBYRANK", KEYS[2], 0, -ARGV[5])
+redis.call("ZREMRANGEBYRANK", KEYS[2], 0, -tonumber(ARGV[5]) - 1)
 local n = redis.call("INCR", KEYS[3])
 if tonumber(n) == 1 then
 	redis.call("EXPIREAT", KEYS[3], ARGV[6])
@@ -254,42 +909,78 @@ return redis.status_reply("OK")`)
 // the error message to the task.
 // It also trims the set by timestamp and set size.
 func (r *RDB) Kill(msg *base.TaskMessage, errMsg string) error {
-	bytesToRemove, err := json.Marshal(msg)
+	bytesToRemove, err := base.EncodeMessage(msg)
 	if err != nil {
 		return err
 	}
-	modified := *msg
-	modified.ErrorMsg = errMsg
-	bytesToAdd, err := json.Marshal(&modified)
+	now := r.clock.Now()
+	modified := base.RecordError(msg, errMsg, now)
+	bytesToAdd, err := base.EncodeMessage(modified)
 	if err != nil {
 		return err
 	}
-	now := time.Now()
-	limit := now.AddDate(0, 0, -deadExpirationInDays).Unix() // 90 days ago
-	processedKey := base.ProcessedKey(now)
-	failureKey := base.FailureKey(now)
-	expireAt := now.Add(statsTTL)
+	limit, maxSize := r.deadLimits(now)
+	// stats expire in real time.
+	statsAt := time.Now()
+	processedKey := r.keys.ProcessedKey(statsAt)
+	failureKey := r.keys.FailureKey(statsAt)
+	expireAt := statsAt.Add(statsTTL)
 	return killCmd.Run(r.client,
-		[]string{base.InProgressQueue, base.DeadQueue, processedKey, failureKey},
-		string(bytesToRemove), string(bytesToAdd), now.Unix(), limit, maxDeadTasks, expireAt.Unix()).Err()
+		[]string{r.keys.InProgressQueue, r.keys.DeadQueue, processedKey, failureKey, r.keys.Leases, r.keys.Rollups},
+		string(bytesToRemove), string(bytesToAdd), now.Unix(), limit, maxSize, expireAt.Unix()).Err()
+}
+
+// KEYS[1] -> {asynq}:dead
+// ARGV[1] -> cutoff timestamp (e.g., 90 days ago)
+// ARGV[2] -> max number of tasks in dead queue (e.g., 100)
+var trimDeadCmd = redis.NewScript(`
+local n = redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+return n + redis.call("ZREMRANGEBYRANK", KEYS[1], 0, -tonumber(ARGV[2]) - 1)`)
+
+// TrimDead deletes the tasks killed before maxAge ago from the dead queue,
+// and then the oldest tasks beyond maxSize, and returns the number of tasks
+// deleted. Zero or negative values use the limits set by SetDeadRetention.
+func (r *RDB) TrimDead(maxSize int, maxAge time.Duration) (int64, error) {
+	now := r.clock.Now()
+	limit, size := r.deadLimits(now)
+	if maxSize > 0 {
+		size = maxSize
+	}
+	if maxAge > 0 {
+		limit = now.Add(-maxAge).Unix()
+	}
+	return trimDeadCmd.Run(r.client, []string{r.keys.DeadQueue}, limit, size).Int64()
 }
 
-// KEYS[1] -> asynq:in_progress
+// KEYS[1] -> {asynq}:in_progress
+// KEYS[2] -> {asynq}:leases
+// KEYS[3] -> {asynq}:rollups
 // ARGV[1] -> queue prefix
-var requeueAllCmd = redis.NewScript(`
+// ARGV[2] -> wake channel to publish the queue names to, or empty string
+var requeueAllCmd = redis.NewScript(rollupsLua + `
 local msgs = redis.call("LRANGE", KEYS[1], 0, -1)
+local qnames = {}
 for _, msg in ipairs(msgs) do
-	local decoded = cjson.decode(msg)
+	local decoded = decodeMessage(msg)
 	local qkey = ARGV[1] .. decoded["Queue"]
 	redis.call("RPUSH", qkey, msg)
 	redis.call("LREM", KEYS[1], 0, msg)
+	moveRollups(KEYS[3], msg, "inprogress", "enqueued")
+	qnames[decoded["Queue"]] = true
 end
+if ARGV[2] ~= "" then
+	for qname in pairs(qnames) do
+		redis.call("PUBLISH", ARGV[2], qname)
+	end
+end
+redis.call("DEL", KEYS[2])
 return table.getn(msgs)`)
 
 // RequeueAll moves all tasks from in-progress list to the queue
 // and reports the number of tasks restored.
 func (r *RDB) RequeueAll() (int64, error) {
-	res, err := requeueAllCmd.Run(r.client, []string{base.InProgressQueue}, base.QueuePrefix).Result()
+	res, err := requeueAllCmd.Run(r.client, []string{r.keys.InProgressQueue, r.keys.Leases, r.keys.Rollups},
+		r.keys.QueuePrefix, r.wakeChannel()).Result()
 	if err != nil {
 		return 0, err
 	}
@@ -300,67 +991,536 @@ func (r *RDB) RequeueAll() (int64, error) {
 	return n, nil
 }
 
+// AddCosts adds the costs reported by the handler of the task, by
+// resource name, to the costs of its type and of its rollup dimension
+// values for today.
+//
+// Costs are stored in a hash per day with fields formatted as
+// "type:<type>:<resource>" and "dimension:<dimension>:<value>:<resource>".
+func (r *RDB) AddCosts(msg *base.TaskMessage, costs map[string]float64) error {
+	if len(costs) == 0 {
+		return nil
+	}
+	now := time.Now()
+	key := r.keys.CostsKey(now)
+	_, err := r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for resource, amount := range costs {
+			pipe.HIncrByFloat(key, costTypeField(msg.Type, resource), amount)
+			for dim, val := range msg.Dimensions {
+				pipe.HIncrByFloat(key, costDimensionField(dim, val, resource), amount)
+			}
+		}
+		pipe.ExpireAt(key, now.Add(statsTTL))
+		return nil
+	})
+	return err
+}
+
+// LatencyRetention is how long the latency histograms are kept.
+const LatencyRetention = 24 * time.Hour
+
+// AddLatencies adds the durations the task waited in its queue and took
+// to process to the latency histograms of its queue and type for the
+// current minute. wait is ignored if it's negative.
+//
+// Histograms are stored in a hash per minute with fields formatted as
+// "wait:<bucket>:<queue>:<type>" and "run:<bucket>:<queue>:<type>".
+func (r *RDB) AddLatencies(msg *base.TaskMessage, wait, run time.Duration) error {
+	now := time.Now()
+	key := r.keys.LatencyKey(now)
+	_, err := r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		if wait >= 0 {
+			pipe.HIncrBy(key, latencyField("wait", wait, msg), 1)
+		}
+		pipe.HIncrBy(key, latencyField("run", run, msg), 1)
+		pipe.ExpireAt(key, now.Add(LatencyRetention))
+		return nil
+	})
+	return err
+}
+
+func latencyField(kind string, d time.Duration, msg *base.TaskMessage) string {
+	return kind + ":" + strconv.Itoa(latencyBucket(d)) + ":" + msg.Queue + ":" + msg.Type
+}
+
+// latencyBucket returns the index of the histogram bucket for d.
+//
+// Bucket i counts the durations up to latencyBucketBound(i), and greater
+// than the bound of the previous bucket. Bounds grow by a factor of 2^(1/4)
+// from a millisecond, so that the percentiles read from the histograms are
+// at most 19% greater than the actual values.
+func latencyBucket(d time.Duration) int {
+	if d <= time.Millisecond {
+		return 0
+	}
+	return int(math.Ceil(4 * math.Log2(float64(d)/float64(time.Millisecond))))
+}
+
+// latencyBucketBound returns the upper bound of the histogram bucket i.
+func latencyBucketBound(i int) time.Duration {
+	return time.Duration(float64(time.Millisecond) * math.Pow(2, float64(i)/4))
+}
+
+// SetResult stores the pointer to the result of the task with the given id,
+// which expires after ttl.
+func (r *RDB) SetResult(id string, res *base.TaskResult, ttl time.Duration) error {
+	bytes, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(r.keys.ResultKey(id), bytes, ttl).Err()
+}
+
+// SetProgress stores the progress of the task with the given id,
+// which expires after ttl.
+func (r *RDB) SetProgress(id string, p *base.TaskProgress, ttl time.Duration) error {
+	bytes, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(r.keys.ProgressKey(id), bytes, ttl).Err()
+}
+
+func costTypeField(typename, resource string) string {
+	return "type:" + typename + ":" + resource
+}
+
+func costDimensionField(dimension, value, resource string) string {
+	return "dimension:" + dimension + ":" + value + ":" + resource
+}
+
+// ExtendLeases sets the expiration of the leases of in-progress tasks
+// with a single command. Tasks without a lease are ignored, since they
+// have been removed from the in-progress list.
+func (r *RDB) ExtendLeases(leases []*base.Lease) error {
+	if len(leases) == 0 {
+		return nil
+	}
+	members := make([]*redis.Z, 0, len(leases))
+	for _, l := range leases {
+		bytes, err := base.EncodeMessage(l.Msg)
+		if err != nil {
+			return err
+		}
+		members = append(members, &redis.Z{Member: string(bytes), Score: float64(l.ExpireAt.Unix())})
+	}
+	return r.client.ZAddXX(r.keys.Leases, members...).Err()
+}
+
+// KEYS[1] -> {asynq}:in_progress
+// KEYS[2] -> {asynq}:leases
+// ARGV[1] -> lease expiration timestamp
+var leaseOrphansCmd = redis.NewScript(`
+local n = 0
+local msgs = redis.call("LRANGE", KEYS[1], 0, -1)
+for _, msg in ipairs(msgs) do
+	if not redis.call("ZSCORE", KEYS[2], msg) then
+		redis.call("ZADD", KEYS[2], ARGV[1], msg)
+		n = n + 1
+	end
+end
+return n`)
+
+// KEYS[1] -> {asynq}:leases
+// KEYS[2] -> {asynq}:in_progress
+// KEYS[3] -> {asynq}:retry or {asynq}:dead
+// ARGV[1] -> base.TaskMessage value to remove from in-progress list
+// ARGV[2] -> base.TaskMessage value to add to KEYS[3]
+// ARGV[3] -> score of the task in KEYS[3]
+// ARGV[4] -> current UNIX timestamp
+// ARGV[5] -> cutoff timestamp of dead tasks (only for dead)
+// ARGV[6] -> max number of dead tasks (only for dead)
+// KEYS[4] -> {asynq}:rollups
+// KEYS[5] -> {asynq}:workflows:<workflow id> (only for dead workflow steps)
+// ARGV[7] -> step name (only for dead workflow steps)
+// ARGV[8] -> workflow retention in seconds (only for dead workflow steps)
+//
+// Leases extended after they were read are left alone.
+var recoverCmd = redis.NewScript(failWorkflowStepLua + rollupsLua + `
+local expireAt = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if not expireAt or tonumber(expireAt) > tonumber(ARGV[4]) then
+	return 0
+end
+redis.call("ZREM", KEYS[1], ARGV[1])
+if redis.call("LREM", KEYS[2], 1, ARGV[1]) == 0 then
+	return 0
+end
+redis.call("ZADD", KEYS[3], ARGV[3], ARGV[2])
+if ARGV[5] then
+	redis.call("ZREMRANGEBYSCORE", KEYS[3], "-inf", ARGV[5])
+	redis.call("ZREMRANGEBYRANK", KEYS[3], 0, -tonumber(ARGV[6]) - 1)
+	moveRollups(KEYS[4], ARGV[1], "inprogress", "dead", ARGV[2])
+else
+	moveRollups(KEYS[4], ARGV[1], "inprogress", "retry", ARGV[2])
+end
+if KEYS[5] then
+	failWorkflowStep(KEYS[5], ARGV[7], ARGV[8])
+end
+return 1`)
+
+// leaseExpiredMsg is the error message assigned to the tasks
+// recovered by RecoverExpiredLeases.
+const leaseExpiredMsg = "lease expired: the worker processing the task stopped responding"
+
+// RecoverExpiredLeases moves the in-progress tasks whose leases have
+// expired to the retry queue to be processed again immediately, or to the
+// dead queue if they have exhausted their retries, and reports the number
+// of tasks recovered. The workflow steps moved to the dead queue fail.
+//
+// In-progress tasks without a lease are leased for base.LeaseDuration,
+// so that they are recovered by a later call unless their lease is extended.
+func (r *RDB) RecoverExpiredLeases() (int, error) {
+	now := time.Now()
+	err := leaseOrphansCmd.Run(r.client, []string{r.keys.InProgressQueue, r.keys.Leases},
+		now.Add(base.LeaseDuration).Unix()).Err()
+	if err != nil {
+		return 0, err
+	}
+	data, err := r.client.ZRangeByScore(r.keys.Leases, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.Unix(), 10),
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, s := range data {
+		msg, err := base.DecodeMessage([]byte(s))
+		if err != nil {
+			continue // bad data, ignore and continue
+		}
+		modified := base.RecordError(msg, leaseExpiredMsg, now)
+		keys := []string{r.keys.Leases, r.keys.InProgressQueue, r.keys.RetryQueue, r.keys.Rollups}
+		args := []interface{}{s, "", now.Unix(), now.Unix()}
+		if msg.Retried >= msg.Retry {
+			keys[2] = r.keys.DeadQueue
+			limit, maxSize := r.deadLimits(now)
+			args = append(args, limit, maxSize)
+			if msg.WorkflowID != "" {
+				keys = append(keys, r.keys.WorkflowKey(msg.WorkflowID))
+				args = append(args, msg.WorkflowStep, int(WorkflowRetention.Seconds()))
+			}
+		} else {
+			modified.Retried++
+			modified.Recovered++
+		}
+		bytes, err := base.EncodeMessage(modified)
+		if err != nil {
+			return n, err
+		}
+		args[1] = string(bytes)
+		res, err := recoverCmd.Run(r.client, keys, args...).Int()
+		if err != nil {
+			return n, err
+		}
+		n += res
+	}
+	return n, nil
+}
+
 // CheckAndEnqueue checks for all scheduled tasks and enqueues any tasks that
 // have to be processed.
 //
-// qnames specifies to which queues to send tasks.
+// Each task is sent to the queue in its message regardless of qnames, even
+// if the background serves one queue, since the tasks of the other queues
+// (e.g. the queues of other regions) are scheduled in the same zsets.
+//
+// Tasks are moved in batches of forwardBatchSize, each in a single script,
+// so that redis keeps serving other clients while a large number of tasks
+// come due at once.
 func (r *RDB) CheckAndEnqueue(qnames ...string) error {
-	delayed := []string{base.ScheduledQueue, base.RetryQueue}
+	delayed := []string{r.keys.ScheduledQueue, r.keys.RetryQueue}
 	for _, zset := range delayed {
-		var err error
-		if len(qnames) == 1 {
-			err = r.forwardSingle(zset, base.QueueKey(qnames[0]))
-		} else {
-			err = r.forward(zset)
-		}
-		if err != nil {
-			return err
+		for {
+			n, err := r.forward(zset, forwardBatchSize)
+			if err != nil {
+				return err
+			}
+			if n < forwardBatchSize {
+				break
+			}
 		}
 	}
 	return nil
 }
 
+// number of tasks to move at a time from the scheduled and retry queues.
+const forwardBatchSize = 1000
+
 // KEYS[1] -> source queue (e.g. scheduled or retry queue)
+// KEYS[2] -> {asynq}:queues
+// KEYS[3] -> {asynq}:rollups
 // ARGV[1] -> current unix time
 // ARGV[2] -> queue prefix
-var forwardCmd = redis.NewScript(`
-local msgs = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+// ARGV[3] -> batch size
+// ARGV[4] -> wake channel to publish the queue names to, or empty string
+// ARGV[5] -> state of the tasks in the source queue (e.g. "scheduled")
+//
+// Every queue a task is moved to is added to KEYS[2], since the queue of
+// a retried task may not be known yet (e.g. the slow retry queue).
+var forwardCmd = redis.NewScript(rollupsLua + `
+local msgs = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, tonumber(ARGV[3]))
+if #msgs == 0 then
+	return 0
+end
+local byQueue = {}
 for _, msg in ipairs(msgs) do
-	local decoded = cjson.decode(msg)
-	local qkey = ARGV[2] .. decoded["Queue"]
-	redis.call("LPUSH", qkey, msg)
-	redis.call("ZREM", KEYS[1], msg)
+	local qname = decodeMessage(msg)["Queue"]
+	moveRollups(KEYS[3], msg, ARGV[5], "enqueued")
+	if byQueue[qname] == nil then
+		byQueue[qname] = {}
+	end
+	table.insert(byQueue[qname], msg)
+end
+for qname, batch in pairs(byQueue) do
+	local qkey = ARGV[2] .. qname
+	redis.call("LPUSH", qkey, unpack(batch))
+	redis.call("SADD", KEYS[2], qkey)
+	if ARGV[4] ~= "" then
+		redis.call("PUBLISH", ARGV[4], qname)
+	end
 end
-return msgs`)
+redis.call("ZREM", KEYS[1], unpack(msgs))
+return #msgs`)
 
-// forward moves all tasks with a score less than the current unix time
-// from the src zset.
-func (r *RDB) forward(src string) error {
-	now := float64(time.Now().Unix())
-	return forwardCmd.Run(r.client,
-		[]string{src}, now, base.QueuePrefix).Err()
+// forward moves up to batch tasks with a score less than the current unix
+// time from the src zset, and returns the number of tasks moved.
+func (r *RDB) forward(src string, batch int) (int, error) {
+	now := float64(r.clock.Now().Unix())
+	return forwardCmd.Run(r.client, []string{src, r.keys.AllQueues, r.keys.Rollups},
+		now, r.keys.QueuePrefix, batch, r.wakeChannel(), r.zsetState(src)).Int()
 }
 
-// KEYS[1] -> source queue (e.g. scheduled or retry queue)
-// KEYS[2] -> destination queue
-var forwardSingleCmd = redis.NewScript(`
-local msgs = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
-for _, msg in ipairs(msgs) do
-	redis.call("LPUSH", KEYS[2], msg)
-	redis.call("ZREM", KEYS[1], msg)
+// zsetState returns the state of the tasks in the given zset.
+func (r *RDB) zsetState(zset string) string {
+	switch zset {
+	case r.keys.ScheduledQueue:
+		return "scheduled"
+	case r.keys.RetryQueue:
+		return "retry"
+	case r.keys.DeadQueue:
+		return "dead"
+	case r.keys.CompletedQueue:
+		return "completed"
+	}
+	return ""
+}
+
+// stateZSet returns the zset of the tasks in the given state, or an empty
+// string if the tasks in the state are not in a zset.
+func (r *RDB) stateZSet(state string) string {
+	switch state {
+	case "scheduled":
+		return r.keys.ScheduledQueue
+	case "retry":
+		return r.keys.RetryQueue
+	case "dead":
+		return r.keys.DeadQueue
+	case "completed":
+		return r.keys.CompletedQueue
+	}
+	return ""
+}
+
+// SeedQueueWeights writes the given weights of queues to redis,
+// except for the queues whose weights are already set.
+func (r *RDB) SeedQueueWeights(weights map[string]int) error {
+	if len(weights) == 0 {
+		return nil
+	}
+	_, err := r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for qname, w := range weights {
+			pipe.HSetNX(r.keys.QueueWeights, qname, w)
+		}
+		return nil
+	})
+	return err
+}
+
+// SetQueueWeight sets the weight of the given queue.
+func (r *RDB) SetQueueWeight(qname string, weight int) error {
+	return r.client.HSet(r.keys.QueueWeights, qname, weight).Err()
+}
+
+// QueueWeights returns the weights of queues stored in redis.
+func (r *RDB) QueueWeights() (map[string]int, error) {
+	data, err := r.client.HGetAll(r.keys.QueueWeights).Result()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]int)
+	for qname, s := range data {
+		w, err := strconv.Atoi(s)
+		if err != nil {
+			continue // bad data, ignore and continue
+		}
+		res[qname] = w
+	}
+	return res, nil
+}
+
+// number of kill switch events to keep in the log.
+const killSwitchLogSize = 100
+
+// KEYS[1] -> {asynq}:killswitch
+// KEYS[2] -> {asynq}:killswitch:log
+// ARGV[1] -> kill switch in JSON
+// ARGV[2] -> TTL in milliseconds
+// ARGV[3] -> event in JSON
+// ARGV[4] -> log size
+var engageKillSwitchCmd = redis.NewScript(`
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+redis.call("LPUSH", KEYS[2], ARGV[3])
+redis.call("LTRIM", KEYS[2], 0, tonumber(ARGV[4]) - 1)
+return redis.status_reply("OK")`)
+
+// EngageKillSwitch engages the kill switch until ks.Expires,
+// replacing the kill switch already engaged if any, and records
+// the change in the kill switch log.
+func (r *RDB) EngageKillSwitch(ks *base.KillSwitch) error {
+	ttl := time.Until(ks.Expires)
+	if ttl <= 0 {
+		return fmt.Errorf("kill switch should expire in the future, got %v", ks.Expires)
+	}
+	bytes, err := json.Marshal(ks)
+	if err != nil {
+		return err
+	}
+	event, err := json.Marshal(&base.KillSwitchEvent{
+		Action:  "on",
+		Reason:  ks.Reason,
+		By:      ks.By,
+		Time:    ks.Engaged,
+		Expires: ks.Expires,
+	})
+	if err != nil {
+		return err
+	}
+	return engageKillSwitchCmd.Run(r.client,
+		[]string{r.keys.KillSwitchKey, r.keys.KillSwitchLog},
+		string(bytes), ttl.Milliseconds(), string(event), killSwitchLogSize).Err()
+}
+
+// KEYS[1] -> {asynq}:killswitch
+// KEYS[2] -> {asynq}:killswitch:log
+// ARGV[1] -> event in JSON
+// ARGV[2] -> log size
+var disengageKillSwitchCmd = redis.NewScript(`
+if redis.call("DEL", KEYS[1]) == 0 then
+	return 0
 end
-return msgs`)
+redis.call("LPUSH", KEYS[2], ARGV[1])
+redis.call("LTRIM", KEYS[2], 0, tonumber(ARGV[2]) - 1)
+return 1`)
 
-// forwardSingle moves all tasks with a score less than the current unix time
-// from the src zset to dst list.
-func (r *RDB) forwardSingle(src, dst string) error {
-	now := float64(time.Now().Unix())
-	return forwardSingleCmd.Run(r.client,
-		[]string{src, dst}, now).Err()
+// DisengageKillSwitch disengages the kill switch and records the change
+// in the kill switch log. It reports whether the kill switch was engaged.
+func (r *RDB) DisengageKillSwitch(by string) (bool, error) {
+	event, err := json.Marshal(&base.KillSwitchEvent{
+		Action: "off",
+		By:     by,
+		Time:   time.Now(),
+	})
+	if err != nil {
+		return false, err
+	}
+	n, err := disengageKillSwitchCmd.Run(r.client,
+		[]string{r.keys.KillSwitchKey, r.keys.KillSwitchLog},
+		string(event), killSwitchLogSize).Int()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
 }
 
-// KEYS[1] -> asynq:ps
-// KEYS[2] -> asynq:ps:<host:pid>
+// KillSwitch returns the kill switch if it's engaged, or nil otherwise.
+func (r *RDB) KillSwitch() (*base.KillSwitch, error) {
+	data, err := r.client.Get(r.keys.KillSwitchKey).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ks base.KillSwitch
+	if err := json.Unmarshal([]byte(data), &ks); err != nil {
+		return nil, err
+	}
+	return &ks, nil
+}
+
+// KillSwitchLog returns up to n most recent changes to the kill switch,
+// most recent first.
+func (r *RDB) KillSwitchLog(n int) ([]*base.KillSwitchEvent, error) {
+	data, err := r.client.LRange(r.keys.KillSwitchLog, 0, int64(n-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var events []*base.KillSwitchEvent
+	for _, s := range data {
+		var e base.KillSwitchEvent
+		if err := json.Unmarshal([]byte(s), &e); err != nil {
+			continue // bad data, ignore and continue
+		}
+		events = append(events, &e)
+	}
+	return events, nil
+}
+
+// SetDependencyDown marks the named dependency as down for ttl, or extends
+// the outage to ttl from now if the dependency is already down.
+func (r *RDB) SetDependencyDown(name string, ttl time.Duration) error {
+	return r.client.Set(r.keys.DependencyKey(name), r.clock.Now().Unix(), ttl).Err()
+}
+
+// ClearDependencyDown marks the named dependency as recovered.
+func (r *RDB) ClearDependencyDown(name string) error {
+	return r.client.Del(r.keys.DependencyKey(name)).Err()
+}
+
+// DependenciesDown returns the names of the given dependencies which are down.
+func (r *RDB) DependenciesDown(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = r.keys.DependencyKey(name)
+	}
+	vals, err := r.client.MGet(keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	var down []string
+	for i, v := range vals {
+		if v != nil {
+			down = append(down, names[i])
+		}
+	}
+	return down, nil
+}
+
+// EnqueueCanary schedules the canary task to be processed now, so that
+// it's enqueued by the forwarder like any scheduled task, and records the
+// time it was enqueued and how long after its completion the canary is
+// considered stale.
+func (r *RDB) EnqueueCanary(msg *base.TaskMessage, maxAge time.Duration) error {
+	if err := r.Schedule(msg, r.clock.Now()); err != nil {
+		return err
+	}
+	return r.client.HMSet(r.keys.Canary, map[string]interface{}{
+		"enqueued": time.Now().Unix(),
+		"max_age":  int64(maxAge / time.Second),
+	}).Err()
+}
+
+// CompleteCanary records that a canary task was completed.
+func (r *RDB) CompleteCanary() error {
+	return r.client.HSet(r.keys.Canary, "completed", time.Now().Unix()).Err()
+}
+
+// KEYS[1] -> {asynq}:ps
+// KEYS[2] -> {asynq}:ps:<host:pid>
 // ARGV[1] -> expiration time
 // ARGV[2] -> TTL in seconds
 // ARGV[3] -> process info
@@ -379,13 +1539,37 @@ func (r *RDB) WriteProcessInfo(ps *base.ProcessInfo, ttl time.Duration) error {
 	// Note: Add key to ZSET with expiration time as score.
 	// ref: https://github.com/antirez/redis/issues/135#issuecomment-2361996
 	exp := time.Now().Add(ttl).UTC()
-	key := base.ProcessInfoKey(ps.Host, ps.PID)
-	return writeProcessInfoCmd.Run(r.client, []string{base.AllProcesses, key}, float64(exp.Unix()), ttl.Seconds(), string(bytes)).Err()
+	key := r.keys.ProcessInfoKey(ps.Host, ps.PID)
+	return writeProcessInfoCmd.Run(r.client, []string{r.keys.AllProcesses, key}, float64(exp.Unix()), ttl.Seconds(), string(bytes)).Err()
+}
+
+// KEYS[1] -> {asynq}:ps
+// KEYS[2] -> {asynq}:ps:<host:pid>
+// ARGV[1] -> expiration time
+// ARGV[2] -> TTL in milliseconds
+var refreshProcessInfoCmd = redis.NewScript(`
+if redis.call("PEXPIRE", KEYS[2], ARGV[2]) == 0 then
+	return 0
+end
+redis.call("ZADD", KEYS[1], ARGV[1], KEYS[2])
+return 1`)
+
+// RefreshProcessInfo sets the expiration of the process information written
+// by WriteProcessInfo to the value ttl without rewriting it. It reports false
+// if the information has expired, in which case it should be written again.
+func (r *RDB) RefreshProcessInfo(ps *base.ProcessInfo, ttl time.Duration) (bool, error) {
+	exp := time.Now().Add(ttl).UTC()
+	key := r.keys.ProcessInfoKey(ps.Host, ps.PID)
+	n, err := refreshProcessInfoCmd.Run(r.client, []string{r.keys.AllProcesses, key}, float64(exp.Unix()), ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
 }
 
 // ReadProcessInfo reads process information stored in redis.
 func (r *RDB) ReadProcessInfo(host string, pid int) (*base.ProcessInfo, error) {
-	key := base.ProcessInfoKey(host, pid)
+	key := r.keys.ProcessInfoKey(host, pid)
 	data, err := r.client.Get(key).Result()
 	if err != nil {
 		return nil, err
@@ -398,8 +1582,8 @@ func (r *RDB) ReadProcessInfo(host string, pid int) (*base.ProcessInfo, error) {
 	return &pinfo, nil
 }
 
-// KEYS[1] -> asynq:ps
-// KEYS[2] -> asynq:ps:<host:pid>
+// KEYS[1] -> {asynq}:ps
+// KEYS[2] -> {asynq}:ps:<host:pid>
 var clearProcessInfoCmd = redis.NewScript(`
 redis.call("ZREM", KEYS[1], KEYS[2])
 redis.call("DEL", KEYS[2])
@@ -407,22 +1591,206 @@ return redis.status_reply("OK")`)
 
 // ClearProcessInfo deletes process information from redis.
 func (r *RDB) ClearProcessInfo(ps *base.ProcessInfo) error {
-	key := base.ProcessInfoKey(ps.Host, ps.PID)
-	return clearProcessInfoCmd.Run(r.client, []string{base.AllProcesses, key}).Err()
+	key := r.keys.ProcessInfoKey(ps.Host, ps.PID)
+	return clearProcessInfoCmd.Run(r.client, []string{r.keys.AllProcesses, key}).Err()
 }
 
-// CancelationPubSub returns a pubsub for cancelation messages.
-func (r *RDB) CancelationPubSub() (*redis.PubSub, error) {
-	pubsub := r.client.Subscribe(base.CancelChannel)
+// CancelationPubSub returns a subscription for cancelation messages.
+func (r *RDB) CancelationPubSub() (base.Subscription, error) {
+	pubsub := r.client.Subscribe(r.keys.CancelChannel)
 	_, err := pubsub.Receive()
 	if err != nil {
 		return nil, err
 	}
-	return pubsub, nil
+	return newSubscription(pubsub), nil
 }
 
 // PublishCancelation publish cancelation message to all subscribers.
 // The message is the ID for the task to be canceled.
 func (r *RDB) PublishCancelation(id string) error {
-	return r.client.Publish(base.CancelChannel, id).Err()
+	return r.client.Publish(r.keys.CancelChannel, id).Err()
+}
+
+// ControlPubSub returns a subscription for control messages.
+func (r *RDB) ControlPubSub() (base.Subscription, error) {
+	pubsub := r.client.Subscribe(r.keys.ControlChannel)
+	_, err := pubsub.Receive()
+	if err != nil {
+		return nil, err
+	}
+	return newSubscription(pubsub), nil
+}
+
+// subscription implements base.Subscription with a redis pubsub.
+type subscription struct {
+	pubsub *redis.PubSub
+	ch     chan string
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newSubscription(pubsub *redis.PubSub) *subscription {
+	s := &subscription{
+		pubsub: pubsub,
+		ch:     make(chan string),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		for m := range pubsub.Channel() {
+			select {
+			case s.ch <- m.Payload:
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func (s *subscription) Channel() <-chan string {
+	return s.ch
+}
+
+func (s *subscription) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return s.pubsub.Close()
+}
+
+// PublishControl publishes control message to all subscribers.
+func (r *RDB) PublishControl(msg *base.ControlMessage) error {
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return r.client.Publish(r.keys.ControlChannel, string(bytes)).Err()
+}
+
+// ControlReplyPubSub returns a pubsub for replies to the control message
+// with the given id.
+//
+// Caller should subscribe before publishing the control message to
+// avoid missing any replies.
+func (r *RDB) ControlReplyPubSub(id string) (*redis.PubSub, error) {
+	pubsub := r.client.Subscribe(r.keys.ControlReplyChannel(id))
+	_, err := pubsub.Receive()
+	if err != nil {
+		return nil, err
+	}
+	return pubsub, nil
+}
+
+// WakePubSub returns a pubsub for the names of the queues
+// to which tasks are enqueued.
+func (r *RDB) WakePubSub() (*redis.PubSub, error) {
+	pubsub := r.client.Subscribe(r.keys.WakeChannel)
+	_, err := pubsub.Receive()
+	if err != nil {
+		return nil, err
+	}
+	return pubsub, nil
+}
+
+// PublishControlReply publishes a reply to the control message with the given id.
+func (r *RDB) PublishControlReply(id string, reply *base.ControlReply) error {
+	bytes, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	return r.client.Publish(r.keys.ControlReplyChannel(id), string(bytes)).Err()
+}
+
+// KEYS[1] -> {asynq}:lock:<name>
+// ARGV[1] -> lock token
+// ARGV[2] -> ttl in milliseconds
+var lockCmd = redis.NewScript(`
+local token = redis.call("GET", KEYS[1])
+if token == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+if token then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1`)
+
+// Lock acquires the named lock for the ttl, or extends the ttl if the lock
+// is already held by this RDB, and reports whether the lock is held.
+func (r *RDB) Lock(name string, ttl time.Duration) (bool, error) {
+	res, err := lockCmd.Run(r.client, []string{r.keys.LockKey(name)},
+		r.lockToken, ttl.Milliseconds()).Result()
+	if err != nil {
+		return false, err
+	}
+	n, ok := res.(int64)
+	if !ok {
+		return false, fmt.Errorf("could not cast %v to int64", res)
+	}
+	return n == 1, nil
+}
+
+// KEYS[1] -> {asynq}:lock:<name>
+// ARGV[1] -> lock token
+var unlockCmd = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("DEL", KEYS[1])
+end
+return redis.status_reply("OK")`)
+
+// Unlock releases the named lock if it's held by this RDB.
+func (r *RDB) Unlock(name string) error {
+	return unlockCmd.Run(r.client, []string{r.keys.LockKey(name)}, r.lockToken).Err()
+}
+
+// KEYS[1] -> {asynq}:ratelimit:<name>
+// ARGV[1] -> capacity of the bucket
+// ARGV[2] -> interval between tokens in milliseconds
+// ARGV[3] -> current unix time in milliseconds
+//
+// Returns the number of milliseconds to wait for a token, or zero
+// if a token was taken.
+var takeTokenCmd = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+	tokens = capacity
+	ts = now
+end
+if now > ts then
+	tokens = math.min(capacity, tokens + (now - ts) / interval)
+	ts = now
+end
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) * interval)
+end
+redis.call("HMSET", KEYS[1], "tokens", tokens, "ts", ts)
+redis.call("PEXPIRE", KEYS[1], math.ceil(capacity * interval) + 1000)
+return wait`)
+
+// TakeToken takes a token from the named token bucket shared by all
+// clients of the redis instance, which holds up to limit tokens and is
+// refilled with limit tokens per the given duration.
+//
+// It returns zero if a token was taken, or how long to wait for a token
+// otherwise.
+func (r *RDB) TakeToken(name string, limit int, per time.Duration) (time.Duration, error) {
+	interval := float64(per) / float64(limit) / float64(time.Millisecond)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	res, err := takeTokenCmd.Run(r.client, []string{r.keys.RateLimitKey(name)},
+		limit, strconv.FormatFloat(interval, 'f', -1, 64), now).Result()
+	if err != nil {
+		return 0, err
+	}
+	n, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("could not cast %v to int64", res)
+	}
+	return time.Duration(n) * time.Millisecond, nil
 }
@@ -68,6 +68,228 @@ func TestEnqueue(t *testing.T) {
 	}
 }
 
+func TestDequeueN(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("send_email", nil)
+	t3 := h.NewTaskMessageWithQueue("export_csv", nil, "low")
+	t4 := h.NewTaskMessageWithQueue("export_csv", nil, "low")
+
+	tests := []struct {
+		n            int
+		qnames       []string
+		want         []*base.TaskMessage
+		wantErr      error
+		wantEnqueued map[string][]*base.TaskMessage
+	}{
+		{
+			n:       3,
+			qnames:  []string{"default", "low"},
+			want:    []*base.TaskMessage{t1, t2, t3},
+			wantErr: nil,
+			wantEnqueued: map[string][]*base.TaskMessage{
+				"default": {},
+				"low":     {t4},
+			},
+		},
+		{
+			n:       10,
+			qnames:  []string{"low", "default"},
+			want:    []*base.TaskMessage{t3, t4, t1, t2},
+			wantErr: nil,
+			wantEnqueued: map[string][]*base.TaskMessage{
+				"default": {},
+				"low":     {},
+			},
+		},
+		{
+			n:       1,
+			qnames:  []string{"critical"},
+			want:    nil,
+			wantErr: ErrNoProcessableTask,
+			wantEnqueued: map[string][]*base.TaskMessage{
+				"default": {t1, t2},
+				"low":     {t3, t4},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client)
+		h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{t1, t2})
+		h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{t3, t4}, "low")
+
+		got, err := r.DequeueN(tc.n, tc.qnames...)
+		if err != tc.wantErr {
+			t.Errorf("(*RDB).DequeueN(%d, %v) returned error %v, want %v", tc.n, tc.qnames, err, tc.wantErr)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("(*RDB).DequeueN(%d, %v) = %v, want %v; (-want,+got)\n%s", tc.n, tc.qnames, got, tc.want, diff)
+		}
+		for qname, want := range tc.wantEnqueued {
+			gotEnqueued := h.GetEnqueuedMessages(t, r.client, qname)
+			if diff := cmp.Diff(want, gotEnqueued, h.SortMsgOpt); diff != "" {
+				t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.QueueKey(qname), diff)
+			}
+		}
+		gotInProgress := h.GetInProgressMessages(t, r.client)
+		if diff := cmp.Diff(tc.want, gotInProgress, h.SortMsgOpt, cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.InProgressQueue, diff)
+		}
+		if n := int(r.client.ZCard(base.Leases).Val()); n != len(tc.want) {
+			t.Errorf("ZCARD %q = %d, want %d", base.Leases, n, len(tc.want))
+		}
+	}
+}
+
+func TestDequeueNBadData(t *testing.T) {
+	r := setup(t)
+	h.FlushDB(t, r.client)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("send_email", nil)
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{t1})
+	const bad = "bad data"
+	if err := r.client.LPush(base.QueueKey("default"), bad).Err(); err != nil {
+		t.Fatal(err)
+	}
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{t2})
+
+	got, err := r.DequeueN(3, "default")
+	if err != nil {
+		t.Fatalf("(*RDB).DequeueN(3, \"default\") returned error %v", err)
+	}
+	want := []*base.TaskMessage{t1, t2}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(*RDB).DequeueN(3, \"default\") = %v, want %v; (-want,+got)\n%s", got, want, diff)
+	}
+	gotInProgress := h.GetInProgressMessages(t, r.client)
+	if diff := cmp.Diff(want, gotInProgress, h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.InProgressQueue, diff)
+	}
+	if n := int(r.client.ZCard(base.Leases).Val()); n != len(want) {
+		t.Errorf("ZCARD %q = %d, want %d", base.Leases, n, len(want))
+	}
+	if _, err := r.client.ZScore(base.DeadQueue, bad).Result(); err != nil {
+		t.Errorf("ZSCORE %q %q returned error %v, want the data in the dead queue", base.DeadQueue, bad, err)
+	}
+}
+
+func TestRollupsMaintained(t *testing.T) {
+	r := setup(t)
+	for _, enc := range []base.MessageEncoding{base.JSONEncoding, base.ProtobufEncoding} {
+		h.FlushDB(t, r.client)
+		m1 := h.NewTaskMessage("export", nil)
+		m1.Dimensions = map[string]string{"plan": "pro"}
+		m2 := h.NewTaskMessage("export", nil)
+		m2.Dimensions = map[string]string{"plan": "pro"}
+		m3 := h.NewTaskMessage("export", nil)
+		m3.Dimensions = map[string]string{"plan": "free:trial"}
+		for _, m := range []*base.TaskMessage{m1, m2, m3} {
+			m.Encoding = enc
+		}
+
+		steps := []struct {
+			desc string
+			fn   func() error
+			want map[string]map[string]int
+		}{
+			{
+				desc: "enqueue and schedule",
+				fn: func() error {
+					if err := r.Enqueue(m1); err != nil {
+						return err
+					}
+					if err := r.Schedule(m2, time.Now().Add(-time.Minute)); err != nil {
+						return err
+					}
+					return r.Enqueue(m3)
+				},
+				want: map[string]map[string]int{
+					"pro":        {"enqueued": 1, "scheduled": 1},
+					"free:trial": {"enqueued": 1},
+				},
+			},
+			{
+				desc: "dequeue",
+				fn: func() error {
+					_, err := r.Dequeue("default")
+					return err
+				},
+				want: map[string]map[string]int{
+					"pro":        {"inprogress": 1, "scheduled": 1},
+					"free:trial": {"enqueued": 1},
+				},
+			},
+			{
+				desc: "forward and retry",
+				fn: func() error {
+					if err := r.CheckAndEnqueue(); err != nil {
+						return err
+					}
+					return r.Retry(m1, time.Now().Add(time.Minute), "error")
+				},
+				want: map[string]map[string]int{
+					"pro":        {"enqueued": 1, "retry": 1},
+					"free:trial": {"enqueued": 1},
+				},
+			},
+			{
+				desc: "dequeue batch, finish and kill",
+				fn: func() error {
+					if _, err := r.DequeueN(10, "default"); err != nil {
+						return err
+					}
+					if err := r.Done(m3); err != nil {
+						return err
+					}
+					return r.Kill(m2, "error")
+				},
+				want: map[string]map[string]int{
+					"pro": {"retry": 1, "dead": 1},
+				},
+			},
+		}
+		for _, s := range steps {
+			if err := s.fn(); err != nil {
+				t.Fatalf("encoding %d, %s: returned error %v", enc, s.desc, err)
+			}
+			got, err := r.Rollups("plan")
+			if err != nil {
+				t.Fatalf("(*RDB).Rollups(\"plan\") returned error: %v", err)
+			}
+			if diff := cmp.Diff(s.want, got); diff != "" {
+				t.Errorf("encoding %d, after %s: (*RDB).Rollups(\"plan\") = %v, want %v; (-want,+got)\n%s",
+					enc, s.desc, got, s.want, diff)
+			}
+		}
+	}
+}
+
+func TestEnqueueWithQuota(t *testing.T) {
+	r := setup(t)
+	h.FlushDB(t, r.client)
+	msgs := []*base.TaskMessage{
+		h.NewTaskMessage("send_email", nil),
+		h.NewTaskMessage("send_email", nil),
+		h.NewTaskMessage("send_email", nil),
+	}
+
+	for i, msg := range msgs {
+		want := error(nil)
+		if i == 2 {
+			want = ErrQueueFull
+		}
+		if err := r.EnqueueWithQuota(msg, 2); err != want {
+			t.Errorf("(*RDB).EnqueueWithQuota(msgs[%d], 2) = %v, want %v", i, err, want)
+		}
+	}
+	gotEnqueued := h.GetEnqueuedMessages(t, r.client, base.DefaultQueueName)
+	if diff := cmp.Diff(msgs[:2], gotEnqueued, h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.QueueKey(base.DefaultQueueName), diff)
+	}
+}
+
 func TestDequeue(t *testing.T) {
 	r := setup(t)
 	t1 := h.NewTaskMessage("send_email", map[string]interface{}{"subject": "hello!"})
@@ -234,6 +456,230 @@ func TestDone(t *testing.T) {
 	}
 }
 
+func TestComplete(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("export_csv", nil)
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{t1, t2})
+	expireAt := time.Now().Add(time.Hour)
+
+	if err := r.Complete(t1, expireAt); err != nil {
+		t.Fatalf("(*RDB).Complete(task, %v) = %v, want nil", expireAt, err)
+	}
+
+	wantInProgress := []*base.TaskMessage{t2}
+	if diff := cmp.Diff(wantInProgress, h.GetInProgressMessages(t, r.client), h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.InProgressQueue, diff)
+	}
+	wantCompleted := []h.ZSetEntry{{Msg: t1, Score: float64(expireAt.Unix())}}
+	if diff := cmp.Diff(wantCompleted, h.GetCompletedEntries(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.CompletedQueue, diff)
+	}
+	processedKey := base.ProcessedKey(time.Now())
+	if got := r.client.Get(processedKey).Val(); got != "1" {
+		t.Errorf("GET %q = %q, want 1", processedKey, got)
+	}
+}
+
+func TestDeleteExpiredCompleted(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("export_csv", nil)
+	h.SeedCompletedQueue(t, r.client, []h.ZSetEntry{
+		{Msg: t1, Score: float64(now.Add(-time.Minute).Unix())},
+		{Msg: t2, Score: float64(now.Add(time.Hour).Unix())},
+	})
+
+	n, err := r.DeleteExpiredCompleted()
+	if err != nil {
+		t.Fatalf("(*RDB).DeleteExpiredCompleted() returned error: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("(*RDB).DeleteExpiredCompleted() = %d, want 1", n)
+	}
+	want := []h.ZSetEntry{{Msg: t2, Score: float64(now.Add(time.Hour).Unix())}}
+	if diff := cmp.Diff(want, h.GetCompletedEntries(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.CompletedQueue, diff)
+	}
+}
+
+func TestAck(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("export_csv", nil)
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{t1, t2})
+
+	if err := r.Ack(t1); err != nil {
+		t.Fatalf("(*RDB).Ack(task) = %v, want nil", err)
+	}
+
+	gotInProgress := h.GetInProgressMessages(t, r.client)
+	if diff := cmp.Diff([]*base.TaskMessage{t2}, gotInProgress, h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.InProgressQueue, diff)
+	}
+	processedKey := base.ProcessedKey(time.Now())
+	if n := r.client.Exists(processedKey).Val(); n != 0 {
+		t.Errorf("EXISTS %q = %d, want 0", processedKey, n)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("handle_webhook", nil)
+	m2 := h.NewTaskMessage("handle_webhook", nil)
+
+	tests := []struct {
+		msg  *base.TaskMessage
+		hash string
+		want string // ID of the task enqueued first
+	}{
+		{m1, "9f86d081", ""},
+		{m2, "9f86d081", m1.ID.String()},
+		{m2, "60303ae2", ""},
+	}
+	for _, tc := range tests {
+		got, err := r.Dedup(tc.msg, tc.hash, time.Minute)
+		if err != nil {
+			t.Fatalf("(*RDB).Dedup(msg, %q) returned error: %v", tc.hash, err)
+		}
+		if got != tc.want {
+			t.Errorf("(*RDB).Dedup(msg, %q) = %q, want %q", tc.hash, got, tc.want)
+		}
+	}
+	if ttl := r.client.TTL(base.DefaultKeys.DedupKey("9f86d081")).Val(); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("TTL of the content = %v, want up to %v", ttl, time.Minute)
+	}
+
+	// Only the task which recorded the content forgets it.
+	if err := r.Forget(m2, "9f86d081"); err != nil {
+		t.Fatalf("(*RDB).Forget returned error: %v", err)
+	}
+	if got, _ := r.Dedup(m2, "9f86d081", time.Minute); got != m1.ID.String() {
+		t.Errorf("(*RDB).Dedup after the other task forgot = %q, want %q", got, m1.ID.String())
+	}
+	if err := r.Forget(m1, "9f86d081"); err != nil {
+		t.Fatalf("(*RDB).Forget returned error: %v", err)
+	}
+	if got, _ := r.Dedup(m2, "9f86d081", time.Minute); got != "" {
+		t.Errorf("(*RDB).Dedup after the task forgot = %q, want %q", got, "")
+	}
+}
+
+func TestRecordDelivery(t *testing.T) {
+	r := setup(t)
+	msg := h.NewTaskMessage("send_email", nil)
+
+	tests := []struct {
+		worker string
+		msg    *base.TaskMessage
+		want   string // worker which started the attempt first
+	}{
+		{"host-a:1234", msg, ""},
+		{"host-b:5678", msg, "host-a:1234"},
+		{"host-b:5678", msg, "host-a:1234"},
+		{"host-b:5678", &base.TaskMessage{ID: msg.ID, Type: msg.Type, Retried: 1}, ""},
+	}
+
+	for _, tc := range tests {
+		got, err := r.RecordDelivery(tc.msg, tc.worker, time.Minute)
+		if err != nil {
+			t.Fatalf("(*RDB).RecordDelivery(msg, %q) returned error: %v", tc.worker, err)
+		}
+		if got != tc.want {
+			t.Errorf("(*RDB).RecordDelivery(msg, %q) = %q, want %q", tc.worker, got, tc.want)
+		}
+	}
+	if n := r.client.Get(base.Duplicates).Val(); n != "2" {
+		t.Errorf("GET %q = %q, want %q", base.Duplicates, n, "2")
+	}
+	if ttl := r.client.TTL(base.DefaultKeys.DeliveryKey(msg.ID.String(), 0)).Val(); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("TTL of the delivery = %v, want up to %v", ttl, time.Minute)
+	}
+}
+
+func TestRecordDeliveryAfterLeaseExpired(t *testing.T) {
+	r := setup(t)
+	h.FlushDB(t, r.client)
+	msg := h.NewTaskMessage("send_email", nil)
+	msg.Retry = 25
+	msg.Retried = 2
+
+	// the worker started processing the task, and stopped responding.
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{msg})
+	if got, err := r.RecordDelivery(msg, "host-a:1234", time.Minute); err != nil || got != "" {
+		t.Fatalf("(*RDB).RecordDelivery(msg, %q) = %q, %v, want %q, nil", "host-a:1234", got, err, "")
+	}
+	bytes, err := base.EncodeMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.client.ZAdd(base.Leases, &redis.Z{Member: string(bytes), Score: float64(time.Now().Add(-time.Minute).Unix())})
+	if n, err := r.RecoverExpiredLeases(); err != nil || n != 1 {
+		t.Fatalf("(*RDB).RecoverExpiredLeases() = %d, %v, want 1, nil", n, err)
+	}
+
+	// the task redelivered after its lease expired is a duplicate delivery
+	// of the same attempt.
+	gotRetry := h.GetRetryMessages(t, r.client)
+	if len(gotRetry) != 1 {
+		t.Fatalf("%q has %d tasks, want 1", base.RetryQueue, len(gotRetry))
+	}
+	recovered := gotRetry[0]
+	if recovered.Retried != 3 || base.Attempt(recovered) != 2 {
+		t.Errorf("recovered task retried %d times at attempt %d, want 3 and 2", recovered.Retried, base.Attempt(recovered))
+	}
+	if got, err := r.RecordDelivery(recovered, "host-b:5678", time.Minute); err != nil || got != "host-a:1234" {
+		t.Errorf("(*RDB).RecordDelivery(recovered, %q) = %q, %v, want %q, nil", "host-b:5678", got, err, "host-a:1234")
+	}
+
+	// the task retried after its handler failed is a new attempt.
+	retried := *recovered
+	retried.Retried++
+	if got, err := r.RecordDelivery(&retried, "host-b:5678", time.Minute); err != nil || got != "" {
+		t.Errorf("(*RDB).RecordDelivery(retried, %q) = %q, %v, want %q, nil", "host-b:5678", got, err, "")
+	}
+}
+
+func TestRecordStart(t *testing.T) {
+	r := setup(t)
+	h.FlushDB(t, r.client)
+	msg := h.NewTaskMessage("import_rows", nil)
+	retried := &base.TaskMessage{ID: msg.ID, Type: msg.Type, Retried: 1}
+
+	for _, tc := range []struct {
+		msg  *base.TaskMessage
+		want int
+	}{
+		{msg, 1},
+		{msg, 2},
+		// starts are counted across the attempts of the task.
+		{retried, 3},
+	} {
+		got, err := r.RecordStart(tc.msg, time.Minute)
+		if err != nil {
+			t.Fatalf("(*RDB).RecordStart(msg) returned error: %v", err)
+		}
+		if got != tc.want {
+			t.Errorf("(*RDB).RecordStart(msg) with retried=%d = %d, want %d", tc.msg.Retried, got, tc.want)
+		}
+	}
+	key := base.DefaultKeys.StartsKey(msg.ID.String())
+	if ttl := r.client.TTL(key).Val(); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("TTL %q = %v, want up to %v", key, ttl, time.Minute)
+	}
+
+	if err := r.ClearStarts(msg); err != nil {
+		t.Fatalf("(*RDB).ClearStarts(msg) returned error: %v", err)
+	}
+	if n := r.client.Exists(key).Val(); n != 0 {
+		t.Errorf("EXISTS %q = %d, want 0", key, n)
+	}
+	if got, _ := r.RecordStart(msg, time.Minute); got != 1 {
+		t.Errorf("(*RDB).RecordStart(msg) after ClearStarts = %d, want 1", got)
+	}
+}
+
 func TestRequeue(t *testing.T) {
 	r := setup(t)
 	t1 := h.NewTaskMessage("send_email", nil)
@@ -343,6 +789,65 @@ func TestSchedule(t *testing.T) {
 	}
 }
 
+func TestWriteBatch(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", map[string]interface{}{"subject": "hello"})
+	t2 := h.NewTaskMessageWithQueue("generate_csv", nil, "csv")
+	t3 := h.NewTaskMessage("reindex", nil)
+	processAt := time.Now().Add(15 * time.Minute)
+
+	tests := []struct {
+		entries       []*BatchEntry
+		wantEnqueued  map[string][]*base.TaskMessage
+		wantScheduled []h.ZSetEntry
+	}{
+		{
+			entries: []*BatchEntry{
+				{Msg: t1},
+				{Msg: t2},
+				{Msg: t3, ProcessAt: processAt},
+			},
+			wantEnqueued: map[string][]*base.TaskMessage{
+				base.DefaultQueueName: {t1},
+				"csv":                 {t2},
+			},
+			wantScheduled: []h.ZSetEntry{
+				{Msg: t3, Score: float64(processAt.Unix())},
+			},
+		},
+		{
+			entries: []*BatchEntry{},
+			wantEnqueued: map[string][]*base.TaskMessage{
+				base.DefaultQueueName: {},
+			},
+			wantScheduled: []h.ZSetEntry{},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client) // clean up db before each test case
+
+		if err := r.WriteBatch(tc.entries); err != nil {
+			t.Errorf("(*RDB).WriteBatch(entries) = %v, want nil", err)
+			continue
+		}
+
+		for qname, want := range tc.wantEnqueued {
+			gotEnqueued := h.GetEnqueuedMessages(t, r.client, qname)
+			if diff := cmp.Diff(want, gotEnqueued, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.QueueKey(qname), diff)
+			}
+			if len(want) > 0 && !r.client.SIsMember(base.AllQueues, base.QueueKey(qname)).Val() {
+				t.Errorf("%q is not a member of SET %q", base.QueueKey(qname), base.AllQueues)
+			}
+		}
+		gotScheduled := h.GetScheduledEntries(t, r.client)
+		if diff := cmp.Diff(tc.wantScheduled, gotScheduled, h.SortZSetEntryOpt, cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.ScheduledQueue, diff)
+		}
+	}
+}
+
 func TestRetry(t *testing.T) {
 	r := setup(t)
 	t1 := h.NewTaskMessage("send_email", map[string]interface{}{"subject": "Hola!"})
@@ -358,6 +863,8 @@ func TestRetry(t *testing.T) {
 		Retry:    t1.Retry,
 		Retried:  t1.Retried + 1,
 		ErrorMsg: errMsg,
+
+		ErrorHistory: []*base.TaskError{{Msg: errMsg}},
 	}
 	now := time.Now()
 
@@ -412,7 +919,7 @@ func TestRetry(t *testing.T) {
 		}
 
 		gotRetry := h.GetRetryEntries(t, r.client)
-		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortZSetEntryOpt); diff != "" {
+		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortZSetEntryOpt, h.IgnoreErrorTimeOpt); diff != "" {
 			t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.RetryQueue, diff)
 		}
 
@@ -438,6 +945,33 @@ func TestRetry(t *testing.T) {
 	}
 }
 
+func TestRetryInQueue(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	errMsg := "SMTP server is not responding"
+	h.FlushDB(t, r.client)
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{t1})
+
+	processAt := time.Now().Add(5 * time.Minute)
+	if err := r.RetryInQueue(t1, "slow_retry", processAt, errMsg); err != nil {
+		t.Fatalf("(*RDB).RetryInQueue = %v, want nil", err)
+	}
+
+	want := *t1
+	want.Queue = "slow_retry"
+	want.Retried++
+	want.ErrorMsg = errMsg
+	want.ErrorHistory = []*base.TaskError{{Msg: errMsg}}
+	wantRetry := []h.ZSetEntry{{Msg: &want, Score: float64(processAt.Unix())}}
+	gotRetry := h.GetRetryEntries(t, r.client)
+	if diff := cmp.Diff(wantRetry, gotRetry, h.IgnoreErrorTimeOpt); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.RetryQueue, diff)
+	}
+	if l := r.client.LLen(base.InProgressQueue).Val(); l != 0 {
+		t.Errorf("LLEN %q = %d, want 0", base.InProgressQueue, l)
+	}
+}
+
 func TestKill(t *testing.T) {
 	r := setup(t)
 	t1 := h.NewTaskMessage("send_email", nil)
@@ -452,6 +986,8 @@ func TestKill(t *testing.T) {
 		Retry:    t1.Retry,
 		Retried:  t1.Retried,
 		ErrorMsg: errMsg,
+
+		ErrorHistory: []*base.TaskError{{Msg: errMsg}},
 	}
 	now := time.Now()
 
@@ -515,7 +1051,7 @@ func TestKill(t *testing.T) {
 		}
 
 		gotDead := h.GetDeadEntries(t, r.client)
-		if diff := cmp.Diff(tc.wantDead, gotDead, h.SortZSetEntryOpt); diff != "" {
+		if diff := cmp.Diff(tc.wantDead, gotDead, h.SortZSetEntryOpt, h.IgnoreErrorTimeOpt); diff != "" {
 			t.Errorf("mismatch found in %q after calling (*RDB).Kill: (-want, +got):\n%s", base.DeadQueue, diff)
 		}
 
@@ -541,6 +1077,89 @@ func TestKill(t *testing.T) {
 	}
 }
 
+func TestTrimDead(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("reindex", nil)
+	t3 := h.NewTaskMessage("generate_csv", nil)
+	t4 := h.NewTaskMessage("sync_stuff", nil)
+	dead := []h.ZSetEntry{
+		{Msg: t1, Score: float64(now.Add(-48 * time.Hour).Unix())},
+		{Msg: t2, Score: float64(now.Add(-3 * time.Hour).Unix())},
+		{Msg: t3, Score: float64(now.Add(-2 * time.Hour).Unix())},
+		{Msg: t4, Score: float64(now.Add(-time.Hour).Unix())},
+	}
+
+	tests := []struct {
+		maxSize  int
+		maxAge   time.Duration
+		want     int64
+		wantDead []h.ZSetEntry
+	}{
+		{0, 0, 0, dead},
+		{0, 24 * time.Hour, 1, dead[1:]},
+		{2, 0, 2, dead[2:]},
+		{2, 24 * time.Hour, 2, dead[2:]},
+		{1, 90 * time.Minute, 3, dead[3:]},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client)
+		h.SeedDeadQueue(t, r.client, dead)
+
+		got, err := r.TrimDead(tc.maxSize, tc.maxAge)
+		if err != nil {
+			t.Errorf("(*RDB).TrimDead(%d, %v) returned error: %v", tc.maxSize, tc.maxAge, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("(*RDB).TrimDead(%d, %v) = %d, want %d", tc.maxSize, tc.maxAge, got, tc.want)
+		}
+		gotDead := h.GetDeadEntries(t, r.client)
+		if diff := cmp.Diff(tc.wantDead, gotDead, h.SortZSetEntryOpt); diff != "" {
+			t.Errorf("mismatch found in %q after TrimDead(%d, %v); (-want,+got)\n%s", base.DeadQueue, tc.maxSize, tc.maxAge, diff)
+		}
+	}
+}
+
+func TestKillWithDeadRetention(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("reindex", nil)
+	t3 := h.NewTaskMessage("generate_csv", nil)
+
+	tests := []struct {
+		maxSize int
+		wantIDs []string
+	}{
+		{maxSize: 2, wantIDs: []string{t2.ID.String(), t3.ID.String()}},
+		{maxSize: 1, wantIDs: []string{t3.ID.String()}},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client) // clean up db before each test case
+		r.SetDeadRetention(tc.maxSize, time.Hour)
+		h.SeedDeadQueue(t, r.client, []h.ZSetEntry{
+			{Msg: t1, Score: float64(now.Add(-2 * time.Hour).Unix())},
+			{Msg: t2, Score: float64(now.Add(-time.Minute).Unix())},
+		})
+		h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{t3})
+
+		if err := r.Kill(t3, "SMTP server not responding"); err != nil {
+			t.Fatalf("(*RDB).Kill(%v) returned error: %v", t3, err)
+		}
+		var gotIDs []string
+		for _, msg := range h.GetDeadMessages(t, r.client) {
+			gotIDs = append(gotIDs, msg.ID.String())
+		}
+		if diff := cmp.Diff(tc.wantIDs, gotIDs, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+			t.Errorf("with max size %d, mismatch found in %q; (-want,+got)\n%s", tc.maxSize, base.DeadQueue, diff)
+		}
+	}
+}
+
 func TestRequeueAll(t *testing.T) {
 	r := setup(t)
 	t1 := h.NewTaskMessage("send_email", nil)
@@ -633,6 +1252,103 @@ func TestRequeueAll(t *testing.T) {
 	}
 }
 
+func TestRecoverExpiredLeases(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("reindex", nil)
+	t3 := h.NewTaskMessage("generate_csv", nil)
+	t4 := h.NewTaskMessage("sync", nil)
+	t2.Retried = t2.Retry // t2 has exhausted its retries.
+	now := time.Now()
+
+	h.FlushDB(t, r.client)
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{t1, t2, t3, t4})
+	leases := map[*base.TaskMessage]time.Time{
+		t1: now.Add(-time.Minute), // expired
+		t2: now.Add(-time.Minute), // expired
+		t3: now.Add(time.Minute),
+		// t4 has no lease.
+	}
+	for msg, expireAt := range leases {
+		bytes, err := base.EncodeMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.client.ZAdd(base.Leases, &redis.Z{Member: string(bytes), Score: float64(expireAt.Unix())})
+	}
+
+	n, err := r.RecoverExpiredLeases()
+	if err != nil {
+		t.Fatalf("(*RDB).RecoverExpiredLeases() returned error: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("(*RDB).RecoverExpiredLeases() = %d, want 2", n)
+	}
+
+	errHistory := []*base.TaskError{{Msg: leaseExpiredMsg}}
+	r1 := *t1
+	r1.Retried++
+	r1.Recovered++
+	r1.ErrorMsg = leaseExpiredMsg
+	r1.ErrorHistory = errHistory
+	d2 := *t2
+	d2.ErrorMsg = leaseExpiredMsg
+	d2.ErrorHistory = errHistory
+
+	gotInProgress := h.GetInProgressMessages(t, r.client)
+	if diff := cmp.Diff([]*base.TaskMessage{t3, t4}, gotInProgress, h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.InProgressQueue, diff)
+	}
+	gotRetry := h.GetRetryMessages(t, r.client)
+	if diff := cmp.Diff([]*base.TaskMessage{&r1}, gotRetry, h.IgnoreErrorTimeOpt); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.RetryQueue, diff)
+	}
+	gotDead := h.GetDeadMessages(t, r.client)
+	if diff := cmp.Diff([]*base.TaskMessage{&d2}, gotDead, h.IgnoreErrorTimeOpt); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.DeadQueue, diff)
+	}
+	// t4 should have been leased so that it's recovered unless its lease is extended.
+	if got := r.client.ZCard(base.Leases).Val(); got != 2 {
+		t.Errorf("ZCARD %q = %d, want 2", base.Leases, got)
+	}
+}
+
+func TestExtendLeases(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("reindex", nil)
+
+	h.FlushDB(t, r.client)
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{t1})
+	if _, err := r.Dequeue(base.DefaultQueueName); err != nil {
+		t.Fatal(err)
+	}
+	// t2 is not leased, since it's not in progress.
+	expireAt := time.Now().Add(time.Hour)
+	if err := r.ExtendLeases([]*base.Lease{{Msg: t1, ExpireAt: expireAt}, {Msg: t2, ExpireAt: expireAt}}); err != nil {
+		t.Fatalf("(*RDB).ExtendLeases() returned error: %v", err)
+	}
+
+	zs := r.client.ZRangeWithScores(base.Leases, 0, -1).Val()
+	if len(zs) != 1 {
+		t.Fatalf("%q has %d leases, want 1", base.Leases, len(zs))
+	}
+	if got, want := int64(zs[0].Score), expireAt.Unix(); got != want {
+		t.Errorf("lease expires at %d, want %d", got, want)
+	}
+
+	msg, err := base.DecodeMessage([]byte(zs[0].Member.(string)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Done(msg); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.client.ZCard(base.Leases).Val(); got != 0 {
+		t.Errorf("ZCARD %q = %d after (*RDB).Done, want 0", base.Leases, got)
+	}
+}
+
 func TestCheckAndEnqueue(t *testing.T) {
 	r := setup(t)
 	t1 := h.NewTaskMessage("send_email", nil)
@@ -642,6 +1358,7 @@ func TestCheckAndEnqueue(t *testing.T) {
 	t4.Queue = "critical"
 	t5 := h.NewTaskMessage("minor_task", nil)
 	t5.Queue = "low"
+	t6 := h.NewTaskMessageWithQueue("send_email", nil, "email@eu")
 	secondAgo := time.Now().Add(-time.Second)
 	hourFromNow := time.Now().Add(time.Hour)
 
@@ -709,6 +1426,24 @@ func TestCheckAndEnqueue(t *testing.T) {
 			wantScheduled: []*base.TaskMessage{},
 			wantRetry:     []*base.TaskMessage{},
 		},
+		{
+			// tasks of the other queues are sent to their queues
+			// when a background serves a single queue.
+			scheduled: []h.ZSetEntry{
+				{Msg: t1, Score: float64(secondAgo.Unix())},
+				{Msg: t6, Score: float64(secondAgo.Unix())},
+			},
+			retry: []h.ZSetEntry{
+				{Msg: t5, Score: float64(secondAgo.Unix())}},
+			qnames: []string{"default"},
+			wantEnqueued: map[string][]*base.TaskMessage{
+				"default":  {t1},
+				"email@eu": {t6},
+				"low":      {t5},
+			},
+			wantScheduled: []*base.TaskMessage{},
+			wantRetry:     []*base.TaskMessage{},
+		},
 	}
 
 	for _, tc := range tests {
@@ -727,6 +1462,9 @@ func TestCheckAndEnqueue(t *testing.T) {
 			if diff := cmp.Diff(want, gotEnqueued, h.SortMsgOpt); diff != "" {
 				t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.QueueKey(qname), diff)
 			}
+			if len(want) > 0 && !r.client.SIsMember(base.AllQueues, base.QueueKey(qname)).Val() {
+				t.Errorf("%q is not a member of %q", base.QueueKey(qname), base.AllQueues)
+			}
 		}
 
 		gotScheduled := h.GetScheduledMessages(t, r.client)
@@ -741,6 +1479,51 @@ func TestCheckAndEnqueue(t *testing.T) {
 	}
 }
 
+func TestForwardBatches(t *testing.T) {
+	r := setup(t)
+	secondAgo := float64(time.Now().Add(-time.Second).Unix())
+	hourFromNow := float64(time.Now().Add(time.Hour).Unix())
+	var scheduled []h.ZSetEntry
+	var msgs []*base.TaskMessage
+	for i := 0; i < 5; i++ {
+		msg := h.NewTaskMessage("send_email", nil)
+		if i%2 == 1 {
+			msg.Queue = "low"
+		}
+		msgs = append(msgs, msg)
+		scheduled = append(scheduled, h.ZSetEntry{Msg: msg, Score: secondAgo})
+	}
+	later := h.NewTaskMessage("send_email", nil)
+	scheduled = append(scheduled, h.ZSetEntry{Msg: later, Score: hourFromNow})
+	h.FlushDB(t, r.client)
+	h.SeedScheduledQueue(t, r.client, scheduled)
+
+	for _, want := range []int{2, 2, 1, 0} {
+		n, err := r.forward(base.ScheduledQueue, 2)
+		if err != nil {
+			t.Fatalf("(*RDB).forward() returned error: %v", err)
+		}
+		if n != want {
+			t.Errorf("(*RDB).forward() = %d, want %d", n, want)
+		}
+	}
+
+	wantEnqueued := map[string][]*base.TaskMessage{
+		"default": {msgs[0], msgs[2], msgs[4]},
+		"low":     {msgs[1], msgs[3]},
+	}
+	for qname, want := range wantEnqueued {
+		got := h.GetEnqueuedMessages(t, r.client, qname)
+		if diff := cmp.Diff(want, got, h.SortMsgOpt); diff != "" {
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.QueueKey(qname), diff)
+		}
+	}
+	gotScheduled := h.GetScheduledMessages(t, r.client)
+	if diff := cmp.Diff([]*base.TaskMessage{later}, gotScheduled, h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.ScheduledQueue, diff)
+	}
+}
+
 func TestReadWriteClearProcessInfo(t *testing.T) {
 	r := setup(t)
 	pinfo := &base.ProcessInfo{
@@ -819,3 +1602,340 @@ func TestReadWriteClearProcessInfo(t *testing.T) {
 
 	}
 }
+
+func TestRefreshProcessInfo(t *testing.T) {
+	r := setup(t)
+	pinfo := base.NewProcessInfo("localhost", 98765, 10, map[string]int{"default": 1}, false)
+	key := base.ProcessInfoKey(pinfo.Host, pinfo.PID)
+
+	ok, err := r.RefreshProcessInfo(pinfo, 10*time.Second)
+	if err != nil || ok {
+		t.Fatalf("(*RDB).RefreshProcessInfo() before the info is written = %t, %v, want false, nil", ok, err)
+	}
+	if err := r.WriteProcessInfo(pinfo, time.Second); err != nil {
+		t.Fatalf("(*RDB).WriteProcessInfo() returned error: %v", err)
+	}
+	ok, err = r.RefreshProcessInfo(pinfo, 10*time.Second)
+	if err != nil || !ok {
+		t.Fatalf("(*RDB).RefreshProcessInfo() = %t, %v, want true, nil", ok, err)
+	}
+	if ttl := r.client.TTL(key).Val(); ttl < 9*time.Second {
+		t.Errorf("redis TTL %q returned %v, want 10s", key, ttl)
+	}
+	if score := r.client.ZScore(base.AllProcesses, key).Val(); score < float64(time.Now().Add(9*time.Second).Unix()) {
+		t.Errorf("%q has score %v in %q, want about 10s from now", key, score, base.AllProcesses)
+	}
+}
+
+func TestQueueWeights(t *testing.T) {
+	r := setup(t)
+
+	if err := r.SetQueueWeight("critical", 10); err != nil {
+		t.Fatalf("(*RDB).SetQueueWeight(%q, 10) returned error: %v", "critical", err)
+	}
+	seed := map[string]int{"critical": 6, "default": 3, "low": 1}
+	if err := r.SeedQueueWeights(seed); err != nil {
+		t.Fatalf("(*RDB).SeedQueueWeights(%v) returned error: %v", seed, err)
+	}
+
+	// seeding should not override the weight set already.
+	want := map[string]int{"critical": 10, "default": 3, "low": 1}
+	got, err := r.QueueWeights()
+	if err != nil {
+		t.Fatalf("(*RDB).QueueWeights() returned error: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(*RDB).QueueWeights() = %v, want %v; (-want,+got)\n%s", got, want, diff)
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	r := setup(t)
+	other := NewRDB(r.client)
+	other.SetKeyPrefix("myapp")
+
+	m := h.NewTaskMessage("send_email", nil)
+	if err := other.Enqueue(m); err != nil {
+		t.Fatalf("(*RDB).Enqueue(%v) returned error: %v", m, err)
+	}
+
+	// Tasks in another namespace should not be visible.
+	if _, err := r.Dequeue("default"); err != ErrNoProcessableTask {
+		t.Errorf("(*RDB).Dequeue(%q) in the default namespace returned error %v, want %v", "default", err, ErrNoProcessableTask)
+	}
+	got, err := other.Dequeue("default")
+	if err != nil {
+		t.Fatalf("(*RDB).Dequeue(%q) returned error: %v", "default", err)
+	}
+	if diff := cmp.Diff(m, got); diff != "" {
+		t.Errorf("(*RDB).Dequeue(%q) = %v, want %v; (-want,+got)\n%s", "default", got, m, diff)
+	}
+	if n := r.client.LLen(base.InProgressQueue).Val(); n != 0 {
+		t.Errorf("%q has length %d, want 0", base.InProgressQueue, n)
+	}
+	if n := r.client.LLen("{myapp}:in_progress").Val(); n != 1 {
+		t.Errorf("%q has length %d, want 1", "{myapp}:in_progress", n)
+	}
+}
+
+func TestProtobufEncodedMessages(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", map[string]interface{}{"user_id": 42.0})
+	m1.Queue = "critical"
+	m1.Encoding = base.ProtobufEncoding
+	m2 := h.NewTaskMessage("generate_csv", nil)
+	m2.Encoding = base.ProtobufEncoding
+
+	if err := r.Schedule(m1, time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("(*RDB).Schedule(%v) returned error: %v", m1, err)
+	}
+	if err := r.Enqueue(m2); err != nil {
+		t.Fatalf("(*RDB).Enqueue(%v) returned error: %v", m2, err)
+	}
+	// forward script should read the queue name of protobuf encoded messages.
+	if err := r.CheckAndEnqueue("critical", "default"); err != nil {
+		t.Fatalf("(*RDB).CheckAndEnqueue() returned error: %v", err)
+	}
+	got, err := r.Dequeue("critical", "default")
+	if err != nil {
+		t.Fatalf("(*RDB).Dequeue() returned error: %v", err)
+	}
+	if diff := cmp.Diff(m1, got); diff != "" {
+		t.Errorf("(*RDB).Dequeue() = %v, want %v; (-want,+got)\n%s", got, m1, diff)
+	}
+	if _, err := r.Dequeue("critical", "default"); err != nil {
+		t.Fatalf("(*RDB).Dequeue() returned error: %v", err)
+	}
+
+	// requeueAll script should restore the tasks to their queues.
+	n, err := r.RequeueAll()
+	if err != nil || n != 2 {
+		t.Fatalf("(*RDB).RequeueAll() = %d, %v, want 2, nil", n, err)
+	}
+	if got := r.client.LLen(base.QueueKey("critical")).Val(); got != 1 {
+		t.Errorf("%q has length %d, want 1", base.QueueKey("critical"), got)
+	}
+
+	got, err = r.Dequeue("critical")
+	if err != nil {
+		t.Fatalf("(*RDB).Dequeue(%q) returned error: %v", "critical", err)
+	}
+	if err := r.Kill(got, "error"); err != nil {
+		t.Fatalf("(*RDB).Kill() returned error: %v", err)
+	}
+	if n := r.client.LLen(base.InProgressQueue).Val(); n != 0 {
+		t.Errorf("%q has length %d, want 0", base.InProgressQueue, n)
+	}
+	if n := r.client.ZCard(base.DeadQueue).Val(); n != 1 {
+		t.Errorf("%q has length %d, want 1", base.DeadQueue, n)
+	}
+}
+
+func TestPostpone(t *testing.T) {
+	r := setup(t)
+	m := h.NewTaskMessage("send_email", nil)
+	m.Retried = 3
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{m})
+	processAt := time.Now().Add(time.Minute)
+
+	if err := r.Postpone(m, processAt); err != nil {
+		t.Fatalf("(*RDB).Postpone(%v, %v) returned error: %v", m, processAt, err)
+	}
+	if n := r.client.LLen(base.InProgressQueue).Val(); n != 0 {
+		t.Errorf("%q has length %d, want 0", base.InProgressQueue, n)
+	}
+	want := []h.ZSetEntry{{Msg: m, Score: float64(processAt.Unix())}}
+	gotRetry := h.GetRetryEntries(t, r.client)
+	if diff := cmp.Diff(want, gotRetry, h.SortZSetEntryOpt); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.RetryQueue, diff)
+	}
+}
+
+func TestLock(t *testing.T) {
+	r := setup(t)
+	other := NewRDB(r.client)
+
+	ok, err := r.Lock("scheduler", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("(*RDB).Lock() = %t, %v, want true, nil", ok, err)
+	}
+	// Lock held by the same RDB should be extended.
+	if ok, err := r.Lock("scheduler", time.Minute); err != nil || !ok {
+		t.Errorf("(*RDB).Lock() by the holder = %t, %v, want true, nil", ok, err)
+	}
+	if ok, err := other.Lock("scheduler", time.Minute); err != nil || ok {
+		t.Errorf("(*RDB).Lock() by another RDB = %t, %v, want false, nil", ok, err)
+	}
+	// Unlock by another RDB should not release the lock.
+	if err := other.Unlock("scheduler"); err != nil {
+		t.Fatalf("(*RDB).Unlock() returned error: %v", err)
+	}
+	if ok, err := other.Lock("scheduler", time.Minute); err != nil || ok {
+		t.Errorf("(*RDB).Lock() by another RDB after its Unlock = %t, %v, want false, nil", ok, err)
+	}
+
+	if err := r.Unlock("scheduler"); err != nil {
+		t.Fatalf("(*RDB).Unlock() returned error: %v", err)
+	}
+	if ok, err := other.Lock("scheduler", time.Minute); err != nil || !ok {
+		t.Errorf("(*RDB).Lock() by another RDB after release = %t, %v, want true, nil", ok, err)
+	}
+}
+
+func TestKillSwitch(t *testing.T) {
+	r := setup(t)
+	h.FlushDB(t, r.client)
+
+	ks, err := r.KillSwitch()
+	if err != nil || ks != nil {
+		t.Fatalf("(*RDB).KillSwitch() = %v, %v before engaging; want nil, nil", ks, err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	want := &base.KillSwitch{
+		Reason:  "bad deploy",
+		By:      "alice@host",
+		Engaged: now,
+		Expires: now.Add(time.Hour),
+	}
+	if err := r.EngageKillSwitch(want); err != nil {
+		t.Fatalf("(*RDB).EngageKillSwitch() returned error: %v", err)
+	}
+	got, err := r.KillSwitch()
+	if err != nil {
+		t.Fatalf("(*RDB).KillSwitch() returned error: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(*RDB).KillSwitch() = %v, want %v; (-want,+got)\n%s", got, want, diff)
+	}
+	if ttl := r.client.TTL(base.KillSwitchKey).Val(); ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("TTL of %q is %v, want about an hour", base.KillSwitchKey, ttl)
+	}
+
+	ok, err := r.DisengageKillSwitch("bob@host")
+	if err != nil || !ok {
+		t.Fatalf("(*RDB).DisengageKillSwitch() = %t, %v; want true, nil", ok, err)
+	}
+	ok, err = r.DisengageKillSwitch("bob@host")
+	if err != nil || ok {
+		t.Fatalf("(*RDB).DisengageKillSwitch() = %t, %v for disengaged kill switch; want false, nil", ok, err)
+	}
+	if ks, err := r.KillSwitch(); err != nil || ks != nil {
+		t.Errorf("(*RDB).KillSwitch() = %v, %v after disengaging; want nil, nil", ks, err)
+	}
+
+	events, err := r.KillSwitchLog(10)
+	if err != nil {
+		t.Fatalf("(*RDB).KillSwitchLog(10) returned error: %v", err)
+	}
+	var gotActions []string
+	for _, e := range events {
+		gotActions = append(gotActions, e.Action+" by "+e.By)
+	}
+	wantActions := []string{"off by bob@host", "on by alice@host"}
+	if diff := cmp.Diff(wantActions, gotActions); diff != "" {
+		t.Errorf("(*RDB).KillSwitchLog(10) returned %v, want %v; (-want,+got)\n%s", gotActions, wantActions, diff)
+	}
+
+	if err := r.EngageKillSwitch(&base.KillSwitch{Expires: now.Add(-time.Minute)}); err == nil {
+		t.Errorf("(*RDB).EngageKillSwitch() with expired kill switch succeeded, want error")
+	}
+}
+
+func TestTakeToken(t *testing.T) {
+	r := setup(t)
+	h.FlushDB(t, r.client)
+	other := NewRDB(r.client)
+
+	// Tokens should be shared by all clients of the redis instance.
+	for i, rdb := range []*RDB{r, other, r} {
+		wait, err := rdb.TakeToken("type:send_email", 3, time.Minute)
+		if err != nil || wait != 0 {
+			t.Fatalf("token %d: (*RDB).TakeToken() = %v, %v, want 0, nil", i, wait, err)
+		}
+	}
+	wait, err := other.TakeToken("type:send_email", 3, time.Minute)
+	if err != nil {
+		t.Fatalf("(*RDB).TakeToken() returned error: %v", err)
+	}
+	if wait <= 19*time.Second || wait > 20*time.Second {
+		t.Errorf("(*RDB).TakeToken() on empty bucket = %v, want about 20s", wait)
+	}
+	// Other buckets should not be affected.
+	if wait, err := r.TakeToken("queue:low", 3, time.Minute); err != nil || wait != 0 {
+		t.Errorf("(*RDB).TakeToken() of another bucket = %v, %v, want 0, nil", wait, err)
+	}
+	key := r.keys.RateLimitKey("type:send_email")
+	if ttl := r.client.PTTL(key).Val(); ttl <= 0 || ttl > time.Minute+time.Second {
+		t.Errorf("TTL %q = %v, want between 0 and %v", key, ttl, time.Minute+time.Second)
+	}
+}
+
+func TestCanary(t *testing.T) {
+	r := setup(t)
+	h.FlushDB(t, r.client)
+
+	if got, err := r.Canary(); err != nil || got != nil {
+		t.Fatalf("(*RDB).Canary() = %v, %v before enqueuing; want nil, nil", got, err)
+	}
+
+	msg := h.NewTaskMessage("asynq:canary", nil)
+	start := time.Now().Truncate(time.Second)
+	if err := r.EnqueueCanary(msg, 3*time.Minute); err != nil {
+		t.Fatalf("(*RDB).EnqueueCanary() returned error: %v", err)
+	}
+	gotScheduled := h.GetScheduledEntries(t, r.client)
+	wantScheduled := []h.ZSetEntry{{Msg: msg, Score: float64(time.Now().Unix())}}
+	if diff := cmp.Diff(wantScheduled, gotScheduled, cmpopts.EquateApprox(0, 1)); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.ScheduledQueue, diff)
+	}
+	got, err := r.Canary()
+	if err != nil {
+		t.Fatalf("(*RDB).Canary() returned error: %v", err)
+	}
+	if got.Enqueued.Before(start) || !got.Completed.IsZero() || got.MaxAge != 3*time.Minute {
+		t.Errorf("(*RDB).Canary() = %+v before completion, want enqueued after %v, no completion, and max age 3m", got, start)
+	}
+
+	if err := r.CompleteCanary(); err != nil {
+		t.Fatalf("(*RDB).CompleteCanary() returned error: %v", err)
+	}
+	got, err = r.Canary()
+	if err != nil {
+		t.Fatalf("(*RDB).Canary() returned error: %v", err)
+	}
+	if got.Completed.Before(start) {
+		t.Errorf("(*RDB).Canary().Completed = %v, want no earlier than %v", got.Completed, start)
+	}
+}
+
+func TestDependencyDown(t *testing.T) {
+	r := setup(t)
+	names := []string{"smtp", "payments"}
+
+	if err := r.SetDependencyDown("smtp", time.Minute); err != nil {
+		t.Fatalf("(*RDB).SetDependencyDown(%q, %v) returned error: %v", "smtp", time.Minute, err)
+	}
+	got, err := r.DependenciesDown(names)
+	if err != nil {
+		t.Fatalf("(*RDB).DependenciesDown(%v) returned error: %v", names, err)
+	}
+	if diff := cmp.Diff([]string{"smtp"}, got); diff != "" {
+		t.Errorf("(*RDB).DependenciesDown(%v) = %v, want %v; (-want,+got)\n%s", names, got, []string{"smtp"}, diff)
+	}
+	key := base.DefaultKeys.DependencyKey("smtp")
+	if ttl := r.client.TTL(key).Val(); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("TTL of %q = %v, want up to %v", key, ttl, time.Minute)
+	}
+
+	if err := r.ClearDependencyDown("smtp"); err != nil {
+		t.Fatalf("(*RDB).ClearDependencyDown(%q) returned error: %v", "smtp", err)
+	}
+	got, err = r.DependenciesDown(names)
+	if err != nil {
+		t.Fatalf("(*RDB).DependenciesDown(%v) returned error: %v", names, err)
+	}
+	if len(got) != 0 {
+		t.Errorf("(*RDB).DependenciesDown(%v) = %v after recovery, want none", names, got)
+	}
+}
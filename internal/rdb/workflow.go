@@ -0,0 +1,364 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/spf13/cast"
+)
+
+var (
+	// ErrWorkflowNotFound indicates that no workflow has the given ID.
+	ErrWorkflowNotFound = errors.New("could not find a workflow")
+
+	// ErrDuplicateWorkflowStep indicates that the workflow already has
+	// a step of the given name.
+	ErrDuplicateWorkflowStep = errors.New("workflow step already exists")
+)
+
+// WorkflowRetention is how long the state of a workflow is kept
+// since it last changed.
+const WorkflowRetention = 7 * 24 * time.Hour
+
+// States of the workflow steps.
+const (
+	StepWaiting   = "waiting"   // waiting for the steps it depends on to complete
+	StepEnqueued  = "enqueued"  // released to its queue
+	StepCompleted = "completed" // processed successfully
+	StepFailed    = "failed"    // moved to the dead queue
+	StepCanceled  = "canceled"  // never released since the workflow failed
+)
+
+// The state of a workflow is a hash with the fields of each step:
+//
+//	s:<step> -> state of the step
+//	i:<step> -> ID of the task of the step
+//	t:<step> -> type of the task of the step
+//	c:<step> -> steps waiting for the step to complete, JSON array
+//	d:<step> -> number of steps the waiting step still waits for
+//	m:<step> -> task message of the waiting step
+//	q:<step> -> queue name of the waiting step
+//	p:<step> -> steps the step depends on, JSON array
+//	r:<step> -> result set by the handler of the step
+
+// KEYS[1] -> {asynq}:workflows:<workflow id>
+// KEYS[2] -> {asynq}:queues:<qname>
+// KEYS[3] -> {asynq}:queues
+// ARGV[1] -> step name
+// ARGV[2] -> task message data
+// ARGV[3] -> task ID
+// ARGV[4] -> task type
+// ARGV[5] -> queue name
+// ARGV[6] -> workflow retention in seconds
+// ARGV[7] -> wake channel to publish the queue name to, or empty string
+// ARGV[8:] -> names of the steps the step depends on
+//
+// Returns 0 if the step already exists, -1 if a step it depends on
+// doesn't exist, otherwise 1 if the step is enqueued, 2 if it waits,
+// or 3 if it's canceled as the workflow has failed.
+var enqueueWorkflowStepCmd = redis.NewScript(`
+local step = ARGV[1]
+if redis.call("HEXISTS", KEYS[1], "s:" .. step) == 1 then
+	return 0
+end
+local canceled = false
+local waiting = {}
+for i = 8, #ARGV do
+	local s = redis.call("HGET", KEYS[1], "s:" .. ARGV[i])
+	if not s then
+		return -1
+	end
+	if s == "failed" or s == "canceled" then
+		canceled = true
+	elseif s ~= "completed" then
+		table.insert(waiting, ARGV[i])
+	end
+end
+local res = 1
+redis.call("HMSET", KEYS[1], "i:" .. step, ARGV[3], "t:" .. step, ARGV[4])
+if #ARGV >= 8 then
+	redis.call("HSET", KEYS[1], "p:" .. step, cjson.encode({unpack(ARGV, 8)}))
+end
+if canceled then
+	redis.call("HSET", KEYS[1], "s:" .. step, "canceled")
+	res = 3
+elseif #waiting > 0 then
+	for _, dep in ipairs(waiting) do
+		local children = {}
+		local data = redis.call("HGET", KEYS[1], "c:" .. dep)
+		if data then
+			children = cjson.decode(data)
+		end
+		table.insert(children, step)
+		redis.call("HSET", KEYS[1], "c:" .. dep, cjson.encode(children))
+	end
+	redis.call("HMSET", KEYS[1], "s:" .. step, "waiting", "d:" .. step, #waiting,
+		"m:" .. step, ARGV[2], "q:" .. step, ARGV[5])
+	res = 2
+else
+	redis.call("LPUSH", KEYS[2], ARGV[2])
+	redis.call("SADD", KEYS[3], KEYS[2])
+	if ARGV[7] ~= "" then
+		redis.call("PUBLISH", ARGV[7], ARGV[5])
+	end
+	redis.call("HSET", KEYS[1], "s:" .. step, "enqueued")
+end
+redis.call("EXPIRE", KEYS[1], ARGV[6])
+return res`)
+
+// EnqueueWorkflowStep adds the task of the step to its workflow. The task
+// is enqueued if all the steps it depends on have completed, otherwise it
+// waits in the workflow until they do. The task is canceled if one of the
+// steps of the workflow has failed.
+//
+// It returns the state of the step.
+func (r *RDB) EnqueueWorkflowStep(msg *base.TaskMessage, dependsOn []string) (string, error) {
+	bytes, err := base.EncodeMessage(msg)
+	if err != nil {
+		return "", err
+	}
+	keys := []string{r.keys.WorkflowKey(msg.WorkflowID), r.keys.QueueKey(msg.Queue), r.keys.AllQueues}
+	args := []interface{}{msg.WorkflowStep, bytes, msg.ID.String(), msg.Type, msg.Queue,
+		int(WorkflowRetention.Seconds()), r.wakeChannel()}
+	for _, dep := range dependsOn {
+		args = append(args, dep)
+	}
+	res, err := enqueueWorkflowStepCmd.Run(r.client, keys, args...).Result()
+	if err != nil {
+		return "", err
+	}
+	n, err := cast.ToInt64E(res)
+	if err != nil {
+		return "", err
+	}
+	switch n {
+	case 0:
+		return "", ErrDuplicateWorkflowStep
+	case -1:
+		return "", fmt.Errorf("workflow step %q depends on a step which does not exist", msg.WorkflowStep)
+	case 2:
+		return StepWaiting, nil
+	case 3:
+		return StepCanceled, nil
+	}
+	return StepEnqueued, nil
+}
+
+// KEYS[1] -> {asynq}:workflows:<workflow id>
+// KEYS[2] -> {asynq}:queues
+// ARGV[1] -> step name
+// ARGV[2] -> workflow retention in seconds
+// ARGV[3] -> wake channel to publish the queue names to, or empty string
+// ARGV[4] -> queue key prefix
+//
+// Returns the number of the steps released.
+var completeWorkflowStepCmd = redis.NewScript(`
+local step = ARGV[1]
+if redis.call("HGET", KEYS[1], "s:" .. step) ~= "enqueued" then
+	return 0
+end
+redis.call("HSET", KEYS[1], "s:" .. step, "completed")
+local released = 0
+local data = redis.call("HGET", KEYS[1], "c:" .. step)
+if data then
+	for _, child in ipairs(cjson.decode(data)) do
+		if redis.call("HGET", KEYS[1], "s:" .. child) == "waiting" and
+			redis.call("HINCRBY", KEYS[1], "d:" .. child, -1) <= 0 then
+			local qname = redis.call("HGET", KEYS[1], "q:" .. child)
+			local qkey = ARGV[4] .. qname
+			redis.call("LPUSH", qkey, redis.call("HGET", KEYS[1], "m:" .. child))
+			redis.call("SADD", KEYS[2], qkey)
+			if ARGV[3] ~= "" then
+				redis.call("PUBLISH", ARGV[3], qname)
+			end
+			redis.call("HSET", KEYS[1], "s:" .. child, "enqueued")
+			redis.call("HDEL", KEYS[1], "d:" .. child, "m:" .. child, "q:" .. child)
+			released = released + 1
+		end
+	end
+	redis.call("HDEL", KEYS[1], "c:" .. step)
+end
+redis.call("EXPIRE", KEYS[1], ARGV[2])
+return released`)
+
+// CompleteWorkflowStep marks the step of the workflow as completed, and
+// enqueues the tasks of the steps which no longer wait for other steps.
+//
+// Completing a step which isn't enqueued (e.g. completed already) has
+// no effect.
+func (r *RDB) CompleteWorkflowStep(id, step string) error {
+	return completeWorkflowStepCmd.Run(r.client,
+		[]string{r.keys.WorkflowKey(id), r.keys.AllQueues},
+		step, int(WorkflowRetention.Seconds()), r.wakeChannel(), r.keys.QueuePrefix).Err()
+}
+
+// failWorkflowStepLua defines the lua function failWorkflowStep, which
+// marks the step of the workflow stored at key as failed and cancels the
+// steps still waiting, so that the scripts moving tasks to the dead queue
+// fail their steps atomically.
+const failWorkflowStepLua = `
+local function failWorkflowStep(key, step, retention)
+	if redis.call("HGET", key, "s:" .. step) ~= "enqueued" then
+		return 0
+	end
+	redis.call("HSET", key, "s:" .. step, "failed")
+	local canceled = 0
+	local fields = redis.call("HGETALL", key)
+	for i = 1, #fields, 2 do
+		if string.sub(fields[i], 1, 2) == "s:" and fields[i+1] == "waiting" then
+			local s = string.sub(fields[i], 3)
+			redis.call("HSET", key, fields[i], "canceled")
+			redis.call("HDEL", key, "d:" .. s, "m:" .. s, "q:" .. s)
+			canceled = canceled + 1
+		end
+	end
+	redis.call("EXPIRE", key, retention)
+	return canceled
+end
+`
+
+// KEYS[1] -> {asynq}:workflows:<workflow id>
+// ARGV[1] -> step name
+// ARGV[2] -> workflow retention in seconds
+//
+// Returns the number of the steps canceled.
+var failWorkflowStepCmd = redis.NewScript(failWorkflowStepLua + `
+return failWorkflowStep(KEYS[1], ARGV[1], ARGV[2])`)
+
+// FailWorkflowStep marks the step of the workflow as failed, and cancels
+// the steps of the workflow still waiting.
+//
+// Failing a step which isn't enqueued (e.g. failed already) has no effect.
+func (r *RDB) FailWorkflowStep(id, step string) error {
+	return failWorkflowStepCmd.Run(r.client, []string{r.keys.WorkflowKey(id)},
+		step, int(WorkflowRetention.Seconds())).Err()
+}
+
+// KEYS[1] -> {asynq}:workflows:<workflow id>
+// ARGV[1] -> step name
+// ARGV[2] -> result
+// ARGV[3] -> workflow retention in seconds
+//
+// Returns 0 if the step doesn't exist.
+var setWorkflowStepResultCmd = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[1], "s:" .. ARGV[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], "r:" .. ARGV[1], ARGV[2])
+redis.call("EXPIRE", KEYS[1], ARGV[3])
+return 1`)
+
+// SetWorkflowStepResult stores the result of the step of the workflow,
+// overwriting the result set before.
+func (r *RDB) SetWorkflowStepResult(id, step string, result []byte) error {
+	res, err := setWorkflowStepResultCmd.Run(r.client, []string{r.keys.WorkflowKey(id)},
+		step, result, int(WorkflowRetention.Seconds())).Result()
+	if err != nil {
+		return err
+	}
+	if n, err := cast.ToInt64E(res); err != nil || n == 0 {
+		return ErrWorkflowNotFound
+	}
+	return nil
+}
+
+// WorkflowStepResults returns the results of the steps the step of the
+// workflow depends on, by step name. Steps without results are mapped to nil.
+func (r *RDB) WorkflowStepResults(id, step string) (map[string][]byte, error) {
+	key := r.keys.WorkflowKey(id)
+	data, err := r.client.HGet(key, "p:"+step).Result()
+	if err == redis.Nil {
+		if exists, err := r.client.HExists(key, "s:"+step).Result(); err != nil || !exists {
+			return nil, ErrWorkflowNotFound
+		}
+		return map[string][]byte{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var deps []string
+	if err := json.Unmarshal([]byte(data), &deps); err != nil {
+		return nil, err
+	}
+	fields := make([]string, len(deps))
+	for i, dep := range deps {
+		fields[i] = "r:" + dep
+	}
+	vals, err := r.client.HMGet(key, fields...).Result()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string][]byte)
+	for i, dep := range deps {
+		res[dep] = nil
+		if s, ok := vals[i].(string); ok {
+			res[dep] = []byte(s)
+		}
+	}
+	return res, nil
+}
+
+// WorkflowStep is the state of a step of a workflow.
+type WorkflowStep struct {
+	Name   string
+	TaskID string
+	Type   string
+	State  string
+
+	// Waiting is the number of steps the step still waits for.
+	Waiting int
+}
+
+// Workflow returns the steps of the workflow sorted by name.
+//
+// It returns ErrWorkflowNotFound if the workflow doesn't exist or
+// has expired.
+func (r *RDB) Workflow(id string) ([]*WorkflowStep, error) {
+	fields, err := r.client.HGetAll(r.keys.WorkflowKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, ErrWorkflowNotFound
+	}
+	steps := make(map[string]*WorkflowStep)
+	get := func(name string) *WorkflowStep {
+		s, ok := steps[name]
+		if !ok {
+			s = &WorkflowStep{Name: name}
+			steps[name] = s
+		}
+		return s
+	}
+	for field, val := range fields {
+		if len(field) < 2 || field[1] != ':' {
+			continue
+		}
+		name := field[2:]
+		switch field[0] {
+		case 's':
+			get(name).State = val
+		case 'i':
+			get(name).TaskID = val
+		case 't':
+			get(name).Type = val
+		case 'd':
+			get(name).Waiting = cast.ToInt(val)
+		}
+	}
+	var res []*WorkflowStep
+	for _, s := range steps {
+		res = append(res, s)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
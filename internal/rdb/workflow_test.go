@@ -0,0 +1,254 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+func newStepMessage(step string) *base.TaskMessage {
+	msg := h.NewTaskMessage(step, nil)
+	msg.WorkflowID = "order:1234"
+	msg.WorkflowStep = step
+	return msg
+}
+
+// enqueuedTypes returns the types of the tasks in the default queue sorted by type.
+func enqueuedTypes(t *testing.T, r *RDB) []string {
+	t.Helper()
+	var res []string
+	for _, msg := range h.GetEnqueuedMessages(t, r.client) {
+		res = append(res, msg.Type)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func stepStates(t *testing.T, r *RDB) map[string]string {
+	t.Helper()
+	steps, err := r.Workflow("order:1234")
+	if err != nil {
+		t.Fatalf("(*RDB).Workflow returned error: %v", err)
+	}
+	res := make(map[string]string)
+	for _, s := range steps {
+		res[s.Name] = s.State
+	}
+	return res
+}
+
+func TestWorkflowReleasesSteps(t *testing.T) {
+	r := setup(t)
+	// reserve -> (charge, notify) -> ship
+	steps := []struct {
+		name      string
+		dependsOn []string
+		want      string
+	}{
+		{"reserve", nil, StepEnqueued},
+		{"charge", []string{"reserve"}, StepWaiting},
+		{"notify", []string{"reserve"}, StepWaiting},
+		{"ship", []string{"charge", "notify"}, StepWaiting},
+	}
+	for _, s := range steps {
+		got, err := r.EnqueueWorkflowStep(newStepMessage(s.name), s.dependsOn)
+		if err != nil {
+			t.Fatalf("(*RDB).EnqueueWorkflowStep(%q) returned error: %v", s.name, err)
+		}
+		if got != s.want {
+			t.Errorf("(*RDB).EnqueueWorkflowStep(%q) = %q, want %q", s.name, got, s.want)
+		}
+	}
+	if _, err := r.EnqueueWorkflowStep(newStepMessage("ship"), nil); err != ErrDuplicateWorkflowStep {
+		t.Errorf("(*RDB).EnqueueWorkflowStep(duplicate) returned error %v, want %v", err, ErrDuplicateWorkflowStep)
+	}
+	if _, err := r.EnqueueWorkflowStep(newStepMessage("refund"), []string{"cancel"}); err == nil {
+		t.Errorf("(*RDB).EnqueueWorkflowStep(unknown dependency) returned nil error")
+	}
+
+	tests := []struct {
+		complete string
+		want     []string // types of the tasks in the queue
+	}{
+		{"", []string{"reserve"}},
+		{"reserve", []string{"charge", "notify", "reserve"}},
+		{"charge", []string{"charge", "notify", "reserve"}},
+		{"charge", []string{"charge", "notify", "reserve"}}, // completing twice has no effect
+		{"notify", []string{"charge", "notify", "reserve", "ship"}},
+	}
+	for _, tc := range tests {
+		if tc.complete != "" {
+			if err := r.CompleteWorkflowStep("order:1234", tc.complete); err != nil {
+				t.Fatalf("(*RDB).CompleteWorkflowStep(%q) returned error: %v", tc.complete, err)
+			}
+		}
+		if diff := cmp.Diff(tc.want, enqueuedTypes(t, r)); diff != "" {
+			t.Errorf("after completing %q, enqueued %v, want %v; (-want,+got)\n%s", tc.complete, enqueuedTypes(t, r), tc.want, diff)
+		}
+	}
+
+	want := map[string]string{
+		"reserve": StepCompleted,
+		"charge":  StepCompleted,
+		"notify":  StepCompleted,
+		"ship":    StepEnqueued,
+	}
+	if diff := cmp.Diff(want, stepStates(t, r)); diff != "" {
+		t.Errorf("step states mismatch; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestWorkflowFailedStepCancelsWaitingSteps(t *testing.T) {
+	r := setup(t)
+	for _, s := range []struct {
+		name      string
+		dependsOn []string
+	}{
+		{"reserve", nil},
+		{"audit", nil},
+		{"charge", []string{"reserve"}},
+	} {
+		if _, err := r.EnqueueWorkflowStep(newStepMessage(s.name), s.dependsOn); err != nil {
+			t.Fatalf("(*RDB).EnqueueWorkflowStep(%q) returned error: %v", s.name, err)
+		}
+	}
+
+	if err := r.FailWorkflowStep("order:1234", "reserve"); err != nil {
+		t.Fatalf("(*RDB).FailWorkflowStep returned error: %v", err)
+	}
+	got, err := r.EnqueueWorkflowStep(newStepMessage("ship"), []string{"charge"})
+	if err != nil {
+		t.Fatalf("(*RDB).EnqueueWorkflowStep returned error: %v", err)
+	}
+	if got != StepCanceled {
+		t.Errorf("(*RDB).EnqueueWorkflowStep after failure = %q, want %q", got, StepCanceled)
+	}
+
+	want := map[string]string{
+		"reserve": StepFailed,
+		"audit":   StepEnqueued,
+		"charge":  StepCanceled,
+		"ship":    StepCanceled,
+	}
+	if diff := cmp.Diff(want, stepStates(t, r)); diff != "" {
+		t.Errorf("step states mismatch; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestWorkflowKilledStepCancelsWaitingSteps(t *testing.T) {
+	seedRetry := func(t *testing.T, r *RDB, msg *base.TaskMessage) {
+		h.SeedRetryQueue(t, r.client, []h.ZSetEntry{{Msg: msg, Score: 1000}})
+	}
+	tests := []struct {
+		desc string
+		seed func(t *testing.T, r *RDB, msg *base.TaskMessage)
+		kill func(r *RDB, msg *base.TaskMessage) error
+	}{
+		{
+			desc: "KillRetryTask",
+			seed: seedRetry,
+			kill: func(r *RDB, msg *base.TaskMessage) error { return r.KillRetryTask(msg.ID, 1000) },
+		},
+		{
+			desc: "KillAllRetryTasks",
+			seed: seedRetry,
+			kill: func(r *RDB, msg *base.TaskMessage) error {
+				_, err := r.KillAllRetryTasks()
+				return err
+			},
+		},
+		{
+			desc: "RecoverExpiredLeases",
+			seed: func(t *testing.T, r *RDB, msg *base.TaskMessage) {
+				msg.Retried = msg.Retry // exhausted its retries
+				h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{msg})
+				bytes, err := base.EncodeMessage(msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.client.ZAdd(base.Leases, &redis.Z{Member: string(bytes), Score: float64(time.Now().Add(-time.Minute).Unix())})
+			},
+			kill: func(r *RDB, msg *base.TaskMessage) error {
+				_, err := r.RecoverExpiredLeases()
+				return err
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		r := setup(t)
+		reserve := newStepMessage("reserve")
+		if _, err := r.EnqueueWorkflowStep(reserve, nil); err != nil {
+			t.Fatalf("(*RDB).EnqueueWorkflowStep returned error: %v", err)
+		}
+		if _, err := r.EnqueueWorkflowStep(newStepMessage("charge"), []string{"reserve"}); err != nil {
+			t.Fatalf("(*RDB).EnqueueWorkflowStep returned error: %v", err)
+		}
+		r.client.Del(base.DefaultQueue)
+		tc.seed(t, r, reserve)
+
+		if err := tc.kill(r, reserve); err != nil {
+			t.Fatalf("%s: returned error: %v", tc.desc, err)
+		}
+		if got := len(h.GetDeadMessages(t, r.client)); got != 1 {
+			t.Errorf("%s: %q has %d tasks, want 1", tc.desc, base.DeadQueue, got)
+		}
+		want := map[string]string{"reserve": StepFailed, "charge": StepCanceled}
+		if diff := cmp.Diff(want, stepStates(t, r)); diff != "" {
+			t.Errorf("%s: step states mismatch; (-want,+got)\n%s", tc.desc, diff)
+		}
+	}
+}
+
+func TestWorkflowNotFound(t *testing.T) {
+	r := setup(t)
+	if _, err := r.Workflow("order:1234"); err != ErrWorkflowNotFound {
+		t.Errorf("(*RDB).Workflow returned error %v, want %v", err, ErrWorkflowNotFound)
+	}
+}
+
+func TestWorkflowStepResults(t *testing.T) {
+	r := setup(t)
+	for _, s := range []struct {
+		name      string
+		dependsOn []string
+	}{
+		{"0", nil},
+		{"1", nil},
+		{"callback", []string{"0", "1"}},
+	} {
+		if _, err := r.EnqueueWorkflowStep(newStepMessage(s.name), s.dependsOn); err != nil {
+			t.Fatalf("(*RDB).EnqueueWorkflowStep(%q) returned error: %v", s.name, err)
+		}
+	}
+	if err := r.SetWorkflowStepResult("order:1234", "0", []byte("42")); err != nil {
+		t.Fatalf("(*RDB).SetWorkflowStepResult returned error: %v", err)
+	}
+	if err := r.SetWorkflowStepResult("order:1234", "2", []byte("42")); err != ErrWorkflowNotFound {
+		t.Errorf("(*RDB).SetWorkflowStepResult(unknown step) returned error %v, want %v", err, ErrWorkflowNotFound)
+	}
+
+	got, err := r.WorkflowStepResults("order:1234", "callback")
+	if err != nil {
+		t.Fatalf("(*RDB).WorkflowStepResults returned error: %v", err)
+	}
+	want := map[string][]byte{"0": []byte("42"), "1": nil}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(*RDB).WorkflowStepResults = %v, want %v; (-want,+got)\n%s", got, want, diff)
+	}
+	if got, err := r.WorkflowStepResults("order:1234", "0"); err != nil || len(got) != 0 {
+		t.Errorf("(*RDB).WorkflowStepResults(step without dependencies) = %v, %v; want empty results", got, err)
+	}
+	if _, err := r.WorkflowStepResults("order:5678", "callback"); err != ErrWorkflowNotFound {
+		t.Errorf("(*RDB).WorkflowStepResults(unknown workflow) returned error %v, want %v", err, ErrWorkflowNotFound)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"sync"
+	"time"
+)
+
+// DeadRetention specifies how many dead tasks, and for how long, to keep
+// in redis, so that the dead queue doesn't grow unbounded when tasks keep
+// failing (e.g. during an outage of a dependency).
+//
+// The dead queue is trimmed whenever the background kills a task, and
+// periodically by one of the backgrounds sharing a redis instance, which
+// also trims the tasks killed with an Inspector or by older backgrounds.
+type DeadRetention struct {
+	// MaxSize specifies the maximum number of tasks to keep in the dead
+	// queue. The tasks killed the earliest are deleted first.
+	//
+	// If zero or negative, 10,000 tasks are kept.
+	MaxSize int
+
+	// MaxAge specifies how long to keep a task in the dead queue since
+	// it was killed.
+	//
+	// If zero or negative, tasks are kept for 90 days.
+	MaxAge time.Duration
+}
+
+// janitorStore is implemented by brokers which can trim the dead queue
+// and delete the expired completed tasks.
+type janitorStore interface {
+	TrimDead(maxSize int, maxAge time.Duration) (int64, error)
+	DeleteExpiredCompleted() (int64, error)
+}
+
+// janitorLockName is the name of the lock to acquire before trimming.
+const janitorLockName = "janitor"
+
+// janitor periodically deletes the dead and completed tasks past their
+// retention from redis.
+//
+// A nil janitor does nothing.
+type janitor struct {
+	logger *asynqLogger
+	rdb    janitorStore
+
+	// locker ensures only one of the backgrounds trims the queues
+	// at a time, nil if backgrounds don't coordinate.
+	locker Locker
+
+	// dead is the retention of the dead tasks, nil if the dead queue
+	// is not trimmed.
+	dead *DeadRetention
+
+	// completed is true if the expired completed tasks are deleted.
+	completed bool
+
+	// channel to communicate back to the long running "janitor" goroutine.
+	done chan struct{}
+
+	// interval between trims.
+	interval time.Duration
+}
+
+func newJanitor(logger *asynqLogger, r janitorStore, locker Locker, dead *DeadRetention, retention, interval time.Duration) *janitor {
+	if r == nil || (dead == nil && retention <= 0) {
+		return nil
+	}
+	return &janitor{
+		logger:    logger,
+		rdb:       r,
+		locker:    locker,
+		dead:      dead,
+		completed: retention > 0,
+		done:      make(chan struct{}),
+		interval:  interval,
+	}
+}
+
+func (j *janitor) terminate() {
+	if j == nil {
+		return
+	}
+	j.logger.debug("Janitor shutting down...")
+	// Signal the janitor goroutine to stop.
+	j.done <- struct{}{}
+	if j.locker != nil {
+		if err := j.locker.Unlock(janitorLockName); err != nil {
+			j.logger.warn("Could not release janitor lock: %v", err)
+		}
+	}
+}
+
+func (j *janitor) start(wg *sync.WaitGroup) {
+	if j == nil {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-j.done:
+				j.logger.debug("Janitor done")
+				return
+			case <-time.After(j.interval):
+				j.exec()
+			}
+		}
+	}()
+}
+
+func (j *janitor) exec() {
+	if j.locker != nil {
+		ok, err := j.locker.Lock(janitorLockName, 3*j.interval)
+		if err != nil {
+			j.logger.error("Could not acquire janitor lock: %v", err)
+			return
+		}
+		if !ok {
+			return
+		}
+	}
+	if j.dead != nil {
+		n, err := j.rdb.TrimDead(j.dead.MaxSize, j.dead.MaxAge)
+		if err != nil {
+			j.logger.error("Could not trim dead tasks: %v", err)
+		} else if n > 0 {
+			j.logger.info("Deleted %d dead tasks past their retention", n)
+		}
+	}
+	if j.completed {
+		n, err := j.rdb.DeleteExpiredCompleted()
+		if err != nil {
+			j.logger.error("Could not delete expired completed tasks: %v", err)
+		} else if n > 0 {
+			j.logger.debug("Deleted %d completed tasks past their retention", n)
+		}
+	}
+}
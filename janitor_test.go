@@ -0,0 +1,112 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// trimmingStore records the limits TrimDead is called with, and the number
+// of calls to DeleteExpiredCompleted.
+type trimmingStore struct {
+	mu        sync.Mutex
+	calls     []DeadRetention
+	completed int
+}
+
+func (s *trimmingStore) TrimDead(maxSize int, maxAge time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, DeadRetention{MaxSize: maxSize, MaxAge: maxAge})
+	return 1, nil
+}
+
+func (s *trimmingStore) DeleteExpiredCompleted() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.completed++
+	return 1, nil
+}
+
+func TestJanitorWithLocker(t *testing.T) {
+	retention := &DeadRetention{MaxSize: 100, MaxAge: 24 * time.Hour}
+	tests := []struct {
+		held      bool
+		wantCalls []DeadRetention
+	}{
+		{held: true, wantCalls: []DeadRetention{*retention}},
+		{held: false, wantCalls: nil},
+	}
+
+	for _, tc := range tests {
+		s := &trimmingStore{}
+		l := &fakeLocker{held: tc.held}
+		j := newJanitor(testLogger, s, l, retention, 0, time.Minute)
+		j.exec()
+		if diff := cmp.Diff(tc.wantCalls, s.calls); diff != "" {
+			t.Errorf("with lock held=%t, TrimDead called with %v, want %v; (-want,+got)\n%s", tc.held, s.calls, tc.wantCalls, diff)
+		}
+		var wg sync.WaitGroup
+		j.start(&wg)
+		j.terminate()
+		wg.Wait()
+		want := []string{janitorLockName}
+		if diff := cmp.Diff(want, l.unlocked); diff != "" {
+			t.Errorf("unlocked %v, want %v; (-want,+got)\n%s", l.unlocked, want, diff)
+		}
+	}
+}
+
+func TestJanitorCompletedRetention(t *testing.T) {
+	s := &trimmingStore{}
+	j := newJanitor(testLogger, s, nil, nil, time.Hour, time.Minute)
+	j.exec()
+	if len(s.calls) != 0 || s.completed != 1 {
+		t.Errorf("janitor with completed retention called TrimDead %d times and DeleteExpiredCompleted %d times, want 0 and 1",
+			len(s.calls), s.completed)
+	}
+}
+
+func TestNewJanitorDisabled(t *testing.T) {
+	if j := newJanitor(testLogger, &trimmingStore{}, nil, nil, 0, time.Minute); j != nil {
+		t.Errorf("newJanitor without retention = %v, want nil", j)
+	}
+	if j := newJanitor(testLogger, nil, nil, &DeadRetention{}, time.Hour, time.Minute); j != nil {
+		t.Errorf("newJanitor without store = %v, want nil", j)
+	}
+	// nil janitor should be safe to start and terminate.
+	var j *janitor
+	var wg sync.WaitGroup
+	j.start(&wg)
+	j.terminate()
+	wg.Wait()
+}
+
+func TestBackgroundDeadRetention(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	old := h.NewTaskMessage("send_email", nil)
+	recent := h.NewTaskMessage("send_email", nil)
+	h.SeedDeadQueue(t, r, []h.ZSetEntry{
+		{Msg: old, Score: float64(now.Add(-48 * time.Hour).Unix())},
+		{Msg: recent, Score: float64(now.Add(-time.Hour).Unix())},
+	})
+
+	bg := NewBackground(RedisClientOpt{Addr: redisAddr, DB: redisDB}, &Config{
+		DeadRetention: &DeadRetention{MaxAge: 24 * time.Hour},
+	})
+	bg.janitor.exec()
+
+	gotDead := h.GetDeadMessages(t, r)
+	if len(gotDead) != 1 || gotDead[0].ID != recent.ID {
+		t.Errorf("%q has %v after trimming, want only %v", base.DeadQueue, gotDead, recent)
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// latencyStore is implemented by brokers which store latency histograms.
+type latencyStore interface {
+	AddLatencies(msg *base.TaskMessage, wait, run time.Duration) error
+}
+
+// addLatencies records how long the task waited in its queue until the
+// given start time and took to process since then.
+//
+// The wait is recorded only for the first attempt of the tasks whose
+// messages have the time they were scheduled at.
+func (p *processor) addLatencies(msg *base.TaskMessage, started time.Time) {
+	if p.latencies == nil {
+		return
+	}
+	run := time.Since(started)
+	wait := time.Duration(-1)
+	if msg.Retried == 0 && msg.ProcessAt > 0 {
+		if wait = started.Sub(time.Unix(0, msg.ProcessAt)); wait < 0 {
+			wait = 0 // clocks of the client and the background differ.
+		}
+	}
+	if err := p.latencies.AddLatencies(msg, wait, run); err != nil {
+		p.logger.warn("Could not record latencies of task id=%s: %v", msg.ID, err)
+	}
+}
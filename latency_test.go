@@ -0,0 +1,67 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"testing"
+	"time"
+
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// fakeLatencyStore records the latencies of the last task.
+type fakeLatencyStore struct {
+	base.Broker
+	wait, run time.Duration
+}
+
+func (s *fakeLatencyStore) AddLatencies(msg *base.TaskMessage, wait, run time.Duration) error {
+	s.wait, s.run = wait, run
+	return nil
+}
+
+func TestProcessorAddLatencies(t *testing.T) {
+	s := &fakeLatencyStore{}
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            s,
+		queues:         defaultQueueConfig,
+		concurrency:    1,
+		retryDelayFunc: defaultDelayFunc,
+		cancelations:   base.NewCancelations(),
+	})
+	started := time.Now().Add(-time.Second)
+
+	tests := []struct {
+		desc      string
+		processAt time.Time
+		retried   int
+		wantWait  time.Duration // negative if wait should not be recorded
+	}{
+		{"first attempt", started.Add(-3 * time.Second), 0, 3 * time.Second},
+		{"retry", started.Add(-3 * time.Second), 1, -1},
+		{"written by older version", time.Time{}, 0, -1},
+		{"clock skew", started.Add(time.Second), 0, 0},
+	}
+
+	for _, tc := range tests {
+		msg := h.NewTaskMessage("send_email", nil)
+		msg.Retried = tc.retried
+		if !tc.processAt.IsZero() {
+			msg.ProcessAt = tc.processAt.UnixNano()
+		}
+		p.addLatencies(msg, started)
+		if tc.wantWait < 0 && s.wait >= 0 {
+			t.Errorf("%s: recorded wait %v, want no wait recorded", tc.desc, s.wait)
+		}
+		if tc.wantWait >= 0 && s.wait != tc.wantWait {
+			t.Errorf("%s: recorded wait %v, want %v", tc.desc, s.wait, tc.wantWait)
+		}
+		if s.run < time.Second {
+			t.Errorf("%s: recorded run %v, want at least %v", tc.desc, s.run, time.Second)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+type leaseKey struct{}
+
+// ExtendLease extends the lease of the task being processed so that it
+// expires no earlier than d from now, which prevents legitimately long
+// running tasks from being recovered as orphaned if the process stops
+// refreshing its leases for a while (e.g. while it's busy or paused).
+//
+// The lease is written to redis immediately, and the process keeps
+// the lease at least until that time while it's processing the task.
+//
+// ctx should be the context passed to the handler; ExtendLease does nothing
+// if ctx is not a context of a task processed by a background.
+func ExtendLease(ctx context.Context, d time.Duration) error {
+	l, ok := ctx.Value(leaseKey{}).(*taskLease)
+	if !ok {
+		return nil
+	}
+	return l.keeper.extend(l.msgs, time.Now().Add(d))
+}
+
+// taskLease is the handle to the leases of the tasks carried by the context
+// of the handler.
+type taskLease struct {
+	keeper *leaseKeeper
+	msgs   []*base.TaskMessage
+}
+
+// leaseStore is implemented by brokers which lease in-progress tasks
+// to the processes which dequeued them.
+type leaseStore interface {
+	ExtendLeases(leases []*base.Lease) error
+	RecoverExpiredLeases() (int, error)
+}
+
+// leaseKeeper periodically extends the leases of the tasks being processed,
+// and recovers the tasks whose leases have expired because the process
+// processing them crashed or lost connection to redis.
+//
+// A nil leaseKeeper does nothing.
+type leaseKeeper struct {
+	logger *asynqLogger
+	rdb    leaseStore
+
+	mu sync.Mutex
+
+	// active holds the tasks being processed by task ID.
+	active map[string]*activeTask
+
+	// channel to communicate back to the long running "lease keeper" goroutine.
+	done chan struct{}
+
+	// interval between extending leases.
+	interval time.Duration
+}
+
+// activeTask is a task being processed.
+type activeTask struct {
+	msg *base.TaskMessage
+
+	// until is the time requested with ExtendLease until which
+	// the lease should be kept.
+	until time.Time
+
+	// expireAt is the expiration of the lease last written, zero if the
+	// lease hasn't been written by the lease keeper.
+	expireAt time.Time
+}
+
+func newLeaseKeeper(logger *asynqLogger, r leaseStore, interval time.Duration) *leaseKeeper {
+	if r == nil {
+		return nil
+	}
+	return &leaseKeeper{
+		logger:   logger,
+		rdb:      r,
+		active:   make(map[string]*activeTask),
+		done:     make(chan struct{}),
+		interval: interval,
+	}
+}
+
+// add records that the task is being processed.
+func (k *leaseKeeper) add(msg *base.TaskMessage) {
+	if k == nil {
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.active[msg.ID.String()] = &activeTask{msg: msg}
+}
+
+// withContext returns a copy of ctx which carries the leases of the tasks
+// for ExtendLease.
+func (k *leaseKeeper) withContext(ctx context.Context, msgs ...*base.TaskMessage) context.Context {
+	if k == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, leaseKey{}, &taskLease{keeper: k, msgs: msgs})
+}
+
+// extend extends the leases of the tasks until the given time,
+// except for the tasks no longer being processed.
+func (k *leaseKeeper) extend(msgs []*base.TaskMessage, until time.Time) error {
+	now := time.Now()
+	var leases []*base.Lease
+	k.mu.Lock()
+	for _, msg := range msgs {
+		t, ok := k.active[msg.ID.String()]
+		if !ok {
+			continue
+		}
+		if until.After(t.until) {
+			t.until = until
+		}
+		l := t.lease(now)
+		t.expireAt = l.ExpireAt
+		leases = append(leases, l)
+	}
+	k.mu.Unlock()
+	return k.rdb.ExtendLeases(leases)
+}
+
+// lease returns the lease of the task to be written at the given time.
+func (t *activeTask) lease(now time.Time) *base.Lease {
+	expireAt := now.Add(base.LeaseDuration)
+	if t.until.After(expireAt) {
+		expireAt = t.until
+	}
+	return &base.Lease{Msg: t.msg, ExpireAt: expireAt}
+}
+
+// remove records that the task is no longer being processed.
+func (k *leaseKeeper) remove(msg *base.TaskMessage) {
+	if k == nil {
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.active, msg.ID.String())
+}
+
+// release returns the tasks still being processed, and records that they
+// are no longer processed.
+func (k *leaseKeeper) release() []*base.TaskMessage {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var msgs []*base.TaskMessage
+	for id, t := range k.active {
+		msgs = append(msgs, t.msg)
+		delete(k.active, id)
+	}
+	return msgs
+}
+
+func (k *leaseKeeper) terminate() {
+	if k == nil {
+		return
+	}
+	k.logger.debug("Lease keeper shutting down...")
+	// Signal the lease keeper goroutine to stop.
+	k.done <- struct{}{}
+}
+
+func (k *leaseKeeper) start(wg *sync.WaitGroup) {
+	if k == nil {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-k.done:
+				k.logger.debug("Lease keeper done")
+				return
+			case <-time.After(k.interval):
+				k.exec()
+			}
+		}
+	}()
+}
+
+// exec extends the leases which would expire soon after the next tick,
+// and recovers the tasks with expired leases.
+func (k *leaseKeeper) exec() {
+	k.extendLeases(time.Now())
+	n, err := k.rdb.RecoverExpiredLeases()
+	if err != nil {
+		k.logger.error("Could not recover tasks with expired leases: %v", err)
+	}
+	if n > 0 {
+		k.logger.warn("Recovered %d tasks whose workers stopped responding", n)
+	}
+}
+
+// extendLeases extends the leases which would expire within an interval
+// and a half from now, so that each lease is rewritten only every few ticks
+// rather than on every tick, while it's still extended a half interval
+// before it expires if the next tick is late.
+func (k *leaseKeeper) extendLeases(now time.Time) {
+	k.mu.Lock()
+	var leases []*base.Lease
+	for _, t := range k.active {
+		if !t.expireAt.Before(now.Add(k.interval + k.interval/2)) {
+			continue
+		}
+		l := t.lease(now)
+		t.expireAt = l.ExpireAt
+		leases = append(leases, l)
+	}
+	k.mu.Unlock()
+	if len(leases) > 0 {
+		if err := k.rdb.ExtendLeases(leases); err != nil {
+			k.logger.error("Could not extend leases of in-progress tasks: %v", err)
+			k.reset(leases)
+		}
+	}
+}
+
+// reset records that the leases could not be written, so that they are
+// written again on the next tick.
+func (k *leaseKeeper) reset(leases []*base.Lease) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, l := range leases {
+		if t, ok := k.active[l.Msg.ID.String()]; ok {
+			t.expireAt = time.Time{}
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// fakeLeaseStore records the leases extended.
+type fakeLeaseStore struct {
+	mu        sync.Mutex
+	extended  [][]*base.Lease
+	recovered int
+}
+
+func (s *fakeLeaseStore) ExtendLeases(leases []*base.Lease) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.extended = append(s.extended, leases)
+	return nil
+}
+
+// msgs returns the tasks whose leases were extended in each call.
+func (s *fakeLeaseStore) msgs() [][]*base.TaskMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res [][]*base.TaskMessage
+	for _, leases := range s.extended {
+		var msgs []*base.TaskMessage
+		for _, l := range leases {
+			msgs = append(msgs, l.Msg)
+		}
+		res = append(res, msgs)
+	}
+	return res
+}
+
+func (s *fakeLeaseStore) RecoverExpiredLeases() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recovered++
+	return 0, nil
+}
+
+func TestLeaseKeeper(t *testing.T) {
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	s := &fakeLeaseStore{}
+	k := newLeaseKeeper(testLogger, s, time.Minute)
+
+	k.add(m1)
+	k.add(m2)
+	k.exec()
+	k.remove(m1)
+	k.exec()
+
+	want := [][]*base.TaskMessage{{m1, m2}, {m2}}
+	if got := s.msgs(); !cmp.Equal(want, got, h.SortMsgOpt) {
+		t.Errorf("extended leases %v, want %v; (-want,+got)\n%s", got, want, cmp.Diff(want, got, h.SortMsgOpt))
+	}
+	if s.recovered != 2 {
+		t.Errorf("RecoverExpiredLeases called %d times, want 2", s.recovered)
+	}
+
+	var wg sync.WaitGroup
+	k.start(&wg)
+	k.terminate()
+	wg.Wait()
+}
+
+func TestLeaseKeeperSkipsFreshLeases(t *testing.T) {
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	s := &fakeLeaseStore{}
+	k := newLeaseKeeper(testLogger, s, base.LeaseDuration/3)
+
+	k.add(m1)
+	k.exec()
+	// the lease of m1 is fresh enough to last until after the next tick.
+	k.add(m2)
+	k.exec()
+	k.exec()
+
+	want := [][]*base.TaskMessage{{m1}, {m2}}
+	if got := s.msgs(); !cmp.Equal(want, got) {
+		t.Errorf("extended leases %v, want %v; (-want,+got)\n%s", got, want, cmp.Diff(want, got))
+	}
+	if s.recovered != 3 {
+		t.Errorf("RecoverExpiredLeases called %d times, want 3", s.recovered)
+	}
+}
+
+func TestLeaseKeeperExtendsEveryFewTicks(t *testing.T) {
+	m := h.NewTaskMessage("send_email", nil)
+	s := &fakeLeaseStore{}
+	interval := base.LeaseDuration / 3
+	k := newLeaseKeeper(testLogger, s, interval)
+	k.add(m)
+
+	start := time.Now()
+	var extended []int // ticks the lease was extended at
+	for tick := 0; tick < 7; tick++ {
+		n := len(s.msgs())
+		k.extendLeases(start.Add(time.Duration(tick) * interval))
+		if len(s.msgs()) > n {
+			extended = append(extended, tick)
+		}
+		if expireAt := k.active[m.ID.String()].expireAt; !expireAt.After(start.Add(time.Duration(tick+1) * interval)) {
+			t.Errorf("lease expires at %v on tick %d, before the next tick", expireAt, tick)
+		}
+	}
+
+	// A lease written on a tick lasts for three intervals, so it's
+	// rewritten on every other tick.
+	want := []int{0, 2, 4, 6}
+	if diff := cmp.Diff(want, extended); diff != "" {
+		t.Errorf("lease extended on ticks %v, want %v; (-want,+got)\n%s", extended, want, diff)
+	}
+}
+
+func TestExtendLease(t *testing.T) {
+	m1 := h.NewTaskMessage("export_report", nil)
+	m2 := h.NewTaskMessage("send_email", nil)
+	s := &fakeLeaseStore{}
+	k := newLeaseKeeper(testLogger, s, time.Minute)
+	k.add(m1)
+	ctx := k.withContext(context.Background(), m1, m2)
+
+	start := time.Now()
+	if err := ExtendLease(ctx, time.Hour); err != nil {
+		t.Fatalf("ExtendLease(ctx, time.Hour) returned error: %v", err)
+	}
+	if err := ExtendLease(ctx, time.Second); err != nil {
+		t.Fatalf("ExtendLease(ctx, time.Second) returned error: %v", err)
+	}
+	k.exec()
+
+	// m2 is not being processed, so its lease should not be extended.
+	// The lease extended for an hour is not rewritten by the lease keeper.
+	want := [][]*base.TaskMessage{{m1}, {m1}}
+	if got := s.msgs(); !cmp.Equal(want, got) {
+		t.Fatalf("extended leases %v, want %v; (-want,+got)\n%s", got, want, cmp.Diff(want, got))
+	}
+	// Shorter extensions and periodic extensions should keep the longer lease.
+	for i, leases := range s.extended {
+		if got, want := leases[0].ExpireAt, start.Add(time.Hour); got.Before(want) {
+			t.Errorf("call %d extended lease until %v, want no earlier than %v", i, got, want)
+		}
+	}
+
+	k.remove(m1)
+	if err := ExtendLease(ctx, time.Hour); err != nil {
+		t.Fatalf("ExtendLease(ctx, time.Hour) returned error: %v", err)
+	}
+	k.exec()
+	if got := s.msgs(); len(got) != 3 || len(got[2]) != 0 {
+		t.Errorf("extended leases %v after the task finished, want none", got[2:])
+	}
+
+	// ExtendLease should be a no-op for a context without a lease.
+	if err := ExtendLease(context.Background(), time.Hour); err != nil {
+		t.Errorf("ExtendLease(context.Background(), time.Hour) returned error: %v", err)
+	}
+}
+
+func TestNilLeaseKeeper(t *testing.T) {
+	k := newLeaseKeeper(testLogger, nil, time.Minute)
+	if k != nil {
+		t.Fatalf("newLeaseKeeper(testLogger, nil, time.Minute) = %v, want nil", k)
+	}
+	// nil lease keeper should be safe to use.
+	msg := h.NewTaskMessage("send_email", nil)
+	k.add(msg)
+	if ctx := k.withContext(context.Background(), msg); ctx != context.Background() {
+		t.Errorf("nil leaseKeeper.withContext(ctx, msg) = %v, want ctx", ctx)
+	}
+	k.remove(msg)
+	var wg sync.WaitGroup
+	k.start(&wg)
+	k.terminate()
+	wg.Wait()
+}
+
+// requeueBroker records the tasks requeued.
+type requeueBroker struct {
+	base.Broker
+
+	mu         sync.Mutex
+	requeued   []*base.TaskMessage
+	requeueAll int
+}
+
+func (b *requeueBroker) Requeue(msg *base.TaskMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.requeued = append(b.requeued, msg)
+	return nil
+}
+
+func (b *requeueBroker) RequeueAll() (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.requeueAll++
+	return 0, nil
+}
+
+func TestProcessorRestoreWithLeases(t *testing.T) {
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	b := &requeueBroker{}
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            b,
+		queues:         defaultQueueConfig,
+		concurrency:    1,
+		retryDelayFunc: defaultDelayFunc,
+		cancelations:   base.NewCancelations(),
+		leases:         newLeaseKeeper(testLogger, &fakeLeaseStore{}, time.Minute),
+	})
+
+	// restoring on start doesn't touch the tasks of the other processes.
+	p.restore()
+	p.leases.add(m1)
+	p.leases.add(m2)
+	p.leases.remove(m2)
+	// restoring on shutdown requeues the tasks held by the process.
+	p.restore()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.requeueAll != 0 {
+		t.Errorf("RequeueAll called %d times, want 0", b.requeueAll)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{m1}, b.requeued); diff != "" {
+		t.Errorf("requeued tasks mismatch; (-want,+got)\n%s", diff)
+	}
+}
@@ -0,0 +1,26 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import "time"
+
+// Locker provides named distributed locks shared by background worker
+// processes, so that only one of them performs a task at a time (e.g.
+// forwarding scheduled tasks to their queues).
+//
+// By default, backgrounds use locks stored in redis. Set Locker field
+// of Config to use another lock service (e.g. etcd or consul) instead.
+//
+// A Locker must be safe for concurrent use by multiple goroutines.
+type Locker interface {
+	// Lock acquires the named lock for the ttl and reports whether the
+	// lock is held by this Locker. If the lock is already held by this
+	// Locker, Lock extends its ttl. Lock should not block while the lock
+	// is held by another Locker.
+	Lock(name string, ttl time.Duration) (bool, error)
+
+	// Unlock releases the named lock if it's held by this Locker.
+	Unlock(name string) error
+}
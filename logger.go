@@ -1,35 +1,184 @@
 package asynq
 
 import (
+	"fmt"
 	"io"
 	"log"
-	"os"
+	"strings"
+	"sync"
 )
 
-// global logger used in asynq package.
-var logger = newLogger(os.Stderr)
+// Logger supports logging at various log levels.
+//
+// Implement Logger to use a logging library of your choice (e.g. zap or
+// zerolog) and set it to Logger field of Config.
+// A Logger must be safe for concurrent use by multiple goroutines.
+type Logger interface {
+	// Debug logs a message at Debug level.
+	Debug(args ...interface{})
+
+	// Info logs a message at Info level.
+	Info(args ...interface{})
+
+	// Warn logs a message at Warning level.
+	Warn(args ...interface{})
+
+	// Error logs a message at Error level.
+	Error(args ...interface{})
+}
+
+// LogLevel represents the minimum severity of messages to log.
+type LogLevel int
+
+const (
+	// Note: reserving value zero to differentiate unspecified case.
+	levelUnspecified LogLevel = iota
+
+	// DebugLevel is the lowest level of logging.
+	// Debug logs are intended for debugging and development purposes.
+	DebugLevel
+
+	// InfoLevel is used for general informational log messages.
+	InfoLevel
+
+	// WarnLevel is used for undesired but relatively expected events,
+	// which may indicate a problem.
+	WarnLevel
+
+	// ErrorLevel is used for undesired and unexpected events that
+	// the program can recover from.
+	ErrorLevel
+)
+
+// String returns the string representation of the log level.
+func (l LogLevel) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	}
+	return fmt.Sprintf("LogLevel(%d)", l)
+}
+
+// parseLogLevel returns a LogLevel given its string representation.
+func parseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return DebugLevel, nil
+	case "info":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
 
 func newLogger(out io.Writer) *asynqLogger {
 	return &asynqLogger{
-		log.New(out, "", log.Ldate|log.Ltime|log.Lmicroseconds|log.LUTC),
+		base:  newDefaultLogger(out),
+		level: InfoLevel,
 	}
 }
 
+// asynqLogger formats messages and passes the ones at or above
+// the log level to the base logger.
 type asynqLogger struct {
-	*log.Logger
+	mu    sync.Mutex
+	base  Logger
+	level LogLevel
+}
+
+// setBase sets the logger to which messages are passed.
+func (l *asynqLogger) setBase(base Logger) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.base = base
+}
+
+// setPrefix sets the prefix of the messages logged by the default logger.
+func (l *asynqLogger) setPrefix(prefix string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if d, ok := l.base.(*defaultLogger); ok {
+		d.SetPrefix(prefix)
+	}
+}
+
+func (l *asynqLogger) setLevel(level LogLevel) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.level = level
+}
+
+func (l *asynqLogger) getLevel() LogLevel {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.level
+}
+
+// enabled reports whether messages at the level should be logged,
+// and returns the base logger to log them.
+func (l *asynqLogger) enabled(level LogLevel) (Logger, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.base, level >= l.level
+}
+
+func (l *asynqLogger) debug(format string, args ...interface{}) {
+	if base, ok := l.enabled(DebugLevel); ok {
+		base.Debug(fmt.Sprintf(format, args...))
+	}
 }
 
 func (l *asynqLogger) info(format string, args ...interface{}) {
-	format = "INFO: " + format
-	l.Printf(format, args...)
+	if base, ok := l.enabled(InfoLevel); ok {
+		base.Info(fmt.Sprintf(format, args...))
+	}
 }
 
 func (l *asynqLogger) warn(format string, args ...interface{}) {
-	format = "WARN: " + format
-	l.Printf(format, args...)
+	if base, ok := l.enabled(WarnLevel); ok {
+		base.Warn(fmt.Sprintf(format, args...))
+	}
 }
 
 func (l *asynqLogger) error(format string, args ...interface{}) {
-	format = "ERROR: " + format
-	l.Printf(format, args...)
+	if base, ok := l.enabled(ErrorLevel); ok {
+		base.Error(fmt.Sprintf(format, args...))
+	}
+}
+
+// defaultLogger is a Logger which writes messages with
+// their level and timestamp using the standard log package.
+type defaultLogger struct {
+	*log.Logger
+}
+
+func newDefaultLogger(out io.Writer) *defaultLogger {
+	return &defaultLogger{
+		log.New(out, "", log.Ldate|log.Ltime|log.Lmicroseconds|log.LUTC),
+	}
+}
+
+func (l *defaultLogger) Debug(args ...interface{}) {
+	l.Print(append([]interface{}{"DEBUG: "}, args...)...)
+}
+
+func (l *defaultLogger) Info(args ...interface{}) {
+	l.Print(append([]interface{}{"INFO: "}, args...)...)
+}
+
+func (l *defaultLogger) Warn(args ...interface{}) {
+	l.Print(append([]interface{}{"WARN: "}, args...)...)
+}
+
+func (l *defaultLogger) Error(args ...interface{}) {
+	l.Print(append([]interface{}{"ERROR: "}, args...)...)
 }
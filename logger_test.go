@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"fmt"
 	"regexp"
+	"sync"
 	"testing"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 // regexp for timestamps
@@ -115,3 +118,97 @@ func TestLoggerError(t *testing.T) {
 		}
 	}
 }
+
+func TestLoggerLevel(t *testing.T) {
+	tests := []struct {
+		level    LogLevel
+		log      func(l *asynqLogger)
+		wantLogs bool
+	}{
+		{DebugLevel, func(l *asynqLogger) { l.debug("hello") }, true},
+		{InfoLevel, func(l *asynqLogger) { l.debug("hello") }, false},
+		{InfoLevel, func(l *asynqLogger) { l.info("hello") }, true},
+		{WarnLevel, func(l *asynqLogger) { l.info("hello") }, false},
+		{WarnLevel, func(l *asynqLogger) { l.warn("hello") }, true},
+		{ErrorLevel, func(l *asynqLogger) { l.warn("hello") }, false},
+		{ErrorLevel, func(l *asynqLogger) { l.error("hello") }, true},
+	}
+
+	for _, tc := range tests {
+		var buf bytes.Buffer
+		logger := newLogger(&buf)
+		logger.setLevel(tc.level)
+
+		tc.log(logger)
+
+		if got := buf.Len() > 0; got != tc.wantLogs {
+			t.Errorf("with level %v, logged = %t, want %t", tc.level, got, tc.wantLogs)
+		}
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		input string
+		want  LogLevel
+	}{
+		{"debug", DebugLevel},
+		{"info", InfoLevel},
+		{"WARN", WarnLevel},
+		{"warning", WarnLevel},
+		{"error", ErrorLevel},
+	}
+
+	for _, tc := range tests {
+		got, err := parseLogLevel(tc.input)
+		if err != nil {
+			t.Errorf("parseLogLevel(%q) returned error: %v", tc.input, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("parseLogLevel(%q) = %v, want %v", tc.input, got, tc.want)
+		}
+	}
+
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Errorf("parseLogLevel(%q) returned nil error, want non-nil error", "verbose")
+	}
+}
+
+// recordingLogger records the messages logged at each level.
+type recordingLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *recordingLogger) record(level string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logs = append(l.logs, level+": "+fmt.Sprint(args...))
+}
+
+func (l *recordingLogger) Debug(args ...interface{}) { l.record("debug", args...) }
+func (l *recordingLogger) Info(args ...interface{})  { l.record("info", args...) }
+func (l *recordingLogger) Warn(args ...interface{})  { l.record("warn", args...) }
+func (l *recordingLogger) Error(args ...interface{}) { l.record("error", args...) }
+
+func TestLoggerWithBase(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLogger(&buf)
+	base := &recordingLogger{}
+	logger.setBase(base)
+	logger.setLevel(WarnLevel)
+
+	logger.debug("task %d dequeued", 1)
+	logger.info("task %d processed", 1)
+	logger.warn("task %d failed", 2)
+	logger.error("could not connect to %s", "redis")
+
+	want := []string{"warn: task 2 failed", "error: could not connect to redis"}
+	if diff := cmp.Diff(want, base.logs); diff != "" {
+		t.Errorf("logged %v, want %v; (-want,+got)\n%s", base.logs, want, diff)
+	}
+	if buf.Len() > 0 {
+		t.Errorf("default logger outputted %q, want nothing", buf.String())
+	}
+}
@@ -0,0 +1,633 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+// Package memory provides an in-memory implementation of asynq.Broker.
+//
+// The broker keeps all tasks in the process, so that unit tests and CI
+// runs can use Client and Background without a redis server.
+//
+//	b := memory.NewBroker()
+//	client := asynq.NewClientWithBroker(b)
+//	bg := asynq.NewBackgroundWithBroker(b, &asynq.Config{Concurrency: 1})
+//
+// Use Drain to run a handler over the enqueued tasks synchronously
+// in the calling goroutine instead of starting a Background, or SetHandler
+// to process each task as soon as it's enqueued:
+//
+//	b := memory.NewBroker()
+//	b.SetHandler(mux)
+//	client := asynq.NewClientWithBroker(b)
+//	client.Schedule(task, time.Now()) // returns after mux has processed the task.
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// maximum duration Dequeue waits for a task to arrive.
+const dequeueTimeout = time.Second
+
+// Broker is an in-memory implementation of asynq.Broker.
+//
+// Brokers are safe for concurrent use by multiple goroutines.
+type Broker struct {
+	mu sync.Mutex
+
+	queues     map[string][]*asynq.TaskMessage // head of each list is dequeued first
+	inProgress []*asynq.TaskMessage
+	scheduled  []*entry
+	retry      []*entry
+	dead       []*entry
+	processes  map[string]*asynq.ProcessInfo
+	weights    map[string]int
+	killSwitch *asynq.KillSwitch
+	clock      asynq.Clock   // nil to use the time of the system
+	handler    asynq.Handler // processes the enqueued tasks if non-nil
+
+	// closed and replaced when a task is enqueued to wake up Dequeue.
+	wake chan struct{}
+
+	cancelSubs  map[*subscription]struct{}
+	controlSubs map[*subscription]struct{}
+}
+
+// entry is a task message with a timestamp (e.g. when to process the task).
+type entry struct {
+	msg   *asynq.TaskMessage
+	score time.Time
+}
+
+var _ asynq.Broker = (*Broker)(nil)
+
+// NewBroker returns a new empty Broker.
+func NewBroker() *Broker {
+	return &Broker{
+		queues:      make(map[string][]*asynq.TaskMessage),
+		processes:   make(map[string]*asynq.ProcessInfo),
+		weights:     make(map[string]int),
+		wake:        make(chan struct{}),
+		cancelSubs:  make(map[*subscription]struct{}),
+		controlSubs: make(map[*subscription]struct{}),
+	}
+}
+
+// SetClock makes the broker tell the time with the clock to forward the
+// scheduled and retry tasks which have come due, so that tests can
+// fast-forward time without sleeping. It should be called before the broker
+// is used.
+func (b *Broker) SetClock(c asynq.Clock) {
+	b.clock = c
+}
+
+// now returns the current time told by the clock of the broker.
+func (b *Broker) now() time.Time {
+	if b.clock == nil {
+		return time.Now()
+	}
+	return b.clock.Now()
+}
+
+// clone returns a deep copy of the message as if it was read back
+// from redis, so that the payload values have the same types.
+func clone(msg *asynq.TaskMessage) (*asynq.TaskMessage, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	var res asynq.TaskMessage
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// SetHandler puts the broker in synchronous mode, where the tasks are
+// processed with the handler in the goroutine enqueueing them before Enqueue
+// (and so Client.Schedule) returns, so that tests can verify the effects of
+// the tasks deterministically without running a background. Tasks enqueued
+// by the handler are processed before the handler returns.
+//
+// Tasks scheduled to be processed in the future and failed tasks are kept
+// in the scheduled and retry lists as usual; call Drain to process them
+// once they're due. A nil handler turns synchronous mode off.
+func (b *Broker) SetHandler(h asynq.Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handler = h
+}
+
+// push adds the message to the tail of its queue and wakes up Dequeue.
+// Caller must hold the lock.
+func (b *Broker) push(msg *asynq.TaskMessage) {
+	b.queues[msg.Queue] = append(b.queues[msg.Queue], msg)
+	close(b.wake)
+	b.wake = make(chan struct{})
+}
+
+// add pushes the enqueued message, or moves it to the in-progress list in
+// synchronous mode, and returns the handler to process the message with,
+// nil if not in synchronous mode.
+// Caller must hold the lock.
+func (b *Broker) add(msg *asynq.TaskMessage) asynq.Handler {
+	if b.handler == nil {
+		b.push(msg)
+		return nil
+	}
+	b.inProgress = append(b.inProgress, msg)
+	return b.handler
+}
+
+// Enqueue adds the message to the queue specified by its Queue field.
+//
+// In synchronous mode, the message is processed before Enqueue returns.
+func (b *Broker) Enqueue(msg *asynq.TaskMessage) error {
+	m, err := clone(msg)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	h := b.add(m)
+	b.mu.Unlock()
+	if h != nil {
+		return b.process(h, m)
+	}
+	return nil
+}
+
+// Schedule adds the message to the scheduled tasks to be processed at processAt.
+func (b *Broker) Schedule(msg *asynq.TaskMessage, processAt time.Time) error {
+	m, err := clone(msg)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.scheduled = append(b.scheduled, &entry{m, processAt})
+	return nil
+}
+
+// WriteBatch enqueues or schedules all the given messages atomically.
+//
+// In synchronous mode, the enqueued messages are processed in order
+// before WriteBatch returns.
+func (b *Broker) WriteBatch(entries []*asynq.BatchEntry) error {
+	msgs := make([]*asynq.TaskMessage, len(entries))
+	for i, e := range entries {
+		m, err := clone(e.Msg)
+		if err != nil {
+			return err
+		}
+		msgs[i] = m
+	}
+	b.mu.Lock()
+	var h asynq.Handler
+	var pushed []*asynq.TaskMessage
+	for i, e := range entries {
+		if e.ProcessAt.IsZero() {
+			h = b.add(msgs[i])
+			pushed = append(pushed, msgs[i])
+		} else {
+			b.scheduled = append(b.scheduled, &entry{msgs[i], e.ProcessAt})
+		}
+	}
+	b.mu.Unlock()
+	if h == nil {
+		return nil
+	}
+	for _, msg := range pushed {
+		if err := b.process(h, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Dequeue queries the given queues in order and moves a message to the
+// in-progress list if there is one and returns it.
+//
+// If all queues are empty, Dequeue waits for a task to arrive for up to a
+// second, and returns asynq.ErrNoProcessableTask if none arrives.
+func (b *Broker) Dequeue(qnames ...string) (*asynq.TaskMessage, error) {
+	timeout := time.NewTimer(dequeueTimeout)
+	defer timeout.Stop()
+	for {
+		b.mu.Lock()
+		msg, ok := b.pop(qnames)
+		wake := b.wake
+		b.mu.Unlock()
+		if ok {
+			return msg, nil
+		}
+
+		select {
+		case <-wake:
+		case <-timeout.C:
+			return nil, asynq.ErrNoProcessableTask
+		}
+	}
+}
+
+// removeInProgress removes the message from the in-progress list
+// and reports whether the message was found.
+// Caller must hold the lock.
+func (b *Broker) removeInProgress(msg *asynq.TaskMessage) bool {
+	for i, m := range b.inProgress {
+		if m.ID == msg.ID {
+			b.inProgress = append(b.inProgress[:i], b.inProgress[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Done removes the message from the in-progress list.
+func (b *Broker) Done(msg *asynq.TaskMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.removeInProgress(msg)
+	return nil
+}
+
+// Requeue moves the message from the in-progress list to the head of its queue.
+func (b *Broker) Requeue(msg *asynq.TaskMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.removeInProgress(msg) {
+		b.requeue(msg)
+	}
+	return nil
+}
+
+// requeue adds the message to the head of its queue.
+// Caller must hold the lock.
+func (b *Broker) requeue(msg *asynq.TaskMessage) {
+	b.queues[msg.Queue] = append([]*asynq.TaskMessage{msg}, b.queues[msg.Queue]...)
+	close(b.wake)
+	b.wake = make(chan struct{})
+}
+
+// RequeueAll moves all messages in the in-progress list back to
+// their queues and returns the number of messages moved.
+func (b *Broker) RequeueAll() (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(b.inProgress)
+	for i := n - 1; i >= 0; i-- {
+		b.requeue(b.inProgress[i])
+	}
+	b.inProgress = nil
+	return int64(n), nil
+}
+
+// Retry moves the message from the in-progress list to the retry list,
+// incrementing retry count and assigning the error message to the message.
+func (b *Broker) Retry(msg *asynq.TaskMessage, processAt time.Time, errMsg string) error {
+	return b.RetryInQueue(msg, msg.Queue, processAt, errMsg)
+}
+
+// RetryInQueue is like Retry, but the message is moved to the given queue
+// when it's processed again.
+func (b *Broker) RetryInQueue(msg *asynq.TaskMessage, qname string, processAt time.Time, errMsg string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.removeInProgress(msg) {
+		return nil
+	}
+	modified := base.RecordError(msg, errMsg, b.now())
+	modified.Retried++
+	modified.Queue = qname
+	b.retry = append(b.retry, &entry{modified, processAt})
+	return nil
+}
+
+// Postpone moves the message from the in-progress list to the retry list
+// without incrementing its retry count.
+func (b *Broker) Postpone(msg *asynq.TaskMessage, processAt time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.removeInProgress(msg) {
+		return nil
+	}
+	b.retry = append(b.retry, &entry{msg, processAt})
+	return nil
+}
+
+// Kill moves the message from the in-progress list to the dead list,
+// assigning the error message to the message.
+func (b *Broker) Kill(msg *asynq.TaskMessage, errMsg string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.removeInProgress(msg) {
+		return nil
+	}
+	now := b.now()
+	b.dead = append(b.dead, &entry{base.RecordError(msg, errMsg, now), now})
+	return nil
+}
+
+// CheckAndEnqueue moves the scheduled and retry messages that are ready
+// to be processed to their queues.
+func (b *Broker) CheckAndEnqueue(qnames ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	b.scheduled = b.forward(b.scheduled, now)
+	b.retry = b.forward(b.retry, now)
+	return nil
+}
+
+// forward enqueues the messages in the entries which are ready to be
+// processed and returns the remaining entries.
+// Caller must hold the lock.
+func (b *Broker) forward(entries []*entry, now time.Time) []*entry {
+	var res []*entry
+	for _, e := range entries {
+		if e.score.After(now) {
+			res = append(res, e)
+			continue
+		}
+		b.push(e.msg)
+	}
+	return res
+}
+
+func processKey(ps *asynq.ProcessInfo) string {
+	return fmt.Sprintf("%s:%d", ps.Host, ps.PID)
+}
+
+// WriteProcessInfo writes the process info. ttl is ignored.
+func (b *Broker) WriteProcessInfo(ps *asynq.ProcessInfo, ttl time.Duration) error {
+	info := *ps
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.processes[processKey(ps)] = &info
+	return nil
+}
+
+// ClearProcessInfo deletes the process info.
+func (b *Broker) ClearProcessInfo(ps *asynq.ProcessInfo) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.processes, processKey(ps))
+	return nil
+}
+
+// SeedQueueWeights sets the weights of the queues unless they have been set already.
+func (b *Broker) SeedQueueWeights(weights map[string]int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for qname, w := range weights {
+		if _, ok := b.weights[qname]; !ok {
+			b.weights[qname] = w
+		}
+	}
+	return nil
+}
+
+// SetQueueWeight sets the weight of the given queue.
+func (b *Broker) SetQueueWeight(qname string, weight int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.weights[qname] = weight
+}
+
+// QueueWeights returns the weights of the queues.
+func (b *Broker) QueueWeights() (map[string]int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	res := make(map[string]int, len(b.weights))
+	for qname, w := range b.weights {
+		res[qname] = w
+	}
+	return res, nil
+}
+
+// SetKillSwitch engages the kill switch until ks.Expires,
+// or disengages it if ks is nil.
+func (b *Broker) SetKillSwitch(ks *asynq.KillSwitch) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.killSwitch = ks
+}
+
+// KillSwitch returns the kill switch if it's engaged, or nil otherwise.
+func (b *Broker) KillSwitch() (*asynq.KillSwitch, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.killSwitch == nil || !time.Now().Before(b.killSwitch.Expires) {
+		return nil, nil
+	}
+	return b.killSwitch, nil
+}
+
+// subscription implements asynq.Subscription.
+type subscription struct {
+	b    *Broker
+	subs map[*subscription]struct{}
+	ch   chan string
+}
+
+// subscribe adds a subscription to subs.
+func (b *Broker) subscribe(subs map[*subscription]struct{}) *subscription {
+	s := &subscription{b: b, subs: subs, ch: make(chan string, 100)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subs[s] = struct{}{}
+	return s
+}
+
+func (s *subscription) Channel() <-chan string {
+	return s.ch
+}
+
+func (s *subscription) Close() error {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	delete(s.subs, s)
+	return nil
+}
+
+// publish sends the message to all subscriptions in subs.
+// Messages are dropped for the subscriptions whose buffer is full.
+func (b *Broker) publish(subs map[*subscription]struct{}, msg string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range subs {
+		select {
+		case s.ch <- msg:
+		default:
+		}
+	}
+}
+
+// CancelationPubSub subscribes to the task cancelation messages.
+func (b *Broker) CancelationPubSub() (asynq.Subscription, error) {
+	return b.subscribe(b.cancelSubs), nil
+}
+
+// PublishCancelation publishes a cancelation message for the task with the given id.
+func (b *Broker) PublishCancelation(id string) {
+	b.publish(b.cancelSubs, id)
+}
+
+// ControlPubSub subscribes to the control messages.
+func (b *Broker) ControlPubSub() (asynq.Subscription, error) {
+	return b.subscribe(b.controlSubs), nil
+}
+
+// PublishControlReply discards the reply, since control messages
+// are not supported by Broker.
+func (b *Broker) PublishControlReply(id string, reply *asynq.ControlReply) error {
+	return nil
+}
+
+// Ping always succeeds, since the broker is in memory.
+func (b *Broker) Ping() error {
+	return nil
+}
+
+// Close does nothing, tasks are kept in the broker.
+func (b *Broker) Close() error {
+	return nil
+}
+
+// EnqueuedTasks returns the messages in the queue in the order they will be processed.
+func (b *Broker) EnqueuedTasks(qname string) []*asynq.TaskMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*asynq.TaskMessage(nil), b.queues[qname]...)
+}
+
+// InProgressTasks returns the messages being processed.
+func (b *Broker) InProgressTasks() []*asynq.TaskMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*asynq.TaskMessage(nil), b.inProgress...)
+}
+
+// ScheduledTasks returns the scheduled messages sorted by the time to be processed.
+func (b *Broker) ScheduledTasks() []*asynq.TaskMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return sorted(b.scheduled)
+}
+
+// RetryTasks returns the messages to be retried sorted by the time to be processed.
+func (b *Broker) RetryTasks() []*asynq.TaskMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return sorted(b.retry)
+}
+
+// DeadTasks returns the dead messages sorted by the time they were killed.
+func (b *Broker) DeadTasks() []*asynq.TaskMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return sorted(b.dead)
+}
+
+func sorted(entries []*entry) []*asynq.TaskMessage {
+	es := append([]*entry(nil), entries...)
+	sort.SliceStable(es, func(i, j int) bool { return es[i].score.Before(es[j].score) })
+	res := make([]*asynq.TaskMessage, len(es))
+	for i, e := range es {
+		res[i] = e.msg
+	}
+	return res
+}
+
+// Drain processes the tasks in the given queues one at a time with the
+// handler in the calling goroutine, until the queues are empty.
+// If no queue is given, the "default" queue is processed. Drain returns
+// the number of tasks processed.
+//
+// Scheduled and retry tasks are not processed unless they are ready to be
+// processed. A task whose handler returns an error (or panics) is moved to
+// the retry list to be processed immediately, unless the max retry count is
+// reached, then it's moved to the dead list. Call Drain again to process the
+// retry tasks.
+func (b *Broker) Drain(h asynq.Handler, qnames ...string) (int, error) {
+	if len(qnames) == 0 {
+		qnames = []string{base.DefaultQueueName}
+	}
+	if err := b.CheckAndEnqueue(); err != nil {
+		return 0, err
+	}
+	var n int
+	for {
+		b.mu.Lock()
+		msg, ok := b.pop(qnames)
+		b.mu.Unlock()
+		if !ok {
+			return n, nil
+		}
+		n++
+		if err := b.process(h, msg); err != nil {
+			return n, err
+		}
+	}
+}
+
+// process processes the in-progress message with the handler, and then
+// removes it from the in-progress list, or moves it to the retry or dead
+// list if the handler fails.
+func (b *Broker) process(h asynq.Handler, msg *asynq.TaskMessage) error {
+	err := perform(h, msg)
+	switch {
+	case err == nil:
+		return b.Done(msg)
+	case msg.Retried >= msg.Retry:
+		return b.Kill(msg, err.Error())
+	default:
+		return b.Retry(msg, b.now(), err.Error())
+	}
+}
+
+// pop moves the message at the head of the first non-empty queue to
+// the in-progress list.
+// Caller must hold the lock.
+func (b *Broker) pop(qnames []string) (*asynq.TaskMessage, bool) {
+	for _, qname := range qnames {
+		if q := b.queues[qname]; len(q) > 0 {
+			b.queues[qname] = q[1:]
+			b.inProgress = append(b.inProgress, q[0])
+			return q[0], true
+		}
+	}
+	return nil, false
+}
+
+// perform calls the handler with the task, converting a panic into an error.
+func perform(h asynq.Handler, msg *asynq.TaskMessage) (err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("panic: %v", x)
+		}
+	}()
+	ctx := context.Background()
+	if d, err := time.ParseDuration(msg.Timeout); err == nil && d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	if msg.Deadline != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, time.Unix(0, msg.Deadline))
+		defer cancel()
+	}
+	task := asynq.NewTask(msg.Type, msg.Payload)
+	if msg.Data != nil {
+		task = asynq.NewBinaryTask(msg.Type, msg.Data)
+	}
+	task.Headers = msg.Headers
+	return h.ProcessTask(ctx, task)
+}
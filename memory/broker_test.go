@@ -0,0 +1,206 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package memory
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hibiken/asynq"
+	"github.com/hibiken/asynq/asynqtest"
+)
+
+func TestDrain(t *testing.T) {
+	b := NewBroker()
+	client := asynq.NewClientWithBroker(b)
+
+	schedule := func(task *asynq.Task, processAt time.Time, opts ...asynq.Option) {
+		t.Helper()
+		if _, err := client.Schedule(task, processAt, opts...); err != nil {
+			t.Fatalf("(*Client).Schedule returned error: %v", err)
+		}
+	}
+	schedule(asynq.NewTask("send_email", map[string]interface{}{"user_id": 42}), time.Now())
+	schedule(asynq.NewTask("fail", nil), time.Now(), asynq.MaxRetry(1))
+	schedule(asynq.NewTask("send_email", map[string]interface{}{"user_id": 43}), time.Now().Add(time.Hour))
+
+	var processed []string
+	h := asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+		if task.Type == "fail" {
+			return fmt.Errorf("something went wrong")
+		}
+		id, err := task.Payload.GetInt("user_id")
+		if err != nil {
+			return err
+		}
+		processed = append(processed, fmt.Sprintf("%s:%d", task.Type, id))
+		return nil
+	})
+
+	n, err := b.Drain(h)
+	if err != nil {
+		t.Fatalf("(*Broker).Drain returned error: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("(*Broker).Drain processed %d tasks, want 2", n)
+	}
+	if len(processed) != 1 || processed[0] != "send_email:42" {
+		t.Errorf("processed tasks %v, want [send_email:42]", processed)
+	}
+	if retry := b.RetryTasks(); len(retry) != 1 || retry[0].Retried != 1 {
+		t.Errorf("(*Broker).RetryTasks() = %v, want one task retried once", retry)
+	}
+
+	// The retry task should be processed again and killed.
+	if n, err := b.Drain(h); err != nil || n != 1 {
+		t.Errorf("(*Broker).Drain = %d, %v, want 1, nil", n, err)
+	}
+	if dead := b.DeadTasks(); len(dead) != 1 || dead[0].ErrorMsg != "something went wrong" {
+		t.Errorf("(*Broker).DeadTasks() = %v, want one dead task", dead)
+	}
+	if scheduled := b.ScheduledTasks(); len(scheduled) != 1 {
+		t.Errorf("(*Broker).ScheduledTasks() = %v, want one scheduled task", scheduled)
+	}
+	if inProgress := b.InProgressTasks(); len(inProgress) != 0 {
+		t.Errorf("(*Broker).InProgressTasks() = %v, want none", inProgress)
+	}
+}
+
+func TestDrainWithClock(t *testing.T) {
+	b := NewBroker()
+	clock := asynqtest.NewClock(time.Now())
+	b.SetClock(clock)
+	client := asynq.NewClientWithBroker(b)
+	if _, err := client.Schedule(asynq.NewTask("send_email", nil), clock.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("(*Client).Schedule returned error: %v", err)
+	}
+
+	h := asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error { return nil })
+	if n, err := b.Drain(h); err != nil || n != 0 {
+		t.Errorf("(*Broker).Drain before the task is due = %d, %v, want 0, nil", n, err)
+	}
+	clock.Advance(time.Hour)
+	if n, err := b.Drain(h); err != nil || n != 1 {
+		t.Errorf("(*Broker).Drain after advancing the clock = %d, %v, want 1, nil", n, err)
+	}
+}
+
+func TestSetHandler(t *testing.T) {
+	b := NewBroker()
+	client := asynq.NewClientWithBroker(b)
+	var processed []string
+	b.SetHandler(asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+		processed = append(processed, task.Type)
+		switch task.Type {
+		case "signup":
+			if _, err := client.Schedule(asynq.NewTask("welcome_email", nil), time.Now()); err != nil {
+				return err
+			}
+		case "fail":
+			return fmt.Errorf("something went wrong")
+		}
+		return nil
+	}))
+
+	if _, err := client.Schedule(asynq.NewTask("signup", nil), time.Now()); err != nil {
+		t.Fatalf("(*Client).Schedule returned error: %v", err)
+	}
+	// The task enqueued by the handler is processed before Schedule returns.
+	want := []string{"signup", "welcome_email"}
+	if diff := cmp.Diff(want, processed); diff != "" {
+		t.Errorf("processed tasks %v, want %v; (-want,+got)\n%s", processed, want, diff)
+	}
+
+	processed = nil
+	if _, err := client.Schedule(asynq.NewTask("fail", nil), time.Now()); err != nil {
+		t.Fatalf("(*Client).Schedule returned error: %v", err)
+	}
+	if _, err := client.Schedule(asynq.NewTask("report", nil), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("(*Client).Schedule returned error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"fail"}, processed); diff != "" {
+		t.Errorf("processed tasks %v, want [fail]; (-want,+got)\n%s", processed, diff)
+	}
+	if retry := b.RetryTasks(); len(retry) != 1 || retry[0].Type != "fail" {
+		t.Errorf("(*Broker).RetryTasks() = %v, want the failed task", retry)
+	}
+	if scheduled := b.ScheduledTasks(); len(scheduled) != 1 {
+		t.Errorf("(*Broker).ScheduledTasks() = %v, want one scheduled task", scheduled)
+	}
+	if inProgress := b.InProgressTasks(); len(inProgress) != 0 {
+		t.Errorf("(*Broker).InProgressTasks() = %v, want none", inProgress)
+	}
+}
+
+func TestDequeueWaitsForTask(t *testing.T) {
+	b := NewBroker()
+	client := asynq.NewClientWithBroker(b)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		client.Schedule(asynq.NewTask("send_email", nil), time.Now(), asynq.Queue("low"))
+	}()
+
+	start := time.Now()
+	msg, err := b.Dequeue("default", "low")
+	if err != nil {
+		t.Fatalf("(*Broker).Dequeue returned error: %v", err)
+	}
+	if msg.Type != "send_email" || msg.Queue != "low" {
+		t.Errorf("(*Broker).Dequeue returned %+v, want send_email task in low queue", msg)
+	}
+	if elapsed := time.Since(start); elapsed >= dequeueTimeout {
+		t.Errorf("(*Broker).Dequeue took %v, want less than %v", elapsed, dequeueTimeout)
+	}
+	if _, err := b.Dequeue("default", "low"); err != asynq.ErrNoProcessableTask {
+		t.Errorf("(*Broker).Dequeue on empty queues returned error %v, want %v", err, asynq.ErrNoProcessableTask)
+	}
+}
+
+func TestRequeueAll(t *testing.T) {
+	b := NewBroker()
+	client := asynq.NewClientWithBroker(b)
+	for i := 0; i < 3; i++ {
+		client.Schedule(asynq.NewTask(fmt.Sprintf("task%d", i), nil), time.Now())
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := b.Dequeue("default"); err != nil {
+			t.Fatalf("(*Broker).Dequeue returned error: %v", err)
+		}
+	}
+
+	n, err := b.RequeueAll()
+	if err != nil || n != 2 {
+		t.Fatalf("(*Broker).RequeueAll() = %d, %v, want 2, nil", n, err)
+	}
+	// The requeued tasks should be processed first in the original order.
+	var got []string
+	for _, msg := range b.EnqueuedTasks("default") {
+		got = append(got, msg.Type)
+	}
+	want := []string{"task0", "task1", "task2"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("(*Broker).EnqueuedTasks(%q) = %v, want %v", "default", got, want)
+	}
+}
+
+func TestKillSwitch(t *testing.T) {
+	b := NewBroker()
+	if ks, err := b.KillSwitch(); err != nil || ks != nil {
+		t.Fatalf("KillSwitch() = %v, %v before engaging; want nil, nil", ks, err)
+	}
+	want := &asynq.KillSwitch{Reason: "bad deploy", Expires: time.Now().Add(time.Hour)}
+	b.SetKillSwitch(want)
+	if ks, err := b.KillSwitch(); err != nil || ks != want {
+		t.Errorf("KillSwitch() = %v, %v; want %v, nil", ks, err, want)
+	}
+	b.SetKillSwitch(&asynq.KillSwitch{Expires: time.Now().Add(-time.Minute)})
+	if ks, err := b.KillSwitch(); err != nil || ks != nil {
+		t.Errorf("KillSwitch() = %v, %v for expired kill switch; want nil, nil", ks, err)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// Outcome is what a background does with a task once its handler returns.
+type Outcome int
+
+const (
+	// OutcomeDone means the task is done and removed from the queues.
+	OutcomeDone Outcome = iota
+
+	// OutcomeRetry means the task is moved to the retry queue to be
+	// processed again.
+	OutcomeRetry
+
+	// OutcomeDead means the task is moved to the dead queue without being
+	// retried.
+	OutcomeDead
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeDone:
+		return "done"
+	case OutcomeRetry:
+		return "retry"
+	case OutcomeDead:
+		return "dead"
+	}
+	return fmt.Sprintf("Outcome(%d)", int(o))
+}
+
+// isFinal reports whether the task which failed with the error at time t
+// is not retried regardless of how the background is configured.
+func isFinal(msg *base.TaskMessage, err error, t time.Time) bool {
+	return msg.Retried >= msg.Retry || isContentError(err) || isFatalPanic(err) || deadlinePassed(msg, t)
+}
+
+// ProcessOnce processes the task once with the handler in the calling
+// goroutine, the way a background processes a task pulled out of a queue,
+// and returns what the background would do with the task along with the
+// error returned by the handler. It's meant for the unit tests of the
+// handlers; see asynqtest.RunHandler.
+//
+// The handler is passed a context which carries the metadata of the task
+// (see GetTaskID) and times out with the Timeout and Deadline options of
+// the task.
+// retried is the number of times the task has been retried before, so that
+// the last attempt of a task can be tested with retried equal to MaxRetry.
+//
+// Panics of the handler are recovered and returned as errors. Tasks with
+// at most once delivery (see Ack) are never retried.
+func ProcessOnce(h Handler, task *Task, retried int, opts ...Option) (Outcome, error) {
+	msg := newTaskMessage(task, append(append([]Option(nil), task.opts...), opts...)...)
+	if err := checkContentType(msg); err != nil {
+		return OutcomeDead, err
+	}
+	msg.Retried = retried
+	ctx, cancel := createContext(context.Background(), msg, 0)
+	defer cancel()
+	payload, err := messagePayload(msg, nil, nil)
+	switch {
+	case err != nil:
+	case deadlinePassed(msg, time.Now()):
+		err = errDeadlinePassed
+	default:
+		err = perform(ctx, &Task{Type: msg.Type, Payload: payload, Headers: copyHeaders(msg.Headers)}, h)
+	}
+	switch {
+	case err == nil:
+		return OutcomeDone, nil
+	case isFinal(msg, err, time.Now()) || msg.AtMostOnce:
+		return OutcomeDead, err
+	default:
+		return OutcomeRetry, err
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"testing"
+)
+
+func TestProcessOnce(t *testing.T) {
+	panicky := HandlerFunc(func(ctx context.Context, task *Task) error {
+		panic("nil map")
+	})
+	outcome, err := ProcessOnce(panicky, NewTask("send_email", nil), 0)
+	if outcome != OutcomeRetry || err == nil {
+		t.Errorf("ProcessOnce with a panicking handler = %v, %v, want %v and an error", outcome, err, OutcomeRetry)
+	}
+
+	called := false
+	h := HandlerFunc(func(ctx context.Context, task *Task) error {
+		called = true
+		return nil
+	})
+	outcome, err = ProcessOnce(h, NewTask("send_email", nil), 0, ContentType("application/x-unknown"))
+	if outcome != OutcomeDead || err == nil || called {
+		t.Errorf("ProcessOnce with an unknown content type = %v, %v (handler called: %t), want %v and an error without calling the handler", outcome, err, called, OutcomeDead)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// RecoverPanicFunc is called when a handler panics, with the task, the value
+// passed to panic, and the stack trace of the goroutine which panicked
+// (e.g. to report the panic to an error tracker).
+//
+// It returns true if the task should be retried as if the handler returned
+// an error, or false to move the task to the dead queue right away.
+type RecoverPanicFunc func(task *Task, v interface{}, stack []byte) (retry bool)
+
+// panicError is the error of a task whose handler panicked.
+type panicError struct {
+	value interface{}
+	stack []byte
+
+	// kill is true if the task should be moved to the dead queue
+	// without being retried.
+	kill bool
+}
+
+func newPanicError(v interface{}) *panicError {
+	return &panicError{value: v, stack: debug.Stack()}
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+// isFatalPanic reports whether err is a panic of a handler after which
+// the task should not be retried.
+func isFatalPanic(err error) bool {
+	e, ok := err.(*panicError)
+	return ok && e.kill
+}
+
+// recoverPanic calls the RecoverPanicFunc if err is a panic of the handler
+// of the task, and returns err. If the RecoverPanicFunc panics, the task
+// is retried.
+func (p *processor) recoverPanic(task *Task, err error) (res error) {
+	e, ok := err.(*panicError)
+	if !ok || p.recoverPanicFunc == nil {
+		return err
+	}
+	defer func() {
+		if x := recover(); x != nil {
+			p.logger.error("RecoverPanicFunc panicked for task type=%s: %v", task.Type, x)
+			res = err
+		}
+	}()
+	// Copy the error, as the same error is returned for all the tasks
+	// of a batch which panicked.
+	c := *e
+	c.kill = !p.recoverPanicFunc(task, e.value, e.stack)
+	return &c
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+func TestRecoverPanicFunc(t *testing.T) {
+	type call struct {
+		typename string
+		value    interface{}
+		stack    string
+	}
+	var got []call
+	tests := []struct {
+		desc      string
+		fn        RecoverPanicFunc
+		wantEvent string
+	}{
+		{"retry", func(task *Task, v interface{}, stack []byte) bool {
+			got = append(got, call{task.Type, v, string(stack)})
+			return true
+		}, "retry"},
+		{"kill", func(task *Task, v interface{}, stack []byte) bool {
+			got = append(got, call{task.Type, v, string(stack)})
+			return false
+		}, "kill"},
+		{"func panics", func(task *Task, v interface{}, stack []byte) bool {
+			got = append(got, call{task.Type, v, string(stack)})
+			panic("report failed")
+		}, "retry"},
+		{"no func", nil, "retry"},
+	}
+
+	for _, tc := range tests {
+		got = nil
+		b := &earlyAckBroker{}
+		workerCh := make(chan int)
+		go fakeHeartbeater(workerCh)
+		p := newProcessor(processorParams{
+			logger:         testLogger,
+			rdb:            b,
+			queues:         defaultQueueConfig,
+			concurrency:    1,
+			retryDelayFunc: defaultDelayFunc,
+			workerCh:       workerCh,
+			cancelations:   base.NewCancelations(),
+			recoverPanic:   tc.fn,
+		})
+		p.handler = HandlerFunc(func(ctx context.Context, task *Task) error {
+			panic("nil map")
+		})
+		msg := h.NewTaskMessage("import_rows", nil)
+		msg.Retry = 3
+
+		p.dispatch(msg)
+		// wait for the worker to finish.
+		p.sema <- struct{}{}
+		<-p.sema
+		close(workerCh)
+
+		b.mu.Lock()
+		if diff := cmp.Diff([]string{tc.wantEvent}, b.events); diff != "" {
+			t.Errorf("%s: broker received %v, want %v; (-want,+got)\n%s", tc.desc, b.events, []string{tc.wantEvent}, diff)
+		}
+		b.mu.Unlock()
+		if tc.fn == nil {
+			continue
+		}
+		if len(got) != 1 {
+			t.Errorf("%s: RecoverPanicFunc called %d times, want once", tc.desc, len(got))
+			continue
+		}
+		if got[0].typename != "import_rows" || got[0].value != "nil map" {
+			t.Errorf("%s: RecoverPanicFunc called with task %q and value %v, want %q and %q", tc.desc, got[0].typename, got[0].value, "import_rows", "nil map")
+		}
+		if !strings.Contains(got[0].stack, "panic_test.go") {
+			t.Errorf("%s: RecoverPanicFunc called with stack not including the handler:\n%s", tc.desc, got[0].stack)
+		}
+	}
+}
@@ -5,6 +5,7 @@
 package asynq
 
 import (
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -12,8 +13,14 @@ import (
 )
 
 // Payload holds arbitrary data needed for task execution.
+//
+// A payload is either a map of values, read with the getters, or binary
+// data of a task created with NewBinaryTask, read with Bytes.
 type Payload struct {
 	data map[string]interface{}
+
+	// raw is the binary data, nil if the payload is a map.
+	raw []byte
 }
 
 type errKeyNotFound struct {
@@ -24,6 +31,27 @@ func (e *errKeyNotFound) Error() string {
 	return fmt.Sprintf("key %q does not exist", e.key)
 }
 
+// errTypeMismatch is returned when the value associated with the key
+// cannot be converted to the requested type.
+type errTypeMismatch struct {
+	key   string
+	value interface{}
+	typ   string
+}
+
+func (e *errTypeMismatch) Error() string {
+	return fmt.Sprintf("value of key %q is %T, not convertible to %s", e.key, e.value, e.typ)
+}
+
+// typeError returns an error reporting that the value of the key could not
+// be converted to the type, or nil if err is nil.
+func typeError(key string, value interface{}, typ string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &errTypeMismatch{key, value, typ}
+}
+
 // Has reports whether key exists.
 func (p Payload) Has(key string) bool {
 	_, ok := p.data[key]
@@ -37,7 +65,8 @@ func (p Payload) GetString(key string) (string, error) {
 	if !ok {
 		return "", &errKeyNotFound{key}
 	}
-	return cast.ToStringE(v)
+	res, err := cast.ToStringE(v)
+	return res, typeError(key, v, "string", err)
 }
 
 // GetInt returns an int value if a numeric type is associated with
@@ -47,7 +76,8 @@ func (p Payload) GetInt(key string) (int, error) {
 	if !ok {
 		return 0, &errKeyNotFound{key}
 	}
-	return cast.ToIntE(v)
+	res, err := cast.ToIntE(v)
+	return res, typeError(key, v, "int", err)
 }
 
 // GetFloat64 returns a float64 value if a numeric type is associated with
@@ -57,7 +87,8 @@ func (p Payload) GetFloat64(key string) (float64, error) {
 	if !ok {
 		return 0, &errKeyNotFound{key}
 	}
-	return cast.ToFloat64E(v)
+	res, err := cast.ToFloat64E(v)
+	return res, typeError(key, v, "float64", err)
 }
 
 // GetBool returns a boolean value if a boolean type is associated with
@@ -67,7 +98,8 @@ func (p Payload) GetBool(key string) (bool, error) {
 	if !ok {
 		return false, &errKeyNotFound{key}
 	}
-	return cast.ToBoolE(v)
+	res, err := cast.ToBoolE(v)
+	return res, typeError(key, v, "bool", err)
 }
 
 // GetStringSlice returns a slice of strings if a string slice type is associated with
@@ -77,7 +109,8 @@ func (p Payload) GetStringSlice(key string) ([]string, error) {
 	if !ok {
 		return nil, &errKeyNotFound{key}
 	}
-	return cast.ToStringSliceE(v)
+	res, err := cast.ToStringSliceE(v)
+	return res, typeError(key, v, "[]string", err)
 }
 
 // GetIntSlice returns a slice of ints if a int slice type is associated with
@@ -87,7 +120,8 @@ func (p Payload) GetIntSlice(key string) ([]int, error) {
 	if !ok {
 		return nil, &errKeyNotFound{key}
 	}
-	return cast.ToIntSliceE(v)
+	res, err := cast.ToIntSliceE(v)
+	return res, typeError(key, v, "[]int", err)
 }
 
 // GetStringMap returns a map of string to empty interface
@@ -98,7 +132,8 @@ func (p Payload) GetStringMap(key string) (map[string]interface{}, error) {
 	if !ok {
 		return nil, &errKeyNotFound{key}
 	}
-	return cast.ToStringMapE(v)
+	res, err := cast.ToStringMapE(v)
+	return res, typeError(key, v, "map[string]interface{}", err)
 }
 
 // GetStringMapString returns a map of string to string
@@ -109,7 +144,8 @@ func (p Payload) GetStringMapString(key string) (map[string]string, error) {
 	if !ok {
 		return nil, &errKeyNotFound{key}
 	}
-	return cast.ToStringMapStringE(v)
+	res, err := cast.ToStringMapStringE(v)
+	return res, typeError(key, v, "map[string]string", err)
 }
 
 // GetStringMapStringSlice returns a map of string to string slice
@@ -120,7 +156,8 @@ func (p Payload) GetStringMapStringSlice(key string) (map[string][]string, error
 	if !ok {
 		return nil, &errKeyNotFound{key}
 	}
-	return cast.ToStringMapStringSliceE(v)
+	res, err := cast.ToStringMapStringSliceE(v)
+	return res, typeError(key, v, "map[string][]string", err)
 }
 
 // GetStringMapInt returns a map of string to int
@@ -131,7 +168,8 @@ func (p Payload) GetStringMapInt(key string) (map[string]int, error) {
 	if !ok {
 		return nil, &errKeyNotFound{key}
 	}
-	return cast.ToStringMapIntE(v)
+	res, err := cast.ToStringMapIntE(v)
+	return res, typeError(key, v, "map[string]int", err)
 }
 
 // GetStringMapBool returns a map of string to boolean
@@ -142,7 +180,8 @@ func (p Payload) GetStringMapBool(key string) (map[string]bool, error) {
 	if !ok {
 		return nil, &errKeyNotFound{key}
 	}
-	return cast.ToStringMapBoolE(v)
+	res, err := cast.ToStringMapBoolE(v)
+	return res, typeError(key, v, "map[string]bool", err)
 }
 
 // GetTime returns a time value if a correct map type is associated with the key,
@@ -152,7 +191,8 @@ func (p Payload) GetTime(key string) (time.Time, error) {
 	if !ok {
 		return time.Time{}, &errKeyNotFound{key}
 	}
-	return cast.ToTimeE(v)
+	res, err := cast.ToTimeE(v)
+	return res, typeError(key, v, "time.Time", err)
 }
 
 // GetDuration returns a duration value if a correct map type is associated with the key,
@@ -162,5 +202,108 @@ func (p Payload) GetDuration(key string) (time.Duration, error) {
 	if !ok {
 		return 0, &errKeyNotFound{key}
 	}
-	return cast.ToDurationE(v)
+	res, err := cast.ToDurationE(v)
+	return res, typeError(key, v, "time.Duration", err)
+}
+
+// GetPayload returns the nested payload if a map type is associated with
+// the key, otherwise reports an error. Values of the nested payload can be
+// read with its getters (e.g. payload.GetPayload("user") then GetString("name")).
+func (p Payload) GetPayload(key string) (Payload, error) {
+	v, ok := p.data[key]
+	if !ok {
+		return Payload{}, &errKeyNotFound{key}
+	}
+	res, err := cast.ToStringMapE(v)
+	return Payload{data: res}, typeError(key, v, "map[string]interface{}", err)
+}
+
+// GetPayloadSlice returns a slice of nested payloads if a slice of map
+// types is associated with the key, otherwise reports an error.
+func (p Payload) GetPayloadSlice(key string) ([]Payload, error) {
+	v, ok := p.data[key]
+	if !ok {
+		return nil, &errKeyNotFound{key}
+	}
+	items, err := cast.ToSliceE(v)
+	if err != nil {
+		return nil, typeError(key, v, "[]map[string]interface{}", err)
+	}
+	res := make([]Payload, len(items))
+	for i, item := range items {
+		m, err := cast.ToStringMapE(item)
+		if err != nil {
+			return nil, typeError(key, v, "[]map[string]interface{}", err)
+		}
+		res[i] = Payload{data: m}
+	}
+	return res, nil
+}
+
+// Bytes returns the binary data of the payload of a task created with
+// NewBinaryTask, or nil if the payload is a map.
+func (p Payload) Bytes() []byte {
+	return p.raw
+}
+
+// MarshalJSON encodes the payload data as a JSON object, or the binary
+// data as a base64 encoded JSON string.
+func (p Payload) MarshalJSON() ([]byte, error) {
+	if p.raw != nil {
+		return json.Marshal(p.raw)
+	}
+	if p.data == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(p.data)
+}
+
+// Bind decodes the payload into the struct pointed to by v, matching the
+// keys of the payload with the JSON field names of the struct (e.g. given
+// by `json:"user_id"` tags), as json.Unmarshal does.
+//
+// Example:
+//
+//	type EmailPayload struct {
+//	    UserID   int    `json:"user_id"`
+//	    Template string `json:"template"`
+//	}
+//
+//	func handler(ctx context.Context, task *asynq.Task) error {
+//	    var p EmailPayload
+//	    if err := task.Payload.Bind(&p); err != nil {
+//	        return err
+//	    }
+//	    ...
+//	}
+//
+// See NewTaskFromStruct to create a task with the payload given by a struct.
+func (p Payload) Bind(v interface{}) error {
+	data, err := p.MarshalJSON()
+	if err != nil {
+		return fmt.Errorf("asynq: cannot bind payload: %v", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("asynq: cannot bind payload: %v", err)
+	}
+	return nil
+}
+
+// NewTaskFromStruct returns a new Task given a type name and a struct,
+// whose JSON fields (e.g. given by `json:"user_id"` tags) become the keys
+// of the payload, so that the handler can read the payload with Bind.
+//
+// v should be a struct or a pointer to a struct, or a map with string keys.
+// Numbers in the payload are float64, as they are in the payload of the
+// tasks passed to the handler.
+func NewTaskFromStruct(typename string, v interface{}) (*Task, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("asynq: cannot encode payload: %v", err)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, fmt.Errorf("asynq: payload should be a struct or a map, got %T", v)
+	}
+	return NewTask(typename, payload), nil
 }
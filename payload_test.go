@@ -51,7 +51,7 @@ func TestPayloadGet(t *testing.T) {
 		"timestamp": now,
 		"duration":  duration,
 	}
-	payload := Payload{data}
+	payload := Payload{data: data}
 
 	gotStr, err := payload.GetString("greeting")
 	if gotStr != "Hello" || err != nil {
@@ -154,7 +154,7 @@ func TestPayloadGetWithMarshaling(t *testing.T) {
 	now := time.Now()
 	duration := 15 * time.Minute
 
-	in := Payload{map[string]interface{}{
+	in := Payload{data: map[string]interface{}{
 		"subject":      "Hello",
 		"recipient_id": 9876,
 		"pi":           3.14,
@@ -180,7 +180,7 @@ func TestPayloadGetWithMarshaling(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	out := Payload{outMsg.Payload}
+	out := Payload{data: outMsg.Payload}
 
 	gotStr, err := out.GetString("subject")
 	if gotStr != "Hello" || err != nil {
@@ -262,7 +262,7 @@ func TestPayloadGetWithMarshaling(t *testing.T) {
 }
 
 func TestPayloadKeyNotFound(t *testing.T) {
-	payload := Payload{nil}
+	payload := Payload{data: nil}
 
 	key := "something"
 	gotStr, err := payload.GetString(key)
@@ -342,10 +342,22 @@ func TestPayloadKeyNotFound(t *testing.T) {
 		t.Errorf("Payload.GetDuration(%q) = %v, %v, want 0, error",
 			key, gotDuration, err)
 	}
+
+	gotPayload, err := payload.GetPayload(key)
+	if err == nil || gotPayload.data != nil {
+		t.Errorf("Payload.GetPayload(%q) = %v, %v, want empty payload, error",
+			key, gotPayload, err)
+	}
+
+	gotPayloadSlice, err := payload.GetPayloadSlice(key)
+	if err == nil || gotPayloadSlice != nil {
+		t.Errorf("Payload.GetPayloadSlice(%q) = %v, %v, want nil, error",
+			key, gotPayloadSlice, err)
+	}
 }
 
 func TestPayloadHas(t *testing.T) {
-	payload := Payload{map[string]interface{}{
+	payload := Payload{data: map[string]interface{}{
 		"user_id": 123,
 	}}
 
@@ -356,3 +368,209 @@ func TestPayloadHas(t *testing.T) {
 		t.Errorf("Payload.Has(%q) = true, want false", "name")
 	}
 }
+
+func TestPayloadMarshalJSON(t *testing.T) {
+	tests := []struct {
+		payload Payload
+		want    string
+	}{
+		{Payload{data: map[string]interface{}{"user_id": 42, "name": "gopher"}}, `{"name":"gopher","user_id":42}`},
+		{Payload{}, `{}`},
+		{Payload{raw: []byte("hello")}, `"aGVsbG8="`},
+	}
+
+	for _, tc := range tests {
+		got, err := json.Marshal(tc.payload)
+		if err != nil {
+			t.Errorf("json.Marshal(%v) returned error: %v", tc.payload, err)
+			continue
+		}
+		if string(got) != tc.want {
+			t.Errorf("json.Marshal(%v) = %s, want %s", tc.payload, got, tc.want)
+		}
+	}
+}
+
+type emailPayload struct {
+	UserID   int               `json:"user_id"`
+	Template string            `json:"template"`
+	Tags     []string          `json:"tags,omitempty"`
+	SendAt   time.Time         `json:"send_at"`
+	Headers  map[string]string `json:"headers,omitempty"`
+}
+
+func TestPayloadBind(t *testing.T) {
+	sendAt := time.Date(2020, 3, 1, 9, 0, 0, 0, time.UTC)
+	want := emailPayload{
+		UserID:   42,
+		Template: "welcome",
+		Tags:     []string{"onboarding"},
+		SendAt:   sendAt,
+		Headers:  map[string]string{"X-Priority": "1"},
+	}
+	task, err := NewTaskFromStruct("send_email", &want)
+	if err != nil {
+		t.Fatalf("NewTaskFromStruct returned error: %v", err)
+	}
+	if got, _ := task.Payload.GetString("template"); got != "welcome" {
+		t.Errorf("Payload.GetString(%q) = %q, want %q", "template", got, "welcome")
+	}
+
+	// simulate the payload being encoded and decoded as it is stored in redis.
+	msg := h.NewTaskMessage(task.Type, task.Payload.data)
+	data, err := base.EncodeMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := base.DecodeMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, payload := range []Payload{task.Payload, {data: decoded.Payload}} {
+		var got emailPayload
+		if err := payload.Bind(&got); err != nil {
+			t.Errorf("Payload.Bind returned error: %v", err)
+			continue
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Payload.Bind = %+v, want %+v; (-want,+got)\n%s", got, want, diff)
+		}
+	}
+}
+
+func TestPayloadBindError(t *testing.T) {
+	payload := Payload{data: map[string]interface{}{"user_id": "not a number"}}
+	var got emailPayload
+	if err := payload.Bind(&got); err == nil {
+		t.Errorf("Payload.Bind with mismatched types returned nil error, want non-nil")
+	}
+	if _, err := NewTaskFromStruct("send_email", []int{1, 2}); err == nil {
+		t.Errorf("NewTaskFromStruct with a slice returned nil error, want non-nil")
+	}
+}
+
+func TestPayloadGetNested(t *testing.T) {
+	in := Payload{data: map[string]interface{}{
+		"user": map[string]interface{}{"name": "Ken", "score": 3.14},
+		"items": []map[string]interface{}{
+			{"sku": "A-1", "quantity": 2},
+			{"sku": "B-2", "quantity": 1},
+		},
+	}}
+	// encode and then decode task messsage
+	inMsg := h.NewTaskMessage("testing", in.data)
+	data, err := json.Marshal(inMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var outMsg base.TaskMessage
+	if err := json.Unmarshal(data, &outMsg); err != nil {
+		t.Fatal(err)
+	}
+	out := Payload{data: outMsg.Payload}
+
+	for _, payload := range []Payload{in, out} {
+		user, err := payload.GetPayload("user")
+		if err != nil {
+			t.Errorf("Payload.GetPayload(%q) returned error: %v", "user", err)
+			continue
+		}
+		if name, err := user.GetString("name"); name != "Ken" || err != nil {
+			t.Errorf("Payload.GetPayload(%q).GetString(%q) = %v, %v; want %q, nil", "user", "name", name, err, "Ken")
+		}
+
+		items, err := payload.GetPayloadSlice("items")
+		if err != nil || len(items) != 2 {
+			t.Errorf("Payload.GetPayloadSlice(%q) = %v, %v; want 2 payloads, nil", "items", items, err)
+			continue
+		}
+		var skus []string
+		for _, item := range items {
+			sku, err := item.GetString("sku")
+			if err != nil {
+				t.Errorf("GetString(%q) of an item returned error: %v", "sku", err)
+			}
+			skus = append(skus, sku)
+		}
+		if diff := cmp.Diff([]string{"A-1", "B-2"}, skus); diff != "" {
+			t.Errorf("skus of Payload.GetPayloadSlice(%q) = %v; (-want,+got)\n%s", "items", skus, diff)
+		}
+	}
+}
+
+func TestPayloadTypeMismatch(t *testing.T) {
+	payload := Payload{data: map[string]interface{}{
+		"user_id": "abc",
+		"names":   "luke",
+		"user":    []string{"Ken"},
+	}}
+
+	tests := []struct {
+		desc string
+		get  func() error
+		want string
+	}{
+		{
+			desc: "GetInt",
+			get:  func() error { _, err := payload.GetInt("user_id"); return err },
+			want: `value of key "user_id" is string, not convertible to int`,
+		},
+		{
+			desc: "GetDuration",
+			get:  func() error { _, err := payload.GetDuration("user_id"); return err },
+			want: `value of key "user_id" is string, not convertible to time.Duration`,
+		},
+		{
+			desc: "GetPayload",
+			get:  func() error { _, err := payload.GetPayload("user"); return err },
+			want: `value of key "user" is []string, not convertible to map[string]interface{}`,
+		},
+		{
+			desc: "GetPayloadSlice",
+			get:  func() error { _, err := payload.GetPayloadSlice("names"); return err },
+			want: `value of key "names" is string, not convertible to []map[string]interface{}`,
+		},
+	}
+
+	for _, tc := range tests {
+		err := tc.get()
+		if err == nil {
+			t.Errorf("Payload.%s returned nil error, want %q", tc.desc, tc.want)
+			continue
+		}
+		if err.Error() != tc.want {
+			t.Errorf("Payload.%s returned error %q, want %q", tc.desc, err.Error(), tc.want)
+		}
+	}
+}
+
+func TestNewBinaryTask(t *testing.T) {
+	data := []byte{0x0a, 0x05, 0x68, 0x65, 0x6c, 0x6c, 0x6f}
+	task := NewBinaryTask("resize_image", data)
+
+	msg := newTaskMessage(task)
+	msg.Encoding = base.ProtobufEncoding
+	encoded, err := base.EncodeMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := base.DecodeMessage(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := messagePayload(decoded, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(data, got.Bytes()); diff != "" {
+		t.Errorf("Payload.Bytes() = %v, want %v; (-want,+got)\n%s", got.Bytes(), data, diff)
+	}
+	if _, err := got.GetString("user"); err == nil {
+		t.Errorf("Payload.GetString on binary payload returned nil error, want non-nil")
+	}
+	if b := NewTask("send_email", nil).Payload.Bytes(); b != nil {
+		t.Errorf("Payload.Bytes() of map payload = %v, want nil", b)
+	}
+}
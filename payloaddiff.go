@@ -0,0 +1,113 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// PayloadVersion is a previous payload of a task, kept when the payload
+// was rewritten by Inspector.UpdateTaskPayload or Inspector.RenameTaskType.
+type PayloadVersion struct {
+	// Type of the task when it had the payload.
+	Type string
+
+	// Payload is the previous payload.
+	Payload Payload
+
+	// Time is when the payload was replaced.
+	Time time.Time
+}
+
+// PayloadChange describes a change to a key of the payload.
+type PayloadChange struct {
+	// Key of the payload changed.
+	Key string
+
+	// Op is one of "added", "removed", or "changed".
+	Op string
+
+	// Old and New are the values before and after the change.
+	// Old is nil if the key was added, New is nil if it was removed.
+	Old, New interface{}
+}
+
+func newPayloadHistory(history []*base.PayloadVersion) []*PayloadVersion {
+	if len(history) == 0 {
+		return nil
+	}
+	res := make([]*PayloadVersion, len(history))
+	for i, v := range history {
+		res[i] = &PayloadVersion{Type: v.Type, Payload: Payload{data: v.Payload}, Time: v.Time}
+	}
+	return res
+}
+
+// PayloadDiff returns the changes from the last previous payload of the task
+// to the current one, sorted by key, or nil if the payload has never been
+// rewritten.
+func (info *TaskInfo) PayloadDiff() []*PayloadChange {
+	if len(info.PayloadHistory) == 0 {
+		return nil
+	}
+	return diffPayloads(info.PayloadHistory[len(info.PayloadHistory)-1].Payload, info.Payload)
+}
+
+// diffPayloads returns the changes from the old payload to the new one.
+func diffPayloads(old, new Payload) []*PayloadChange {
+	var res []*PayloadChange
+	for k, v := range old.data {
+		w, ok := new.data[k]
+		switch {
+		case !ok:
+			res = append(res, &PayloadChange{Key: k, Op: "removed", Old: v})
+		case !reflect.DeepEqual(v, w):
+			res = append(res, &PayloadChange{Key: k, Op: "changed", Old: v, New: w})
+		}
+	}
+	for k, w := range new.data {
+		if _, ok := old.data[k]; !ok {
+			res = append(res, &PayloadChange{Key: k, Op: "added", New: w})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Key < res[j].Key })
+	return res
+}
+
+// UpdateTaskPayload rewrites the payload of the scheduled, retry, or dead task
+// specified by the key with transform, and returns the updated task info.
+// The previous payload is kept in the PayloadHistory of the task, so that
+// the change can be reviewed with TaskInfo.PayloadDiff.
+//
+// transform is called with the type of the task and a copy of the payload.
+// Binary payloads, and payloads encoded by a PayloadCodec, compressed, or
+// encrypted cannot be updated.
+//
+// If the task does not exist, it returns ErrTaskNotFound.
+func (i *Inspector) UpdateTaskPayload(key string, transform PayloadTransformer) (*TaskInfo, error) {
+	k, err := parseTaskKey(key, i.rdb.Keys())
+	if err != nil {
+		return nil, err
+	}
+	msg, _, err := i.rdb.FindZSetTask(k.zset, k.id, k.score, k.score)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Codec != "" || msg.Compression != "" || msg.KeyID != "" {
+		return nil, fmt.Errorf("cannot update encoded payload of task %s", msg.ID)
+	}
+	msg, err = i.rdb.UpdateZSetTaskPayload(k.zset, k.id, k.score, func(payload map[string]interface{}) (map[string]interface{}, error) {
+		return transform(msg.Type, payload)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newTaskInfo(msg, k.state, k.score), nil
+}
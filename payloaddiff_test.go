@@ -0,0 +1,69 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+)
+
+func TestTaskInfoPayloadDiff(t *testing.T) {
+	info := &TaskInfo{
+		Payload: Payload{data: map[string]interface{}{"to": "user@example.com", "template": "welcome", "retries": 3}},
+		PayloadHistory: []*PayloadVersion{
+			{Payload: Payload{data: map[string]interface{}{"to": "user@example.com"}}},
+			{Payload: Payload{data: map[string]interface{}{"to": "usr@example.com", "retries": 3, "lang": "en"}}},
+		},
+	}
+	want := []*PayloadChange{
+		{Key: "lang", Op: "removed", Old: "en"},
+		{Key: "template", Op: "added", New: "welcome"},
+		{Key: "to", Op: "changed", Old: "usr@example.com", New: "user@example.com"},
+	}
+	got := info.PayloadDiff()
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("PayloadDiff() = %v, want %v; (-want,+got)\n%s", got, want, diff)
+	}
+
+	if got := (&TaskInfo{Payload: info.Payload}).PayloadDiff(); got != nil {
+		t.Errorf("PayloadDiff() of task without payload history = %v, want nil", got)
+	}
+}
+
+func TestInspectorUpdateTaskPayload(t *testing.T) {
+	r := setup(t)
+	m := h.NewTaskMessage("send_email", map[string]interface{}{"to": "usr@example.com"})
+	score := time.Now().Add(-time.Hour).Unix()
+	h.SeedDeadQueue(t, r, []h.ZSetEntry{{Msg: m, Score: float64(score)}})
+
+	inspector := NewInspector(RedisClientOpt{Addr: redisAddr, DB: redisDB}, nil)
+	key := fmt.Sprintf("d:%d:%s", score, m.ID)
+
+	got, err := inspector.UpdateTaskPayload(key, func(typename string, payload map[string]interface{}) (map[string]interface{}, error) {
+		payload["to"] = "user@example.com"
+		return payload, nil
+	})
+	if err != nil {
+		t.Fatalf("(*Inspector).UpdateTaskPayload(%q) returned error: %v", key, err)
+	}
+	want := []*PayloadChange{{Key: "to", Op: "changed", Old: "usr@example.com", New: "user@example.com"}}
+	if diff := cmp.Diff(want, got.PayloadDiff()); diff != "" {
+		t.Errorf("PayloadDiff() = %v, want %v; (-want,+got)\n%s", got.PayloadDiff(), want, diff)
+	}
+	info, err := inspector.GetTaskInfo(key)
+	if err != nil {
+		t.Fatalf("(*Inspector).GetTaskInfo(%q) returned error: %v", key, err)
+	}
+	if len(info.PayloadHistory) != 1 || info.PayloadHistory[0].Type != "send_email" {
+		t.Errorf("(*Inspector).GetTaskInfo(%q).PayloadHistory = %v, want the previous payload", key, info.PayloadHistory)
+	}
+	if diff := cmp.Diff(want, info.PayloadDiff()); diff != "" {
+		t.Errorf("PayloadDiff() = %v, want %v; (-want,+got)\n%s", info.PayloadDiff(), want, diff)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// PoisonPillDetection specifies how the backgrounds detect the tasks which
+// repeatedly crash the worker processes (e.g. a malformed payload which
+// makes the handler run out of memory), so that one task cannot take down
+// the whole fleet over and over again.
+//
+// Each background counts the times it starts processing a task in redis,
+// across the attempts of the task, and forgets the count once an attempt
+// finishes (i.e. the handler returns). When the processing of a task was
+// interrupted MaxCrashes times without finishing, the task is moved to the
+// dead queue the next time it's delivered, with an error message starting
+// with "poison pill", instead of being passed to the handler again.
+//
+// Crashed tasks are recovered once their leases expire, so a poison pill
+// crashes at most MaxCrashes workers. Tasks still running when a background
+// is shut down are not counted as crashes.
+type PoisonPillDetection struct {
+	// MaxCrashes is the number of times processing of a task can be
+	// interrupted before the task is moved to the dead queue.
+	//
+	// If zero or negative, 3 is used.
+	MaxCrashes int
+
+	// Window specifies how long the starts of a task are counted
+	// since it was last started, so that crashes far apart are not
+	// mistaken for a poison pill.
+	//
+	// If zero or negative, 24 hours is used.
+	Window time.Duration
+}
+
+// startStore is implemented by brokers which count the starts of the tasks.
+type startStore interface {
+	RecordStart(msg *base.TaskMessage, ttl time.Duration) (int, error)
+	ClearStarts(msg *base.TaskMessage) error
+}
+
+// poisonPillDetector counts the unfinished starts of the tasks to detect
+// the tasks which crash the workers.
+//
+// A nil poisonPillDetector does nothing.
+type poisonPillDetector struct {
+	logger     *asynqLogger
+	rdb        startStore
+	maxCrashes int
+	window     time.Duration
+}
+
+func newPoisonPillDetector(logger *asynqLogger, r startStore, cfg *PoisonPillDetection) *poisonPillDetector {
+	if r == nil || cfg == nil {
+		return nil
+	}
+	maxCrashes := cfg.MaxCrashes
+	if maxCrashes <= 0 {
+		maxCrashes = 3
+	}
+	window := cfg.Window
+	if window <= 0 {
+		window = 24 * time.Hour
+	}
+	return &poisonPillDetector{logger: logger, rdb: r, maxCrashes: maxCrashes, window: window}
+}
+
+// start records that the background started processing the task, and
+// returns the number of times processing of the task was interrupted
+// before. It returns zero if the starts could not be counted.
+func (d *poisonPillDetector) start(msg *base.TaskMessage) int {
+	if d == nil {
+		return 0
+	}
+	n, err := d.rdb.RecordStart(msg, d.window)
+	if err != nil {
+		d.logger.error("Could not record start of task id=%s: %v", msg.ID, err)
+		return 0
+	}
+	return n - 1
+}
+
+// finish forgets the starts of the task once an attempt has finished.
+func (d *poisonPillDetector) finish(msg *base.TaskMessage) {
+	if d == nil {
+		return
+	}
+	if err := d.rdb.ClearStarts(msg); err != nil {
+		d.logger.error("Could not clear starts of task id=%s: %v", msg.ID, err)
+	}
+}
+
+// poisonPillError is the error of a task which crashed the workers.
+type poisonPillError struct {
+	crashes int
+}
+
+func (e *poisonPillError) Error() string {
+	return fmt.Sprintf("poison pill: processing of the task was interrupted %d times (e.g. the worker crashed or ran out of memory)", e.crashes)
+}
+
+func isPoisonPill(err error) bool {
+	_, ok := err.(*poisonPillError)
+	return ok
+}
+
+// safeToStart records that the background starts processing the task, and
+// reports whether the task may be processed. Tasks which crashed the workers
+// too many times are moved to the dead queue.
+func (p *processor) safeToStart(msg *base.TaskMessage) bool {
+	if n := p.pills.start(msg); n > 0 && n >= p.pills.maxCrashes {
+		p.pills.finish(msg)
+		p.kill(msg, &poisonPillError{crashes: n})
+		return false
+	}
+	return true
+}
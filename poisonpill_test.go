@@ -0,0 +1,135 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+)
+
+func TestNewPoisonPillDetector(t *testing.T) {
+	r := rdb.NewRDB(redis.NewClient(&redis.Options{Addr: redisAddr, DB: redisDB}))
+	if d := newPoisonPillDetector(testLogger, r, nil); d != nil {
+		t.Errorf("newPoisonPillDetector with nil config = %v, want nil", d)
+	}
+	if d := newPoisonPillDetector(testLogger, nil, &PoisonPillDetection{}); d != nil {
+		t.Errorf("newPoisonPillDetector with broker which cannot count starts = %v, want nil", d)
+	}
+	d := newPoisonPillDetector(testLogger, r, &PoisonPillDetection{})
+	if d == nil || d.maxCrashes != 3 || d.window != 24*time.Hour {
+		t.Fatalf("newPoisonPillDetector with zero config = %+v, want 3 crashes in 24h", d)
+	}
+	// A nil detector does nothing.
+	var nop *poisonPillDetector
+	if n := nop.start(h.NewTaskMessage("import_rows", nil)); n != 0 {
+		t.Errorf("nil detector counted %d crashes, want 0", n)
+	}
+	nop.finish(h.NewTaskMessage("import_rows", nil))
+}
+
+// expireLeases makes the leases of the in-progress tasks expire.
+func expireLeases(tb testing.TB, r *redis.Client) {
+	tb.Helper()
+	msgs, err := r.LRange(base.InProgressQueue, 0, -1).Result()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	expired := float64(time.Now().Add(-time.Minute).Unix())
+	for _, msg := range msgs {
+		if err := r.ZAdd(base.Leases, &redis.Z{Member: msg, Score: expired}).Err(); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+func TestProcessorPoisonPill(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+	workerCh := make(chan int)
+	go fakeHeartbeater(workerCh)
+	defer close(workerCh)
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            rdbClient,
+		queues:         defaultQueueConfig,
+		concurrency:    1,
+		retryDelayFunc: defaultDelayFunc,
+		workerCh:       workerCh,
+		cancelations:   base.NewCancelations(),
+		pills:          newPoisonPillDetector(testLogger, rdbClient, &PoisonPillDetection{MaxCrashes: 2}),
+	})
+	processed := 0
+	p.handler = HandlerFunc(func(ctx context.Context, task *Task) error {
+		processed++
+		return nil
+	})
+
+	dequeue := func() *base.TaskMessage {
+		t.Helper()
+		msg, err := rdbClient.Dequeue(base.DefaultQueueName)
+		if err != nil {
+			t.Fatalf("(*RDB).Dequeue returned error: %v", err)
+		}
+		return msg
+	}
+	run := func() {
+		p.dispatch(dequeue())
+		// wait for the worker to finish.
+		p.sema <- struct{}{}
+		<-p.sema
+	}
+
+	// a task which finishes is not counted as a crash.
+	ok := h.NewTaskMessage("import_rows", nil)
+	for i := 0; i < 3; i++ {
+		if err := rdbClient.Enqueue(ok); err != nil {
+			t.Fatal(err)
+		}
+		run()
+	}
+	if processed != 3 {
+		t.Errorf("handler processed %d tasks, want 3", processed)
+	}
+
+	// the workers processing the task crash twice, and the task is
+	// recovered each time once its lease expires.
+	pill := h.NewTaskMessage("import_rows", nil)
+	pill.Retry = 25
+	if err := rdbClient.Enqueue(pill); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		p.pills.start(dequeue())
+		expireLeases(t, r)
+		if n, err := rdbClient.RecoverExpiredLeases(); err != nil || n != 1 {
+			t.Fatalf("(*RDB).RecoverExpiredLeases() = %d, %v, want 1, nil", n, err)
+		}
+		if err := rdbClient.CheckAndEnqueue(base.DefaultQueueName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run()
+	if processed != 3 {
+		t.Errorf("handler processed the poison pill")
+	}
+
+	dead := h.GetDeadMessages(t, r)
+	if len(dead) != 1 || dead[0].ID != pill.ID {
+		t.Fatalf("dead tasks = %v, want the poison pill", dead)
+	}
+	if !strings.HasPrefix(dead[0].ErrorMsg, "poison pill: processing of the task was interrupted 2 times") {
+		t.Errorf("poison pill killed with error %q", dead[0].ErrorMsg)
+	}
+	if n := r.Exists(base.DefaultKeys.StartsKey(pill.ID.String())).Val(); n != 0 {
+		t.Errorf("starts of the poison pill kept after it was killed")
+	}
+}
@@ -13,22 +13,84 @@ import (
 	"time"
 
 	"github.com/hibiken/asynq/internal/base"
-	"github.com/hibiken/asynq/internal/rdb"
 	"golang.org/x/time/rate"
 )
 
 type processor struct {
-	rdb *rdb.RDB
+	logger *asynqLogger
+	rdb    base.Broker
 
 	handler Handler
 
+	// queueConfig holds the normalized weights of the queues to process.
+	// Queues whose weights are set to zero at runtime are excluded.
 	queueConfig map[string]int
 
 	// orderedQueues is set only in strict-priority mode.
 	orderedQueues []string
 
+	// configuredQueues holds the weights of the queues given by the config,
+	// which are used to seed the weights stored in redis.
+	configuredQueues map[string]int
+
+	strictPriority bool
+
+	// time the queue weights were last read from redis.
+	weightsRefreshedAt time.Time
+
+	// killSwitch is the kill switch engaged, nil if processing is allowed.
+	killSwitch *base.KillSwitch
+
+	// time the kill switch was last read from redis.
+	killSwitchCheckedAt time.Time
+
+	// index of the queue to block on next when all queues are empty
+	// in strict-priority mode.
+	blockRotation int
+
 	retryDelayFunc retryDelayFunc
 
+	// transformers are applied to the payload of each task in order
+	// before the task is passed to the handler.
+	transformers []PayloadTransformer
+
+	// typeAliases maps the old names of the renamed task types to the
+	// new names, which are passed to the handler instead.
+	typeAliases map[string]string
+
+	// faults injects failures for testing, nil in production.
+	faults *faultInjector
+
+	// gate pauses retries of the tasks whose dependencies are down,
+	// nil if no dependencies are configured.
+	gate *dependencyGate
+
+	// limiter throttles the tasks over the rate limits of their types
+	// or queues, nil if no rate limits are configured.
+	limiter *rateLimiter
+
+	// idle keeps track of how long the processor has been idle.
+	idle *idleMonitor
+
+	// duplicates detects the tasks delivered more than once,
+	// nil if duplicate detection is not configured.
+	duplicates *duplicateDetector
+
+	// profiler captures profiles when the workers are saturated or
+	// a task is slow, nil if profiling is not configured.
+	profiler *profiler
+
+	// lane reserves workers for the tasks expected to finish quickly,
+	// nil if no fast lane is configured.
+	lane *fastLane
+
+	// pool holds the preloaded resources of the workers,
+	// nil if no warm pool is configured.
+	pool *warmPool
+
+	// maximum number of tasks to pass at once to a BulkHandler.
+	bulkSize int
+
 	// channel via which to send sync requests to syncer.
 	syncRequestCh chan<- *syncRequest
 
@@ -55,40 +117,339 @@ type processor struct {
 
 	// cancelations is a set of cancel functions for all in-progress tasks.
 	cancelations *base.Cancelations
+
+	// leases keeps the leases of the tasks being processed.
+	leases *leaseKeeper
+
+	// slowRetry is the policy to move chronically failing tasks
+	// to a low priority queue, nil if tasks are retried in their queues.
+	slowRetry *SlowRetry
+
+	// results lets handlers stream their results to the result sink,
+	// nil if no result sink is configured.
+	results *results
+
+	// costs stores the costs reported by handlers, nil if the broker
+	// doesn't store costs.
+	costs costStore
+
+	// latencies records the wait and run durations of the tasks, nil if
+	// the broker doesn't store latency histograms.
+	latencies latencyStore
+
+	// canary records the completions of canary tasks, nil if the broker
+	// doesn't keep track of the canary.
+	canary canaryStore
+
+	// codec decodes the payloads encoded by a PayloadCodec, nil if
+	// payloads are not encoded.
+	codec PayloadCodec
+
+	// encryption holds the keys to decrypt the payloads, nil if
+	// payloads are not encrypted.
+	encryption *Encryption
+
+	// signing verifies the signatures of the tasks, nil if signatures
+	// are not verified.
+	signing *Signing
+
+	// acks acknowledges the tasks to be processed at most once before
+	// processing them, nil if the broker cannot acknowledge them early.
+	acks ackStore
+
+	// completions keeps the completed tasks for the retention, nil if the
+	// broker cannot keep them.
+	completions completedStore
+
+	// workflows tracks the steps of the workflows, nil if the broker
+	// cannot track them.
+	workflows workflowStore
+
+	// progress stores the progress reported by the handlers, nil if the
+	// broker cannot store it.
+	progress progressStore
+
+	// simulation is true if the simulated tasks are processed without
+	// calling the handler.
+	simulation bool
+
+	// pills detects the tasks which crash the workers.
+	pills *poisonPillDetector
+
+	// breakers pause the queues whose tasks are failing.
+	breakers *circuitBreakers
+
+	// batches pops several tasks out of the queues at once, nil if
+	// the broker cannot.
+	batches batchDequeuer
+
+	// waker wakes up the processor waiting for tasks, nil if the processor
+	// blocks on one of the queues.
+	waker *waker
+
+	// shards holds the number of shards of the sharded queues, whose shards
+	// are pulled out of in place of the queues.
+	shards queueShards
+
+	// clock tells the time to retry and postpone the tasks at, the time of
+	// the system if nil.
+	clock Clock
+
+	// defaultTimeout is the timeout of the tasks without a timeout,
+	// zero for no timeout.
+	defaultTimeout time.Duration
+
+	// baseContext returns the context the contexts of the tasks are
+	// derived from, context.Background if nil.
+	baseContext func() context.Context
+
+	// onDead is called with the tasks moved to the dead queue, nil to
+	// not call it.
+	onDead func(info *TaskInfo, err error)
+
+	// idleWait is how long to wait for wakeups the next time the queues
+	// are found empty. It doubles up to maxIdleWait while the queues stay
+	// empty, and is reset when the processor is woken up.
+	idleWait    time.Duration
+	maxIdleWait time.Duration
+
+	// dequeueBatch is the max number of tasks to pop out of the queues
+	// at once.
+	dequeueBatch int
+
+	// recoverPanicFunc decides whether to retry the tasks whose handler
+	// panicked, nil to always retry them.
+	recoverPanicFunc RecoverPanicFunc
+
+	// retention is how long to keep the completed tasks, zero to delete
+	// them once they're done.
+	retention time.Duration
+
+	// mu guards quiet and concurrency.
+	mu sync.Mutex
+
+	// quiet is true if the processor is not pulling new tasks out of the queues.
+	quiet bool
+
+	// concurrency is the current limit on the number of active workers.
+	// It's at most cap(sema).
+	concurrency int
+}
+
+// batchDequeuer is implemented by brokers which can pop several tasks
+// out of the queues in one round trip.
+type batchDequeuer interface {
+	DequeueN(n int, qnames ...string) ([]*base.TaskMessage, error)
 }
 
 type retryDelayFunc func(n int, err error, task *Task) time.Duration
 
+type processorParams struct {
+	logger         *asynqLogger
+	rdb            base.Broker
+	queues         map[string]int
+	strictPriority bool
+	concurrency    int
+	retryDelayFunc retryDelayFunc
+	syncCh         chan<- *syncRequest
+	workerCh       chan<- int
+	cancelations   *base.Cancelations
+	transformers   []PayloadTransformer
+	typeAliases    map[string]string
+	codec          PayloadCodec
+	encryption     *Encryption
+	signing        *Signing
+	faults         *faultInjector
+	gate           *dependencyGate
+	rateLimits     []*TaskRateLimit
+	idleTimeout    time.Duration
+	onIdle         func()
+	warmPool       *WarmPool
+	fastLane       *FastLane
+	bulkSize       int
+	leases         *leaseKeeper
+	results        *results
+	slowRetry      *SlowRetry
+	profiling      *Profiling
+	duplicates     *duplicateDetector
+	retention      time.Duration
+	simulation     bool
+	recoverPanic   RecoverPanicFunc
+	pills          *poisonPillDetector
+	breakers       *circuitBreakers
+	dequeueBatch   int
+	waker          *waker
+	maxIdleWait    time.Duration
+	shards         queueShards
+	clock          Clock
+	defaultTimeout time.Duration
+	baseContext    func() context.Context
+	onDead         func(info *TaskInfo, err error)
+}
+
+const (
+	minIdleWait        = time.Second
+	defaultMaxIdleWait = 30 * time.Second
+)
+
 // newProcessor constructs a new processor.
-func newProcessor(r *rdb.RDB, queues map[string]int, strict bool, concurrency int, fn retryDelayFunc,
-	syncRequestCh chan<- *syncRequest, workerCh chan<- int, cancelations *base.Cancelations) *processor {
-	qcfg := normalizeQueueCfg(queues)
-	orderedQueues := []string(nil)
-	if strict {
-		orderedQueues = sortByPriority(qcfg)
-	}
-	return &processor{
-		rdb:            r,
-		queueConfig:    qcfg,
-		orderedQueues:  orderedQueues,
-		retryDelayFunc: fn,
-		syncRequestCh:  syncRequestCh,
-		workerCh:       workerCh,
-		cancelations:   cancelations,
-		errLogLimiter:  rate.NewLimiter(rate.Every(3*time.Second), 1),
-		sema:           make(chan struct{}, concurrency),
-		done:           make(chan struct{}),
-		abort:          make(chan struct{}),
-		quit:           make(chan struct{}),
-		handler:        HandlerFunc(func(ctx context.Context, t *Task) error { return fmt.Errorf("handler not set") }),
+func newProcessor(params processorParams) *processor {
+	maxIdleWait := params.maxIdleWait
+	switch {
+	case maxIdleWait <= 0:
+		maxIdleWait = defaultMaxIdleWait
+	case maxIdleWait < minIdleWait:
+		maxIdleWait = minIdleWait
+	}
+	p := &processor{
+		logger:           params.logger,
+		rdb:              params.rdb,
+		configuredQueues: params.queues,
+		strictPriority:   params.strictPriority,
+		retryDelayFunc:   params.retryDelayFunc,
+		syncRequestCh:    params.syncCh,
+		workerCh:         params.workerCh,
+		cancelations:     params.cancelations,
+		leases:           params.leases,
+		slowRetry:        params.slowRetry,
+		results:          params.results,
+		duplicates:       params.duplicates,
+		retention:        params.retention,
+		simulation:       params.simulation,
+		recoverPanicFunc: params.recoverPanic,
+		pills:            params.pills,
+		breakers:         params.breakers,
+		dequeueBatch:     params.dequeueBatch,
+		waker:            params.waker,
+		idleWait:         minIdleWait,
+		maxIdleWait:      maxIdleWait,
+		shards:           params.shards,
+		clock:            params.clock,
+		defaultTimeout:   params.defaultTimeout,
+		baseContext:      params.baseContext,
+		onDead:           params.onDead,
+		transformers:     params.transformers,
+		typeAliases:      params.typeAliases,
+		codec:            params.codec,
+		encryption:       params.encryption,
+		signing:          params.signing,
+		faults:           params.faults,
+		gate:             params.gate,
+		idle:             newIdleMonitor(params.logger, params.idleTimeout, params.onIdle),
+		pool:             newWarmPool(params.logger, params.warmPool, params.concurrency),
+		lane:             newFastLane(params.fastLane, params.concurrency),
+		bulkSize:         params.bulkSize,
+		errLogLimiter:    rate.NewLimiter(rate.Every(3*time.Second), 1),
+		sema:             make(chan struct{}, params.concurrency),
+		concurrency:      params.concurrency,
+		done:             make(chan struct{}),
+		abort:            make(chan struct{}),
+		quit:             make(chan struct{}),
+		handler:          HandlerFunc(func(ctx context.Context, t *Task) error { return fmt.Errorf("handler not set") }),
+	}
+	p.costs, _ = params.rdb.(costStore)
+	p.canary, _ = params.rdb.(canaryStore)
+	p.acks, _ = params.rdb.(ackStore)
+	p.completions, _ = params.rdb.(completedStore)
+	p.workflows, _ = params.rdb.(workflowStore)
+	p.progress, _ = params.rdb.(progressStore)
+	p.batches, _ = params.rdb.(batchDequeuer)
+	p.latencies, _ = params.rdb.(latencyStore)
+	tokens, _ := params.rdb.(tokenStore)
+	p.limiter = newRateLimiter(params.logger, params.rateLimits, tokens)
+	p.profiler = newProfiler(params.logger, params.profiling, p.saturated)
+	p.setQueueConfig(params.queues)
+	return p
+}
+
+// interval between reads of the queue weights stored in redis.
+const queueWeightsRefreshInterval = 5 * time.Second
+
+// setQueueConfig sets the weights of the queues to process.
+// Queues with a zero or negative weight are excluded.
+func (p *processor) setQueueConfig(weights map[string]int) {
+	qcfg := make(map[string]int)
+	for qname, w := range weights {
+		if w > 0 {
+			qcfg[qname] = w
+		}
+	}
+	if len(qcfg) > 0 {
+		qcfg = normalizeQueueCfg(qcfg)
+	}
+	p.queueConfig = qcfg
+	p.orderedQueues = nil
+	if p.strictPriority {
+		p.orderedQueues = sortByPriority(qcfg)
+	}
+}
+
+// seedQueueWeights writes the queue weights given by the config
+// to redis, unless they have been set already.
+func (p *processor) seedQueueWeights() {
+	if err := p.rdb.SeedQueueWeights(p.configuredQueues); err != nil {
+		p.logger.error("Could not write queue weights: %v", err)
+	}
+}
+
+// refreshQueueWeights reads the queue weights stored in redis, which may
+// have been adjusted at runtime, and updates the weights of the queues
+// to process. Only the queues given by the config are processed.
+func (p *processor) refreshQueueWeights() {
+	if time.Since(p.weightsRefreshedAt) < queueWeightsRefreshInterval {
+		return
+	}
+	p.weightsRefreshedAt = time.Now()
+	weights, err := p.rdb.QueueWeights()
+	if err != nil {
+		if p.errLogLimiter.Allow() {
+			p.logger.error("Could not read queue weights: %v", err)
+		}
+		return
+	}
+	qcfg := make(map[string]int)
+	for qname, w := range p.configuredQueues {
+		if v, ok := weights[qname]; ok {
+			w = v
+		}
+		qcfg[qname] = w
 	}
+	p.setQueueConfig(qcfg)
+}
+
+// interval between reads of the kill switch stored in redis.
+const killSwitchCheckInterval = time.Second
+
+// killSwitchEngaged reads the kill switch stored in redis, and reports
+// whether processing is paused by the kill switch.
+func (p *processor) killSwitchEngaged() bool {
+	if time.Since(p.killSwitchCheckedAt) < killSwitchCheckInterval {
+		return p.killSwitch != nil
+	}
+	p.killSwitchCheckedAt = time.Now()
+	ks, err := p.rdb.KillSwitch()
+	if err != nil {
+		if p.errLogLimiter.Allow() {
+			p.logger.error("Could not read kill switch: %v", err)
+		}
+		return p.killSwitch != nil
+	}
+	switch {
+	case ks != nil && p.killSwitch == nil:
+		p.logger.warn("Kill switch engaged by %s until %v: %s; Pausing processing",
+			ks.By, ks.Expires.Format(time.RFC3339), ks.Reason)
+	case ks == nil && p.killSwitch != nil:
+		p.logger.info("Kill switch disengaged; Resuming processing")
+	}
+	p.killSwitch = ks
+	return ks != nil
 }
 
 // Note: stops only the "processor" goroutine, does not stop workers.
 // It's safe to call this method multiple times.
 func (p *processor) stop() {
 	p.once.Do(func() {
-		logger.info("Processor shutting down...")
+		p.logger.debug("Processor shutting down...")
 		// Unblock if processor is waiting for sema token.
 		close(p.abort)
 		// Signal the processor goroutine to stop processing tasks
@@ -97,6 +458,24 @@ func (p *processor) stop() {
 	})
 }
 
+// isStopped reports whether the processor goroutine has been stopped.
+func (p *processor) isStopped() bool {
+	select {
+	case <-p.abort:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for the duration, or until the processor is stopped.
+func (p *processor) sleep(d time.Duration) {
+	select {
+	case <-p.abort:
+	case <-time.After(d):
+	}
+}
+
 // NOTE: once terminated, processor cannot be re-started.
 func (p *processor) terminate() {
 	p.stop()
@@ -104,32 +483,42 @@ func (p *processor) terminate() {
 	// IDEA: Allow user to customize this timeout value.
 	const timeout = 8 * time.Second
 	time.AfterFunc(timeout, func() { close(p.quit) })
-	logger.info("Waiting for all workers to finish...")
+	p.logger.info("Waiting for all workers to finish...")
 
 	// send cancellation signal to all in-progress task handlers
 	for _, cancel := range p.cancelations.GetAll() {
 		cancel()
 	}
 
+	// block until the tasks waiting for a worker outside the fast lane
+	// have been requeued or passed to a worker.
+	p.lane.wait()
+
 	// block until all workers have released the token
 	for i := 0; i < cap(p.sema); i++ {
 		p.sema <- struct{}{}
 	}
-	logger.info("All workers have finished")
+	p.logger.info("All workers have finished")
 	p.restore() // move any unfinished tasks back to the queue.
+	p.pool.close()
+	p.profiler.terminate()
 }
 
 func (p *processor) start(wg *sync.WaitGroup) {
 	// NOTE: The call to "restore" needs to complete before starting
 	// the processor goroutine.
 	p.restore()
+	p.seedQueueWeights()
+	// Load the worker slots before pulling tasks out of the queues.
+	p.pool.load()
+	p.profiler.start(wg)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		for {
 			select {
 			case <-p.done:
-				logger.info("Processor done")
+				p.logger.debug("Processor done")
 				return
 			default:
 				p.exec()
@@ -138,101 +527,513 @@ func (p *processor) start(wg *sync.WaitGroup) {
 	}()
 }
 
+// setQuiet sets whether the processor should stop pulling new tasks
+// out of the queues. In-flight tasks are not affected.
+func (p *processor) setQuiet(quiet bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.quiet = quiet
+}
+
+func (p *processor) isQuiet() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.quiet
+}
+
+// setConcurrency sets the limit on the number of active workers.
+// The value n should be between one and the concurrency the processor
+// was created with.
+func (p *processor) setConcurrency(n int) error {
+	if n < 1 || n > cap(p.sema) {
+		return fmt.Errorf("concurrency should be between 1 and %d", cap(p.sema))
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.concurrency = n
+	return nil
+}
+
+func (p *processor) getConcurrency() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.concurrency
+}
+
+// activeWorkers returns the number of workers currently processing tasks.
+func (p *processor) activeWorkers() int {
+	return len(p.sema)
+}
+
+// saturated reports whether all the workers are processing tasks.
+func (p *processor) saturated() bool {
+	return p.activeWorkers() >= p.getConcurrency()
+}
+
 // exec pulls a task out of the queue and starts a worker goroutine to
 // process the task.
 func (p *processor) exec() {
-	qnames := p.queues()
-	msg, err := p.rdb.Dequeue(qnames...)
-	if err == rdb.ErrNoProcessableTask {
-		// queues are empty, this is a normal behavior.
-		if len(p.queueConfig) > 1 {
-			// sleep to avoid slamming redis and let scheduler move tasks into queues.
-			// Note: With multiple queues, we are not using blocking pop operation and
-			// polling queues instead. This adds significant load to redis.
-			time.Sleep(time.Second)
+	if p.isQuiet() || p.killSwitchEngaged() {
+		p.sleep(time.Second)
+		return
+	}
+	if n := p.getConcurrency(); n < cap(p.sema) && p.activeWorkers() >= n {
+		// wait for a worker to finish since concurrency has been lowered.
+		p.sleep(100 * time.Millisecond)
+		return
+	}
+	p.refreshQueueWeights()
+	if len(p.queueConfig) == 0 {
+		// all queues have been paused by setting their weights to zero.
+		p.sleep(time.Second)
+		return
+	}
+	qnames := p.shards.expand(p.breakers.allowed(p.queues(), time.Now()))
+	if len(qnames) == 0 {
+		// all queues have been paused by their circuit breakers.
+		p.sleep(time.Second)
+		return
+	}
+	var msg *base.TaskMessage
+	var err error
+	if n := p.dequeueBatchSize(); n > 1 {
+		var msgs []*base.TaskMessage
+		msgs, err = p.batches.DequeueN(n, qnames...)
+		if err == nil {
+			p.idleWait = minIdleWait
+			for _, msg := range msgs {
+				p.route(msg, qnames)
+			}
+			return
 		}
+		if err == base.ErrNoProcessableTask {
+			msg, err = p.waitForTasks(qnames)
+		}
+	} else {
+		msg, err = p.rdb.Dequeue(qnames...)
+		if err == base.ErrNoProcessableTask && (len(qnames) > 1 || p.waker != nil) {
+			msg, err = p.waitForTasks(qnames)
+		}
+	}
+	if err == base.ErrNoProcessableTask {
+		// queues are empty, this is a normal behavior.
+		p.idle.check()
 		return
 	}
 	if err != nil {
 		if p.errLogLimiter.Allow() {
-			logger.error("Dequeue error: %v", err)
+			p.logger.error("Dequeue error: %v", err)
 		}
 		return
 	}
+	p.idleWait = minIdleWait
+	p.route(msg, qnames)
+}
+
+// waitForTasks is called when all the queues are empty. Instead of polling
+// the queues, it waits for a wakeup published when a task is enqueued to one
+// of them, backing off exponentially while the queues stay empty, or blocks
+// on one of the queues until a task arrives or the timeout elapses; the
+// other queues are queried again in the next iteration.
+func (p *processor) waitForTasks(qnames []string) (*base.TaskMessage, error) {
+	woken, ok := p.waker.wait(p.idleWait, p.abort)
+	if !ok {
+		return p.rdb.Dequeue(p.blockingQueue(qnames))
+	}
+	if woken {
+		p.idleWait = minIdleWait
+	} else if p.idleWait *= 2; p.idleWait > p.maxIdleWait {
+		p.idleWait = p.maxIdleWait
+	}
+	return nil, base.ErrNoProcessableTask
+}
+
+// dequeueBatchSize returns the number of tasks to pop out of the queues
+// at once, which is bounded by the workers available.
+func (p *processor) dequeueBatchSize() int {
+	if p.batches == nil || p.dequeueBatch < 2 {
+		return 1
+	}
+	if _, ok := p.bulkHandler(); ok {
+		// batches of the bulk handler are filled by fillBulk.
+		return 1
+	}
+	n := p.getConcurrency() - p.activeWorkers()
+	switch {
+	case n < 1:
+		return 1
+	case n > p.dequeueBatch:
+		return p.dequeueBatch
+	}
+	return n
+}
+
+// route starts processing the task pulled out of the queues, unless it
+// should be processed later.
+func (p *processor) route(msg *base.TaskMessage, qnames []string) {
+	if d, ok := p.gate.retryPaused(msg); ok {
+		// a dependency of the task is down, try again later.
+		p.postpone(msg, now(p.clock).Add(d))
+		return
+	}
+	if d, ok := p.limiter.throttled(msg); ok {
+		// the task is over the rate limit of its type or queue, try again later.
+		p.postpone(msg, now(p.clock).Add(d))
+		return
+	}
+	if h, ok := p.bulkHandler(); ok {
+		p.execBulk(h, p.fillBulk(msg, qnames))
+		return
+	}
+	if p.lane != nil && !p.lane.isFast(msg) {
+		p.dispatchSlow(msg)
+		return
+	}
+	p.dispatch(msg)
+}
 
+// dispatch starts a worker goroutine to process the task once a worker
+// is available.
+func (p *processor) dispatch(msg *base.TaskMessage) {
 	select {
 	case <-p.abort:
 		// shutdown is starting, return immediately after requeuing the message.
+		p.lane.release(msg)
+		p.leases.remove(msg)
 		p.requeue(msg)
 		return
 	case p.sema <- struct{}{}: // acquire token
 		p.workerCh <- 1
+		p.idle.taskStarted()
 		go func() {
 			defer func() {
+				p.idle.taskFinished()
 				p.workerCh <- -1
+				p.lane.release(msg)
 				<-p.sema /* release token */
 			}()
 
+			slot, err := p.pool.acquire()
+			if err != nil {
+				p.logger.error("%v; Pushing task id=%s back to queue", err, msg.ID)
+				p.requeue(msg)
+				time.Sleep(time.Second) // wait before loading the slot again.
+				return
+			}
+
+			p.injectDeliveryFaults(msg)
+			if !p.verified(msg) {
+				p.pool.release(slot)
+				return
+			}
+			if !p.ack(msg) || !p.safeToStart(msg) {
+				p.pool.release(slot)
+				return
+			}
+			p.duplicates.check(msg)
 			resCh := make(chan error, 1)
-			task := NewTask(msg.Type, msg.Payload)
-			ctx, cancel := createContext(msg)
+			ctx, cancel := createContext(p.newBaseContext(), msg, p.defaultTimeout)
+			ctx = p.gate.withContext(ctx)
+			ctx = slot.withContext(ctx)
+			ctx, costs := withCosts(ctx)
+			ctx = p.leases.withContext(ctx, msg)
+			ctx = p.results.withContext(ctx, msg)
+			ctx = p.withWorkflowStep(ctx, msg)
+			ctx = p.withProgress(ctx, msg)
 			p.cancelations.Add(msg.ID.String(), cancel)
+			p.leases.add(msg)
+			started := time.Now()
 			go func() {
-				resCh <- perform(ctx, task, p.handler)
+				stop := p.profiler.watch(msg)
+				defer stop()
+				if isCanary(msg) {
+					resCh <- p.completeCanary()
+				} else if deadlinePassed(msg, now(p.clock)) {
+					resCh <- errDeadlinePassed
+				} else if task, err := p.transform(msg); err != nil {
+					resCh <- err
+				} else if p.simulation && isSimulated(task) {
+					resCh <- simulate(ctx, task)
+				} else {
+					resCh <- p.recoverPanic(task, perform(ctx, task, p.handler))
+				}
 				p.cancelations.Delete(msg.ID.String())
 			}()
 
 			select {
 			case <-p.quit:
 				// time is up, quit this worker goroutine.
-				logger.warn("Quitting worker to process task id=%s", msg.ID)
+				p.logger.warn("Quitting worker to process task id=%s", msg.ID)
+				p.pool.release(slot)
+				p.pills.finish(msg)
 				return
 			case resErr := <-resCh:
-				// Note: One of three things should happen.
-				// 1) Done  -> Removes the message from InProgress
-				// 2) Retry -> Removes the message from InProgress & Adds the message to Retry
-				// 3) Kill  -> Removes the message from InProgress & Adds the message to Dead
-				if resErr != nil {
-					if msg.Retried >= msg.Retry {
-						p.kill(msg, resErr)
-					} else {
-						p.retry(msg, resErr)
-					}
-					return
+				p.pool.release(slot)
+				p.addCosts(msg, costs.split(1))
+				p.addLatencies(msg, started)
+				p.handleResult(msg, resErr)
+			}
+		}()
+	}
+}
+
+// handleResult updates the state of the task given the error
+// returned by its handler.
+func (p *processor) handleResult(msg *base.TaskMessage, err error) {
+	// Note: One of three things should happen.
+	// 1) Done  -> Removes the message from InProgress
+	// 2) Retry -> Removes the message from InProgress & Adds the message to Retry
+	// 3) Kill  -> Removes the message from InProgress & Adds the message to Dead
+	p.leases.remove(msg)
+	p.pills.finish(msg)
+	p.breakers.record(logicalQueue(msg.Queue), err != nil, time.Now())
+	if err != nil {
+		// tasks acknowledged before processing are never retried.
+		if isFinal(msg, err, now(p.clock)) || p.ackedEarly(msg) {
+			p.kill(msg, err)
+		} else {
+			p.retry(msg, err)
+		}
+		return
+	}
+	p.markAsDone(msg)
+}
+
+// bulkHandler returns the handler as a BulkHandler if tasks should
+// be processed in batches.
+func (p *processor) bulkHandler() (BulkHandler, bool) {
+	if p.bulkSize < 2 {
+		return nil, false
+	}
+	h, ok := p.handler.(BulkHandler)
+	return h, ok
+}
+
+// fillBulk pulls more tasks out of the queues to make a batch of up to
+// bulkSize tasks with msg, until the queues are empty.
+//
+// Note: Dequeue blocks for up to a second if one queue is given,
+// which lets the batch fill up when the queue is short.
+func (p *processor) fillBulk(msg *base.TaskMessage, qnames []string) []*base.TaskMessage {
+	msgs := []*base.TaskMessage{msg}
+	for len(msgs) < p.bulkSize {
+		m, err := p.rdb.Dequeue(qnames...)
+		if err == base.ErrNoProcessableTask {
+			break
+		}
+		if err != nil {
+			if p.errLogLimiter.Allow() {
+				p.logger.error("Dequeue error: %v", err)
+			}
+			break
+		}
+		if d, ok := p.gate.retryPaused(m); ok {
+			p.postpone(m, now(p.clock).Add(d))
+			continue
+		}
+		if d, ok := p.limiter.throttled(m); ok {
+			p.postpone(m, now(p.clock).Add(d))
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+// execBulk starts a worker goroutine to process the batch of tasks
+// with the batch handler.
+func (p *processor) execBulk(h BulkHandler, msgs []*base.TaskMessage) {
+	select {
+	case <-p.abort:
+		// shutdown is starting, return immediately after requeuing the messages.
+		for _, msg := range msgs {
+			p.requeue(msg)
+		}
+		return
+	case p.sema <- struct{}{}: // acquire token
+		p.workerCh <- 1
+		p.idle.taskStarted()
+		go func() {
+			defer func() {
+				p.idle.taskFinished()
+				p.workerCh <- -1
+				<-p.sema /* release token */
+			}()
+
+			slot, err := p.pool.acquire()
+			if err != nil {
+				p.logger.error("%v; Pushing %d tasks back to queue", err, len(msgs))
+				for _, msg := range msgs {
+					p.requeue(msg)
+				}
+				time.Sleep(time.Second) // wait before loading the slot again.
+				return
+			}
+
+			acked := msgs[:0]
+			for _, msg := range msgs {
+				p.injectDeliveryFaults(msg)
+				if p.verified(msg) && p.ack(msg) && p.safeToStart(msg) {
+					p.duplicates.check(msg)
+					acked = append(acked, msg)
+				}
+			}
+			if msgs = acked; len(msgs) == 0 {
+				p.pool.release(slot)
+				return
+			}
+			resCh := make(chan []error, 1)
+			ctx, cancel := createBulkContext(p.newBaseContext(), msgs, p.defaultTimeout)
+			ctx = p.gate.withContext(ctx)
+			ctx = slot.withContext(ctx)
+			ctx, costs := withCosts(ctx)
+			ctx = p.leases.withContext(ctx, msgs...)
+			for _, msg := range msgs {
+				p.cancelations.Add(msg.ID.String(), cancel)
+				p.leases.add(msg)
+			}
+			started := time.Now()
+			go func() {
+				resCh <- p.processBulk(ctx, h, msgs)
+				for _, msg := range msgs {
+					p.cancelations.Delete(msg.ID.String())
+				}
+			}()
+
+			select {
+			case <-p.quit:
+				// time is up, quit this worker goroutine.
+				p.logger.warn("Quitting worker to process a batch of %d tasks", len(msgs))
+				p.pool.release(slot)
+				for _, msg := range msgs {
+					p.pills.finish(msg)
+				}
+				return
+			case errs := <-resCh:
+				p.pool.release(slot)
+				// costs of the batch are shared by its tasks.
+				shares := costs.split(len(msgs))
+				for i, msg := range msgs {
+					p.addCosts(msg, shares)
+					p.addLatencies(msg, started)
+					p.handleResult(msg, errs[i])
 				}
-				p.markAsDone(msg)
 			}
 		}()
 	}
 }
 
-// restore moves all tasks from "in-progress" back to queue
-// to restore all unfinished tasks.
+// processBulk calls the batch handler with the tasks of the messages
+// after applying the payload transformers, and returns an error for
+// each message. Messages which fail to transform are not passed to the handler.
+func (p *processor) processBulk(ctx context.Context, h BulkHandler, msgs []*base.TaskMessage) []error {
+	errs := make([]error, len(msgs))
+	var tasks []*Task
+	var indices []int // indices of the messages of the tasks
+	for i, msg := range msgs {
+		if isCanary(msg) {
+			errs[i] = p.completeCanary()
+			continue
+		}
+		task, err := p.transform(msg)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if p.simulation && isSimulated(task) {
+			errs[i] = simulate(ctx, task)
+			continue
+		}
+		tasks = append(tasks, task)
+		indices = append(indices, i)
+	}
+	if len(tasks) == 0 {
+		return errs
+	}
+	for j, err := range performBulk(ctx, tasks, h) {
+		errs[indices[j]] = p.recoverPanic(tasks[j], err)
+	}
+	return errs
+}
+
+// restore moves the unfinished tasks back to their queues.
+//
+// With leases, only the tasks held by this process are moved, since the
+// in-progress list is shared with the other backgrounds; the tasks of the
+// processes which crashed are recovered once their leases expire.
+// Without leases, all the tasks in the in-progress list are moved.
 func (p *processor) restore() {
+	if p.leases != nil {
+		msgs := p.leases.release()
+		for _, msg := range msgs {
+			p.requeue(msg)
+		}
+		if len(msgs) > 0 {
+			p.logger.info("Restored %d unfinished tasks back to queue", len(msgs))
+		}
+		return
+	}
 	n, err := p.rdb.RequeueAll()
 	if err != nil {
-		logger.error("Could not restore unfinished tasks: %v", err)
+		p.logger.error("Could not restore unfinished tasks: %v", err)
 	}
 	if n > 0 {
-		logger.info("Restored %d unfinished tasks back to queue", n)
+		p.logger.info("Restored %d unfinished tasks back to queue", n)
+	}
+}
+
+// completeCanary records that a canary task was completed.
+func (p *processor) completeCanary() error {
+	if p.canary == nil {
+		return nil
+	}
+	return p.canary.CompleteCanary()
+}
+
+// addCosts stores the costs reported by the handler of the task.
+func (p *processor) addCosts(msg *base.TaskMessage, costs map[string]float64) {
+	if p.costs == nil || len(costs) == 0 {
+		return
+	}
+	if err := p.costs.AddCosts(msg, costs); err != nil {
+		p.logger.warn("Could not record costs of task id=%s: %v", msg.ID, err)
 	}
 }
 
 func (p *processor) requeue(msg *base.TaskMessage) {
 	err := p.rdb.Requeue(msg)
 	if err != nil {
-		logger.error("Could not push task id=%s back to queue: %v", msg.ID, err)
+		p.logger.error("Could not push task id=%s back to queue: %v", msg.ID, err)
+	}
+}
+
+// injectDeliveryFaults injects failures configured for testing
+// after the message is dequeued.
+func (p *processor) injectDeliveryFaults(msg *base.TaskMessage) {
+	if p.faults.duplicateDelivery() {
+		p.logger.warn("Fault injection: enqueueing a duplicate of task id=%s", msg.ID)
+		if err := p.rdb.Enqueue(msg); err != nil {
+			p.logger.error("Could not enqueue a duplicate of task id=%s: %v", msg.ID, err)
+		}
+	}
+	if p.faults.loseLease() {
+		p.logger.warn("Fault injection: task id=%s lost its lease", msg.ID)
+		p.requeue(msg)
 	}
 }
 
 func (p *processor) markAsDone(msg *base.TaskMessage) {
-	err := p.rdb.Done(msg)
+	if p.faults.dropAck() {
+		p.logger.warn("Fault injection: dropping acknowledgement of task id=%s", msg.ID)
+		return
+	}
+	err := p.complete(msg)
 	if err != nil {
-		errMsg := fmt.Sprintf("Could not remove task id=%s from %q", msg.ID, base.InProgressQueue)
-		logger.warn("%s; Will retry syncing", errMsg)
+		errMsg := fmt.Sprintf("Could not remove task id=%s from %q", msg.ID, "in_progress")
+		p.logger.warn("%s; Will retry syncing", errMsg)
 		p.syncRequestCh <- &syncRequest{
 			fn: func() error {
-				return p.rdb.Done(msg)
+				return p.complete(msg)
 			},
 			errMsg: errMsg,
 		}
@@ -240,15 +1041,37 @@ func (p *processor) markAsDone(msg *base.TaskMessage) {
 }
 
 func (p *processor) retry(msg *base.TaskMessage, e error) {
-	d := p.retryDelayFunc(msg.Retried, e, NewTask(msg.Type, msg.Payload))
-	retryAt := time.Now().Add(d)
-	err := p.rdb.Retry(msg, retryAt, e.Error())
+	payload, err := messagePayload(msg, p.codec, p.encryption)
 	if err != nil {
-		errMsg := fmt.Sprintf("Could not move task id=%s from %q to %q", msg.ID, base.InProgressQueue, base.RetryQueue)
-		logger.warn("%s; Will retry syncing", errMsg)
+		payload = Payload{data: msg.Payload, raw: msg.Data}
+	}
+	d := p.retryDelayFunc(msg.Retried, e, &Task{Type: msg.Type, Payload: payload, Headers: copyHeaders(msg.Headers)})
+	retryAt := now(p.clock).Add(d)
+	qname := p.slowRetry.queue(msg.Queue, msg.Retried)
+	if qname != msg.Queue {
+		p.logger.info("Moving task id=%s to queue %q after %d retries", msg.ID, qname, msg.Retried+1)
+	}
+	err = p.rdb.RetryInQueue(msg, qname, retryAt, e.Error())
+	if err != nil {
+		errMsg := fmt.Sprintf("Could not move task id=%s from %q to %q", msg.ID, "in_progress", "retry")
+		p.logger.warn("%s; Will retry syncing", errMsg)
 		p.syncRequestCh <- &syncRequest{
 			fn: func() error {
-				return p.rdb.Retry(msg, retryAt, e.Error())
+				return p.rdb.RetryInQueue(msg, qname, retryAt, e.Error())
+			},
+			errMsg: errMsg,
+		}
+	}
+}
+
+func (p *processor) postpone(msg *base.TaskMessage, processAt time.Time) {
+	err := p.rdb.Postpone(msg, processAt)
+	if err != nil {
+		errMsg := fmt.Sprintf("Could not move task id=%s from %q to %q", msg.ID, "in_progress", "retry")
+		p.logger.warn("%s; Will retry syncing", errMsg)
+		p.syncRequestCh <- &syncRequest{
+			fn: func() error {
+				return p.rdb.Postpone(msg, processAt)
 			},
 			errMsg: errMsg,
 		}
@@ -256,20 +1079,75 @@ func (p *processor) retry(msg *base.TaskMessage, e error) {
 }
 
 func (p *processor) kill(msg *base.TaskMessage, e error) {
-	logger.warn("Retry exhausted for task id=%s", msg.ID)
-	err := p.rdb.Kill(msg, e.Error())
+	switch {
+	case e == errInvalidSignature, isContentError(e):
+		p.logger.error("Rejecting task id=%s type=%s in queue %q: %v", msg.ID, msg.Type, msg.Queue, e)
+	case isPoisonPill(e):
+		p.logger.error("Killing task id=%s type=%s in queue %q: %v", msg.ID, msg.Type, msg.Queue, e)
+	case isFatalPanic(e):
+		p.logger.error("Killing task id=%s type=%s after its handler panicked: %v", msg.ID, msg.Type, e)
+	case p.ackedEarly(msg):
+		p.logger.warn("Task id=%s to be processed at most once failed", msg.ID)
+	default:
+		p.logger.warn("Retry exhausted for task id=%s", msg.ID)
+	}
+	err := p.bury(msg, e)
 	if err != nil {
-		errMsg := fmt.Sprintf("Could not move task id=%s from %q to %q", msg.ID, base.InProgressQueue, base.DeadQueue)
-		logger.warn("%s; Will retry syncing", errMsg)
+		errMsg := fmt.Sprintf("Could not move task id=%s from %q to %q", msg.ID, "in_progress", "dead")
+		p.logger.warn("%s; Will retry syncing", errMsg)
 		p.syncRequestCh <- &syncRequest{
 			fn: func() error {
-				return p.rdb.Kill(msg, e.Error())
+				return p.bury(msg, e)
 			},
 			errMsg: errMsg,
 		}
 	}
 }
 
+// bury moves the task to the dead queue, failing its workflow step first,
+// and calls onDead in a new goroutine once the task is moved.
+func (p *processor) bury(msg *base.TaskMessage, e error) error {
+	if err := p.failStep(msg); err != nil {
+		return err
+	}
+	if err := p.rdb.Kill(msg, e.Error()); err != nil {
+		return err
+	}
+	if p.onDead != nil {
+		t := now(p.clock)
+		info := newTaskInfo(base.RecordError(msg, e.Error(), t), "dead", 0)
+		info.Key = "" // the score of the task in the dead queue is not known.
+		info.NextProcessAt = t
+		go p.callOnDead(info, e)
+	}
+	return nil
+}
+
+// callOnDead calls onDead, recovering from a panic so that the hook
+// doesn't crash the background.
+func (p *processor) callOnDead(info *TaskInfo, e error) {
+	defer func() {
+		if x := recover(); x != nil {
+			p.logger.error("OnDead panicked for task id=%s: %v", info.ID, x)
+		}
+	}()
+	p.onDead(info, e)
+}
+
+// verified reports whether the signature of the task is valid, and
+// kills the task otherwise. Canary tasks are enqueued by the backgrounds,
+// and are not signed.
+func (p *processor) verified(msg *base.TaskMessage) bool {
+	if isCanary(msg) {
+		return true
+	}
+	if err := p.signing.verify(msg); err != nil {
+		p.kill(msg, err)
+		return false
+	}
+	return true
+}
+
 // queues returns a list of queues to query.
 // Order of the queue names is based on the priority of each queue.
 // Queue names is sorted by their priority level if strict-priority is true.
@@ -297,18 +1175,93 @@ func (p *processor) queues() []string {
 	return uniq(names, len(p.queueConfig))
 }
 
+// blockingQueue returns the name of the queue to block on when all queues are empty.
+//
+// Queues are rotated so that an empty high priority queue doesn't keep
+// the processor from picking up tasks arriving in other queues promptly.
+// If strict-priority is false, the first of the randomized queue names is
+// used, so that the queues are rotated in proportion to their priority levels.
+func (p *processor) blockingQueue(qnames []string) string {
+	if !p.strictPriority {
+		return qnames[0]
+	}
+	p.blockRotation = (p.blockRotation + 1) % len(qnames)
+	return qnames[p.blockRotation]
+}
+
+// transform returns a task to pass to the handler after applying all
+// payload transformers to the message's payload, and the type alias
+// to the message's type.
+func (p *processor) transform(msg *base.TaskMessage) (*Task, error) {
+	typename := msg.Type
+	if alias, ok := p.typeAliases[typename]; ok {
+		typename = alias
+	}
+	payload, err := messagePayload(msg, p.codec, p.encryption)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.transformers) == 0 || payload.raw != nil {
+		return &Task{Type: typename, Payload: payload, Headers: copyHeaders(msg.Headers)}, nil
+	}
+	data := payload.data
+	if msg.Data == nil {
+		// Copy payload to avoid mutating the message, which needs to be
+		// kept as is to update the task state in redis.
+		data = make(map[string]interface{}, len(msg.Payload))
+		for k, v := range msg.Payload {
+			data[k] = v
+		}
+	}
+	for _, fn := range p.transformers {
+		data, err = fn(msg.Type, data)
+		if err != nil {
+			return nil, fmt.Errorf("payload transformation failed: %v", err)
+		}
+	}
+	task := NewTask(typename, data)
+	task.Headers = copyHeaders(msg.Headers)
+	return task, nil
+}
+
 // perform calls the handler with the given task.
 // If the call returns without panic, it simply returns the value,
 // otherwise, it recovers from panic and returns an error.
 func perform(ctx context.Context, task *Task, h Handler) (err error) {
 	defer func() {
 		if x := recover(); x != nil {
-			err = fmt.Errorf("panic: %v", x)
+			err = newPanicError(x)
 		}
 	}()
 	return h.ProcessTask(ctx, task)
 }
 
+// performBulk calls the batch handler with the given tasks, and returns
+// an error for each task.
+// If the call panics or returns the wrong number of errors, the same
+// error is returned for all tasks.
+func performBulk(ctx context.Context, tasks []*Task, h BulkHandler) (errs []error) {
+	defer func() {
+		if x := recover(); x != nil {
+			errs = repeatError(newPanicError(x), len(tasks))
+		}
+	}()
+	errs = h.ProcessTasks(ctx, tasks)
+	if len(errs) != len(tasks) {
+		err := fmt.Errorf("batch handler returned %d errors for %d tasks", len(errs), len(tasks))
+		return repeatError(err, len(tasks))
+	}
+	return errs
+}
+
+func repeatError(err error, n int) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
 // uniq dedupes elements and returns a slice of unique names of length l.
 // Order of the output slice is based on the input list.
 func uniq(names []string, l int) []string {
@@ -384,15 +1337,78 @@ func gcd(xs ...int) int {
 	return res
 }
 
-// createContext returns a context and cancel function for a given task message.
-func createContext(msg *base.TaskMessage) (context.Context, context.CancelFunc) {
-	timeout, err := time.ParseDuration(msg.Timeout)
-	if err != nil {
-		logger.error("cannot parse timeout duration for %+v", msg)
-		return context.WithCancel(context.Background())
+// createContext returns a context derived from parent and cancel function
+// for a given task message. The context times out with defaultTimeout if the
+// message has no timeout, and is canceled at the deadline of the message.
+func createContext(parent context.Context, msg *base.TaskMessage, defaultTimeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx := withTaskMetadata(parent, msg)
+	if msg.Deadline != 0 {
+		ctx, cancel := context.WithDeadline(ctx, time.Unix(0, msg.Deadline))
+		ctx, cancelTimeout := withTimeout(ctx, msg, defaultTimeout)
+		return ctx, func() {
+			cancelTimeout()
+			cancel()
+		}
 	}
+	return withTimeout(ctx, msg, defaultTimeout)
+}
+
+// withTimeout returns a copy of ctx which times out with the timeout of
+// the message, or defaultTimeout if the message has no timeout or its
+// timeout cannot be parsed.
+func withTimeout(ctx context.Context, msg *base.TaskMessage, defaultTimeout time.Duration) (context.Context, context.CancelFunc) {
+	timeout, _ := time.ParseDuration(msg.Timeout)
 	if timeout == 0 {
-		return context.WithCancel(context.Background())
+		timeout = defaultTimeout
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// createBulkContext returns a context derived from parent and cancel function
+// for a batch of task messages, which times out with the shortest timeout of
+// the messages, defaultTimeout for the messages without a timeout, or at the
+// earliest deadline of the messages.
+func createBulkContext(parent context.Context, msgs []*base.TaskMessage, defaultTimeout time.Duration) (context.Context, context.CancelFunc) {
+	var shortest time.Duration
+	var earliest int64
+	for _, msg := range msgs {
+		if msg.Deadline != 0 && (earliest == 0 || msg.Deadline < earliest) {
+			earliest = msg.Deadline
+		}
+		timeout, err := time.ParseDuration(msg.Timeout)
+		if err != nil {
+			continue
+		}
+		if timeout == 0 {
+			timeout = defaultTimeout
+		}
+		if timeout > 0 && (shortest == 0 || timeout < shortest) {
+			shortest = timeout
+		}
+	}
+	if earliest != 0 {
+		deadline := time.Unix(0, earliest)
+		if shortest == 0 || deadline.Before(time.Now().Add(shortest)) {
+			return context.WithDeadline(parent, deadline)
+		}
+	}
+	if shortest == 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, shortest)
+}
+
+// newBaseContext returns the context the contexts of the tasks are derived from.
+func (p *processor) newBaseContext() context.Context {
+	if p.baseContext == nil {
+		return context.Background()
+	}
+	ctx := p.baseContext()
+	if ctx == nil {
+		panic("asynq: BaseContext returned a nil context")
 	}
-	return context.WithTimeout(context.Background(), timeout)
+	return ctx
 }
@@ -6,6 +6,7 @@ package asynq
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sort"
 	"sync"
@@ -69,7 +70,15 @@ func TestProcessorSuccess(t *testing.T) {
 		workerCh := make(chan int)
 		go fakeHeartbeater(workerCh)
 		cancelations := base.NewCancelations()
-		p := newProcessor(rdbClient, defaultQueueConfig, false, 10, defaultDelayFunc, nil, workerCh, cancelations)
+		p := newProcessor(processorParams{
+			logger:         testLogger,
+			rdb:            rdbClient,
+			queues:         defaultQueueConfig,
+			concurrency:    10,
+			retryDelayFunc: defaultDelayFunc,
+			workerCh:       workerCh,
+			cancelations:   cancelations,
+		})
 		p.handler = HandlerFunc(handler)
 
 		var wg sync.WaitGroup
@@ -109,14 +118,18 @@ func TestProcessorRetry(t *testing.T) {
 	// r* is m* after retry
 	r1 := *m1
 	r1.ErrorMsg = errMsg
+	r1.ErrorHistory = []*base.TaskError{{Msg: errMsg}}
 	r2 := *m2
 	r2.ErrorMsg = errMsg
+	r2.ErrorHistory = []*base.TaskError{{Msg: errMsg}}
 	r2.Retried = m2.Retried + 1
 	r3 := *m3
 	r3.ErrorMsg = errMsg
+	r3.ErrorHistory = []*base.TaskError{{Msg: errMsg}}
 	r3.Retried = m3.Retried + 1
 	r4 := *m4
 	r4.ErrorMsg = errMsg
+	r4.ErrorHistory = []*base.TaskError{{Msg: errMsg}}
 	r4.Retried = m4.Retried + 1
 
 	now := time.Now()
@@ -157,7 +170,15 @@ func TestProcessorRetry(t *testing.T) {
 		workerCh := make(chan int)
 		go fakeHeartbeater(workerCh)
 		cancelations := base.NewCancelations()
-		p := newProcessor(rdbClient, defaultQueueConfig, false, 10, delayFunc, nil, workerCh, cancelations)
+		p := newProcessor(processorParams{
+			logger:         testLogger,
+			rdb:            rdbClient,
+			queues:         defaultQueueConfig,
+			concurrency:    10,
+			retryDelayFunc: delayFunc,
+			workerCh:       workerCh,
+			cancelations:   cancelations,
+		})
 		p.handler = HandlerFunc(handler)
 
 		var wg sync.WaitGroup
@@ -175,12 +196,12 @@ func TestProcessorRetry(t *testing.T) {
 
 		cmpOpt := cmpopts.EquateApprox(0, float64(time.Second)) // allow up to second difference in zset score
 		gotRetry := h.GetRetryEntries(t, r)
-		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortZSetEntryOpt, cmpOpt); diff != "" {
+		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortZSetEntryOpt, cmpOpt, h.IgnoreErrorTimeOpt); diff != "" {
 			t.Errorf("mismatch found in %q after running processor; (-want, +got)\n%s", base.RetryQueue, diff)
 		}
 
 		gotDead := h.GetDeadMessages(t, r)
-		if diff := cmp.Diff(tc.wantDead, gotDead, h.SortMsgOpt); diff != "" {
+		if diff := cmp.Diff(tc.wantDead, gotDead, h.SortMsgOpt, h.IgnoreErrorTimeOpt); diff != "" {
 			t.Errorf("mismatch found in %q after running processor; (-want, +got)\n%s", base.DeadQueue, diff)
 		}
 
@@ -219,7 +240,13 @@ func TestProcessorQueues(t *testing.T) {
 
 	for _, tc := range tests {
 		cancelations := base.NewCancelations()
-		p := newProcessor(nil, tc.queueCfg, false, 10, defaultDelayFunc, nil, nil, cancelations)
+		p := newProcessor(processorParams{
+			logger:         testLogger,
+			queues:         tc.queueCfg,
+			concurrency:    10,
+			retryDelayFunc: defaultDelayFunc,
+			cancelations:   cancelations,
+		})
 		got := p.queues()
 		if diff := cmp.Diff(tc.want, got, sortOpt); diff != "" {
 			t.Errorf("with queue config: %v\n(*processor).queues() = %v, want %v\n(-want,+got):\n%s",
@@ -228,6 +255,29 @@ func TestProcessorQueues(t *testing.T) {
 	}
 }
 
+func TestProcessorBlockingQueueWithStrictPriority(t *testing.T) {
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		queues:         map[string]int{"high": 6, "default": 3, "low": 1},
+		strictPriority: true,
+		concurrency:    10,
+		retryDelayFunc: defaultDelayFunc,
+		cancelations:   base.NewCancelations(),
+	})
+	qnames := p.queues()
+
+	// every queue should be blocked on in turn.
+	seen := make(map[string]int)
+	for i := 0; i < 2*len(qnames); i++ {
+		seen[p.blockingQueue(qnames)]++
+	}
+	want := map[string]int{"high": 2, "default": 2, "low": 2}
+	if diff := cmp.Diff(want, seen); diff != "" {
+		t.Errorf("(*processor).blockingQueue(%v) returned queues %v, want %v; (-want,+got)\n%s",
+			qnames, seen, want, diff)
+	}
+}
+
 func TestProcessorWithStrictPriority(t *testing.T) {
 	r := setup(t)
 	rdbClient := rdb.NewRDB(r)
@@ -288,8 +338,16 @@ func TestProcessorWithStrictPriority(t *testing.T) {
 		workerCh := make(chan int)
 		go fakeHeartbeater(workerCh)
 		cancelations := base.NewCancelations()
-		p := newProcessor(rdbClient, queueCfg, true /* strict */, 1, /* concurrency */
-			defaultDelayFunc, nil, workerCh, cancelations)
+		p := newProcessor(processorParams{
+			logger:         testLogger,
+			rdb:            rdbClient,
+			queues:         queueCfg,
+			strictPriority: true,
+			concurrency:    1,
+			retryDelayFunc: defaultDelayFunc,
+			workerCh:       workerCh,
+			cancelations:   cancelations,
+		})
 		p.handler = HandlerFunc(handler)
 
 		var wg sync.WaitGroup
@@ -359,3 +417,604 @@ func fakeHeartbeater(ch <-chan int) {
 	for range ch {
 	}
 }
+
+func TestProcessorTransform(t *testing.T) {
+	rename := func(typename string, payload map[string]interface{}) (map[string]interface{}, error) {
+		if v, ok := payload["uid"]; ok {
+			payload["user_id"] = v
+			delete(payload, "uid")
+		}
+		return payload, nil
+	}
+	addVersion := func(typename string, payload map[string]interface{}) (map[string]interface{}, error) {
+		payload["version"] = 2
+		return payload, nil
+	}
+	failing := func(typename string, payload map[string]interface{}) (map[string]interface{}, error) {
+		return nil, fmt.Errorf("could not decrypt")
+	}
+
+	tests := []struct {
+		transformers []PayloadTransformer
+		payload      map[string]interface{}
+		want         *Task
+		wantErr      bool
+	}{
+		{
+			transformers: nil,
+			payload:      map[string]interface{}{"uid": 42},
+			want:         NewTask("send_email", map[string]interface{}{"uid": 42}),
+		},
+		{
+			transformers: []PayloadTransformer{rename, addVersion},
+			payload:      map[string]interface{}{"uid": 42},
+			want:         NewTask("send_email", map[string]interface{}{"user_id": 42, "version": 2}),
+		},
+		{
+			transformers: []PayloadTransformer{rename, failing},
+			payload:      map[string]interface{}{"uid": 42},
+			wantErr:      true,
+		},
+	}
+
+	for _, tc := range tests {
+		p := newProcessor(processorParams{
+			logger:         testLogger,
+			queues:         defaultQueueConfig,
+			concurrency:    10,
+			retryDelayFunc: defaultDelayFunc,
+			cancelations:   base.NewCancelations(),
+			transformers:   tc.transformers,
+		})
+		msg := h.NewTaskMessage("send_email", tc.payload)
+		got, err := p.transform(msg)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("(*processor).transform(%+v) returned nil error, want non-nil error", msg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("(*processor).transform(%+v) returned error: %v", msg, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(Payload{})); diff != "" {
+			t.Errorf("(*processor).transform(%+v) = %+v, want %+v; (-want,+got)\n%s", msg, got, tc.want, diff)
+		}
+		if diff := cmp.Diff(map[string]interface{}{"uid": 42}, msg.Payload); diff != "" {
+			t.Errorf("(*processor).transform mutated the message payload; (-want,+got)\n%s", diff)
+		}
+	}
+}
+
+func TestProcessorTransformTypeAlias(t *testing.T) {
+	var typenames []string
+	record := func(typename string, payload map[string]interface{}) (map[string]interface{}, error) {
+		typenames = append(typenames, typename)
+		return payload, nil
+	}
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		queues:         defaultQueueConfig,
+		concurrency:    10,
+		retryDelayFunc: defaultDelayFunc,
+		cancelations:   base.NewCancelations(),
+		transformers:   []PayloadTransformer{record},
+		typeAliases:    map[string]string{"send_email": "email:send"},
+	})
+
+	for _, typename := range []string{"send_email", "email:send", "reindex"} {
+		msg := h.NewTaskMessage(typename, nil)
+		got, err := p.transform(msg)
+		if err != nil {
+			t.Fatalf("(*processor).transform(%+v) returned error: %v", msg, err)
+		}
+		want := typename
+		if typename == "send_email" {
+			want = "email:send"
+		}
+		if got.Type != want {
+			t.Errorf("(*processor).transform(%+v).Type = %q, want %q", msg, got.Type, want)
+		}
+	}
+	// transformers should be called with the type the task was enqueued with.
+	want := []string{"send_email", "email:send", "reindex"}
+	if diff := cmp.Diff(want, typenames); diff != "" {
+		t.Errorf("transformers called with %v, want %v; (-want,+got)\n%s", typenames, want, diff)
+	}
+}
+
+func TestProcessorDropAck(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+	m1 := h.NewTaskMessage("send_email", nil)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+
+	var mu sync.Mutex
+	var processed []*Task
+	handler := func(ctx context.Context, task *Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, task)
+		return nil
+	}
+	workerCh := make(chan int)
+	go fakeHeartbeater(workerCh)
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            rdbClient,
+		queues:         defaultQueueConfig,
+		concurrency:    1,
+		retryDelayFunc: defaultDelayFunc,
+		workerCh:       workerCh,
+		cancelations:   base.NewCancelations(),
+		faults:         newFaultInjector(&FaultInjection{DropAckRate: 1}),
+	})
+	p.handler = HandlerFunc(handler)
+
+	var wg sync.WaitGroup
+	p.start(&wg)
+	time.Sleep(time.Second)
+	mu.Lock()
+	gotProcessed := len(processed)
+	mu.Unlock()
+	if gotProcessed != 1 {
+		t.Errorf("processed %d tasks, want 1", gotProcessed)
+	}
+	// un-acknowledged task stays in in-progress until the processor restores it.
+	if l := r.LLen(base.InProgressQueue).Val(); l != 1 {
+		t.Errorf("%q has %d tasks, want 1", base.InProgressQueue, l)
+	}
+	p.terminate()
+	close(workerCh)
+
+	if diff := cmp.Diff([]*base.TaskMessage{m1}, h.GetEnqueuedMessages(t, r)); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.DefaultQueue, diff)
+	}
+}
+
+func TestProcessorRefreshQueueWeights(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            rdbClient,
+		queues:         map[string]int{"critical": 6, "default": 3, "low": 1},
+		concurrency:    10,
+		retryDelayFunc: defaultDelayFunc,
+		cancelations:   base.NewCancelations(),
+	})
+	p.seedQueueWeights()
+
+	// weights of queues not processed by the processor should be ignored.
+	for qname, w := range map[string]int{"critical": 0, "default": 4, "unknown": 5} {
+		if err := rdbClient.SetQueueWeight(qname, w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.refreshQueueWeights()
+
+	want := map[string]int{"default": 4, "low": 1}
+	if diff := cmp.Diff(want, p.queueConfig); diff != "" {
+		t.Errorf("queueConfig = %v, want %v; (-want,+got)\n%s", p.queueConfig, want, diff)
+	}
+}
+
+func TestProcessorBulkHandler(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessage("insert_row", map[string]interface{}{"id": 1})
+	m2 := h.NewTaskMessage("insert_row", map[string]interface{}{"id": 2})
+	m3 := h.NewTaskMessage("insert_row", map[string]interface{}{"id": 3})
+	m4 := h.NewTaskMessage("insert_row", map[string]interface{}{"id": 4})
+	m5 := h.NewTaskMessage("insert_row", map[string]interface{}{"id": 5})
+
+	errMsg := "duplicate key"
+	// r3 is m3 after retry
+	r3 := *m3
+	r3.ErrorMsg = errMsg
+	r3.ErrorHistory = []*base.TaskError{{Msg: errMsg}}
+	r3.Retried = m3.Retried + 1
+
+	h.FlushDB(t, r)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1, m2, m3, m4, m5})
+
+	var mu sync.Mutex
+	var batchSizes []int
+	handler := func(ctx context.Context, tasks []*Task) []error {
+		mu.Lock()
+		defer mu.Unlock()
+		batchSizes = append(batchSizes, len(tasks))
+		errs := make([]error, len(tasks))
+		for i, task := range tasks {
+			if id, _ := task.Payload.GetInt("id"); id == 3 {
+				errs[i] = fmt.Errorf(errMsg)
+			}
+		}
+		return errs
+	}
+	workerCh := make(chan int)
+	go fakeHeartbeater(workerCh)
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            rdbClient,
+		queues:         defaultQueueConfig,
+		concurrency:    10,
+		retryDelayFunc: func(n int, e error, t *Task) time.Duration { return time.Minute },
+		workerCh:       workerCh,
+		cancelations:   base.NewCancelations(),
+		bulkSize:       3,
+	})
+	p.handler = BulkHandlerFunc(handler)
+
+	var wg sync.WaitGroup
+	p.start(&wg)
+	time.Sleep(3 * time.Second)
+	p.terminate()
+	close(workerCh)
+
+	if diff := cmp.Diff([]int{3, 2}, batchSizes); diff != "" {
+		t.Errorf("handler was called with batches of sizes %v, want %v; (-want, +got)\n%s", batchSizes, []int{3, 2}, diff)
+	}
+	cmpOpt := cmpopts.EquateApprox(0, float64(time.Second)) // allow up to second difference in zset score
+	wantRetry := []h.ZSetEntry{{Msg: &r3, Score: float64(time.Now().Add(time.Minute).Unix())}}
+	gotRetry := h.GetRetryEntries(t, r)
+	if diff := cmp.Diff(wantRetry, gotRetry, h.SortZSetEntryOpt, cmpOpt, h.IgnoreErrorTimeOpt); diff != "" {
+		t.Errorf("mismatch found in %q after running processor; (-want, +got)\n%s", base.RetryQueue, diff)
+	}
+	if l := r.LLen(base.InProgressQueue).Val(); l != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.InProgressQueue, l)
+	}
+}
+
+func TestPerformBulk(t *testing.T) {
+	tasks := []*Task{
+		NewTask("insert_row", map[string]interface{}{"id": 1}),
+		NewTask("insert_row", map[string]interface{}{"id": 2}),
+	}
+	errFailed := fmt.Errorf("something went wrong")
+	tests := []struct {
+		desc    string
+		handler BulkHandlerFunc
+		wantErr []bool
+	}{
+		{
+			desc: "handler returns an error for each task",
+			handler: func(ctx context.Context, tasks []*Task) []error {
+				return []error{nil, errFailed}
+			},
+			wantErr: []bool{false, true},
+		},
+		{
+			desc: "handler returns wrong number of errors",
+			handler: func(ctx context.Context, tasks []*Task) []error {
+				return nil
+			},
+			wantErr: []bool{true, true},
+		},
+		{
+			desc: "handler panics",
+			handler: func(ctx context.Context, tasks []*Task) []error {
+				panic("something went terribly wrong")
+			},
+			wantErr: []bool{true, true},
+		},
+	}
+
+	for _, tc := range tests {
+		got := performBulk(context.Background(), tasks, tc.handler)
+		if len(got) != len(tasks) {
+			t.Errorf("%s: performBulk() returned %d errors, want %d", tc.desc, len(got), len(tasks))
+			continue
+		}
+		for i, err := range got {
+			if tc.wantErr[i] != (err != nil) {
+				t.Errorf("%s: performBulk()[%d] = %v, want error: %t", tc.desc, i, err, tc.wantErr[i])
+			}
+		}
+	}
+}
+
+func TestCreateBulkContext(t *testing.T) {
+	m1 := h.NewTaskMessage("insert_row", nil)
+	m1.Timeout = "30m"
+	m2 := h.NewTaskMessage("insert_row", nil)
+	m2.Timeout = "1m"
+	m3 := h.NewTaskMessage("insert_row", nil)
+	m3.Timeout = "0s"
+
+	ctx, cancel := createBulkContext(context.Background(), []*base.TaskMessage{m1, m2, m3}, 0)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		t.Fatalf("context has no deadline, want deadline in a minute")
+	}
+	if d := time.Until(deadline); d > time.Minute || d < 59*time.Second {
+		t.Errorf("context times out in %v, want a minute", d)
+	}
+
+	ctx, cancel = createBulkContext(context.Background(), []*base.TaskMessage{m3}, 0)
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("context of tasks without timeout has a deadline")
+	}
+
+	ctx, cancel = createBulkContext(context.Background(), []*base.TaskMessage{m1, m3}, 10*time.Minute)
+	defer cancel()
+	deadline, ok = ctx.Deadline()
+	if !ok {
+		t.Fatalf("context has no deadline, want deadline in the default timeout")
+	}
+	if d := time.Until(deadline); d > 10*time.Minute || d < 599*time.Second {
+		t.Errorf("context times out in %v, want the default timeout of 10m", d)
+	}
+}
+
+func TestCreateContextDefaultTimeout(t *testing.T) {
+	m1 := h.NewTaskMessage("send_email", nil)
+	m1.Timeout = "1m"
+	m2 := h.NewTaskMessage("send_email", nil)
+	m2.Timeout = "0s"
+
+	tests := []struct {
+		msg            *base.TaskMessage
+		defaultTimeout time.Duration
+		want           time.Duration // zero for no deadline
+	}{
+		{m1, 0, time.Minute},
+		{m1, time.Hour, time.Minute},
+		{m2, 0, 0},
+		{m2, time.Hour, time.Hour},
+	}
+	for _, tc := range tests {
+		ctx, cancel := createContext(context.Background(), tc.msg, tc.defaultTimeout)
+		deadline, ok := ctx.Deadline()
+		cancel()
+		if ok != (tc.want > 0) {
+			t.Errorf("createContext(timeout=%q, %v) has deadline: %t, want %t", tc.msg.Timeout, tc.defaultTimeout, ok, tc.want > 0)
+			continue
+		}
+		if d := time.Until(deadline); ok && (d > tc.want || d < tc.want-time.Second) {
+			t.Errorf("createContext(timeout=%q, %v) times out in %v, want %v", tc.msg.Timeout, tc.defaultTimeout, d, tc.want)
+		}
+	}
+}
+
+func TestDefaultTimeoutOverridesZeroTimeout(t *testing.T) {
+	msg := newTaskMessage(NewTask("send_email", nil), Timeout(0))
+
+	ctx, cancel := createContext(context.Background(), msg, time.Hour)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		t.Fatalf("context of task with Timeout(0) has no deadline, want the default timeout")
+	}
+	if d := time.Until(deadline); d > time.Hour || d < time.Hour-time.Second {
+		t.Errorf("context of task with Timeout(0) times out in %v, want the default timeout of 1h", d)
+	}
+}
+
+// killSwitchBroker returns ks from KillSwitch.
+// Calling other methods panics.
+type killSwitchBroker struct {
+	base.Broker
+	ks *base.KillSwitch
+}
+
+func (b *killSwitchBroker) KillSwitch() (*base.KillSwitch, error) {
+	return b.ks, nil
+}
+
+func TestProcessorKillSwitch(t *testing.T) {
+	b := &killSwitchBroker{}
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            b,
+		queues:         defaultQueueConfig,
+		concurrency:    10,
+		retryDelayFunc: defaultDelayFunc,
+		cancelations:   base.NewCancelations(),
+	})
+
+	if p.killSwitchEngaged() {
+		t.Errorf("killSwitchEngaged() = true before engaging the kill switch")
+	}
+
+	b.ks = &base.KillSwitch{Reason: "bad deploy", Expires: time.Now().Add(time.Hour)}
+	if p.killSwitchEngaged() {
+		t.Errorf("killSwitchEngaged() = true before the next check of the kill switch")
+	}
+	p.killSwitchCheckedAt = time.Time{} // force the next check.
+	if !p.killSwitchEngaged() {
+		t.Errorf("killSwitchEngaged() = false after engaging the kill switch")
+	}
+
+	b.ks = nil // kill switch expired.
+	p.killSwitchCheckedAt = time.Time{}
+	if p.killSwitchEngaged() {
+		t.Errorf("killSwitchEngaged() = true after the kill switch expired")
+	}
+}
+
+// batchDequeueBroker pops the tasks of msgs with DequeueN.
+type batchDequeueBroker struct {
+	earlyAckBroker
+
+	msgs []*base.TaskMessage
+	ns   []int // n of the calls to DequeueN
+}
+
+func (b *batchDequeueBroker) KillSwitch() (*base.KillSwitch, error) { return nil, nil }
+
+func (b *batchDequeueBroker) QueueWeights() (map[string]int, error) { return nil, nil }
+
+func (b *batchDequeueBroker) Dequeue(qnames ...string) (*base.TaskMessage, error) {
+	b.record("dequeue")
+	return nil, base.ErrNoProcessableTask
+}
+
+func (b *batchDequeueBroker) DequeueN(n int, qnames ...string) ([]*base.TaskMessage, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ns = append(b.ns, n)
+	if len(b.msgs) == 0 {
+		return nil, base.ErrNoProcessableTask
+	}
+	if n > len(b.msgs) {
+		n = len(b.msgs)
+	}
+	res := b.msgs[:n]
+	b.msgs = b.msgs[n:]
+	return res, nil
+}
+
+func TestProcessorDequeueBatch(t *testing.T) {
+	b := &batchDequeueBroker{}
+	for i := 0; i < 5; i++ {
+		b.msgs = append(b.msgs, h.NewTaskMessage("send_email", nil))
+	}
+	workerCh := make(chan int)
+	go fakeHeartbeater(workerCh)
+	defer close(workerCh)
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            b,
+		queues:         defaultQueueConfig,
+		concurrency:    3,
+		retryDelayFunc: defaultDelayFunc,
+		workerCh:       workerCh,
+		cancelations:   base.NewCancelations(),
+		dequeueBatch:   10,
+	})
+	release := make(chan struct{})
+	p.handler = HandlerFunc(func(ctx context.Context, task *Task) error {
+		<-release
+		return nil
+	})
+
+	p.exec() // pops a batch of as many tasks as there are workers.
+	p.exec() // all workers are busy, so tasks are popped one by one.
+	if n := p.dequeueBatchSize(); n != 1 {
+		t.Errorf("dequeueBatchSize() = %d with all workers busy, want 1", n)
+	}
+	close(release)
+	// wait for the workers to finish.
+	for i := 0; i < cap(p.sema); i++ {
+		p.sema <- struct{}{}
+	}
+	for i := 0; i < cap(p.sema); i++ {
+		<-p.sema
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if diff := cmp.Diff([]int{3}, b.ns); diff != "" {
+		t.Errorf("DequeueN called with %v; (-want,+got)\n%s", b.ns, diff)
+	}
+	if len(b.msgs) != 2 {
+		t.Errorf("%d tasks left in the queue, want 2", len(b.msgs))
+	}
+	if diff := cmp.Diff([]string{"dequeue", "done", "done", "done"}, b.events); diff != "" {
+		t.Errorf("broker received %v; (-want,+got)\n%s", b.events, diff)
+	}
+}
+
+// killBroker records the messages of the tasks killed.
+type killBroker struct {
+	base.Broker
+
+	mu     sync.Mutex
+	killed []*base.TaskMessage
+}
+
+func (b *killBroker) Kill(msg *base.TaskMessage, errMsg string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.killed = append(b.killed, base.RecordError(msg, errMsg, time.Now()))
+	return nil
+}
+
+func TestProcessorOnDead(t *testing.T) {
+	b := &killBroker{}
+	workerCh := make(chan int)
+	go fakeHeartbeater(workerCh)
+	defer close(workerCh)
+	type dead struct {
+		info *TaskInfo
+		err  error
+	}
+	deadCh := make(chan dead, 1)
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            b,
+		queues:         defaultQueueConfig,
+		concurrency:    1,
+		retryDelayFunc: defaultDelayFunc,
+		workerCh:       workerCh,
+		cancelations:   base.NewCancelations(),
+		onDead: func(info *TaskInfo, err error) {
+			deadCh <- dead{info, err}
+		},
+	})
+	errDeclined := errors.New("card declined")
+	p.handler = HandlerFunc(func(ctx context.Context, task *Task) error {
+		return errDeclined
+	})
+
+	msg := h.NewTaskMessage("charge_card", map[string]interface{}{"amount": 100})
+	msg.Retry, msg.Retried = 3, 3
+	msg.ErrorHistory = []*base.TaskError{{Msg: "gateway timed out", Time: time.Now()}}
+	p.dispatch(msg)
+
+	select {
+	case d := <-deadCh:
+		if d.err != errDeclined {
+			t.Errorf("OnDead called with error %v, want %v", d.err, errDeclined)
+		}
+		if d.info.ID != msg.ID.String() || d.info.State != "dead" || d.info.ErrorMsg != errDeclined.Error() {
+			t.Errorf("OnDead called with task id=%s state=%q error=%q, want id=%s state=%q error=%q",
+				d.info.ID, d.info.State, d.info.ErrorMsg, msg.ID, "dead", errDeclined.Error())
+		}
+		var errs []string
+		for _, e := range d.info.ErrorHistory {
+			errs = append(errs, e.Msg)
+		}
+		if diff := cmp.Diff([]string{"gateway timed out", errDeclined.Error()}, errs); diff != "" {
+			t.Errorf("error history of the dead task mismatch; (-want,+got)\n%s", diff)
+		}
+		if amount, err := d.info.Payload.GetInt("amount"); err != nil || amount != 100 {
+			t.Errorf("amount in the payload of the dead task = %d, %v, want 100", amount, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnDead was not called")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.killed) != 1 {
+		t.Errorf("%d tasks killed, want 1", len(b.killed))
+	}
+}
+
+func TestProcessorOnDeadPanic(t *testing.T) {
+	called := false
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            &killBroker{},
+		queues:         defaultQueueConfig,
+		concurrency:    1,
+		retryDelayFunc: defaultDelayFunc,
+		cancelations:   base.NewCancelations(),
+		onDead: func(info *TaskInfo, err error) {
+			called = true
+			panic("mirror unavailable")
+		},
+	})
+
+	// The panic is recovered, so that it doesn't crash the background.
+	p.callOnDead(&TaskInfo{ID: "task1"}, errors.New("card declined"))
+	if !called {
+		t.Errorf("OnDead was not called")
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// Profiling specifies when the background captures pprof profiles of the
+// process, so that performance incidents of the workers in production can
+// be diagnosed after the fact.
+//
+// Each capture records a CPU profile for CPUDuration, followed by a heap
+// and a goroutine profile, and stores them with the Store. The names of
+// the profiles are in "<host>-<pid>-<time>-<reason>-<kind>.pprof" format,
+// where reason is "saturation" or "slowtask".
+type Profiling struct {
+	// Store stores the profiles captured.
+	//
+	// Profiling is disabled if Store is nil.
+	Store ProfileStore
+
+	// Saturation specifies how long all the workers should be busy before
+	// the profiles are captured.
+	//
+	// If zero or negative, profiles are not captured on saturation.
+	Saturation time.Duration
+
+	// SlowTask specifies how long a task should be processed before the
+	// profiles are captured.
+	//
+	// If zero or negative, profiles are not captured for slow tasks.
+	SlowTask time.Duration
+
+	// CPUDuration specifies how long to record the CPU profile.
+	//
+	// If zero or negative, 10 seconds is used.
+	CPUDuration time.Duration
+
+	// MinInterval specifies the minimum interval between captures, which
+	// bounds the overhead of profiling while the thresholds keep being
+	// breached.
+	//
+	// If zero or negative, 10 minutes is used.
+	MinInterval time.Duration
+}
+
+// ProfileStore stores the profiles captured by a background,
+// e.g. by uploading them to a blob store.
+type ProfileStore interface {
+	// StoreProfile stores the profile data with the given name.
+	StoreProfile(name string, data []byte) error
+}
+
+// ProfileDir returns a ProfileStore which writes the profiles as files
+// in the directory dir, which should exist.
+func ProfileDir(dir string) ProfileStore {
+	return profileDir(dir)
+}
+
+type profileDir string
+
+func (d profileDir) StoreProfile(name string, data []byte) error {
+	return ioutil.WriteFile(filepath.Join(string(d), name), data, 0644)
+}
+
+// profiler captures profiles when the processor is saturated or a task
+// is slow.
+//
+// A nil profiler does nothing.
+type profiler struct {
+	logger *asynqLogger
+	store  ProfileStore
+
+	// prefix of the names of the profiles, identifying the process.
+	prefix string
+
+	saturation  time.Duration
+	slowTask    time.Duration
+	cpuDuration time.Duration
+	minInterval time.Duration
+
+	// saturated reports whether all the workers are busy.
+	saturated func() bool
+
+	// interval between saturation checks.
+	interval time.Duration
+
+	// channel closed to stop the "profiler" goroutine and ongoing captures.
+	done chan struct{}
+
+	// wg waits for ongoing captures.
+	wg sync.WaitGroup
+
+	mu sync.Mutex
+
+	// time the workers became all busy, zero if some are idle.
+	saturatedSince time.Time
+
+	// time of the last capture.
+	last time.Time
+
+	// capturing is true while profiles are being captured.
+	capturing bool
+
+	// stopped is true once the profiler has been terminated.
+	stopped bool
+}
+
+func newProfiler(logger *asynqLogger, cfg *Profiling, saturated func() bool) *profiler {
+	if cfg == nil || cfg.Store == nil {
+		return nil
+	}
+	cpuDuration := cfg.CPUDuration
+	if cpuDuration <= 0 {
+		cpuDuration = 10 * time.Second
+	}
+	minInterval := cfg.MinInterval
+	if minInterval <= 0 {
+		minInterval = 10 * time.Minute
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown-host"
+	}
+	return &profiler{
+		logger:      logger,
+		store:       cfg.Store,
+		prefix:      fmt.Sprintf("%s-%d", host, os.Getpid()),
+		saturation:  cfg.Saturation,
+		slowTask:    cfg.SlowTask,
+		cpuDuration: cpuDuration,
+		minInterval: minInterval,
+		saturated:   saturated,
+		interval:    time.Second,
+		done:        make(chan struct{}),
+	}
+}
+
+func (p *profiler) terminate() {
+	if p == nil {
+		return
+	}
+	p.logger.debug("Profiler shutting down...")
+	p.mu.Lock()
+	p.stopped = true
+	p.mu.Unlock()
+	// Signal the profiler goroutine and the captures to stop.
+	close(p.done)
+	p.wg.Wait()
+}
+
+func (p *profiler) start(wg *sync.WaitGroup) {
+	if p == nil || p.saturation <= 0 {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-p.done:
+				p.logger.debug("Profiler done")
+				return
+			case <-time.After(p.interval):
+				p.checkSaturation()
+			}
+		}
+	}()
+}
+
+// checkSaturation captures the profiles if all the workers have been busy
+// for the saturation threshold.
+func (p *profiler) checkSaturation() {
+	if !p.saturated() {
+		p.mu.Lock()
+		p.saturatedSince = time.Time{}
+		p.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	p.mu.Lock()
+	if p.saturatedSince.IsZero() {
+		p.saturatedSince = now
+	}
+	since := p.saturatedSince
+	p.mu.Unlock()
+	if now.Sub(since) >= p.saturation {
+		p.trigger("saturation", fmt.Sprintf("all workers busy for %v", now.Sub(since).Round(time.Second)))
+	}
+}
+
+// watch captures the profiles if the task is still being processed after
+// the slow task threshold. The returned function should be called once
+// the task has been processed.
+func (p *profiler) watch(msg *base.TaskMessage) (stop func()) {
+	if p == nil || p.slowTask <= 0 {
+		return func() {}
+	}
+	t := time.AfterFunc(p.slowTask, func() {
+		p.trigger("slowtask", fmt.Sprintf("task id=%s type=%s running for %v", msg.ID, msg.Type, p.slowTask))
+	})
+	return func() { t.Stop() }
+}
+
+// trigger starts capturing the profiles in a new goroutine, unless
+// profiles are being captured or have been captured recently.
+func (p *profiler) trigger(reason, detail string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped || p.capturing || (!p.last.IsZero() && time.Since(p.last) < p.minInterval) {
+		return
+	}
+	p.capturing = true
+	p.last = time.Now()
+	p.logger.info("Capturing profiles: %s", detail)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.capture(reason)
+		p.mu.Lock()
+		p.capturing = false
+		p.mu.Unlock()
+	}()
+}
+
+func (p *profiler) capture(reason string) {
+	prefix := fmt.Sprintf("%s-%s-%s", p.prefix, time.Now().UTC().Format("20060102T150405Z"), reason)
+	var cpu bytes.Buffer
+	if err := pprof.StartCPUProfile(&cpu); err != nil {
+		// the CPU is already being profiled, e.g. with net/http/pprof.
+		p.logger.warn("Could not start CPU profile: %v", err)
+	} else {
+		select {
+		case <-time.After(p.cpuDuration):
+		case <-p.done:
+		}
+		pprof.StopCPUProfile()
+		p.storeProfile(prefix+"-cpu.pprof", cpu.Bytes())
+	}
+	for _, kind := range []string{"heap", "goroutine"} {
+		var buf bytes.Buffer
+		if err := pprof.Lookup(kind).WriteTo(&buf, 0); err != nil {
+			p.logger.error("Could not write %s profile: %v", kind, err)
+			continue
+		}
+		p.storeProfile(prefix+"-"+kind+".pprof", buf.Bytes())
+	}
+}
+
+func (p *profiler) storeProfile(name string, data []byte) {
+	if err := p.store.StoreProfile(name, data); err != nil {
+		p.logger.error("Could not store profile %s: %v", name, err)
+	}
+}
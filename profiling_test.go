@@ -0,0 +1,143 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	h "github.com/hibiken/asynq/internal/asynqtest"
+)
+
+// memProfileStore keeps the names of the profiles stored.
+type memProfileStore struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (s *memProfileStore) StoreProfile(name string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.names = append(s.names, name)
+	return nil
+}
+
+// kinds returns the kinds of the profiles stored with the reason.
+func (s *memProfileStore) kinds(reason string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []string
+	for _, name := range s.names {
+		name = strings.TrimSuffix(name, ".pprof")
+		if i := strings.LastIndex(name, "-"); i > 0 && strings.HasSuffix(name[:i], "-"+reason) {
+			res = append(res, name[i+1:])
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestProfilerSlowTask(t *testing.T) {
+	store := &memProfileStore{}
+	p := newProfiler(testLogger, &Profiling{Store: store, SlowTask: 10 * time.Millisecond, CPUDuration: 10 * time.Millisecond}, func() bool { return false })
+
+	// tasks finished before the threshold are not profiled.
+	stop := p.watch(h.NewTaskMessage("send_email", nil))
+	stop()
+	stop = p.watch(h.NewTaskMessage("generate_thumbnail", nil))
+	time.Sleep(50 * time.Millisecond)
+	stop()
+	p.terminate()
+
+	got := store.kinds("slowtask")
+	// CPU profile is missing if the test binary is being profiled.
+	if len(got) < 2 || got[len(got)-2] != "goroutine" || got[len(got)-1] != "heap" {
+		t.Errorf("stored profiles %v, want cpu, goroutine and heap profiles", store.names)
+	}
+}
+
+func TestProfilerSaturation(t *testing.T) {
+	store := &memProfileStore{}
+	var (
+		mu        sync.Mutex
+		saturated bool
+	)
+	p := newProfiler(testLogger, &Profiling{Store: store, Saturation: 30 * time.Millisecond, CPUDuration: 10 * time.Millisecond}, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return saturated
+	})
+	p.interval = 10 * time.Millisecond
+
+	var wg sync.WaitGroup
+	p.start(&wg)
+	time.Sleep(50 * time.Millisecond)
+	if got := store.kinds("saturation"); len(got) != 0 {
+		t.Errorf("stored profiles %v while workers are idle, want none", got)
+	}
+	mu.Lock()
+	saturated = true
+	mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	p.terminate()
+	wg.Wait()
+
+	if got := store.kinds("saturation"); len(got) < 2 {
+		t.Errorf("stored profiles %v after saturation, want heap and goroutine profiles at least", store.names)
+	}
+}
+
+func TestProfilerMinInterval(t *testing.T) {
+	store := &memProfileStore{}
+	p := newProfiler(testLogger, &Profiling{Store: store, CPUDuration: time.Millisecond}, func() bool { return false })
+
+	p.trigger("slowtask", "first")
+	p.wg.Wait()
+	n := len(store.kinds("slowtask"))
+	p.trigger("slowtask", "second")
+	p.terminate()
+
+	if got := len(store.kinds("slowtask")); got != n {
+		t.Errorf("stored %d profiles after two captures within MinInterval, want %d", got, n)
+	}
+}
+
+func TestNewProfilerDisabled(t *testing.T) {
+	saturated := func() bool { return true }
+	if p := newProfiler(testLogger, nil, saturated); p != nil {
+		t.Errorf("newProfiler(testLogger, nil) = %v, want nil", p)
+	}
+	if p := newProfiler(testLogger, &Profiling{SlowTask: time.Second}, saturated); p != nil {
+		t.Errorf("newProfiler without Store = %v, want nil", p)
+	}
+	// A nil profiler does nothing.
+	var p *profiler
+	var wg sync.WaitGroup
+	p.start(&wg)
+	p.watch(h.NewTaskMessage("send_email", nil))()
+	p.terminate()
+}
+
+func TestProfileDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "asynq-profiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ProfileDir(dir).StoreProfile("host-1-heap.pprof", []byte("profile")); err != nil {
+		t.Fatalf("StoreProfile returned error: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "host-1-heap.pprof"))
+	if err != nil || string(data) != "profile" {
+		t.Errorf("profile file contains %q (error %v), want %q", data, err, "profile")
+	}
+}
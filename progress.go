@@ -0,0 +1,86 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+)
+
+// TaskProgress is the progress of a task reported by its handler
+// with ReportProgress.
+type TaskProgress = base.TaskProgress
+
+// ErrNoProgress is returned by ReportProgress if the context doesn't
+// belong to a task processed by a background which can store its progress.
+var ErrNoProgress = errors.New("asynq: cannot report progress of the task")
+
+// ErrProgressNotFound indicates that no progress was reported for a task,
+// or the progress has expired.
+var ErrProgressNotFound = rdb.ErrProgressNotFound
+
+// progressRetention is how long the progress of a task is kept since it was
+// last reported, so that it can be read after the task is processed.
+const progressRetention = 24 * time.Hour
+
+// progressStore is implemented by brokers which store the progress of tasks.
+type progressStore interface {
+	SetProgress(id string, p *base.TaskProgress, ttl time.Duration) error
+}
+
+type progressKey struct{}
+
+// taskProgress is the handle to the progress of a task carried by the
+// context of the handler.
+type taskProgress struct {
+	store progressStore
+	id    string
+}
+
+// withProgress returns a copy of ctx which lets the handler of the task
+// report its progress with ReportProgress.
+func (p *processor) withProgress(ctx context.Context, msg *base.TaskMessage) context.Context {
+	if p.progress == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, progressKey{}, &taskProgress{store: p.progress, id: msg.ID.String()})
+}
+
+// ReportProgress stores the progress of the task being processed, which can
+// be read with Inspector.Progress (e.g. to show a progress bar to users).
+// percent is the percentage of the task done, between 0 and 100, and data
+// holds the details of the progress, which are encoded as JSON, or nil.
+//
+// Each call overwrites the progress reported before; the last progress is
+// kept for 24 hours, so long-running handlers should avoid reporting it
+// more often than needed (e.g. once per percent or per second).
+//
+// ctx should be the context passed to the handler; ReportProgress returns
+// ErrNoProgress if ctx is not a context of a task processed by a background
+// (tasks processed by BulkHandler are not supported).
+func ReportProgress(ctx context.Context, percent float64, data interface{}) error {
+	t, ok := ctx.Value(progressKey{}).(*taskProgress)
+	if !ok {
+		return ErrNoProgress
+	}
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("asynq: progress percent %v is not between 0 and 100", percent)
+	}
+	p := &base.TaskProgress{Percent: percent, Time: time.Now().UTC()}
+	if data != nil {
+		bytes, err := json.Marshal(data)
+		if err != nil {
+			return fmt.Errorf("asynq: could not encode progress: %v", err)
+		}
+		p.Data = bytes
+	}
+	return t.store.SetProgress(t.id, p, progressRetention)
+}
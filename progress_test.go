@@ -0,0 +1,89 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// progressBroker records the progress reported by the handlers.
+type progressBroker struct {
+	earlyAckBroker
+
+	progress []*base.TaskProgress
+	ttl      time.Duration
+}
+
+func (b *progressBroker) SetProgress(id string, p *base.TaskProgress, ttl time.Duration) error {
+	b.record("progress " + id)
+	b.mu.Lock()
+	b.progress = append(b.progress, p)
+	b.ttl = ttl
+	b.mu.Unlock()
+	return nil
+}
+
+func TestReportProgress(t *testing.T) {
+	b := &progressBroker{}
+	workerCh := make(chan int)
+	go fakeHeartbeater(workerCh)
+	defer close(workerCh)
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            b,
+		queues:         defaultQueueConfig,
+		concurrency:    1,
+		retryDelayFunc: defaultDelayFunc,
+		workerCh:       workerCh,
+		cancelations:   base.NewCancelations(),
+	})
+	var invalidErr error
+	p.handler = HandlerFunc(func(ctx context.Context, task *Task) error {
+		if err := ReportProgress(ctx, 25, nil); err != nil {
+			return err
+		}
+		invalidErr = ReportProgress(ctx, 101, nil)
+		return ReportProgress(ctx, 50, map[string]int{"rows": 500, "total": 1000})
+	})
+	msg := h.NewTaskMessage("export", nil)
+
+	p.dispatch(msg)
+	// wait for the worker to finish.
+	p.sema <- struct{}{}
+	<-p.sema
+
+	if invalidErr == nil {
+		t.Errorf("ReportProgress(ctx, 101, nil) returned nil error")
+	}
+	id := msg.ID.String()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	want := []string{"progress " + id, "progress " + id, "done"}
+	if diff := cmp.Diff(want, b.events); diff != "" {
+		t.Errorf("broker received %v, want %v; (-want,+got)\n%s", b.events, want, diff)
+	}
+	if len(b.progress) != 2 {
+		t.Fatalf("broker stored %d progresses, want 2", len(b.progress))
+	}
+	if got := b.progress[0]; got.Percent != 25 || got.Data != nil {
+		t.Errorf("first progress = %+v, want 25 percent without data", got)
+	}
+	if got := b.progress[1]; got.Percent != 50 || string(got.Data) != `{"rows":500,"total":1000}` {
+		t.Errorf("second progress = {Percent: %v, Data: %s}, want {Percent: 50, Data: {\"rows\":500,\"total\":1000}}", got.Percent, got.Data)
+	}
+	if b.ttl != progressRetention {
+		t.Errorf("progress stored with TTL %v, want %v", b.ttl, progressRetention)
+	}
+
+	if err := ReportProgress(context.Background(), 10, nil); err != ErrNoProgress {
+		t.Errorf("ReportProgress(context.Background()) returned error %v, want %v", err, ErrNoProgress)
+	}
+}
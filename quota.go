@@ -0,0 +1,121 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+)
+
+// ErrQueueFull is returned by Client.Schedule when the queue of the task
+// has as many pending tasks as its quota in ClientConfig.QueueQuotas.
+var ErrQueueFull = rdb.ErrQueueFull
+
+// quotaStore is implemented by brokers which can enqueue tasks
+// within a quota.
+type quotaStore interface {
+	EnqueueWithQuota(msg *base.TaskMessage, max int) error
+}
+
+// errQuotaUnsupported is returned when a task is enqueued to a queue with
+// a quota with a broker which cannot enforce it.
+var errQuotaUnsupported = errors.New("asynq: broker does not support queue quotas")
+
+// max interval between attempts to enqueue a task to a full queue.
+const maxQuotaWaitInterval = time.Second
+
+// enqueueWithQuota enqueues the task unless its queue has max pending
+// tasks. If the queue is full, it retries until the queue has room or
+// the quota timeout of the client elapses.
+func (c *Client) enqueueWithQuota(msg *base.TaskMessage, max int) error {
+	qs, ok := c.rdb.(quotaStore)
+	if !ok {
+		return errQuotaUnsupported
+	}
+	deadline := time.Now().Add(c.quotaTimeout)
+	interval := 10 * time.Millisecond
+	for {
+		err := qs.EnqueueWithQuota(msg, max)
+		if err != ErrQueueFull {
+			return err
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return err
+		}
+		if interval > left {
+			interval = left
+		}
+		time.Sleep(interval)
+		if interval *= 2; interval > maxQuotaWaitInterval {
+			interval = maxQuotaWaitInterval
+		}
+	}
+}
+
+// QueueInfo holds the numbers of tasks of a queue waiting to be processed,
+// which producers can use to shed load or delay enqueues when the backlog
+// grows.
+type QueueInfo struct {
+	// Name of the queue.
+	Queue string
+
+	// Number of tasks enqueued and waiting to be processed.
+	Pending int
+
+	// Number of tasks scheduled to be processed in the future.
+	Scheduled int
+
+	// Number of tasks currently being processed.
+	InProgress int
+
+	// Time the numbers were read.
+	Timestamp time.Time
+}
+
+// queueSizeStore is implemented by brokers which can count the tasks
+// of a queue.
+type queueSizeStore interface {
+	QueueSize(qname string) (*rdb.QueueSize, error)
+}
+
+// QueueInfo returns the numbers of tasks of the queue which are pending,
+// scheduled, and in progress. The numbers of a sharded queue are the sums
+// of the numbers of its shards.
+//
+// Counting the scheduled and in-progress tasks of a queue reads the
+// scheduled and in-progress tasks of all queues, so producers should call
+// QueueInfo periodically (e.g. every few seconds) rather than before each
+// enqueue.
+//
+// Example:
+//
+//	info, err := client.QueueInfo("email")
+//	if err == nil && info.Pending > 10000 {
+//	    return errTryLater
+//	}
+func (c *Client) QueueInfo(qname string) (*QueueInfo, error) {
+	qs, ok := c.rdb.(queueSizeStore)
+	if !ok {
+		return nil, errors.New("asynq: broker does not support queue info")
+	}
+	qname = strings.ToLower(qname)
+	info := &QueueInfo{Queue: qname}
+	for _, q := range c.shards.expand([]string{qname}) {
+		size, err := qs.QueueSize(q)
+		if err != nil {
+			return nil, err
+		}
+		info.Pending += size.Pending
+		info.Scheduled += size.Scheduled
+		info.InProgress += size.InProgress
+		info.Timestamp = size.Timestamp
+	}
+	return info, nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+)
+
+// quotaBroker holds the number of tasks in each queue, and drains
+// a task from a full queue each time an enqueue is rejected.
+// Calling other methods panics.
+type quotaBroker struct {
+	base.Broker
+
+	size      map[string]int
+	drain     bool
+	rejected  int
+	scheduled int
+}
+
+func (b *quotaBroker) EnqueueWithQuota(msg *base.TaskMessage, max int) error {
+	if b.size[msg.Queue] >= max {
+		b.rejected++
+		if b.drain {
+			b.size[msg.Queue]--
+		}
+		return ErrQueueFull
+	}
+	b.size[msg.Queue]++
+	return nil
+}
+
+func (b *quotaBroker) Schedule(msg *base.TaskMessage, processAt time.Time) error {
+	b.scheduled++
+	return nil
+}
+
+func (b *quotaBroker) QueueSize(qname string) (*rdb.QueueSize, error) {
+	return &rdb.QueueSize{Pending: b.size[qname], Scheduled: b.scheduled}, nil
+}
+
+func TestClientQueueInfo(t *testing.T) {
+	b := &quotaBroker{size: map[string]int{"email": 42}, scheduled: 3}
+	client := &Client{rdb: b}
+
+	got, err := client.QueueInfo("Email")
+	if err != nil {
+		t.Fatalf("QueueInfo returned error: %v", err)
+	}
+	want := &QueueInfo{Queue: "email", Pending: 42, Scheduled: 3}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("QueueInfo = %+v, want %+v; (-want,+got)\n%s", got, want, diff)
+	}
+
+	shared := &Client{rdb: sharedBroker{b}}
+	if _, err := shared.QueueInfo("email"); err == nil {
+		t.Errorf("QueueInfo with a broker which cannot count tasks returned nil error")
+	}
+}
+
+func TestClientQueueQuota(t *testing.T) {
+	b := &quotaBroker{size: map[string]int{"email": 2}}
+	client := &Client{rdb: b, quotas: map[string]int{"email": 2}}
+
+	if _, err := client.Schedule(NewTask("send_email", nil), time.Now(), Queue("email")); err != ErrQueueFull {
+		t.Errorf("Schedule to a full queue returned error %v, want %v", err, ErrQueueFull)
+	}
+	if b.rejected != 1 {
+		t.Errorf("broker rejected %d tasks, want 1", b.rejected)
+	}
+	// tasks scheduled to be processed in the future are not limited.
+	if _, err := client.Schedule(NewTask("send_email", nil), time.Now().Add(time.Hour), Queue("email")); err != nil {
+		t.Errorf("Schedule in the future to a full queue returned error: %v", err)
+	}
+	if b.scheduled != 1 {
+		t.Errorf("broker scheduled %d tasks, want 1", b.scheduled)
+	}
+
+	// the queue has room after a wait.
+	b.drain = true
+	client.quotaTimeout = time.Second
+	if _, err := client.Schedule(NewTask("send_email", nil), time.Now(), Queue("email")); err != nil {
+		t.Errorf("Schedule with a timeout to a queue draining returned error: %v", err)
+	}
+	if b.size["email"] != 2 {
+		t.Errorf("queue has %d tasks, want 2", b.size["email"])
+	}
+
+	// the queue stays full until the timeout.
+	b.drain = false
+	client.quotaTimeout = 50 * time.Millisecond
+	start := time.Now()
+	if _, err := client.Schedule(NewTask("send_email", nil), time.Now(), Queue("email")); err != ErrQueueFull {
+		t.Errorf("Schedule with a timeout to a full queue returned error %v, want %v", err, ErrQueueFull)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Schedule waited %v for the full queue, want 50ms", elapsed)
+	}
+
+	shared := &Client{rdb: sharedBroker{b}, quotas: map[string]int{"email": 2}}
+	if _, err := shared.Schedule(NewTask("send_email", nil), time.Now(), Queue("email")); err != errQuotaUnsupported {
+		t.Errorf("Schedule with a broker without quotas returned error %v, want %v", err, errQuotaUnsupported)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+	"golang.org/x/time/rate"
+)
+
+// TaskRateLimit limits the rate at which tasks of a type, or tasks in
+// a queue, are processed (e.g. tasks calling a third party API with
+// a rate limit).
+//
+// Tasks over the limit are throttled when they are pulled out of the queues:
+// they are postponed until the limit allows them, without running the handler
+// or counting them as retries.
+type TaskRateLimit struct {
+	// TaskType is the type of the tasks to limit.
+	TaskType string
+
+	// Queue is the name of the queue whose tasks to limit,
+	// used if TaskType is empty.
+	Queue string
+
+	// Limit is the number of tasks processed per Per, which may be
+	// processed in a burst.
+	Limit int
+	Per   time.Duration
+
+	// Shared makes the limit apply to all background worker processes
+	// sharing the redis instance together, with a token bucket stored in
+	// redis, so that the aggregate rate stays under the limit regardless
+	// of the number of processes.
+	//
+	// If false, the limit applies to each process separately. Limits are
+	// not shared by backgrounds created with NewBackgroundWithBroker.
+	Shared bool
+}
+
+// RateLimit returns a limit of n tasks of the given type per the given duration.
+//
+// Example:
+//
+//	bg := asynq.NewBackground(redis, &asynq.Config{
+//	    RateLimits: []*asynq.TaskRateLimit{
+//	        asynq.RateLimit("send_email", 100, time.Minute),
+//	    },
+//	})
+func RateLimit(typename string, n int, per time.Duration) *TaskRateLimit {
+	return &TaskRateLimit{TaskType: typename, Limit: n, Per: per}
+}
+
+// QueueRateLimit returns a limit of n tasks in the given queue per the given duration.
+func QueueRateLimit(qname string, n int, per time.Duration) *TaskRateLimit {
+	return &TaskRateLimit{Queue: qname, Limit: n, Per: per}
+}
+
+// name returns the name of the token bucket of the limit.
+func (l *TaskRateLimit) name() string {
+	if l.TaskType != "" {
+		return "type:" + l.TaskType
+	}
+	return "queue:" + l.Queue
+}
+
+// tokenStore is implemented by brokers which store token buckets
+// shared by all background worker processes.
+type tokenStore interface {
+	TakeToken(name string, limit int, per time.Duration) (time.Duration, error)
+}
+
+// rateLimiter throttles the tasks by type and queue.
+//
+// A nil rateLimiter never throttles tasks.
+type rateLimiter struct {
+	logger *asynqLogger
+	// local limiters by name of the limit.
+	local map[string]*rate.Limiter
+
+	// shared limits stored in redis by name of the limit.
+	shared map[string]*TaskRateLimit
+
+	store tokenStore
+
+	// rate limiter to prevent spamming logs with a bunch of errors.
+	errLogLimiter *rate.Limiter
+}
+
+func newRateLimiter(logger *asynqLogger, limits []*TaskRateLimit, store tokenStore) *rateLimiter {
+	l := &rateLimiter{
+		logger:        logger,
+		local:         make(map[string]*rate.Limiter),
+		shared:        make(map[string]*TaskRateLimit),
+		store:         store,
+		errLogLimiter: rate.NewLimiter(rate.Every(3*time.Second), 1),
+	}
+	for _, lim := range limits {
+		if lim.Limit <= 0 || lim.Per <= 0 || (lim.TaskType == "" && lim.Queue == "") {
+			continue
+		}
+		if lim.Shared && store != nil {
+			l.shared[lim.name()] = lim
+			continue
+		}
+		every := rate.Every(lim.Per / time.Duration(lim.Limit))
+		l.local[lim.name()] = rate.NewLimiter(every, lim.Limit)
+	}
+	if len(l.local) == 0 && len(l.shared) == 0 {
+		return nil
+	}
+	return l
+}
+
+// throttled reports whether the task is over the rate limit of its type
+// or queue, and if so, how long to wait before processing it.
+func (l *rateLimiter) throttled(msg *base.TaskMessage) (time.Duration, bool) {
+	if l == nil {
+		return 0, false
+	}
+	names := []string{"type:" + msg.Type, "queue:" + logicalQueue(msg.Queue)}
+	// Reservations are made and canceled at the same time, otherwise
+	// the tokens taken without delay are not given back.
+	now := time.Now()
+	var reserved []*rate.Reservation
+	// cancel gives the local tokens back, since the task will take
+	// them again when it's pulled out of the queue again.
+	cancel := func() {
+		for _, r := range reserved {
+			r.CancelAt(now)
+		}
+	}
+	var wait time.Duration
+	for _, name := range names {
+		lim, ok := l.local[name]
+		if !ok {
+			continue
+		}
+		r := lim.ReserveN(now, 1)
+		reserved = append(reserved, r)
+		if d := r.DelayFrom(now); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		cancel()
+		return wait, true
+	}
+	for _, name := range names {
+		lim, ok := l.shared[name]
+		if !ok {
+			continue
+		}
+		d, err := l.store.TakeToken(name, lim.Limit, lim.Per)
+		if err != nil {
+			// Don't hold up the tasks while redis is unreachable.
+			if l.errLogLimiter.Allow() {
+				l.logger.error("Could not take a token of rate limit %q: %v", name, err)
+			}
+			continue
+		}
+		if d > 0 {
+			cancel()
+			return d, true
+		}
+	}
+	return 0, false
+}
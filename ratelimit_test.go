@@ -0,0 +1,140 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+)
+
+// fakeTokenStore hands out the given number of tokens per bucket,
+// and records the buckets tokens are taken from.
+type fakeTokenStore struct {
+	tokens map[string]int
+	taken  []string
+	err    error
+}
+
+func (s *fakeTokenStore) TakeToken(name string, limit int, per time.Duration) (time.Duration, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	s.taken = append(s.taken, name)
+	if s.tokens[name] == 0 {
+		return per / time.Duration(limit), nil
+	}
+	s.tokens[name]--
+	return 0, nil
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(testLogger, []*TaskRateLimit{
+		RateLimit("send_email", 2, time.Minute),
+		RateLimit("ignored", 0, time.Minute),
+	}, nil)
+	email := h.NewTaskMessage("send_email", nil)
+	other := h.NewTaskMessage("reindex", nil)
+
+	for i := 0; i < 2; i++ {
+		if d, ok := l.throttled(email); ok {
+			t.Fatalf("task %d within burst throttled for %v, want not throttled", i, d)
+		}
+	}
+	// Throttled tasks should not use up tokens, so the delay stays the same.
+	for i := 0; i < 3; i++ {
+		d, ok := l.throttled(email)
+		if !ok || d <= 29*time.Second || d > 30*time.Second {
+			t.Errorf("throttled(email) = %v, %t; want about 30s, true", d, ok)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if d, ok := l.throttled(other); ok {
+			t.Fatalf("task without rate limit throttled for %v, want not throttled", d)
+		}
+	}
+	if _, ok := l.local["type:ignored"]; ok {
+		t.Errorf("limiter created for zero limit, want ignored")
+	}
+}
+
+func TestQueueRateLimiter(t *testing.T) {
+	l := newRateLimiter(testLogger, []*TaskRateLimit{
+		QueueRateLimit("low", 1, time.Minute),
+		RateLimit("send_email", 2, time.Minute),
+	}, nil)
+	low := h.NewTaskMessage("send_email", nil)
+	low.Queue = "low"
+	email := h.NewTaskMessage("send_email", nil)
+
+	if d, ok := l.throttled(low); ok {
+		t.Fatalf("first task in queue throttled for %v, want not throttled", d)
+	}
+	if _, ok := l.throttled(low); !ok {
+		t.Fatalf("second task in queue not throttled, want throttled")
+	}
+	// The task throttled by its queue should give back the token of its type.
+	if d, ok := l.throttled(email); ok {
+		t.Errorf("task of type with a token left throttled for %v, want not throttled", d)
+	}
+	if _, ok := l.throttled(email); !ok {
+		t.Errorf("task of type with no tokens left not throttled, want throttled")
+	}
+}
+
+func TestSharedRateLimiter(t *testing.T) {
+	store := &fakeTokenStore{tokens: map[string]int{"type:send_email": 1, "queue:default": 5}}
+	l := newRateLimiter(testLogger, []*TaskRateLimit{
+		{TaskType: "send_email", Limit: 10, Per: time.Minute, Shared: true},
+		{Queue: "default", Limit: 10, Per: time.Minute, Shared: true},
+	}, store)
+	msg := h.NewTaskMessage("send_email", nil)
+
+	if d, ok := l.throttled(msg); ok {
+		t.Fatalf("task with shared tokens left throttled for %v, want not throttled", d)
+	}
+	if d, ok := l.throttled(msg); !ok || d != 6*time.Second {
+		t.Errorf("throttled(msg) = %v, %t; want 6s, true", d, ok)
+	}
+	want := []string{"type:send_email", "queue:default", "type:send_email"}
+	if diff := cmp.Diff(want, store.taken); diff != "" {
+		t.Errorf("tokens taken from %v, want %v; (-want,+got)\n%s", store.taken, want, diff)
+	}
+
+	// Tasks should not be throttled while the store is unavailable.
+	store.err = errors.New("connection refused")
+	if d, ok := l.throttled(msg); ok {
+		t.Errorf("task throttled for %v while store is unavailable, want not throttled", d)
+	}
+}
+
+func TestSharedRateLimiterWithoutStore(t *testing.T) {
+	l := newRateLimiter(testLogger, []*TaskRateLimit{
+		{TaskType: "send_email", Limit: 1, Per: time.Minute, Shared: true},
+	}, nil)
+	msg := h.NewTaskMessage("send_email", nil)
+
+	// Shared limits should apply to the process if the broker doesn't store tokens.
+	if d, ok := l.throttled(msg); ok {
+		t.Fatalf("first task throttled for %v, want not throttled", d)
+	}
+	if _, ok := l.throttled(msg); !ok {
+		t.Errorf("second task not throttled, want throttled")
+	}
+}
+
+func TestNilRateLimiter(t *testing.T) {
+	l := newRateLimiter(testLogger, nil, nil)
+	if l != nil {
+		t.Fatalf("newRateLimiter(testLogger, nil, nil) = %v, want nil", l)
+	}
+	// nil rate limiter should never throttle tasks.
+	if d, ok := l.throttled(h.NewTaskMessage("send_email", nil)); ok {
+		t.Errorf("nil rateLimiter throttled task for %v, want not throttled", d)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+)
+
+// ResultSink stores the results of tasks outside of redis
+// (e.g. in S3, GCS, or a filesystem).
+//
+// Results are streamed to the sink by the handlers with CreateResult,
+// and only the locations and checksums of the results are stored in redis,
+// so large results don't take up memory in redis.
+type ResultSink interface {
+	// Create creates an object with the given name to write a result to.
+	// It returns a writer to the object and the location of the object
+	// (e.g. "s3://bucket/name"), which is stored in redis when the writer
+	// is closed.
+	//
+	// The result should be complete once Close of the writer returns nil.
+	Create(ctx context.Context, name string) (w io.WriteCloser, location string, err error)
+}
+
+// FileSink is a ResultSink which writes the results to files in Dir.
+type FileSink struct {
+	Dir string
+}
+
+// Create creates the file with the given name in Dir, creating the parent
+// directories as needed. Names which point outside of Dir (e.g. the names
+// of the tasks whose type contains "..") are rejected.
+func (s *FileSink) Create(ctx context.Context, name string) (io.WriteCloser, string, error) {
+	dir := filepath.Clean(s.Dir)
+	p := filepath.Join(dir, filepath.FromSlash(name))
+	rel, err := filepath.Rel(dir, p)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, "", fmt.Errorf("asynq: result name %q is outside of %s", name, s.Dir)
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, "", err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, p, nil
+}
+
+// TaskResult points to the result of a task stored in a ResultSink.
+type TaskResult = base.TaskResult
+
+// ErrNoResultSink is returned by CreateResult if the context doesn't
+// belong to a task which can stream its result to a ResultSink.
+var ErrNoResultSink = errors.New("asynq: no result sink for the task")
+
+// ErrResultNotFound indicates that no result was stored for a task,
+// or the result has expired.
+var ErrResultNotFound = rdb.ErrResultNotFound
+
+// defaultResultRetention is how long the pointers to the results are kept
+// if Config.ResultRetention is unset.
+const defaultResultRetention = 7 * 24 * time.Hour
+
+type resultKey struct{}
+
+// CreateResult creates an object in Config.ResultSink to stream the result of
+// the task to, named "<task type>/<task id>".
+//
+// When the returned writer is closed, the location, size and SHA-256 checksum
+// of the result are stored in redis and can be read with Inspector.Result.
+// Calling CreateResult again for the same task overwrites the result.
+//
+// ctx should be the context passed to the handler; CreateResult returns
+// ErrNoResultSink if ResultSink is not configured, or ctx is not a context of
+// a task processed by a background (results of tasks processed by BulkHandler
+// are not supported).
+func CreateResult(ctx context.Context) (io.WriteCloser, error) {
+	t, ok := ctx.Value(resultKey{}).(*taskResult)
+	if !ok {
+		return nil, ErrNoResultSink
+	}
+	id := t.msg.ID.String()
+	w, loc, err := t.results.sink.Create(ctx, path.Join(t.msg.Type, id))
+	if err != nil {
+		return nil, err
+	}
+	return &resultWriter{
+		results:  t.results,
+		id:       id,
+		w:        w,
+		location: loc,
+		hash:     sha256.New(),
+	}, nil
+}
+
+// resultStore is implemented by brokers which store the pointers to results.
+type resultStore interface {
+	SetResult(id string, res *base.TaskResult, ttl time.Duration) error
+}
+
+// results streams the results of the tasks to the sink and stores
+// the pointers to them in the broker.
+//
+// A nil results doesn't add results to the contexts of the tasks.
+type results struct {
+	sink      ResultSink
+	store     resultStore
+	retention time.Duration
+}
+
+func newResults(sink ResultSink, store resultStore, retention time.Duration) *results {
+	if sink == nil || store == nil {
+		return nil
+	}
+	if retention <= 0 {
+		retention = defaultResultRetention
+	}
+	return &results{sink: sink, store: store, retention: retention}
+}
+
+// taskResult is the handle to the result of a task carried by the context
+// of the handler.
+type taskResult struct {
+	results *results
+	msg     *base.TaskMessage
+}
+
+// withContext returns a copy of ctx which lets the handler of the task
+// stream its result with CreateResult.
+func (r *results) withContext(ctx context.Context, msg *base.TaskMessage) context.Context {
+	if r == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, resultKey{}, &taskResult{results: r, msg: msg})
+}
+
+// resultWriter writes a result to the sink, and stores the pointer
+// to the result when closed.
+type resultWriter struct {
+	results  *results
+	id       string
+	w        io.WriteCloser
+	location string
+	hash     hash.Hash
+	size     int64
+}
+
+func (w *resultWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *resultWriter) Close() error {
+	if err := w.w.Close(); err != nil {
+		return err
+	}
+	res := &base.TaskResult{
+		Location: w.location,
+		Checksum: hex.EncodeToString(w.hash.Sum(nil)),
+		Size:     w.size,
+		Time:     time.Now().UTC(),
+	}
+	return w.results.store.SetResult(w.id, res, w.results.retention)
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// fakeResultStore records the results stored by task ID.
+type fakeResultStore struct {
+	results map[string]*base.TaskResult
+	ttl     time.Duration
+}
+
+func (s *fakeResultStore) SetResult(id string, res *base.TaskResult, ttl time.Duration) error {
+	s.results[id] = res
+	s.ttl = ttl
+	return nil
+}
+
+func TestCreateResult(t *testing.T) {
+	dir, err := ioutil.TempDir("", "asynq-results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &fakeResultStore{results: make(map[string]*base.TaskResult)}
+	r := newResults(&FileSink{Dir: dir}, store, 0)
+	msg := h.NewTaskMessage("export_report", nil)
+	id := msg.ID.String()
+	ctx := r.withContext(context.Background(), msg)
+
+	w, err := CreateResult(ctx)
+	if err != nil {
+		t.Fatalf("CreateResult(ctx) returned error: %v", err)
+	}
+	data := strings.Repeat("id,amount\n", 1000)
+	if _, err := io.Copy(w, strings.NewReader(data)); err != nil {
+		t.Fatalf("writing result returned error: %v", err)
+	}
+	if len(store.results) != 0 {
+		t.Errorf("result stored before the writer is closed: %v", store.results)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("closing result returned error: %v", err)
+	}
+
+	res, ok := store.results[id]
+	if !ok {
+		t.Fatalf("result of task %s not stored", id)
+	}
+	path := filepath.Join(dir, "export_report", id)
+	sum := sha256.Sum256([]byte(data))
+	if res.Location != path || res.Checksum != hex.EncodeToString(sum[:]) || res.Size != int64(len(data)) {
+		t.Errorf("stored result %+v, want location %q, checksum %x, size %d", res, path, sum, len(data))
+	}
+	if store.ttl != defaultResultRetention {
+		t.Errorf("stored result with ttl %v, want %v", store.ttl, defaultResultRetention)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read result file: %v", err)
+	}
+	if string(got) != data {
+		t.Errorf("result file has %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestCreateResultWithoutSink(t *testing.T) {
+	store := &fakeResultStore{results: make(map[string]*base.TaskResult)}
+	msg := h.NewTaskMessage("export_report", nil)
+	tests := []struct {
+		desc string
+		ctx  context.Context
+	}{
+		{"not a task", context.Background()},
+		{"no sink", newResults(nil, store, 0).withContext(context.Background(), msg)},
+		{"no store", newResults(&FileSink{Dir: os.TempDir()}, nil, 0).withContext(context.Background(), msg)},
+	}
+	for _, tc := range tests {
+		if _, err := CreateResult(tc.ctx); err != ErrNoResultSink {
+			t.Errorf("%s: CreateResult(ctx) returned error %v, want %v", tc.desc, err, ErrNoResultSink)
+		}
+	}
+}
+
+func TestFileSinkOutsideDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "asynq-results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := &FileSink{Dir: filepath.Join(dir, "results")}
+
+	for _, name := range []string{"../../etc/x/b4dd2an05e5gu3ufv1pg", "..", "", "a/../../b"} {
+		if w, _, err := s.Create(context.Background(), name); err == nil {
+			w.Close()
+			t.Errorf("(*FileSink).Create(ctx, %q) succeeded, want error", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "etc")); !os.IsNotExist(err) {
+		t.Errorf("file created outside of the sink: %v", err)
+	}
+
+	w, loc, err := s.Create(context.Background(), "export/../report/b4dd2an05e5gu3ufv1pg")
+	if err != nil {
+		t.Fatalf("(*FileSink).Create returned error: %v", err)
+	}
+	w.Close()
+	if want := filepath.Join(dir, "results", "report", "b4dd2an05e5gu3ufv1pg"); loc != want {
+		t.Errorf("(*FileSink).Create created %q, want %q", loc, want)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"sync"
+	"time"
+)
+
+// rollupStore is implemented by brokers which store rollup counts.
+type rollupStore interface {
+	RefreshRollups() error
+}
+
+// rollupRefresher periodically recounts the tasks by their rollup dimensions.
+//
+// A nil rollupRefresher does nothing.
+type rollupRefresher struct {
+	logger *asynqLogger
+	rdb    rollupStore
+
+	// locker ensures only one of the backgrounds refreshes the rollups
+	// at a time, nil if backgrounds don't coordinate.
+	locker Locker
+
+	// channel to communicate back to the long running "rollup refresher" goroutine.
+	done chan struct{}
+
+	// interval between refreshes.
+	interval time.Duration
+}
+
+// rollupLockName is the name of the lock to acquire before refreshing rollups.
+const rollupLockName = "rollups"
+
+func newRollupRefresher(logger *asynqLogger, r rollupStore, locker Locker, interval time.Duration) *rollupRefresher {
+	if r == nil || interval <= 0 {
+		return nil
+	}
+	return &rollupRefresher{
+		logger:   logger,
+		rdb:      r,
+		locker:   locker,
+		done:     make(chan struct{}),
+		interval: interval,
+	}
+}
+
+func (r *rollupRefresher) terminate() {
+	if r == nil {
+		return
+	}
+	r.logger.debug("Rollup refresher shutting down...")
+	// Signal the rollup refresher goroutine to stop.
+	r.done <- struct{}{}
+	if r.locker != nil {
+		if err := r.locker.Unlock(rollupLockName); err != nil {
+			r.logger.warn("Could not release rollup lock: %v", err)
+		}
+	}
+}
+
+func (r *rollupRefresher) start(wg *sync.WaitGroup) {
+	if r == nil {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-r.done:
+				r.logger.debug("Rollup refresher done")
+				return
+			case <-time.After(r.interval):
+				r.exec()
+			}
+		}
+	}()
+}
+
+func (r *rollupRefresher) exec() {
+	if r.locker != nil {
+		ok, err := r.locker.Lock(rollupLockName, 3*r.interval)
+		if err != nil {
+			r.logger.error("Could not acquire rollup lock: %v", err)
+			return
+		}
+		if !ok {
+			return
+		}
+	}
+	if err := r.rdb.RefreshRollups(); err != nil {
+		r.logger.error("Could not refresh rollups: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestClientRollupDimensions(t *testing.T) {
+	b := &recordingBroker{}
+	client := &Client{rdb: sharedBroker{b}, dimensions: []string{"plan", "count", "country"}}
+
+	tests := []struct {
+		payload map[string]interface{}
+		want    map[string]string
+	}{
+		{
+			payload: map[string]interface{}{"plan": "pro", "count": 3, "user_id": 42},
+			want:    map[string]string{"plan": "pro", "count": "3"},
+		},
+		{
+			payload: map[string]interface{}{"user_id": 42},
+			want:    nil,
+		},
+	}
+
+	for _, tc := range tests {
+		b.enqueued = nil
+		task := NewTask("export", tc.payload)
+		if _, err := client.Schedule(task, time.Now()); err != nil {
+			t.Fatalf("Schedule returned error: %v", err)
+		}
+		if len(b.enqueued) != 1 {
+			t.Fatalf("broker received %d tasks, want 1", len(b.enqueued))
+		}
+		got := b.enqueued[0].Dimensions
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("task with payload %v has dimensions %v, want %v; (-want,+got)\n%s",
+				tc.payload, got, tc.want, diff)
+		}
+	}
+}
+
+// countingRollupStore counts the calls to RefreshRollups.
+type countingRollupStore struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (s *countingRollupStore) RefreshRollups() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	return nil
+}
+
+func TestRollupRefresherWithLocker(t *testing.T) {
+	tests := []struct {
+		held      bool
+		wantCalls int
+	}{
+		{held: true, wantCalls: 1},
+		{held: false, wantCalls: 0},
+	}
+
+	for _, tc := range tests {
+		s := &countingRollupStore{}
+		l := &fakeLocker{held: tc.held}
+		r := newRollupRefresher(testLogger, s, l, time.Minute)
+		r.exec()
+		if s.calls != tc.wantCalls {
+			t.Errorf("with lock held=%t, RefreshRollups called %d times, want %d", tc.held, s.calls, tc.wantCalls)
+		}
+		var wg sync.WaitGroup
+		r.start(&wg)
+		r.terminate()
+		wg.Wait()
+		want := []string{rollupLockName}
+		if diff := cmp.Diff(want, l.unlocked); diff != "" {
+			t.Errorf("unlocked %v, want %v; (-want,+got)\n%s", l.unlocked, want, diff)
+		}
+	}
+}
+
+func TestNewRollupRefresherDisabled(t *testing.T) {
+	if r := newRollupRefresher(testLogger, &countingRollupStore{}, nil, 0); r != nil {
+		t.Errorf("newRollupRefresher with zero interval = %v, want nil", r)
+	}
+	if r := newRollupRefresher(testLogger, nil, nil, time.Minute); r != nil {
+		t.Errorf("newRollupRefresher without store = %v, want nil", r)
+	}
+	// nil refresher should be safe to start and terminate.
+	var r *rollupRefresher
+	var wg sync.WaitGroup
+	r.start(&wg)
+	r.terminate()
+	wg.Wait()
+}
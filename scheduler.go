@@ -5,14 +5,24 @@
 package asynq
 
 import (
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/hibiken/asynq/internal/base"
 )
 
 type scheduler struct {
-	rdb *rdb.RDB
+	logger *asynqLogger
+	rdb    base.Broker
+
+	// locker ensures only one of the schedulers with the same queues
+	// forwards tasks at a time, nil if schedulers don't coordinate.
+	locker Locker
+
+	// name of the lock to acquire before forwarding tasks.
+	lockName string
 
 	// channel to communicate back to the long running "scheduler" goroutine.
 	done chan struct{}
@@ -24,13 +34,22 @@ type scheduler struct {
 	qnames []string
 }
 
-func newScheduler(r *rdb.RDB, avgInterval time.Duration, qcfg map[string]int) *scheduler {
+const defaultSchedulerInterval = 5 * time.Second
+
+func newScheduler(logger *asynqLogger, r base.Broker, locker Locker, avgInterval time.Duration, qcfg map[string]int) *scheduler {
+	if avgInterval <= 0 {
+		avgInterval = defaultSchedulerInterval
+	}
 	var qnames []string
 	for q := range qcfg {
 		qnames = append(qnames, q)
 	}
+	sort.Strings(qnames)
 	return &scheduler{
+		logger:      logger,
 		rdb:         r,
+		locker:      locker,
+		lockName:    "scheduler:" + strings.Join(qnames, ","),
 		done:        make(chan struct{}),
 		avgInterval: avgInterval,
 		qnames:      qnames,
@@ -38,9 +57,14 @@ func newScheduler(r *rdb.RDB, avgInterval time.Duration, qcfg map[string]int) *s
 }
 
 func (s *scheduler) terminate() {
-	logger.info("Scheduler shutting down...")
+	s.logger.debug("Scheduler shutting down...")
 	// Signal the scheduler goroutine to stop polling.
 	s.done <- struct{}{}
+	if s.locker != nil {
+		if err := s.locker.Unlock(s.lockName); err != nil {
+			s.logger.warn("Could not release scheduler lock: %v", err)
+		}
+	}
 }
 
 // start starts the "scheduler" goroutine.
@@ -51,7 +75,7 @@ func (s *scheduler) start(wg *sync.WaitGroup) {
 		for {
 			select {
 			case <-s.done:
-				logger.info("Scheduler done")
+				s.logger.debug("Scheduler done")
 				return
 			case <-time.After(s.avgInterval):
 				s.exec()
@@ -61,7 +85,20 @@ func (s *scheduler) start(wg *sync.WaitGroup) {
 }
 
 func (s *scheduler) exec() {
+	if s.locker != nil {
+		// Schedulers with the same queues forward the tasks the same way,
+		// so only the one holding the lock needs to. The lock expires if
+		// the holder stops renewing it.
+		ok, err := s.locker.Lock(s.lockName, 3*s.avgInterval)
+		if err != nil {
+			s.logger.error("Could not acquire scheduler lock: %v", err)
+			return
+		}
+		if !ok {
+			return
+		}
+	}
 	if err := s.rdb.CheckAndEnqueue(s.qnames...); err != nil {
-		logger.error("Could not enqueue scheduled tasks: %v", err)
+		s.logger.error("Could not enqueue scheduled tasks: %v", err)
 	}
 }
@@ -19,7 +19,7 @@ func TestScheduler(t *testing.T) {
 	r := setup(t)
 	rdbClient := rdb.NewRDB(r)
 	const pollInterval = time.Second
-	s := newScheduler(rdbClient, pollInterval, defaultQueueConfig)
+	s := newScheduler(testLogger, rdbClient, nil, pollInterval, defaultQueueConfig)
 	t1 := h.NewTaskMessage("gen_thumbnail", nil)
 	t2 := h.NewTaskMessage("send_email", nil)
 	t3 := h.NewTaskMessage("reindex", nil)
@@ -91,3 +91,80 @@ func TestScheduler(t *testing.T) {
 		}
 	}
 }
+
+// countingBroker counts the calls to CheckAndEnqueue.
+// Calling other methods panics.
+type countingBroker struct {
+	base.Broker
+	mu    sync.Mutex
+	calls int
+}
+
+func (b *countingBroker) CheckAndEnqueue(qnames ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls++
+	return nil
+}
+
+// fakeLocker holds the locks if held is true.
+type fakeLocker struct {
+	held     bool
+	unlocked []string
+}
+
+func (l *fakeLocker) Lock(name string, ttl time.Duration) (bool, error) {
+	return l.held, nil
+}
+
+func (l *fakeLocker) Unlock(name string) error {
+	l.unlocked = append(l.unlocked, name)
+	return nil
+}
+
+func TestSchedulerWithLocker(t *testing.T) {
+	qcfg := map[string]int{"low": 1, "critical": 3}
+	tests := []struct {
+		held      bool
+		wantCalls int
+	}{
+		{held: true, wantCalls: 1},
+		{held: false, wantCalls: 0},
+	}
+	for _, tc := range tests {
+		b := &countingBroker{}
+		l := &fakeLocker{held: tc.held}
+		s := newScheduler(testLogger, b, l, time.Second, qcfg)
+		s.exec()
+		if b.calls != tc.wantCalls {
+			t.Errorf("with lock held=%t, CheckAndEnqueue called %d times, want %d", tc.held, b.calls, tc.wantCalls)
+		}
+		var wg sync.WaitGroup
+		s.start(&wg)
+		s.terminate()
+		wg.Wait()
+		want := []string{"scheduler:critical,low"}
+		if diff := cmp.Diff(want, l.unlocked); diff != "" {
+			t.Errorf("unlocked %v, want %v; (-want,+got)\n%s", l.unlocked, want, diff)
+		}
+	}
+}
+
+func TestSchedulerInterval(t *testing.T) {
+	if s := newScheduler(testLogger, &countingBroker{}, nil, 0, defaultQueueConfig); s.avgInterval != defaultSchedulerInterval {
+		t.Errorf("scheduler with zero interval polls every %v, want %v", s.avgInterval, defaultSchedulerInterval)
+	}
+
+	b := &countingBroker{}
+	s := newScheduler(testLogger, b, nil, 10*time.Millisecond, defaultQueueConfig)
+	var wg sync.WaitGroup
+	s.start(&wg)
+	time.Sleep(100 * time.Millisecond)
+	s.terminate()
+	wg.Wait()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.calls < 3 {
+		t.Errorf("scheduler polling every 10ms called CheckAndEnqueue %d times in 100ms, want at least 3", b.calls)
+	}
+}
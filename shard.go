@@ -0,0 +1,126 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// shardQueue returns the name of the queue which holds the given shard
+// of a queue.
+func shardQueue(qname string, shard int) string {
+	return qname + "#" + strconv.Itoa(shard)
+}
+
+// logicalQueue returns the name of the queue which the given queue is
+// a shard of, or the name itself if it's not a shard.
+func logicalQueue(qname string) string {
+	if shardIndex(qname) < 0 {
+		return qname
+	}
+	return qname[:strings.LastIndexByte(qname, '#')]
+}
+
+// shardIndex returns the shard of the queue the given queue holds,
+// or -1 if it's not a shard.
+func shardIndex(qname string) int {
+	i := strings.LastIndexByte(qname, '#')
+	if i < 0 {
+		return -1
+	}
+	n, err := strconv.Atoi(qname[i+1:])
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// queueShards holds the number of shards of the sharded queues by name.
+//
+// The shards of a queue in a region are looked up by the name of the queue
+// without the region, so that a queue is sharded the same way in every
+// region.
+type queueShards map[string]int
+
+// newQueueShards returns the shards of the queues with more than one shard,
+// or nil if no queue is sharded.
+func newQueueShards(shards map[string]int) queueShards {
+	var res queueShards
+	for qname, n := range shards {
+		if n < 2 {
+			continue
+		}
+		if res == nil {
+			res = make(queueShards)
+		}
+		res[strings.ToLower(qname)] = n
+	}
+	return res
+}
+
+// count returns the number of shards of the queue, zero if it's not sharded.
+func (s queueShards) count(qname string) int {
+	if len(s) == 0 {
+		return 0
+	}
+	if i := strings.IndexByte(qname, '@'); i >= 0 {
+		qname = qname[:i]
+	}
+	return s[qname]
+}
+
+// pick returns the name of a random shard of the queue, or the name of
+// the queue if it's not sharded.
+func (s queueShards) pick(qname string) string {
+	n := s.count(qname)
+	if n == 0 {
+		return qname
+	}
+	return shardQueue(qname, rand.Intn(n))
+}
+
+// expand returns the queue names with each sharded queue replaced by its
+// shards. The shards are rotated from a random one in each call, so that
+// they're consumed evenly.
+func (s queueShards) expand(qnames []string) []string {
+	if len(s) == 0 {
+		return qnames
+	}
+	res := make([]string, 0, len(qnames))
+	for _, qname := range qnames {
+		n := s.count(qname)
+		if n == 0 {
+			res = append(res, qname)
+			continue
+		}
+		first := rand.Intn(n)
+		for i := 0; i < n; i++ {
+			res = append(res, shardQueue(qname, (first+i)%n))
+		}
+	}
+	return res
+}
+
+// expandConfig returns a copy of the queue config with each sharded queue
+// replaced by its shards with the same priority.
+func (s queueShards) expandConfig(queues map[string]int) map[string]int {
+	if len(s) == 0 {
+		return queues
+	}
+	res := make(map[string]int)
+	for qname, p := range queues {
+		n := s.count(qname)
+		if n == 0 {
+			res[qname] = p
+			continue
+		}
+		for i := 0; i < n; i++ {
+			res[shardQueue(qname, i)] = p
+		}
+	}
+	return res
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLogicalQueue(t *testing.T) {
+	tests := []struct {
+		qname string
+		want  string
+	}{
+		{"default", "default"},
+		{"default#3", "default"},
+		{"email@eu#0", "email@eu"},
+		{"order#123#1", "order#123"},
+		{"order#next", "order#next"},
+	}
+	for _, tc := range tests {
+		if got := logicalQueue(tc.qname); got != tc.want {
+			t.Errorf("logicalQueue(%q) = %q, want %q", tc.qname, got, tc.want)
+		}
+	}
+}
+
+func TestQueueShards(t *testing.T) {
+	if s := newQueueShards(map[string]int{"default": 1, "low": 0}); s != nil {
+		t.Errorf("newQueueShards without sharded queues = %v, want nil", s)
+	}
+	s := newQueueShards(map[string]int{"Critical": 3, "default": 1})
+	if diff := cmp.Diff(queueShards{"critical": 3}, s); diff != "" {
+		t.Errorf("newQueueShards returned %v; (-want,+got)\n%s", s, diff)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		seen[s.pick("critical")] = true
+	}
+	if diff := cmp.Diff(map[string]bool{"critical#0": true, "critical#1": true, "critical#2": true}, seen); diff != "" {
+		t.Errorf("picked shards %v; (-want,+got)\n%s", seen, diff)
+	}
+	if got := s.pick("critical@eu"); got != "critical@eu#0" && got != "critical@eu#1" && got != "critical@eu#2" {
+		t.Errorf("pick(%q) = %q, want a shard of the queue in the region", "critical@eu", got)
+	}
+	if got := s.pick("default"); got != "default" {
+		t.Errorf("pick(%q) = %q, want %q", "default", got, "default")
+	}
+
+	got := s.expand([]string{"critical", "default"})
+	if len(got) != 4 || got[3] != "default" {
+		t.Fatalf("expand returned %v, want the shards of critical followed by default", got)
+	}
+	// shards are rotated from a random one.
+	first := -1
+	for i := 0; i < 3; i++ {
+		if got[0] == shardQueue("critical", i) {
+			first = i
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if want := shardQueue("critical", (first+i)%3); first < 0 || got[i] != want {
+			t.Errorf("expand returned %v, want shard %q at %d", got, want, i)
+		}
+	}
+
+	cfg := s.expandConfig(map[string]int{"critical": 6, "default": 3})
+	want := map[string]int{"critical#0": 6, "critical#1": 6, "critical#2": 6, "default": 3}
+	if diff := cmp.Diff(want, cfg); diff != "" {
+		t.Errorf("expandConfig returned %v; (-want,+got)\n%s", cfg, diff)
+	}
+}
+
+func TestClientQueueShards(t *testing.T) {
+	b := &recordingBroker{}
+	client := NewClientWithBroker(b)
+	client.shards = newQueueShards(map[string]int{"critical": 2})
+
+	task := NewTask("send_email", nil)
+	for i := 0; i < 50; i++ {
+		if _, err := client.Schedule(task, time.Now(), Queue("critical")); err != nil {
+			t.Fatalf("(*Client).Schedule returned error: %v", err)
+		}
+	}
+	if _, err := client.Schedule(task, time.Now()); err != nil {
+		t.Fatalf("(*Client).Schedule returned error: %v", err)
+	}
+
+	counts := make(map[string]int)
+	for _, msg := range b.enqueued {
+		counts[msg.Queue]++
+	}
+	var qnames []string
+	for qname := range counts {
+		qnames = append(qnames, qname)
+	}
+	sort.Strings(qnames)
+	if diff := cmp.Diff([]string{"critical#0", "critical#1", "default"}, qnames); diff != "" {
+		t.Errorf("tasks enqueued to %v; (-want,+got)\n%s", counts, diff)
+	}
+}
+
+func TestLogicalQueueSizes(t *testing.T) {
+	sizes := map[string]int{"default": 1, "critical#0": 2, "critical#1": 3, "order#next": 4}
+	want := map[string]int{"default": 1, "critical": 5, "order#next": 4}
+	if diff := cmp.Diff(want, logicalQueueSizes(sizes)); diff != "" {
+		t.Errorf("logicalQueueSizes(%v) mismatch; (-want,+got)\n%s", sizes, diff)
+	}
+}
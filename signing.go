@@ -0,0 +1,162 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// Signing specifies the keys to sign the task messages with HMAC-SHA256,
+// so that tasks written to redis by anyone without the key (e.g. a
+// compromised producer or a stray script) are not processed.
+//
+// A Client signs the ID, type, and payload of each task as stored in redis.
+// Backgrounds verify the signature of each task before processing it, and
+// move the tasks whose signature is missing or invalid to the dead queue
+// without calling the handler. Retries of a task keep the signature.
+//
+// The other fields of a task, including its queue, timeout, and deadline,
+// are not signed. Anyone with write access to redis can replay a signed task
+// into another queue or change how long it may run, and the task still
+// passes verification.
+//
+// Tasks whose type or payload is rewritten by Inspector.RenameTaskType or
+// Inspector.UpdateTaskPayload are not signed again, and fail verification;
+// use TypeAliases to rename the types of signed tasks.
+type Signing struct {
+	// Key specifies the key to sign the task messages with.
+	Key []byte
+
+	// PreviousKeys specifies the keys the tasks in redis may have been
+	// signed with before the key was rotated. Backgrounds accept the tasks
+	// signed with any of them. Clients ignore them.
+	PreviousKeys [][]byte
+
+	// Queues specifies the names of the queues whose tasks are verified
+	// by the backgrounds. Clients sign the tasks of all the queues.
+	//
+	// If empty, the tasks of all the queues are verified.
+	Queues []string
+}
+
+// errInvalidSignature indicates that a task was not signed by a client
+// with the key.
+var errInvalidSignature = errors.New("asynq: missing or invalid task signature")
+
+// signTask sets the signature of the message.
+func signTask(s *Signing, msg *base.TaskMessage) error {
+	if s == nil {
+		return nil
+	}
+	data, err := signedData(msg, true)
+	if err != nil {
+		return fmt.Errorf("asynq: could not sign task: %v", err)
+	}
+	msg.Signature = sign(s.Key, data)
+	return nil
+}
+
+// verify returns errInvalidSignature if the message is in a queue to
+// verify, and it's not signed with one of the keys.
+func (s *Signing) verify(msg *base.TaskMessage) error {
+	if s == nil || !s.verifies(msg.Queue) {
+		return nil
+	}
+	data, err := signedData(msg, false)
+	if err != nil {
+		return errInvalidSignature
+	}
+	for _, key := range append([][]byte{s.Key}, s.PreviousKeys...) {
+		if hmac.Equal(msg.Signature, sign(key, data)) {
+			return nil
+		}
+	}
+	return errInvalidSignature
+}
+
+// verifies reports whether the tasks in the queue should be verified.
+func (s *Signing) verifies(qname string) bool {
+	if len(s.Queues) == 0 {
+		return true
+	}
+	for _, q := range s.Queues {
+		if strings.EqualFold(q, qname) {
+			return true
+		}
+	}
+	return false
+}
+
+func sign(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// signedData returns the fields of the message covered by the signature,
+// each prefixed with its length.
+//
+// Map payloads are signed in JSON. Since numbers in the payloads are
+// decoded as float64 from redis, the client normalizes the payload as
+// decoded before signing it.
+func signedData(msg *base.TaskMessage, normalize bool) ([]byte, error) {
+	var buf bytes.Buffer
+	write := func(b []byte) {
+		var n [binary.MaxVarintLen64]byte
+		buf.Write(n[:binary.PutUvarint(n[:], uint64(len(b)))])
+		buf.Write(b)
+	}
+	write(msg.ID.Bytes())
+	write([]byte(msg.Type))
+	payload := msg.Data
+	if payload == nil && len(msg.Payload) > 0 {
+		var err error
+		if payload, err = json.Marshal(msg.Payload); err != nil {
+			return nil, err
+		}
+		if normalize {
+			var m map[string]interface{}
+			if err := json.Unmarshal(payload, &m); err != nil {
+				return nil, err
+			}
+			if payload, err = json.Marshal(m); err != nil {
+				return nil, err
+			}
+		}
+	}
+	write(payload)
+	write([]byte(msg.Codec))
+	write([]byte(msg.Compression))
+	write([]byte(msg.KeyID))
+	// Fields added later are signed only if set, to keep the signatures
+	// of the tasks signed before valid. The content type is signed along
+	// with the headers, so that the fields can't be mistaken for each other.
+	if msg.ContentType != "" || msg.ContentEncoding != "" || len(msg.Headers) > 0 {
+		write([]byte(msg.ContentType))
+		write([]byte(msg.ContentEncoding))
+	}
+	if len(msg.Headers) > 0 {
+		keys := make([]string, 0, len(msg.Headers))
+		for k := range msg.Headers {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			write([]byte(k))
+			write([]byte(msg.Headers[k]))
+		}
+	}
+	return buf.Bytes(), nil
+}
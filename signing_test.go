@@ -0,0 +1,166 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+var (
+	signingKey    = []byte("current signing key")
+	oldSigningKey = []byte("previous signing key")
+)
+
+// scheduleSigned schedules the task with a client signing the tasks with
+// the key, and returns the message as read back from redis.
+func scheduleSigned(t *testing.T, cfg *ClientConfig, task *Task, enc base.MessageEncoding) *base.TaskMessage {
+	t.Helper()
+	b := &recordingBroker{}
+	client := &Client{
+		rdb:         sharedBroker{b},
+		encoding:    enc,
+		compression: cfg.Compression,
+		encryption:  cfg.Encryption,
+		signing:     cfg.Signing,
+	}
+	if _, err := client.Schedule(task, time.Now(), Queue("payments")); err != nil {
+		t.Fatalf("Schedule returned error: %v", err)
+	}
+	data, err := base.EncodeMessage(b.enqueued[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := base.DecodeMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestSigningVerify(t *testing.T) {
+	tests := []struct {
+		desc string
+		cfg  *ClientConfig
+		task *Task
+	}{
+		{
+			desc: "payload",
+			cfg:  &ClientConfig{Signing: &Signing{Key: signingKey}},
+			task: NewTask("charge_card", map[string]interface{}{"user_id": 42, "amount": 12.5, "items": []string{"a", "b"}}),
+		},
+		{
+			desc: "empty payload",
+			cfg:  &ClientConfig{Signing: &Signing{Key: signingKey}},
+			task: NewTask("charge_card", map[string]interface{}{}),
+		},
+		{
+			desc: "binary payload",
+			cfg:  &ClientConfig{Signing: &Signing{Key: signingKey}},
+			task: NewBinaryTask("charge_card", []byte{0x01, 0x02}),
+		},
+		{
+			desc: "encrypted payload",
+			cfg: &ClientConfig{
+				Signing:    &Signing{Key: signingKey},
+				Encryption: &Encryption{KeyID: "2020-06", Keys: map[string][]byte{"2020-06": newKey}},
+			},
+			task: NewTask("charge_card", map[string]interface{}{"user_id": 42}),
+		},
+		{
+			desc: "signed with previous key",
+			cfg:  &ClientConfig{Signing: &Signing{Key: oldSigningKey}},
+			task: NewTask("charge_card", map[string]interface{}{"user_id": 42}),
+		},
+	}
+
+	s := &Signing{Key: signingKey, PreviousKeys: [][]byte{oldSigningKey}}
+	for _, tc := range tests {
+		for _, enc := range []base.MessageEncoding{base.JSONEncoding, base.ProtobufEncoding} {
+			msg := scheduleSigned(t, tc.cfg, tc.task, enc)
+			if err := s.verify(msg); err != nil {
+				t.Errorf("%s (encoding %d): verify returned error: %v", tc.desc, enc, err)
+			}
+			// The signature is kept when the task is retried.
+			msg.Retried++
+			msg.ErrorMsg = "card declined"
+			if err := s.verify(msg); err != nil {
+				t.Errorf("%s (encoding %d): verify of retried task returned error: %v", tc.desc, enc, err)
+			}
+		}
+	}
+}
+
+func TestSigningRejectsForgedTasks(t *testing.T) {
+	s := &Signing{Key: signingKey}
+	signed := func() *base.TaskMessage {
+		return scheduleSigned(t, &ClientConfig{Signing: &Signing{Key: signingKey}}, NewTask("charge_card", map[string]interface{}{"amount": 10}), base.JSONEncoding)
+	}
+	tests := []struct {
+		desc   string
+		forge  func(msg *base.TaskMessage)
+		verify *Signing
+	}{
+		{"unsigned", func(msg *base.TaskMessage) { msg.Signature = nil }, s},
+		{"payload changed", func(msg *base.TaskMessage) { msg.Payload["amount"] = 1000.0 }, s},
+		{"type changed", func(msg *base.TaskMessage) { msg.Type = "refund" }, s},
+		{"headers changed", func(msg *base.TaskMessage) { msg.Headers = map[string]string{"tenant-id": "acme"} }, s},
+		{"copied to another task", func(msg *base.TaskMessage) { msg.ID = h.NewTaskMessage("charge_card", nil).ID }, s},
+		{"signed with another key", func(msg *base.TaskMessage) {}, &Signing{Key: []byte("another key")}},
+	}
+
+	for _, tc := range tests {
+		msg := signed()
+		tc.forge(msg)
+		if err := tc.verify.verify(msg); err != errInvalidSignature {
+			t.Errorf("%s: verify returned error %v, want %v", tc.desc, err, errInvalidSignature)
+		}
+	}
+
+	// Tasks in the queues not to verify are accepted.
+	unsigned := h.NewTaskMessageWithQueue("send_email", nil, "low")
+	if err := (&Signing{Key: signingKey, Queues: []string{"payments"}}).verify(unsigned); err != nil {
+		t.Errorf("verify of task in a queue not to verify returned error: %v", err)
+	}
+}
+
+func TestProcessorRejectsUnsignedTasks(t *testing.T) {
+	b := &earlyAckBroker{}
+	workerCh := make(chan int)
+	go fakeHeartbeater(workerCh)
+	defer close(workerCh)
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            b,
+		queues:         defaultQueueConfig,
+		concurrency:    1,
+		retryDelayFunc: defaultDelayFunc,
+		workerCh:       workerCh,
+		cancelations:   base.NewCancelations(),
+		signing:        &Signing{Key: signingKey},
+	})
+	p.handler = HandlerFunc(func(ctx context.Context, task *Task) error {
+		b.record("process")
+		return nil
+	})
+
+	p.dispatch(scheduleSigned(t, &ClientConfig{Signing: &Signing{Key: signingKey}}, NewTask("charge_card", nil), base.JSONEncoding))
+	p.dispatch(h.NewTaskMessage("charge_card", nil))
+	// wait for the worker to finish.
+	p.sema <- struct{}{}
+	<-p.sema
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	want := []string{"process", "done", "kill"}
+	if diff := cmp.Diff(want, b.events); diff != "" {
+		t.Errorf("broker received %v, want %v; (-want,+got)\n%s", b.events, want, diff)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// SimulatedTaskType is the prefix of the types of the synthetic tasks
+// created with NewSimulatedTask, followed by the simulated task type
+// (e.g. "asynq:simulate:send_email").
+const SimulatedTaskType = "asynq:simulate:"
+
+// SimulatedWork describes the work a background with Simulation enabled
+// performs for a simulated task.
+type SimulatedWork struct {
+	// Duration specifies how long the task takes to process.
+	Duration time.Duration
+
+	// FailureRate specifies the probability between 0 and 1 of the task
+	// failing, in which case it's retried like any other task.
+	FailureRate float64
+
+	// PayloadSize specifies the number of bytes to pad the payload with,
+	// to simulate the size of the real tasks.
+	PayloadSize int
+}
+
+// errSimulatedFailure is returned for the simulated tasks which fail.
+var errSimulatedFailure = errors.New("simulated failure")
+
+// NewSimulatedTask returns a synthetic task of the given type, which a
+// background with Simulation enabled processes by waiting for the duration
+// of the work instead of calling the handler.
+//
+// Simulated tasks are recorded like any other task, so the throughput and
+// the latencies of a fleet can be measured with Inspector.CurrentStats and
+// Inspector.Latencies.
+func NewSimulatedTask(typename string, w SimulatedWork) *Task {
+	payload := map[string]interface{}{
+		"duration":     w.Duration.String(),
+		"failure_rate": w.FailureRate,
+	}
+	if w.PayloadSize > 0 {
+		payload["padding"] = strings.Repeat("x", w.PayloadSize)
+	}
+	return NewTask(SimulatedTaskType+typename, payload)
+}
+
+// isSimulated reports whether the task was created with NewSimulatedTask.
+func isSimulated(task *Task) bool {
+	return strings.HasPrefix(task.Type, SimulatedTaskType)
+}
+
+// simulate performs the work described in the payload of the simulated task.
+func simulate(ctx context.Context, task *Task) error {
+	d, err := task.Payload.GetDuration("duration")
+	if err != nil {
+		return err
+	}
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	rate, err := task.Payload.GetFloat64("failure_rate")
+	if err == nil && rand.Float64() < rate {
+		return errSimulatedFailure
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+func TestProcessorSimulation(t *testing.T) {
+	tests := []struct {
+		desc       string
+		simulation bool
+		work       SimulatedWork
+		want       []string
+	}{
+		{"simulated", true, SimulatedWork{Duration: time.Millisecond}, []string{"done"}},
+		{"simulated failure", true, SimulatedWork{FailureRate: 1}, []string{"retry"}},
+		{"simulation disabled", false, SimulatedWork{}, []string{"process", "done"}},
+	}
+
+	for _, tc := range tests {
+		b := &earlyAckBroker{}
+		workerCh := make(chan int)
+		go fakeHeartbeater(workerCh)
+		p := newProcessor(processorParams{
+			logger:         testLogger,
+			rdb:            b,
+			queues:         defaultQueueConfig,
+			concurrency:    1,
+			retryDelayFunc: defaultDelayFunc,
+			workerCh:       workerCh,
+			cancelations:   base.NewCancelations(),
+			simulation:     tc.simulation,
+		})
+		p.handler = HandlerFunc(func(ctx context.Context, task *Task) error {
+			b.record("process")
+			return nil
+		})
+		task := NewSimulatedTask("send_email", tc.work)
+		msg := h.NewTaskMessage(task.Type, task.Payload.data)
+
+		p.dispatch(msg)
+		// wait for the worker to finish.
+		p.sema <- struct{}{}
+		<-p.sema
+
+		b.mu.Lock()
+		if diff := cmp.Diff(tc.want, b.events); diff != "" {
+			t.Errorf("%s: broker received %v, want %v; (-want,+got)\n%s", tc.desc, b.events, tc.want, diff)
+		}
+		b.mu.Unlock()
+		close(workerCh)
+	}
+}
+
+func TestNewSimulatedTask(t *testing.T) {
+	task := NewSimulatedTask("send_email", SimulatedWork{Duration: 50 * time.Millisecond, PayloadSize: 10})
+	if want := "asynq:simulate:send_email"; task.Type != want {
+		t.Errorf("NewSimulatedTask returned task of type %q, want %q", task.Type, want)
+	}
+	if !isSimulated(task) {
+		t.Errorf("isSimulated(%q) = false, want true", task.Type)
+	}
+	if d, err := task.Payload.GetDuration("duration"); err != nil || d != 50*time.Millisecond {
+		t.Errorf("duration = %v, %v; want %v", d, err, 50*time.Millisecond)
+	}
+	if s, _ := task.Payload.GetString("padding"); len(s) != 10 {
+		t.Errorf("padding has %d bytes, want 10", len(s))
+	}
+	if isSimulated(NewTask("send_email", nil)) {
+		t.Errorf("isSimulated(%q) = true, want false", "send_email")
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import "strings"
+
+// SlowRetry specifies a policy to move chronically failing tasks to
+// a low priority queue, so that they don't keep taking workers from
+// the other tasks while they are retried.
+type SlowRetry struct {
+	// After specifies the number of retries after which a task is moved
+	// to the slow retry queue. A task is moved when it's retried for the
+	// After-th time, and stays in the queue for its remaining retries.
+	//
+	// If zero or negative, tasks are not moved.
+	After int
+
+	// Queue specifies the name of the slow retry queue.
+	//
+	// If empty, "slow_retry" is used.
+	Queue string
+
+	// Weight specifies the priority of the slow retry queue, which is
+	// processed by the background in addition to Queues of Config, in
+	// each of Regions of Config if set.
+	// Weight is ignored if Queues of Config has the queue.
+	//
+	// If zero or negative, the weight is set to 1.
+	Weight int
+
+	// regional is true if the background processes Regions, in which case
+	// the slow retry queue is processed in each region, and tasks are moved
+	// to the slow retry queue of their regions.
+	regional bool
+}
+
+// defaultSlowRetryQueue is the name of the slow retry queue
+// if none is specified.
+const defaultSlowRetryQueue = "slow_retry"
+
+// normalize returns a copy of the policy with the defaults applied,
+// or nil if the policy doesn't move tasks.
+func (s *SlowRetry) normalize() *SlowRetry {
+	if s == nil || s.After <= 0 {
+		return nil
+	}
+	res := *s
+	res.Queue = strings.ToLower(res.Queue)
+	if res.Queue == "" {
+		res.Queue = defaultSlowRetryQueue
+	}
+	if res.Weight <= 0 {
+		res.Weight = 1
+	}
+	return &res
+}
+
+// queue returns the queue to retry the task in, given the number of
+// times the task has been retried so far.
+func (s *SlowRetry) queue(qname string, retried int) string {
+	if s == nil || retried+1 < s.After {
+		return qname
+	}
+	if s.regional {
+		if i := strings.LastIndex(qname, "@"); i >= 0 {
+			return regionQueue(s.Queue, qname[i+1:])
+		}
+	}
+	return s.Queue
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// retryQueueBroker records the queues tasks are retried in.
+type retryQueueBroker struct {
+	base.Broker
+	queues []string
+}
+
+func (b *retryQueueBroker) RetryInQueue(msg *base.TaskMessage, qname string, processAt time.Time, errMsg string) error {
+	b.queues = append(b.queues, qname)
+	return nil
+}
+
+func TestProcessorSlowRetry(t *testing.T) {
+	b := &retryQueueBroker{}
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            b,
+		queues:         defaultQueueConfig,
+		concurrency:    1,
+		retryDelayFunc: func(n int, e error, t *Task) time.Duration { return time.Minute },
+		cancelations:   base.NewCancelations(),
+		slowRetry:      (&SlowRetry{After: 3}).normalize(),
+	})
+
+	msg := h.NewTaskMessage("send_email", nil)
+	for retried := 0; retried < 4; retried++ {
+		msg.Retried = retried
+		p.retry(msg, errors.New("SMTP server not responding"))
+	}
+
+	want := []string{"default", "default", "slow_retry", "slow_retry"}
+	if diff := cmp.Diff(want, b.queues); diff != "" {
+		t.Errorf("tasks retried in queues %v, want %v; (-want,+got)\n%s", b.queues, want, diff)
+	}
+}
+
+func TestProcessorSlowRetryInRegions(t *testing.T) {
+	b := &retryQueueBroker{}
+	slowRetry := (&SlowRetry{After: 1}).normalize()
+	slowRetry.regional = true
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            b,
+		queues:         regionQueues(defaultQueueConfig, []string{"eu", "us"}),
+		concurrency:    1,
+		retryDelayFunc: func(n int, e error, t *Task) time.Duration { return time.Minute },
+		cancelations:   base.NewCancelations(),
+		slowRetry:      slowRetry,
+	})
+
+	for _, qname := range []string{"default@eu", "default@us"} {
+		msg := h.NewTaskMessage("send_email", nil)
+		msg.Queue = qname
+		p.retry(msg, errors.New("SMTP server not responding"))
+	}
+
+	want := []string{"slow_retry@eu", "slow_retry@us"}
+	if diff := cmp.Diff(want, b.queues); diff != "" {
+		t.Errorf("tasks retried in queues %v, want %v; (-want,+got)\n%s", b.queues, want, diff)
+	}
+}
+
+func TestSlowRetryNormalize(t *testing.T) {
+	tests := []struct {
+		policy *SlowRetry
+		want   *SlowRetry
+	}{
+		{nil, nil},
+		{&SlowRetry{After: 0, Queue: "slow"}, nil},
+		{&SlowRetry{After: 5}, &SlowRetry{After: 5, Queue: "slow_retry", Weight: 1}},
+		{&SlowRetry{After: 5, Queue: "Slow", Weight: 2}, &SlowRetry{After: 5, Queue: "slow", Weight: 2}},
+	}
+
+	for _, tc := range tests {
+		got := tc.policy.normalize()
+		if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(SlowRetry{})); diff != "" {
+			t.Errorf("(%+v).normalize() = %+v, want %+v; (-want,+got)\n%s", tc.policy, got, tc.want, diff)
+		}
+	}
+}
+
+func TestWithQueue(t *testing.T) {
+	got := withQueue(defaultQueueConfig, "slow_retry", 1)
+	want := map[string]int{"default": 1, "slow_retry": 1}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("withQueue returned %v, want %v; (-want,+got)\n%s", got, want, diff)
+	}
+	if len(defaultQueueConfig) != 1 {
+		t.Errorf("withQueue modified the given queues: %v", defaultQueueConfig)
+	}
+
+	// The weight of a queue already given is not changed.
+	got = withQueue(map[string]int{"slow_retry": 3}, "slow_retry", 1)
+	want = map[string]int{"slow_retry": 3}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("withQueue returned %v, want %v; (-want,+got)\n%s", got, want, diff)
+	}
+}
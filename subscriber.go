@@ -8,11 +8,11 @@ import (
 	"sync"
 
 	"github.com/hibiken/asynq/internal/base"
-	"github.com/hibiken/asynq/internal/rdb"
 )
 
 type subscriber struct {
-	rdb *rdb.RDB
+	logger *asynqLogger
+	rdb    base.Broker
 
 	// channel to communicate back to the long running "subscriber" goroutine.
 	done chan struct{}
@@ -21,8 +21,9 @@ type subscriber struct {
 	cancelations *base.Cancelations
 }
 
-func newSubscriber(rdb *rdb.RDB, cancelations *base.Cancelations) *subscriber {
+func newSubscriber(logger *asynqLogger, rdb base.Broker, cancelations *base.Cancelations) *subscriber {
 	return &subscriber{
+		logger:       logger,
 		rdb:          rdb,
 		done:         make(chan struct{}),
 		cancelations: cancelations,
@@ -30,18 +31,18 @@ func newSubscriber(rdb *rdb.RDB, cancelations *base.Cancelations) *subscriber {
 }
 
 func (s *subscriber) terminate() {
-	logger.info("Subscriber shutting down...")
+	s.logger.debug("Subscriber shutting down...")
 	// Signal the subscriber goroutine to stop.
 	s.done <- struct{}{}
 }
 
 func (s *subscriber) start(wg *sync.WaitGroup) {
 	pubsub, err := s.rdb.CancelationPubSub()
-	cancelCh := pubsub.Channel()
 	if err != nil {
-		logger.error("cannot subscribe to cancelation channel: %v", err)
+		s.logger.error("cannot subscribe to cancelation channel: %v", err)
 		return
 	}
+	cancelCh := pubsub.Channel()
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -49,10 +50,10 @@ func (s *subscriber) start(wg *sync.WaitGroup) {
 			select {
 			case <-s.done:
 				pubsub.Close()
-				logger.info("Subscriber done")
+				s.logger.debug("Subscriber done")
 				return
-			case msg := <-cancelCh:
-				cancel := s.cancelations.Get(msg.Payload)
+			case id := <-cancelCh:
+				cancel := s.cancelations.Get(id)
 				if cancel != nil {
 					cancel()
 				}
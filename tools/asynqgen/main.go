@@ -0,0 +1,285 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+// Asynqgen generates typed functions to schedule and handle the tasks whose
+// payloads are defined by the structs of a package, so that the type names
+// and the payload shapes stay in sync between the producers and consumers.
+//
+// A struct is a task payload if its doc comment has an asynq:task line
+// with the type name of the task:
+//
+//	//asynq:task send_email
+//	type SendEmailPayload struct {
+//	    To      string `json:"to"`
+//	    Subject string `json:"subject"`
+//	}
+//
+// For each of them, asynqgen generates a TypeX constant with the type name,
+// a NewXTask function to create a task with the payload, and an EnqueueX
+// function to schedule it with a client, where X is the name of the struct
+// without the "Payload" suffix. It also generates TaskHandlers, a Handler
+// which decodes the payload of each task and passes it to the handler of
+// its type.
+//
+// The payloads are encoded by asynq.NewTaskFromStruct, whose numbers are
+// float64, so integers above 2^53 (e.g. int64 IDs) lose precision on the
+// way to the handler. Encode such fields as strings with the string option
+// of their JSON tag:
+//
+//	UserID int64 `json:"user_id,string"`
+//
+// Usage:
+//
+//	asynqgen [-o output] [dir]
+//
+// The code is generated from the package in dir, the current directory by
+// default, into the output file in the same directory, asynq_tasks.go by
+// default. It's meant to be run with go generate:
+//
+//	//go:generate asynqgen
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+)
+
+// directive marks the structs which are task payloads.
+const directive = "asynq:task"
+
+var output = flag.String("o", "asynq_tasks.go", "name of the generated file")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: asynqgen [-o output] [dir]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	dir := "."
+	if flag.NArg() > 0 {
+		dir = flag.Arg(0)
+	}
+	if err := run(dir, *output); err != nil {
+		fmt.Fprintf(os.Stderr, "asynqgen: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// task is a task type defined by a payload struct.
+type task struct {
+	TypeName string // type name of the task, e.g. "send_email"
+	Struct   string // name of the payload struct, e.g. "SendEmailPayload"
+	Name     string // name of the generated functions, e.g. "SendEmail"
+	Pos      token.Position
+}
+
+func run(dir, output string) error {
+	pkg, tasks, err := parse(dir, output)
+	if err != nil {
+		return err
+	}
+	if len(tasks) == 0 {
+		return fmt.Errorf("no structs with %s directive in %s", directive, dir)
+	}
+	src, err := generate(pkg, tasks)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, output), src, 0644)
+}
+
+// parse returns the name of the package in dir and the tasks defined in it,
+// ignoring test files and the output file.
+func parse(dir, output string) (string, []*task, error) {
+	fset := token.NewFileSet()
+	filter := func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go") && fi.Name() != output
+	}
+	pkgs, err := parser.ParseDir(fset, dir, filter, parser.ParseComments)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(pkgs) != 1 {
+		return "", nil, fmt.Errorf("found %d packages in %s, want 1", len(pkgs), dir)
+	}
+	var (
+		name  string
+		tasks []*task
+	)
+	for _, pkg := range pkgs {
+		name = pkg.Name
+		for _, f := range pkg.Files {
+			ts, err := fileTasks(fset, f)
+			if err != nil {
+				return "", nil, err
+			}
+			tasks = append(tasks, ts...)
+		}
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].TypeName < tasks[j].TypeName })
+	names := make(map[string]*task)
+	for i, t := range tasks {
+		if i > 0 && tasks[i-1].TypeName == t.TypeName {
+			return "", nil, fmt.Errorf("%v: task type %q is already defined at %v", t.Pos, t.TypeName, tasks[i-1].Pos)
+		}
+		if prev, ok := names[t.Name]; ok {
+			return "", nil, fmt.Errorf("%v: struct %s generates the same functions as %s at %v", t.Pos, t.Struct, prev.Struct, prev.Pos)
+		}
+		names[t.Name] = t
+	}
+	return name, tasks, nil
+}
+
+// fileTasks returns the tasks defined by the structs of the file.
+func fileTasks(fset *token.FileSet, f *ast.File) ([]*task, error) {
+	var tasks []*task
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			spec := spec.(*ast.TypeSpec)
+			doc := spec.Doc
+			if doc == nil && len(gen.Specs) == 1 {
+				doc = gen.Doc
+			}
+			typename, ok, err := taskType(doc)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", fset.Position(spec.Pos()), err)
+			}
+			if !ok {
+				continue
+			}
+			if _, ok := spec.Type.(*ast.StructType); !ok {
+				return nil, fmt.Errorf("%v: %s has %s directive but is not a struct", fset.Position(spec.Pos()), spec.Name.Name, directive)
+			}
+			tasks = append(tasks, &task{
+				TypeName: typename,
+				Struct:   spec.Name.Name,
+				Name:     funcName(spec.Name.Name),
+				Pos:      fset.Position(spec.Pos()),
+			})
+		}
+	}
+	return tasks, nil
+}
+
+// taskType returns the type name given by the directive in the comments,
+// and whether there is a directive.
+func taskType(doc *ast.CommentGroup) (string, bool, error) {
+	if doc == nil {
+		return "", false, nil
+	}
+	for _, c := range doc.List {
+		text := strings.TrimPrefix(c.Text, "//")
+		if !strings.HasPrefix(text, directive) {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(text, directive))
+		if len(fields) != 1 {
+			return "", false, errors.New("want the type name of the task after " + directive)
+		}
+		return fields[0], true, nil
+	}
+	return "", false, nil
+}
+
+// funcName returns the name of the functions generated for the struct,
+// the name of the struct without the "Payload" suffix and capitalized.
+func funcName(name string) string {
+	if s := strings.TrimSuffix(name, "Payload"); s != "" {
+		name = s
+	}
+	r, n := utf8.DecodeRuneInString(name)
+	return string(unicode.ToUpper(r)) + name[n:]
+}
+
+func generate(pkg string, tasks []*task) ([]byte, error) {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, struct {
+		Package string
+		Tasks   []*task
+	}{pkg, tasks})
+	if err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
+
+var tmpl = template.Must(template.New("").Parse(`// Code generated by asynqgen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// Type names of the tasks.
+const (
+{{- range .Tasks}}
+	Type{{.Name}} = {{printf "%q" .TypeName}}
+{{- end}}
+)
+{{range .Tasks}}
+// New{{.Name}}Task returns a new task of type {{printf "%q" .TypeName}} with the payload.
+func New{{.Name}}Task(p {{.Struct}}) (*asynq.Task, error) {
+	return asynq.NewTaskFromStruct(Type{{.Name}}, p)
+}
+
+// Enqueue{{.Name}} schedules a task of type {{printf "%q" .TypeName}} with the payload
+// to be processed immediately.
+func Enqueue{{.Name}}(c *asynq.Client, p {{.Struct}}, opts ...asynq.Option) (*asynq.TaskInfo, error) {
+	task, err := New{{.Name}}Task(p)
+	if err != nil {
+		return nil, err
+	}
+	return c.Schedule(task, time.Now(), opts...)
+}
+{{end}}
+// TaskHandlers is a Handler which decodes the payload of each task and
+// passes it to the handler of its type. Tasks of types without a handler
+// fail with an error.
+type TaskHandlers struct {
+{{- range .Tasks}}
+	{{.Name}} func(context.Context, {{.Struct}}) error
+{{- end}}
+}
+
+// ProcessTask implements asynq.Handler.
+func (h *TaskHandlers) ProcessTask(ctx context.Context, task *asynq.Task) error {
+	switch task.Type {
+{{- range .Tasks}}
+	case Type{{.Name}}:
+		if h.{{.Name}} == nil {
+			break
+		}
+		var p {{.Struct}}
+		if err := task.Payload.Bind(&p); err != nil {
+			return err
+		}
+		return h.{{.Name}}(ctx, p)
+{{- end}}
+	}
+	return fmt.Errorf("no handler for task type %q", task.Type)
+}
+`))
@@ -0,0 +1,102 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func TestGenerate(t *testing.T) {
+	dir := filepath.Join("testdata", "tasks")
+	pkg, tasks, err := parse(dir, "asynq_tasks.go")
+	if err != nil {
+		t.Fatalf("parse(%q) returned error: %v", dir, err)
+	}
+	var got []string
+	for _, task := range tasks {
+		got = append(got, task.TypeName+" "+task.Struct+" "+task.Name)
+	}
+	want := []string{
+		"image:resize ResizeImagePayload ResizeImage",
+		"report report Report",
+		"send_email SendEmailPayload SendEmail",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("parse(%q) returned tasks %q, want %q", dir, got, want)
+	}
+
+	src, err := generate(pkg, tasks)
+	if err != nil {
+		t.Fatalf("generate returned error: %v", err)
+	}
+	golden := filepath.Join(dir, "asynq_tasks.go.golden")
+	if *update {
+		if err := ioutil.WriteFile(golden, src, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src, data) {
+		t.Errorf("generated code differs from %s, run the test with -update to see the diff:\n%s", golden, src)
+	}
+}
+
+func TestGenerateCompiles(t *testing.T) {
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	// The package is built in a directory of the module, so that the
+	// generated code is compiled against this version of asynq.
+	dir, err := ioutil.TempDir("testdata", "build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, err := ioutil.ReadFile(filepath.Join("testdata", "tasks", "tasks.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "tasks.go"), src, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(dir, "asynq_tasks.go"); err != nil {
+		t.Fatalf("run(%q) returned error: %v", dir, err)
+	}
+	out, err := exec.Command(gobin, "vet", "./"+filepath.ToSlash(dir)).CombinedOutput()
+	if err != nil {
+		t.Errorf("generated code does not compile: %v\n%s", err, out)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		dir  string
+		want string // substring of the error
+	}{
+		{"duplicate", `task type "send_email" is already defined`},
+		{"samefunc", "generates the same functions as"},
+		{"nonstruct", "SendEmailPayload has asynq:task directive but is not a struct"},
+	}
+	for _, tc := range tests {
+		dir := filepath.Join("testdata", tc.dir)
+		_, _, err := parse(dir, "asynq_tasks.go")
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("parse(%q) returned error %v, want error containing %q", dir, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package duplicate
+
+//asynq:task send_email
+type SendEmailPayload struct {
+	To string `json:"to"`
+}
+
+//asynq:task send_email
+type SendEmailV2Payload struct {
+	To string `json:"to"`
+}
@@ -0,0 +1,4 @@
+package nonstruct
+
+//asynq:task send_email
+type SendEmailPayload map[string]interface{}
@@ -0,0 +1,11 @@
+package samefunc
+
+//asynq:task send_email
+type SendEmailPayload struct {
+	To string `json:"to"`
+}
+
+//asynq:task send_email:v2
+type SendEmail struct {
+	To string `json:"to"`
+}
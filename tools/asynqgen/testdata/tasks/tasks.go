@@ -0,0 +1,33 @@
+package tasks
+
+import "time"
+
+// SendEmailPayload is the payload of the tasks sending emails.
+//
+//asynq:task send_email
+type SendEmailPayload struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+}
+
+type (
+	//asynq:task image:resize
+	ResizeImagePayload struct {
+		URL    string `json:"url"`
+		Width  int    `json:"width"`
+		Height int    `json:"height"`
+	}
+
+	//asynq:task report
+	report struct {
+		From time.Time `json:"from"`
+	}
+
+	// options is not a payload.
+	options struct {
+		Verbose bool
+	}
+)
+
+// Limits is not a payload either.
+type Limits map[string]int
@@ -8,10 +8,7 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/go-redis/redis/v7"
-	"github.com/hibiken/asynq/internal/rdb"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 // cancelCmd represents the cancel command
@@ -38,16 +35,16 @@ func init() {
 }
 
 func cancel(cmd *cobra.Command, args []string) {
-	r := rdb.NewRDB(redis.NewClient(&redis.Options{
-		Addr:     viper.GetString("uri"),
-		DB:       viper.GetInt("db"),
-		Password: viper.GetString("password"),
-	}))
+	r := createRDB()
 
 	err := r.PublishCancelation(args[0])
 	if err != nil {
 		fmt.Printf("could not send cancelation signal: %v\n", err)
 		os.Exit(1)
 	}
+	if jsonOutput {
+		printJSON(map[string]string{"canceled": args[0]})
+		return
+	}
 	fmt.Printf("Successfully sent cancelation siganl for task %s\n", args[0])
 }
@@ -0,0 +1,86 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// compactCmd represents the compact command
+var compactCmd = &cobra.Command{
+	Use:   "compact",
+	Short: "Rewrites large queues and task sets to reclaim redis memory",
+	Long: `Compact (asynqmon compact) will rewrite the queues and the scheduled, retry,
+dead, and completed task sets into fresh keys, to reclaim the memory redis keeps
+fragmented after a large backlog has drained. It reports the memory used by
+each key and by redis before and after.
+
+Each key is rewritten atomically, and redis doesn't serve other clients while
+a key is rewritten. Keys with fewer elements than --min-len are not worth
+rewriting, and keys with more elements than --max-len are skipped to keep
+the pause brief.
+
+Use --dry-run flag to see the keys to compact without rewriting them.
+
+Example: asynqmon compact --min-len=100 --dry-run`,
+	Args: cobra.NoArgs,
+	Run:  compact,
+}
+
+// Flags
+var (
+	compactMinLen int64
+	compactMaxLen int64
+	compactDryRun bool
+)
+
+func init() {
+	rootCmd.AddCommand(compactCmd)
+	compactCmd.Flags().Int64Var(&compactMinLen, "min-len", 1, "minimum number of elements of the keys to compact")
+	compactCmd.Flags().Int64Var(&compactMaxLen, "max-len", 1000000, "maximum number of elements of the keys to compact, zero for no limit")
+	compactCmd.Flags().BoolVar(&compactDryRun, "dry-run", false, "report the keys to compact without rewriting them")
+}
+
+func compact(cmd *cobra.Command, args []string) {
+	r := createRDB()
+
+	res, err := r.Compact(compactMinLen, compactMaxLen, compactDryRun)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printJSON(res)
+		return
+	}
+	for _, key := range res.Skipped {
+		fmt.Printf("Skipped key %q longer than %d elements\n", key, compactMaxLen)
+	}
+	if len(res.Keys) == 0 {
+		fmt.Println("No keys to compact")
+		return
+	}
+	if compactDryRun {
+		printTable([]string{"Key", "Length", "Memory"}, func(w io.Writer, tmpl string) {
+			for _, k := range res.Keys {
+				fmt.Fprintf(w, tmpl, k.Key, k.Len, k.Before)
+			}
+		})
+		fmt.Printf("\nWould compact %d keys\n", len(res.Keys))
+		return
+	}
+	printTable([]string{"Key", "Length", "Before", "After"}, func(w io.Writer, tmpl string) {
+		for _, k := range res.Keys {
+			fmt.Fprintf(w, tmpl, k.Key, k.Len, k.Before, k.After)
+		}
+	})
+	fmt.Printf("\nCompacted %d keys\n", len(res.Keys))
+	fmt.Printf("Used memory: %d -> %d bytes\n", res.UsedMemoryBefore, res.UsedMemoryAfter)
+	fmt.Printf("Fragmentation ratio: %.2f -> %.2f\n", res.FragmentationBefore, res.FragmentationAfter)
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+// costsCmd represents the costs command
+var costsCmd = &cobra.Command{
+	Use:   "costs",
+	Short: "Shows the costs reported by handlers",
+	Long: `Costs (asynqmon costs) will show the amounts of resources consumed by
+tasks from the last x days, as reported by handlers with asynq.AddCost.
+
+By default, costs are shown by task type. Use --dimension flag to show
+the costs by value of a rollup dimension instead.
+
+Example:
+asynqmon costs                  -> Shows today's costs by task type
+asynqmon costs -x=30 -d=team    -> Shows the costs from the last 30 days by team`,
+	Args: cobra.NoArgs,
+	Run:  showCosts,
+}
+
+var costsDays int
+var costsDimension string
+
+func init() {
+	rootCmd.AddCommand(costsCmd)
+	costsCmd.Flags().IntVarP(&costsDays, "days", "x", 1, "show costs from last x days")
+	costsCmd.Flags().StringVarP(&costsDimension, "dimension", "d", "", "rollup dimension to show the costs by")
+}
+
+func showCosts(cmd *cobra.Command, args []string) {
+	costs, err := createInspector().Costs(costsDays)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printJSON(costs)
+		return
+	}
+	col := "Type"
+	if costsDimension != "" {
+		col = "Value"
+	}
+	type row struct {
+		date, key, resource string
+		amount              float64
+	}
+	var rows []row
+	for _, day := range costs {
+		date := day.Time.Format("2006-01-02")
+		byKey := day.ByType
+		if costsDimension != "" {
+			byKey = day.ByDimension[costsDimension]
+		}
+		var dayRows []row
+		for key, amounts := range byKey {
+			for resource, amount := range amounts {
+				dayRows = append(dayRows, row{date, key, resource, amount})
+			}
+		}
+		sort.Slice(dayRows, func(i, j int) bool {
+			if dayRows[i].key != dayRows[j].key {
+				return dayRows[i].key < dayRows[j].key
+			}
+			return dayRows[i].resource < dayRows[j].resource
+		})
+		rows = append(rows, dayRows...)
+	}
+	if len(rows) == 0 {
+		fmt.Println("No costs reported")
+		return
+	}
+	printTable([]string{"Date (UTC)", col, "Resource", "Amount"}, func(w io.Writer, tmpl string) {
+		for _, r := range rows {
+			fmt.Fprintf(w, tmpl, r.date, r.key, r.resource, r.amount)
+		}
+	})
+}
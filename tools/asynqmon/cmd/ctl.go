@@ -0,0 +1,132 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/rs/xid"
+	"github.com/spf13/cobra"
+)
+
+var ctlValidCommands = []string{"quiet", "resume", "loglevel", "concurrency", "recover", "status"}
+
+// ctlCmd represents the ctl command
+var ctlCmd = &cobra.Command{
+	Use:   "ctl [command] [arg]",
+	Short: "Sends a command to all background worker processes",
+	Long: `Ctl (asynqmon ctl) will broadcast a command to all running background worker
+processes and print their replies.
+
+The first argument should be one of "quiet", "resume", "loglevel",
+"concurrency", "recover", or "status".
+
+* quiet:       stop pulling new tasks out of queues
+* resume:      resume pulling tasks out of queues
+* loglevel:    set log level to the given value ("debug", "info", "warn", or "error")
+* concurrency: set the number of concurrent workers to the given value
+               (up to the concurrency the process was started with)
+* recover:     mark the given dependency as recovered to resume retries
+               of the tasks depending on it
+* status:      report status
+
+Example:
+asynqmon ctl quiet          -> Stops all processes from processing new tasks
+asynqmon ctl concurrency 5  -> Sets concurrency of all processes to five
+asynqmon ctl recover smtp   -> Resumes retries of the tasks depending on "smtp"`,
+	Args: cobra.RangeArgs(1, 2),
+	Run:  ctl,
+}
+
+// Flags
+var ctlWait time.Duration
+
+func init() {
+	rootCmd.AddCommand(ctlCmd)
+	ctlCmd.Flags().DurationVar(&ctlWait, "wait", 2*time.Second, "how long to wait for replies")
+}
+
+func ctl(cmd *cobra.Command, args []string) {
+	msg := &base.ControlMessage{ID: xid.New().String(), Command: args[0]}
+	if len(args) > 1 {
+		msg.Arg = args[1]
+	}
+	switch msg.Command {
+	case "loglevel", "concurrency", "recover":
+		if msg.Arg == "" {
+			fmt.Printf("error: command %q requires an argument\n", msg.Command)
+			os.Exit(1)
+		}
+	case "quiet", "resume", "status":
+	default:
+		fmt.Printf("error: `asynqmon ctl [command]` only accepts %v as the command.\n", ctlValidCommands)
+		os.Exit(1)
+	}
+	r := createRDB()
+
+	// Subscribe before publishing to avoid missing any replies.
+	pubsub, err := r.ControlReplyPubSub(msg.ID)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer pubsub.Close()
+	if err := r.PublishControl(msg); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var replies []*base.ControlReply
+	replyCh := pubsub.Channel()
+	timeout := time.After(ctlWait)
+loop:
+	for {
+		select {
+		case m := <-replyCh:
+			var reply base.ControlReply
+			if err := json.Unmarshal([]byte(m.Payload), &reply); err != nil {
+				continue // skip bad data
+			}
+			replies = append(replies, &reply)
+		case <-timeout:
+			break loop
+		}
+	}
+
+	// sort by hostname and pid
+	sort.Slice(replies, func(i, j int) bool {
+		x, y := replies[i], replies[j]
+		if x.Host != y.Host {
+			return x.Host < y.Host
+		}
+		return x.PID < y.PID
+	})
+	if jsonOutput {
+		printJSON(replies)
+		return
+	}
+	if len(replies) == 0 {
+		fmt.Println("No replies")
+		return
+	}
+
+	cols := []string{"Host", "PID", "State", "Active Workers", "Log Level", "Error"}
+	printRows := func(w io.Writer, tmpl string) {
+		for _, r := range replies {
+			fmt.Fprintf(w, tmpl,
+				r.Host, r.PID, r.State,
+				fmt.Sprintf("%d/%d", r.ActiveWorkerCount, r.Concurrency),
+				r.LogLevel, r.ErrorMsg)
+		}
+	}
+	printTable(cols, printRows)
+	fmt.Printf("\n%d processes replied\n", len(replies))
+}
@@ -0,0 +1,396 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/spf13/cobra"
+)
+
+// dashCmd represents the dash command
+var dashCmd = &cobra.Command{
+	Use:   "dash",
+	Short: "Shows a live dashboard of tasks, queues and processes",
+	Long: `Dash (asynqmon dash) will show a dashboard that refreshes the state of
+queues, worker processes and error rates periodically (similar to top).
+
+Keybindings:
+  1-9      drill into the n-th queue (from overview) or inspect the n-th task (from task list)
+  i,s,r,d  list in-progress, scheduled, retry, or dead tasks
+  n,p      next or previous page of the task list
+  b        go back
+  q        quit
+
+Example: asynqmon dash --refresh=5s -> Refreshes the dashboard every five seconds`,
+	Args: cobra.NoArgs,
+	Run:  dash,
+}
+
+// Flags
+var dashRefresh time.Duration
+
+func init() {
+	rootCmd.AddCommand(dashCmd)
+	dashCmd.Flags().DurationVar(&dashRefresh, "refresh", 3*time.Second, "interval between refreshes")
+}
+
+// dashboard views
+const (
+	viewOverview = iota
+	viewTasks
+	viewTaskDetail
+)
+
+// dashPageSize is the number of tasks shown in a task list.
+// It's the number of tasks selectable with a single digit key.
+const dashPageSize = 9
+
+type dashboard struct {
+	r *rdb.RDB
+
+	view int
+
+	// queue names shown in overview, sorted by name.
+	qnames []string
+
+	// state of the tasks listed in task list view ("enqueued", "inprogress", etc).
+	state string
+	// queue to list tasks from if state is "enqueued".
+	qname string
+	page  int
+
+	// details of each task in the current task list.
+	details [][]string
+	// index of task to show in task detail view.
+	selected int
+}
+
+func dash(cmd *cobra.Command, args []string) {
+	if jsonOutput {
+		fmt.Println("dash command does not support --json flag.")
+		os.Exit(1)
+	}
+	if dashRefresh <= 0 {
+		fmt.Println("refresh interval should be positive.")
+		os.Exit(1)
+	}
+	d := &dashboard{
+		r: createRDB(),
+	}
+
+	restore := setCbreakMode()
+	defer restore()
+
+	keyCh := make(chan byte)
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keyCh)
+				return
+			}
+			if n > 0 {
+				keyCh <- buf[0]
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(dashRefresh)
+	defer ticker.Stop()
+	d.render()
+	for {
+		select {
+		case <-ticker.C:
+			d.render()
+		case key, ok := <-keyCh:
+			if !ok || key == 'q' {
+				return
+			}
+			d.handleKey(key)
+			d.render()
+		}
+	}
+}
+
+// setCbreakMode sets the terminal so that key presses are read without
+// waiting for a newline, and returns a function to restore the original
+// terminal settings. If the terminal cannot be configured, keys need to be
+// followed by enter.
+func setCbreakMode() (restore func()) {
+	saved, err := stty("-g")
+	if err != nil {
+		return func() {}
+	}
+	if _, err := stty("cbreak", "-echo"); err != nil {
+		return func() {}
+	}
+	return func() { stty(strings.TrimSpace(saved)) }
+}
+
+func stty(args ...string) (string, error) {
+	c := exec.Command("stty", args...)
+	c.Stdin = os.Stdin
+	out, err := c.Output()
+	return string(out), err
+}
+
+func (d *dashboard) handleKey(key byte) {
+	switch {
+	case key >= '1' && key <= '9':
+		i := int(key - '1')
+		switch d.view {
+		case viewOverview:
+			if i < len(d.qnames) {
+				d.listTasks("enqueued", d.qnames[i])
+			}
+		case viewTasks:
+			if i < len(d.details) {
+				d.selected = i
+				d.view = viewTaskDetail
+			}
+		}
+	case key == 'i':
+		d.listTasks("inprogress", "")
+	case key == 's':
+		d.listTasks("scheduled", "")
+	case key == 'r':
+		d.listTasks("retry", "")
+	case key == 'd':
+		d.listTasks("dead", "")
+	case key == 'n' && d.view == viewTasks:
+		d.page++
+	case key == 'p' && d.view == viewTasks && d.page > 0:
+		d.page--
+	case key == 'b':
+		switch d.view {
+		case viewTaskDetail:
+			d.view = viewTasks
+		case viewTasks:
+			d.view = viewOverview
+		}
+	}
+}
+
+func (d *dashboard) listTasks(state, qname string) {
+	d.view = viewTasks
+	d.state = state
+	d.qname = qname
+	d.page = 0
+}
+
+func (d *dashboard) render() {
+	// clear screen and move cursor to top-left corner.
+	fmt.Print("\033[H\033[2J")
+	fmt.Printf("asynqmon dash - %s (refresh every %v)\n\n", time.Now().Format("15:04:05"), dashRefresh)
+	switch d.view {
+	case viewOverview:
+		d.renderOverview()
+		fmt.Println("\n1-9: drill into queue  i/s/r/d: list tasks  q: quit")
+	case viewTasks:
+		d.renderTasks()
+		fmt.Println("\n1-9: inspect task  n/p: next/prev page  b: back  q: quit")
+	case viewTaskDetail:
+		d.renderTaskDetail()
+		fmt.Println("\nb: back  q: quit")
+	}
+}
+
+func (d *dashboard) renderOverview() {
+	stats, err := d.r.CurrentStats()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("STATES")
+	printStates(stats)
+	fmt.Println()
+
+	d.qnames = nil
+	for qname := range stats.Queues {
+		d.qnames = append(d.qnames, qname)
+	}
+	sort.Strings(d.qnames)
+	fmt.Println("QUEUES")
+	cols := []string{"#", "Queue", "Size"}
+	printTable(cols, func(w io.Writer, tmpl string) {
+		for i, qname := range d.qnames {
+			fmt.Fprintf(w, tmpl, i+1, qname, stats.Queues[qname])
+		}
+	})
+	fmt.Println()
+
+	fmt.Printf("STATS FOR %s UTC\n", stats.Timestamp.UTC().Format("2006-01-02"))
+	printStats(stats)
+	fmt.Println()
+
+	processes, err := d.r.ListProcesses()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	sort.Slice(processes, func(i, j int) bool {
+		x, y := processes[i], processes[j]
+		if x.Host != y.Host {
+			return x.Host < y.Host
+		}
+		return x.PID < y.PID
+	})
+	fmt.Println("PROCESSES")
+	cols = []string{"Host", "PID", "State", "Active Workers", "Queues", "Started"}
+	printTable(cols, func(w io.Writer, tmpl string) {
+		for _, ps := range processes {
+			fmt.Fprintf(w, tmpl,
+				ps.Host, ps.PID, ps.State,
+				fmt.Sprintf("%d/%d", ps.ActiveWorkerCount, ps.Concurrency),
+				formatQueues(ps.Queues), timeAgo(ps.Started))
+		}
+	})
+}
+
+func (d *dashboard) renderTasks() {
+	pgn := rdb.Pagination{Size: dashPageSize, Page: d.page}
+	title := strings.ToUpper(d.state)
+	if d.state == "enqueued" {
+		title = fmt.Sprintf("ENQUEUED IN %q", d.qname)
+	}
+	fmt.Printf("%s TASKS (page %d)\n", title, d.page)
+
+	var cols []string
+	var rows [][]interface{}
+	d.details = nil
+	switch d.state {
+	case "enqueued":
+		tasks, err := d.r.ListEnqueued(d.qname, pgn)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		cols = []string{"#", "ID", "Type"}
+		for i, t := range tasks {
+			rows = append(rows, []interface{}{i + 1, t.ID, t.Type})
+			d.details = append(d.details, []string{
+				fmt.Sprintf("ID:      %v", t.ID),
+				fmt.Sprintf("Type:    %s", t.Type),
+				fmt.Sprintf("Queue:   %s", t.Queue),
+				fmt.Sprintf("Payload: %v", t.Payload),
+			})
+		}
+	case "inprogress":
+		tasks, err := d.r.ListInProgress(pgn)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		cols = []string{"#", "ID", "Type"}
+		for i, t := range tasks {
+			rows = append(rows, []interface{}{i + 1, t.ID, t.Type})
+			d.details = append(d.details, []string{
+				fmt.Sprintf("ID:      %v", t.ID),
+				fmt.Sprintf("Type:    %s", t.Type),
+				fmt.Sprintf("Payload: %v", t.Payload),
+			})
+		}
+	case "scheduled":
+		tasks, err := d.r.ListScheduled(pgn)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		cols = []string{"#", "ID", "Type", "Process At", "Queue"}
+		for i, t := range tasks {
+			rows = append(rows, []interface{}{i + 1, queryID(t.ID, t.Score, "s"), t.Type, t.ProcessAt, t.Queue})
+			d.details = append(d.details, []string{
+				fmt.Sprintf("ID:         %s", queryID(t.ID, t.Score, "s")),
+				fmt.Sprintf("Type:       %s", t.Type),
+				fmt.Sprintf("Queue:      %s", t.Queue),
+				fmt.Sprintf("Process At: %v", t.ProcessAt),
+				fmt.Sprintf("Payload:    %v", t.Payload),
+			})
+		}
+	case "retry":
+		tasks, err := d.r.ListRetry(pgn)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		cols = []string{"#", "ID", "Type", "Next Retry", "Retried", "Queue"}
+		for i, t := range tasks {
+			rows = append(rows, []interface{}{i + 1, queryID(t.ID, t.Score, "r"), t.Type, t.ProcessAt, t.Retried, t.Queue})
+			d.details = append(d.details, []string{
+				fmt.Sprintf("ID:         %s", queryID(t.ID, t.Score, "r")),
+				fmt.Sprintf("Type:       %s", t.Type),
+				fmt.Sprintf("Queue:      %s", t.Queue),
+				fmt.Sprintf("Next Retry: %v", t.ProcessAt),
+				fmt.Sprintf("Retried:    %d/%d", t.Retried, t.Retry),
+				fmt.Sprintf("Last Error: %s", t.ErrorMsg),
+				fmt.Sprintf("Payload:    %v", t.Payload),
+			})
+			d.details[i] = append(d.details[i], errorHistoryLines(t.ErrorHistory)...)
+		}
+	case "dead":
+		tasks, err := d.r.ListDead(pgn)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		cols = []string{"#", "ID", "Type", "Last Failed", "Queue"}
+		for i, t := range tasks {
+			rows = append(rows, []interface{}{i + 1, queryID(t.ID, t.Score, "d"), t.Type, t.LastFailedAt, t.Queue})
+			d.details = append(d.details, []string{
+				fmt.Sprintf("ID:          %s", queryID(t.ID, t.Score, "d")),
+				fmt.Sprintf("Type:        %s", t.Type),
+				fmt.Sprintf("Queue:       %s", t.Queue),
+				fmt.Sprintf("Last Failed: %v", t.LastFailedAt),
+				fmt.Sprintf("Last Error:  %s", t.ErrorMsg),
+				fmt.Sprintf("Payload:     %v", t.Payload),
+			})
+			d.details[i] = append(d.details[i], errorHistoryLines(t.ErrorHistory)...)
+		}
+	}
+	if len(rows) == 0 {
+		fmt.Println("No tasks")
+		return
+	}
+	printTable(cols, func(w io.Writer, tmpl string) {
+		for _, row := range rows {
+			fmt.Fprintf(w, tmpl, row...)
+		}
+	})
+}
+
+func (d *dashboard) renderTaskDetail() {
+	if d.selected >= len(d.details) {
+		fmt.Println("Task no longer exists")
+		return
+	}
+	fmt.Println("TASK")
+	for _, l := range d.details[d.selected] {
+		fmt.Println(l)
+	}
+}
+
+// errorHistoryLines returns the lines to show the error history of a task,
+// most recent error first.
+func errorHistoryLines(history []*base.TaskError) []string {
+	if len(history) == 0 {
+		return nil
+	}
+	lines := []string{"Errors:"}
+	for i := len(history) - 1; i >= 0; i-- {
+		e := history[i]
+		lines = append(lines, fmt.Sprintf("  %s  %s", e.Time.Format(time.RFC3339), e.Msg))
+	}
+	return lines
+}
@@ -8,10 +8,7 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/go-redis/redis/v7"
-	"github.com/hibiken/asynq/internal/rdb"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 var enqallValidArgs = []string{"scheduled", "retry", "dead"}
@@ -48,12 +45,7 @@ func init() {
 }
 
 func enqall(cmd *cobra.Command, args []string) {
-	c := redis.NewClient(&redis.Options{
-		Addr:     viper.GetString("uri"),
-		DB:       viper.GetInt("db"),
-		Password: viper.GetString("password"),
-	})
-	r := rdb.NewRDB(c)
+	r := createRDB()
 	var n int64
 	var err error
 	switch args[0] {
@@ -71,5 +63,9 @@ func enqall(cmd *cobra.Command, args []string) {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	if jsonOutput {
+		printJSON(map[string]interface{}{"enqueued": n, "state": args[0]})
+		return
+	}
 	fmt.Printf("Enqueued %d tasks in %q state\n", n, args[0])
 }
@@ -8,10 +8,7 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/go-redis/redis/v7"
-	"github.com/hibiken/asynq/internal/rdb"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 // killCmd represents the kill command
@@ -44,29 +41,17 @@ func init() {
 }
 
 func kill(cmd *cobra.Command, args []string) {
-	id, score, qtype, err := parseQueryID(args[0])
+	info, err := createInspector().KillTask(args[0])
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	r := rdb.NewRDB(redis.NewClient(&redis.Options{
-		Addr:     viper.GetString("uri"),
-		DB:       viper.GetInt("db"),
-		Password: viper.GetString("password"),
-	}))
-	switch qtype {
-	case "s":
-		err = r.KillScheduledTask(id, score)
-	case "r":
-		err = r.KillRetryTask(id, score)
-	default:
-		fmt.Println("invalid argument")
-		os.Exit(1)
-	}
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	if jsonOutput {
+		printJSON(map[string]string{"killed": args[0], "key": info.Key})
+		return
 	}
 	fmt.Printf("Successfully killed %v\n", args[0])
-
+	if info.Key != "" {
+		fmt.Printf("The task is now identified by %v\n", info.Key)
+	}
 }
@@ -8,10 +8,7 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/go-redis/redis/v7"
-	"github.com/hibiken/asynq/internal/rdb"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 var killallValidArgs = []string{"scheduled", "retry"}
@@ -45,12 +42,7 @@ func init() {
 }
 
 func killall(cmd *cobra.Command, args []string) {
-	c := redis.NewClient(&redis.Options{
-		Addr:     viper.GetString("uri"),
-		DB:       viper.GetInt("db"),
-		Password: viper.GetString("password"),
-	})
-	r := rdb.NewRDB(c)
+	r := createRDB()
 	var n int64
 	var err error
 	switch args[0] {
@@ -66,5 +58,9 @@ func killall(cmd *cobra.Command, args []string) {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	if jsonOutput {
+		printJSON(map[string]interface{}{"killed": n, "state": args[0]})
+		return
+	}
 	fmt.Printf("Successfully updated %d tasks to \"dead\" state\n", n)
 }
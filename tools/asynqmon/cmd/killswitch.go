@@ -0,0 +1,123 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/spf13/cobra"
+)
+
+// killswitchCmd represents the killswitch command
+var killswitchCmd = &cobra.Command{
+	Use:   "killswitch [on|off]",
+	Short: "Shows, engages, or disengages the kill switch",
+	Long: `Killswitch (asynqmon killswitch) will show the state of the kill switch
+and its recent changes.
+
+The kill switch is an emergency stop which pauses processing in all
+background worker processes backed by the specified redis instance.
+In-flight tasks are not affected. The kill switch expires after the
+duration given by --for flag, and processing resumes automatically
+unless the kill switch is engaged again to renew it.
+
+Example:
+asynqmon killswitch                                    -> Shows the kill switch
+asynqmon killswitch on --for 30m --reason "bad deploy" -> Pauses processing for 30 minutes
+asynqmon killswitch off                                -> Resumes processing`,
+	Args:      cobra.RangeArgs(0, 1),
+	ValidArgs: []string{"on", "off"},
+	Run:       killswitch,
+}
+
+var (
+	killswitchFor    time.Duration
+	killswitchReason string
+)
+
+func init() {
+	rootCmd.AddCommand(killswitchCmd)
+	killswitchCmd.Flags().DurationVar(&killswitchFor, "for", 30*time.Minute, "how long to pause processing")
+	killswitchCmd.Flags().StringVar(&killswitchReason, "reason", "", "reason to record in the kill switch log")
+}
+
+func killswitch(cmd *cobra.Command, args []string) {
+	inspector := createInspector()
+	if len(args) == 0 {
+		showKillSwitch(inspector)
+		return
+	}
+	switch args[0] {
+	case "on":
+		ks, err := inspector.EngageKillSwitch(killswitchFor, killswitchReason)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if jsonOutput {
+			printJSON(ks)
+			return
+		}
+		fmt.Printf("Kill switch engaged until %s\n", ks.Expires.Format(time.RFC3339))
+	case "off":
+		ok, err := inspector.DisengageKillSwitch()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if jsonOutput {
+			printJSON(map[string]bool{"disengaged": ok})
+			return
+		}
+		if !ok {
+			fmt.Println("Kill switch is not engaged")
+			return
+		}
+		fmt.Println("Kill switch disengaged")
+	default:
+		fmt.Printf("error: unknown argument %q, want \"on\" or \"off\"\n", args[0])
+		os.Exit(1)
+	}
+}
+
+func showKillSwitch(inspector *asynq.Inspector) {
+	ks, err := inspector.KillSwitch()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	events, err := inspector.KillSwitchLog(10)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printJSON(map[string]interface{}{"killswitch": ks, "log": events})
+		return
+	}
+	if ks == nil {
+		fmt.Println("Kill switch is not engaged")
+	} else {
+		fmt.Printf("Kill switch engaged by %s until %s: %s\n",
+			ks.By, ks.Expires.Format(time.RFC3339), ks.Reason)
+	}
+	if len(events) == 0 {
+		return
+	}
+	fmt.Println()
+	printTable([]string{"Time", "Action", "By", "Expires", "Reason"}, func(w io.Writer, tmpl string) {
+		for _, e := range events {
+			expires := "-"
+			if e.Action == "on" {
+				expires = e.Expires.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, tmpl, e.Time.Format(time.RFC3339), e.Action, e.By, expires, e.Reason)
+		}
+	})
+}
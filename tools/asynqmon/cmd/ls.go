@@ -8,18 +8,15 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"strconv"
 	"strings"
 	"time"
 
-	"github.com/go-redis/redis/v7"
 	"github.com/hibiken/asynq/internal/rdb"
 	"github.com/rs/xid"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
-var lsValidArgs = []string{"enqueued", "inprogress", "scheduled", "retry", "dead"}
+var lsValidArgs = []string{"enqueued", "inprogress", "scheduled", "retry", "dead", "completed"}
 
 // lsCmd represents the ls command
 var lsCmd = &cobra.Command{
@@ -29,7 +26,7 @@ var lsCmd = &cobra.Command{
 
 The command takes one argument which specifies the state of tasks.
 The argument value should be one of "enqueued", "inprogress", "scheduled",
-"retry", or "dead".
+"retry", "dead", or "completed".
 
 Example:
 asynqmon ls dead -> Lists all tasks in dead state
@@ -62,12 +59,7 @@ func ls(cmd *cobra.Command, args []string) {
 		fmt.Println("page number cannot be negative.")
 		os.Exit(1)
 	}
-	c := redis.NewClient(&redis.Options{
-		Addr:     viper.GetString("uri"),
-		DB:       viper.GetInt("db"),
-		Password: viper.GetString("password"),
-	})
-	r := rdb.NewRDB(c)
+	r := createRDB()
 	parts := strings.Split(args[0], ":")
 	switch parts[0] {
 	case "enqueued":
@@ -84,6 +76,8 @@ func ls(cmd *cobra.Command, args []string) {
 		listRetry(r)
 	case "dead":
 		listDead(r)
+	case "completed":
+		listCompleted(r)
 	default:
 		fmt.Printf("error: `asynqmon ls [state]`\nonly accepts %v as the argument.\n", lsValidArgs)
 		os.Exit(1)
@@ -92,41 +86,22 @@ func ls(cmd *cobra.Command, args []string) {
 
 // queryID returns an identifier used for "enq" command.
 // score is the zset score and queryType should be one
-// of "s", "r" or "d" (scheduled, retry, dead respectively).
+// of "s", "r", "d" or "c" (scheduled, retry, dead, completed respectively).
 func queryID(id xid.ID, score int64, qtype string) string {
 	const format = "%v:%v:%v"
 	return fmt.Sprintf(format, qtype, score, id)
 }
 
-// parseQueryID is a reverse operation of queryID function.
-// It takes a queryID and return each part of id with proper
-// type if valid, otherwise it reports an error.
-func parseQueryID(queryID string) (id xid.ID, score int64, qtype string, err error) {
-	parts := strings.Split(queryID, ":")
-	if len(parts) != 3 {
-		return xid.NilID(), 0, "", fmt.Errorf("invalid id")
-	}
-	id, err = xid.FromString(parts[2])
-	if err != nil {
-		return xid.NilID(), 0, "", fmt.Errorf("invalid id")
-	}
-	score, err = strconv.ParseInt(parts[1], 10, 64)
-	if err != nil {
-		return xid.NilID(), 0, "", fmt.Errorf("invalid id")
-	}
-	qtype = parts[0]
-	if len(qtype) != 1 || !strings.Contains("srd", qtype) {
-		return xid.NilID(), 0, "", fmt.Errorf("invalid id")
-	}
-	return id, score, qtype, nil
-}
-
 func listEnqueued(r *rdb.RDB, qname string) {
 	tasks, err := r.ListEnqueued(qname, rdb.Pagination{Size: pageSize, Page: pageNum})
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	if jsonOutput {
+		printJSON(tasks)
+		return
+	}
 	if len(tasks) == 0 {
 		fmt.Printf("No enqueued tasks in %q queue\n", qname)
 		return
@@ -147,6 +122,10 @@ func listInProgress(r *rdb.RDB) {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	if jsonOutput {
+		printJSON(tasks)
+		return
+	}
 	if len(tasks) == 0 {
 		fmt.Println("No in-progress tasks")
 		return
@@ -167,6 +146,10 @@ func listScheduled(r *rdb.RDB) {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	if jsonOutput {
+		printJSON(tasks)
+		return
+	}
 	if len(tasks) == 0 {
 		fmt.Println("No scheduled tasks")
 		return
@@ -188,6 +171,10 @@ func listRetry(r *rdb.RDB) {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	if jsonOutput {
+		printJSON(tasks)
+		return
+	}
 	if len(tasks) == 0 {
 		fmt.Println("No retry tasks")
 		return
@@ -214,6 +201,10 @@ func listDead(r *rdb.RDB) {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	if jsonOutput {
+		printJSON(tasks)
+		return
+	}
 	if len(tasks) == 0 {
 		fmt.Println("No dead tasks")
 		return
@@ -227,3 +218,27 @@ func listDead(r *rdb.RDB) {
 	printTable(cols, printRows)
 	fmt.Printf("\nShowing %d tasks from page %d\n", len(tasks), pageNum)
 }
+
+func listCompleted(r *rdb.RDB) {
+	tasks, err := r.ListMessages("completed", "", rdb.Pagination{Size: pageSize, Page: pageNum})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printJSON(tasks)
+		return
+	}
+	if len(tasks) == 0 {
+		fmt.Println("No completed tasks")
+		return
+	}
+	cols := []string{"ID", "Type", "Payload", "Retained Until", "Queue"}
+	printRows := func(w io.Writer, tmpl string) {
+		for _, t := range tasks {
+			fmt.Fprintf(w, tmpl, queryID(t.Msg.ID, t.Score, "c"), t.Msg.Type, t.Msg.Payload, time.Unix(t.Score, 0), t.Msg.Queue)
+		}
+	}
+	printTable(cols, printRows)
+	fmt.Printf("\nShowing %d tasks from page %d\n", len(tasks), pageNum)
+}
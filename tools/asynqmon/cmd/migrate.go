@@ -0,0 +1,81 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Upgrades data written by older versions of asynq to the current format",
+	Long: `Migrate (asynqmon migrate) will detect task messages and key layouts written
+by older versions of asynq in redis and rewrite them in the current format.
+
+Tasks do not need to be drained before running this command, and it's safe
+to run it multiple times.
+
+Use --dry-run flag to see the changes without making them.
+
+Example: asynqmon migrate --dry-run`,
+	Args: cobra.NoArgs,
+	Run:  migrate,
+}
+
+// Flags
+var migrateDryRun bool
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+	migrateCmd.Flags().BoolVar(&migrateDryRun, "dry-run", false, "report the changes without making them")
+}
+
+func migrate(cmd *cobra.Command, args []string) {
+	r := createRDB()
+
+	res, err := r.Migrate(migrateDryRun)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printJSON(res)
+		return
+	}
+	if len(res.Keys) == 0 && len(res.Messages) == 0 && len(res.Queues) == 0 {
+		fmt.Println("Data is up to date, nothing to migrate")
+		return
+	}
+	verb := "Migrated"
+	if migrateDryRun {
+		verb = "Would migrate"
+	}
+	for _, key := range res.Keys {
+		fmt.Printf("%s key %q to the current key name\n", verb, key)
+	}
+	for _, qname := range res.Queues {
+		fmt.Printf("%s queue %q by registering it\n", verb, qname)
+	}
+	if len(res.Messages) > 0 {
+		var keys []string
+		for key := range res.Messages {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fmt.Println()
+		printTable([]string{"Key", "Messages"}, func(w io.Writer, tmpl string) {
+			for _, key := range keys {
+				fmt.Fprintf(w, tmpl, key, res.Messages[key])
+			}
+		})
+		fmt.Printf("\n%s task messages in %d keys\n", verb, len(keys))
+	}
+}
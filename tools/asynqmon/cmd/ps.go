@@ -12,10 +12,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/go-redis/redis/v7"
-	"github.com/hibiken/asynq/internal/rdb"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 // psCmd represents the ps command
@@ -29,10 +26,12 @@ The command shows the following for each process:
 * Host and PID of the process
 * Number of active workers out of worker pool
 * Queue configuration
-* State of the worker process ("running" | "stopped")
+* State of the worker process ("running" | "quiet" | "stopped")
 * Time the process was started
 
 A "running" process is processing tasks in queues.
+A "quiet" process has been told to stop processing new tasks via "asynqmon ctl quiet"
+and can be resumed via "asynqmon ctl resume".
 A "stopped" process is no longer processing new tasks.`,
 	Args: cobra.NoArgs,
 	Run:  ps,
@@ -43,17 +42,17 @@ func init() {
 }
 
 func ps(cmd *cobra.Command, args []string) {
-	r := rdb.NewRDB(redis.NewClient(&redis.Options{
-		Addr:     viper.GetString("uri"),
-		DB:       viper.GetInt("db"),
-		Password: viper.GetString("password"),
-	}))
+	r := createRDB()
 
 	processes, err := r.ListProcesses()
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	if jsonOutput {
+		printJSON(processes)
+		return
+	}
 	if len(processes) == 0 {
 		fmt.Println("No processes")
 		return
@@ -0,0 +1,63 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+// renameCmd represents the rename command
+var renameCmd = &cobra.Command{
+	Use:   "rename [old type] [new type]",
+	Short: "Renames the type of the tasks waiting to be processed",
+	Long: `Rename (asynqmon rename) will rewrite the enqueued, scheduled, and retry tasks
+of the old type to be of the new type.
+
+To rename a task type without stranding tasks in flight, run the backgrounds
+with TypeAliases mapping the old type to the new type, and update the clients
+before running this command. It's safe to run it multiple times.
+
+Example: asynqmon rename send_email email:send`,
+	Args: cobra.ExactArgs(2),
+	Run:  rename,
+}
+
+func init() {
+	rootCmd.AddCommand(renameCmd)
+}
+
+func rename(cmd *cobra.Command, args []string) {
+	r := createRDB()
+
+	res, err := r.RenameTaskType(args[0], args[1], nil)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printJSON(res)
+		return
+	}
+	if len(res) == 0 {
+		fmt.Printf("No tasks of type %q to rename\n", args[0])
+		return
+	}
+	var keys []string
+	for key := range res {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	printTable([]string{"Key", "Tasks"}, func(w io.Writer, tmpl string) {
+		for _, key := range keys {
+			fmt.Fprintf(w, tmpl, key, res[key])
+		}
+	})
+	fmt.Printf("\nRenamed tasks of type %q to %q in %d keys\n", args[0], args[1], len(keys))
+}
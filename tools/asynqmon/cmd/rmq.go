@@ -8,10 +8,8 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/go-redis/redis/v7"
 	"github.com/hibiken/asynq/internal/rdb"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 // rmqCmd represents the rmq command
@@ -35,12 +33,7 @@ func init() {
 }
 
 func rmq(cmd *cobra.Command, args []string) {
-	c := redis.NewClient(&redis.Options{
-		Addr:     viper.GetString("uri"),
-		DB:       viper.GetInt("db"),
-		Password: viper.GetString("password"),
-	})
-	r := rdb.NewRDB(c)
+	r := createRDB()
 	err := r.RemoveQueue(args[0], rmqForce)
 	if err != nil {
 		if _, ok := err.(*rdb.ErrQueueNotEmpty); ok {
@@ -50,5 +43,9 @@ func rmq(cmd *cobra.Command, args []string) {
 		fmt.Printf("error: %v", err)
 		os.Exit(1)
 	}
+	if jsonOutput {
+		printJSON(map[string]string{"removed": args[0]})
+		return
+	}
 	fmt.Printf("Successfully removed queue %q\n", args[0])
 }
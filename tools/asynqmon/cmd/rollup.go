@@ -0,0 +1,75 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+// rollupCmd represents the rollup command
+var rollupCmd = &cobra.Command{
+	Use:   "rollup [dimension]",
+	Short: "Shows the number of tasks in each state by value of a payload dimension",
+	Long: `Rollup (asynqmon rollup) will show the number of tasks in each state
+by value of the given rollup dimension.
+
+Dimensions are configured with RollupDimensions option of the client,
+and the counts are refreshed periodically by the background worker
+processes with RollupInterval option. Use --refresh flag to recount
+the tasks now, which scans all tasks.
+
+Example:
+asynqmon rollup plan           -> Shows the task counts by plan
+asynqmon rollup plan --refresh -> Recounts the tasks and shows the counts by plan`,
+	Args: cobra.ExactArgs(1),
+	Run:  rollup,
+}
+
+var rollupRefresh bool
+
+func init() {
+	rootCmd.AddCommand(rollupCmd)
+	rollupCmd.Flags().BoolVar(&rollupRefresh, "refresh", false, "recount the tasks before showing the counts")
+}
+
+func rollup(cmd *cobra.Command, args []string) {
+	inspector := createInspector()
+	if rollupRefresh {
+		if err := inspector.RefreshRollups(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	counts, err := inspector.Rollup(args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printJSON(counts)
+		return
+	}
+	if len(counts) == 0 {
+		fmt.Printf("No tasks are counted for dimension %q\n", args[0])
+		return
+	}
+	var vals []string
+	for v := range counts {
+		vals = append(vals, v)
+	}
+	sort.Strings(vals)
+	cols := []string{"Value", "Enqueued", "InProgress", "Scheduled", "Retry", "Dead"}
+	printTable(cols, func(w io.Writer, tmpl string) {
+		for _, v := range vals {
+			c := counts[v]
+			fmt.Fprintf(w, tmpl, v, c["enqueued"], c["inprogress"], c["scheduled"], c["retry"], c["dead"])
+		}
+	})
+}
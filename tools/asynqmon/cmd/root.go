@@ -5,12 +5,18 @@
 package cmd
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"reflect"
 	"strings"
 	"text/tabwriter"
 
+	"github.com/go-redis/redis/v7"
+	"github.com/hibiken/asynq"
+	"github.com/hibiken/asynq/internal/rdb"
 	"github.com/spf13/cobra"
 
 	homedir "github.com/mitchellh/go-homedir"
@@ -23,6 +29,13 @@ var cfgFile string
 var uri string
 var db int
 var password string
+var sentinelAddrs []string
+var masterName string
+var sentinelPassword string
+var clusterAddrs []string
+var useTLS bool
+var keyPrefix string
+var jsonOutput bool
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -47,9 +60,22 @@ func init() {
 	rootCmd.PersistentFlags().StringVarP(&uri, "uri", "u", "127.0.0.1:6379", "redis server URI")
 	rootCmd.PersistentFlags().IntVarP(&db, "db", "n", 0, "redis database number (default is 0)")
 	rootCmd.PersistentFlags().StringVarP(&password, "password", "p", "", "password to use when connecting to redis server")
+	rootCmd.PersistentFlags().StringSliceVar(&sentinelAddrs, "sentinel-addrs", nil, "comma separated list of redis sentinel addresses (overrides --uri)")
+	rootCmd.PersistentFlags().StringVar(&masterName, "master-name", "", "redis master name monitored by sentinels")
+	rootCmd.PersistentFlags().StringVar(&sentinelPassword, "sentinel-password", "", "password to use when connecting to redis sentinels")
+	rootCmd.PersistentFlags().StringSliceVar(&clusterAddrs, "cluster-addrs", nil, "comma separated list of redis cluster node addresses (overrides --uri)")
+	rootCmd.PersistentFlags().BoolVar(&useTLS, "tls", false, "use TLS to connect to redis server")
+	rootCmd.PersistentFlags().StringVar(&keyPrefix, "key-prefix", "", "namespace of the redis keys used by the application (default is {asynq})")
+	rootCmd.PersistentFlags().BoolVar(&jsonOutput, "json", false, "print output in JSON format")
 	viper.BindPFlag("uri", rootCmd.PersistentFlags().Lookup("uri"))
 	viper.BindPFlag("db", rootCmd.PersistentFlags().Lookup("db"))
 	viper.BindPFlag("password", rootCmd.PersistentFlags().Lookup("password"))
+	viper.BindPFlag("sentinel_addrs", rootCmd.PersistentFlags().Lookup("sentinel-addrs"))
+	viper.BindPFlag("master_name", rootCmd.PersistentFlags().Lookup("master-name"))
+	viper.BindPFlag("sentinel_password", rootCmd.PersistentFlags().Lookup("sentinel-password"))
+	viper.BindPFlag("cluster_addrs", rootCmd.PersistentFlags().Lookup("cluster-addrs"))
+	viper.BindPFlag("tls", rootCmd.PersistentFlags().Lookup("tls"))
+	viper.BindPFlag("key_prefix", rootCmd.PersistentFlags().Lookup("key-prefix"))
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -73,11 +99,97 @@ func initConfig() {
 	viper.AutomaticEnv() // read in environment variables that match
 
 	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
+	if err := viper.ReadInConfig(); err == nil && !jsonOutput {
 		fmt.Println("Using config file:", viper.ConfigFileUsed())
 	}
 }
 
+// createRedisClient returns a redis client configured by the flags.
+//
+// If cluster node addresses are given, the client connects to the cluster.
+// If sentinel addresses are given, the client talks to the sentinels to
+// find the current master, otherwise it connects to the server at --uri.
+func createRedisClient() redis.UniversalClient {
+	if addrs := viper.GetStringSlice("cluster_addrs"); len(addrs) > 0 {
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     addrs,
+			Password:  viper.GetString("password"),
+			TLSConfig: tlsConfig(),
+		})
+	}
+	if addrs := viper.GetStringSlice("sentinel_addrs"); len(addrs) > 0 {
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       viper.GetString("master_name"),
+			SentinelAddrs:    addrs,
+			SentinelPassword: viper.GetString("sentinel_password"),
+			Password:         viper.GetString("password"),
+			DB:               viper.GetInt("db"),
+			TLSConfig:        tlsConfig(),
+		})
+	}
+	return redis.NewClient(&redis.Options{
+		Addr:      viper.GetString("uri"),
+		DB:        viper.GetInt("db"),
+		Password:  viper.GetString("password"),
+		TLSConfig: tlsConfig(),
+	})
+}
+
+// createRDB returns an RDB that operates on the keys in the namespace
+// specified by the flags.
+func createRDB() *rdb.RDB {
+	r := rdb.NewRDB(createRedisClient())
+	r.SetKeyPrefix(viper.GetString("key_prefix"))
+	return r
+}
+
+// createRedisConnOpt returns a redis connection option configured by the flags.
+func createRedisConnOpt() asynq.RedisConnOpt {
+	if addrs := viper.GetStringSlice("cluster_addrs"); len(addrs) > 0 {
+		return asynq.RedisClusterClientOpt{
+			Addrs:     addrs,
+			Password:  viper.GetString("password"),
+			TLSConfig: tlsConfig(),
+		}
+	}
+	if addrs := viper.GetStringSlice("sentinel_addrs"); len(addrs) > 0 {
+		return asynq.RedisFailoverClientOpt{
+			MasterName:       viper.GetString("master_name"),
+			SentinelAddrs:    addrs,
+			SentinelPassword: viper.GetString("sentinel_password"),
+			Password:         viper.GetString("password"),
+			DB:               viper.GetInt("db"),
+			TLSConfig:        tlsConfig(),
+		}
+	}
+	return asynq.RedisClientOpt{
+		Addr:      viper.GetString("uri"),
+		DB:        viper.GetInt("db"),
+		Password:  viper.GetString("password"),
+		TLSConfig: tlsConfig(),
+	}
+}
+
+// tlsConfig returns a TLS config to connect to redis server,
+// or nil if TLS is not enabled by the flag.
+func tlsConfig() *tls.Config {
+	if !viper.GetBool("tls") {
+		return nil
+	}
+	return &tls.Config{}
+}
+
+// createInspector returns an inspector configured by the flags.
+//
+// Mutating operations read back their effect, so that a command run
+// right after shows the updated state.
+func createInspector() *asynq.Inspector {
+	return asynq.NewInspector(createRedisConnOpt(), &asynq.InspectorConfig{
+		ReadBack:  true,
+		KeyPrefix: viper.GetString("key_prefix"),
+	})
+}
+
 // printTable is a helper function to print data in table format.
 //
 // cols is a list of headers and printRow specifies how to print rows.
@@ -110,3 +222,19 @@ func printTable(cols []string, printRows func(w io.Writer, tmpl string)) {
 	printRows(tw, format)
 	tw.Flush()
 }
+
+// printJSON is a helper function to print data in JSON format.
+//
+// A nil slice is printed as an empty JSON array so that the output
+// can be iterated over by tools like jq.
+func printJSON(v interface{}) {
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice && rv.IsNil() {
+		v = []interface{}{}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
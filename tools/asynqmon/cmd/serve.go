@@ -0,0 +1,501 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/spf13/cobra"
+)
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Starts a monitoring server",
+	Long: `Serve (asynqmon serve) will start a long running HTTP server which serves
+the following endpoints:
+
+* /                   web UI showing the overview of tasks, queues and processes
+* /task               web UI showing a task and the diff of its payload (use ?key=)
+* /api/stats          current state of tasks and queues
+* /api/history        daily stats from the last x days (use ?days=x, default 10)
+* /api/processes      list of background worker processes
+* /api/tasks/[state]  list of tasks in the state (use ?queue=, ?page= and ?size=)
+* /api/task           a task and the diff of its payload (use ?key=)
+* /api/latencies      latency histograms per queue and task type (use ?window=, default 1h)
+* /metrics            metrics in Prometheus text exposition format
+
+The server is designed to be run in a container (see Dockerfile) so that
+monitoring can be stood up quickly.
+
+Example: asynqmon serve --addr=:8080 --uri=redis:6379`,
+	Args: cobra.NoArgs,
+	Run:  serve,
+}
+
+// Flags
+var serveAddr string
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+	serveCmd.Flags().StringVar(&serveAddr, "addr", ":8080", "address to listen on")
+}
+
+func serve(cmd *cobra.Command, args []string) {
+	r := createRDB()
+	inspector := createInspector()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", uiHandler(r))
+	mux.HandleFunc("/task", taskUIHandler(inspector))
+	mux.HandleFunc("/api/stats", statsHandler(r))
+	mux.HandleFunc("/api/history", historyHandler(r))
+	mux.HandleFunc("/api/processes", processesHandler(r))
+	mux.HandleFunc("/api/tasks/", tasksHandler(r))
+	mux.HandleFunc("/api/task", taskHandler(inspector))
+	mux.HandleFunc("/api/latencies", latenciesHandler(r))
+	mux.HandleFunc("/metrics", metricsHandler(r))
+
+	log.Printf("asynqmon: serving monitoring server on %s", serveAddr)
+	if err := http.ListenAndServe(serveAddr, mux); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// writeJSON writes v as a JSON response body.
+// A nil slice is written as an empty JSON array.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice && rv.IsNil() {
+		v = []interface{}{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("asynqmon: could not write response: %v", err)
+	}
+}
+
+// writeError writes an error response with the given status code.
+func writeError(w http.ResponseWriter, err error, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+func statsHandler(r *rdb.RDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		stats, err := r.CurrentStats()
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, stats)
+	}
+}
+
+func historyHandler(r *rdb.RDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		n := 10
+		if s := req.URL.Query().Get("days"); s != "" {
+			var err error
+			if n, err = strconv.Atoi(s); err != nil {
+				writeError(w, fmt.Errorf("invalid days %q", s), http.StatusBadRequest)
+				return
+			}
+		}
+		stats, err := r.HistoricalStats(n)
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, stats)
+	}
+}
+
+func processesHandler(r *rdb.RDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		processes, err := r.ListProcesses()
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, processes)
+	}
+}
+
+func tasksHandler(r *rdb.RDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		pgn := rdb.Pagination{Size: 30, Page: 0}
+		for name, dst := range map[string]*int{"size": &pgn.Size, "page": &pgn.Page} {
+			if s := q.Get(name); s != "" {
+				n, err := strconv.Atoi(s)
+				if err != nil || n < 0 {
+					writeError(w, fmt.Errorf("invalid %s %q", name, s), http.StatusBadRequest)
+					return
+				}
+				*dst = n
+			}
+		}
+		var (
+			tasks interface{}
+			err   error
+		)
+		switch state := strings.TrimPrefix(req.URL.Path, "/api/tasks/"); state {
+		case "enqueued":
+			qname := q.Get("queue")
+			if qname == "" {
+				qname = base.DefaultQueueName
+			}
+			tasks, err = r.ListEnqueued(qname, pgn)
+		case "inprogress":
+			tasks, err = r.ListInProgress(pgn)
+		case "scheduled":
+			tasks, err = r.ListScheduled(pgn)
+		case "retry":
+			tasks, err = r.ListRetry(pgn)
+		case "dead":
+			tasks, err = r.ListDead(pgn)
+		default:
+			writeError(w, fmt.Errorf("unknown state %q, should be one of %v", state, lsValidArgs), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, tasks)
+	}
+}
+
+// taskDetail is a task with the changes of its payload from the last
+// previous version.
+type taskDetail struct {
+	Task *asynq.TaskInfo        `json:"task"`
+	Diff []*asynq.PayloadChange `json:"diff"`
+}
+
+// getTaskDetail returns the task specified by the key in the request,
+// and the status code to respond with if it fails.
+func getTaskDetail(inspector *asynq.Inspector, req *http.Request) (*taskDetail, int, error) {
+	key := req.URL.Query().Get("key")
+	if key == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("task key is required")
+	}
+	info, err := inspector.GetTaskInfo(key)
+	switch {
+	case err == asynq.ErrTaskNotFound:
+		return nil, http.StatusNotFound, err
+	case err != nil:
+		return nil, http.StatusInternalServerError, err
+	}
+	return &taskDetail{Task: info, Diff: info.PayloadDiff()}, http.StatusOK, nil
+}
+
+func taskHandler(inspector *asynq.Inspector) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		detail, code, err := getTaskDetail(inspector, req)
+		if err != nil {
+			writeError(w, err, code)
+			return
+		}
+		writeJSON(w, detail)
+	}
+}
+
+// latencyStats is the summary of the latency histograms of a queue and task type.
+type latencyStats struct {
+	Queue string               `json:"queue"`
+	Type  string               `json:"type"`
+	Wait  *latencyDistribution `json:"wait"`
+	Run   *latencyDistribution `json:"run"`
+}
+
+type latencyDistribution struct {
+	Count int64         `json:"count"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+}
+
+func newLatencyDistribution(h rdb.LatencyHistogram) *latencyDistribution {
+	return &latencyDistribution{
+		Count: h.Count(),
+		P50:   h.Quantile(0.5),
+		P90:   h.Quantile(0.9),
+		P99:   h.Quantile(0.99),
+	}
+}
+
+// latencies returns the summaries of the latency histograms of the last window.
+func latencies(r *rdb.RDB, window time.Duration) ([]*latencyStats, error) {
+	data, err := r.Latencies(window)
+	if err != nil {
+		return nil, err
+	}
+	var res []*latencyStats
+	for _, l := range data {
+		res = append(res, &latencyStats{
+			Queue: l.Queue,
+			Type:  l.Type,
+			Wait:  newLatencyDistribution(l.Wait),
+			Run:   newLatencyDistribution(l.Run),
+		})
+	}
+	return res, nil
+}
+
+func latenciesHandler(r *rdb.RDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		window := time.Hour
+		if s := req.URL.Query().Get("window"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				writeError(w, fmt.Errorf("invalid window %q", s), http.StatusBadRequest)
+				return
+			}
+			window = d
+		}
+		stats, err := latencies(r, window)
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, stats)
+	}
+}
+
+func metricsHandler(r *rdb.RDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		stats, err := r.CurrentStats()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		processes, err := r.ListProcesses()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, stats, len(processes))
+	}
+}
+
+// writeMetrics writes metrics in Prometheus text exposition format.
+func writeMetrics(w io.Writer, stats *rdb.Stats, processes int) {
+	fmt.Fprintln(w, "# HELP asynq_tasks Number of tasks in each state.")
+	fmt.Fprintln(w, "# TYPE asynq_tasks gauge")
+	for _, s := range []struct {
+		state string
+		n     int
+	}{
+		{"enqueued", stats.Enqueued},
+		{"inprogress", stats.InProgress},
+		{"scheduled", stats.Scheduled},
+		{"retry", stats.Retry},
+		{"dead", stats.Dead},
+		{"completed", stats.Completed},
+	} {
+		fmt.Fprintf(w, "asynq_tasks{state=%q} %d\n", s.state, s.n)
+	}
+
+	var qnames []string
+	for qname := range stats.Queues {
+		qnames = append(qnames, qname)
+	}
+	sort.Strings(qnames)
+	fmt.Fprintln(w, "# HELP asynq_queue_size Number of enqueued tasks in each queue.")
+	fmt.Fprintln(w, "# TYPE asynq_queue_size gauge")
+	for _, qname := range qnames {
+		fmt.Fprintf(w, "asynq_queue_size{queue=%q} %d\n", qname, stats.Queues[qname])
+	}
+
+	fmt.Fprintln(w, "# HELP asynq_processed_today Number of tasks processed today (UTC).")
+	fmt.Fprintln(w, "# TYPE asynq_processed_today gauge")
+	fmt.Fprintf(w, "asynq_processed_today %d\n", stats.Processed)
+	fmt.Fprintln(w, "# HELP asynq_failed_today Number of tasks failed today (UTC).")
+	fmt.Fprintln(w, "# TYPE asynq_failed_today gauge")
+	fmt.Fprintf(w, "asynq_failed_today %d\n", stats.Failed)
+	fmt.Fprintln(w, "# HELP asynq_duplicate_deliveries_total Number of tasks delivered to the handlers more than once.")
+	fmt.Fprintln(w, "# TYPE asynq_duplicate_deliveries_total counter")
+	fmt.Fprintf(w, "asynq_duplicate_deliveries_total %d\n", stats.Duplicates)
+	fmt.Fprintln(w, "# HELP asynq_processes Number of running background worker processes.")
+	fmt.Fprintln(w, "# TYPE asynq_processes gauge")
+	fmt.Fprintf(w, "asynq_processes %d\n", processes)
+}
+
+var uiTemplate = template.Must(template.New("ui").Funcs(template.FuncMap{
+	"timeAgo":      timeAgo,
+	"formatQueues": formatQueues,
+	"latencyBar":   latencyBar,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>asynqmon</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+.bar { display: inline-block; height: 0.8em; background: #69c; }
+</style>
+</head>
+<body>
+<h1>asynqmon</h1>
+<h2>States</h2>
+<table>
+<tr><th>InProgress</th><th>Enqueued</th><th>Scheduled</th><th>Retry</th><th>Dead</th></tr>
+<tr><td>{{.Stats.InProgress}}</td><td>{{.Stats.Enqueued}}</td><td>{{.Stats.Scheduled}}</td><td>{{.Stats.Retry}}</td><td>{{.Stats.Dead}}</td></tr>
+</table>
+<h2>Queues</h2>
+<table>
+<tr><th>Queue</th><th>Size</th></tr>
+{{range $qname, $n := .Stats.Queues}}<tr><td>{{$qname}}</td><td>{{$n}}</td></tr>
+{{end}}</table>
+<h2>Stats for today (UTC)</h2>
+<table>
+<tr><th>Processed</th><th>Failed</th></tr>
+<tr><td>{{.Stats.Processed}}</td><td>{{.Stats.Failed}}</td></tr>
+</table>
+<h2>Latencies (last hour)</h2>
+<table>
+<tr><th>Queue</th><th>Type</th><th>Count</th><th>Wait p50</th><th>Wait p90</th><th>Wait p99</th><th>Run p50</th><th>Run p90</th><th>Run p99</th><th>Run p99 (log scale)</th></tr>
+{{range .Latencies}}<tr><td>{{.Queue}}</td><td>{{.Type}}</td><td>{{.Run.Count}}</td><td>{{.Wait.P50}}</td><td>{{.Wait.P90}}</td><td>{{.Wait.P99}}</td><td>{{.Run.P50}}</td><td>{{.Run.P90}}</td><td>{{.Run.P99}}</td><td><span class="bar" style="width: {{latencyBar .Run.P99}}px"></span></td></tr>
+{{end}}</table>
+<h2>Processes</h2>
+<table>
+<tr><th>Host</th><th>PID</th><th>State</th><th>Active Workers</th><th>Queues</th><th>Started</th></tr>
+{{range .Processes}}<tr><td>{{.Host}}</td><td>{{.PID}}</td><td>{{.State}}</td><td>{{.ActiveWorkerCount}}/{{.Concurrency}}</td><td>{{formatQueues .Queues}}</td><td>{{timeAgo .Started}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+var taskTemplate = template.Must(template.New("task").Funcs(template.FuncMap{
+	"toJSON": toJSON,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>asynqmon - task {{.Task.ID}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; vertical-align: top; }
+pre { margin: 0; }
+.added { background: #e6ffed; }
+.removed { background: #ffeef0; }
+.changed { background: #fff5b1; }
+</style>
+</head>
+<body>
+<h1>Task {{.Task.ID}}</h1>
+<table>
+<tr><th>Type</th><td>{{.Task.Type}}</td></tr>
+<tr><th>Queue</th><td>{{.Task.Queue}}</td></tr>
+<tr><th>State</th><td>{{.Task.State}}</td></tr>
+<tr><th>Retried</th><td>{{.Task.Retried}}/{{.Task.MaxRetry}}</td></tr>
+<tr><th>Error</th><td>{{.Task.ErrorMsg}}</td></tr>
+<tr><th>Payload</th><td><pre>{{toJSON .Task.Payload}}</pre></td></tr>
+</table>
+{{if .Diff}}<h2>Changes from the previous payload</h2>
+<table>
+<tr><th>Key</th><th>Change</th><th>Old</th><th>New</th></tr>
+{{range .Diff}}<tr class="{{.Op}}"><td>{{.Key}}</td><td>{{.Op}}</td><td><pre>{{toJSON .Old}}</pre></td><td><pre>{{toJSON .New}}</pre></td></tr>
+{{end}}</table>
+{{end}}{{if .Task.PayloadHistory}}<h2>Previous payloads</h2>
+<table>
+<tr><th>Replaced</th><th>Type</th><th>Payload</th></tr>
+{{range .Task.PayloadHistory}}<tr><td>{{.Time.Format "2006-01-02 15:04:05 MST"}}</td><td>{{.Type}}</td><td><pre>{{toJSON .Payload}}</pre></td></tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
+
+func taskUIHandler(inspector *asynq.Inspector) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		detail, code, err := getTaskDetail(inspector, req)
+		if err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+		if err := taskTemplate.Execute(w, detail); err != nil {
+			log.Printf("asynqmon: could not render template: %v", err)
+		}
+	}
+}
+
+// toJSON returns v formatted as indented JSON for display.
+func toJSON(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+func uiHandler(r *rdb.RDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			http.NotFound(w, req)
+			return
+		}
+		stats, err := r.CurrentStats()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		processes, err := r.ListProcesses()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		lats, err := latencies(r, time.Hour)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data := struct {
+			Stats     *rdb.Stats
+			Processes []*base.ProcessInfo
+			Latencies []*latencyStats
+		}{stats, processes, lats}
+		if err := uiTemplate.Execute(w, data); err != nil {
+			log.Printf("asynqmon: could not render template: %v", err)
+		}
+	}
+}
+
+// latencyBar returns the width in pixels of a bar representing the duration
+// on a log scale, from 1ms (zero width) to 1h (300 pixels).
+func latencyBar(d time.Duration) int {
+	if d <= time.Millisecond {
+		return 0
+	}
+	w := int(300 * math.Log10(float64(d)/float64(time.Millisecond)) / math.Log10(float64(time.Hour/time.Millisecond)))
+	if w > 300 {
+		w = 300
+	}
+	return w
+}
@@ -0,0 +1,380 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// simulateCmd represents the simulate command
+var simulateCmd = &cobra.Command{
+	Use:   "simulate",
+	Short: "Measures the capacity of a worker fleet with synthetic tasks",
+	Long: `Simulate (asynqmon simulate) will enqueue synthetic tasks at the given
+rate for the given duration, and report the throughput achieved by the
+background worker processes, the time the tasks waited in the queues,
+and the point the workers could no longer keep up with the rate.
+
+The backgrounds should be started with Simulation option, so that they
+process the synthetic tasks by waiting for the durations of the mix
+instead of calling the handler. Run it against a staging fleet which
+processes no other tasks, as the throughput counts all processed tasks.
+
+The mix is a YAML file declaring the task types to enqueue:
+
+  tasks:
+    - type: send_email    # type of the task (required)
+      weight: 80          # relative share of the tasks (default 1)
+      duration: 50ms      # time each task takes to process
+      queue: default      # queue to enqueue the tasks in (default "default")
+      failure_rate: 0.01  # probability of a task failing (default 0)
+      payload_size: 512   # bytes to pad the payload with (default 0)
+    - type: generate_report
+      weight: 20
+      duration: 2s
+
+Rate is the number of tasks per second, minute or hour (e.g. 500/s, 30/m).
+Use --ramp flag to increase the rate linearly from zero over the duration,
+to find the rate at which the workers saturate.
+
+Tasks left in the queues at the end of the simulation are still processed
+by the workers.
+
+Example:
+asynqmon simulate --rate 500/s --mix mix.yaml --duration 10m        -> Enqueues 500 tasks per second for 10 minutes
+asynqmon simulate --rate 2000/s --mix mix.yaml --duration 30m --ramp -> Ramps up to 2000 tasks per second over 30 minutes`,
+	Args: cobra.NoArgs,
+	Run:  simulate,
+}
+
+var (
+	simulateRate     string
+	simulateMix      string
+	simulateDuration time.Duration
+	simulateInterval time.Duration
+	simulateRamp     bool
+)
+
+func init() {
+	rootCmd.AddCommand(simulateCmd)
+	simulateCmd.Flags().StringVar(&simulateRate, "rate", "100/s", "number of tasks to enqueue per second, minute or hour")
+	simulateCmd.Flags().StringVar(&simulateMix, "mix", "", "YAML file declaring the task types to enqueue")
+	simulateCmd.Flags().DurationVar(&simulateDuration, "duration", time.Minute, "how long to enqueue tasks for")
+	simulateCmd.Flags().DurationVar(&simulateInterval, "interval", 10*time.Second, "how often to measure the throughput")
+	simulateCmd.Flags().BoolVar(&simulateRamp, "ramp", false, "increase the rate linearly from zero over the duration")
+	simulateCmd.MarkFlagRequired("mix")
+}
+
+// simulatedType is a task type of the mix.
+type simulatedType struct {
+	Type        string        `mapstructure:"type"`
+	Weight      int           `mapstructure:"weight"`
+	Duration    time.Duration `mapstructure:"duration"`
+	Queue       string        `mapstructure:"queue"`
+	FailureRate float64       `mapstructure:"failure_rate"`
+	PayloadSize int           `mapstructure:"payload_size"`
+}
+
+// simulationInterval is the measurement of an interval of the simulation.
+type simulationInterval struct {
+	Elapsed time.Duration
+
+	// Number of tasks per second offered by the rate, actually enqueued,
+	// and processed by the workers in the interval.
+	Offered   float64
+	Enqueued  float64
+	Processed float64
+	Failed    float64
+
+	// Backlog is the number of tasks in the queues of the mix at the end
+	// of the interval.
+	Backlog int
+
+	// Saturated is true if the backlog grew in the interval as the workers
+	// processed fewer tasks than enqueued.
+	Saturated bool
+}
+
+// simulationReport is the result of a simulation.
+type simulationReport struct {
+	Elapsed   time.Duration
+	Enqueued  int
+	Intervals []*simulationInterval
+
+	// Throughput is the average number of tasks processed per second.
+	Throughput float64
+
+	// PeakThroughput is the highest number of tasks processed per second
+	// in an interval.
+	PeakThroughput float64
+
+	// SaturatedAt is the first saturated interval, nil if the workers
+	// kept up with the rate.
+	SaturatedAt *simulationInterval `json:",omitempty"`
+
+	Latencies []*asynq.LatencyStats
+}
+
+func simulate(cmd *cobra.Command, args []string) {
+	perSecond, err := parseRate(simulateRate)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	mix, err := readMix(simulateMix)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if simulateDuration <= 0 || simulateInterval <= 0 {
+		fmt.Println("duration and interval should be positive")
+		os.Exit(1)
+	}
+	queues := make(map[string]bool)
+	totalWeight := 0
+	for _, t := range mix {
+		queues[t.Queue] = true
+		totalWeight += t.Weight
+	}
+
+	client := asynq.NewClientWithConfig(createRedisConnOpt(), &asynq.ClientConfig{
+		KeyPrefix: viper.GetString("key_prefix"),
+	})
+	inspector := createInspector()
+	last, err := inspector.CurrentStats()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// due returns the number of tasks the rate offers until elapsed.
+	due := func(elapsed time.Duration) float64 {
+		s := elapsed.Seconds()
+		if simulateRamp {
+			return perSecond * s * s / (2 * simulateDuration.Seconds())
+		}
+		return perSecond * s
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	report := &simulationReport{}
+	if !jsonOutput {
+		fmt.Printf("Simulating %d task types at %s for %v; press Ctrl-C to stop\n\n", len(mix), simulateRate, simulateDuration)
+		fmt.Printf("%-10s %10s %10s %10s %10s %10s\n", "Elapsed", "Offered/s", "Enqueued/s", "Processed/s", "Failed/s", "Backlog")
+	}
+	start := time.Now()
+	end := time.After(simulateDuration)
+	enqueueTick := time.NewTicker(10 * time.Millisecond)
+	defer enqueueTick.Stop()
+	reportTick := time.NewTicker(simulateInterval)
+	defer reportTick.Stop()
+	lastTime, lastDue, enqueued, lastEnqueued, processed := start, 0.0, 0, 0, 0
+
+	measure := func() {
+		now := time.Now()
+		stats, err := inspector.CurrentStats()
+		if err != nil {
+			fmt.Printf("Could not measure the throughput: %v\n", err)
+			return
+		}
+		secs := now.Sub(lastTime).Seconds()
+		if secs <= 0 {
+			return
+		}
+		elapsed := now.Sub(start)
+		iv := &simulationInterval{
+			Elapsed:  elapsed.Round(time.Second),
+			Offered:  (due(elapsed) - lastDue) / secs,
+			Enqueued: float64(enqueued-lastEnqueued) / secs,
+		}
+		// Daily counters are reset at midnight (UTC).
+		if stats.Processed >= last.Processed {
+			processed += stats.Processed - last.Processed
+			iv.Processed = float64(stats.Processed-last.Processed) / secs
+			iv.Failed = float64(stats.Failed-last.Failed) / secs
+		}
+		prevBacklog := backlog(last.Queues, queues)
+		iv.Backlog = backlog(stats.Queues, queues)
+		iv.Saturated = iv.Backlog > prevBacklog && iv.Processed < iv.Enqueued
+		report.Intervals = append(report.Intervals, iv)
+		if iv.Processed > report.PeakThroughput {
+			report.PeakThroughput = iv.Processed
+		}
+		if iv.Saturated && report.SaturatedAt == nil {
+			report.SaturatedAt = iv
+		}
+		if !jsonOutput {
+			fmt.Printf("%-10v %10.1f %10.1f %10.1f %10.1f %10d\n", iv.Elapsed, iv.Offered, iv.Enqueued, iv.Processed, iv.Failed, iv.Backlog)
+		}
+		last, lastTime, lastDue, lastEnqueued = stats, now, due(elapsed), enqueued
+	}
+
+loop:
+	for {
+		select {
+		case <-end:
+			break loop
+		case <-interrupt:
+			break loop
+		case <-reportTick.C:
+			measure()
+		case <-enqueueTick.C:
+			target := int(due(time.Since(start)))
+			for ; enqueued < target; enqueued++ {
+				t := pickType(mix, totalWeight)
+				task := asynq.NewSimulatedTask(t.Type, asynq.SimulatedWork{
+					Duration:    t.Duration,
+					FailureRate: t.FailureRate,
+					PayloadSize: t.PayloadSize,
+				})
+				if _, err := client.Schedule(task, time.Now(), asynq.Queue(t.Queue)); err != nil {
+					fmt.Printf("Could not enqueue task: %v\n", err)
+					os.Exit(1)
+				}
+			}
+		}
+	}
+	measure()
+
+	report.Elapsed = time.Since(start).Round(time.Second)
+	report.Enqueued = enqueued
+	if secs := time.Since(start).Seconds(); secs > 0 {
+		report.Throughput = float64(processed) / secs
+	}
+	// Latencies are recorded with a resolution of a minute.
+	window := time.Duration(math.Ceil(report.Elapsed.Minutes())) * time.Minute
+	if window > 24*time.Hour {
+		window = 24 * time.Hour
+	}
+	stats, err := inspector.Latencies(window)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	report.Latencies = []*asynq.LatencyStats{}
+	for _, l := range stats {
+		if strings.HasPrefix(l.Type, asynq.SimulatedTaskType) {
+			report.Latencies = append(report.Latencies, l)
+		}
+	}
+
+	if jsonOutput {
+		printJSON(report)
+		return
+	}
+	printSimulationReport(report)
+}
+
+func printSimulationReport(r *simulationReport) {
+	fmt.Printf("\nEnqueued %d tasks in %v\n", r.Enqueued, r.Elapsed)
+	fmt.Printf("Throughput: %.1f tasks/s on average, %.1f tasks/s at peak\n", r.Throughput, r.PeakThroughput)
+	if s := r.SaturatedAt; s != nil {
+		fmt.Printf("Saturated at %v: %.1f tasks/s enqueued, %.1f tasks/s processed\n", s.Elapsed, s.Enqueued, s.Processed)
+	} else {
+		fmt.Println("Not saturated: workers kept up with the rate")
+	}
+	if len(r.Latencies) == 0 {
+		return
+	}
+	fmt.Println()
+	cols := []string{"Queue", "Type", "Count", "Wait P50", "Wait P90", "Wait P99", "Run P50", "Run P99"}
+	printTable(cols, func(w io.Writer, tmpl string) {
+		for _, l := range r.Latencies {
+			typename := strings.TrimPrefix(l.Type, asynq.SimulatedTaskType)
+			fmt.Fprintf(w, tmpl, l.Queue, typename, l.Wait.Count, l.Wait.P50, l.Wait.P90, l.Wait.P99, l.Run.P50, l.Run.P99)
+		}
+	})
+}
+
+// parseRate parses the rate (e.g. "500/s", "30/m") and returns the number
+// of tasks per second. A rate without unit is per second.
+func parseRate(s string) (float64, error) {
+	num, unit := s, "s"
+	if i := strings.Index(s, "/"); i >= 0 {
+		num, unit = s[:i], s[i+1:]
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate %q: should be a positive number of tasks per unit (e.g. 500/s)", s)
+	}
+	switch unit {
+	case "s":
+		return n, nil
+	case "m":
+		return n / 60, nil
+	case "h":
+		return n / 3600, nil
+	}
+	return 0, fmt.Errorf("invalid rate %q: unit should be one of s, m, or h", s)
+}
+
+// readMix reads the task types of the mix from the YAML file.
+func readMix(path string) ([]*simulatedType, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType("yaml")
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("could not read mix: %v", err)
+	}
+	var mix []*simulatedType
+	if err := v.UnmarshalKey("tasks", &mix); err != nil {
+		return nil, fmt.Errorf("could not read mix: %v", err)
+	}
+	if len(mix) == 0 {
+		return nil, fmt.Errorf("mix %s declares no tasks", path)
+	}
+	for _, t := range mix {
+		if t.Type == "" {
+			return nil, fmt.Errorf("mix %s declares a task without type", path)
+		}
+		if t.Weight < 0 || t.Duration < 0 || t.FailureRate < 0 || t.FailureRate > 1 {
+			return nil, fmt.Errorf("task %q of mix %s has invalid weight, duration, or failure rate", t.Type, path)
+		}
+		if t.Weight == 0 {
+			t.Weight = 1
+		}
+		if t.Queue == "" {
+			t.Queue = "default"
+		}
+		t.Queue = strings.ToLower(t.Queue)
+	}
+	return mix, nil
+}
+
+// pickType picks a task type of the mix at random by weight.
+func pickType(mix []*simulatedType, totalWeight int) *simulatedType {
+	n := rand.Intn(totalWeight)
+	for _, t := range mix {
+		if n < t.Weight {
+			return t
+		}
+		n -= t.Weight
+	}
+	return mix[len(mix)-1]
+}
+
+// backlog returns the number of tasks enqueued in the given queues.
+func backlog(sizes map[string]int, queues map[string]bool) int {
+	n := 0
+	for qname := range queues {
+		n += sizes[qname]
+	}
+	return n
+}
@@ -12,10 +12,8 @@ import (
 	"strings"
 	"text/tabwriter"
 
-	"github.com/go-redis/redis/v7"
 	"github.com/hibiken/asynq/internal/rdb"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 // statsCmd represents the stats command
@@ -53,12 +51,7 @@ func init() {
 }
 
 func stats(cmd *cobra.Command, args []string) {
-	c := redis.NewClient(&redis.Options{
-		Addr:     viper.GetString("uri"),
-		DB:       viper.GetInt("db"),
-		Password: viper.GetString("password"),
-	})
-	r := rdb.NewRDB(c)
+	r := createRDB()
 
 	stats, err := r.CurrentStats()
 	if err != nil {
@@ -70,6 +63,13 @@ func stats(cmd *cobra.Command, args []string) {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	if jsonOutput {
+		printJSON(struct {
+			Stats     *rdb.Stats
+			RedisInfo map[string]string
+		}{stats, info})
+		return
+	}
 	fmt.Println("STATES")
 	printStates(stats)
 	fmt.Println()
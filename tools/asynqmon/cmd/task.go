@@ -0,0 +1,165 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/spf13/cobra"
+)
+
+// taskCmd represents the task command
+var taskCmd = &cobra.Command{
+	Use:   "task",
+	Short: "Manages tasks",
+	Long: `Task (asynqmon task) groups the commands to list and manage individual tasks.
+
+Identifier for a task should be obtained by running "asynqmon task ls" command.
+
+Example:
+asynqmon task ls --state=dead                  -> Lists all tasks in dead state
+asynqmon task ls --state=enqueued --queue=low  -> Lists tasks from low queue
+asynqmon task run d:1575732274:bnogo8gt6toe23vhef0g     -> Enqueues the dead task
+asynqmon task archive r:1575732274:bnogo8gt6toe23vhef0g -> Kills the retry task`,
+}
+
+var taskListCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "Lists tasks in the specified state",
+	Long: `Ls (asynqmon task ls) will list tasks in the state specified by --state flag.
+
+The --state flag value should be one of "enqueued", "inprogress", "scheduled",
+"retry", or "dead". Enqueued tasks are listed from the queue specified by
+--queue flag (default is "default").`,
+	Args: cobra.NoArgs,
+	Run:  taskList,
+}
+
+var taskCancelCmd = &cobra.Command{
+	Use:   "cancel [task id]",
+	Short: "Sends a cancelation signal to the goroutine processing the specified task",
+	Args:  cobra.ExactArgs(1),
+	Run:   cancel,
+}
+
+var taskDeleteCmd = &cobra.Command{
+	Use:   "delete [task id]",
+	Short: "Deletes a task given an identifier",
+	Long: `Delete (asynqmon task delete) will delete a task given an identifier.
+
+The task should be in either scheduled, retry or dead state.
+If --all flag is set, the command deletes all tasks in the state specified
+by --state flag instead and takes no argument.`,
+	Args: cobra.MaximumNArgs(1),
+	Run:  taskDelete,
+}
+
+var taskRunCmd = &cobra.Command{
+	Use:   "run [task id]",
+	Short: "Enqueues a task given an identifier",
+	Long: `Run (asynqmon task run) will enqueue a task given an identifier so that
+the task gets processed immediately.
+
+The task should be in either scheduled, retry or dead state.
+If --all flag is set, the command enqueues all tasks in the state specified
+by --state flag instead and takes no argument.`,
+	Args: cobra.MaximumNArgs(1),
+	Run:  taskRun,
+}
+
+var taskArchiveCmd = &cobra.Command{
+	Use:   "archive [task id]",
+	Short: "Moves a task to dead state given an identifier",
+	Long: `Archive (asynqmon task archive) will put a task in dead state given an identifier.
+
+The task should be in either scheduled or retry state.
+If --all flag is set, the command archives all tasks in the state specified
+by --state flag instead and takes no argument.`,
+	Args: cobra.MaximumNArgs(1),
+	Run:  taskArchive,
+}
+
+// Flags
+var taskState string
+var taskQueue string
+var taskAll bool
+
+func init() {
+	rootCmd.AddCommand(taskCmd)
+	taskCmd.AddCommand(taskListCmd)
+	taskCmd.AddCommand(taskCancelCmd)
+	taskCmd.AddCommand(taskDeleteCmd)
+	taskCmd.AddCommand(taskRunCmd)
+	taskCmd.AddCommand(taskArchiveCmd)
+
+	taskListCmd.Flags().StringVarP(&taskState, "state", "s", "", "state of the tasks to list")
+	taskListCmd.Flags().StringVarP(&taskQueue, "queue", "q", base.DefaultQueueName, "queue to list enqueued tasks from")
+	taskListCmd.Flags().IntVar(&pageSize, "size", 30, "page size")
+	taskListCmd.Flags().IntVar(&pageNum, "page", 0, "page number - zero indexed (default 0)")
+	taskListCmd.MarkFlagRequired("state")
+
+	for _, c := range []*cobra.Command{taskDeleteCmd, taskRunCmd, taskArchiveCmd} {
+		c.Flags().BoolVar(&taskAll, "all", false, "apply to all tasks in the state specified by --state")
+		c.Flags().StringVarP(&taskState, "state", "s", "", "state of the tasks (used with --all)")
+	}
+}
+
+func taskList(cmd *cobra.Command, args []string) {
+	arg := taskState
+	if taskState == "enqueued" {
+		arg = fmt.Sprintf("%s:%s", taskState, taskQueue)
+	}
+	ls(cmd, []string{arg})
+}
+
+func taskDelete(cmd *cobra.Command, args []string) {
+	if !taskAll {
+		requireTaskID(args)
+		del(cmd, args)
+		return
+	}
+	requireStateForAll(args)
+	delall(cmd, []string{taskState})
+}
+
+func taskRun(cmd *cobra.Command, args []string) {
+	if !taskAll {
+		requireTaskID(args)
+		enq(cmd, args)
+		return
+	}
+	requireStateForAll(args)
+	enqall(cmd, []string{taskState})
+}
+
+func taskArchive(cmd *cobra.Command, args []string) {
+	if !taskAll {
+		requireTaskID(args)
+		kill(cmd, args)
+		return
+	}
+	requireStateForAll(args)
+	killall(cmd, []string{taskState})
+}
+
+func requireTaskID(args []string) {
+	if len(args) != 1 {
+		fmt.Println("error: task id is required unless --all flag is set")
+		os.Exit(1)
+	}
+}
+
+func requireStateForAll(args []string) {
+	if len(args) != 0 {
+		fmt.Println("error: task id cannot be used with --all flag")
+		os.Exit(1)
+	}
+	if taskState == "" {
+		fmt.Println("error: --state flag is required with --all flag")
+		os.Exit(1)
+	}
+}
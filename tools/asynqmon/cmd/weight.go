@@ -0,0 +1,90 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+// weightCmd represents the weight command
+var weightCmd = &cobra.Command{
+	Use:   "weight [queue name] [weight]",
+	Short: "Shows or sets the weights of queues",
+	Long: `Weight (asynqmon weight) will show the weights of queues used by the
+background worker processes to pick a queue to process.
+
+If a queue name and a weight are given, it will set the weight of the queue.
+The new weight is picked up by all running processes within a few seconds,
+and a weight of zero pauses processing the queue.
+
+Example:
+asynqmon weight             -> Shows the weights of all queues
+asynqmon weight critical 10 -> Sets the weight of "critical" queue to 10
+asynqmon weight low 0       -> Pauses processing "low" queue`,
+	Args: cobra.RangeArgs(0, 2),
+	Run:  weight,
+}
+
+func init() {
+	rootCmd.AddCommand(weightCmd)
+}
+
+func weight(cmd *cobra.Command, args []string) {
+	inspector := createInspector()
+	switch len(args) {
+	case 0:
+		weights, err := inspector.QueueWeights()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		printWeights(weights)
+	case 2:
+		w, err := strconv.Atoi(args[1])
+		if err != nil {
+			fmt.Printf("error: weight should be an integer, got %q\n", args[1])
+			os.Exit(1)
+		}
+		if err := inspector.SetQueueWeight(args[0], w); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if jsonOutput {
+			printJSON(map[string]interface{}{"queue": args[0], "weight": w})
+			return
+		}
+		fmt.Printf("Successfully set weight of queue %q to %d\n", args[0], w)
+	default:
+		fmt.Println("error: both queue name and weight are required to set a weight")
+		os.Exit(1)
+	}
+}
+
+func printWeights(weights map[string]int) {
+	if jsonOutput {
+		printJSON(weights)
+		return
+	}
+	if len(weights) == 0 {
+		fmt.Println("No queue weights are stored yet")
+		return
+	}
+	var qnames []string
+	for qname := range weights {
+		qnames = append(qnames, qname)
+	}
+	sort.Strings(qnames)
+	printTable([]string{"Queue", "Weight"}, func(w io.Writer, tmpl string) {
+		for _, qname := range qnames {
+			fmt.Fprintf(w, tmpl, qname, weights[qname])
+		}
+	})
+}
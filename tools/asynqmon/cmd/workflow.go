@@ -0,0 +1,56 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// workflowCmd represents the workflow command
+var workflowCmd = &cobra.Command{
+	Use:   "workflow [workflow id]",
+	Short: "Shows the state of the steps of a workflow",
+	Long: `Workflow (asynqmon workflow) will show the state of the workflow with
+the given ID, and the state of each of its steps.
+
+Workflows are enqueued with package workflow, and their state is kept
+for 7 days since it last changed.
+
+Example:
+asynqmon workflow order:1234 -> Shows the steps of workflow "order:1234"`,
+	Args: cobra.ExactArgs(1),
+	Run:  showWorkflow,
+}
+
+func init() {
+	rootCmd.AddCommand(workflowCmd)
+}
+
+func showWorkflow(cmd *cobra.Command, args []string) {
+	info, err := createInspector().Workflow(args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printJSON(info)
+		return
+	}
+	fmt.Printf("Workflow %q is %s\n\n", info.ID, info.State)
+	cols := []string{"Step", "State", "Waiting For", "Type", "Task ID"}
+	printTable(cols, func(w io.Writer, tmpl string) {
+		for _, s := range info.Steps {
+			waiting := "-"
+			if s.State == "waiting" {
+				waiting = fmt.Sprintf("%d steps", s.Waiting)
+			}
+			fmt.Fprintf(w, tmpl, s.Name, s.State, waiting, s.Type, s.TaskID)
+		}
+	})
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// wakeStore is implemented by brokers which relay the wakeups published
+// when tasks are enqueued.
+type wakeStore interface {
+	WakePubSub() (*redis.PubSub, error)
+}
+
+// waker wakes up the processor waiting for tasks when a task is enqueued
+// to one of its queues, so that the processor doesn't have to block on one
+// of the queues when it processes several.
+//
+// A nil waker never wakes up the processor.
+type waker struct {
+	logger *asynqLogger
+	rdb    wakeStore
+
+	// names of the queues to wake up for.
+	queues map[string]bool
+
+	// wakeups has a value when a task was enqueued since the last wait.
+	wakeups chan struct{}
+
+	// mu guards active.
+	mu sync.Mutex
+
+	// active is true while the waker is subscribed to the wakeups.
+	active bool
+
+	// channel to communicate back to the long running "waker" goroutine.
+	done chan struct{}
+}
+
+func newWaker(logger *asynqLogger, r wakeStore, queues map[string]int, enabled bool) *waker {
+	if r == nil || !enabled {
+		return nil
+	}
+	w := &waker{
+		logger:  logger,
+		rdb:     r,
+		queues:  make(map[string]bool),
+		wakeups: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	for qname := range queues {
+		w.queues[qname] = true
+	}
+	return w
+}
+
+func (w *waker) terminate() {
+	if w == nil {
+		return
+	}
+	w.logger.debug("Waker shutting down...")
+	// Signal the waker goroutine to stop.
+	w.done <- struct{}{}
+}
+
+func (w *waker) start(wg *sync.WaitGroup) {
+	if w == nil {
+		return
+	}
+	pubsub, err := w.rdb.WakePubSub()
+	if err != nil {
+		w.logger.error("cannot subscribe to wake channel: %v", err)
+		return
+	}
+	w.mu.Lock()
+	w.active = true
+	w.mu.Unlock()
+	wakeCh := pubsub.Channel()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-w.done:
+				w.mu.Lock()
+				w.active = false
+				w.mu.Unlock()
+				pubsub.Close()
+				w.logger.debug("Waker done")
+				return
+			case m := <-wakeCh:
+				if w.queues[m.Payload] {
+					w.wake()
+				}
+			}
+		}
+	}()
+}
+
+// wake wakes up the processor waiting, or the next one to wait.
+func (w *waker) wake() {
+	select {
+	case w.wakeups <- struct{}{}:
+	default:
+		// a wakeup is already pending.
+	}
+}
+
+// wait blocks until a task is enqueued to one of the queues, the timeout
+// elapses, or abort is closed, and reports whether it was woken up by a
+// wakeup. ok is false, without waiting, if the waker is not subscribed to
+// the wakeups.
+func (w *waker) wait(timeout time.Duration, abort <-chan struct{}) (woken, ok bool) {
+	if w == nil {
+		return false, false
+	}
+	w.mu.Lock()
+	active := w.active
+	w.mu.Unlock()
+	if !active {
+		return false, false
+	}
+	select {
+	case <-w.wakeups:
+		return true, true
+	case <-abort:
+	case <-time.After(timeout):
+	}
+	return false, true
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/go-cmp/cmp"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// wakeBroker cannot subscribe to the wakeups, and records the dequeues.
+// Calling other methods panics.
+type wakeBroker struct {
+	earlyAckBroker
+}
+
+func (b *wakeBroker) WakePubSub() (*redis.PubSub, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (b *wakeBroker) Dequeue(qnames ...string) (*base.TaskMessage, error) {
+	b.record("dequeue " + qnames[0])
+	return nil, base.ErrNoProcessableTask
+}
+
+func TestNewWaker(t *testing.T) {
+	b := &wakeBroker{}
+	if w := newWaker(testLogger, b, defaultQueueConfig, false); w != nil {
+		t.Errorf("newWaker with wakeups disabled = %v, want nil", w)
+	}
+	if w := newWaker(testLogger, nil, defaultQueueConfig, true); w != nil {
+		t.Errorf("newWaker with broker which cannot relay wakeups = %v, want nil", w)
+	}
+	// A nil waker never waits.
+	var nop *waker
+	if _, ok := nop.wait(time.Second, nil); ok {
+		t.Errorf("nil waker waited")
+	}
+}
+
+func TestWakerWait(t *testing.T) {
+	w := newWaker(testLogger, &wakeBroker{}, map[string]int{"default": 1, "low": 1}, true)
+	if _, ok := w.wait(time.Second, nil); ok {
+		t.Errorf("waker waited before subscribing to the wakeups")
+	}
+	w.active = true
+
+	start := time.Now()
+	if woken, ok := w.wait(50*time.Millisecond, nil); woken || !ok {
+		t.Errorf("waker.wait() = %t, %t without a wakeup, want false, true", woken, ok)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("waker waited %v without a wakeup, want 50ms", elapsed)
+	}
+
+	// wakeups published before the wait are not missed.
+	w.wake()
+	w.wake()
+	start = time.Now()
+	if woken, _ := w.wait(time.Second, nil); !woken {
+		t.Errorf("waker was not woken up")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("waker waited %v after a wakeup, want no wait", elapsed)
+	}
+
+	abort := make(chan struct{})
+	close(abort)
+	start = time.Now()
+	w.wait(time.Second, abort)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("waker waited %v after abort, want no wait", elapsed)
+	}
+}
+
+func TestProcessorWaitForTasks(t *testing.T) {
+	b := &wakeBroker{}
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            b,
+		queues:         map[string]int{"default": 1, "low": 1},
+		concurrency:    1,
+		retryDelayFunc: defaultDelayFunc,
+		cancelations:   base.NewCancelations(),
+		waker:          newWaker(testLogger, b, map[string]int{"default": 1, "low": 1}, true),
+		maxIdleWait:    4 * time.Second,
+	})
+
+	// the waker is not subscribed; block on one of the queues.
+	if _, err := p.waitForTasks([]string{"default", "low"}); err != base.ErrNoProcessableTask {
+		t.Errorf("waitForTasks returned error %v, want %v", err, base.ErrNoProcessableTask)
+	}
+	b.mu.Lock()
+	want := []string{"dequeue default"}
+	if diff := cmp.Diff(want, b.events); diff != "" {
+		t.Errorf("broker received %v, want %v; (-want,+got)\n%s", b.events, want, diff)
+	}
+	b.mu.Unlock()
+
+	p.waker.active = true
+	p.waker.wake()
+	if _, err := p.waitForTasks([]string{"default", "low"}); err != base.ErrNoProcessableTask {
+		t.Errorf("waitForTasks returned error %v, want %v", err, base.ErrNoProcessableTask)
+	}
+	if p.idleWait != minIdleWait {
+		t.Errorf("processor woken up waits %v next, want %v", p.idleWait, minIdleWait)
+	}
+
+	// the wait backs off while the queues stay empty, and is reset by wakeups.
+	close(p.abort)
+	for _, want := range []time.Duration{2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		p.waitForTasks([]string{"low"})
+		if p.idleWait != want {
+			t.Errorf("processor waits %v next, want %v", p.idleWait, want)
+		}
+	}
+	p.abort = make(chan struct{})
+	p.waker.wake()
+	p.waitForTasks([]string{"low"})
+	if p.idleWait != minIdleWait {
+		t.Errorf("processor woken up waits %v next, want %v", p.idleWait, minIdleWait)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.events) != 1 {
+		t.Errorf("broker received %v while the processor waited for wakeups, want no dequeues", b.events)
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WarmPool specifies the resources preloaded by each worker slot of
+// the background (e.g. ML models or headless browsers), which are too
+// heavy to load for each task.
+//
+// The background has one slot per worker, up to Concurrency, and loads
+// all slots before it starts processing tasks. Each task is processed
+// with the resource of the slot it runs in, which the handler gets with
+// WorkerResource.
+type WarmPool struct {
+	// Init loads the resource of the given slot, numbered from zero.
+	//
+	// If Init returns a non-nil error, the slot is loaded again
+	// before processing its next task.
+	Init func(slot int) (interface{}, error)
+
+	// Close releases the resource loaded by Init.
+	//
+	// If nil, resources are not released.
+	Close func(slot int, resource interface{})
+
+	// MaxTasks specifies the number of tasks after which a slot is
+	// recycled, by closing and loading its resource again, to contain
+	// leaks in the resource.
+	//
+	// If zero or negative, slots are never recycled.
+	MaxTasks int
+}
+
+type workerResourceKey struct{}
+
+// WorkerResource returns the resource loaded by the WarmPool of the
+// background for the worker slot processing the task.
+//
+// ctx should be the context passed to the handler. WorkerResource returns
+// nil if the background has no WarmPool.
+func WorkerResource(ctx context.Context) interface{} {
+	return ctx.Value(workerResourceKey{})
+}
+
+// warmSlot is a worker slot of a warm pool.
+type warmSlot struct {
+	id int
+
+	resource interface{}
+
+	// loaded is true if the resource has been loaded.
+	loaded bool
+
+	// number of tasks processed since the resource was loaded.
+	tasks int
+}
+
+// withContext returns a copy of ctx which carries the resource of the slot
+// for WorkerResource.
+func (s *warmSlot) withContext(ctx context.Context) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, workerResourceKey{}, s.resource)
+}
+
+// warmPool manages the worker slots of the processor.
+//
+// A nil warmPool has no slots and is always ready.
+type warmPool struct {
+	logger *asynqLogger
+	cfg    WarmPool
+
+	// slots not in use by a worker.
+	slots chan *warmSlot
+
+	mu sync.Mutex
+
+	// ready is true once all slots have been loaded at startup.
+	ready bool
+}
+
+func newWarmPool(logger *asynqLogger, cfg *WarmPool, concurrency int) *warmPool {
+	if cfg == nil || cfg.Init == nil {
+		return nil
+	}
+	p := &warmPool{
+		logger: logger,
+		cfg:    *cfg,
+		slots:  make(chan *warmSlot, concurrency),
+	}
+	for i := 0; i < concurrency; i++ {
+		p.slots <- &warmSlot{id: i}
+	}
+	return p
+}
+
+// load loads all slots concurrently and blocks until they are loaded.
+// Slots which fail to load are loaded again when they are acquired.
+func (p *warmPool) load() {
+	if p == nil {
+		return
+	}
+	start := time.Now()
+	var slots []*warmSlot
+	for len(p.slots) > 0 {
+		slots = append(slots, <-p.slots)
+	}
+	var wg sync.WaitGroup
+	for _, s := range slots {
+		wg.Add(1)
+		go func(s *warmSlot) {
+			defer wg.Done()
+			if err := p.init(s); err != nil {
+				p.logger.error("Could not load worker slot %d: %v", s.id, err)
+			}
+		}(s)
+	}
+	wg.Wait()
+	loaded := 0
+	for _, s := range slots {
+		if s.loaded {
+			loaded++
+		}
+		p.slots <- s
+	}
+	p.mu.Lock()
+	p.ready = true
+	p.mu.Unlock()
+	p.logger.info("Loaded %d of %d worker slots in %v", loaded, len(slots), time.Since(start))
+}
+
+// isReady reports whether the slots have been loaded at startup.
+func (p *warmPool) isReady() bool {
+	if p == nil {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ready
+}
+
+// acquire takes a slot to process a task, loading it if necessary.
+//
+// The caller should hold a worker token, which guarantees a slot is
+// available. If the slot fails to load, it's put back and an error
+// is returned.
+func (p *warmPool) acquire() (*warmSlot, error) {
+	if p == nil {
+		return nil, nil
+	}
+	s := <-p.slots
+	if !s.loaded {
+		if err := p.init(s); err != nil {
+			p.slots <- s
+			return nil, fmt.Errorf("could not load worker slot %d: %v", s.id, err)
+		}
+	}
+	return s, nil
+}
+
+// release puts back the slot after its task is processed, recycling
+// the slot first if it has processed MaxTasks tasks.
+func (p *warmPool) release(s *warmSlot) {
+	if p == nil {
+		return
+	}
+	s.tasks++
+	if p.cfg.MaxTasks > 0 && s.tasks >= p.cfg.MaxTasks {
+		p.logger.debug("Recycling worker slot %d after %d tasks", s.id, s.tasks)
+		p.unload(s)
+		if err := p.init(s); err != nil {
+			p.logger.error("Could not reload worker slot %d: %v", s.id, err)
+		}
+	}
+	p.slots <- s
+}
+
+// close releases the resources of the slots not in use by a worker.
+func (p *warmPool) close() {
+	if p == nil {
+		return
+	}
+	for {
+		select {
+		case s := <-p.slots:
+			p.unload(s)
+		default:
+			return
+		}
+	}
+}
+
+func (p *warmPool) init(s *warmSlot) error {
+	res, err := p.cfg.Init(s.id)
+	if err != nil {
+		return err
+	}
+	s.resource = res
+	s.loaded = true
+	s.tasks = 0
+	return nil
+}
+
+func (p *warmPool) unload(s *warmSlot) {
+	if s.loaded && p.cfg.Close != nil {
+		p.cfg.Close(s.id, s.resource)
+	}
+	s.resource = nil
+	s.loaded = false
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// fakeResources records the loads and closes of the resources of a warm pool.
+type fakeResources struct {
+	mu     sync.Mutex
+	loads  int
+	closed []int
+	// fail is the number of loads to fail.
+	fail int
+}
+
+func (r *fakeResources) init(slot int) (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fail > 0 {
+		r.fail--
+		return nil, errors.New("out of memory")
+	}
+	r.loads++
+	return r.loads, nil
+}
+
+func (r *fakeResources) close(slot int, resource interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = append(r.closed, resource.(int))
+}
+
+func TestWarmPool(t *testing.T) {
+	res := &fakeResources{}
+	p := newWarmPool(testLogger, &WarmPool{Init: res.init, Close: res.close, MaxTasks: 2}, 3)
+	if p.isReady() {
+		t.Errorf("warm pool is ready before loading slots")
+	}
+	p.load()
+	if !p.isReady() {
+		t.Errorf("warm pool is not ready after loading slots")
+	}
+	if res.loads != 3 {
+		t.Errorf("loaded %d resources at startup, want 3", res.loads)
+	}
+
+	// Take all slots and process two tasks with each of them.
+	for i := 0; i < 2; i++ {
+		var slots []*warmSlot
+		for j := 0; j < 3; j++ {
+			s, err := p.acquire()
+			if err != nil {
+				t.Fatalf("acquire returned error: %v", err)
+			}
+			ctx := s.withContext(context.Background())
+			if got := WorkerResource(ctx); got != s.resource {
+				t.Errorf("WorkerResource(ctx) = %v, want %v", got, s.resource)
+			}
+			slots = append(slots, s)
+		}
+		for _, s := range slots {
+			p.release(s)
+		}
+	}
+
+	// Each slot should have been recycled once.
+	if res.loads != 6 {
+		t.Errorf("loaded %d resources, want 6", res.loads)
+	}
+	p.close()
+	sort.Ints(res.closed)
+	want := []int{1, 2, 3, 4, 5, 6}
+	if diff := cmp.Diff(want, res.closed); diff != "" {
+		t.Errorf("closed resources %v, want %v; (-want,+got)\n%s", res.closed, want, diff)
+	}
+}
+
+func TestWarmPoolLoadFailure(t *testing.T) {
+	res := &fakeResources{fail: 2}
+	p := newWarmPool(testLogger, &WarmPool{Init: res.init}, 1)
+	p.load() // first load fails.
+	if !p.isReady() {
+		t.Errorf("warm pool is not ready after loading slots")
+	}
+
+	if _, err := p.acquire(); err == nil {
+		t.Errorf("acquire succeeded while the slot fails to load, want error")
+	}
+	s, err := p.acquire()
+	if err != nil {
+		t.Fatalf("acquire returned error: %v", err)
+	}
+	if s.resource != 1 {
+		t.Errorf("slot has resource %v, want 1", s.resource)
+	}
+	p.release(s)
+}
+
+func TestNilWarmPool(t *testing.T) {
+	p := newWarmPool(testLogger, nil, 10)
+	if p != nil {
+		t.Fatalf("newWarmPool(testLogger, nil, 10) = %v, want nil", p)
+	}
+	p.load()
+	if !p.isReady() {
+		t.Errorf("nil warm pool is not ready")
+	}
+	s, err := p.acquire()
+	if err != nil {
+		t.Fatalf("acquire returned error: %v", err)
+	}
+	ctx := s.withContext(context.Background())
+	if got := WorkerResource(ctx); got != nil {
+		t.Errorf("WorkerResource(ctx) = %v, want nil", got)
+	}
+	p.release(s)
+	p.close()
+}
+
+func TestProcessorQuitReleasesWarmSlot(t *testing.T) {
+	res := &fakeResources{}
+	workerCh := make(chan int)
+	go fakeHeartbeater(workerCh)
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            &ackBroker{},
+		queues:         defaultQueueConfig,
+		concurrency:    1,
+		retryDelayFunc: defaultDelayFunc,
+		workerCh:       workerCh,
+		cancelations:   base.NewCancelations(),
+		warmPool:       &WarmPool{Init: res.init, Close: res.close},
+	})
+	p.pool.load()
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	defer close(unblock)
+	p.handler = HandlerFunc(func(ctx context.Context, task *Task) error {
+		close(started)
+		<-unblock // ignores the cancelation
+		return nil
+	})
+
+	p.dispatch(h.NewTaskMessage("render", nil))
+	<-started
+	close(p.quit)
+	deadline := time.Now().Add(time.Second)
+	for p.activeWorkers() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(p.pool.slots); n != 1 {
+		t.Errorf("warm pool has %d free slots after the worker quit, want 1", n)
+	}
+}
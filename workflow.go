@@ -0,0 +1,204 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+)
+
+// ErrWorkflowNotFound indicates that a workflow specified by an ID does not
+// exist or has expired.
+var ErrWorkflowNotFound = rdb.ErrWorkflowNotFound
+
+// ErrDuplicateWorkflowStep indicates that a workflow already has a step
+// of the name.
+var ErrDuplicateWorkflowStep = rdb.ErrDuplicateWorkflowStep
+
+// WorkflowStep returns an option to enqueue the task as the named step of
+// the workflow with the given ID, which is released to its queue once all
+// the steps it depends on have been processed successfully.
+//
+// The steps it depends on must be enqueued before the step. If one of the
+// steps of the workflow is moved to the dead queue, the steps still waiting
+// are canceled and never processed.
+//
+// Package workflow declares the steps of a workflow as a DAG and enqueues
+// them in order, which is how most applications should use this option.
+func WorkflowStep(id, step string, dependsOn ...string) Option {
+	return workflowStepOption{id: id, step: step, dependsOn: dependsOn}
+}
+
+// workflowStore is implemented by brokers which can track the steps
+// of the workflows.
+type workflowStore interface {
+	EnqueueWorkflowStep(msg *base.TaskMessage, dependsOn []string) (string, error)
+	CompleteWorkflowStep(id, step string) error
+	FailWorkflowStep(id, step string) error
+	SetWorkflowStepResult(id, step string, result []byte) error
+	WorkflowStepResults(id, step string) (map[string][]byte, error)
+}
+
+// errWorkflowUnsupported is returned when a workflow step is enqueued with
+// a broker which cannot track the workflows.
+var errWorkflowUnsupported = errors.New("asynq: broker does not support workflows")
+
+// enqueueWorkflowStep adds the task to its workflow, and returns the info
+// of the task in the state of the step.
+func (c *Client) enqueueWorkflowStep(msg *base.TaskMessage, dependsOn []string, processAt time.Time) (*TaskInfo, error) {
+	ws, ok := c.rdb.(workflowStore)
+	if !ok {
+		return nil, errWorkflowUnsupported
+	}
+	if msg.WorkflowStep == "" {
+		return nil, fmt.Errorf("asynq: workflow step of task %q has no name", msg.Type)
+	}
+	t := now(c.clock)
+	if processAt.After(t) {
+		return nil, fmt.Errorf("asynq: workflow step %q cannot be scheduled", msg.WorkflowStep)
+	}
+	msg.ProcessAt = t.UnixNano()
+	state, err := ws.EnqueueWorkflowStep(msg, dependsOn)
+	if err != nil {
+		return nil, err
+	}
+	return newTaskInfo(msg, state, 0), nil
+}
+
+// completeStep marks the workflow step of the task as completed, which
+// releases the steps waiting for it.
+func (p *processor) completeStep(msg *base.TaskMessage) error {
+	if p.workflows == nil || msg.WorkflowID == "" {
+		return nil
+	}
+	return p.workflows.CompleteWorkflowStep(msg.WorkflowID, msg.WorkflowStep)
+}
+
+// failStep marks the workflow step of the task as failed, which cancels
+// the steps of the workflow still waiting.
+func (p *processor) failStep(msg *base.TaskMessage) error {
+	if p.workflows == nil || msg.WorkflowID == "" {
+		return nil
+	}
+	return p.workflows.FailWorkflowStep(msg.WorkflowID, msg.WorkflowStep)
+}
+
+// ErrNotWorkflowStep is returned by SetStepResult and StepResults if the
+// context doesn't belong to a workflow step processed by a background.
+var ErrNotWorkflowStep = errors.New("asynq: task is not a step of a workflow")
+
+type workflowStepKey struct{}
+
+// stepContext is the handle to the workflow step carried by the context
+// of the handler.
+type stepContext struct {
+	store workflowStore
+	id    string
+	step  string
+}
+
+// withWorkflowStep returns a copy of ctx which lets the handler of the
+// workflow step set and read the results of the steps.
+func (p *processor) withWorkflowStep(ctx context.Context, msg *base.TaskMessage) context.Context {
+	if p.workflows == nil || msg.WorkflowID == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, workflowStepKey{}, &stepContext{store: p.workflows, id: msg.WorkflowID, step: msg.WorkflowStep})
+}
+
+// SetStepResult stores the result of the workflow step being processed,
+// which the steps depending on it read with StepResults (e.g. the callback
+// of a chord aggregating the results of the tasks). Setting the result
+// again, e.g. on a retry, overwrites it.
+//
+// Results are stored in redis with the state of the workflow, so they
+// should be small; stream large results with CreateResult instead, and
+// set the location as the result of the step.
+//
+// ctx should be the context passed to the handler; SetStepResult returns
+// ErrNotWorkflowStep if ctx is not a context of a workflow step (steps
+// processed by BulkHandler are not supported).
+func SetStepResult(ctx context.Context, result []byte) error {
+	s, ok := ctx.Value(workflowStepKey{}).(*stepContext)
+	if !ok {
+		return ErrNotWorkflowStep
+	}
+	return s.store.SetWorkflowStepResult(s.id, s.step, result)
+}
+
+// StepResults returns the results set with SetStepResult by the steps the
+// workflow step being processed depends on, by step name. Steps which set
+// no result are mapped to nil.
+//
+// See SetStepResult for the contexts of the workflow steps.
+func StepResults(ctx context.Context) (map[string][]byte, error) {
+	s, ok := ctx.Value(workflowStepKey{}).(*stepContext)
+	if !ok {
+		return nil, ErrNotWorkflowStep
+	}
+	return s.store.WorkflowStepResults(s.id, s.step)
+}
+
+// WorkflowInfo describes the state of a workflow.
+type WorkflowInfo struct {
+	ID string
+
+	// State is "failed" if one of the steps has failed, "completed" if all
+	// the steps have completed, and "running" otherwise.
+	State string
+
+	// Steps of the workflow sorted by name.
+	Steps []*WorkflowStepInfo
+}
+
+// WorkflowStepInfo describes the state of a step of a workflow.
+type WorkflowStepInfo struct {
+	Name string
+
+	// TaskID and Type are the ID and the type of the task of the step.
+	TaskID string
+	Type   string
+
+	// State is one of "waiting", "enqueued", "completed", "failed",
+	// and "canceled". The task of an enqueued step may be in progress,
+	// scheduled for retry, or processed but not yet marked as completed.
+	State string
+
+	// Waiting is the number of steps a waiting step still waits for.
+	Waiting int
+}
+
+// Workflow returns the state of the workflow with the given ID.
+//
+// The state is kept for 7 days since it last changed. If the workflow
+// doesn't exist or has expired, it returns ErrWorkflowNotFound.
+func (i *Inspector) Workflow(id string) (*WorkflowInfo, error) {
+	steps, err := i.rdb.Workflow(id)
+	if err != nil {
+		return nil, err
+	}
+	info := &WorkflowInfo{ID: id, State: "completed"}
+	for _, s := range steps {
+		info.Steps = append(info.Steps, &WorkflowStepInfo{
+			Name:    s.Name,
+			TaskID:  s.TaskID,
+			Type:    s.Type,
+			State:   s.State,
+			Waiting: s.Waiting,
+		})
+		switch {
+		case s.State == rdb.StepFailed:
+			info.State = "failed"
+		case s.State != rdb.StepCompleted && info.State != "failed":
+			info.State = "running"
+		}
+	}
+	return info, nil
+}
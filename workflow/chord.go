@@ -0,0 +1,69 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package workflow
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/hibiken/asynq"
+)
+
+// ChordCallback is the name of the callback step of a chord.
+const ChordCallback = "callback"
+
+// NewChord returns a workflow which processes the tasks in parallel, and
+// the callback once all of them have succeeded. The steps of the tasks are
+// named by their index ("0", "1", ...), and the callback step ChordCallback.
+//
+// The handlers of the tasks set their results with asynq.SetStepResult, and
+// the handler of the callback reads them with ChordResults:
+//
+//	func handleSum(ctx context.Context, task *asynq.Task) error {
+//	    results, err := workflow.ChordResults(ctx)
+//	    if err != nil {
+//	        return err
+//	    }
+//	    var sum int
+//	    for _, r := range results {
+//	        n, _ := strconv.Atoi(string(r))
+//	        sum += n
+//	    }
+//	    return save(sum)
+//	}
+//
+// The options are applied to all the tasks and the callback. If one of the
+// tasks is moved to the dead queue, the callback is canceled.
+func NewChord(id string, tasks []*asynq.Task, callback *asynq.Task, opts ...asynq.Option) *Workflow {
+	w := New(id)
+	deps := make([]string, len(tasks))
+	for i, t := range tasks {
+		deps[i] = strconv.Itoa(i)
+		w.Add(deps[i], t, nil, opts...)
+	}
+	return w.Add(ChordCallback, callback, deps, opts...)
+}
+
+// ChordResults returns the results of the tasks of the chord in the order
+// of the tasks, which the handler of the callback reads. Tasks which set no
+// result have nil results.
+//
+// ctx should be the context passed to the handler of the callback.
+func ChordResults(ctx context.Context) ([][]byte, error) {
+	results, err := asynq.StepResults(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := make([][]byte, len(results))
+	for step, r := range results {
+		i, err := strconv.Atoi(step)
+		if err != nil || i < 0 || i >= len(res) {
+			return nil, fmt.Errorf("workflow: step %q is not a task of a chord", step)
+		}
+		res[i] = r
+	}
+	return res, nil
+}
@@ -0,0 +1,185 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+// Package workflow declares workflows of tasks with dependencies between
+// them, which asynq runs as directed acyclic graphs.
+//
+// Each step of a workflow is a task, which is released to its queue once
+// all the steps it depends on have been processed successfully. The state
+// of the workflow is tracked in redis, so that the steps are released by
+// whichever background processed the last of their dependencies.
+//
+//	w := workflow.New("order:" + orderID)
+//	w.Add("reserve", asynq.NewTask("reserve_stock", payload), nil)
+//	w.Add("charge", asynq.NewTask("charge_card", payload), []string{"reserve"})
+//	w.Add("notify", asynq.NewTask("send_email", payload), []string{"reserve"}, asynq.Queue("low"))
+//	w.Add("ship", asynq.NewTask("ship_order", payload), []string{"charge", "notify"})
+//	if _, err := w.Enqueue(client); err != nil {
+//	    log.Fatal(err)
+//	}
+//
+// If a step is moved to the dead queue (e.g. its retries are exhausted),
+// the steps still waiting are canceled. The state of a workflow is read
+// with Inspector.Workflow.
+package workflow
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// Workflow is a directed acyclic graph of steps.
+//
+// A Workflow is not safe for concurrent use by multiple goroutines.
+type Workflow struct {
+	id     string
+	steps  []*Step
+	byName map[string]*Step
+}
+
+// Step is a task of a workflow.
+type Step struct {
+	// Name identifies the step in the workflow.
+	Name string
+
+	// Task is the task to enqueue once the steps it depends on
+	// have completed.
+	Task *asynq.Task
+
+	// DependsOn lists the names of the steps to complete before the step.
+	DependsOn []string
+
+	// Options are the options to enqueue the task with.
+	Options []asynq.Option
+}
+
+// New returns an empty workflow with the given ID. IDs should be unique
+// among the workflows of the last 7 days (e.g. "order:<order id>").
+func New(id string) *Workflow {
+	return &Workflow{id: id, byName: make(map[string]*Step)}
+}
+
+// ID returns the ID of the workflow.
+func (w *Workflow) ID() string {
+	return w.id
+}
+
+// Add adds a step which runs the task once the steps it depends on have
+// completed, and returns the workflow so that calls can be chained.
+//
+// Steps are validated by Validate and Enqueue, so they may be added
+// in any order.
+func (w *Workflow) Add(name string, task *asynq.Task, dependsOn []string, opts ...asynq.Option) *Workflow {
+	s := &Step{Name: name, Task: task, DependsOn: dependsOn, Options: opts}
+	w.steps = append(w.steps, s)
+	if _, ok := w.byName[name]; !ok {
+		w.byName[name] = s
+	}
+	return w
+}
+
+// Steps returns the steps of the workflow in the order they were added.
+func (w *Workflow) Steps() []*Step {
+	return append([]*Step(nil), w.steps...)
+}
+
+// Validate reports an error if the workflow has no steps, a step without
+// a name or a task, duplicate steps, or dependencies on unknown steps,
+// or if the dependencies form a cycle.
+func (w *Workflow) Validate() error {
+	_, err := w.order()
+	return err
+}
+
+// order returns the steps sorted so that each step comes after the steps
+// it depends on. Independent steps are kept in the order they were added.
+func (w *Workflow) order() ([]*Step, error) {
+	if w.id == "" {
+		return nil, fmt.Errorf("workflow: workflow has no ID")
+	}
+	if len(w.steps) == 0 {
+		return nil, fmt.Errorf("workflow: workflow %q has no steps", w.id)
+	}
+	waiting := make(map[string]int)      // name -> number of dependencies not yet sorted
+	children := make(map[string][]*Step) // name -> steps depending on it
+	for _, s := range w.steps {
+		if s.Name == "" {
+			return nil, fmt.Errorf("workflow: workflow %q has a step without name", w.id)
+		}
+		if s.Task == nil {
+			return nil, fmt.Errorf("workflow: step %q has no task", s.Name)
+		}
+		if w.byName[s.Name] != s {
+			return nil, fmt.Errorf("workflow: workflow %q has duplicate steps %q", w.id, s.Name)
+		}
+		seen := make(map[string]bool)
+		for _, dep := range s.DependsOn {
+			if _, ok := w.byName[dep]; !ok {
+				return nil, fmt.Errorf("workflow: step %q depends on unknown step %q", s.Name, dep)
+			}
+			if seen[dep] {
+				continue
+			}
+			seen[dep] = true
+			waiting[s.Name]++
+			children[dep] = append(children[dep], s)
+		}
+	}
+	var res []*Step
+	var ready []*Step
+	for _, s := range w.steps {
+		if waiting[s.Name] == 0 {
+			ready = append(ready, s)
+		}
+	}
+	for len(ready) > 0 {
+		s := ready[0]
+		ready = ready[1:]
+		res = append(res, s)
+		for _, c := range children[s.Name] {
+			waiting[c.Name]--
+			if waiting[c.Name] == 0 {
+				ready = append(ready, c)
+			}
+		}
+	}
+	if len(res) < len(w.steps) {
+		for _, s := range w.steps {
+			if waiting[s.Name] > 0 {
+				return nil, fmt.Errorf("workflow: step %q is part of a dependency cycle", s.Name)
+			}
+		}
+	}
+	return res, nil
+}
+
+// Enqueue validates the workflow and enqueues its steps, and returns the
+// info of the tasks by step name. Steps which don't depend on other steps
+// are enqueued to their queues right away; the others wait in redis until
+// the steps they depend on complete.
+//
+// If Enqueue returns an error, some of the steps may have been enqueued;
+// Enqueue can be called again to enqueue the rest, as steps which already
+// exist in the workflow are skipped and not included in the result.
+func (w *Workflow) Enqueue(c *asynq.Client) (map[string]*asynq.TaskInfo, error) {
+	steps, err := w.order()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]*asynq.TaskInfo)
+	for _, s := range steps {
+		opts := append(append([]asynq.Option(nil), s.Options...), asynq.WorkflowStep(w.id, s.Name, s.DependsOn...))
+		info, err := c.Schedule(s.Task, time.Now(), opts...)
+		if err == asynq.ErrDuplicateWorkflowStep {
+			continue
+		}
+		if err != nil {
+			return res, fmt.Errorf("workflow: could not enqueue step %q: %v", s.Name, err)
+		}
+		res[s.Name] = info
+	}
+	return res, nil
+}
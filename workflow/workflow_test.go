@@ -0,0 +1,90 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package workflow
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hibiken/asynq"
+)
+
+func stepNames(steps []*Step) []string {
+	var res []string
+	for _, s := range steps {
+		res = append(res, s.Name)
+	}
+	return res
+}
+
+func TestOrder(t *testing.T) {
+	task := asynq.NewTask("noop", nil)
+	w := New("order:1234").
+		Add("ship", task, []string{"charge", "notify"}).
+		Add("notify", task, []string{"reserve"}).
+		Add("charge", task, []string{"reserve", "reserve"}).
+		Add("reserve", task, nil).
+		Add("audit", task, nil)
+
+	steps, err := w.order()
+	if err != nil {
+		t.Fatalf("order returned error: %v", err)
+	}
+	want := []string{"reserve", "audit", "notify", "charge", "ship"}
+	if diff := cmp.Diff(want, stepNames(steps)); diff != "" {
+		t.Errorf("order = %v, want %v; (-want,+got)\n%s", stepNames(steps), want, diff)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	task := asynq.NewTask("noop", nil)
+	tests := []struct {
+		desc string
+		w    *Workflow
+		want string // substring of the error, empty if valid
+	}{
+		{"valid", New("a").Add("x", task, nil).Add("y", task, []string{"x"}), ""},
+		{"no id", New("").Add("x", task, nil), "no ID"},
+		{"no steps", New("a"), "no steps"},
+		{"no name", New("a").Add("", task, nil), "without name"},
+		{"no task", New("a").Add("x", nil, nil), "no task"},
+		{"duplicate", New("a").Add("x", task, nil).Add("x", task, nil), "duplicate"},
+		{"unknown dependency", New("a").Add("x", task, []string{"y"}), "unknown step"},
+		{"self dependency", New("a").Add("x", task, []string{"x"}), "cycle"},
+		{"cycle", New("a").Add("x", task, nil).Add("y", task, []string{"x", "z"}).Add("z", task, []string{"y"}), "cycle"},
+	}
+
+	for _, tc := range tests {
+		err := tc.w.Validate()
+		switch {
+		case tc.want == "" && err != nil:
+			t.Errorf("%s: Validate returned error: %v", tc.desc, err)
+		case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+			t.Errorf("%s: Validate returned error %v, want error containing %q", tc.desc, err, tc.want)
+		}
+	}
+}
+
+func TestNewChord(t *testing.T) {
+	tasks := []*asynq.Task{asynq.NewTask("count", nil), asynq.NewTask("count", nil)}
+	w := NewChord("sum:1234", tasks, asynq.NewTask("sum", nil), asynq.Queue("low"))
+
+	steps, err := w.order()
+	if err != nil {
+		t.Fatalf("order returned error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"0", "1", ChordCallback}, stepNames(steps)); diff != "" {
+		t.Errorf("chord has steps %v; (-want,+got)\n%s", stepNames(steps), diff)
+	}
+	if diff := cmp.Diff([]string{"0", "1"}, steps[2].DependsOn); diff != "" {
+		t.Errorf("callback depends on %v; (-want,+got)\n%s", steps[2].DependsOn, diff)
+	}
+	for _, s := range steps {
+		if len(s.Options) != 1 {
+			t.Errorf("step %q has %d options, want 1", s.Name, len(s.Options))
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// workflowBroker records the events of the workflow steps.
+type workflowBroker struct {
+	earlyAckBroker
+
+	dependsOn []string
+	results   map[string][]byte
+}
+
+func (b *workflowBroker) EnqueueWorkflowStep(msg *base.TaskMessage, dependsOn []string) (string, error) {
+	b.record("enqueue " + msg.WorkflowID + ":" + msg.WorkflowStep)
+	b.dependsOn = dependsOn
+	return "waiting", nil
+}
+
+func (b *workflowBroker) CompleteWorkflowStep(id, step string) error {
+	b.record("complete " + id + ":" + step)
+	return nil
+}
+
+func (b *workflowBroker) FailWorkflowStep(id, step string) error {
+	b.record("fail " + id + ":" + step)
+	return nil
+}
+
+func (b *workflowBroker) SetWorkflowStepResult(id, step string, result []byte) error {
+	b.record("result " + id + ":" + step + "=" + string(result))
+	return nil
+}
+
+func (b *workflowBroker) WorkflowStepResults(id, step string) (map[string][]byte, error) {
+	return b.results, nil
+}
+
+func TestProcessorWorkflowSteps(t *testing.T) {
+	tests := []struct {
+		desc       string
+		workflowID string
+		handlerErr error
+		want       []string
+	}{
+		{"completed", "order:1234", nil, []string{"complete order:1234:charge", "done"}},
+		{"failed", "order:1234", errors.New("card declined"), []string{"fail order:1234:charge", "kill"}},
+		{"not in workflow", "", nil, []string{"done"}},
+	}
+
+	for _, tc := range tests {
+		b := &workflowBroker{}
+		workerCh := make(chan int)
+		go fakeHeartbeater(workerCh)
+		p := newProcessor(processorParams{
+			logger:         testLogger,
+			rdb:            b,
+			queues:         defaultQueueConfig,
+			concurrency:    1,
+			retryDelayFunc: defaultDelayFunc,
+			workerCh:       workerCh,
+			cancelations:   base.NewCancelations(),
+		})
+		p.handler = HandlerFunc(func(ctx context.Context, task *Task) error {
+			return tc.handlerErr
+		})
+		msg := h.NewTaskMessage("charge_card", nil)
+		msg.Retry = 0
+		msg.WorkflowID = tc.workflowID
+		msg.WorkflowStep = "charge"
+
+		p.dispatch(msg)
+		// wait for the worker to finish.
+		p.sema <- struct{}{}
+		<-p.sema
+
+		b.mu.Lock()
+		if diff := cmp.Diff(tc.want, b.events); diff != "" {
+			t.Errorf("%s: broker received %v, want %v; (-want,+got)\n%s", tc.desc, b.events, tc.want, diff)
+		}
+		b.mu.Unlock()
+		close(workerCh)
+	}
+}
+
+func TestClientWorkflowStep(t *testing.T) {
+	b := &workflowBroker{}
+	client := &Client{rdb: b}
+
+	info, err := client.Schedule(NewTask("ship_order", nil), time.Now(), WorkflowStep("order:1234", "ship", "charge", "notify"))
+	if err != nil {
+		t.Fatalf("Schedule returned error: %v", err)
+	}
+	if info.State != "waiting" {
+		t.Errorf("Schedule returned task in state %q, want %q", info.State, "waiting")
+	}
+	if diff := cmp.Diff([]string{"enqueue order:1234:ship"}, b.events); diff != "" {
+		t.Errorf("broker received %v; (-want,+got)\n%s", b.events, diff)
+	}
+	if diff := cmp.Diff([]string{"charge", "notify"}, b.dependsOn); diff != "" {
+		t.Errorf("step depends on %v; (-want,+got)\n%s", b.dependsOn, diff)
+	}
+
+	if _, err := client.Schedule(NewTask("ship_order", nil), time.Now().Add(time.Hour), WorkflowStep("order:1234", "ship")); err == nil {
+		t.Errorf("Schedule of a workflow step in the future returned nil error")
+	}
+	if _, err := client.Schedule(NewTask("ship_order", nil), time.Now(), WorkflowStep("order:1234", "")); err == nil {
+		t.Errorf("Schedule of a workflow step without name returned nil error")
+	}
+
+	shared := &Client{rdb: sharedBroker{b}}
+	if _, err := shared.Schedule(NewTask("ship_order", nil), time.Now(), WorkflowStep("order:1234", "ship")); err != errWorkflowUnsupported {
+		t.Errorf("Schedule with a broker without workflows returned error %v, want %v", err, errWorkflowUnsupported)
+	}
+}
+
+func TestStepResults(t *testing.T) {
+	b := &workflowBroker{results: map[string][]byte{"0": []byte("20"), "1": []byte("22")}}
+	workerCh := make(chan int)
+	go fakeHeartbeater(workerCh)
+	defer close(workerCh)
+	p := newProcessor(processorParams{
+		logger:         testLogger,
+		rdb:            b,
+		queues:         defaultQueueConfig,
+		concurrency:    1,
+		retryDelayFunc: defaultDelayFunc,
+		workerCh:       workerCh,
+		cancelations:   base.NewCancelations(),
+	})
+	var got map[string][]byte
+	p.handler = HandlerFunc(func(ctx context.Context, task *Task) error {
+		var err error
+		if got, err = StepResults(ctx); err != nil {
+			return err
+		}
+		return SetStepResult(ctx, []byte("42"))
+	})
+	msg := h.NewTaskMessage("sum", nil)
+	msg.WorkflowID = "sum:1234"
+	msg.WorkflowStep = "callback"
+
+	p.dispatch(msg)
+	// wait for the worker to finish.
+	p.sema <- struct{}{}
+	<-p.sema
+
+	if diff := cmp.Diff(b.results, got); diff != "" {
+		t.Errorf("StepResults = %v, want %v; (-want,+got)\n%s", got, b.results, diff)
+	}
+	want := []string{"result sum:1234:callback=42", "complete sum:1234:callback", "done"}
+	b.mu.Lock()
+	if diff := cmp.Diff(want, b.events); diff != "" {
+		t.Errorf("broker received %v, want %v; (-want,+got)\n%s", b.events, want, diff)
+	}
+	b.mu.Unlock()
+
+	if err := SetStepResult(context.Background(), nil); err != ErrNotWorkflowStep {
+		t.Errorf("SetStepResult(context.Background()) returned error %v, want %v", err, ErrNotWorkflowStep)
+	}
+	if _, err := StepResults(context.Background()); err != ErrNotWorkflowStep {
+		t.Errorf("StepResults(context.Background()) returned error %v, want %v", err, ErrNotWorkflowStep)
+	}
+}
@@ -0,0 +1,11 @@
+module github.com/hibiken/asynq/x
+
+go 1.13
+
+require (
+	github.com/go-redis/redis/v7 v7.0.0-beta.4
+	github.com/hibiken/asynq v0.4.0
+	github.com/prometheus/client_golang v1.7.1
+)
+
+replace github.com/hibiken/asynq => ./..
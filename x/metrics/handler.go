@@ -0,0 +1,94 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HandlerMetrics counts and times the tasks processed by the handlers
+// it instruments, and exports them as Prometheus metrics.
+//
+// HandlerMetrics is a prometheus.Collector and should be registered
+// to be exported.
+type HandlerMetrics struct {
+	processed  *prometheus.CounterVec
+	failed     *prometheus.CounterVec
+	inProgress *prometheus.GaugeVec
+	duration   *prometheus.HistogramVec
+}
+
+// NewHandlerMetrics returns a new HandlerMetrics with the default
+// histogram buckets for task processing durations.
+func NewHandlerMetrics() *HandlerMetrics {
+	return NewHandlerMetricsWithBuckets(prometheus.DefBuckets)
+}
+
+// NewHandlerMetricsWithBuckets returns a new HandlerMetrics with the given
+// histogram buckets, in seconds, for task processing durations.
+func NewHandlerMetricsWithBuckets(buckets []float64) *HandlerMetrics {
+	return &HandlerMetrics{
+		processed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "handler_processed_total",
+			Help:      "Number of tasks processed by the handler, including failed ones.",
+		}, []string{"task_type"}),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "handler_failed_total",
+			Help:      "Number of tasks for which the handler returned an error.",
+		}, []string{"task_type"}),
+		inProgress: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "handler_in_progress",
+			Help:      "Number of tasks being processed by the handler.",
+		}, []string{"task_type"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "handler_duration_seconds",
+			Help:      "Time taken by the handler to process a task.",
+			Buckets:   buckets,
+		}, []string{"task_type"}),
+	}
+}
+
+// Instrument returns a Handler which calls h and records the metrics
+// of each task processed.
+func (m *HandlerMetrics) Instrument(h asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+		inProgress := m.inProgress.WithLabelValues(task.Type)
+		inProgress.Inc()
+		defer inProgress.Dec()
+
+		start := time.Now()
+		err := h.ProcessTask(ctx, task)
+		m.duration.WithLabelValues(task.Type).Observe(time.Since(start).Seconds())
+		m.processed.WithLabelValues(task.Type).Inc()
+		if err != nil {
+			m.failed.WithLabelValues(task.Type).Inc()
+		}
+		return err
+	})
+}
+
+// Describe implements prometheus.Collector.
+func (m *HandlerMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.processed.Describe(ch)
+	m.failed.Describe(ch)
+	m.inProgress.Describe(ch)
+	m.duration.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *HandlerMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.processed.Collect(ch)
+	m.failed.Collect(ch)
+	m.inProgress.Collect(ch)
+	m.duration.Collect(ch)
+}
@@ -0,0 +1,60 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHandlerMetrics(t *testing.T) {
+	m := NewHandlerMetrics()
+	var inProgress float64
+	h := m.Instrument(asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+		inProgress = testutil.ToFloat64(m.inProgress.WithLabelValues(task.Type))
+		if task.Type == "fail" {
+			return errors.New("failed")
+		}
+		return nil
+	}))
+
+	for _, typename := range []string{"send_email", "send_email", "fail"} {
+		h.ProcessTask(context.Background(), asynq.NewTask(typename, nil))
+	}
+
+	tests := []struct {
+		desc string
+		got  float64
+		want float64
+	}{
+		{"processed send_email", testutil.ToFloat64(m.processed.WithLabelValues("send_email")), 2},
+		{"failed send_email", testutil.ToFloat64(m.failed.WithLabelValues("send_email")), 0},
+		{"processed fail", testutil.ToFloat64(m.processed.WithLabelValues("fail")), 1},
+		{"failed fail", testutil.ToFloat64(m.failed.WithLabelValues("fail")), 1},
+		{"in progress while processing", inProgress, 1},
+		{"in progress after processing", testutil.ToFloat64(m.inProgress.WithLabelValues("send_email")), 0},
+	}
+	for _, tc := range tests {
+		if tc.got != tc.want {
+			t.Errorf("%s = %v, want %v", tc.desc, tc.got, tc.want)
+		}
+	}
+	// processed and failed counters, in-progress gauges, and duration
+	// histograms of the two types.
+	if n := testutil.CollectAndCount(m); n != 8 {
+		t.Errorf("HandlerMetrics collected %d metrics, want 8", n)
+	}
+	problems, err := testutil.CollectAndLint(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("metric %s: %s", p.Metric, p.Text)
+	}
+}
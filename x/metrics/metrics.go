@@ -0,0 +1,184 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+// Package metrics exports asynq metrics as Prometheus collectors.
+//
+// QueueMetricsCollector reads the state of the queues from redis on each
+// scrape, and HandlerMetrics instruments a Handler to count and time the
+// tasks processed by the background worker process it runs in.
+//
+// Example:
+//
+//	inspector := asynq.NewInspector(redisConnOpt, nil)
+//	handlerMetrics := metrics.NewHandlerMetrics()
+//	reg := prometheus.NewRegistry()
+//	reg.MustRegister(
+//	    metrics.NewQueueMetricsCollector(inspector),
+//	    handlerMetrics,
+//	)
+//	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+//	go http.ListenAndServe(":2112", nil)
+//
+//	bg := asynq.NewBackground(redisConnOpt, &asynq.Config{Concurrency: 10})
+//	bg.Run(handlerMetrics.Instrument(handler))
+//
+// Only one of the processes sharing a redis instance needs to export queue
+// metrics, while every background worker process should export its handler
+// metrics.
+package metrics
+
+import (
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Namespace used in fully-qualified metrics names.
+const namespace = "asynq"
+
+// QueueMetricsCollector gathers the state of the queues from redis
+// and exports them as Prometheus metrics.
+type QueueMetricsCollector struct {
+	inspector *asynq.Inspector
+}
+
+// NewQueueMetricsCollector returns a collector which exports metrics
+// about the queues using the inspector.
+func NewQueueMetricsCollector(inspector *asynq.Inspector) *QueueMetricsCollector {
+	return &QueueMetricsCollector{inspector: inspector}
+}
+
+// Descriptors used by QueueMetricsCollector.
+var (
+	queueSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "queue_size"),
+		"Number of tasks enqueued in a queue.",
+		[]string{"queue"}, nil,
+	)
+
+	tasksDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tasks"),
+		"Number of tasks in each state.",
+		[]string{"state"}, nil,
+	)
+
+	inProgressDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tasks_in_progress"),
+		"Number of tasks currently being processed.",
+		nil, nil,
+	)
+
+	processedTodayDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "processed_today"),
+		"Number of tasks processed today (UTC).",
+		nil, nil,
+	)
+
+	failedTodayDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "failed_today"),
+		"Number of tasks failed today (UTC).",
+		nil, nil,
+	)
+
+	costTodayDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cost_today"),
+		"Amount of a resource consumed by the tasks of a type today (UTC), as reported with asynq.AddCost.",
+		[]string{"type", "resource"}, nil,
+	)
+
+	dimensionCostTodayDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "dimension_cost_today"),
+		"Amount of a resource consumed by the tasks with a value of a rollup dimension today (UTC), as reported with asynq.AddCost.",
+		[]string{"dimension", "value", "resource"}, nil,
+	)
+
+	canaryHealthyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "canary_healthy"),
+		"1 if the canary task has been completed recently, 0 otherwise.",
+		nil, nil,
+	)
+
+	canaryLastCompletedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "canary_last_completed_timestamp_seconds"),
+		"Unix time the canary task was last completed.",
+		nil, nil,
+	)
+
+	scrapeErrorDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "scrape_error"),
+		"1 if reading the state of the queues from redis failed, 0 otherwise.",
+		nil, nil,
+	)
+)
+
+// Describe implements prometheus.Collector.
+func (c *QueueMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueSizeDesc
+	ch <- tasksDesc
+	ch <- inProgressDesc
+	ch <- processedTodayDesc
+	ch <- failedTodayDesc
+	ch <- costTodayDesc
+	ch <- dimensionCostTodayDesc
+	ch <- canaryHealthyDesc
+	ch <- canaryLastCompletedDesc
+	ch <- scrapeErrorDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *QueueMetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, err := c.inspector.CurrentStats()
+	var costs []*asynq.DailyCosts
+	if err == nil {
+		costs, err = c.inspector.Costs(1)
+	}
+	var canary *asynq.CanaryStatus
+	if err == nil {
+		canary, err = c.inspector.Canary()
+	}
+	if err != nil {
+		ch <- prometheus.MustNewConstMetric(scrapeErrorDesc, prometheus.GaugeValue, 1)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(scrapeErrorDesc, prometheus.GaugeValue, 0)
+	for qname, n := range stats.Queues {
+		ch <- prometheus.MustNewConstMetric(queueSizeDesc, prometheus.GaugeValue, float64(n), qname)
+	}
+	states := map[string]int{
+		"enqueued":   stats.Enqueued,
+		"inprogress": stats.InProgress,
+		"scheduled":  stats.Scheduled,
+		"retry":      stats.Retry,
+		"dead":       stats.Dead,
+	}
+	for state, n := range states {
+		ch <- prometheus.MustNewConstMetric(tasksDesc, prometheus.GaugeValue, float64(n), state)
+	}
+	ch <- prometheus.MustNewConstMetric(inProgressDesc, prometheus.GaugeValue, float64(stats.InProgress))
+	ch <- prometheus.MustNewConstMetric(processedTodayDesc, prometheus.GaugeValue, float64(stats.Processed))
+	ch <- prometheus.MustNewConstMetric(failedTodayDesc, prometheus.GaugeValue, float64(stats.Failed))
+	for _, day := range costs {
+		for typename, amounts := range day.ByType {
+			for resource, amount := range amounts {
+				ch <- prometheus.MustNewConstMetric(costTodayDesc, prometheus.GaugeValue, amount, typename, resource)
+			}
+		}
+		for dim, vals := range day.ByDimension {
+			for val, amounts := range vals {
+				for resource, amount := range amounts {
+					ch <- prometheus.MustNewConstMetric(dimensionCostTodayDesc, prometheus.GaugeValue, amount, dim, val, resource)
+				}
+			}
+		}
+	}
+	if canary != nil {
+		healthy := 0.0
+		if canary.Healthy {
+			healthy = 1
+		}
+		ch <- prometheus.MustNewConstMetric(canaryHealthyDesc, prometheus.GaugeValue, healthy)
+		if !canary.LastCompleted.IsZero() {
+			ch <- prometheus.MustNewConstMetric(canaryLastCompletedDesc, prometheus.GaugeValue, float64(canary.LastCompleted.Unix()))
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// variables used for package testing.
+const (
+	redisAddr = "localhost:6379"
+	redisDB   = 14
+)
+
+func TestQueueMetricsCollector(t *testing.T) {
+	r := redis.NewClient(&redis.Options{Addr: redisAddr, DB: redisDB})
+	if err := r.FlushDB().Err(); err != nil {
+		t.Fatal(err)
+	}
+	opt := asynq.RedisClientOpt{Addr: redisAddr, DB: redisDB}
+	client := asynq.NewClient(opt)
+	for _, s := range []struct {
+		processAt time.Time
+		opts      []asynq.Option
+	}{
+		{time.Now(), nil},
+		{time.Now(), []asynq.Option{asynq.Queue("critical")}},
+		{time.Now(), []asynq.Option{asynq.Queue("critical")}},
+		{time.Now().Add(time.Hour), nil},
+	} {
+		if _, err := client.Schedule(asynq.NewTask("send_email", nil), s.processAt, s.opts...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := NewQueueMetricsCollector(asynq.NewInspector(opt, nil))
+	want := `
+# HELP asynq_queue_size Number of tasks enqueued in a queue.
+# TYPE asynq_queue_size gauge
+asynq_queue_size{queue="critical"} 2
+asynq_queue_size{queue="default"} 1
+# HELP asynq_scrape_error 1 if reading the state of the queues from redis failed, 0 otherwise.
+# TYPE asynq_scrape_error gauge
+asynq_scrape_error 0
+# HELP asynq_tasks Number of tasks in each state.
+# TYPE asynq_tasks gauge
+asynq_tasks{state="dead"} 0
+asynq_tasks{state="enqueued"} 3
+asynq_tasks{state="inprogress"} 0
+asynq_tasks{state="retry"} 0
+asynq_tasks{state="scheduled"} 1
+`
+	err := testutil.CollectAndCompare(c, strings.NewReader(want), "asynq_queue_size", "asynq_scrape_error", "asynq_tasks")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQueueMetricsCollectorScrapeError(t *testing.T) {
+	// nothing listens on the port, so that reading from redis fails.
+	c := NewQueueMetricsCollector(asynq.NewInspector(asynq.RedisClientOpt{Addr: "localhost:1"}, nil))
+	want := `
+# HELP asynq_scrape_error 1 if reading the state of the queues from redis failed, 0 otherwise.
+# TYPE asynq_scrape_error gauge
+asynq_scrape_error 1
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,358 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+// Package monitor provides an http.Handler exposing a JSON API to monitor
+// and administer asynq queues and tasks, which can be mounted in an
+// existing admin service.
+//
+// Example:
+//
+//	inspector := asynq.NewInspector(redisConnOpt, nil)
+//	http.Handle("/asynq/", http.StripPrefix("/asynq", monitor.NewHandler(inspector)))
+//
+// The handler serves the following endpoints:
+//
+//	GET    /stats                       current state of the queues
+//	GET    /snapshot                    state of the queues, processes, and rates
+//	GET    /queues                      queues with their sizes and weights
+//	PUT    /queues/{queue}/weight       sets the weight of the queue, body: {"Weight": 3}
+//	GET    /processes                   running background worker processes
+//	GET    /canary                      state of the canary task, with status 503 if unhealthy
+//	GET    /tasks?state=&queue=&page=&size=
+//	                                    page of the tasks in the state (default "enqueued"),
+//	                                    queue is used for enqueued tasks (default "default")
+//	GET    /tasks/{key}                 task specified by the key
+//	POST   /tasks/{key}/enqueue         enqueues the task to be processed immediately
+//	POST   /tasks/{key}/kill            kills the task
+//	DELETE /tasks/{key}                 deletes the task
+//	GET    /progress/{task id}          last progress reported by the handler of the task
+//
+// Errors are returned with an appropriate status code and a JSON body
+// of the form {"Error": "message"}.
+//
+// The handler performs no authentication; wrap it with the admin
+// service's authentication middleware.
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 1000
+)
+
+// handler serves the monitoring API.
+type handler struct {
+	inspector *asynq.Inspector
+}
+
+// NewHandler returns an http.Handler which serves the monitoring API
+// using the inspector.
+func NewHandler(inspector *asynq.Inspector) http.Handler {
+	return &handler{inspector: inspector}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "stats":
+		h.allow(w, r, http.MethodGet, h.getStats)
+	case len(parts) == 1 && parts[0] == "snapshot":
+		h.allow(w, r, http.MethodGet, h.getSnapshot)
+	case len(parts) == 1 && parts[0] == "queues":
+		h.allow(w, r, http.MethodGet, h.listQueues)
+	case len(parts) == 3 && parts[0] == "queues" && parts[2] == "weight":
+		h.allow(w, r, http.MethodPut, func(w http.ResponseWriter, r *http.Request) {
+			h.setQueueWeight(w, r, parts[1])
+		})
+	case len(parts) == 1 && parts[0] == "processes":
+		h.allow(w, r, http.MethodGet, h.listProcesses)
+	case len(parts) == 1 && parts[0] == "canary":
+		h.allow(w, r, http.MethodGet, h.getCanary)
+	case len(parts) == 1 && parts[0] == "tasks":
+		h.allow(w, r, http.MethodGet, h.listTasks)
+	case len(parts) == 2 && parts[0] == "tasks":
+		key := parts[1]
+		switch r.Method {
+		case http.MethodGet:
+			h.getTask(w, r, key)
+		case http.MethodDelete:
+			h.deleteTask(w, r, key)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		}
+	case len(parts) == 3 && parts[0] == "tasks" && parts[2] == "enqueue":
+		h.allow(w, r, http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+			h.taskAction(w, parts[1], h.inspector.EnqueueTask)
+		})
+	case len(parts) == 3 && parts[0] == "tasks" && parts[2] == "kill":
+		h.allow(w, r, http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+			h.taskAction(w, parts[1], h.inspector.KillTask)
+		})
+	case len(parts) == 2 && parts[0] == "progress":
+		h.allow(w, r, http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+			h.getProgress(w, r, parts[1])
+		})
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+	}
+}
+
+// allow calls fn if the request has the given method,
+// and responds with 405 Method Not Allowed otherwise.
+func (h *handler) allow(w http.ResponseWriter, r *http.Request, method string, fn http.HandlerFunc) {
+	if r.Method != method {
+		methodNotAllowed(w, method)
+		return
+	}
+	fn(w, r)
+}
+
+func (h *handler) getStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.inspector.CurrentStats()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (h *handler) getSnapshot(w http.ResponseWriter, r *http.Request) {
+	s, err := h.inspector.Snapshot()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+// queue is the JSON representation of a queue.
+type queue struct {
+	Name   string
+	Size   int
+	Weight *int `json:",omitempty"`
+}
+
+func (h *handler) listQueues(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.inspector.CurrentStats()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	weights, err := h.inspector.QueueWeights()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res := []*queue{}
+	for qname, n := range stats.Queues {
+		q := &queue{Name: qname, Size: n}
+		if w, ok := weights[qname]; ok {
+			q.Weight = &w
+		}
+		res = append(res, q)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (h *handler) setQueueWeight(w http.ResponseWriter, r *http.Request, qname string) {
+	var body struct {
+		Weight *int
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Weight == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf(`request body should be {"Weight": <int>}`))
+		return
+	}
+	if err := h.inspector.SetQueueWeight(qname, *body.Weight); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &queue{Name: qname, Weight: body.Weight})
+}
+
+func (h *handler) listProcesses(w http.ResponseWriter, r *http.Request) {
+	ps, err := h.inspector.ListProcesses()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if ps == nil {
+		ps = []*asynq.ProcessInfo{}
+	}
+	writeJSON(w, http.StatusOK, ps)
+}
+
+// getCanary responds with the state of the canary, so that the endpoint
+// can be used as a health check of the whole pipeline.
+func (h *handler) getCanary(w http.ResponseWriter, r *http.Request) {
+	c, err := h.inspector.Canary()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if c == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("canary has not been enqueued"))
+		return
+	}
+	status := http.StatusOK
+	if !c.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, c)
+}
+
+func (h *handler) listTasks(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	state := q.Get("state")
+	if state == "" {
+		state = "enqueued"
+	}
+	qname := q.Get("queue")
+	if qname == "" {
+		qname = "default"
+	}
+	page, err := intParam(q.Get("page"), 0)
+	if err != nil || page < 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("page should be a non-negative integer"))
+		return
+	}
+	size, err := intParam(q.Get("size"), defaultPageSize)
+	if err != nil || size < 1 || size > maxPageSize {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("size should be an integer between 1 and %d", maxPageSize))
+		return
+	}
+	tasks, err := h.inspector.ListTasks(state, qname, page, size)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	res := []*task{}
+	for _, t := range tasks {
+		res = append(res, newTask(t))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (h *handler) getTask(w http.ResponseWriter, r *http.Request, key string) {
+	h.taskAction(w, key, h.inspector.GetTaskInfo)
+}
+
+func (h *handler) deleteTask(w http.ResponseWriter, r *http.Request, key string) {
+	if err := h.inspector.DeleteTask(key); err != nil {
+		writeTaskError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) getProgress(w http.ResponseWriter, r *http.Request, id string) {
+	p, err := h.inspector.Progress(id)
+	if err == asynq.ErrProgressNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// taskAction calls fn with the task key and responds with the task returned.
+func (h *handler) taskAction(w http.ResponseWriter, key string, fn func(key string) (*asynq.TaskInfo, error)) {
+	info, err := fn(key)
+	if err != nil {
+		writeTaskError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newTask(info))
+}
+
+// task is the JSON representation of a task.
+type task struct {
+	ID            string
+	Key           string `json:",omitempty"`
+	Type          string
+	Payload       asynq.Payload
+	Queue         string
+	State         string
+	MaxRetry      int
+	Retried       int
+	Timeout       string             `json:",omitempty"`
+	CorrelationID string             `json:",omitempty"`
+	ErrorMsg      string             `json:",omitempty"`
+	ErrorHistory  []*asynq.TaskError `json:",omitempty"`
+	NextProcessAt *time.Time         `json:",omitempty"`
+}
+
+func newTask(info *asynq.TaskInfo) *task {
+	t := &task{
+		ID:            info.ID,
+		Key:           info.Key,
+		Type:          info.Type,
+		Payload:       info.Payload,
+		Queue:         info.Queue,
+		State:         info.State,
+		MaxRetry:      info.MaxRetry,
+		Retried:       info.Retried,
+		CorrelationID: info.CorrelationID,
+		ErrorMsg:      info.ErrorMsg,
+		ErrorHistory:  info.ErrorHistory,
+	}
+	if info.Timeout > 0 {
+		t.Timeout = info.Timeout.String()
+	}
+	if !info.NextProcessAt.IsZero() {
+		t.NextProcessAt = &info.NextProcessAt
+	}
+	return t
+}
+
+func intParam(s string, defaultVal int) (int, error) {
+	if s == "" {
+		return defaultVal, nil
+	}
+	return strconv.Atoi(s)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"Error": err.Error()})
+}
+
+// writeTaskError writes the error returned by an Inspector method
+// which takes a task key.
+func writeTaskError(w http.ResponseWriter, err error) {
+	switch {
+	case err == asynq.ErrTaskNotFound:
+		writeError(w, http.StatusNotFound, err)
+	case strings.HasPrefix(err.Error(), "invalid task key"):
+		writeError(w, http.StatusBadRequest, err)
+	case strings.HasPrefix(err.Error(), "cannot "):
+		writeError(w, http.StatusConflict, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+}